@@ -3,17 +3,34 @@ package main
 import (
 	"archive/zip"
 	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
+	"io"
+	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
+	"text/tabwriter"
 	"time"
 
 	"github.com/urfave/cli/v2"
 	"go.uber.org/zap"
 
+	"github.com/techninja8/getvault.io/internal/tmp"
 	"github.com/techninja8/getvault.io/pkg/config"
 	"github.com/techninja8/getvault.io/pkg/datastorage"
+	"github.com/techninja8/getvault.io/pkg/encryption"
+	"github.com/techninja8/getvault.io/pkg/metadata"
+	"github.com/techninja8/getvault.io/pkg/planning"
+	"github.com/techninja8/getvault.io/pkg/plumbing"
+	"github.com/techninja8/getvault.io/pkg/server"
 	"github.com/techninja8/getvault.io/pkg/sharding"
 )
 
@@ -21,202 +38,885 @@ func main() {
 	logger, _ := zap.NewProduction()
 	defer logger.Sync()
 
+	// --profile sets PROFILE for the configuration it is loaded into
+	if profile, ok := config.ProfileArg(os.Args[1:]); ok {
+		os.Setenv("PROFILE", profile)
+	}
 	cfg := config.LoadConfig()
-	store := sharding.NewInMemoryShardStore()
+	// New objects are coded with this code, so storage location
+	// configuration files list a location for each of its shards
+	code, err := datastorage.ConfiguredCode(cfg)
+	if err != nil {
+		logger.Fatal("Invalid erasure code configuration", zap.Error(err))
+	}
+	diskStore := sharding.NewInMemoryShardStore()
+	diskStore.Log = os.Stderr
+	diskStore.Headers = cfg.ShardHeaders
+	if cfg.ObfuscateShardPaths {
+		key, err := datastorage.GetShardPathKey(cfg)
+		if err != nil {
+			logger.Fatal("Failed to get shard path key", zap.Error(err))
+		}
+		diskStore.PathKey = key
+	}
+	health, err := sharding.LoadHealth(cfg.HealthFile)
+	if err != nil {
+		logger.Warn("Starting location health from scratch", zap.Error(err))
+		health = sharding.NewHealthTracker(cfg.HealthFile)
+	}
+	layers, err := datastorage.ShardStoreBuilder(cfg, health)
+	if err != nil {
+		logger.Fatal("Invalid shard store configuration", zap.Error(err))
+	}
+	store, err := layers.Build(diskStore)
+	if err != nil {
+		logger.Fatal("Invalid shard store configuration", zap.Error(err))
+	}
+	closeStore := func() {
+		if err := store.Close(); err != nil {
+			logger.Error("Failed to close shard store", zap.Error(err))
+		}
+	}
+
+	// Temporary files go in a workspace of this invocation's own, removed
+	// when it ends or is interrupted; what crashed invocations left behind
+	// is swept away first
+	tmpRoot := tmp.Root(cfg.TmpDir)
+	if swept, err := tmp.Sweep(tmpRoot, cfg.TmpMaxAge); err != nil {
+		logger.Warn("Failed to sweep temporary files", zap.Error(err))
+	} else if len(swept) > 0 {
+		logger.Info("Removed temporary files left by earlier runs", zap.Strings("paths", swept))
+	}
+	workspace, err := tmp.Open(tmpRoot)
+	if err != nil {
+		logger.Fatal("Failed to create temporary workspace", zap.Error(err))
+	}
+	stopRemoveOnSignal := workspace.RemoveOnSignal()
+	closeWorkspace := func() {
+		if err := workspace.Close(); err != nil {
+			logger.Error("Failed to remove temporary workspace", zap.Error(err))
+		}
+	}
+
+	// The token commands talk to a running server, or with --local edit
+	// the tokens of the metadata directory, which is how the first admin
+	// token is made
+	tokenFlags := func() []cli.Flag {
+		return []cli.Flag{
+			&cli.StringFlag{Name: "server", Usage: "URL of the vault server"},
+			&cli.StringFlag{Name: "token", Usage: "admin token sent to the server (default $SERVER_TOKEN)"},
+			&cli.BoolFlag{Name: "local", Usage: "edit the tokens in the metadata directory directly instead of through a server"},
+		}
+	}
+	tokenServer := func(c *cli.Context) (string, string, error) {
+		if c.String("server") == "" {
+			return "", "", fmt.Errorf("please provide --server, or --local to edit the tokens in %s", cfg.MetadataDir)
+		}
+		adminToken := cfg.ServerToken
+		if c.IsSet("token") {
+			adminToken = c.String("token")
+		}
+		return c.String("server"), adminToken, nil
+	}
 
 	app := &cli.App{
-		Name:  "vault",
-		Usage: "Distributed Storage and Retrieval of Erasure-coded Data Shards Using Vault's Storage Engine",
+		Name:    "vault",
+		Version: datastorage.Version,
+		Usage:   "Distributed Storage and Retrieval of Erasure-coded Data Shards Using Vault's Storage Engine",
+		Flags: []cli.Flag{
+			&cli.StringFlag{Name: "metadata-dir", Usage: "directory metadata files are written to and looked up in (default $METADATA_DIR)"},
+			&cli.BoolFlag{Name: "verify-only", Usage: "audit without encryption keys: verification works, reading or writing contents fails (default $VERIFY_ONLY)"},
+			&cli.StringFlag{Name: "profile", Usage: "defaults for speed, size or safety: " + strings.Join(config.ProfileNames(), ", ") + "; settings in the environment still win (default $PROFILE)"},
+		},
+		Before: func(c *cli.Context) error {
+			if c.IsSet("metadata-dir") {
+				cfg.MetadataDir = c.String("metadata-dir")
+			}
+			if c.Bool("verify-only") {
+				cfg.VerifyOnly = true
+			}
+			return nil
+		},
 		Commands: []*cli.Command{
 			{
 				Name:    "store",
 				Aliases: []string{"s"},
-				Usage:   "Store data. Usage: store <filename_or_directory> <storage-location-configuration>",
+				Usage:   "Store data. Usage: store [--if-absent] <filename_or_directory> <storage-location-configuration>",
+				Flags: []cli.Flag{
+					&cli.StringSliceFlag{Name: "recipient", Aliases: []string{"r"}, Usage: "also wrap the object's key to this recipient public key (repeatable)"},
+					&cli.BoolFlag{Name: "stream", Usage: "stream the file whatever its size, so it can be appended to later"},
+					&cli.DurationFlag{Name: "lock", Usage: "make the object write-once for this long, e.g. 8760h"},
+					&cli.BoolFlag{Name: "preview", Usage: "also store a thumbnail of PNG, JPEG and GIF images, retrieved with preview"},
+					&cli.BoolFlag{Name: "scan-secrets", Usage: "look for credentials such as cloud keys and private keys before storing"},
+					&cli.StringFlag{Name: "secrets-policy", Value: datastorage.SecretsPolicyBlock, Usage: "what to do when --scan-secrets finds something: warn or block"},
+					&cli.IntFlag{Name: "cpu", Usage: "segments of a streamed file encrypted and coded at once (default $CPU_WORKERS, or one per CPU)"},
+					&cli.BoolFlag{Name: "if-absent", Usage: "skip the store if the file is already stored and healthy (needs ID_MODE=content)"},
+					&cli.BoolFlag{Name: "convergent", Usage: "encrypt under a key derived from the contents, so anyone storing the same file shares its shards; reveals which objects are the same (default $CONVERGENT)"},
+				},
 				Action: func(c *cli.Context) error {
 					if c.NArg() < 2 {
 						return fmt.Errorf("please provide a file or directory to store and a storage location configuration file")
 					}
-					path := c.Args().Get(0)
-					storageConfigPath := c.Args().Get(1)
-
-					locations, err := datastorage.ReadStorageLocations(storageConfigPath)
-					if err != nil {
-						return fmt.Errorf("failed to read storage location configuration file: %w", err)
+					if c.Bool("if-absent") && cfg.IDMode != config.IDModeContent {
+						return fmt.Errorf("--if-absent needs ID_MODE=%s, so the dataID is known before storing", config.IDModeContent)
 					}
-
-					// Determine if the path is a directory or a file
-					info, err := os.Stat(path)
-					if err != nil {
-						return fmt.Errorf("failed to stat path: %w", err)
+					if recipients := c.StringSlice("recipient"); len(recipients) > 0 {
+						cfg.Recipients = append(cfg.Recipients, recipients...)
 					}
+					if c.Bool("convergent") {
+						cfg.Convergent = true
+					}
+					if c.IsSet("cpu") {
+						if c.Int("cpu") < 1 {
+							return fmt.Errorf("--cpu must be at least 1")
+						}
+						cfg.CPUWorkers = c.Int("cpu")
+					}
+					if c.IsSet("lock") && c.Duration("lock") <= 0 {
+						return fmt.Errorf("--lock needs a positive duration")
+					}
+					policy := c.String("secrets-policy")
+					if policy != datastorage.SecretsPolicyWarn && policy != datastorage.SecretsPolicyBlock {
+						return fmt.Errorf("--secrets-policy must be %s or %s", datastorage.SecretsPolicyWarn, datastorage.SecretsPolicyBlock)
+					}
+					path := c.Args().Get(0)
+					storageConfigPath := c.Args().Get(1)
 
-					var filePath string
-					// In the store command action
-					if info.IsDir() {
-						// Zip the directory
-						zipFilePath := filepath.Join(os.TempDir(), filepath.Base(path)+".zip")
-						logger.Info("Zipping directory",
-							zap.String("source", path),
-							zap.String("target", zipFilePath))
-
-						err = datastorage.ZipDirectory(path, zipFilePath)
+					if c.Bool("scan-secrets") {
+						findings, err := datastorage.ScanSecretsPath(path)
 						if err != nil {
-							return fmt.Errorf("failed to zip directory: %w", err)
+							return fmt.Errorf("secrets scan failed: %w", err)
+						}
+						for _, finding := range findings {
+							fmt.Fprintf(os.Stderr, "possible secret: %s\n", finding)
 						}
+						if len(findings) > 0 {
+							if policy == datastorage.SecretsPolicyBlock {
+								return fmt.Errorf("%w: %d in %s; remove them or store with --secrets-policy warn", datastorage.ErrSecretsFound, len(findings), path)
+							}
+							logger.Warn("Storing despite possible secrets", zap.Int("findings", len(findings)))
+						}
+					}
 
-						// Verify the zip file before storing
-						zipFileInfo, err := os.Stat(zipFilePath)
+					if c.Bool("if-absent") {
+						file, err := os.Open(path)
 						if err != nil {
-							return fmt.Errorf("failed to stat zip file: %w", err)
+							return fmt.Errorf("failed to read file: %w", err)
 						}
-						logger.Info("Original zip file size", zap.Int64("size", zipFileInfo.Size()))
-
-						// Validate the zip format
-						isValid, err := datastorage.IsValidZipFile(zipFilePath)
-						if err != nil || !isValid {
-							logger.Error("Created ZIP file validation failed", zap.Error(err))
-							return fmt.Errorf("created zip file is not valid: %w", err)
+						info, err := file.Stat()
+						if err == nil && info.IsDir() {
+							err = fmt.Errorf("--if-absent only works on files: a directory is zipped afresh, with another ID, every time")
 						}
-
-						// Check zip contents by listing files in the archive
-						zipReader, err := zip.OpenReader(zipFilePath)
+						var dataID string
+						if err == nil {
+							dataID, err = datastorage.ContentID(cfg, file)
+						}
+						file.Close()
 						if err != nil {
-							return fmt.Errorf("failed to open created zip: %w", err)
+							return err
 						}
-
-						logger.Info("ZIP archive contains", zap.Int("files", len(zipReader.File)))
-						for i, f := range zipReader.File {
-							logger.Info("ZIP entry",
-								zap.Int("index", i),
-								zap.String("name", f.Name),
-								zap.Int64("size", int64(f.UncompressedSize64)))
+						metadataFile, err := datastorage.FindHealthy(dataID, store, cfg, logger)
+						if err == nil {
+							fmt.Printf("Already stored with ID: %s\n", dataID)
+							fmt.Printf("Metadata file: %s\n", metadataFile)
+							return nil
 						}
-						zipReader.Close()
+						if !errors.Is(err, datastorage.ErrObjectNotFound) {
+							return err
+						}
+						logger.Info("Storing", zap.String("dataID", dataID), zap.String("reason", err.Error()))
+					}
 
-						filePath = zipFilePath
-					} else {
-						filePath = path
+					pool, err := datastorage.ReadStorageLocationPool(storageConfigPath, code.Total())
+					if err != nil {
+						return fmt.Errorf("failed to read storage location configuration file: %w", err)
+					}
+					// Unwritable locations, such as read-only mounts, are routed
+					// around when there are spares
+					writable, unwritable, err := sharding.RequireWritable(pool, code.Total())
+					if err != nil {
+						return err
+					}
+					for _, err := range unwritable {
+						logger.Warn("Skipping unwritable storage location", zap.Error(err))
+					}
+					// With more locations than shards, the least healthy are left
+					// out, and the rest spread over their zones
+					zones, err := datastorage.ReadLocationZones(storageConfigPath)
+					if err != nil {
+						return err
+					}
+					locations, err := health.PlaceInZones(writable, zones, code.Total())
+					if err != nil {
+						return err
+					}
+					if err := datastorage.CheckPlacementZones(locations, zones, code.Parity, cfg, logger); err != nil {
+						return err
+					}
+					for _, location := range locations {
+						if score := health.Score(location); score < sharding.HealthyScore {
+							logger.Warn("Placing shard on an unhealthy location", zap.String("location", location), zap.Float64("score", score))
+						}
 					}
 
-					data, err := os.ReadFile(filePath)
+					// Determine if the path is a directory or a file
+					info, err := os.Stat(path)
 					if err != nil {
-						return fmt.Errorf("failed to read file: %w", err)
+						return fmt.Errorf("failed to stat path: %w", err)
 					}
 
-					err = datastorage.Retry(3, 2*time.Second, logger, func() error {
-						dataID, err := datastorage.StoreData(data, store, cfg, locations, logger, filePath)
+					// Every attempt draws on one retry budget
+					ctx := datastorage.NewOperationContext(cfg)
+					var storedFile string
+					err = datastorage.RetryWithBudget(ctx, 3, 2*time.Second, logger, func() error {
+						var (
+							dataID       string
+							metadataFile string
+							err          error
+						)
+						if info.IsDir() {
+							// Zip the directory straight into the store, without a temporary file
+							logger.Info("Zipping directory", zap.String("source", path))
+							newHash, hashErr := datastorage.NewTreeHash(cfg)
+							if hashErr != nil {
+								return hashErr
+							}
+							var tree datastorage.TreeStats
+							hashes := make(datastorage.TreeHashes)
+							pr, pw := io.Pipe()
+							go func() {
+								pw.CloseWithError(datastorage.ZipDirectoryToWriter(path, pw, datastorage.ZipOptions{Stats: &tree, Hashes: hashes, NewHash: newHash}))
+							}()
+							dataID, metadataFile, err = datastorage.StoreReaderContext(ctx, pr, -1, store, cfg, locations, logger, filepath.Base(filepath.Clean(path))+".zip")
+							pr.CloseWithError(err) // Stops the zipper if the store failed
+							if err == nil {
+								// The store read the archive to its end, so the walk is done
+								err = datastorage.SetTreeStats(metadataFile, tree)
+								if err == nil {
+									err = datastorage.SetTreeHashes(metadataFile, hashes)
+								}
+								if err == nil {
+									fmt.Printf("Directory stored: %d files, %s\n", tree.Files, planning.FormatSize(tree.Bytes))
+								}
+							}
+						} else {
+							file, openErr := os.Open(path)
+							if openErr != nil {
+								return fmt.Errorf("failed to read file: %w", openErr)
+							}
+							defer file.Close()
+							info, statErr := file.Stat()
+							if statErr != nil {
+								return fmt.Errorf("failed to stat file: %w", statErr)
+							}
+							size := info.Size()
+							if c.Bool("stream") {
+								size = -1
+							}
+							dataID, metadataFile, err = datastorage.StoreReaderContext(ctx, file, size, store, cfg, locations, logger, path)
+						}
 						if err != nil {
 							logger.Error("Store failed", zap.Error(err))
 							return fmt.Errorf("store failed: %w", err)
 						}
 						fmt.Printf("Data stored with ID: %s\n", dataID)
+						fmt.Printf("Metadata file: %s\n", metadataFile)
+						if estimate, err := datastorage.ReadCompressibility(metadataFile); err == nil && estimate != nil && estimate.Sampled > 0 {
+							fmt.Printf("Compressibility: %.0f%% of its size, from %s sampled\n", 100*estimate.Ratio(), planning.FormatSize(estimate.Sampled))
+							if hint := datastorage.CompressionHint(*estimate); hint != "" {
+								fmt.Printf("Hint: %s\n", hint)
+							}
+						}
+						storedFile = metadataFile
 						return nil
 					})
 					if err != nil {
 						return fmt.Errorf("failed to store data after retries: %w", err)
 					}
+
+					if c.Bool("preview") && !info.IsDir() {
+						// The object is stored either way; a missing preview is only reported
+						file, err := os.Open(path)
+						if err != nil {
+							return fmt.Errorf("failed to store preview: %w", err)
+						}
+						previewID, err := datastorage.StorePreview(storedFile, file, store, cfg, locations, logger)
+						file.Close()
+						switch {
+						case errors.Is(err, datastorage.ErrNoPreview):
+							logger.Warn("No preview stored", zap.Error(err))
+						case err != nil:
+							return err
+						default:
+							fmt.Printf("Preview stored with ID: %s\n", previewID)
+						}
+					}
+
+					if c.IsSet("lock") {
+						until := time.Now().Add(c.Duration("lock"))
+						if err := datastorage.LockObject(storedFile, until, store, logger); err != nil {
+							return fmt.Errorf("failed to lock object: %w", err)
+						}
+						fmt.Printf("Object locked until %s\n", until.UTC().Format(time.RFC3339))
+					}
 					return nil
 				},
 			},
 			{
 				Name:    "retrieve",
 				Aliases: []string{"r"},
-				Usage:   "Retrieve Data From Metadata File. Usage: retrieve <metadatafile>",
+				Usage:   "Retrieve Data From Metadata File. Usage: retrieve <metadatafile> | retrieve --from-server <url> <dataID>",
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "from-server", Usage: "download the object from a vault server instead"},
+					&cli.BoolFlag{Name: "resume", Usage: "continue an interrupted download (with --from-server)"},
+					&cli.StringFlag{Name: "extract-to", Usage: "directory a retrieved archive is extracted into"},
+					&cli.BoolFlag{Name: "merge", Usage: "extract into an existing, non-empty directory"},
+					&cli.BoolFlag{Name: "force", Usage: "replace an existing, non-empty directory"},
+					&cli.IntFlag{Name: "max-extract-files", Value: datastorage.DefaultUnzipLimits.MaxFiles, Usage: "refuse to extract archives with more entries than this"},
+					&cli.Int64Flag{Name: "max-extract-size", Value: datastorage.DefaultUnzipLimits.MaxTotalSize, Usage: "refuse to extract archives holding more bytes than this"},
+					&cli.StringFlag{Name: "identity", Aliases: []string{"i"}, Usage: "identity file used when the master key is unavailable"},
+					&cli.BoolFlag{Name: "allow-cold", Usage: "retrieve objects in cold storage (when TIER_REQUIRE_ALLOW_COLD is set)"},
+					&cli.StringFlag{Name: "verify-checksum", Usage: "fail unless the retrieved data matches this checksum, given as <algo>:<hex>"},
+					&cli.StringFlag{Name: "on-conflict", Value: cfg.RetrieveConflict, Usage: "what to do with files that exist already: " + strings.Join(config.ConflictPolicies, ", ")},
+					&cli.BoolFlag{Name: "interactive", Usage: "ask what to do with every file that exists already"},
+				},
 				Action: func(c *cli.Context) error {
 					if c.NArg() < 1 {
 						return fmt.Errorf("please provide a metadata file")
 					}
+					conflicts, err := datastorage.NewConflicts(c.String("on-conflict"))
+					if err != nil {
+						return err
+					}
+					if c.Bool("interactive") {
+						if info, err := os.Stdin.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+							return fmt.Errorf("--interactive needs a terminal to ask on")
+						}
+						conflicts.Ask = datastorage.NewConflictPrompt(os.Stdin, os.Stderr)
+					}
+					// What was done about files that existed already is reported however retrieve ends
+					defer func() {
+						for _, path := range conflicts.Summary.Overwritten {
+							fmt.Printf("Overwrote existing %s\n", path)
+						}
+						for _, path := range conflicts.Summary.Skipped {
+							fmt.Printf("Skipped existing %s\n", path)
+						}
+						for _, renamed := range conflicts.Summary.Renamed {
+							fmt.Printf("Wrote %s as %s, it exists already\n", renamed.Path, renamed.RenamedTo)
+						}
+					}()
+					if c.IsSet("identity") {
+						cfg.IdentityFile = c.String("identity")
+					}
 					metadataFile := c.Args().Get(0)
 
-					var data []byte
-					err := datastorage.Retry(3, 2*time.Second, logger, func() error {
-						retrievedData, err := datastorage.RetrieveData(metadataFile, store, cfg, logger)
+					var checksum *datastorage.Checksum
+					if spec := c.String("verify-checksum"); spec != "" {
+						parsed, err := datastorage.ParseChecksum(spec)
 						if err != nil {
-							logger.Error("Retrieve failed", zap.Error(err))
-							return fmt.Errorf("retrieve failed: %w", err)
+							return err
 						}
-						data = retrievedData
-						return nil
-					})
-					if err != nil {
-						return fmt.Errorf("failed to retrieve data after retries: %w", err)
+						checksum = &parsed
 					}
 
-					// Read filename from metadata file
-					filename, err := datastorage.MetadataFileReader(metadataFile, "filename")
-					if err != nil {
-						return fmt.Errorf("failed to read filename from metadata file: %w", err)
+					if c.Bool("merge") && c.Bool("force") {
+						return fmt.Errorf("--merge and --force cannot be used together")
+					}
+					extractMode := datastorage.ExtractRefuse
+					if c.Bool("merge") {
+						extractMode = datastorage.ExtractMerge
+					} else if c.Bool("force") {
+						extractMode = datastorage.ExtractReplace
+					}
+					extractTarget := func(filename string) string {
+						if dir := c.String("extract-to"); dir != "" {
+							return dir
+						}
+						return strings.TrimSuffix(filename, ".zip")
 					}
 
-					// Debugging: Check the size of the retrieved data
-					logger.Info("Retrieved data size", zap.Int("size", len(data)))
+					var (
+						filename string
+						archive  string                 // Where a retrieved archive was saved
+						tree     *datastorage.TreeStats // Of a directory, recorded when it was stored
+					)
+					if serverURL := c.String("from-server"); serverURL != "" {
+						// The argument names the object on the server rather than a metadata file
+						// Partial downloads are staged to be resumed by a later invocation
+						staging, err := tmp.Staging(tmpRoot)
+						if err != nil {
+							return err
+						}
+						downloaded, err := server.Download(serverURL, metadataFile, ".", staging, cfg.ServerToken, c.Bool("resume"), logger)
+						if err != nil {
+							return fmt.Errorf("failed to download data: %w", err)
+						}
+						filename, archive = downloaded, downloaded
+						fmt.Printf("Data downloaded and saved to: %s\n", filename)
+					} else {
+						metadataFile = datastorage.ResolveMetadataFile(cfg, metadataFile)
+						if err := datastorage.CheckColdRetrieval(metadataFile, cfg, c.Bool("allow-cold"), logger); err != nil {
+							return err
+						}
+
+						// Read filename from metadata file
+						var err error
+						filename, err = datastorage.ReadFilename(metadataFile)
+						if err != nil {
+							return fmt.Errorf("failed to read filename from metadata file: %w", err)
+						}
+						if tree, err = datastorage.ReadTreeStats(metadataFile); err != nil {
+							return err
+						}
+						if filename, err = datastorage.SafeFilename(filename); err != nil {
+							return fmt.Errorf("refusing to retrieve: %w", err)
+						}
 
-					// Check if we expect a ZIP file
-					isZipFile := strings.HasSuffix(filename, ".zip")
+						// Check the extraction target before doing any work
+						if strings.HasSuffix(filename, ".zip") && extractMode == datastorage.ExtractRefuse {
+							if err := datastorage.PrepareExtractTarget(extractTarget(filename), extractMode); err != nil {
+								return fmt.Errorf("%w (use --merge, --force or --extract-to)", err)
+							}
+						}
 
-					// If expecting a ZIP, validate the file signature first
-					if isZipFile && (len(data) < 4 || string(data[:4]) != "PK\x03\x04") {
-						logger.Warn("Expected ZIP file but data does not have ZIP signature",
-							zap.String("expected_signature", "504B0304"),
-							zap.String("actual_signature", fmt.Sprintf("%x", data[:min(4, len(data))])))
-					}
+						// An existing file is dealt with before doing any work
+						target, err := conflicts.Resolve(filename)
+						if err != nil {
+							return fmt.Errorf("%w (use --on-conflict or --interactive)", err)
+						}
+						if target == "" {
+							return nil
+						}
+
+						// Write in the workspace and move into place, so a failed retrieve leaves an existing file alone
+						partial := filepath.Join(workspace.Dir, filepath.Base(target)+".part")
+						var (
+							size int64
+							sum  hash.Hash
+						)
+						// Every attempt draws on one retry budget
+						ctx := datastorage.NewOperationContext(cfg)
+						err = datastorage.RetryWithBudget(ctx, 3, 2*time.Second, logger, func() error {
+							file, err := os.Create(partial)
+							if err != nil {
+								return fmt.Errorf("failed to write retrieved data: %w", err)
+							}
+							var w io.Writer = file
+							if checksum != nil {
+								sum = checksum.New()
+								w = io.MultiWriter(file, sum)
+							}
+							n, err := datastorage.RetrieveToContext(ctx, metadataFile, w, store, cfg, logger)
+							if closeErr := file.Close(); err == nil {
+								err = closeErr
+							}
+							if err != nil {
+								logger.Error("Retrieve failed", zap.Error(err))
+								return fmt.Errorf("retrieve failed: %w", err)
+							}
+							size = n
+							return nil
+						})
+						if err != nil {
+							os.Remove(partial)
+							return fmt.Errorf("failed to retrieve data after retries: %w", err)
+						}
+						if checksum != nil {
+							if err := checksum.Verify(sum); err != nil {
+								os.Remove(partial)
+								return err
+							}
+							fmt.Printf("Checksum verified: %s\n", c.String("verify-checksum"))
+						}
+						if err := tmp.Move(partial, target); err != nil {
+							return fmt.Errorf("failed to write retrieved data: %w", err)
+						}
+						if err := datastorage.RecordAccess(metadataFile, time.Now()); err != nil {
+							logger.Warn("Failed to record object access", zap.Error(err))
+						}
 
-					if err := os.WriteFile(filename, data, 0644); err != nil {
-						return fmt.Errorf("failed to write retrieved data: %w", err)
+						// Debugging: Check the size of the retrieved data
+						logger.Info("Retrieved data size", zap.Int64("size", size))
+						fmt.Printf("Data retrieved and saved to: %s\n", target)
+						// The archive is extracted from where it was saved, into the directory named after the object
+						archive = target
 					}
-					fmt.Printf("Data retrieved and saved to: %s\n", filename)
 
 					// Determine if the retrieved file is a zip file and extract if so
-					if isZipFile {
-						extractDir := strings.TrimSuffix(filename, ".zip")
+					if strings.HasSuffix(filename, ".zip") {
+						extractDir := extractTarget(filename)
 
 						// Verify the file is a valid ZIP before attempting to extract
-						_, err := zip.OpenReader(filename)
+						zipReader, err := zip.OpenReader(archive)
 						if err != nil {
 							logger.Error("Retrieved file is not a valid ZIP", zap.Error(err))
 							return fmt.Errorf("failed to process ZIP file: %w", err)
 						}
+						zipReader.Close()
+
+						if err := datastorage.PrepareExtractTarget(extractDir, extractMode); err != nil {
+							return fmt.Errorf("failed to prepare extraction target: %w", err)
+						}
 
-						err = datastorage.Unzip(filename, extractDir)
+						limits := datastorage.DefaultUnzipLimits
+						limits.MaxFiles = c.Int("max-extract-files")
+						limits.MaxTotalSize = c.Int64("max-extract-size")
+						limits.MaxFileSize = min(limits.MaxFileSize, limits.MaxTotalSize)
+						extracted, err := datastorage.UnzipWithConflicts(archive, extractDir, limits, conflicts)
 						if err != nil {
 							logger.Error("Failed to unzip file", zap.Error(err))
 							return fmt.Errorf("failed to unzip file: %w", err)
 						}
-						fmt.Printf("Data extracted to: %s\n", extractDir)
+						fmt.Printf("Data extracted to: %s (%d files, %s)\n", extractDir, extracted.Files, planning.FormatSize(extracted.Bytes))
+						// Directories stored before tree sizes were recorded have nothing to compare with,
+						// and skipped files are missing on purpose
+						if tree != nil && len(conflicts.Summary.Skipped) == 0 {
+							if err := datastorage.CompareTree(*tree, extracted); err != nil {
+								logger.Warn("The extracted directory may be incomplete", zap.Error(err))
+							}
+						}
+					}
+
+					return nil
+				},
+			},
+			{
+				Name:  "cat",
+				Usage: "Write an object's contents to stdout. Usage: cat <metadatafile> | cat --id <dataID prefix>",
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "id", Usage: "find the object by a prefix of its dataID"},
+					&cli.StringFlag{Name: "max-size", Value: "64MiB", Usage: "refuse larger objects when stdout is a terminal"},
+					&cli.BoolFlag{Name: "force", Usage: "write to a terminal whatever the size"},
+					&cli.BoolFlag{Name: "raw", Usage: "write zipped directories as the zip archive"},
+					&cli.StringFlag{Name: "identity", Aliases: []string{"i"}, Usage: "identity file used when the master key is unavailable"},
+					&cli.BoolFlag{Name: "allow-cold", Usage: "read objects in cold storage (when TIER_REQUIRE_ALLOW_COLD is set)"},
+				},
+				Action: func(c *cli.Context) error {
+					var metadataFile string
+					switch {
+					case c.IsSet("id"):
+						object, err := datastorage.FindObjectByPrefix(cfg.MetadataDir, c.String("id"))
+						if err != nil {
+							return err
+						}
+						metadataFile = object.MetadataFile
+					case c.NArg() == 1:
+						metadataFile = datastorage.ResolveMetadataFile(cfg, c.Args().Get(0))
+					default:
+						return fmt.Errorf("please provide a metadata file or --id")
+					}
+					if c.IsSet("identity") {
+						cfg.IdentityFile = c.String("identity")
+					}
+					if err := datastorage.CheckColdRetrieval(metadataFile, cfg, c.Bool("allow-cold"), logger); err != nil {
+						return err
+					}
+
+					format, err := metadata.ReadValue(metadataFile, "format")
+					if err != nil {
+						return fmt.Errorf("failed to read metadata file: %w", err)
+					}
+					if format == "zip" && !c.Bool("raw") {
+						return fmt.Errorf("object is a zipped directory; use retrieve to extract it, or --raw for the archive")
+					}
+					if info, err := os.Stdout.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 && !c.Bool("force") {
+						limit, err := planning.ParseSize(c.String("max-size"))
+						if err != nil {
+							return err
+						}
+						value, err := metadata.ReadValue(metadataFile, "filesize")
+						if err != nil {
+							return fmt.Errorf("failed to read metadata file: %w", err)
+						}
+						if size, err := strconv.ParseInt(value, 10, 64); err == nil && size > limit {
+							return fmt.Errorf("object is %s, over --max-size %s for a terminal; redirect stdout or use --force", planning.FormatSize(size), planning.FormatSize(limit))
+						}
 					}
 
+					// stdout carries only the object. Shard reads are retried,
+					// but the object isn't: part of it may already be written.
+					_, err = datastorage.RetrieveTo(metadataFile, os.Stdout, store, cfg, logger)
+					if err != nil {
+						return fmt.Errorf("failed to read object: %w", err)
+					}
+					if err := datastorage.RecordAccess(metadataFile, time.Now()); err != nil {
+						logger.Warn("Failed to record object access", zap.Error(err))
+					}
+					return nil
+				},
+			},
+			{
+				Name:  "diff",
+				Usage: "Show what changed in a file or directory since it was stored, exiting 1 if anything did and 2 on trouble. Usage: diff <file_or_directory> <metadatafile> | diff --id <dataID prefix> <file_or_directory>",
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "id", Usage: "find the object by a prefix of its dataID"},
+					&cli.StringFlag{Name: "identity", Aliases: []string{"i"}, Usage: "identity file used when the master key is unavailable"},
+					&cli.BoolFlag{Name: "allow-cold", Usage: "read objects in cold storage, when the comparison needs the object (when TIER_REQUIRE_ALLOW_COLD is set)"},
+				},
+				Action: func(c *cli.Context) error {
+					var path, metadataFile string
+					switch {
+					case c.IsSet("id") && c.NArg() == 1:
+						object, err := datastorage.FindObjectByPrefix(cfg.MetadataDir, c.String("id"))
+						if err != nil {
+							return exitStatus{err, datastorage.DiffExitTrouble}
+						}
+						path, metadataFile = c.Args().Get(0), object.MetadataFile
+					case !c.IsSet("id") && c.NArg() == 2:
+						path, metadataFile = c.Args().Get(0), datastorage.ResolveMetadataFile(cfg, c.Args().Get(1))
+					default:
+						return exitStatus{fmt.Errorf("please provide a file or directory and a metadata file or --id"), datastorage.DiffExitTrouble}
+					}
+					if c.IsSet("identity") {
+						cfg.IdentityFile = c.String("identity")
+					}
+					if err := datastorage.CheckColdRetrieval(metadataFile, cfg, c.Bool("allow-cold"), logger); err != nil {
+						return exitStatus{err, datastorage.DiffExitTrouble}
+					}
+					diff, err := datastorage.DiffObject(path, metadataFile, store, cfg, logger)
+					if err != nil {
+						return exitStatus{err, datastorage.DiffExitTrouble}
+					}
+					if err := diff.Print(os.Stdout); err != nil {
+						return exitStatus{err, datastorage.DiffExitTrouble}
+					}
+					if code := diff.ExitCode(); code != datastorage.DiffExitSame {
+						return exitStatus{nil, code}
+					}
+					return nil
+				},
+			},
+			{
+				Name:  "preview",
+				Usage: "Write an object's preview thumbnail to a PNG file. Usage: preview <metadatafile> [--out <file>]",
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "out", Aliases: []string{"o"}, Usage: "file the preview is written to (default <filename>.preview.png)"},
+				},
+				Action: func(c *cli.Context) error {
+					if c.NArg() < 1 {
+						return fmt.Errorf("please provide a metadata file")
+					}
+					metadataFile := datastorage.ResolveMetadataFile(cfg, c.Args().Get(0))
+					preview, err := datastorage.RetrievePreview(metadataFile, store, cfg, logger)
+					if errors.Is(err, datastorage.ErrNoPreview) {
+						return fmt.Errorf("%w; store the object with --preview to make one", err)
+					}
+					if err != nil {
+						return fmt.Errorf("failed to retrieve preview: %w", err)
+					}
+					out := c.String("out")
+					if out == "" {
+						filename, err := datastorage.ReadFilename(metadataFile)
+						if err != nil {
+							return fmt.Errorf("failed to read metadata file: %w", err)
+						}
+						filename = filepath.Base(filename)
+						out, err = datastorage.SafeFilename(strings.TrimSuffix(filename, filepath.Ext(filename)) + ".preview.png")
+						if err != nil {
+							return fmt.Errorf("refusing to write preview: %w", err)
+						}
+					}
+					if err := os.WriteFile(out, preview, 0644); err != nil {
+						return fmt.Errorf("failed to write preview: %w", err)
+					}
+					fmt.Printf("Preview written to %s\n", out)
 					return nil
 				},
 			},
 			{
 				Name:    "set-storage",
 				Aliases: []string{"strl"},
-				Usage:   "Setup storage location configuration file. Usage: set-storage <location_1> <location_2> ... <location_14>",
+				Usage:   "Setup storage location configuration file. Usage: set-storage [--create] <location_1> ... <location_n> [<spare> ...], one location per shard of the configured code",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{Name: "create", Usage: "create missing location directories"},
+					&cli.BoolFlag{Name: "json", Usage: "print what was found as JSON"},
+				},
 				Action: func(c *cli.Context) error {
-					if c.NArg() < 14 {
-						return fmt.Errorf("storage locations incomplete, requires 14 locations")
+					if c.NArg() < code.Total() {
+						return fmt.Errorf("storage locations incomplete, requires %d locations", code.Total())
 					}
 					locations := c.Args().Slice()
-					_, err := datastorage.SetupStorage(locations, logger)
+					setup, err := datastorage.SetupStorage(locations, datastorage.SetupOptions{Create: c.Bool("create"), Code: code}, logger)
 					if err != nil {
 						return fmt.Errorf("failed to setup storage locations: %w", err)
 					}
-					fmt.Println("Storage location configuration file created successfully")
+					if c.Bool("json") {
+						out, err := json.MarshalIndent(setup, "", "  ")
+						if err != nil {
+							return err
+						}
+						fmt.Println(string(out))
+						return nil
+					}
+
+					w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+					fmt.Fprintln(w, "LOCATION\tHOST\tDEVICE\tFREE\tSIZE")
+					for _, info := range setup.Locations {
+						free, size := "-", "-"
+						if info.Total > 0 {
+							free, size = planning.FormatSize(int64(info.Free)), planning.FormatSize(int64(info.Total))
+						}
+						fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", info.Location, info.Host, info.Device, free, size)
+					}
+					if err := w.Flush(); err != nil {
+						return err
+					}
+					domains := setup.Domains
+					fmt.Printf("\n%d locations on %d distinct devices across %d hosts\n", len(setup.Locations), domains.Devices, domains.Hosts)
+					if len(setup.SharedDevices) > 0 {
+						fmt.Printf("Warning: %d devices back more than one location; up to %d shards of an object can be on one device\n", len(setup.SharedDevices), domains.MaxShardsPerDevice)
+					}
+					fmt.Printf("Objects survive the loss of any %d devices and any %d hosts (%d of %d shards may be lost)\n",
+						domains.DeviceFailures, domains.HostFailures, code.Parity, code.Total())
+					fmt.Printf("Storage location configuration file created: %s\n", setup.File)
 					return nil
 				},
 			},
 			{
 				Name:    "verify",
 				Aliases: []string{"v"},
-				Usage:   "Verify data availability using cryptographic proofs. Usage: verify <metadatafile>",
+				Usage:   "Verify data availability using cryptographic proofs. Usage: verify <metadatafile> | verify --refresh-proofs <metadatafile> <storage-location-configuration> | verify --placement <metadatafile> <storage-location-configuration> | verify --manifest <sums-file>",
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "manifest", Usage: "check the objects listed in a sums file (e.g. SHA256SUMS) against their checksums"},
+					&cli.StringFlag{Name: "checksum-algo", Value: "sha256", Usage: "algorithm of the manifest checksums: md5, sha1, sha256 or sha512"},
+					&cli.BoolFlag{Name: "refresh-proofs", Usage: "recompute the proofs from the current shards first, once they are shown to hold the object"},
+					&cli.BoolFlag{Name: "steal-lease", Usage: "take over location leases held by another instance (with --refresh-proofs)"},
+					&cli.BoolFlag{Name: "fault-tolerance", Usage: "simulate the loss of each location and report how many failures the object survives as its shards are now"},
+					&cli.BoolFlag{Name: "placement", Usage: "check that losing any one zone the locations are labelled with leaves enough shards to recover the object"},
+					&cli.BoolFlag{Name: "json", Usage: "print the fault tolerance or placement report as JSON (with --fault-tolerance or --placement)"},
+					&cli.BoolFlag{Name: "deep", Usage: "download every shard and check its proof, even where the store can checksum shards in place"},
+				},
 				Action: func(c *cli.Context) error {
+					if manifest := c.String("manifest"); manifest != "" {
+						entries, err := datastorage.ReadManifest(manifest)
+						if err != nil {
+							return err
+						}
+						results, err := datastorage.VerifyManifest(entries, c.String("checksum-algo"), cfg.MetadataDir, store, cfg, logger)
+						if err != nil {
+							return fmt.Errorf("manifest verification failed: %w", err)
+						}
+						failed := 0
+						for _, result := range results {
+							fmt.Printf("%s: %s\n", result.Filename, result.Status)
+							if result.Status != datastorage.ManifestOK {
+								failed++
+							}
+							if result.Err != nil {
+								logger.Warn("Manifest entry failed", zap.String("filename", result.Filename), zap.Error(result.Err))
+							}
+						}
+						if failed > 0 {
+							return fmt.Errorf("%d of %d manifest entries did not verify", failed, len(results))
+						}
+						return nil
+					}
 					if c.NArg() < 1 {
 						return fmt.Errorf("please provide a metadata file")
 					}
-					metadataFile := c.Args().Get(0)
+					metadataFile := datastorage.ResolveMetadataFile(cfg, c.Args().Get(0))
+
+					if c.Bool("placement") {
+						if c.NArg() < 2 {
+							return fmt.Errorf("please provide a storage location configuration file to check placement against")
+						}
+						zones, err := datastorage.ReadLocationZones(c.Args().Get(1))
+						if err != nil {
+							return err
+						}
+						if len(zones) == 0 {
+							return fmt.Errorf("no locations in %s have a %q label", c.Args().Get(1), sharding.ZoneLabel)
+						}
+						check, err := datastorage.CheckObjectZones(metadataFile, zones)
+						if err != nil {
+							return fmt.Errorf("placement check failed: %w", err)
+						}
+						if c.Bool("json") {
+							out, err := json.MarshalIndent(check, "", "  ")
+							if err != nil {
+								return err
+							}
+							fmt.Println(string(out))
+							return check.Err()
+						}
+						names := make([]string, 0, len(check.Shards))
+						for zone := range check.Shards {
+							names = append(names, zone)
+						}
+						sort.Strings(names)
+						w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+						fmt.Fprintln(w, "ZONE\tSHARDS")
+						for _, zone := range names {
+							fmt.Fprintf(w, "%s\t%d\n", zone, check.Shards[zone])
+						}
+						if check.Unlabeled > 0 {
+							fmt.Fprintf(w, "(unlabeled)\t%d\n", check.Unlabeled)
+						}
+						w.Flush()
+						if err := check.Err(); err != nil {
+							return err
+						}
+						fmt.Printf("Survives the loss of any one zone (at most %d shards in one, %d may be lost)\n", check.MaxShards, check.Parity)
+						return nil
+					}
+
+					if c.Bool("fault-tolerance") {
+						report, err := datastorage.CheckFaultTolerance(metadataFile, store, logger)
+						if err != nil {
+							return fmt.Errorf("fault tolerance check failed: %w", err)
+						}
+						if c.Bool("json") {
+							out, err := json.MarshalIndent(report, "", "  ")
+							if err != nil {
+								return err
+							}
+							fmt.Println(string(out))
+							return nil
+						}
+						w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+						fmt.Fprintln(w, "LOCATION\tGOOD SHARDS\tIF LOST")
+						for _, loss := range report.Losses {
+							outcome := "recoverable"
+							if !loss.Survivable {
+								outcome = "UNRECOVERABLE"
+							}
+							fmt.Fprintf(w, "%s\t%v\t%s\n", loss.Location, loss.Shards, outcome)
+						}
+						w.Flush()
+						if report.Margin < 0 {
+							fmt.Printf("Object is unrecoverable: %d good shards, %d needed\n", report.GoodShards, report.NeededShards)
+						} else {
+							fmt.Printf("Survives any %d location failures (%d with every shard good)\n", report.Margin, report.Theoretical)
+						}
+						return nil
+					}
+
+					if c.Bool("refresh-proofs") {
+						if c.NArg() < 2 {
+							return fmt.Errorf("please provide a storage location configuration file to refresh proofs")
+						}
+						objectCode, err := datastorage.ObjectCode(metadataFile)
+						if err != nil {
+							return err
+						}
+						locations, err := datastorage.ReadStorageLocations(c.Args().Get(1), objectCode.Total())
+						if err != nil {
+							return fmt.Errorf("failed to read storage location configuration file: %w", err)
+						}
+						var report *datastorage.RefreshReport
+						err = datastorage.WithLeases(c.Context, locations, "refresh-proofs", cfg, c.Bool("steal-lease"), logger, func(ctx context.Context) (err error) {
+							report, err = datastorage.RefreshProofs(ctx, metadataFile, store, cfg, logger)
+							return err
+						})
+						if err != nil {
+							return fmt.Errorf("failed to refresh proofs: %w", err)
+						}
+						fmt.Printf("Proofs of %d shard sets refreshed\n", report.ShardSets)
+					}
 
 					err := datastorage.Retry(3, 2*time.Second, logger, func() error {
-						err := datastorage.VerifyData(metadataFile, store, logger)
+						err := datastorage.VerifyData(metadataFile, store, datastorage.CheckOptions{Deep: c.Bool("deep"), Concurrency: cfg.MaxConcurrency}, logger)
 						if err != nil {
 							logger.Error("Verification failed", zap.Error(err))
 							return fmt.Errorf("verification failed: %w", err)
@@ -231,25 +931,1775 @@ func main() {
 				},
 			},
 			{
-				Name:    "exit",
-				Aliases: []string{"x"},
-				Usage:   "Exit the CLI",
+				Name:  "audit",
+				Usage: "Challenge random shards to prove they are still held. Usage: audit <metadatafile>",
+				Flags: []cli.Flag{
+					&cli.IntFlag{Name: "challenges", Value: 3, Usage: "number of shards challenged"},
+				},
 				Action: func(c *cli.Context) error {
-					reader := bufio.NewReader(os.Stdin)
-					fmt.Print("Are you sure you want to exit? (y/n): ")
-					resp, _ := reader.ReadString('\n')
-					resp = strings.TrimSpace(strings.ToLower(resp))
-					if resp == "y" || resp == "yes" {
-						fmt.Println("Exiting CLI...")
-						os.Exit(0)
+					if c.NArg() < 1 {
+						return fmt.Errorf("please provide a metadata file")
+					}
+					metadataFile := datastorage.ResolveMetadataFile(cfg, c.Args().Get(0))
+
+					results, err := datastorage.AuditData(metadataFile, store, c.Int("challenges"), logger)
+					if err != nil {
+						return fmt.Errorf("audit failed: %w", err)
+					}
+
+					failed := 0
+					for _, result := range results {
+						switch {
+						case result.Err != nil:
+							failed++
+							fmt.Printf("Shard_%d Challenge: error (%v)\n", result.Index, result.Err)
+						case !result.Passed:
+							failed++
+							fmt.Printf("Shard_%d Challenge: failed\n", result.Index)
+						default:
+							fmt.Printf("Shard_%d Challenge: passed\n", result.Index)
+						}
+					}
+					if failed > 0 {
+						return fmt.Errorf("%d of %d challenges failed", failed, len(results))
 					}
 					return nil
 				},
 			},
-		},
-	}
-
-	if err := app.Run(os.Args); err != nil {
-		logger.Fatal("CLI failed", zap.Error(err))
-	}
-}
+			{
+				Name:  "explain",
+				Usage: "Show how an object is stored and the steps retrieving it takes, from its metadata alone. Usage: explain <metadatafile> [--json]",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{Name: "json", Usage: "print the explanation as JSON"},
+				},
+				Action: func(c *cli.Context) error {
+					if c.NArg() < 1 {
+						return fmt.Errorf("please provide a metadata file")
+					}
+					e, err := datastorage.ExplainObject(datastorage.ResolveMetadataFile(cfg, c.Args().Get(0)))
+					if err != nil {
+						return err
+					}
+					if c.Bool("json") {
+						out, err := json.MarshalIndent(e, "", "  ")
+						if err != nil {
+							return err
+						}
+						fmt.Println(string(out))
+						return nil
+					}
+
+					w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+					fmt.Fprintf(w, "Object:\t%s (%s, %d bytes)\n", e.DataID, e.Filename, e.Size)
+					if e.Tree != nil {
+						fmt.Fprintf(w, "Directory:\t%d files, %d bytes, archived as the %d above\n", e.Tree.Files, e.Tree.Bytes, e.Size)
+					}
+					fmt.Fprintf(w, "Stored:\t%d bytes in shards\n", e.StoredSize)
+					layout := e.Layout
+					if e.LayoutReason != "" {
+						layout += " (" + e.LayoutReason + ")"
+					}
+					fmt.Fprintf(w, "Layout:\t%s\n", layout)
+					fmt.Fprintf(w, "Compression:\t%s\n", e.Compression)
+					if len(e.Transforms) > 0 {
+						fmt.Fprintf(w, "Transforms:\t%s\n", strings.Join(e.Transforms, ", "))
+					}
+					if e.Chunking != "" {
+						fmt.Fprintf(w, "Chunking:\t%s\n", e.Chunking)
+					}
+					fmt.Fprintf(w, "Cipher:\t%s\n", e.Cipher)
+					fmt.Fprintf(w, "Key:\t%s\n", e.KeySource)
+					if e.KeyFingerprint != "" {
+						fmt.Fprintf(w, "Key fingerprint:\t%s\n", e.KeyFingerprint)
+					}
+					fmt.Fprintf(w, "Erasure code:\t%s\n", e.Code)
+					fmt.Fprintf(w, "Shards:\t%s format, %s names\n", e.ShardFormat, e.ShardNaming)
+					fmt.Fprintf(w, "Proofs:\t%s\n", e.ProofScheme)
+					if err := w.Flush(); err != nil {
+						return err
+					}
+					for _, set := range e.Sets {
+						fmt.Printf("\n%s %s: %d bytes in shards of %d bytes\n", set.Label, set.ID, set.StoredBytes, set.ShardSize)
+						if set.MerkleRoot != "" {
+							fmt.Printf("Merkle root: %s\n", set.MerkleRoot)
+						}
+						w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+						fmt.Fprintln(w, "SHARD\tKIND\tLOCATIONS\tCHECKSUM")
+						for _, shard := range set.Shards {
+							fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", shard.Index, shard.Kind, strings.Join(shard.Locations, ","), shard.Checksum)
+						}
+						if err := w.Flush(); err != nil {
+							return err
+						}
+					}
+					fmt.Println("\nRetrieval:")
+					for i, step := range e.Steps {
+						fmt.Printf("%2d. %s\n", i+1, step)
+					}
+					return nil
+				},
+			},
+			{
+				Name:  "list",
+				Usage: "List the objects in the metadata directory. Usage: list [--stats]",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{Name: "stats", Usage: "also sum up how well the objects compress, from the samples taken as they were stored"},
+				},
+				Action: func(c *cli.Context) error {
+					objects, err := datastorage.ListObjects(cfg.MetadataDir)
+					if err != nil {
+						return err
+					}
+					w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+					fmt.Fprintln(w, "DATAID\tFILENAME\tSIZE\tCREATED\tTIER\tCOMPRESSES TO")
+					for _, object := range objects {
+						if object.Error != "" {
+							fmt.Fprintf(w, "-\t%s\t\t\t\terror: %s\n", filepath.Base(object.MetadataFile), object.Error)
+							continue
+						}
+						ratio := "-"
+						if object.Compressibility != nil && object.Compressibility.Sampled > 0 {
+							ratio = fmt.Sprintf("%.0f%%", 100*object.Compressibility.Ratio())
+						}
+						fmt.Fprintf(w, "%.12s\t%s\t%s\t%s\t%s\t%s\n", object.DataID, object.Filename, planning.FormatSize(object.Size), object.Created, object.Tier, ratio)
+					}
+					if err := w.Flush(); err != nil {
+						return err
+					}
+					if c.Bool("stats") {
+						stats := datastorage.SummarizeCompressibility(objects)
+						fmt.Printf("\nObjects sampled: %d of %d", stats.Objects, stats.Objects+stats.Unsampled)
+						if stats.Unsampled > 0 {
+							fmt.Printf(" (%d stored before sampling)", stats.Unsampled)
+						}
+						fmt.Println()
+						fmt.Printf("Compress to: %.0f%% of %s, from %s sampled\n", 100*stats.Ratio(), planning.FormatSize(stats.Bytes), planning.FormatSize(stats.Sampled))
+						fmt.Printf("Estimated savings: %s\n", planning.FormatSize(stats.Savings()))
+					}
+					return nil
+				},
+			},
+			{
+				Name:  "refresh-proofs",
+				Usage: "Recompute an object's proofs from its shards after they were replaced out of band. Usage: refresh-proofs <metadatafile> <storage-location-configuration>",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{Name: "steal-lease", Usage: "take over location leases held by another instance"},
+				},
+				Action: func(c *cli.Context) error {
+					if c.NArg() < 2 {
+						return fmt.Errorf("please provide a metadata file and a storage location configuration file")
+					}
+					metadataFile := datastorage.ResolveMetadataFile(cfg, c.Args().Get(0))
+					objectCode, err := datastorage.ObjectCode(metadataFile)
+					if err != nil {
+						return err
+					}
+					locations, err := datastorage.ReadStorageLocations(c.Args().Get(1), objectCode.Total())
+					if err != nil {
+						return fmt.Errorf("failed to read storage location configuration file: %w", err)
+					}
+					// Shards mustn't be healed or migrated while they are read
+					var report *datastorage.RefreshReport
+					err = datastorage.WithLeases(c.Context, locations, "refresh-proofs", cfg, c.Bool("steal-lease"), logger, func(ctx context.Context) (err error) {
+						report, err = datastorage.RefreshProofs(ctx, metadataFile, store, cfg, logger)
+						return err
+					})
+					if err != nil {
+						return fmt.Errorf("failed to refresh proofs: %w", err)
+					}
+					if len(report.Changed) == 0 {
+						fmt.Printf("Proofs of %d shard sets rewritten, all already matched their shards\n", report.ShardSets)
+					} else {
+						fmt.Printf("Proofs of %d shard sets rewritten, shards with new proofs: %v\n", report.ShardSets, report.Changed)
+					}
+					if report.Upgraded {
+						fmt.Println("Proof scheme upgraded to shard digests")
+					}
+					return nil
+				},
+			},
+			{
+				Name:  "recovery-estimate",
+				Usage: "Estimate how long rebuilding a degraded object's missing shards would take, from the bandwidth of its locations. Usage: recovery-estimate <metadatafile> <storage-location-configuration>",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{Name: "json", Usage: "print the estimate as JSON"},
+				},
+				Action: func(c *cli.Context) error {
+					if c.NArg() < 2 {
+						return fmt.Errorf("please provide a metadata file and a storage location configuration file")
+					}
+					metadataFile := datastorage.ResolveMetadataFile(cfg, c.Args().Get(0))
+					objectCode, err := datastorage.ObjectCode(metadataFile)
+					if err != nil {
+						return err
+					}
+					locations, err := datastorage.ReadStorageLocations(c.Args().Get(1), objectCode.Total())
+					if err != nil {
+						return fmt.Errorf("failed to read storage location configuration file: %w", err)
+					}
+					estimate, err := datastorage.EstimateRecovery(metadataFile, locations, store, logger)
+					if err != nil {
+						return fmt.Errorf("failed to estimate recovery: %w", err)
+					}
+					if c.Bool("json") {
+						out, err := json.MarshalIndent(estimate, "", "  ")
+						if err != nil {
+							return err
+						}
+						fmt.Println(string(out))
+						return nil
+					}
+					rate := func(r float64) string { return planning.FormatSize(int64(r)) + "/s" }
+					w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+					fmt.Fprintln(w, "LOCATION\tREAD\tRATE")
+					for _, probe := range estimate.Probes {
+						if probe.Error != "" {
+							fmt.Fprintf(w, "%s\t-\tfailed: %s\n", probe.Location, probe.Error)
+							continue
+						}
+						fmt.Fprintf(w, "%s\t%s\t%s\n", probe.Location, planning.FormatSize(probe.Bytes), rate(probe.Rate))
+					}
+					w.Flush()
+					switch {
+					case estimate.SetsToRepair == 0:
+						fmt.Println("No shards missing, nothing to rebuild")
+					case !estimate.Recoverable:
+						fmt.Printf("Object is unrecoverable: shards %v missing, more than the %d parity shards of a set\n", estimate.Missing, objectCode.Parity)
+					default:
+						fmt.Printf("Missing shards %v in %d shard sets\n", estimate.Missing, estimate.SetsToRepair)
+						fmt.Printf("Read:        %s at %s, %v\n", planning.FormatSize(estimate.ReadBytes), rate(estimate.ReadRate), estimate.Read.Round(time.Millisecond))
+						fmt.Printf("Reconstruct: at %s, %v\n", rate(estimate.CodingRate), estimate.Coding.Round(time.Millisecond))
+						fmt.Printf("Rewrite:     %s, %v (assumed as fast as reading)\n", planning.FormatSize(estimate.WriteBytes), estimate.Write.Round(time.Millisecond))
+						fmt.Printf("ETA:         %v\n", estimate.ETA.Round(time.Millisecond))
+					}
+					return nil
+				},
+			},
+			{
+				Name:  "verify-all",
+				Usage: "Verify every object in a metadata directory. Usage: verify-all <metadata-dir> <storage-location-configuration>",
+				Flags: []cli.Flag{
+					&cli.IntFlag{Name: "concurrency", Value: 4, Usage: "objects verified at once"},
+					&cli.Float64Flag{Name: "rate", Usage: "maximum objects started per second (0 for unlimited)"},
+					&cli.BoolFlag{Name: "heal", Usage: "rewrite missing shards of recoverable objects, and corrupt ones after quarantining them"},
+					&cli.BoolFlag{Name: "deep", Usage: "download every shard and check its proof, even where the store can checksum shards in place"},
+					&cli.StringFlag{Name: "report", Value: "verify-all-report.json", Usage: "file the JSON report is written to"},
+					&cli.BoolFlag{Name: "restart", Usage: "ignore progress from an interrupted run"},
+					&cli.BoolFlag{Name: "steal-lease", Usage: "take over location leases held by another instance (with --heal)"},
+				},
+				Action: func(c *cli.Context) error {
+					if c.NArg() < 2 {
+						return fmt.Errorf("please provide a metadata directory and a storage location configuration file")
+					}
+					metadataDir := c.Args().Get(0)
+					storageConfigPath := c.Args().Get(1)
+
+					locations, err := datastorage.ReadStorageLocations(storageConfigPath, code.Total())
+					if err != nil {
+						return fmt.Errorf("failed to read storage location configuration file: %w", err)
+					}
+
+					checkpoint := filepath.Join(metadataDir, ".verify-all.checkpoint")
+					if c.Bool("restart") {
+						os.Remove(checkpoint)
+					}
+
+					var summary *datastorage.VerifyAllSummary
+					verifyAll := func(ctx context.Context) (err error) {
+						summary, err = datastorage.VerifyAll(ctx, metadataDir, store, datastorage.VerifyAllOptions{
+							Concurrency: c.Int("concurrency"),
+							Rate:        c.Float64("rate"),
+							Heal:        c.Bool("heal"),
+							Deep:        c.Bool("deep"),
+							Checkpoint:  checkpoint,
+						}, logger)
+						return err
+					}
+					if c.Bool("heal") {
+						err = datastorage.WithLeases(c.Context, locations, "heal", cfg, c.Bool("steal-lease"), logger, verifyAll)
+					} else {
+						err = verifyAll(c.Context)
+					}
+					if err != nil {
+						return fmt.Errorf("failed to verify objects: %w", err)
+					}
+
+					if err := datastorage.WriteVerifyAllReport(summary, c.String("report")); err != nil {
+						return err
+					}
+					fmt.Printf("Objects: %d, healthy: %d, degraded: %d, unrecoverable: %d, failed: %d, shards repaired: %d\n",
+						summary.Objects, summary.Healthy, summary.Degraded, summary.Unrecoverable, summary.Failed, summary.ShardsRepaired)
+					fmt.Printf("Report written to: %s\n", c.String("report"))
+					if cfg.HealthTextfile != "" {
+						if err := datastorage.WriteHealthTextfile(cfg.HealthTextfile, datastorage.NewHealthGauges(summary, health.Snapshot())); err != nil {
+							return err
+						}
+					}
+					for location, h := range health.Snapshot() {
+						if h.NeedsReplacing() {
+							logger.Warn("Replace this disk: corrupt shards keep being found on it", zap.String("location", location), zap.Int64("corruptions", h.Corruptions))
+						}
+					}
+					return nil
+				},
+			},
+			{
+				Name:  "serve",
+				Usage: "Serve stored objects over HTTP. Usage: serve [--addr <host:port>] [--locations <storage-location-configuration>]",
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "addr", Value: ":8080", Usage: "address to listen on"},
+					&cli.StringFlag{Name: "locations", Usage: "storage location configuration file objects stored over HTTP go to; without it storing is disabled"},
+				},
+				Action: func(c *cli.Context) error {
+					var locations []string
+					if c.IsSet("locations") {
+						var err error
+						if locations, err = datastorage.ReadStorageLocations(c.String("locations"), code.Total()); err != nil {
+							return fmt.Errorf("failed to read storage location configuration file: %w", err)
+						}
+					}
+					srv, err := server.NewServer(store, cfg, cfg.MetadataDir, locations, logger)
+					if err != nil {
+						return fmt.Errorf("failed to start server: %w", err)
+					}
+					httpServer := &http.Server{Addr: c.String("addr"), Handler: srv.Handler()}
+
+					// Shut down on SIGINT/SIGTERM so in-flight requests finish and the store is closed.
+					// The workspace is removed on the way out, rather than by the signal.
+					stopRemoveOnSignal()
+					ctx, stop := signal.NotifyContext(c.Context, os.Interrupt, syscall.SIGTERM)
+					defer stop()
+					go func() {
+						<-ctx.Done()
+						shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+						defer cancel()
+						httpServer.Shutdown(shutdownCtx)
+					}()
+
+					if cfg.TierInterval > 0 {
+						policy, err := datastorage.TierPolicyFromConfig(cfg)
+						if err != nil {
+							return fmt.Errorf("failed to set up tiering: %w", err)
+						}
+						go func() {
+							ticker := time.NewTicker(cfg.TierInterval)
+							defer ticker.Stop()
+							for {
+								select {
+								case <-ctx.Done():
+									return
+								case <-ticker.C:
+								}
+								locations, err := datastorage.MetadataDirLocations(cfg.MetadataDir)
+								if err != nil {
+									logger.Error("Tiering run failed", zap.Error(err))
+									continue
+								}
+								var summary *datastorage.TierSummary
+								err = datastorage.WithLeases(ctx, append(locations, policy.ColdLocations...), "tier", cfg, false, logger, func(ctx context.Context) (err error) {
+									summary, err = datastorage.TierRun(ctx, cfg.MetadataDir, store, policy, logger)
+									return err
+								})
+								if err != nil {
+									logger.Error("Tiering run failed", zap.Error(err))
+									continue
+								}
+								logger.Info("Tiering run finished", zap.Int("objects", summary.Objects), zap.Int("demoted", summary.Demoted), zap.Int("failed", summary.Failed))
+							}
+						}()
+					}
+
+					if cfg.CompactInterval > 0 {
+						go func() {
+							ticker := time.NewTicker(cfg.CompactInterval)
+							defer ticker.Stop()
+							for {
+								select {
+								case <-ctx.Done():
+									return
+								case <-ticker.C:
+								}
+								locations, err := datastorage.MetadataDirLocations(cfg.MetadataDir)
+								if err != nil {
+									logger.Error("Emptying the trash failed", zap.Error(err))
+									continue
+								}
+								err = datastorage.WithLeases(ctx, locations, "trash-empty", cfg, false, logger, func(ctx context.Context) error {
+									if _, err := datastorage.EmptyTrash(ctx, cfg.MetadataDir, cfg.TrashRetention, time.Now(), store, logger); err != nil {
+										return err
+									}
+									// Shards of emptied objects linger in memory otherwise
+									report, err := sharding.Compact(store, nil)
+									if err == nil && report.Entries > 0 {
+										logger.Info("Shard store compacted", zap.Int("entries", report.Entries), zap.Int64("bytes", report.Bytes))
+									}
+									return err
+								})
+								if err != nil {
+									logger.Error("Emptying the trash failed", zap.Error(err))
+								}
+								stats, err := datastorage.ReadCatalogStats(cfg.MetadataDir)
+								if err != nil {
+									logger.Error("Failed to read catalog stats", zap.Error(err))
+									continue
+								}
+								if stats.Tombstones == 0 || stats.TombstoneRatio() < cfg.CompactRatio {
+									continue
+								}
+								if _, err := datastorage.CompactCatalog(cfg.MetadataDir, cfg.TombstoneRetention, time.Now(), logger); err != nil {
+									logger.Error("Catalog compaction failed", zap.Error(err))
+								}
+							}
+						}()
+					}
+
+					logger.Info("Serving objects", zap.String("addr", c.String("addr")), zap.String("metadataDir", cfg.MetadataDir))
+					if err := httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+						return fmt.Errorf("server failed: %w", err)
+					}
+					logger.Info("Server stopped")
+					return nil
+				},
+			},
+			{
+				Name:  "token",
+				Usage: "Manage the tokens a vault server accepts, without restarting it",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "create",
+						Usage: "Create a token; its secret is printed once. Usage: token create --name <name> [--namespace <ns>] [--scope objects|admin] [--ttl <duration>] (--server <url> | --local)",
+						Flags: append(tokenFlags(),
+							&cli.StringFlag{Name: "name", Required: true, Usage: "what the token is for"},
+							&cli.StringFlag{Name: "namespace", Usage: "namespace the token's requests are attributed to (default \"default\")"},
+							&cli.StringSliceFlag{Name: "scope", Usage: "objects or admin (repeatable; default objects)"},
+							&cli.DurationFlag{Name: "ttl", Usage: "expire the token after this long, e.g. 720h (default never)"},
+						),
+						Action: func(c *cli.Context) error {
+							var created *server.CreatedToken
+							if c.Bool("local") {
+								tokens, err := server.OpenTokenStore(server.TokenStorePath(cfg.MetadataDir))
+								if err != nil {
+									return err
+								}
+								token, secret, err := tokens.Create(c.String("name"), c.String("namespace"), c.StringSlice("scope"), c.Duration("ttl"), time.Now())
+								if err != nil {
+									return fmt.Errorf("failed to create token: %w", err)
+								}
+								created = &server.CreatedToken{Token: token, Secret: secret}
+							} else {
+								serverURL, adminToken, err := tokenServer(c)
+								if err != nil {
+									return err
+								}
+								req := server.TokenRequest{Name: c.String("name"), Namespace: c.String("namespace"), Scopes: c.StringSlice("scope")}
+								if c.IsSet("ttl") {
+									req.TTL = c.Duration("ttl").String()
+								}
+								if created, err = server.CreateToken(serverURL, adminToken, req); err != nil {
+									return fmt.Errorf("failed to create token: %w", err)
+								}
+							}
+							fmt.Printf("Created token %s (%s) for namespace %s with scopes %s\n", created.Token.ID, created.Token.Name, created.Token.Namespace, strings.Join(created.Token.Scopes, ","))
+							fmt.Printf("Secret (shown only once): %s\n", created.Secret)
+							return nil
+						},
+					},
+					{
+						Name:  "list",
+						Usage: "List the tokens, revoked and expired ones included. Usage: token list (--server <url> | --local)",
+						Flags: tokenFlags(),
+						Action: func(c *cli.Context) error {
+							var tokens []server.ManagedToken
+							if c.Bool("local") {
+								store, err := server.OpenTokenStore(server.TokenStorePath(cfg.MetadataDir))
+								if err != nil {
+									return err
+								}
+								if tokens, err = store.List(); err != nil {
+									return err
+								}
+							} else {
+								serverURL, adminToken, err := tokenServer(c)
+								if err != nil {
+									return err
+								}
+								if tokens, err = server.ListTokens(serverURL, adminToken); err != nil {
+									return fmt.Errorf("failed to list tokens: %w", err)
+								}
+							}
+							now := time.Now()
+							w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+							fmt.Fprintln(w, "ID\tNAME\tNAMESPACE\tSCOPES\tCREATED\tEXPIRES\tSTATUS")
+							for _, token := range tokens {
+								expires, status := "never", "active"
+								if token.Expires != nil {
+									expires = token.Expires.Local().Format(time.RFC3339)
+								}
+								switch {
+								case token.Revoked != nil:
+									status = "revoked " + token.Revoked.Local().Format(time.RFC3339)
+								case !token.Valid(now):
+									status = "expired"
+								}
+								fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", token.ID, token.Name, token.Namespace, strings.Join(token.Scopes, ","), token.Created.Local().Format(time.RFC3339), expires, status)
+							}
+							return w.Flush()
+						},
+					},
+					{
+						Name:  "revoke",
+						Usage: "Revoke a token; requests already under way finish, later ones are refused. Usage: token revoke <id> (--server <url> | --local)",
+						Flags: tokenFlags(),
+						Action: func(c *cli.Context) error {
+							if c.NArg() < 1 {
+								return fmt.Errorf("please provide a token ID")
+							}
+							id := c.Args().Get(0)
+							if c.Bool("local") {
+								store, err := server.OpenTokenStore(server.TokenStorePath(cfg.MetadataDir))
+								if err != nil {
+									return err
+								}
+								if err := store.Revoke(id, time.Now()); err != nil {
+									return fmt.Errorf("failed to revoke token: %w", err)
+								}
+							} else {
+								serverURL, adminToken, err := tokenServer(c)
+								if err != nil {
+									return err
+								}
+								if err := server.RevokeToken(serverURL, adminToken, id); err != nil {
+									return fmt.Errorf("failed to revoke token: %w", err)
+								}
+							}
+							fmt.Printf("Revoked: %s\n", id)
+							return nil
+						},
+					},
+				},
+			},
+			{
+				Name:  "history",
+				Usage: "Show what happened to an object and when. Usage: history <dataID|filename> [--json]",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{Name: "json", Usage: "print the history as JSON"},
+				},
+				Action: func(c *cli.Context) error {
+					if c.NArg() < 1 {
+						return fmt.Errorf("please provide a dataID or filename")
+					}
+					objects, err := datastorage.FindObjects(cfg.MetadataDir, c.Args().Get(0))
+					if errors.Is(err, datastorage.ErrObjectNotFound) {
+						// Deleted objects keep their history, archived once compacted
+						if events, _ := datastorage.ReadHistory(cfg.MetadataDir, c.Args().Get(0)); len(events) > 0 {
+							objects, err = []datastorage.ObjectInfo{{DataID: c.Args().Get(0)}}, nil
+						}
+					}
+					if err != nil {
+						return err
+					}
+
+					type objectHistory struct {
+						DataID   string                    `json:"data_id"`
+						Filename string                    `json:"filename"`
+						Events   []datastorage.ObjectEvent `json:"events"`
+					}
+					var histories []objectHistory
+					seen := make(map[string]bool)
+					for _, object := range objects {
+						// Copies of the same content share a history
+						if seen[object.DataID] {
+							continue
+						}
+						seen[object.DataID] = true
+						events, err := datastorage.ReadHistory(cfg.MetadataDir, object.DataID)
+						if err != nil {
+							return fmt.Errorf("failed to read history of %s: %w", object.DataID, err)
+						}
+						histories = append(histories, objectHistory{DataID: object.DataID, Filename: object.Filename, Events: events})
+					}
+
+					if c.Bool("json") {
+						out, err := json.MarshalIndent(histories, "", "  ")
+						if err != nil {
+							return err
+						}
+						fmt.Println(string(out))
+						return nil
+					}
+					for i, history := range histories {
+						if i > 0 {
+							fmt.Println()
+						}
+						fmt.Printf("%s (%s)\n", history.DataID, history.Filename)
+						w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+						fmt.Fprintln(w, "TIME\tEVENT\tDETAIL\tSHARDS\tBY")
+						for _, event := range history.Events {
+							var shards []string
+							for _, index := range event.Shards {
+								shards = append(shards, strconv.Itoa(index))
+							}
+							fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s@%s\n", event.Time.Local().Format(time.RFC3339), event.Event, event.Detail, strings.Join(shards, ","), event.User, event.Host)
+						}
+						if err := w.Flush(); err != nil {
+							return err
+						}
+					}
+					return nil
+				},
+			},
+			{
+				Name:  "dedup-report",
+				Usage: "Estimate what storing the chunks objects have in common once would save. Usage: dedup-report <metadata-dir> [--chunk-size <size>] [--json]",
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "chunk-size", Usage: "average size objects are cut into, e.g. 64KiB (default $CHUNK_SIZE, or 64KiB)"},
+					&cli.IntFlag{Name: "pairs", Value: 10, Usage: "pairs of objects with the most in common shown"},
+					&cli.BoolFlag{Name: "json", Usage: "print the report as JSON"},
+				},
+				Action: func(c *cli.Context) error {
+					if c.NArg() < 1 {
+						return fmt.Errorf("please provide a metadata directory")
+					}
+					var chunkSize int64
+					if c.IsSet("chunk-size") {
+						var err error
+						if chunkSize, err = planning.ParseSize(c.String("chunk-size")); err != nil {
+							return err
+						}
+					}
+					report, err := datastorage.AnalyzeDedup(c.Context, c.Args().Get(0), chunkSize, store, cfg, logger)
+					if err != nil {
+						return fmt.Errorf("failed to analyze objects: %w", err)
+					}
+
+					if c.Bool("json") {
+						out, err := json.MarshalIndent(report, "", "  ")
+						if err != nil {
+							return err
+						}
+						fmt.Println(string(out))
+						return nil
+					}
+
+					w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+					fmt.Fprintln(w, "DATAID\tFILENAME\tSIZE\tCHUNKS\tSHARED")
+					for _, object := range report.Objects {
+						if object.Error != "" {
+							fmt.Fprintf(w, "%s\t%s\t-\t-\t%s\n", object.DataID, object.Filename, object.Error)
+							continue
+						}
+						fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", object.DataID, object.Filename, planning.FormatSize(object.Size), object.Chunks, planning.FormatSize(object.SharedBytes))
+					}
+					if err := w.Flush(); err != nil {
+						return err
+					}
+					if pairs := report.Pairs; len(pairs) > 0 {
+						if len(pairs) > c.Int("pairs") {
+							pairs = pairs[:c.Int("pairs")]
+						}
+						fmt.Println("\nMost in common:")
+						w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+						for _, pair := range pairs {
+							a, b := report.Objects[pair.A], report.Objects[pair.B]
+							fmt.Fprintf(w, "%s\t%s\t%s\n", a.Filename, b.Filename, planning.FormatSize(pair.SharedBytes))
+						}
+						if err := w.Flush(); err != nil {
+							return err
+						}
+					}
+
+					saved := 0.0
+					if report.TotalBytes > 0 {
+						saved = 100 * float64(report.SavedBytes()) / float64(report.TotalBytes)
+					}
+					fmt.Printf("\n%s in %d chunks of about %s, %s in %d distinct chunks: storing each once would save %s (%.1f%%)\n",
+						planning.FormatSize(report.TotalBytes), report.Chunks, planning.FormatSize(report.ChunkSize),
+						planning.FormatSize(report.UniqueBytes), report.UniqueChunks, planning.FormatSize(report.SavedBytes()), saved)
+					return nil
+				},
+			},
+			{
+				Name:  "plan",
+				Usage: "Estimate the stored footprint of an input. Usage: plan --size <size> [--data <n>] [--parity <n>] [--locations <storage-location-configuration>]",
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "size", Required: true, Usage: "input size, e.g. 500GiB"},
+					&cli.IntFlag{Name: "data", Value: cfg.DataShards, Usage: "data shards"},
+					&cli.IntFlag{Name: "parity", Value: cfg.ParityShards, Usage: "parity shards"},
+					&cli.IntFlag{Name: "replication", Value: 1, Usage: "copies of every shard"},
+					&cli.StringFlag{Name: "compression", Value: "none", Usage: "none or <algo>:estimated-ratio=<ratio>"},
+					&cli.StringFlag{Name: "locations", Usage: "storage location configuration to check the location capacities and spread of shards over zones against"},
+					&cli.BoolFlag{Name: "json", Usage: "print the plan as JSON"},
+				},
+				Action: func(c *cli.Context) error {
+					size, err := planning.ParseSize(c.String("size"))
+					if err != nil {
+						return err
+					}
+					algo, ratio, err := planning.ParseCompression(c.String("compression"))
+					if err != nil {
+						return err
+					}
+
+					// The layout store would pick, given STREAMING_THRESHOLD and MAX_SHARD_SIZE
+					choice, err := datastorage.ChooseLayout(size, cfg)
+					if err != nil {
+						return err
+					}
+					// Chunked objects are planned as segments of the average chunk size
+					segmentSize := choice.SegmentSize
+					if choice.ChunkSize > 0 {
+						segmentSize = choice.ChunkSize
+					}
+					plan, err := planning.Compute(size, planning.Params{
+						DataShards:       c.Int("data"),
+						ParityShards:     c.Int("parity"),
+						Replication:      c.Int("replication"),
+						Compression:      algo,
+						CompressionRatio: ratio,
+						SegmentSize:      segmentSize,
+					})
+					if err != nil {
+						return fmt.Errorf("failed to compute plan: %w", err)
+					}
+					plan.Layout, plan.LayoutReason = choice.Layout, choice.Reason
+
+					// Shards are placed as store would place them
+					var zones *sharding.ZoneCheck
+					if c.IsSet("locations") {
+						total := c.Int("data") + c.Int("parity")
+						pool, err := datastorage.ReadStorageLocationPool(c.String("locations"), total)
+						if err != nil {
+							return fmt.Errorf("failed to read storage location configuration file: %w", err)
+						}
+						capacities, err := datastorage.ReadLocationCapacities(c.String("locations"))
+						if err != nil {
+							return err
+						}
+						plan.CheckCapacities(capacities)
+						labels, err := datastorage.ReadLocationZones(c.String("locations"))
+						if err != nil {
+							return err
+						}
+						if len(labels) > 0 {
+							locations, err := health.PlaceInZones(pool, labels, total)
+							if err != nil {
+								return err
+							}
+							check := datastorage.PlacementZones(locations, labels, c.Int("parity"))
+							zones = &check
+						}
+					}
+
+					if c.Bool("json") {
+						out, err := json.MarshalIndent(struct {
+							*planning.Plan
+							Zones *sharding.ZoneCheck `json:"zones,omitempty"`
+						}{plan, zones}, "", "  ")
+						if err != nil {
+							return err
+						}
+						fmt.Println(string(out))
+						return nil
+					}
+
+					w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+					fmt.Fprintf(w, "Input\t%s\n", planning.FormatSize(plan.InputBytes))
+					fmt.Fprintf(w, "After compression (%s)\t%s\n", algo, planning.FormatSize(plan.CompressedBytes))
+					fmt.Fprintf(w, "After encryption\t%s\n", planning.FormatSize(plan.EncryptedBytes))
+					if plan.Segments > 0 && choice.ChunkSize > 0 {
+						fmt.Fprintf(w, "Layout\t%s (%s), about %d chunks of %s\n", plan.Layout, plan.LayoutReason, plan.Segments, planning.FormatSize(choice.ChunkSize))
+					} else if plan.Segments > 0 {
+						fmt.Fprintf(w, "Layout\t%s (%s), %d segments of %s\n", plan.Layout, plan.LayoutReason, plan.Segments, planning.FormatSize(choice.SegmentSize))
+					} else {
+						fmt.Fprintf(w, "Layout\t%s\n", plan.Layout)
+					}
+					fmt.Fprintf(w, "Shard size\t%s (%d bytes padding)\n", planning.FormatSize(plan.ShardBytes), plan.PaddingBytes)
+					fmt.Fprintf(w, "Locations\t%d\n", plan.Locations)
+					fmt.Fprintf(w, "Stored per location\t%s\n", planning.FormatSize(plan.StoredBytesPerLocation))
+					fmt.Fprintf(w, "Total stored\t%s\n", planning.FormatSize(plan.TotalStoredBytes))
+					fmt.Fprintf(w, "Overhead factor\t%.3fx\n", plan.OverheadFactor)
+					fmt.Fprintf(w, "Fault tolerance\t%d locations\n", plan.FaultTolerance)
+					if plan.Fits != nil {
+						fmt.Fprintf(w, "Fits\t%t, %d locations have room for %s of the %d needed\n", *plan.Fits, plan.LocationsWithRoom, planning.FormatSize(plan.StoredBytesPerLocation), plan.Locations)
+					} else if c.IsSet("locations") {
+						fmt.Fprintf(w, "Fits\tunknown, no location has a capacity\n")
+					}
+					if zones != nil {
+						if err := zones.Err(); err != nil {
+							fmt.Fprintf(w, "Zones\t%d, %v\n", len(zones.Shards), err)
+						} else {
+							fmt.Fprintf(w, "Zones\t%d, at most %d shards in one: survives the loss of any one\n", len(zones.Shards), zones.MaxShards)
+						}
+					} else if c.IsSet("locations") {
+						fmt.Fprintf(w, "Zones\tnone, no location has a %q label\n", sharding.ZoneLabel)
+					}
+					return w.Flush()
+				},
+			},
+			{
+				Name:  "metadata",
+				Usage: "Manage metadata files",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "collect",
+						Usage: "Move stray metadata files into the metadata directory. Usage: metadata collect [dir]",
+						Action: func(c *cli.Context) error {
+							dir := "."
+							if c.NArg() > 0 {
+								dir = c.Args().Get(0)
+							}
+							moved, err := datastorage.CollectMetadataFiles(cfg, dir)
+							for _, file := range moved {
+								fmt.Printf("Moved: %s\n", file)
+							}
+							if err != nil {
+								return fmt.Errorf("failed to collect metadata files: %w", err)
+							}
+							fmt.Printf("Collected %d metadata files into: %s\n", len(moved), cfg.MetadataDir)
+							return nil
+						},
+					},
+				},
+			},
+			{
+				Name:  "cache",
+				Usage: "Manage the local cache of retrieved objects (enabled by CACHE_DIR)",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "ls",
+						Usage: "List the cached objects, most recently used first. Usage: cache ls",
+						Action: func(c *cli.Context) error {
+							cache, err := datastorage.OpenObjectCache(cfg)
+							if err != nil {
+								return err
+							}
+							if cache == nil {
+								return fmt.Errorf("the object cache is disabled, set CACHE_DIR to enable it")
+							}
+							w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+							fmt.Fprintln(w, "DATAID\tSIZE\tLAST USED\tPINNED")
+							var total int64
+							for _, e := range cache.List() {
+								fmt.Fprintf(w, "%s\t%s\t%s\t%t\n", e.DataID, planning.FormatSize(e.Size), e.LastUsed.Local().Format(time.RFC3339), e.Pinned)
+								total += e.Size
+							}
+							w.Flush()
+							fmt.Printf("Cached: %s of %s\n", planning.FormatSize(total), planning.FormatSize(cfg.CacheMaxBytes))
+							return nil
+						},
+					},
+					{
+						Name:  "clear",
+						Usage: "Remove the cached objects, except pinned ones. Usage: cache clear [--all]",
+						Flags: []cli.Flag{
+							&cli.BoolFlag{Name: "all", Usage: "remove pinned objects too"},
+						},
+						Action: func(c *cli.Context) error {
+							cache, err := datastorage.OpenObjectCache(cfg)
+							if err != nil {
+								return err
+							}
+							if cache == nil {
+								return fmt.Errorf("the object cache is disabled, set CACHE_DIR to enable it")
+							}
+							removed, err := cache.Clear(c.Bool("all"))
+							if err != nil {
+								return fmt.Errorf("failed to clear the cache: %w", err)
+							}
+							fmt.Printf("Removed %d cached objects\n", removed)
+							return nil
+						},
+					},
+					{
+						Name:  "pin",
+						Usage: "Keep a cached object from being evicted. Usage: cache pin [--unpin] <dataID | metadatafile>",
+						Flags: []cli.Flag{
+							&cli.BoolFlag{Name: "unpin", Usage: "let the object be evicted again"},
+						},
+						Action: func(c *cli.Context) error {
+							if c.NArg() < 1 {
+								return fmt.Errorf("please provide a dataID or a metadata file")
+							}
+							cache, err := datastorage.OpenObjectCache(cfg)
+							if err != nil {
+								return err
+							}
+							if cache == nil {
+								return fmt.Errorf("the object cache is disabled, set CACHE_DIR to enable it")
+							}
+							dataID := c.Args().Get(0)
+							metadataFile := datastorage.ResolveMetadataFile(cfg, dataID)
+							if info, err := os.Stat(metadataFile); err == nil && info.Mode().IsRegular() {
+								// A metadata file names the object by its dataID
+								if dataID, err = metadata.ReadValue(metadataFile, "dataID"); err != nil {
+									return fmt.Errorf("error reading metadata file: %w", err)
+								}
+							}
+							if err := cache.Pin(dataID, !c.Bool("unpin")); err != nil {
+								return err
+							}
+							if c.Bool("unpin") {
+								fmt.Printf("Unpinned: %s\n", dataID)
+							} else {
+								fmt.Printf("Pinned: %s\n", dataID)
+							}
+							return nil
+						},
+					},
+				},
+			},
+			{
+				Name:  "catalog",
+				Usage: "Manage the catalog of objects in the metadata directory",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "stats",
+						Usage: "Count the objects and tombstones of deleted objects in the catalog. Usage: catalog stats",
+						Action: func(c *cli.Context) error {
+							stats, err := datastorage.ReadCatalogStats(cfg.MetadataDir)
+							if err != nil {
+								return err
+							}
+							fmt.Printf("Objects: %d, tombstones: %d (%.0f%%)\n", stats.Objects, stats.Tombstones, 100*stats.TombstoneRatio())
+							return nil
+						},
+					},
+					{
+						Name:  "compact",
+						Usage: "Drop tombstones older than the retention window, archiving their history. Usage: catalog compact [--retention <duration>]",
+						Flags: []cli.Flag{
+							&cli.DurationFlag{Name: "retention", Value: cfg.TombstoneRetention, Usage: "keep tombstones of objects deleted more recently than this"},
+						},
+						Action: func(c *cli.Context) error {
+							summary, err := datastorage.CompactCatalog(cfg.MetadataDir, c.Duration("retention"), time.Now(), logger)
+							if err != nil {
+								return fmt.Errorf("compaction failed: %w", err)
+							}
+							fmt.Printf("Tombstones dropped: %d, kept: %d, still in the trash: %d, history events archived: %d\n", summary.Dropped, summary.Kept, summary.Unpurged, summary.Archived)
+							return nil
+						},
+					},
+				},
+			},
+			{
+				Name:  "delete",
+				Usage: "Move an object to the trash, or delete its shards with --now. Usage: delete <metadatafile> [--now]",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{Name: "now", Usage: "delete the shards straight away; the object can't be restored"},
+					&cli.BoolFlag{Name: "steal-lease", Usage: "take over location leases held by another instance (with --now)"},
+				},
+				Action: func(c *cli.Context) error {
+					if c.NArg() < 1 {
+						return fmt.Errorf("please provide a metadata file")
+					}
+					metadataFile := datastorage.ResolveMetadataFile(cfg, c.Args().Get(0))
+					now := time.Now()
+					if !c.Bool("now") {
+						if _, err := datastorage.TrashObject(metadataFile, now, logger); err != nil {
+							return fmt.Errorf("delete failed: %w", err)
+						}
+						fmt.Printf("Object moved to the trash; restore it before %s with restore\n", now.Add(cfg.TrashRetention).Format(time.RFC3339))
+						return nil
+					}
+					locations, err := datastorage.ObjectLocations(metadataFile)
+					if err != nil {
+						return fmt.Errorf("delete failed: %w", err)
+					}
+					var deleted int
+					err = datastorage.WithLeases(c.Context, locations, "delete", cfg, c.Bool("steal-lease"), logger, func(ctx context.Context) (err error) {
+						deleted, err = datastorage.DeleteData(ctx, metadataFile, store, now, logger)
+						return err
+					})
+					if err != nil {
+						return fmt.Errorf("delete failed: %w", err)
+					}
+					fmt.Printf("Object deleted, %d shard files removed\n", deleted)
+					return nil
+				},
+			},
+			{
+				Name:  "restore",
+				Usage: "Bring a deleted object back from the trash. Usage: restore <dataID or prefix>",
+				Action: func(c *cli.Context) error {
+					if c.NArg() < 1 {
+						return fmt.Errorf("please provide a dataID")
+					}
+					metadataFile, err := datastorage.RestoreObject(cfg.MetadataDir, c.Args().Get(0), logger)
+					if err != nil {
+						return fmt.Errorf("restore failed: %w", err)
+					}
+					fmt.Printf("Object restored: %s\n", metadataFile)
+					return nil
+				},
+			},
+			{
+				Name:  "trash",
+				Usage: "Manage deleted objects",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "list",
+						Usage: "List deleted objects and when they can be purged. Usage: trash list [--json]",
+						Flags: []cli.Flag{
+							&cli.BoolFlag{Name: "json", Usage: "print the trash as JSON"},
+						},
+						Action: func(c *cli.Context) error {
+							entries, err := datastorage.ListTrash(cfg.MetadataDir)
+							if err != nil {
+								return err
+							}
+							if c.Bool("json") {
+								out, err := json.MarshalIndent(entries, "", "  ")
+								if err != nil {
+									return err
+								}
+								fmt.Println(string(out))
+								return nil
+							}
+							w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+							fmt.Fprintln(w, "DATAID\tFILENAME\tSIZE\tDELETED\tSTATE")
+							for _, entry := range entries {
+								state := "restorable, purged after " + entry.Deleted.Add(cfg.TrashRetention).Local().Format(time.RFC3339)
+								if entry.Purged {
+									state = "purged"
+								}
+								fmt.Fprintf(w, "%.12s\t%s\t%s\t%s\t%s\n", entry.DataID, entry.Filename, planning.FormatSize(entry.Size), entry.Deleted.Local().Format(time.RFC3339), state)
+							}
+							return w.Flush()
+						},
+					},
+					{
+						Name:  "empty",
+						Usage: "Delete the shards of objects deleted longer ago than the retention window. Usage: trash empty [--retention <duration>]",
+						Flags: []cli.Flag{
+							&cli.DurationFlag{Name: "retention", Value: cfg.TrashRetention, Usage: "keep objects deleted more recently than this restorable"},
+							&cli.BoolFlag{Name: "steal-lease", Usage: "take over location leases held by another instance"},
+						},
+						Action: func(c *cli.Context) error {
+							locations, err := datastorage.MetadataDirLocations(cfg.MetadataDir)
+							if err != nil {
+								return fmt.Errorf("failed to read the locations of deleted objects: %w", err)
+							}
+							var summary *datastorage.TrashSummary
+							err = datastorage.WithLeases(c.Context, locations, "trash-empty", cfg, c.Bool("steal-lease"), logger, func(ctx context.Context) (err error) {
+								summary, err = datastorage.EmptyTrash(ctx, cfg.MetadataDir, c.Duration("retention"), time.Now(), store, logger)
+								return err
+							})
+							if err != nil {
+								return fmt.Errorf("emptying the trash failed: %w", err)
+							}
+							fmt.Printf("Objects purged: %d, shard files removed: %d, still restorable: %d\n", summary.Purged, summary.Shards, summary.Kept)
+							return nil
+						},
+					},
+				},
+			},
+			{
+				Name:  "tier",
+				Usage: "Manage storage tiers",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "run",
+						Usage: "Demote objects not retrieved within TIER_COLD_AFTER to the COLD_LOCATIONS tier. Usage: tier run",
+						Flags: []cli.Flag{
+							&cli.BoolFlag{Name: "steal-lease", Usage: "take over location leases held by another instance"},
+						},
+						Action: func(c *cli.Context) error {
+							policy, err := datastorage.TierPolicyFromConfig(cfg)
+							if err != nil {
+								return err
+							}
+							locations, err := datastorage.MetadataDirLocations(cfg.MetadataDir)
+							if err != nil {
+								return fmt.Errorf("failed to read the locations of objects: %w", err)
+							}
+							var summary *datastorage.TierSummary
+							err = datastorage.WithLeases(c.Context, append(locations, policy.ColdLocations...), "tier", cfg, c.Bool("steal-lease"), logger, func(ctx context.Context) (err error) {
+								summary, err = datastorage.TierRun(ctx, cfg.MetadataDir, store, policy, logger)
+								return err
+							})
+							if err != nil {
+								return fmt.Errorf("tiering failed: %w", err)
+							}
+							fmt.Printf("Objects: %d, demoted: %d, failed: %d\n", summary.Objects, summary.Demoted, summary.Failed)
+							if summary.Failed > 0 {
+								return fmt.Errorf("%d objects could not be tiered", summary.Failed)
+							}
+							return nil
+						},
+					},
+				},
+			},
+			{
+				Name:  "config",
+				Usage: "Inspect the configuration",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "show",
+						Usage: "Show the configuration in effect, with the shard store layers in the order calls go through them. Usage: config show",
+						Action: func(c *cli.Context) error {
+							key := "unset"
+							if cfg.EncryptionKey != "" {
+								key = "set"
+							}
+							transforms := strings.Join(cfg.Transforms, " ")
+							if transforms == "" {
+								transforms = "none"
+							}
+							chunkSize := "off"
+							if cfg.ChunkSize > 0 {
+								chunkSize = planning.FormatSize(cfg.ChunkSize)
+							}
+							chain := append(layers.Chain(), "disk")
+							profile := cfg.Profile
+							if profile == "" {
+								profile = "none"
+							}
+
+							w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+							fmt.Fprintf(w, "Profile:\t%s\n", profile)
+							fmt.Fprintf(w, "Metadata directory:\t%s\n", cfg.MetadataDir)
+							fmt.Fprintf(w, "Encryption key:\t%s\n", key)
+							fmt.Fprintf(w, "Erasure code:\t%s\n", code)
+							fmt.Fprintf(w, "Streaming threshold:\t%s\n", planning.FormatSize(cfg.StreamingThreshold))
+							fmt.Fprintf(w, "Chunk size:\t%s\n", chunkSize)
+							fmt.Fprintf(w, "Transforms:\t%s\n", transforms)
+							fmt.Fprintf(w, "ID mode:\t%s\n", cfg.IDMode)
+							fmt.Fprintf(w, "Health file:\t%s\n", cfg.HealthFile)
+							fmt.Fprintf(w, "Shard store:\t%s\n", strings.Join(chain, " -> "))
+							if cfg.FaultPlan != "" {
+								fmt.Fprintf(w, "Fault plan:\t%s\n", cfg.FaultPlan)
+							}
+							return w.Flush()
+						},
+					},
+				},
+			},
+			{
+				Name:  "health",
+				Usage: "Show the health of the storage locations used so far. Usage: health [--scores]",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{Name: "scores", Usage: "show each location's score, success rate and latency"},
+				},
+				Action: func(c *cli.Context) error {
+					snapshot := health.Snapshot()
+					locations := make([]string, 0, len(snapshot))
+					for location := range snapshot {
+						locations = append(locations, location)
+					}
+					sort.Strings(locations)
+
+					w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+					if c.Bool("scores") {
+						fmt.Fprintln(w, "LOCATION\tSTATUS\tSCORE\tSUCCESS RATE\tLATENCY\tOK\tFAILED\tCORRUPT")
+					} else {
+						fmt.Fprintln(w, "LOCATION\tSTATUS")
+					}
+					for _, location := range locations {
+						h := snapshot[location]
+						status := "healthy"
+						if h.Score() < sharding.HealthyScore {
+							status = "unhealthy"
+						}
+						if h.NeedsReplacing() {
+							status = "replace disk"
+						}
+						if c.Bool("scores") {
+							fmt.Fprintf(w, "%s\t%s\t%.2f\t%.2f\t%.0fms\t%d\t%d\t%d\n", location, status, h.Score(), h.SuccessRate, h.LatencyMs, h.Successes, h.Failures, h.Corruptions)
+						} else {
+							fmt.Fprintf(w, "%s\t%s\n", location, status)
+						}
+					}
+					return w.Flush()
+				},
+			},
+			{
+				Name:  "quarantine",
+				Usage: "Manage the corrupt shards set aside by repairs",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "list",
+						Usage: "List quarantined shards at every location. Usage: quarantine list <storage-location-configuration>",
+						Action: func(c *cli.Context) error {
+							if c.NArg() < 1 {
+								return fmt.Errorf("please provide a storage location configuration file")
+							}
+							pool, err := datastorage.ReadStorageLocationPool(c.Args().Get(0), code.Total())
+							if err != nil {
+								return fmt.Errorf("failed to read storage location configuration file: %w", err)
+							}
+							w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+							fmt.Fprintln(w, "LOCATION\tDATAID\tINDEX\tQUARANTINED\tSIZE")
+							for _, location := range pool {
+								shards, err := sharding.ListQuarantine(store, location)
+								if err != nil {
+									return fmt.Errorf("failed to list quarantine at %s: %w", location, err)
+								}
+								for _, shard := range shards {
+									fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%d\n", location, shard.DataID, shard.Index, shard.Time.Format(time.RFC3339), shard.Size)
+								}
+							}
+							return w.Flush()
+						},
+					},
+					{
+						Name:  "purge",
+						Usage: "Remove quarantined shards. Usage: quarantine purge <storage-location-configuration> [--older-than <duration>]",
+						Flags: []cli.Flag{
+							&cli.DurationFlag{Name: "older-than", Usage: "only remove shards quarantined longer ago than this"},
+							&cli.BoolFlag{Name: "steal-lease", Usage: "take over location leases held by another instance"},
+						},
+						Action: func(c *cli.Context) error {
+							if c.NArg() < 1 {
+								return fmt.Errorf("please provide a storage location configuration file")
+							}
+							pool, err := datastorage.ReadStorageLocationPool(c.Args().Get(0), code.Total())
+							if err != nil {
+								return fmt.Errorf("failed to read storage location configuration file: %w", err)
+							}
+							before := time.Now().Add(-c.Duration("older-than"))
+							total := 0
+							err = datastorage.WithLeases(c.Context, pool, "quarantine-purge", cfg, c.Bool("steal-lease"), logger, func(ctx context.Context) error {
+								for _, location := range pool {
+									if err := ctx.Err(); err != nil {
+										return err
+									}
+									purged, err := sharding.PurgeQuarantine(store, location, before)
+									total += purged
+									if err != nil {
+										return fmt.Errorf("failed to purge quarantine at %s: %w", location, err)
+									}
+								}
+								return nil
+							})
+							if err != nil {
+								return err
+							}
+							fmt.Printf("Purged %d quarantined shards\n", total)
+							return nil
+						},
+					},
+				},
+			},
+			{
+				Name:  "compact",
+				Usage: "Drop cached shards whose files are gone and remove files crashed processes left at locations. Usage: compact <storage-location-configuration>",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{Name: "steal-lease", Usage: "take over location leases held by another instance"},
+				},
+				Action: func(c *cli.Context) error {
+					if c.NArg() < 1 {
+						return fmt.Errorf("please provide a storage location configuration file")
+					}
+					pool, err := datastorage.ReadStorageLocationPool(c.Args().Get(0), code.Total())
+					if err != nil {
+						return fmt.Errorf("failed to read storage location configuration file: %w", err)
+					}
+					var report sharding.CompactReport
+					err = datastorage.WithLeases(c.Context, pool, "compact", cfg, c.Bool("steal-lease"), logger, func(ctx context.Context) (err error) {
+						report, err = sharding.Compact(store, pool)
+						return err
+					})
+					fmt.Printf("Entries dropped: %d (%s), leftover files removed: %d (%s)\n",
+						report.Entries, planning.FormatSize(report.Bytes), report.Leftovers, planning.FormatSize(report.DiskBytes))
+					if err != nil {
+						return fmt.Errorf("compaction failed: %w", err)
+					}
+					return nil
+				},
+			},
+			{
+				Name:  "locations",
+				Usage: "Inspect storage locations",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "status",
+						Usage: "Show whether each location can be written to, by writing to it, and its health. Usage: locations status <storage-location-configuration>",
+						Action: func(c *cli.Context) error {
+							if c.NArg() < 1 {
+								return fmt.Errorf("please provide a storage location configuration file")
+							}
+							pool, err := datastorage.ReadStorageLocationPool(c.Args().Get(0), code.Total())
+							if err != nil {
+								return fmt.Errorf("failed to read storage location configuration file: %w", err)
+							}
+
+							w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+							fmt.Fprintln(w, "LOCATION\tWRITABLE\tHEALTH\tCAPABILITIES\tPROBLEM")
+							for _, location := range pool {
+								writable, problem := "yes", ""
+								capabilities := sharding.Probe(store)
+								if sharding.IsObjectLocation(location) {
+									writable = "unknown"
+									capabilities = sharding.Probe(sharding.NewS3ShardStore(cfg.Bucket, cfg.S3Endpoint))
+								} else if err := sharding.ProbeWritable(location); err != nil {
+									writable, problem = "no", err.Error()
+								}
+								status := "healthy"
+								if health.Score(location) < sharding.HealthyScore {
+									status = "unhealthy"
+								}
+								fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", location, writable, status, capabilities, problem)
+							}
+							return w.Flush()
+						},
+					},
+				},
+			},
+			{
+				Name:  "tune",
+				Usage: "Measure shard throughput at increasing concurrency and recommend MAX_CONCURRENCY. Usage: tune <storage-config>",
+				Flags: []cli.Flag{
+					&cli.IntSliceFlag{Name: "levels", Value: cli.NewIntSlice(1, 2, 4, 8, 16, 32), Usage: "concurrency levels to probe"},
+					&cli.IntFlag{Name: "probes", Value: 32, Usage: "shards written and read back at each level"},
+					&cli.StringFlag{Name: "shard-size", Value: "1MiB", Usage: "size of each probe shard"},
+					&cli.Float64Flag{Name: "error-slack", Value: 0.01, Usage: "error rate a level may exceed the lowest level's by"},
+					&cli.BoolFlag{Name: "json", Usage: "print the measurements as JSON"},
+				},
+				Action: func(c *cli.Context) error {
+					if c.Args().Len() < 1 {
+						return fmt.Errorf("please provide a storage location configuration file")
+					}
+					pool, err := datastorage.ReadStorageLocationPool(c.Args().Get(0), code.Total())
+					if err != nil {
+						return fmt.Errorf("failed to read storage location configuration file: %w", err)
+					}
+					shardSize, err := planning.ParseSize(c.String("shard-size"))
+					if err != nil {
+						return err
+					}
+
+					// Probes bypass health tracking and use a fresh store per
+					// phase, so reads come from the backend, not memory.
+					open := func() sharding.ShardStore {
+						probeStore := sharding.NewInMemoryShardStore()
+						probeStore.PathKey = diskStore.PathKey
+						probeStore.Headers = diskStore.Headers
+						return probeStore
+					}
+					result, err := datastorage.Tune(open, pool, datastorage.TuneOptions{
+						Levels:     c.IntSlice("levels"),
+						Probes:     c.Int("probes"),
+						ShardSize:  int(shardSize),
+						ErrorSlack: c.Float64("error-slack"),
+					}, logger)
+					if err != nil {
+						return fmt.Errorf("tuning failed: %w", err)
+					}
+
+					if c.Bool("json") {
+						data, err := json.MarshalIndent(result, "", "  ")
+						if err != nil {
+							return err
+						}
+						fmt.Println(string(data))
+						return nil
+					}
+					w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+					fmt.Fprintln(w, "CONCURRENCY\tTHROUGHPUT\tERRORS")
+					for _, level := range result.Levels {
+						fmt.Fprintf(w, "%d\t%s/s\t%d/%d\n", level.Concurrency, planning.FormatSize(int64(level.Throughput)), level.Errors, level.Operations)
+					}
+					if err := w.Flush(); err != nil {
+						return err
+					}
+					if result.Leftover > 0 {
+						fmt.Printf("Warning: %d probe shards could not be removed\n", result.Leftover)
+					}
+					fmt.Printf("Recommended: MAX_CONCURRENCY=%d (currently %d)\n", result.Recommended, cfg.MaxConcurrency)
+					return nil
+				},
+			},
+			{
+				Name:  "stress",
+				Usage: "Store random objects and read them back through randomly dropped, corrupted and delayed shards. Usage: stress <storage-config>",
+				Flags: []cli.Flag{
+					&cli.IntFlag{Name: "iterations", Value: 200, Usage: "objects stored and read back"},
+					&cli.Int64Flag{Name: "seed", Usage: "seed of the first iteration (default: the current time)"},
+					&cli.StringFlag{Name: "max-size", Value: "1MiB", Usage: "largest random object"},
+					&cli.DurationFlag{Name: "max-delay", Value: 5 * time.Millisecond, Usage: "longest delay injected into a shard retrieval"},
+					&cli.BoolFlag{Name: "json", Usage: "print the result as JSON"},
+				},
+				Action: func(c *cli.Context) error {
+					if c.Args().Len() < 1 {
+						return fmt.Errorf("please provide a storage location configuration file")
+					}
+					locations, err := datastorage.ReadStorageLocations(c.Args().Get(0), code.Total())
+					if err != nil {
+						return fmt.Errorf("failed to read storage location configuration file: %w", err)
+					}
+					maxSize, err := planning.ParseSize(c.String("max-size"))
+					if err != nil {
+						return err
+					}
+					seed := c.Int64("seed")
+					if !c.IsSet("seed") {
+						seed = time.Now().UnixNano()
+					}
+
+					open := func() sharding.ShardStore {
+						stressStore := sharding.NewInMemoryShardStore()
+						stressStore.PathKey = diskStore.PathKey
+						stressStore.Headers = diskStore.Headers
+						return stressStore
+					}
+					result, err := datastorage.Stress(open, locations, datastorage.StressOptions{
+						Iterations: c.Int("iterations"),
+						Seed:       seed,
+						MaxSize:    int(maxSize),
+						MaxDelay:   c.Duration("max-delay"),
+					}, cfg, zap.NewNop())
+					if err != nil {
+						return fmt.Errorf("stress run failed: %w", err)
+					}
+
+					if c.Bool("json") {
+						data, err := json.MarshalIndent(result, "", "  ")
+						if err != nil {
+							return err
+						}
+						fmt.Println(string(data))
+					} else {
+						fmt.Printf("Seed: %d, iterations: %d (%d within parity, %d beyond), failures: %d\n",
+							seed, result.Iterations, result.Recoverable, result.Unrecoverable, len(result.Failures))
+						for _, failure := range result.Failures {
+							fmt.Printf("  seed %d: %d bytes, %s, %s, faults %s: %s\n", failure.Seed, failure.Size, failure.Code, failure.Layout, failure.Faults, failure.Problem)
+						}
+						if result.Leftover > 0 {
+							fmt.Printf("Warning: %d shards could not be removed\n", result.Leftover)
+						}
+					}
+					if len(result.Failures) > 0 {
+						return fmt.Errorf("%d of %d iterations failed; rerun one with --seed <seed> --iterations 1", len(result.Failures), result.Iterations)
+					}
+					return nil
+				},
+			},
+			{
+				// Plumbing output is for other programs: newline-delimited
+				// JSON whose schema is documented in pkg/plumbing.
+				Name:   "plumbing",
+				Usage:  "Machine-readable output for integrations. Usage: plumbing list|health|locations",
+				Hidden: true,
+				Subcommands: []*cli.Command{
+					{
+						Name:  "list",
+						Usage: "One object record per metadata file",
+						Action: func(c *cli.Context) error {
+							objects, err := datastorage.ListObjects(cfg.MetadataDir)
+							if err != nil {
+								return err
+							}
+							enc := plumbing.NewEncoder(os.Stdout)
+							for _, object := range objects {
+								if err := enc.Encode(plumbing.Object(object)); err != nil {
+									return err
+								}
+							}
+							return nil
+						},
+					},
+					{
+						Name:  "health",
+						Usage: "One object_health record per metadata file",
+						Action: func(c *cli.Context) error {
+							objects, err := datastorage.ListObjects(cfg.MetadataDir)
+							if err != nil {
+								return err
+							}
+							enc := plumbing.NewEncoder(os.Stdout)
+							for _, object := range objects {
+								report, err := datastorage.CheckData(object.MetadataFile, store, datastorage.CheckOptions{}, logger)
+								if err != nil {
+									report = &datastorage.VerifyReport{MetadataFile: object.MetadataFile, DataID: object.DataID, Error: err.Error()}
+								}
+								if err := enc.Encode(plumbing.Health(report)); err != nil {
+									return err
+								}
+							}
+							return nil
+						},
+					},
+					{
+						Name:  "locations",
+						Usage: "One location record per location with recorded health",
+						Action: func(c *cli.Context) error {
+							snapshot := health.Snapshot()
+							locations := make([]string, 0, len(snapshot))
+							for location := range snapshot {
+								locations = append(locations, location)
+							}
+							sort.Strings(locations)
+
+							enc := plumbing.NewEncoder(os.Stdout)
+							for _, location := range locations {
+								if err := enc.Encode(plumbing.Location(location, snapshot[location])); err != nil {
+									return err
+								}
+							}
+							return nil
+						},
+					},
+				},
+			},
+			{
+				Name:  "append",
+				Usage: "Append a file's contents to a streamed object. Usage: append <metadatafile> <filename>",
+				Action: func(c *cli.Context) error {
+					if c.NArg() < 2 {
+						return fmt.Errorf("please provide a metadata file and a file to append")
+					}
+					file, err := os.Open(c.Args().Get(1))
+					if err != nil {
+						return fmt.Errorf("failed to read file: %w", err)
+					}
+					defer file.Close()
+					n, err := datastorage.AppendReader(c.Args().Get(0), file, store, cfg, logger)
+					if err != nil {
+						if errors.Is(err, datastorage.ErrNotAppendable) {
+							return fmt.Errorf("%w; store it with --stream to make it appendable", err)
+						}
+						return fmt.Errorf("append failed: %w", err)
+					}
+					fmt.Printf("Appended %d bytes\n", n)
+					return nil
+				},
+			},
+			{
+				Name:  "lock",
+				Usage: "Make an object write-once for a retention period, or extend its lock. Usage: lock <metadatafile> <duration>",
+				Action: func(c *cli.Context) error {
+					if c.NArg() < 2 {
+						return fmt.Errorf("please provide a metadata file and a duration")
+					}
+					metadataFile := datastorage.ResolveMetadataFile(cfg, c.Args().Get(0))
+					duration, err := time.ParseDuration(c.Args().Get(1))
+					if err != nil || duration <= 0 {
+						return fmt.Errorf("invalid duration %q", c.Args().Get(1))
+					}
+					until := time.Now().Add(duration)
+					if err := datastorage.LockObject(metadataFile, until, store, logger); err != nil {
+						return err
+					}
+					fmt.Printf("Object locked until %s\n", until.UTC().Format(time.RFC3339))
+					return nil
+				},
+			},
+			{
+				Name:  "adopt",
+				Usage: "Take shards written by another erasure-coding tool into the catalog in place. Usage: adopt --shard-pattern '<dir>/{index}.bin' --name <name> --key none|<hex>",
+				Flags: []cli.Flag{
+					&cli.IntFlag{Name: "data", Value: 8, Usage: "data shards in the set"},
+					&cli.IntFlag{Name: "parity", Value: 6, Usage: "parity shards in the set"},
+					&cli.StringFlag{Name: "shard-pattern", Required: true, Usage: "path of each shard file, with {index} for its index"},
+					&cli.StringFlag{Name: "name", Required: true, Usage: "filename to record for the object"},
+					&cli.StringFlag{Name: "key", Required: true, Usage: "none, or the hex key the data was encrypted under with vault's scheme"},
+					&cli.BoolFlag{Name: "external-encryption", Usage: "with --key none: the other tool encrypted the data, so it is retrieved still encrypted"},
+					&cli.Int64Flag{Name: "size", Value: -1, Usage: "bytes of data before padding (default: every data shard byte)"},
+				},
+				Action: func(c *cli.Context) error {
+					opts := datastorage.AdoptOptions{
+						DataShards:   c.Int("data"),
+						ParityShards: c.Int("parity"),
+						ShardPattern: c.String("shard-pattern"),
+						Name:         c.String("name"),
+						External:     c.Bool("external-encryption"),
+						Size:         c.Int64("size"),
+					}
+					if c.String("key") != "none" {
+						if opts.External {
+							return fmt.Errorf("--external-encryption only applies with --key none")
+						}
+						key, err := datastorage.GetEncryptionKey(&config.Config{EncryptionKey: c.String("key")})
+						if err != nil {
+							return fmt.Errorf("invalid --key: %w", err)
+						}
+						opts.Key = key
+					}
+					metadataFile, err := datastorage.AdoptShards(opts, store, cfg, logger)
+					if err != nil {
+						if errors.Is(err, datastorage.ErrShardSizeMismatch) {
+							return fmt.Errorf("adopt failed: %w; every shard of a set must be the same size", err)
+						}
+						return fmt.Errorf("adopt failed: %w", err)
+					}
+					fmt.Printf("Shards adopted; metadata file: %s\n", metadataFile)
+					return nil
+				},
+			},
+			{
+				Name:  "add-candidate",
+				Usage: "Record another location holding a copy of a shard. Usage: add-candidate <metadatafile> <shard-index> <location>",
+				Action: func(c *cli.Context) error {
+					if c.NArg() < 3 {
+						return fmt.Errorf("please provide a metadata file, a shard index and a location")
+					}
+					metadataFile := datastorage.ResolveMetadataFile(cfg, c.Args().Get(0))
+					index, err := strconv.Atoi(c.Args().Get(1))
+					if err != nil {
+						return fmt.Errorf("invalid shard index: %w", err)
+					}
+					if err := datastorage.AddShardCandidate(metadataFile, index, c.Args().Get(2)); err != nil {
+						return fmt.Errorf("failed to record candidate location: %w", err)
+					}
+					fmt.Printf("Shard %d candidate location recorded: %s\n", index, c.Args().Get(2))
+					return nil
+				},
+			},
+			{
+				Name:  "identity",
+				Usage: "Manage recipient identities",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "generate",
+						Usage: "Create an identity file and print its recipient. Usage: identity generate <identity-file>",
+						Action: func(c *cli.Context) error {
+							if c.NArg() < 1 {
+								return fmt.Errorf("please provide the identity file to create")
+							}
+							identity, err := encryption.GenerateIdentity()
+							if err != nil {
+								return fmt.Errorf("failed to generate identity: %w", err)
+							}
+							recipient := encryption.FormatRecipient(identity.PublicKey())
+							contents := fmt.Sprintf("# created: %s\n# recipient: %s\n%s\n", time.Now().Format(time.RFC3339), recipient, encryption.FormatIdentity(identity))
+
+							file, err := os.OpenFile(c.Args().Get(0), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+							if err != nil {
+								return fmt.Errorf("failed to create identity file: %w", err)
+							}
+							defer file.Close()
+							if _, err := file.WriteString(contents); err != nil {
+								return fmt.Errorf("failed to write identity file: %w", err)
+							}
+							fmt.Printf("Recipient: %s\n", recipient)
+							return nil
+						},
+					},
+				},
+			},
+			{
+				Name:  "escrow",
+				Usage: "Split the master key into printable recovery shares, and recover it from them",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "export",
+						Usage: "Print the master key as Shamir shares. Usage: escrow export --i-understand-the-risk [--shares N] [--threshold K]",
+						Flags: []cli.Flag{
+							&cli.IntFlag{Name: "shares", Value: 5, Usage: "number of shares to print"},
+							&cli.IntFlag{Name: "threshold", Value: 3, Usage: "number of shares needed to recover the key"},
+							&cli.BoolFlag{Name: "i-understand-the-risk", Usage: "acknowledge that any threshold of the shares decrypts everything"},
+						},
+						Action: func(c *cli.Context) error {
+							if !c.Bool("i-understand-the-risk") {
+								return fmt.Errorf("anyone holding %d of the shares can decrypt all your data; pass --i-understand-the-risk to print them", c.Int("threshold"))
+							}
+							shares, err := datastorage.ExportEscrow(cfg, c.Int("shares"), c.Int("threshold"))
+							if err != nil {
+								return fmt.Errorf("failed to export escrow shares: %w", err)
+							}
+							fmt.Printf("Vault key recovery shares, created %s\n", time.Now().Format(time.RFC3339))
+							fmt.Printf("Any %d of these %d shares recover the master key with `vault escrow recover`.\n", c.Int("threshold"), len(shares))
+							fmt.Println("Store them apart from each other and from your data.")
+							for i, share := range shares {
+								fmt.Printf("\nShare %d of %d:\n%s\n", i+1, len(shares), share)
+							}
+							return nil
+						},
+					},
+					{
+						Name:  "recover",
+						Usage: "Reassemble the master key from shares given as arguments, or one per line on stdin. Usage: escrow recover --out <key-file> [share...]",
+						Flags: []cli.Flag{
+							&cli.StringFlag{Name: "out", Required: true, Usage: "file the recovered key is written to, as hex"},
+						},
+						Action: func(c *cli.Context) error {
+							shares := c.Args().Slice()
+							if len(shares) == 0 {
+								scanner := bufio.NewScanner(os.Stdin)
+								for scanner.Scan() {
+									if line := strings.TrimSpace(scanner.Text()); line != "" {
+										shares = append(shares, line)
+									}
+								}
+								if err := scanner.Err(); err != nil {
+									return fmt.Errorf("failed to read shares: %w", err)
+								}
+							}
+							key, err := datastorage.RecoverEscrow(shares)
+							if err != nil {
+								return fmt.Errorf("failed to recover key: %w", err)
+							}
+
+							file, err := os.OpenFile(c.String("out"), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+							if err != nil {
+								return fmt.Errorf("failed to create key file: %w", err)
+							}
+							defer file.Close()
+							if _, err := fmt.Fprintf(file, "%x\n", key); err != nil {
+								return fmt.Errorf("failed to write key file: %w", err)
+							}
+							fmt.Printf("Key written to %s; set ENCRYPTION_KEY to its contents\n", c.String("out"))
+							return nil
+						},
+					},
+				},
+			},
+			{
+				Name:    "exit",
+				Aliases: []string{"x"},
+				Usage:   "Exit the CLI",
+				Action: func(c *cli.Context) error {
+					reader := bufio.NewReader(os.Stdin)
+					fmt.Print("Are you sure you want to exit? (y/n): ")
+					resp, _ := reader.ReadString('\n')
+					resp = strings.TrimSpace(strings.ToLower(resp))
+					if resp == "y" || resp == "yes" {
+						fmt.Println("Exiting CLI...")
+						closeStore()
+						closeWorkspace()
+						os.Exit(0)
+					}
+					return nil
+				},
+			},
+		},
+	}
+
+	// Not deferred: logger.Fatal and os.Exit skip deferred calls.
+	err = app.Run(os.Args)
+	closeStore()
+	closeWorkspace()
+	var status exitStatus
+	if errors.As(err, &status) {
+		if status.err != nil {
+			for _, hint := range sharding.Hints(status.err) {
+				fmt.Fprintln(os.Stderr, "hint:", hint)
+			}
+			logger.Error("CLI failed", zap.Error(status.err))
+		}
+		logger.Sync()
+		os.Exit(status.code)
+	}
+	if err != nil {
+		for _, hint := range sharding.Hints(err) {
+			fmt.Fprintln(os.Stderr, "hint:", hint)
+		}
+		logger.Fatal("CLI failed", zap.Error(err))
+	}
+}
+
+// exitStatus ends the CLI with an exit status of its own, as diff exits 1
+// for differences and 2 for trouble, after reporting err if there is one.
+type exitStatus struct {
+	err  error
+	code int
+}
+
+func (e exitStatus) Error() string {
+	if e.err == nil {
+		return fmt.Sprintf("exit status %d", e.code)
+	}
+	return e.err.Error()
+}
+
+func (e exitStatus) Unwrap() error { return e.err }
@@ -0,0 +1,133 @@
+// Package shamir splits secrets into shares with Shamir's secret sharing
+// over GF(2^8), so that any threshold of the shares recover the secret and
+// fewer reveal nothing about it. Every byte of the secret is shared with
+// its own random polynomial; a share's index is the point it is evaluated at.
+package shamir
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+// Share is one share of a secret.
+type Share struct {
+	Index byte // 1 to 255; 0 is where the secret is
+	Value []byte
+}
+
+var (
+	errNoShares        = errors.New("no shares given")
+	errShareLength     = errors.New("shares have different lengths")
+	errDuplicateShares = errors.New("shares have duplicate indexes")
+	errZeroIndex       = errors.New("share index 0 is invalid")
+)
+
+// Split divides secret into n shares, any k of which recover it.
+func Split(secret []byte, n, k int) ([]Share, error) {
+	if k < 2 || k > n || n > 255 {
+		return nil, fmt.Errorf("invalid share counts: need 2 <= threshold (%d) <= shares (%d) <= 255", k, n)
+	}
+	if len(secret) == 0 {
+		return nil, errors.New("empty secret")
+	}
+
+	shares := make([]Share, n)
+	for i := range shares {
+		shares[i] = Share{Index: byte(i + 1), Value: make([]byte, len(secret))}
+	}
+	coefficients := make([]byte, k)
+	for b, s := range secret {
+		coefficients[0] = s
+		if _, err := rand.Read(coefficients[1:]); err != nil {
+			return nil, err
+		}
+		for i := range shares {
+			shares[i].Value[b] = evaluate(coefficients, shares[i].Index)
+		}
+	}
+	return shares, nil
+}
+
+// Combine recovers a secret from shares. Given fewer shares than the
+// threshold it was split with, it returns a wrong secret rather than an
+// error; callers that need to know should check the result.
+func Combine(shares []Share) ([]byte, error) {
+	if len(shares) == 0 {
+		return nil, errNoShares
+	}
+	seen := make(map[byte]bool, len(shares))
+	for _, share := range shares {
+		if share.Index == 0 {
+			return nil, errZeroIndex
+		}
+		if seen[share.Index] {
+			return nil, errDuplicateShares
+		}
+		seen[share.Index] = true
+		if len(share.Value) != len(shares[0].Value) {
+			return nil, errShareLength
+		}
+	}
+
+	// Lagrange interpolation at x = 0; subtraction is xor in GF(2^8).
+	secret := make([]byte, len(shares[0].Value))
+	for j, sj := range shares {
+		basis := byte(1)
+		for m, sm := range shares {
+			if m != j {
+				basis = mul(basis, div(sm.Index, sm.Index^sj.Index))
+			}
+		}
+		for b := range secret {
+			secret[b] ^= mul(sj.Value[b], basis)
+		}
+	}
+	return secret, nil
+}
+
+// evaluate computes the polynomial with the given coefficients, constant
+// term first, at x.
+func evaluate(coefficients []byte, x byte) byte {
+	var y byte
+	for i := len(coefficients) - 1; i >= 0; i-- {
+		y = mul(y, x) ^ coefficients[i]
+	}
+	return y
+}
+
+// Log and exp tables for GF(2^8) with the AES polynomial x^8+x^4+x^3+x+1,
+// generated by 3.
+var (
+	expTable [255]byte
+	logTable [256]byte
+)
+
+func init() {
+	x := byte(1)
+	for i := range expTable {
+		expTable[i] = x
+		logTable[x] = byte(i)
+		// x *= 3, i.e. x ^ 2x with 2x reduced by the polynomial
+		double := x << 1
+		if x&0x80 != 0 {
+			double ^= 0x1b
+		}
+		x ^= double
+	}
+}
+
+func mul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return expTable[(int(logTable[a])+int(logTable[b]))%255]
+}
+
+// div divides a by b, which must not be 0.
+func div(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return expTable[(int(logTable[a])-int(logTable[b])+255)%255]
+}
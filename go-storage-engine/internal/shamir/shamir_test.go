@@ -0,0 +1,146 @@
+package shamir
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+func TestMul(t *testing.T) {
+	// From FIPS-197, section 4.2
+	for _, tc := range []struct{ a, b, want byte }{
+		{0x57, 0x83, 0xc1},
+		{0x57, 0x13, 0xfe},
+		{0x57, 0x00, 0x00},
+		{0x01, 0xab, 0xab},
+	} {
+		if got := mul(tc.a, tc.b); got != tc.want {
+			t.Fatalf("mul(%#x, %#x) = %#x, expected %#x", tc.a, tc.b, got, tc.want)
+		}
+		if tc.b != 0 && div(tc.want, tc.b) != tc.a {
+			t.Fatalf("div(%#x, %#x) = %#x, expected %#x", tc.want, tc.b, div(tc.want, tc.b), tc.a)
+		}
+	}
+}
+
+// vectorShares are the shares of "vault" under the polynomials
+// s + a1·x + a2·x² with a1 = 01 80 ff 3c 5a and a2 = 02 7f 10 c3 a5,
+// one byte of each per byte of the secret.
+var vectorShares = map[byte]string{
+	1: "759e9a938b",
+	2: "7c9dd03562",
+	3: "7f623fca9d",
+	4: "52e6bf18b9",
+	5: "511950e746",
+}
+
+func TestVectors(t *testing.T) {
+	secret := []byte("vault")
+	a1, _ := hex.DecodeString("0180ff3c5a")
+	a2, _ := hex.DecodeString("027f10c3a5")
+	for index, want := range vectorShares {
+		var got []byte
+		for b, s := range secret {
+			got = append(got, evaluate([]byte{s, a1[b], a2[b]}, index))
+		}
+		if hex.EncodeToString(got) != want {
+			t.Fatalf("share %d is %x, expected %s", index, got, want)
+		}
+	}
+	for _, indexes := range [][]byte{{1, 2, 3}, {5, 3, 1}, {2, 4, 5}, {1, 2, 3, 4, 5}} {
+		var shares []Share
+		for _, index := range indexes {
+			value, _ := hex.DecodeString(vectorShares[index])
+			shares = append(shares, Share{Index: index, Value: value})
+		}
+		got, err := Combine(shares)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, secret) {
+			t.Fatalf("shares %v combine to %q, expected %q", indexes, got, secret)
+		}
+	}
+}
+
+// subsets calls f with every subset of k of the n indexes 0 to n-1.
+func subsets(n, k int, f func([]int)) {
+	var walk func(start int, chosen []int)
+	walk = func(start int, chosen []int) {
+		if len(chosen) == k {
+			f(chosen)
+			return
+		}
+		for i := start; i < n; i++ {
+			walk(i+1, append(chosen, i))
+		}
+	}
+	walk(0, nil)
+}
+
+func TestRoundTrip(t *testing.T) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		t.Fatal(err)
+	}
+	for n := 2; n <= 7; n++ {
+		for k := 2; k <= n; k++ {
+			shares, err := Split(secret, n, k)
+			if err != nil {
+				t.Fatalf("Split(%d, %d): %v", n, k, err)
+			}
+			subsets(n, k, func(chosen []int) {
+				var picked []Share
+				for _, i := range chosen {
+					picked = append(picked, shares[i])
+				}
+				got, err := Combine(picked)
+				if err != nil || !bytes.Equal(got, secret) {
+					t.Fatalf("%d of %d, shares %v: combined to %x, %v", k, n, chosen, got, err)
+				}
+			})
+			// One share short recovers something else
+			got, err := Combine(shares[:k-1])
+			if err == nil && bytes.Equal(got, secret) {
+				t.Fatalf("%d of %d: %d shares recovered the secret", k, n, k-1)
+			}
+		}
+	}
+}
+
+func TestSplitLimits(t *testing.T) {
+	for _, tc := range []struct{ n, k int }{{3, 1}, {2, 3}, {256, 2}} {
+		if _, err := Split([]byte("secret"), tc.n, tc.k); err == nil {
+			t.Fatalf("Split accepted %d shares with threshold %d", tc.n, tc.k)
+		}
+	}
+	if _, err := Split(nil, 3, 2); err == nil {
+		t.Fatal("Split accepted an empty secret")
+	}
+	if _, err := Split([]byte("secret"), 255, 255); err != nil {
+		t.Fatalf("Split(255, 255): %v", err)
+	}
+}
+
+func TestCombineRejects(t *testing.T) {
+	shares, err := Split([]byte("secret"), 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name   string
+		shares []Share
+		want   error
+	}{
+		{"none", nil, errNoShares},
+		{"duplicate", []Share{shares[0], shares[0]}, errDuplicateShares},
+		{"zero index", []Share{{Index: 0, Value: shares[0].Value}, shares[1]}, errZeroIndex},
+		{"lengths", []Share{shares[0], {Index: shares[1].Index, Value: shares[1].Value[1:]}}, errShareLength},
+	} {
+		if _, err := Combine(tc.shares); !errors.Is(err, tc.want) {
+			t.Fatalf("%s: Combine returned %v, expected %v", tc.name, err, tc.want)
+		}
+	}
+}
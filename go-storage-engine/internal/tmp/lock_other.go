@@ -0,0 +1,13 @@
+//go:build !unix
+
+package tmp
+
+import "os"
+
+// Locks are only implemented on unix; elsewhere every lock is taken, and
+// sweeps go by age alone, so a workspace in use for longer than the max
+// age may be swept.
+
+func tryLock(file *os.File) (bool, error) { return true, nil }
+
+func unlock(file *os.File) error { return nil }
@@ -0,0 +1,360 @@
+// Package tmp keeps the vault's temporary files in one place, a root
+// directory holding:
+//
+//   - a workspace directory for each invocation, removed when it ends,
+//     including on SIGINT and SIGTERM;
+//   - a staging directory for files meant to outlive an invocation, such as
+//     the partial downloads --resume continues;
+//
+// and sweeps it at startup of what crashed invocations left behind.
+package tmp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// DefaultMaxAge is how old an orphaned workspace or staged file gets
+// before a sweep removes it.
+const DefaultMaxAge = 24 * time.Hour
+
+const (
+	workspacePrefix = "ws-"
+	lockSuffix      = ".lock"
+	stagingDir      = "staging"
+	sweepLock       = ".sweep.lock"
+)
+
+// Root returns dir, or without one a directory of the current user's own
+// under os.TempDir.
+func Root(dir string) string {
+	if dir != "" {
+		return dir
+	}
+	if uid := os.Getuid(); uid >= 0 {
+		return filepath.Join(os.TempDir(), fmt.Sprintf("getvault-%d", uid))
+	}
+	// Windows has no uids, and a temporary directory for each user
+	return filepath.Join(os.TempDir(), "getvault")
+}
+
+// makeRoot creates root, readable by the current user only, and refuses
+// anything but a directory there, such as a symlink planted to redirect it.
+func makeRoot(root string) error {
+	if err := os.MkdirAll(root, 0o700); err != nil {
+		return fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	info, err := os.Lstat(root)
+	if err != nil {
+		return fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("temporary directory %s is not a directory", root)
+	}
+	return nil
+}
+
+// Workspace is the temporary directory of one invocation. It holds a lock
+// on the sidecar "<Dir>.lock" for as long as it is open, so sweeps by
+// other instances leave it alone however old it gets.
+type Workspace struct {
+	Dir string
+
+	mu   sync.Mutex
+	lock *os.File
+}
+
+var (
+	currentMu sync.Mutex
+	current   *Workspace
+)
+
+// Open creates a workspace under root and makes it the one CreateTemp and
+// MkdirTemp use until it is closed.
+func Open(root string) (*Workspace, error) {
+	w, err := newWorkspace(root)
+	if err != nil {
+		return nil, err
+	}
+	currentMu.Lock()
+	current = w
+	currentMu.Unlock()
+	return w, nil
+}
+
+func newWorkspace(root string) (*Workspace, error) {
+	if err := makeRoot(root); err != nil {
+		return nil, err
+	}
+	dir, err := os.MkdirTemp(root, workspacePrefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create workspace: %w", err)
+	}
+	lock, err := os.OpenFile(dir+lockSuffix, os.O_RDWR|os.O_CREATE, 0o600)
+	if err == nil {
+		var locked bool
+		if locked, err = tryLock(lock); err == nil && !locked {
+			err = errors.New("locked by another process")
+		}
+		if err != nil {
+			lock.Close()
+		}
+	}
+	if err != nil {
+		os.Remove(dir)
+		return nil, fmt.Errorf("failed to lock workspace: %w", err)
+	}
+	return &Workspace{Dir: dir, lock: lock}, nil
+}
+
+// Close removes the workspace and everything in it. Closing it again does
+// nothing.
+func (w *Workspace) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.lock == nil {
+		return nil
+	}
+	currentMu.Lock()
+	if current == w {
+		current = nil
+	}
+	currentMu.Unlock()
+	err := os.RemoveAll(w.Dir)
+	// The lock file goes while still held, so no sweep takes it for an orphan's
+	os.Remove(w.lock.Name())
+	w.lock.Close()
+	w.lock = nil
+	if err != nil {
+		return fmt.Errorf("failed to remove workspace: %w", err)
+	}
+	return nil
+}
+
+// RemoveOnSignal closes the workspace on SIGINT or SIGTERM, which would
+// otherwise end the process with it left behind, and exits with the status
+// a shell gives a command killed by the signal. The function returned
+// stops it, for commands that shut down on the signals themselves and
+// close the workspace on their way out.
+func (w *Workspace) RemoveOnSignal() (stop func()) {
+	signals := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-signals:
+			w.Close()
+			code := 1
+			if s, ok := sig.(syscall.Signal); ok {
+				code = 128 + int(s)
+			}
+			os.Exit(code)
+		case <-done:
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			signal.Stop(signals)
+			close(done)
+		})
+	}
+}
+
+// CreateTemp creates a temporary file, as os.CreateTemp does, in the
+// invocation's workspace, or in os.TempDir if none is open.
+func CreateTemp(pattern string) (*os.File, error) {
+	return os.CreateTemp(currentDir(), pattern)
+}
+
+// MkdirTemp creates a temporary directory, as os.MkdirTemp does, in the
+// invocation's workspace, or in os.TempDir if none is open.
+func MkdirTemp(pattern string) (string, error) {
+	return os.MkdirTemp(currentDir(), pattern)
+}
+
+func currentDir() string {
+	currentMu.Lock()
+	defer currentMu.Unlock()
+	if current == nil {
+		return ""
+	}
+	return current.Dir
+}
+
+// Staging returns the directory under root for files meant to outlive an
+// invocation, creating it. A sweep removes those left untouched for its
+// max age, so a file picked up again should have its modification time
+// refreshed.
+func Staging(root string) (string, error) {
+	if err := makeRoot(root); err != nil {
+		return "", err
+	}
+	dir := filepath.Join(root, stagingDir)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", fmt.Errorf("failed to create staging directory: %w", err)
+	}
+	return dir, nil
+}
+
+// Sweep removes from root the workspaces of invocations that ended
+// without removing them, once older than maxAge, and staged files left
+// untouched as long, and returns what it removed. A workspace whose lock
+// is held belongs to a running invocation and is kept whatever its age.
+// One sweep runs at a time: if another instance is sweeping, Sweep leaves
+// it to that one.
+func Sweep(root string, maxAge time.Duration) ([]string, error) {
+	entries, err := os.ReadDir(root)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to sweep temporary directory: %w", err)
+	}
+	guard, err := os.OpenFile(filepath.Join(root, sweepLock), os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sweep temporary directory: %w", err)
+	}
+	defer guard.Close()
+	if locked, err := tryLock(guard); err != nil || !locked {
+		return nil, err
+	}
+	defer unlock(guard)
+
+	cutoff := time.Now().Add(-maxAge)
+	var removed []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, workspacePrefix) || strings.HasSuffix(name, lockSuffix) {
+			continue
+		}
+		dir := filepath.Join(root, name)
+		if info, err := entry.Info(); err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+		ok, err := removeWorkspace(dir)
+		if err != nil {
+			return removed, err
+		}
+		if ok {
+			removed = append(removed, dir)
+		}
+	}
+	// Lock files whose workspace is gone, from a crash partway through removing it
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, workspacePrefix) || !strings.HasSuffix(name, lockSuffix) {
+			continue
+		}
+		dir := filepath.Join(root, strings.TrimSuffix(name, lockSuffix))
+		if _, err := os.Lstat(dir); errors.Is(err, os.ErrNotExist) {
+			if _, err := removeWorkspace(dir); err != nil {
+				return removed, err
+			}
+		}
+	}
+
+	staged, err := RemoveStale(filepath.Join(root, stagingDir), "*", maxAge)
+	return append(removed, staged...), err
+}
+
+// removeWorkspace removes dir and its lock file unless the lock is held,
+// and reports whether it did.
+func removeWorkspace(dir string) (bool, error) {
+	lock, err := os.OpenFile(dir+lockSuffix, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return false, fmt.Errorf("failed to sweep workspace: %w", err)
+	}
+	defer lock.Close()
+	locked, err := tryLock(lock)
+	if err != nil || !locked {
+		return false, err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return false, fmt.Errorf("failed to sweep workspace: %w", err)
+	}
+	os.Remove(lock.Name())
+	return true, nil
+}
+
+// RemoveStale removes the files in dir matching pattern that haven't been
+// modified for maxAge, and returns what it removed. For directories that
+// keep their own temporary files next to the ones they replace, such as
+// the object cache, where an interrupted write leaves one behind.
+func RemoveStale(dir, pattern string, maxAge time.Duration) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to sweep %s: %w", dir, err)
+	}
+	cutoff := time.Now().Add(-maxAge)
+	var removed []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		if ok, _ := filepath.Match(pattern, entry.Name()); !ok {
+			continue
+		}
+		if info, err := entry.Info(); err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return removed, fmt.Errorf("failed to sweep %s: %w", dir, err)
+		}
+		removed = append(removed, path)
+	}
+	return removed, nil
+}
+
+// Move renames src to dst, copying it across when they are on different
+// file systems, as a workspace or staging directory and the destination
+// may be. The copy is written next to dst and renamed into place, so dst
+// is never left half-written.
+func Move(src, dst string) error {
+	renameErr := os.Rename(src, dst)
+	if renameErr == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return renameErr
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		return renameErr
+	}
+	out, err := os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+"-*")
+	if err != nil {
+		return fmt.Errorf("failed to move %s: %w", src, err)
+	}
+	defer os.Remove(out.Name())
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Chmod(info.Mode().Perm())
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(out.Name(), dst)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to move %s: %w", src, err)
+	}
+	in.Close()
+	os.Remove(src)
+	return nil
+}
@@ -0,0 +1,125 @@
+package tmp
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// crash leaves a workspace behind as a killed invocation would, unlocked
+// and not removed, last modified age ago.
+func crash(t *testing.T, w *Workspace, age time.Duration) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(w.Dir, "archive.zip"), []byte("left behind"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	w.lock.Close()
+	backdate(t, w.Dir, age)
+}
+
+func backdate(t *testing.T, path string, age time.Duration) {
+	t.Helper()
+	then := time.Now().Add(-age)
+	if err := os.Chtimes(path, then, then); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+func TestSweepCollectsOrphans(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "tmp")
+	orphan, err := newWorkspace(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crash(t, orphan, 2*time.Hour)
+	// Crashed too, but so recently it may be an invocation still starting up
+	fresh, err := newWorkspace(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crash(t, fresh, time.Minute)
+
+	staging, err := Staging(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale, resumable := filepath.Join(staging, "old.part"), filepath.Join(staging, "new.part")
+	for _, path := range []string{stale, resumable} {
+		if err := os.WriteFile(path, []byte("partial"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	backdate(t, stale, 2*time.Hour)
+
+	// The rerun sweeps at startup
+	removed, err := Sweep(root, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(removed)
+	if want := []string{stale, orphan.Dir}; !slices.Equal(removed, slices.Sorted(slices.Values(want))) {
+		t.Fatalf("swept %v, expected %v", removed, want)
+	}
+	if exists(orphan.Dir) || exists(orphan.Dir+lockSuffix) || exists(stale) {
+		t.Fatal("the orphaned workspace or stale staged file survived the sweep")
+	}
+	if !exists(filepath.Join(fresh.Dir, "archive.zip")) || !exists(resumable) {
+		t.Fatal("the sweep removed a fresh workspace or staged file")
+	}
+}
+
+func TestWorkspaceRemovedOnClose(t *testing.T) {
+	root := t.TempDir()
+	w, err := Open(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(w.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0o700 {
+		t.Fatalf("workspace created with mode %o, expected 700", perm)
+	}
+	file, err := CreateTemp("diff-*.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	if filepath.Dir(file.Name()) != w.Dir {
+		t.Fatalf("temporary file created in %s, expected the workspace %s", filepath.Dir(file.Name()), w.Dir)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("closing again: %v", err)
+	}
+	if exists(w.Dir) || exists(w.Dir+lockSuffix) {
+		t.Fatal("the workspace outlived closing it")
+	}
+	if currentDir() != "" {
+		t.Fatal("a closed workspace is still used for temporary files")
+	}
+}
+
+func TestMove(t *testing.T) {
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "a.part"), filepath.Join(dir, "a")
+	if err := os.WriteFile(src, []byte("contents"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := Move(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(dst); err != nil || string(got) != "contents" || exists(src) {
+		t.Fatalf("moved to %q, %v; source left: %v", got, err, exists(src))
+	}
+}
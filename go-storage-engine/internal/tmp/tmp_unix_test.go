@@ -0,0 +1,50 @@
+//go:build unix
+
+package tmp
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSweepSparesLockedWorkspaces(t *testing.T) {
+	root := t.TempDir()
+	// A long-running invocation's workspace is old but still locked
+	running, err := newWorkspace(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer running.Close()
+	backdate(t, running.Dir, 48*time.Hour)
+	orphan, err := newWorkspace(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crash(t, orphan, 48*time.Hour)
+
+	// Another instance is sweeping: this one leaves it be
+	guard, err := os.OpenFile(filepath.Join(root, sweepLock), os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if locked, err := tryLock(guard); err != nil || !locked {
+		t.Fatalf("failed to take the sweep lock: %v", err)
+	}
+	if removed, err := Sweep(root, time.Hour); err != nil || len(removed) != 0 {
+		t.Fatalf("swept %v, %v while another sweep held the lock", removed, err)
+	}
+	guard.Close()
+
+	removed, err := Sweep(root, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || removed[0] != orphan.Dir {
+		t.Fatalf("swept %v, expected only %s", removed, orphan.Dir)
+	}
+	if !exists(running.Dir) {
+		t.Fatal("the sweep removed a running invocation's workspace")
+	}
+}
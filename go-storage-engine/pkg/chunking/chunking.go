@@ -0,0 +1,123 @@
+// Package chunking cuts a stream into content-defined chunks. A boundary
+// falls wherever a rolling hash of the last bytes read matches a pattern,
+// so it depends only on the bytes around it: inserting or removing bytes
+// moves the boundaries near the edit and leaves the chunks elsewhere as
+// they were. The hash is a gear hash, as in FastCDC: each byte shifts the
+// hash left and adds a random value for the byte, so bytes more than 64
+// positions back have been shifted out.
+package chunking
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+// gear holds the value each byte adds to the hash. It is derived from a
+// fixed seed, because chunks only match across stores cut with the same
+// table.
+var gear = func() [256]uint64 {
+	var table [256]uint64
+	for i := range table {
+		sum := sha256.Sum256([]byte{'g', 'e', 'a', 'r', byte(i)})
+		table[i] = binary.BigEndian.Uint64(sum[:8])
+	}
+	return table
+}()
+
+// Chunker reads content-defined chunks from a reader.
+type Chunker struct {
+	r        io.Reader
+	buf      []byte
+	start    int // First byte in buf not yet returned
+	end      int // End of the bytes read into buf
+	min, max int
+	mask     uint64
+	eof      bool
+}
+
+// Sizes returns the smallest and largest chunks cut for an average size,
+// a quarter and four times it, with the largest capped at limit.
+func Sizes(average, limit int) (int, int) {
+	return max(1, average/4), max(1, min(average*4, limit))
+}
+
+// New returns a Chunker cutting r into chunks of about average bytes, and
+// never more than limit. The boundaries depend on average, so only chunks
+// cut with the same average can match.
+func New(r io.Reader, average, limit int) (*Chunker, error) {
+	if average < 64 || limit < average {
+		return nil, fmt.Errorf("invalid chunk sizes: average %d, limit %d", average, limit)
+	}
+	minSize, maxSize := Sizes(average, limit)
+	// A boundary is a hash whose top bits are all zero, which is as likely
+	// as 1 in the average size past the minimum
+	maskBits := bits.Len(uint(average - minSize))
+	return &Chunker{
+		r:    r,
+		buf:  make([]byte, maxSize),
+		min:  minSize,
+		max:  maxSize,
+		mask: ^uint64(0) << (64 - maskBits),
+	}, nil
+}
+
+// MaxSize returns the size of the largest chunk Next can return.
+func (c *Chunker) MaxSize() int {
+	return c.max
+}
+
+// Next returns the next chunk, or io.EOF after the last one. The chunk is
+// only valid until the following call.
+func (c *Chunker) Next() ([]byte, error) {
+	if err := c.fill(); err != nil {
+		return nil, err
+	}
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+	data := c.buf[c.start:c.end]
+	cut := c.cut(data)
+	c.start += cut
+	return data[:cut], nil
+}
+
+// fill moves the unreturned bytes to the front of the buffer and reads
+// until it is full or the reader is drained.
+func (c *Chunker) fill() error {
+	if c.end-c.start >= c.max || c.eof {
+		return nil
+	}
+	c.end = copy(c.buf, c.buf[c.start:c.end])
+	c.start = 0
+	n, err := io.ReadFull(c.r, c.buf[c.end:])
+	c.end += n
+	switch err {
+	case nil:
+	case io.EOF, io.ErrUnexpectedEOF:
+		c.eof = true
+	default:
+		return err
+	}
+	return nil
+}
+
+// cut returns the length of the chunk at the start of data: up to the
+// first boundary past the minimum size, or all of data up to the maximum.
+func (c *Chunker) cut(data []byte) int {
+	if len(data) <= c.min {
+		return len(data)
+	}
+	end := min(len(data), c.max)
+	var hash uint64
+	// The bytes before the minimum are only hashed to fill the window
+	for i := max(0, c.min-64); i < end; i++ {
+		hash = hash<<1 + gear[data[i]]
+		if i >= c.min && hash&c.mask == 0 {
+			return i + 1
+		}
+	}
+	return end
+}
@@ -0,0 +1,177 @@
+package chunking
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"slices"
+	"testing"
+	"testing/iotest"
+)
+
+// pseudoRandom returns n bytes drawn from seed, the same on every run.
+func pseudoRandom(seed int64, n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+// boundaries cuts r into chunks and returns the offset each ends at,
+// failing the test unless they cover every byte read.
+func boundaries(t testing.TB, r io.Reader, average, limit int) []int {
+	t.Helper()
+	chunker, err := New(r, average, limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ends []int
+	offset := 0
+	for {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
+			return ends
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		offset += len(chunk)
+		ends = append(ends, offset)
+	}
+}
+
+// TestBoundariesAreDeterministic checks that the same bytes are cut at
+// the same places on every run and however the reader hands them over,
+// and that the boundaries for a seed are the ones pinned here, since
+// chunks only match across stores cut the same way.
+func TestBoundariesAreDeterministic(t *testing.T) {
+	data := pseudoRandom(964, 1<<20)
+	want := boundaries(t, bytes.NewReader(data), 8<<10, 64<<10)
+	if len(want) < 64 || want[len(want)-1] != len(data) {
+		t.Fatalf("1 MiB cut into %d chunks ending at %d", len(want), want[len(want)-1])
+	}
+	for name, r := range map[string]io.Reader{
+		"again":    bytes.NewReader(data),
+		"one byte": iotest.OneByteReader(bytes.NewReader(data)),
+		"halves":   iotest.HalfReader(bytes.NewReader(data)),
+	} {
+		if got := boundaries(t, r, 8<<10, 64<<10); !slices.Equal(got, want) {
+			t.Fatalf("%s: cut at %d boundaries, differing from the first %d", name, len(got), len(want))
+		}
+	}
+
+	// The gear table and the cut rule pin the first boundaries; should
+	// these change, chunks stored before no longer match
+	if first := want[:4]; !slices.Equal(first, pinnedBoundaries) {
+		t.Fatalf("first boundaries %v, expected %v", first, pinnedBoundaries)
+	}
+}
+
+// pinnedBoundaries are the first chunk ends of pseudoRandom(964, 1<<20)
+// at an average of 8 KiB.
+var pinnedBoundaries = []int{11468, 18018, 47533, 66317}
+
+// TestEditMovesOnlyNearbyBoundaries inserts bytes in the middle of a
+// stream and checks that the chunks before the edit are cut as they were,
+// and those well after it are the same chunks shifted along: only the
+// chunks around the edit are new.
+func TestEditMovesOnlyNearbyBoundaries(t *testing.T) {
+	const average, limit = 8 << 10, 64 << 10
+	_, maxSize := Sizes(average, limit)
+	data := pseudoRandom(960, 1<<20)
+	at, insert := len(data)/2, []byte("inserted in the middle of the stream")
+	edited := slices.Concat(data[:at], insert, data[at:])
+
+	before := boundaries(t, bytes.NewReader(data), average, limit)
+	after := boundaries(t, bytes.NewReader(edited), average, limit)
+	shifted := make(map[int]bool)
+	for _, end := range after {
+		shifted[end-len(insert)] = true
+	}
+	kept := 0
+	for _, end := range before {
+		switch {
+		case end <= at:
+			if !slices.Contains(after, end) {
+				t.Fatalf("boundary at %d before the edit at %d moved", end, at)
+			}
+		case end >= at+maxSize:
+			// The first boundary past the edit is at most a chunk away,
+			// and from there the boundaries are the old ones shifted
+			if !shifted[end] {
+				t.Fatalf("boundary at %d, well after the edit at %d, wasn't kept", end, at)
+			}
+		}
+		if end <= at || shifted[end] {
+			kept++
+		}
+	}
+	if changed := len(after) - kept; changed > 3 {
+		t.Fatalf("%d of %d chunks changed by an edit of %d bytes", changed, len(after), len(insert))
+	}
+}
+
+// TestChunkSizeLimits cuts random and uniform data, whose gear hash
+// repeats and cuts as often or as seldom as it can, and checks every
+// chunk but the last is within the smallest and largest sizes.
+func TestChunkSizeLimits(t *testing.T) {
+	for _, tc := range []struct{ average, limit int }{
+		{64, 64},
+		{1000, 1500},
+		{8 << 10, 64 << 10},
+		{8 << 10, 16 << 10},
+	} {
+		minSize, maxSize := Sizes(tc.average, tc.limit)
+		if minSize != tc.average/4 || maxSize != min(tc.average*4, tc.limit) {
+			t.Fatalf("Sizes(%d, %d) = %d, %d", tc.average, tc.limit, minSize, maxSize)
+		}
+		for name, data := range map[string][]byte{
+			"random":  pseudoRandom(int64(tc.average), 50*tc.average+17),
+			"zeros":   make([]byte, 50*tc.average+17),
+			"repeats": bytes.Repeat([]byte("ab"), 25*tc.average+9),
+		} {
+			chunker, err := New(bytes.NewReader(data), tc.average, tc.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if chunker.MaxSize() != maxSize {
+				t.Fatalf("MaxSize %d, expected %d", chunker.MaxSize(), maxSize)
+			}
+			ends := boundaries(t, bytes.NewReader(data), tc.average, tc.limit)
+			if ends[len(ends)-1] != len(data) {
+				t.Fatalf("%s at %d: chunks end at %d of %d bytes", name, tc.average, ends[len(ends)-1], len(data))
+			}
+			start := 0
+			for i, end := range ends {
+				size := end - start
+				if size > maxSize || size < minSize && i < len(ends)-1 || size == 0 {
+					t.Fatalf("%s at average %d, limit %d: chunk %d of %d bytes, expected %d to %d", name, tc.average, tc.limit, i, size, minSize, maxSize)
+				}
+				start = end
+			}
+		}
+	}
+
+	for _, sizes := range [][2]int{{63, 1000}, {1000, 999}, {0, 0}} {
+		if _, err := New(bytes.NewReader(nil), sizes[0], sizes[1]); err == nil {
+			t.Fatalf("New accepted average %d and limit %d", sizes[0], sizes[1])
+		}
+	}
+}
+
+func BenchmarkChunker(b *testing.B) {
+	data := pseudoRandom(964, 64<<20)
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		chunker, err := New(bytes.NewReader(data), 1<<20, 8<<20)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for {
+			if _, err := chunker.Next(); err == io.EOF {
+				break
+			} else if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
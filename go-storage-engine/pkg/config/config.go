@@ -2,6 +2,10 @@ package config
 
 import (
 	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/spf13/viper"
@@ -15,8 +19,96 @@ type Config struct {
 	Bucket                string
 	MetricsInterval       time.Duration
 	ShardStorageLocations []string
+	LeaseTTL              time.Duration
+	ObfuscateShardPaths   bool
+	ShardPathKey          string
+	MaxConcurrency        int
+	MaxInFlightBytes      int64
+	MetadataDir           string
+	Recipients            []string
+	IdentityFile          string
+	StreamingThreshold    int64
+	ShardRetryAttempts    int
+	ShardRetryDelay       time.Duration
+	MaxRetriesPerOp       int
+	TierColdAfter         time.Duration
+	ColdLocations         string
+	TierRequireAllowCold  bool
+	TierInterval          time.Duration
+	AdminToken            string
+	TokensFile            string
+	ServerToken           string
+	HealthFile            string
+	MaxObjectSize         int64
+	MaxShardSize          int64
+	KeyringFile           string
+	VerifyOnly            bool
+	BufferPoolMax         int64
+	TombstoneRetention    time.Duration
+	CompactRatio          float64
+	CompactInterval       time.Duration
+	Transforms            []string
+	MetadataNameTemplate  string
+	MetadataExt           string
+	PreviewSize           int
+	TrashRetention        time.Duration
+	ChunkSize             int64
+	CPUWorkers            int
+	CacheDir              string
+	CacheMaxBytes         int64
+	CacheEncrypt          bool
+	ErasureField          string
+	RetrieveUnchecked     bool
+	IDMode                string
+	ShardStoreLayers      []string
+	FaultPlan             string
+	Profile               string
+	Convergent            bool
+	ServeMemoryBudget     int64
+	ServeRequestMemoryMax int64
+	ServeMemoryWait       time.Duration
+	ServeCompression      string
+	ShardHeaders          bool
+	ZonePlacement         string
+	VerifyOnWrite         bool
+	HealthTextfile        string
+	RetrieveConflict      string
+	TmpDir                string
+	TmpMaxAge             time.Duration
+	VerifyOnEncode        bool
 }
 
+// Values of ID_MODE. Ciphertext dataIDs are the sha256 of an object's
+// ciphertext, so storing the same file twice gives two IDs; content
+// dataIDs are an HMAC of its plaintext under a key derived from the
+// master key, the same every time.
+const (
+	IDModeCiphertext = "ciphertext"
+	IDModeContent    = "content"
+)
+
+// Values of ZONE_PLACEMENT, what store does when the locations it picks
+// can't be spread over their zones so that losing any one leaves enough
+// shards to recover the object: warn and store anyway, or fail.
+const (
+	ZonePlacementWarn  = "warn"
+	ZonePlacementError = "error"
+)
+
+// Values of RETRIEVE_CONFLICT, what retrieve does with a file it would
+// write, on its own or extracted from a directory archive, that exists
+// already: fail before writing anything, overwrite it, skip it and keep
+// the existing one, or write the new one next to it as "name (restored)".
+const (
+	ConflictFail         = "fail"
+	ConflictOverwrite    = "overwrite"
+	ConflictSkipExisting = "skip-existing"
+	ConflictRenameNew    = "rename-new"
+)
+
+// ConflictPolicies are the values of RETRIEVE_CONFLICT.
+var ConflictPolicies = []string{ConflictFail, ConflictOverwrite, ConflictSkipExisting, ConflictRenameNew}
+
 func LoadConfig() *Config {
 	viper.AutomaticEnv()
 	// Set defaults
@@ -26,6 +118,58 @@ func LoadConfig() *Config {
 	viper.SetDefault("BUCKET", "your-bucket")
 	viper.SetDefault("METRICS_INTERVAL", 10*time.Second)
 	viper.SetDefault("SHARD_STORAGE_LOCATIONS", []string{"/path/to/location1", "/path/to/location2"}) // Default storage locations
+	viper.SetDefault("LEASE_TTL", 2*time.Minute)
+	viper.SetDefault("OBFUSCATE_SHARD_PATHS", false)
+	viper.SetDefault("MAX_CONCURRENCY", 4)
+	viper.SetDefault("MAX_IN_FLIGHT_BYTES", 256<<20) // Memory the segments of a streamed store hold at once
+	viper.SetDefault("STREAMING_THRESHOLD", 256<<20) // Larger objects are streamed; 0 disables streaming
+	viper.SetDefault("SHARD_RETRY_ATTEMPTS", 3)
+	viper.SetDefault("SHARD_RETRY_DELAY", 100*time.Millisecond)
+	viper.SetDefault("MAX_RETRIES_PER_OP", 10)           // Shared by all shards of an operation; -1 for unlimited
+	viper.SetDefault("TIER_COLD_AFTER", 90*24*time.Hour) // Objects not retrieved for this long are demoted
+	viper.SetDefault("TIER_REQUIRE_ALLOW_COLD", false)
+	viper.SetDefault("TIER_INTERVAL", time.Duration(0))                     // How often serve runs tiering; 0 disables it
+	viper.SetDefault("MAX_OBJECT_SIZE", 0)                                  // Largest object accepted, in bytes; 0 for unlimited
+	viper.SetDefault("MAX_SHARD_SIZE", 0)                                   // Largest shard file written, in bytes; larger objects are segmented; 0 for unlimited
+	viper.SetDefault("BUFFER_POOL_MAX", 256<<20)                            // Largest buffer kept for reuse between operations, in bytes; 0 disables pooling
+	viper.SetDefault("TOMBSTONE_RETENTION", 30*24*time.Hour)                // Deleted objects stay in the catalog this long before compaction drops them
+	viper.SetDefault("COMPACT_RATIO", 0.25)                                 // Fraction of catalog entries that are tombstones at which serve compacts it
+	viper.SetDefault("COMPACT_INTERVAL", time.Hour)                         // How often serve empties the trash and checks the tombstone ratio; 0 disables it
+	viper.SetDefault("METADATA_NAME_TEMPLATE", DefaultMetadataNameTemplate) // Names of new metadata files; see MetadataNameTemplate
+	viper.SetDefault("METADATA_EXT", DefaultMetadataExt)
+	viper.SetDefault("PREVIEW_SIZE", 256)               // Longest side of the thumbnails store --preview makes, in pixels
+	viper.SetDefault("TRASH_RETENTION", 7*24*time.Hour) // Deleted objects can be restored this long before their shards are purged
+	viper.SetDefault("CHUNK_SIZE", 0)                   // Average size of the content-defined chunks streamed objects are cut into, so versions share them; 0 cuts fixed segments
+	viper.SetDefault("CPU_WORKERS", 0)                  // Segments of a streamed object encrypted and coded at once; 0 for one per CPU
+	viper.SetDefault("CACHE_DIR", "")                   // Directory retrieved objects are cached in, as plaintext unless CACHE_ENCRYPT is set; empty disables the cache
+	viper.SetDefault("CACHE_MAX_BYTES", 1<<30)          // Size the cache is kept under by evicting the least recently used unpinned objects
+	viper.SetDefault("CACHE_ENCRYPT", false)            // Encrypt cached objects under a key derived from the master key
+	viper.SetDefault("ERASURE_FIELD", "auto")           // Field shards are coded over: gf8, gf16 for more than 256 shards, or auto to pick by shard count
+	viper.SetDefault("ID_MODE", IDModeCiphertext)       // What dataIDs are a hash of: ciphertext, unique to every store, or content, the same for the same plaintext
+	// Layers around the shard store, space-separated, chained in a fixed
+	// order whatever order they are given in; "none" for no layers
+	viper.SetDefault("SHARD_STORE_LAYERS", []string{"health"})
+	viper.SetDefault("SERVE_MEMORY_BUDGET", 1<<30)        // Memory the retrievals serve is serving may reserve between them, in bytes; 0 for unlimited
+	viper.SetDefault("SERVE_REQUEST_MEMORY_MAX", 0)       // Most memory a single retrieval may reserve; larger ones are refused; 0 for the whole budget
+	viper.SetDefault("SERVE_MEMORY_WAIT", 5*time.Second)  // How long a retrieval waits for memory before serve answers 503 Service Unavailable
+	viper.SetDefault("SERVE_COMPRESSION", "none")         // Content coding serve compresses usage, metrics and token responses in, like gzip, for clients accepting it; object bodies never are
+	viper.SetDefault("SHARD_HEADERS", false)              // Write a self-describing header in front of every shard file; shards are read with or without one either way, but older versions can't read headed shards
+	viper.SetDefault("ZONE_PLACEMENT", ZonePlacementWarn) // Whether store warns about or fails on placements losing a single zone of the "zone" location labels could make unrecoverable
+	viper.SetDefault("VERIFY_ON_WRITE", false)            // Read every shard back right after writing it and fail the write if it doesn't match, through the verify-writes layer
+	viper.SetDefault("RETRIEVE_CONFLICT", ConflictFail)   // What retrieve does with files it would write that exist already: fail, overwrite, skip-existing or rename-new
+	viper.SetDefault("TMP_DIR", "")                       // Directory each invocation's temporary workspace and resumable downloads are kept under; empty for one of the user's own in the system temporary directory
+	viper.SetDefault("TMP_MAX_AGE", 24*time.Hour)         // How old workspaces of crashed invocations and abandoned downloads get before startup sweeps them away
+	viper.SetDefault("VERIFY_ON_ENCODE", false)           // Check the parity of every shard set against its data shards right after computing it, failing the store if it doesn't match
+	home, err := os.UserHomeDir()
+	if err != nil {
+		home = "."
+	}
+	viper.SetDefault("METADATA_DIR", filepath.Join(home, ".vault", "metadata"))
+	viper.SetDefault("HEALTH_FILE", filepath.Join(home, ".vault", "health.json"))
+	// A profile replaces the defaults above; see Profiles
+	if err := applyProfile(viper.GetString("PROFILE")); err != nil {
+		log.Fatal(err)
+	}
 
 	cfg := &Config{
 		EncryptionKey:         viper.GetString("ENCRYPTION_KEY"),
@@ -35,15 +179,90 @@ func LoadConfig() *Config {
 		Bucket:                viper.GetString("BUCKET"),
 		MetricsInterval:       viper.GetDuration("METRICS_INTERVAL"),
 		ShardStorageLocations: viper.GetStringSlice("SHARD_STORAGE_LOCATIONS"), // We'll use this to load storage locations
+		LeaseTTL:              viper.GetDuration("LEASE_TTL"),
+		ObfuscateShardPaths:   viper.GetBool("OBFUSCATE_SHARD_PATHS"),
+		ShardPathKey:          viper.GetString("SHARD_PATH_KEY"),
+		MaxConcurrency:        viper.GetInt("MAX_CONCURRENCY"),
+		MaxInFlightBytes:      viper.GetInt64("MAX_IN_FLIGHT_BYTES"),
+		MetadataDir:           viper.GetString("METADATA_DIR"),
+		Recipients:            viper.GetStringSlice("RECIPIENTS"),
+		IdentityFile:          viper.GetString("IDENTITY_FILE"),
+		StreamingThreshold:    viper.GetInt64("STREAMING_THRESHOLD"),
+		ShardRetryAttempts:    viper.GetInt("SHARD_RETRY_ATTEMPTS"),
+		ShardRetryDelay:       viper.GetDuration("SHARD_RETRY_DELAY"),
+		MaxRetriesPerOp:       viper.GetInt("MAX_RETRIES_PER_OP"),
+		TierColdAfter:         viper.GetDuration("TIER_COLD_AFTER"),
+		ColdLocations:         viper.GetString("COLD_LOCATIONS"), // Storage location configuration file of the cold tier
+		TierRequireAllowCold:  viper.GetBool("TIER_REQUIRE_ALLOW_COLD"),
+		TierInterval:          viper.GetDuration("TIER_INTERVAL"),
+		AdminToken:            viper.GetString("ADMIN_TOKEN"),  // Bearer token for the serve admin endpoints
+		TokensFile:            viper.GetString("TOKENS_FILE"),  // Bearer tokens serve accepts for objects, one "<namespace> <token>" per line
+		ServerToken:           viper.GetString("SERVER_TOKEN"), // Bearer token sent to a server by retrieve --from-server and the token commands
+		HealthFile:            viper.GetString("HEALTH_FILE"),
+		MaxObjectSize:         viper.GetInt64("MAX_OBJECT_SIZE"),
+		MaxShardSize:          viper.GetInt64("MAX_SHARD_SIZE"),
+		KeyringFile:           viper.GetString("KEYRING_FILE"), // Further master keys objects may have been stored under, one hex key per line
+		VerifyOnly:            viper.GetBool("VERIFY_ONLY"),    // Audit without encryption keys: verify works, reading contents fails
+		BufferPoolMax:         viper.GetInt64("BUFFER_POOL_MAX"),
+		TombstoneRetention:    viper.GetDuration("TOMBSTONE_RETENTION"),
+		CompactRatio:          viper.GetFloat64("COMPACT_RATIO"),
+		CompactInterval:       viper.GetDuration("COMPACT_INTERVAL"),
+		Transforms:            viper.GetStringSlice("TRANSFORMS"), // Space-separated names of registered transforms applied before encryption, in order
+		MetadataNameTemplate:  viper.GetString("METADATA_NAME_TEMPLATE"),
+		MetadataExt:           viper.GetString("METADATA_EXT"),
+		PreviewSize:           viper.GetInt("PREVIEW_SIZE"),
+		TrashRetention:        viper.GetDuration("TRASH_RETENTION"),
+		ChunkSize:             viper.GetInt64("CHUNK_SIZE"),
+		CPUWorkers:            viper.GetInt("CPU_WORKERS"),
+		CacheDir:              viper.GetString("CACHE_DIR"),
+		CacheMaxBytes:         viper.GetInt64("CACHE_MAX_BYTES"),
+		CacheEncrypt:          viper.GetBool("CACHE_ENCRYPT"),
+		ErasureField:          viper.GetString("ERASURE_FIELD"),
+		RetrieveUnchecked:     viper.GetBool("RETRIEVE_UNCHECKED"), // Decode objects whose proofs can't be read without checking their shards
+		IDMode:                viper.GetString("ID_MODE"),
+		ShardStoreLayers:      viper.GetStringSlice("SHARD_STORE_LAYERS"),
+		FaultPlan:             viper.GetString("FAULT_PLAN"), // Faults the faults layer injects into retrievals, like "2:drop 5:corrupt 9:delay(3ms)"
+		Profile:               viper.GetString("PROFILE"),
+		Convergent:            viper.GetBool("CONVERGENT"), // Encrypt under keys derived from the data, so identical objects share shards; see encryption.ConvergentKey
+		ServeMemoryBudget:     viper.GetInt64("SERVE_MEMORY_BUDGET"),
+		ServeRequestMemoryMax: viper.GetInt64("SERVE_REQUEST_MEMORY_MAX"),
+		ServeMemoryWait:       viper.GetDuration("SERVE_MEMORY_WAIT"),
+		ServeCompression:      viper.GetString("SERVE_COMPRESSION"),
+		ShardHeaders:          viper.GetBool("SHARD_HEADERS"),
+		ZonePlacement:         viper.GetString("ZONE_PLACEMENT"),
+		VerifyOnWrite:         viper.GetBool("VERIFY_ON_WRITE"),
+		HealthTextfile:        viper.GetString("HEALTH_TEXTFILE"), // Prometheus textfile verify-all writes its health gauges to, for node_exporter's textfile collector
+		RetrieveConflict:      viper.GetString("RETRIEVE_CONFLICT"),
+		TmpDir:                viper.GetString("TMP_DIR"),
+		TmpMaxAge:             viper.GetDuration("TMP_MAX_AGE"),
+		VerifyOnEncode:        viper.GetBool("VERIFY_ON_ENCODE"),
 	}
 
-	if cfg.EncryptionKey == "" {
-		log.Fatal("ENCRYPTION_KEY must be set")
-	}
+	// ENCRYPTION_KEY may be left unset when objects are only retrieved with
+	// a recipient identity; commands that need it fail when they read it.
 
 	if len(cfg.ShardStorageLocations) == 0 {
 		log.Fatal("SHARD_STORAGE_LOCATIONS must be set")
 	}
+	// Leases are refreshed at a third of their ttl
+	if cfg.LeaseTTL <= 0 {
+		log.Fatalf("LEASE_TTL must be positive, got %s", cfg.LeaseTTL)
+	}
+	if _, err := ParseMetadataNameTemplate(cfg.MetadataNameTemplate, cfg.MetadataExt); err != nil {
+		log.Fatal(err)
+	}
+	if cfg.IDMode != IDModeCiphertext && cfg.IDMode != IDModeContent {
+		log.Fatalf("ID_MODE must be %s or %s, got %q", IDModeCiphertext, IDModeContent, cfg.IDMode)
+	}
+	if cfg.ZonePlacement != ZonePlacementWarn && cfg.ZonePlacement != ZonePlacementError {
+		log.Fatalf("ZONE_PLACEMENT must be %s or %s, got %q", ZonePlacementWarn, ZonePlacementError, cfg.ZonePlacement)
+	}
+	if !slices.Contains(ConflictPolicies, cfg.RetrieveConflict) {
+		log.Fatalf("RETRIEVE_CONFLICT must be one of %s, got %q", strings.Join(ConflictPolicies, ", "), cfg.RetrieveConflict)
+	}
+	if cfg.TmpMaxAge <= 0 {
+		log.Fatalf("TMP_MAX_AGE must be positive, got %s", cfg.TmpMaxAge)
+	}
 
 	return cfg
 }
@@ -0,0 +1,177 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Defaults for METADATA_NAME_TEMPLATE and METADATA_EXT, which name metadata
+// files vault_session_<12 random characters>.vmd.
+const (
+	DefaultMetadataNameTemplate = "vault_session_{random}"
+	DefaultMetadataExt          = ".vmd"
+)
+
+// A metadata name template is literal text with variables in braces:
+//
+//	{date}        day the object was stored, as 2006-01-02
+//	{dataID}      the object's dataID; {dataID:8} keeps its first 8 characters
+//	{filename}    the stored file's name without its extension, with
+//	              characters other than letters, digits, '-', '_' and '.'
+//	              replaced by '_', and cut to 100 characters
+//	{random}      12 random letters and digits; {random:N} for N of them
+//
+// The extension is added after the rendered name unless the template
+// already ends with it, so "{date}-{dataID:8}.meta" works with METADATA_EXT
+// ".meta".
+
+// MetadataNameTemplate is a parsed metadata name template.
+type MetadataNameTemplate struct {
+	parts []templatePart
+	ext   string
+}
+
+type templatePart struct {
+	literal string
+	name    string // Variable, when literal is empty
+	length  int    // Characters kept of the variable, or 0 for all
+}
+
+// MetadataName holds the values a template's variables are filled from.
+type MetadataName struct {
+	Time     time.Time
+	DataID   string
+	Filename string
+	Random   func(n int) string
+}
+
+// ParseMetadataNameTemplate checks a template and extension and returns
+// the parsed template.
+func ParseMetadataNameTemplate(template, ext string) (*MetadataNameTemplate, error) {
+	if !strings.HasPrefix(ext, ".") || len(ext) < 2 || strings.ContainsAny(ext, `/\{}`) {
+		return nil, fmt.Errorf("invalid metadata extension %q: it must start with a dot and name no directory", ext)
+	}
+	if ext == ".lock" || ext == ".tombstone" {
+		return nil, fmt.Errorf("invalid metadata extension %q: vault uses it for its own files", ext)
+	}
+	body := strings.TrimSuffix(template, ext)
+	if body == "" {
+		return nil, fmt.Errorf("invalid metadata name template %q: it is empty", template)
+	}
+	if strings.HasPrefix(body, ".") {
+		return nil, fmt.Errorf("invalid metadata name template %q: names starting with a dot are hidden and skipped", template)
+	}
+
+	parsed := &MetadataNameTemplate{ext: ext}
+	for rest := body; rest != ""; {
+		open := strings.IndexAny(rest, "{}")
+		if open < 0 {
+			parsed.parts = append(parsed.parts, templatePart{literal: rest})
+			break
+		}
+		if rest[open] == '}' {
+			return nil, fmt.Errorf("invalid metadata name template %q: unmatched }", template)
+		}
+		if open > 0 {
+			parsed.parts = append(parsed.parts, templatePart{literal: rest[:open]})
+		}
+		end := strings.IndexByte(rest[open:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("invalid metadata name template %q: unclosed {", template)
+		}
+		part, err := parseTemplateVariable(rest[open+1 : open+end])
+		if err != nil {
+			return nil, fmt.Errorf("invalid metadata name template %q: %w", template, err)
+		}
+		parsed.parts = append(parsed.parts, part)
+		rest = rest[open+end+1:]
+	}
+	for _, part := range parsed.parts {
+		if strings.ContainsAny(part.literal, `/\`) {
+			return nil, fmt.Errorf("invalid metadata name template %q: it can't name a directory", template)
+		}
+	}
+	return parsed, nil
+}
+
+// parseTemplateVariable parses what is between the braces of a variable.
+func parseTemplateVariable(variable string) (templatePart, error) {
+	name, length, hasLength := strings.Cut(variable, ":")
+	part := templatePart{name: name}
+	switch name {
+	case "date", "filename":
+		if hasLength {
+			return part, fmt.Errorf("{%s} takes no length", name)
+		}
+		return part, nil
+	case "dataID", "random":
+	default:
+		return part, fmt.Errorf("unknown variable {%s}", name)
+	}
+	if !hasLength {
+		return part, nil
+	}
+	n, err := strconv.Atoi(length)
+	if err != nil || n < 1 || n > 64 {
+		return part, fmt.Errorf("{%s} length must be a number from 1 to 64", variable)
+	}
+	part.length = n
+	return part, nil
+}
+
+// Render returns the metadata file name for the given values, extension
+// included.
+func (t *MetadataNameTemplate) Render(values MetadataName) string {
+	var name strings.Builder
+	for _, part := range t.parts {
+		if part.name == "" {
+			name.WriteString(part.literal)
+			continue
+		}
+		var value string
+		switch part.name {
+		case "date":
+			value = values.Time.Format("2006-01-02")
+		case "dataID":
+			value = values.DataID
+		case "filename":
+			value = sanitizeFilename(values.Filename)
+		case "random":
+			n := part.length
+			if n == 0 {
+				n = 12
+			}
+			value = values.Random(n)
+		}
+		if part.length > 0 && len(value) > part.length {
+			value = value[:part.length]
+		}
+		name.WriteString(value)
+	}
+	return name.String() + t.ext
+}
+
+// sanitizeFilename drops a filename's extension and replaces characters
+// that don't belong in a metadata file name, including a leading dot.
+func sanitizeFilename(filename string) string {
+	if dot := strings.LastIndexByte(filename, '.'); dot > 0 {
+		filename = filename[:dot]
+	}
+	clean := []byte(filename)
+	if len(clean) > 100 {
+		clean = clean[:100]
+	}
+	for i, c := range clean {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_', c == '.' && i > 0:
+		default:
+			clean[i] = '_'
+		}
+	}
+	if len(clean) == 0 {
+		return "_"
+	}
+	return string(clean)
+}
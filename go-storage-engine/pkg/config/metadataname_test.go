@@ -0,0 +1,91 @@
+package config
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenderMetadataName(t *testing.T) {
+	values := MetadataName{
+		Time:     time.Date(2026, 3, 1, 23, 59, 0, 0, time.UTC),
+		DataID:   "5d41402abc4b2a76b9719d911017c592",
+		Filename: "Quarterly report (final).pdf",
+		Random:   func(n int) string { return strings.Repeat("r", n) },
+	}
+	for _, tc := range []struct {
+		template, ext, want string
+	}{
+		{DefaultMetadataNameTemplate, DefaultMetadataExt, "vault_session_rrrrrrrrrrrr.vmd"},
+		{"{date}-{dataID:8}.meta", ".meta", "2026-03-01-5d41402a.meta"},
+		{"{date}-{dataID:8}", ".meta", "2026-03-01-5d41402a.meta"},
+		{"{filename}_{dataID}", ".vmd", "Quarterly_report__final__5d41402abc4b2a76b9719d911017c592.vmd"},
+		{"obj-{random:4}-{dataID:64}", ".json", "obj-rrrr-5d41402abc4b2a76b9719d911017c592.json"},
+		{"catalog", ".vmd", "catalog.vmd"},
+	} {
+		template, err := ParseMetadataNameTemplate(tc.template, tc.ext)
+		if err != nil {
+			t.Fatalf("%q: %v", tc.template, err)
+		}
+		if got := template.Render(values); got != tc.want {
+			t.Fatalf("%q rendered as %q, expected %q", tc.template, got, tc.want)
+		}
+	}
+}
+
+func TestSanitizeFilename(t *testing.T) {
+	for filename, want := range map[string]string{
+		"notes.txt":                       "notes",
+		"archive.tar.gz":                  "archive.tar",
+		".bashrc":                         "_bashrc",
+		"dir/sub dir/x.txt":               "dir_sub_dir_x",
+		"caf\xc3\xa9 menu":                "caf___menu",
+		"":                                "_",
+		strings.Repeat("a", 150) + ".bin": strings.Repeat("a", 100),
+	} {
+		if got := sanitizeFilename(filename); got != want {
+			t.Fatalf("sanitizeFilename(%q) = %q, expected %q", filename, got, want)
+		}
+	}
+}
+
+func TestParseMetadataNameTemplateErrors(t *testing.T) {
+	for _, tc := range []struct {
+		template, ext, want string
+	}{
+		{"{date}", "vmd", "must start with a dot"},
+		{"{date}", ".", "must start with a dot"},
+		{"{date}", ".tombstone", "vault uses it"},
+		{".vmd", ".vmd", "it is empty"},
+		{".{dataID}", ".vmd", "hidden"},
+		{"{date", ".vmd", "unclosed {"},
+		{"date}", ".vmd", "unmatched }"},
+		{"{when}", ".vmd", "unknown variable {when}"},
+		{"{date:8}", ".vmd", "{date} takes no length"},
+		{"{dataID:0}", ".vmd", "length must be a number from 1 to 64"},
+		{"{random:x}", ".vmd", "length must be a number from 1 to 64"},
+		{"objects/{dataID}", ".vmd", "can't name a directory"},
+	} {
+		_, err := ParseMetadataNameTemplate(tc.template, tc.ext)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Fatalf("%q with %q: %v, expected an error about %q", tc.template, tc.ext, err, tc.want)
+		}
+	}
+}
+
+// TestLoadConfigRefusesInvalidTemplate loads the configuration with an
+// invalid template in a child process, since LoadConfig exits on it.
+func TestLoadConfigRefusesInvalidTemplate(t *testing.T) {
+	if os.Getenv("VAULT_TEST_LOAD_CONFIG") != "" {
+		loadProfile(t, map[string]string{"METADATA_NAME_TEMPLATE": "{when}"})
+		return
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestLoadConfigRefusesInvalidTemplate$")
+	cmd.Env = append(os.Environ(), "VAULT_TEST_LOAD_CONFIG=1")
+	out, err := cmd.CombinedOutput()
+	if _, exited := err.(*exec.ExitError); !exited || !strings.Contains(string(out), "unknown variable {when}") {
+		t.Fatalf("loading an invalid template: %v\n%s", err, out)
+	}
+}
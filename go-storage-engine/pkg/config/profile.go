@@ -0,0 +1,101 @@
+package config
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// Names of PROFILE values.
+const (
+	ProfileFast     = "fast"
+	ProfileCompact  = "compact"
+	ProfileParanoid = "paranoid"
+)
+
+// Profiles are named sets of defaults for the settings that trade speed,
+// size and safety against each other. A profile only changes defaults, so
+// a setting given in the environment still wins over its profile.
+//
+// fast stores objects whole with no transforms, at four times the
+// default concurrency and in-flight bytes; AES-GCM already runs on AES-NI
+// where the CPU has it. compact cuts objects from 4 MiB up into
+// content-defined chunks so versions share them, and codes them 12+8,
+// which has more parity shards than the default 8+6 and less overhead.
+// paranoid codes objects 8+8, hides shard paths, encrypts the cache, and
+// names objects by their ciphertext so equal files can't be told apart.
+// Recipients for envelope encryption have no default and are still set
+// with RECIPIENTS.
+//
+// compact and paranoid change the shard count, so storage location
+// configuration files need a location for each of their shards.
+var Profiles = map[string]map[string]any{
+	ProfileFast: {
+		"MAX_CONCURRENCY":     16,
+		"MAX_IN_FLIGHT_BYTES": 1 << 30,
+		"BUFFER_POOL_MAX":     1 << 30,
+		"CPU_WORKERS":         0,
+		"CHUNK_SIZE":          0,
+		"TRANSFORMS":          []string{},
+	},
+	ProfileCompact: {
+		"DATA_SHARDS":         12,
+		"PARITY_SHARDS":       8,
+		"CHUNK_SIZE":          64 << 10,
+		"STREAMING_THRESHOLD": 4 << 20,
+	},
+	ProfileParanoid: {
+		"PARITY_SHARDS":         8,
+		"OBFUSCATE_SHARD_PATHS": true,
+		"CACHE_ENCRYPT":         true,
+		"ID_MODE":               IDModeCiphertext,
+		"RETRIEVE_UNCHECKED":    false,
+	},
+}
+
+// ProfileNames returns the names of the profiles, sorted.
+func ProfileNames() []string {
+	return slices.Sorted(maps.Keys(Profiles))
+}
+
+// applyProfile makes the settings of the named profile the defaults. An
+// empty name applies none.
+func applyProfile(name string) error {
+	if name == "" {
+		return nil
+	}
+	settings, ok := Profiles[name]
+	if !ok {
+		return fmt.Errorf("PROFILE must be one of %s, got %q", strings.Join(ProfileNames(), ", "), name)
+	}
+	for key, value := range settings {
+		viper.SetDefault(key, value)
+	}
+	return nil
+}
+
+// ProfileArg returns the value of a --profile flag in a command line. The
+// configuration is loaded before the command line is parsed, so the flag is
+// looked for up front, in every argument before a "--".
+func ProfileArg(args []string) (string, bool) {
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		name, value, hasValue := strings.Cut(arg, "=")
+		if name != "--profile" && name != "-profile" {
+			continue
+		}
+		if !hasValue {
+			if i+1 == len(args) {
+				return "", false
+			}
+			value = args[i+1]
+		}
+		return value, true
+	}
+	return "", false
+}
@@ -0,0 +1,97 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// loadProfile loads the configuration from an environment with the given
+// settings, on top of a storage location.
+func loadProfile(t *testing.T, env map[string]string) *Config {
+	t.Helper()
+	t.Setenv("SHARD_STORAGE_LOCATIONS", t.TempDir())
+	for key, value := range env {
+		t.Setenv(key, value)
+	}
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	return LoadConfig()
+}
+
+func TestProfilesSetEffectiveConfig(t *testing.T) {
+	base := loadProfile(t, nil)
+	if base.Profile != "" || base.DataShards != 8 || base.ParityShards != 6 || base.MaxConcurrency != 4 {
+		t.Fatalf("no profile: %+v", base)
+	}
+
+	for _, tc := range []struct {
+		profile string
+		check   func(cfg *Config) bool
+	}{
+		{ProfileFast, func(cfg *Config) bool {
+			return cfg.MaxConcurrency == 16 && cfg.MaxInFlightBytes == 1<<30 && cfg.BufferPoolMax == 1<<30 &&
+				cfg.ChunkSize == 0 && len(cfg.Transforms) == 0 &&
+				cfg.DataShards == 8 && cfg.ParityShards == 6
+		}},
+		{ProfileCompact, func(cfg *Config) bool {
+			return cfg.DataShards == 12 && cfg.ParityShards == 8 &&
+				cfg.ChunkSize == 64<<10 && cfg.StreamingThreshold == 4<<20 &&
+				cfg.MaxConcurrency == 4
+		}},
+		{ProfileParanoid, func(cfg *Config) bool {
+			return cfg.DataShards == 8 && cfg.ParityShards == 8 &&
+				cfg.ObfuscateShardPaths && cfg.CacheEncrypt && !cfg.RetrieveUnchecked &&
+				cfg.IDMode == IDModeCiphertext
+		}},
+	} {
+		cfg := loadProfile(t, map[string]string{"PROFILE": tc.profile})
+		if cfg.Profile != tc.profile || !tc.check(cfg) {
+			t.Fatalf("profile %s: %+v", tc.profile, cfg)
+		}
+	}
+}
+
+func TestSettingsOverrideProfile(t *testing.T) {
+	cfg := loadProfile(t, map[string]string{
+		"PROFILE":               ProfileParanoid,
+		"PARITY_SHARDS":         "5",
+		"OBFUSCATE_SHARD_PATHS": "false",
+	})
+	if cfg.ParityShards != 5 || cfg.ObfuscateShardPaths {
+		t.Fatalf("settings lost to the profile: %+v", cfg)
+	}
+	// The rest of the profile still applies
+	if !cfg.CacheEncrypt {
+		t.Fatalf("profile lost to other settings: %+v", cfg)
+	}
+
+	cfg = loadProfile(t, map[string]string{"PROFILE": ProfileCompact, "CHUNK_SIZE": "0"})
+	if cfg.ChunkSize != 0 || cfg.DataShards != 12 {
+		t.Fatalf("compact with CHUNK_SIZE=0: %+v", cfg)
+	}
+
+	if err := applyProfile("tiny"); err == nil {
+		t.Fatal("applied an unknown profile")
+	}
+}
+
+func TestProfileArg(t *testing.T) {
+	for _, tc := range []struct {
+		args    []string
+		profile string
+		ok      bool
+	}{
+		{args: []string{"--profile", "fast", "store", "a.txt"}, profile: "fast", ok: true},
+		{args: []string{"--metadata-dir", "/tmp/m", "--profile=compact", "list"}, profile: "compact", ok: true},
+		{args: []string{"-profile", "paranoid"}, profile: "paranoid", ok: true},
+		{args: []string{"store", "a.txt"}},
+		{args: []string{"--profile"}},
+		{args: []string{"store", "--", "--profile", "fast"}},
+	} {
+		profile, ok := ProfileArg(tc.args)
+		if profile != tc.profile || ok != tc.ok {
+			t.Fatalf("ProfileArg(%q) = %q, %t", tc.args, profile, ok)
+		}
+	}
+}
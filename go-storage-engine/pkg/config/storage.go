@@ -0,0 +1,313 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/techninja8/getvault.io/pkg/planning"
+)
+
+// MinStorageLocations is the number of locations a storage location
+// configuration needs: one per data and parity shard.
+const MinStorageLocations = 14
+
+// A storage location configuration file is either a plain list with one
+// location per line, or a JSON document of the form
+//
+//	{
+//	  "locations": [
+//	    {"path": "/mnt/disk1/shards", "backend": "disk", "weight": 1,
+//	     "capacity": "4TiB", "labels": {"host": "nas1", "device": "2049"}},
+//	    {"path": "s3://bucket/prefix", "backend": "s3"},
+//	    ...
+//	  ]
+//	}
+//
+// "locations" is required and holds at least MinStorageLocations entries.
+// For each entry "path" is required; "backend" is "disk" or "s3" and
+// defaults to what the path looks like, but must agree with it when given;
+// "weight", the relative share of shards the location should take, is a
+// number above 0 and at most 100, and defaults to 1; "capacity", the bytes
+// the location can hold for plan to check against, is a number of bytes or
+// a size like "500GiB" and defaults to unknown; "labels" maps names to
+// strings describing where the location is, such as the host and device
+// set-storage records, for placement policies to use; store spreads the
+// shards of an object over the "zone" labels so losing one zone leaves
+// enough to recover it. Other fields are rejected, so typos fail early.
+
+// StorageLocation is one entry of a storage location configuration.
+type StorageLocation struct {
+	Path     string            `json:"path"`
+	Backend  string            `json:"backend,omitempty"`
+	Weight   float64           `json:"weight,omitempty"`
+	Capacity int64             `json:"capacity,omitempty"` // Bytes, 0 if unknown
+	Labels   map[string]string `json:"labels,omitempty"`
+}
+
+var errInvalidCapacity = errors.New("invalid capacity")
+
+// StorageConfigError is a problem found in a storage location
+// configuration, with the line it is on and the field at fault, like
+// locations[3].weight.
+type StorageConfigError struct {
+	Line  int
+	Field string
+	Msg   string
+}
+
+func (e *StorageConfigError) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+	}
+	return fmt.Sprintf("line %d: %s: %s", e.Line, e.Field, e.Msg)
+}
+
+// ValidateStorageConfig checks a storage location configuration, reporting
+// every problem found.
+func ValidateStorageConfig(data []byte) error {
+	_, err := ParseStorageConfig(data)
+	return err
+}
+
+// ParseStorageConfig validates a storage location configuration and
+// returns its locations in order.
+func ParseStorageConfig(data []byte) ([]StorageLocation, error) {
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		return parseJSONStorageConfig(data)
+	}
+	return parsePlainStorageConfig(data)
+}
+
+func parsePlainStorageConfig(data []byte) ([]StorageLocation, error) {
+	var (
+		locations []StorageLocation
+		errs      []error
+		line      int
+	)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 4<<20)
+	for scanner.Scan() {
+		line++
+		path := strings.TrimSpace(scanner.Text())
+		if path == "" {
+			continue
+		}
+		if strings.ContainsRune(path, 0) || strings.Contains(path, ",") {
+			errs = append(errs, &StorageConfigError{Line: line, Msg: fmt.Sprintf("invalid location %q", path)})
+			continue
+		}
+		locations = append(locations, StorageLocation{Path: path, Backend: backendOf(path), Weight: 1})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(locations) < MinStorageLocations {
+		errs = append(errs, &StorageConfigError{Line: line, Msg: fmt.Sprintf("need at least %d locations, have %d", MinStorageLocations, len(locations))})
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return locations, nil
+}
+
+func parseJSONStorageConfig(data []byte) ([]StorageLocation, error) {
+	var doc any
+	if err := json.Unmarshal(data, &doc); err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			return nil, &StorageConfigError{Line: lineAt(data, int(syntaxErr.Offset)-1), Msg: syntaxErr.Error()}
+		}
+		return nil, err
+	}
+	lines := jsonLines(data)
+	var errs []error
+	fail := func(field, format string, args ...any) {
+		errs = append(errs, &StorageConfigError{Line: lines[field], Field: field, Msg: fmt.Sprintf(format, args...)})
+	}
+
+	root, ok := doc.(map[string]any)
+	if !ok {
+		fail("", "must be a JSON object")
+		return nil, errors.Join(errs...)
+	}
+	for _, key := range unknownKeys(root, "locations") {
+		fail(key, "unknown field")
+	}
+	list, ok := root["locations"].([]any)
+	if !ok {
+		if _, present := root["locations"]; present {
+			fail("locations", "must be a list")
+		} else {
+			fail("", `missing required field "locations"`)
+		}
+		return nil, errors.Join(errs...)
+	}
+
+	locations := make([]StorageLocation, 0, len(list))
+	for i, item := range list {
+		field := fmt.Sprintf("locations[%d]", i)
+		entry, ok := item.(map[string]any)
+		if !ok {
+			fail(field, "must be an object")
+			continue
+		}
+		for _, key := range unknownKeys(entry, "path", "backend", "weight", "capacity", "labels") {
+			fail(field+"."+key, "unknown field")
+		}
+
+		location := StorageLocation{Weight: 1}
+		switch path := entry["path"].(type) {
+		case string:
+			location.Path = strings.TrimSpace(path)
+			if location.Path == "" || strings.ContainsRune(path, 0) || strings.Contains(path, ",") {
+				fail(field+".path", "invalid location %q", path)
+			}
+		case nil:
+			fail(field, `missing required field "path"`)
+		default:
+			fail(field+".path", "must be a string")
+		}
+
+		location.Backend = backendOf(location.Path)
+		if backend, present := entry["backend"]; present {
+			switch backend {
+			case "disk", "s3":
+				if location.Path != "" && backend != location.Backend {
+					fail(field+".backend", "%q doesn't match path %q", backend, location.Path)
+				}
+			default:
+				fail(field+".backend", `must be "disk" or "s3", not %v`, backend)
+			}
+		}
+
+		if weight, present := entry["weight"]; present {
+			w, ok := weight.(float64)
+			switch {
+			case !ok:
+				fail(field+".weight", "must be a number")
+			case w <= 0 || w > 100:
+				fail(field+".weight", "must be above 0 and at most 100, not %v", w)
+			default:
+				location.Weight = w
+			}
+		}
+		if capacity, present := entry["capacity"]; present {
+			var err error
+			switch value := capacity.(type) {
+			case float64:
+				if value != math.Trunc(value) || value >= math.MaxInt64 {
+					err = errInvalidCapacity
+				}
+				location.Capacity = int64(value)
+			case string:
+				location.Capacity, err = planning.ParseSize(value)
+			default:
+				err = errInvalidCapacity
+			}
+			if err != nil || location.Capacity < 1 {
+				fail(field+".capacity", `must be a positive number of bytes or a size like "500GiB", not %v`, capacity)
+			}
+		}
+		if labels, present := entry["labels"]; present {
+			object, ok := labels.(map[string]any)
+			if !ok {
+				fail(field+".labels", "must be an object")
+			}
+			for name, value := range object {
+				if text, ok := value.(string); !ok || name == "" {
+					fail(field+".labels."+name, "must be a string with a name")
+				} else {
+					if location.Labels == nil {
+						location.Labels = make(map[string]string)
+					}
+					location.Labels[name] = text
+				}
+			}
+		}
+		locations = append(locations, location)
+	}
+	if len(list) < MinStorageLocations {
+		fail("locations", "need at least %d locations, have %d", MinStorageLocations, len(list))
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return locations, nil
+}
+
+// backendOf returns the backend a location path refers to.
+func backendOf(path string) string {
+	if strings.HasPrefix(path, "s3://") {
+		return "s3"
+	}
+	return "disk"
+}
+
+// unknownKeys returns the keys of an object that aren't allowed, sorted.
+func unknownKeys(object map[string]any, allowed ...string) []string {
+	var unknown []string
+	for key := range object {
+		if !slices.Contains(allowed, key) {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+// jsonLines maps the path of every value in a JSON document, like
+// locations[2].path, to the line it starts on. The document root is "".
+func jsonLines(data []byte) map[string]int {
+	lines := make(map[string]int)
+	dec := json.NewDecoder(bytes.NewReader(data))
+	var walk func(path string) error
+	walk = func(path string) error {
+		lines[path] = lineAt(data, int(dec.InputOffset()))
+		token, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch token {
+		case json.Delim('{'):
+			for dec.More() {
+				key, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				child := key.(string)
+				if path != "" {
+					child = path + "." + child
+				}
+				if err := walk(child); err != nil {
+					return err
+				}
+			}
+			_, err = dec.Token()
+		case json.Delim('['):
+			for i := 0; dec.More(); i++ {
+				if err := walk(fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+			_, err = dec.Token()
+		}
+		return err
+	}
+	walk("")
+	return lines
+}
+
+// lineAt returns the line of the first token at or after offset.
+func lineAt(data []byte, offset int) int {
+	for offset < len(data) && strings.IndexByte(" \t\r\n,:", data[offset]) >= 0 {
+		offset++
+	}
+	return bytes.Count(data[:min(offset, len(data))], []byte("\n")) + 1
+}
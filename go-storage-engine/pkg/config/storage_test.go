@@ -0,0 +1,113 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// jsonStorageConfig returns a JSON storage location configuration of
+// MinStorageLocations disk locations, the first with the given capacity
+// field, or none when it is empty.
+func jsonStorageConfig(capacity string) []byte {
+	first := `"path": "/mnt/disk0/shards"`
+	if capacity != "" {
+		first += `, "capacity": ` + capacity
+	}
+	return jsonLocations(first, MinStorageLocations)
+}
+
+// jsonLocations returns a JSON storage location configuration of n
+// locations, one per line from line 3, the first with the fields in first
+// and the others disk locations with only a path.
+func jsonLocations(first string, n int) []byte {
+	entries := []string{"{" + first + "}"}
+	for i := 1; i < n; i++ {
+		entries = append(entries, fmt.Sprintf(`{"path": "/mnt/disk%d/shards"}`, i))
+	}
+	return []byte("{\n\"locations\": [\n" + strings.Join(entries, ",\n") + "\n]\n}\n")
+}
+
+func TestStorageConfigCapacity(t *testing.T) {
+	for _, tc := range []struct {
+		capacity string
+		want     int64
+	}{
+		{"", 0},
+		{"1000000", 1000000},
+		{`"4TiB"`, 4 << 40},
+		{`"1.5 GB"`, 1_500_000_000},
+	} {
+		locations, err := ParseStorageConfig(jsonStorageConfig(tc.capacity))
+		if err != nil {
+			t.Fatalf("capacity %s: %v", tc.capacity, err)
+		}
+		if locations[0].Capacity != tc.want || locations[1].Capacity != 0 {
+			t.Fatalf("capacity %s parsed as %d, expected %d", tc.capacity, locations[0].Capacity, tc.want)
+		}
+	}
+
+	for _, capacity := range []string{"0", "-5", "1.5", "1e30", `"lots"`, `"1e30PiB"`, `"0B"`, "true", "[1]"} {
+		_, err := ParseStorageConfig(jsonStorageConfig(capacity))
+		var configErr *StorageConfigError
+		if !errors.As(err, &configErr) || configErr.Field != "locations[0].capacity" || configErr.Line != 3 {
+			t.Fatalf("capacity %s: %v", capacity, err)
+		}
+	}
+}
+
+// TestValidateStorageConfigErrors checks the message given for each kind
+// of mistake, which names the line and the field at fault.
+func TestValidateStorageConfigErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		config []byte
+		want   string
+	}{
+		{"misspelled field", jsonLocations(`"path": "/mnt/disk0/shards", "wieght": 2`, 14), "line 3: locations[0].wieght: unknown field"},
+		{"missing path", jsonLocations(`"weight": 2`, 14), `line 3: locations[0]: missing required field "path"`},
+		{"empty path", jsonLocations(`"path": " "`, 14), `line 3: locations[0].path: invalid location " "`},
+		{"path not a string", jsonLocations(`"path": 7`, 14), "line 3: locations[0].path: must be a string"},
+		{"zero weight", jsonLocations(`"path": "/mnt/disk0/shards", "weight": 0`, 14), "line 3: locations[0].weight: must be above 0 and at most 100, not 0"},
+		{"weight too large", jsonLocations(`"path": "/mnt/disk0/shards", "weight": 101`, 14), "line 3: locations[0].weight: must be above 0 and at most 100, not 101"},
+		{"weight not a number", jsonLocations(`"path": "/mnt/disk0/shards", "weight": "2"`, 14), "line 3: locations[0].weight: must be a number"},
+		{"unknown backend", jsonLocations(`"path": "/mnt/disk0/shards", "backend": "ftp"`, 14), `line 3: locations[0].backend: must be "disk" or "s3", not ftp`},
+		{"backend against path", jsonLocations(`"path": "/mnt/disk0/shards", "backend": "s3"`, 14), `line 3: locations[0].backend: "s3" doesn't match path "/mnt/disk0/shards"`},
+		{"label not a string", jsonLocations(`"path": "/mnt/disk0/shards", "labels": {"zone": 1}`, 14), "line 3: locations[0].labels.zone: must be a string with a name"},
+		{"too few locations", jsonLocations(`"path": "/mnt/disk0/shards"`, 13), "line 2: locations: need at least 14 locations, have 13"},
+		{"locations not a list", []byte("{\n\"locations\": {}\n}\n"), "line 2: locations: must be a list"},
+		{"no locations", []byte("{\n\"location\": []\n}\n"), "line 2: location: unknown field\nline 1: missing required field \"locations\""},
+		{"syntax error", []byte("{\n\"locations\": [\n{\"path\": \"/mnt/disk0\",}\n]\n}\n"), "line 3: invalid character '}' looking for beginning of object key string"},
+		{"too few plain locations", []byte("/mnt/disk0\n/mnt/disk1\n"), "line 2: need at least 14 locations, have 2"},
+		{"comma in a plain location", []byte(strings.Repeat("/mnt/disk\n", 14) + "/mnt/a,b\n"), `line 15: invalid location "/mnt/a,b"`},
+	} {
+		err := ValidateStorageConfig(tc.config)
+		if err == nil || err.Error() != tc.want {
+			t.Errorf("%s: got %v, expected %q", tc.name, err, tc.want)
+		}
+	}
+}
+
+// TestValidateStorageConfigReportsEveryProblem checks that problems on
+// different locations are all reported, each with its own line.
+func TestValidateStorageConfigReportsEveryProblem(t *testing.T) {
+	config := []byte(strings.Replace(string(jsonLocations(`"path": "/mnt/disk0/shards", "weight": -1`, 14)),
+		`{"path": "/mnt/disk5/shards"}`, `{"path": "/mnt/disk5/shards", "capacity": "lots"}`, 1))
+	err := ValidateStorageConfig(config)
+	var fields []string
+	for _, e := range err.(interface{ Unwrap() []error }).Unwrap() {
+		var configErr *StorageConfigError
+		if !errors.As(e, &configErr) {
+			t.Fatalf("%v is not a StorageConfigError", e)
+		}
+		fields = append(fields, fmt.Sprintf("%d %s", configErr.Line, configErr.Field))
+	}
+	if strings.Join(fields, ", ") != "3 locations[0].weight, 8 locations[5].capacity" {
+		t.Fatalf("problems reported at %v", fields)
+	}
+
+	if err := ValidateStorageConfig(jsonLocations(`"path": "s3://bucket/prefix/", "backend": "s3", "weight": 2.5, "capacity": "4TiB", "labels": {"zone": "a"}`, 14)); err != nil {
+		t.Fatalf("valid config refused: %v", err)
+	}
+}
@@ -0,0 +1,254 @@
+package datastorage
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/techninja8/getvault.io/pkg/config"
+	"github.com/techninja8/getvault.io/pkg/encryption"
+	"github.com/techninja8/getvault.io/pkg/erasurecoding"
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+// indexPlaceholder stands for a shard's index in an AdoptOptions.ShardPattern.
+const indexPlaceholder = "{index}"
+
+// ErrShardSizeMismatch is returned when the shards being adopted aren't all
+// the same size, so they can't be one Reed-Solomon set.
+var ErrShardSizeMismatch = errors.New("shards differ in size")
+
+// AdoptOptions describes a set of erasure-coded shards written by another
+// tool.
+type AdoptOptions struct {
+	DataShards   int
+	ParityShards int
+	ShardPattern string // Path of each shard file, with {index} for its index
+	Name         string // Filename recorded for the object
+	Key          []byte // Master key the data was encrypted under with vault's scheme, or nil
+	External     bool   // Without a Key, whether the other tool encrypted the data
+	Size         int64  // Bytes of data before padding, or negative to keep every data shard byte
+}
+
+// AdoptShards takes a set of shards written outside vault into the catalog
+// without copying them. Each shard file is checked, hard linked under the
+// name vault's store looks for in its own directory, and described by a new
+// metadata file with its checksums and Merkle proofs. The object is then
+// retrieved through store and compared with what the shards decode to;
+// only if that succeeds is the metadata file kept. Adopted shards have no
+// index headers, and their data is decrypted on retrieval only when it
+// was encrypted with vault's scheme under opts.Key. It returns the
+// metadata file written.
+func AdoptShards(opts AdoptOptions, store sharding.ShardStore, cfg *config.Config, logger *zap.Logger) (string, error) {
+	_, logger = startOperation(context.Background(), cfg, logger, "adopt")
+	code, err := erasurecoding.NewCode(opts.DataShards, opts.ParityShards, erasurecoding.FieldAuto)
+	if err != nil {
+		return "", fmt.Errorf("can't adopt %d+%d shards: %w", opts.DataShards, opts.ParityShards, err)
+	}
+	if !strings.Contains(opts.ShardPattern, indexPlaceholder) {
+		return "", fmt.Errorf("shard pattern %q has no %s", opts.ShardPattern, indexPlaceholder)
+	}
+	if strings.Contains(opts.ShardPattern, "://") {
+		return "", fmt.Errorf("shard pattern %q: only shard files in local directories can be adopted", opts.ShardPattern)
+	}
+	if opts.Name == "" {
+		return "", errors.New("adopted objects need a name")
+	}
+	if err := CheckFilename(filepath.Base(opts.Name)); err != nil {
+		return "", err
+	}
+
+	paths, shards, err := readAdoptedShards(opts.ShardPattern, code, logger)
+	if err != nil {
+		return "", err
+	}
+	shardSize := 0
+	for _, shard := range shards {
+		if shard != nil {
+			shardSize = len(shard)
+			break
+		}
+	}
+
+	decoded, err := code.AppendDecode(nil, shards)
+	if err != nil {
+		return "", fmt.Errorf("shards can't be decoded: %w", err)
+	}
+	stored, size, err := adoptedSizes(opts, int64(len(decoded)))
+	if err != nil {
+		return "", err
+	}
+	decoded = decoded[:stored]
+	dataID := GenerateDataID(decoded)
+	if existing, err := FindMetadataFile(cfg.MetadataDir, dataID); err == nil {
+		return "", fmt.Errorf("these shards are already in the catalog as %s", existing)
+	}
+
+	want := decoded
+	if opts.Key != nil {
+		if want, err = encryption.Decrypt(decoded, opts.Key); err != nil {
+			return "", fmt.Errorf("failed to decrypt adopted data: %w", err)
+		}
+	}
+	want = want[:size]
+
+	locations := make([]string, len(paths))
+	var linked []string
+	unlink := func() {
+		for _, link := range linked {
+			os.Remove(link)
+		}
+	}
+	for i, path := range paths {
+		locations[i] = filepath.Dir(path)
+		if _, err := os.Stat(path); err != nil {
+			// Missing shards keep their directory, so repair rebuilds them there
+			continue
+		}
+		link := filepath.Join(locations[i], sharding.PlainShardName(dataID, i))
+		if err := linkShard(path, link); err != nil {
+			unlink()
+			return "", fmt.Errorf("failed to link shard %d: %w", i, err)
+		}
+		linked = append(linked, link)
+	}
+
+	proofs, err := shardProofLines(shards, "", false)
+	if err != nil {
+		unlink()
+		return "", err
+	}
+	var encryptionLines string
+	switch {
+	case opts.Key != nil:
+		encryptionLines = fmt.Sprintf("key_fingerprint: %s\n", KeyFingerprint(opts.Key))
+	case opts.External:
+		encryptionLines = fmt.Sprintf("encryption: %s\n", externalEncryption)
+	default:
+		encryptionLines = fmt.Sprintf("encryption: %s\n", noEncryption)
+	}
+	// The links carry plain names whatever the store's naming
+	plainCfg := *cfg
+	plainCfg.ObfuscateShardPaths = false
+
+	metadatafile, err := newMetadataPath(cfg, dataID, opts.Name)
+	if err != nil {
+		unlink()
+		return "", err
+	}
+	contents := metadataHeader(dataID, opts.Name, size, LayoutChoice{Layout: layoutInMemory, Code: code}, false, encryptionLines, locations, &plainCfg)
+	contents += fmt.Sprintf("adopted_from: %s\n", opts.ShardPattern)
+	contents += "Proofs: {\n" + proofs + "}\n"
+	if err := writeMetadataFile(metadatafile, contents); err != nil {
+		unlink()
+		return "", err
+	}
+
+	logger.Info("Retrieving adopted object to check it", zap.String("dataID", dataID), zap.Int("shardSize", shardSize))
+	var got bytes.Buffer
+	if _, err := retrieveTo(context.Background(), metadatafile, &got, store, cfg, logger); err != nil || sha256.Sum256(got.Bytes()) != sha256.Sum256(want) {
+		os.Remove(metadatafile)
+		unlink()
+		if err == nil {
+			err = errors.New("retrieved data differs from the decoded shards")
+		}
+		if opts.Key != nil {
+			err = fmt.Errorf("%w; the key must also be in ENCRYPTION_KEY or KEYRING_FILE", err)
+		}
+		return "", fmt.Errorf("adopted object failed to retrieve: %w", err)
+	}
+
+	if err := recordEvent(metadatafile, dataID, ObjectEvent{Event: EventAdopted, Detail: fmt.Sprintf("%d bytes from %s", size, opts.ShardPattern)}); err != nil {
+		logger.Warn("Failed to record object history", zap.Error(err))
+	}
+	logger.Info("Shards adopted", zap.String("dataID", dataID), zap.String("metadataFile", metadatafile))
+	return metadatafile, nil
+}
+
+// readAdoptedShards reads the shards named by pattern, leaving missing
+// ones nil. It fails if the shards differ in size or too many are missing
+// to decode, and when all are present, if their parity doesn't match.
+func readAdoptedShards(pattern string, code erasurecoding.Code, logger *zap.Logger) ([]string, [][]byte, error) {
+	total := code.Total()
+	paths := make([]string, total)
+	shards := make([][]byte, total)
+	missing := 0
+	first := -1
+	for i := range shards {
+		paths[i] = strings.ReplaceAll(pattern, indexPlaceholder, strconv.Itoa(i))
+		shard, err := os.ReadFile(paths[i])
+		if errors.Is(err, os.ErrNotExist) {
+			logger.Warn("Shard to adopt is missing", zap.Int("index", i), zap.String("path", paths[i]))
+			missing++
+			continue
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read shard %d: %w", i, err)
+		}
+		if first < 0 {
+			first = i
+		} else if len(shard) != len(shards[first]) {
+			return nil, nil, fmt.Errorf("%w: %s is %d bytes but %s is %d", ErrShardSizeMismatch, paths[i], len(shard), paths[first], len(shards[first]))
+		}
+		shards[i] = shard
+	}
+	if missing > code.Parity {
+		return nil, nil, fmt.Errorf("%d of %d shards are missing; at most %d can be", missing, total, code.Parity)
+	}
+	if len(shards[first]) == 0 {
+		return nil, nil, errors.New("shards to adopt are empty")
+	}
+	if missing == 0 {
+		ok, err := code.Verify(shards)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !ok {
+			return nil, nil, fmt.Errorf("parity doesn't match the data: the shards aren't a %d+%d Reed-Solomon set, or some are corrupt",
+				code.Data, code.Parity)
+		}
+	}
+	return paths, shards, nil
+}
+
+// adoptedSizes returns how many decoded bytes are the object's stored data
+// and how many bytes it has once retrieved, given the decoded length.
+func adoptedSizes(opts AdoptOptions, decoded int64) (int64, int64, error) {
+	var overhead int64
+	if opts.Key != nil {
+		overhead = aes.BlockSize
+	}
+	if opts.Size < 0 {
+		if decoded < overhead {
+			return 0, 0, errors.New("shards are too small to hold encrypted data")
+		}
+		return decoded, decoded - overhead, nil
+	}
+	if opts.Size+overhead > decoded {
+		return 0, 0, fmt.Errorf("size %d doesn't fit in shards holding %d bytes", opts.Size, decoded-overhead)
+	}
+	return opts.Size + overhead, opts.Size, nil
+}
+
+// linkShard gives an adopted shard the name vault looks for. A hard link
+// keeps working if the original name is removed; a symlink is the fallback
+// where hard links aren't supported.
+func linkShard(path, link string) error {
+	if err := os.Link(path, link); err == nil || errors.Is(err, os.ErrExist) {
+		return err
+	}
+	target, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	return os.Symlink(target, link)
+}
@@ -0,0 +1,171 @@
+package datastorage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/techninja8/getvault.io/pkg/config"
+	"github.com/techninja8/getvault.io/pkg/metadata"
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+// ErrNotAppendable is returned when appending to an object that wasn't
+// streamed. Only streamed objects are made of segments that can be added to.
+var ErrNotAppendable = errors.New("only streamed objects can be appended to")
+
+// errConcurrentAppend is returned when another append to the same object
+// finished first. The segments stored by the losing append are left
+// unreferenced and the append can simply be retried.
+var errConcurrentAppend = errors.New("object was appended to concurrently")
+
+// AppendData appends data to a streamed object. See AppendReader.
+func AppendData(metadatafile string, data []byte, store sharding.ShardStore, cfg *config.Config, logger *zap.Logger) error {
+	_, err := AppendReader(metadatafile, bytes.NewReader(data), store, cfg, logger)
+	return err
+}
+
+// AppendReader appends everything read from r to a streamed object and
+// returns the number of bytes appended. The new bytes are encrypted,
+// erasure coded and stored as new segments after the existing ones, which
+// are left untouched, so an append costs the same as storing the new bytes.
+// A partial final segment stays partial: segments each carry their own IV
+// and size, so they don't have to be full to be concatenated on retrieval.
+// The object keeps its dataID, which identifies the object as first stored.
+func AppendReader(metadatafile string, r io.Reader, store sharding.ShardStore, cfg *config.Config, logger *zap.Logger) (int64, error) {
+	if readLayout(metadatafile) != layoutStreaming {
+		return 0, ErrNotAppendable
+	}
+	ctx, logger := startOperation(context.Background(), cfg, logger, "append")
+	values, err := metadata.ReadValues(metadatafile)
+	if err != nil {
+		return 0, fmt.Errorf("error reading metadata file: %w", err)
+	}
+	if err := checkUnlocked(values, time.Now()); err != nil {
+		return 0, err
+	}
+	// An appended object would keep an ID naming the contents it had
+	if values[idModeKey] == config.IDModeContent {
+		return 0, fmt.Errorf("%w: its dataID names its contents (ID_MODE=%s)", ErrNotAppendable, config.IDModeContent)
+	}
+	existing, err := readSegments(values)
+	if err != nil {
+		return 0, err
+	}
+	size, err := strconv.ParseInt(values["filesize"], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid filesize in metadata: %q", values["filesize"])
+	}
+	candidates, err := readShardCandidates(metadatafile)
+	if err != nil {
+		return 0, err
+	}
+	// New segments go where the object's shards are recorded
+	locations := make([]string, len(candidates))
+	for i := range candidates {
+		locations[i] = candidates[i][0]
+	}
+	key, err := objectKey(metadatafile, cfg, logger)
+	if err != nil {
+		logger.Error("Failed to get encryption key", zap.Error(err))
+		return 0, err
+	}
+
+	// New segments are coded with the code the object was
+	code, err := readCode(values)
+	if err != nil {
+		return 0, err
+	}
+	code.VerifyOnEncode = cfg.VerifyOnEncode
+	segmentSize, err := streamingSegmentSize(cfg, code)
+	if err != nil {
+		return 0, err
+	}
+	// Chunked objects stay chunked, with the chunk size they were cut with
+	chunkSize, err := readChunkSize(values)
+	if err != nil {
+		return 0, err
+	}
+	var chunks *chunkSet
+	if chunkSize > 0 {
+		key, chunks = chunkKey(key), newChunkSet()
+	}
+	indexed := readShardIndexed(values)
+	source, err := newSegmentSource(r, segmentSize, chunkSize, key, indexed, code, io.Discard)
+	if err != nil {
+		return 0, err
+	}
+
+	checkSize := func(appended int64) error { return checkObjectSize(cfg, size+appended) }
+	stored, err := storeSegments(ctx, source, len(existing), key, indexed, code, chunks, io.Discard, checkSize, locations, store, cfg, logger)
+	if err != nil {
+		return 0, err
+	}
+	appended := stored.size
+	if appended == 0 {
+		return 0, nil
+	}
+
+	logger.Info("Updating metadata file", zap.String("metadataFile", metadatafile))
+	err = rewriteMetadataFile(metadatafile, func(lines []string) ([]string, error) {
+		lines, err := appendSegmentLines(lines, len(existing), size+appended, stored.segments, stored.proofs)
+		if err != nil {
+			return nil, err
+		}
+		// The digest was of the contents before the append
+		lines = metadata.DeleteValue(lines, contentDigestKey)
+		// The new segments come with their proofs
+		return bumpGeneration(lines, true)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err := recordEvent(metadatafile, values["dataID"], ObjectEvent{Event: EventAppended, Detail: fmt.Sprintf("%d bytes", appended)}); err != nil {
+		logger.Warn("Failed to record object history", zap.Error(err))
+	}
+	logger.Info("Data appended successfully", zap.String("metadataFile", metadatafile), zap.Int64("appended", appended), zap.Int64("size", size+appended))
+	return appended, nil
+}
+
+// appendSegmentLines adds segment and proof lines to the end of their
+// blocks and updates the filesize. It fails with errConcurrentAppend unless
+// the object still has the segment count the new segments were numbered from.
+func appendSegmentLines(lines []string, count int, size int64, segments, proofs string) ([]string, error) {
+	var (
+		out   = make([]string, 0, len(lines))
+		block string
+		last  = -1
+	)
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case strings.HasSuffix(trimmed, ": {"):
+			block = strings.TrimSuffix(trimmed, ": {")
+		case trimmed == "}":
+			switch block {
+			case "segments":
+				out = append(out, strings.Split(strings.TrimSuffix(segments, "\n"), "\n")...)
+			case "Proofs":
+				out = append(out, strings.Split(strings.TrimSuffix(proofs, "\n"), "\n")...)
+			}
+			block = ""
+		case block == "segments":
+			k, _, _ := strings.Cut(trimmed, ": ")
+			if s, err := strconv.Atoi(strings.TrimPrefix(k, "segment_")); err == nil && s > last {
+				last = s
+			}
+		}
+		out = append(out, line)
+	}
+	if last+1 != count {
+		return nil, errConcurrentAppend
+	}
+	return metadata.SetValue(out, "filesize", strconv.FormatInt(size, 10)), nil
+}
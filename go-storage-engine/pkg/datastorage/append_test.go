@@ -0,0 +1,133 @@
+package datastorage
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/techninja8/getvault.io/pkg/metadata"
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+// TestAppendTwice appends to a streamed object twice, in segments of
+// under 8 KiB so the first append starts after a partial segment, and
+// checks that the object reads back as the three parts concatenated, with
+// the segments stored before each append left as they were.
+func TestAppendTwice(t *testing.T) {
+	for _, layout := range []string{"streamed", "chunked"} {
+		t.Run(layout, func(t *testing.T) {
+			v := newTestVault(t)
+			v.cfg.StreamingThreshold = 1
+			if layout == "chunked" {
+				v.cfg.ChunkSize = minChunkSize
+			} else {
+				v.cfg.MaxShardSize = 1024
+			}
+			parts := [][]byte{randomBytes(t, 10_001), randomBytes(t, 5_003), randomBytes(t, 7)}
+			metadatafile := v.storeObject(t, "log.bin", parts[0])
+			want := parts[0]
+			for _, part := range parts[1:] {
+				before := v.segments(t, metadatafile)
+				appended, err := AppendReader(metadatafile, bytes.NewReader(part), v.store, v.cfg, v.logger)
+				if err != nil {
+					t.Fatalf("AppendReader: %v", err)
+				}
+				if appended != int64(len(part)) {
+					t.Fatalf("appended %d bytes, expected %d", appended, len(part))
+				}
+				want = append(want, part...)
+
+				after := v.segments(t, metadatafile)
+				if len(after) <= len(before) || !slices.Equal(after[:len(before)], before) {
+					t.Fatalf("append turned %d segments into %d, changing the existing ones", len(before), len(after))
+				}
+				if size, err := MetadataFileReader(metadatafile, "filesize"); err != nil || size != strconv.Itoa(len(want)) {
+					t.Fatalf("filesize %s after appending, expected %d", size, len(want))
+				}
+			}
+
+			got, err := RetrieveData(metadatafile, sharding.NewInMemoryShardStore(), v.cfg, v.logger)
+			if err != nil || !bytes.Equal(got, want) {
+				t.Fatalf("RetrieveData returned %d bytes, %v, expected the %d appended", len(got), err, len(want))
+			}
+			var out bytes.Buffer
+			if _, err := RetrieveTo(metadatafile, &out, sharding.NewInMemoryShardStore(), v.cfg, v.logger); err != nil || !bytes.Equal(out.Bytes(), want) {
+				t.Fatalf("RetrieveTo wrote %d bytes, %v, expected the %d appended", out.Len(), err, len(want))
+			}
+			report, err := CheckData(metadatafile, sharding.NewInMemoryShardStore(), CheckOptions{Deep: true}, v.logger)
+			if err != nil || report.Health != ObjectHealthy {
+				t.Fatalf("appended object checks %s, %v", report.Health, err)
+			}
+		})
+	}
+}
+
+// segments returns the segments recorded for a streamed object.
+func (v *testVault) segments(t *testing.T, metadatafile string) []segment {
+	t.Helper()
+	values, err := metadata.ReadValues(metadatafile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	segments, err := readSegments(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return segments
+}
+
+func TestAppendNothing(t *testing.T) {
+	v := newTestVault(t)
+	v.cfg.StreamingThreshold = 1
+	data := randomBytes(t, 1000)
+	metadatafile := v.storeObject(t, "log.bin", data)
+	before := v.segments(t, metadatafile)
+	if appended, err := AppendReader(metadatafile, bytes.NewReader(nil), v.store, v.cfg, v.logger); err != nil || appended != 0 {
+		t.Fatalf("appending nothing returned %d, %v", appended, err)
+	}
+	if after := v.segments(t, metadatafile); !slices.Equal(after, before) {
+		t.Fatalf("appending nothing left %d segments of %d", len(after), len(before))
+	}
+}
+
+func TestAppendRefusesInMemoryObjects(t *testing.T) {
+	v := newTestVault(t)
+	metadatafile := v.storeObject(t, "object.bin", randomBytes(t, 1000))
+	if err := AppendData(metadatafile, []byte("more"), v.store, v.cfg, v.logger); !errors.Is(err, ErrNotAppendable) {
+		t.Fatalf("appending to an in-memory object: %v", err)
+	}
+}
+
+// TestAppendSegmentLinesDetectsConcurrentAppend rewrites the metadata as
+// an append numbered from a stale segment count would, which must fail
+// rather than number two segments alike.
+func TestAppendSegmentLinesDetectsConcurrentAppend(t *testing.T) {
+	lines := []string{
+		"filesize: 10",
+		"segments: {",
+		"  segment_0: aaaa 5",
+		"  segment_1: bbbb 5",
+		"}",
+		"Proofs: {",
+		"}",
+	}
+	out, err := appendSegmentLines(lines, 2, 15, "  segment_2: cccc 5\n", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := map[string]string{}
+	for _, line := range out {
+		if k, v, ok := strings.Cut(line, ": "); ok {
+			values[strings.TrimSpace(k)] = v
+		}
+	}
+	if values["segment_2"] != "cccc 5" || values["filesize"] != "15" {
+		t.Fatalf("appended lines %q", out)
+	}
+	if _, err := appendSegmentLines(lines, 1, 15, "  segment_1: cccc 5\n", ""); !errors.Is(err, errConcurrentAppend) {
+		t.Fatalf("appending from a stale segment count: %v", err)
+	}
+}
@@ -0,0 +1,294 @@
+package datastorage
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/techninja8/getvault.io/pkg/metadata"
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+var errNotRebuildable = errors.New("challenged shard can't be rebuilt from the other shards")
+
+// Every shard set is given auditChallenges challenges when its proofs are
+// computed: a range of up to auditRange bytes of every shard as stored, a
+// nonce, and each shard's answer, truncated to auditResponseSize bytes.
+// An audit uses one up, so a location never sees a challenge twice, and
+// only needs the challenged ranges back. Once a set's challenges are used
+// up, or for objects stored before there were any, audits fall back to
+// rebuilding the answers from the other shards.
+const (
+	auditChallenges   = 4
+	auditRange        = 4096
+	auditResponseSize = 16
+)
+
+func challengeKey(label string, k int) string {
+	return fmt.Sprintf("Audit challenge %d for %sshards", k, label)
+}
+func responseKey(label string, k, i int) string {
+	return fmt.Sprintf("Audit response %d for %sshard %d", k, label, i)
+}
+
+// auditChallenge is a recorded challenge and the answers expected to it.
+type auditChallenge struct {
+	Offset, Length int64
+	Nonce          []byte
+	Responses      [][]byte
+}
+
+// auditChallengeLines draws the audit challenges of a freshly encoded
+// shard set and formats them for the metadata Proofs block. Ranges stay
+// clear of index headers, so answers come from the shards as they are.
+func auditChallengeLines(shards [][]byte, label string, indexed bool) (string, error) {
+	size := int64(len(shards[0]))
+	length := min(size, auditRange)
+	header := int64(0)
+	if indexed {
+		header = shardHeaderSize
+	}
+	var lines string
+	for k := 0; k < auditChallenges; k++ {
+		offset, err := rand.Int(rand.Reader, big.NewInt(size-length+1))
+		if err != nil {
+			return "", err
+		}
+		nonce := make([]byte, 32)
+		if _, err := rand.Read(nonce); err != nil {
+			return "", err
+		}
+		start := offset.Int64()
+		lines += fmt.Sprintf("  %s: %d %d %x\n", challengeKey(label, k), header+start, length, nonce)
+		for i, shard := range shards {
+			response := sharding.RetrievabilityProof(shard[start:start+length], nonce)[:auditResponseSize]
+			lines += fmt.Sprintf("  %s: %x\n", responseKey(label, k, i), response)
+		}
+	}
+	return lines, nil
+}
+
+// readAuditChallenge returns the first challenge of a shard set not yet
+// used up, and its number.
+func readAuditChallenge(values map[string]string, label string, total int) (auditChallenge, int, bool) {
+	for k := 0; k < auditChallenges; k++ {
+		fields := strings.Fields(values[challengeKey(label, k)])
+		if len(fields) != 3 {
+			continue
+		}
+		offset, err1 := strconv.ParseInt(fields[0], 10, 64)
+		length, err2 := strconv.ParseInt(fields[1], 10, 64)
+		nonce, err3 := hex.DecodeString(fields[2])
+		if err1 != nil || err2 != nil || err3 != nil || offset < 0 || length <= 0 {
+			continue
+		}
+		challenge := auditChallenge{Offset: offset, Length: length, Nonce: nonce, Responses: make([][]byte, total)}
+		complete := true
+		for i := range challenge.Responses {
+			response, err := hex.DecodeString(values[responseKey(label, k, i)])
+			if err != nil || len(response) != auditResponseSize {
+				complete = false
+				break
+			}
+			challenge.Responses[i] = response
+		}
+		if complete {
+			return challenge, k, true
+		}
+	}
+	return auditChallenge{}, 0, false
+}
+
+// useAuditChallenge removes challenge k of a shard set from the metadata
+// before it is sent to any location.
+func useAuditChallenge(metadatafile, label string, k int) error {
+	challenge, responses := "  "+challengeKey(label, k)+": ", "  "+fmt.Sprintf("Audit response %d for %sshard ", k, label)
+	return rewriteMetadataFile(metadatafile, func(lines []string) ([]string, error) {
+		kept := lines[:0]
+		for _, line := range lines {
+			if !strings.HasPrefix(line, challenge) && !strings.HasPrefix(line, responses) {
+				kept = append(kept, line)
+			}
+		}
+		return kept, nil
+	})
+}
+
+// AuditResult is the outcome of one retrievability challenge.
+type AuditResult struct {
+	Index    int
+	Location string
+	Passed   bool
+	Err      error
+}
+
+// ProveRetrievability asks the store for a proof that it holds a shard.
+// Stores that can't answer challenges have the shard downloaded instead.
+func ProveRetrievability(dataID string, index int, location string, nonce []byte, store sharding.ShardStore) ([]byte, error) {
+	if sharding.Probe(store).Prove {
+		return store.(sharding.RetrievabilityProver).ProveRetrievability(dataID, index, location, nonce)
+	}
+	shard, err := store.RetrieveShard(dataID, index, location)
+	if err != nil {
+		return nil, err
+	}
+	return sharding.RetrievabilityProof(shard, nonce), nil
+}
+
+// AuditData challenges randomly chosen shards of an object. For a
+// streamed object the challenges go to one randomly chosen segment. Each
+// audit uses up one of the challenges recorded for the shard set, and
+// only the challenged ranges of the challenged shards are fetched. Once
+// those run out, the expected answers are computed from copies rebuilt
+// out of the other shards, with fresh nonces, which takes every shard;
+// either way the location being audited never supplies its own reference.
+func AuditData(metadatafile string, store sharding.ShardStore, challenges int, logger *zap.Logger) ([]AuditResult, error) {
+	values, err := metadata.ReadValues(metadatafile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading metadata file: %w", err)
+	}
+	candidates, err := readShardCandidates(metadatafile)
+	if err != nil {
+		return nil, err
+	}
+	sets, err := readShardSets(metadatafile, values["dataID"])
+	if err != nil {
+		return nil, err
+	}
+	if len(sets) == 0 {
+		return nil, nil
+	}
+	picked, err := randomIndexes(len(sets), 1)
+	if err != nil {
+		return nil, err
+	}
+	label := ""
+	if len(sets) > 1 || readLayout(metadatafile) == layoutStreaming {
+		label = fmt.Sprintf("segment %d ", picked[0])
+		logger.Info("Auditing segment", zap.Int("segment", picked[0]))
+	}
+	set := sets[picked[0]]
+
+	// Challenges go to the recorded locations; copies elsewhere only help
+	// rebuild the expected answers.
+	locations := make([]string, len(candidates))
+	for i := range candidates {
+		locations[i] = candidates[i][0]
+	}
+	indexes, err := randomIndexes(len(locations), challenges)
+	if err != nil {
+		return nil, err
+	}
+
+	challenge, k, ok := readAuditChallenge(values, label, len(locations))
+	if !ok {
+		logger.Info("No recorded challenges left, rebuilding the expected answers from every shard")
+		return auditRebuilt(set, candidates, locations, indexes, store, logger)
+	}
+	if err := useAuditChallenge(metadatafile, label, k); err != nil {
+		return nil, fmt.Errorf("failed to use up audit challenge: %w", err)
+	}
+	var results []AuditResult
+	for _, i := range indexes {
+		result := AuditResult{Index: i, Location: locations[i]}
+		data, err := sharding.RetrieveShardRange(store, set.ID, i, locations[i], challenge.Offset, challenge.Length)
+		if err != nil {
+			result.Err = err
+		} else {
+			answer := sharding.RetrievabilityProof(data, challenge.Nonce)[:auditResponseSize]
+			result.Passed = hmac.Equal(answer, challenge.Responses[i])
+		}
+		logger.Info("Retrievability challenge", zap.Int("index", i), zap.String("location", locations[i]), zap.Bool("passed", result.Passed))
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// auditRebuilt challenges the shards at indexes with fresh nonces, and
+// checks the answers against copies rebuilt out of the other shards.
+func auditRebuilt(set shardSet, candidates [][]string, locations []string, indexes []int, store sharding.ShardStore, logger *zap.Logger) ([]AuditResult, error) {
+	shards := make([][]byte, len(candidates))
+	for i := range candidates {
+		shard, _, err := sharding.RetrieveShardFrom(store, set.ID, i, candidates[i])
+		if err != nil {
+			logger.Warn("Shard retrieval failed", zap.Int("index", i), zap.Strings("locations", candidates[i]), zap.Error(err))
+			continue
+		}
+		shards[i] = shard
+	}
+	shards = placeShards(shards, set.Indexed, logger)
+
+	var results []AuditResult
+	for _, i := range indexes {
+		result := AuditResult{Index: i, Location: locations[i]}
+
+		expected, err := rebuildShard(shards, i, set)
+		if err != nil {
+			result.Err = err
+			results = append(results, result)
+			continue
+		}
+
+		nonce := make([]byte, 32)
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, err
+		}
+		proof, err := ProveRetrievability(set.ID, i, locations[i], nonce, store)
+		if err != nil {
+			result.Err = err
+		} else {
+			// Stores answer for the shard as written, header included
+			result.Passed = hmac.Equal(proof, sharding.RetrievabilityProof(encodeShard(set.Indexed, i, expected), nonce))
+		}
+		logger.Info("Retrievability challenge", zap.Int("index", i), zap.String("location", locations[i]), zap.Bool("passed", result.Passed))
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// rebuildShard reconstructs shard i without using it and confirms the
+// result against the proof recorded for it.
+func rebuildShard(shards [][]byte, i int, set shardSet) ([]byte, error) {
+	usable, _, err := set.usableShards(shards)
+	if err != nil {
+		return nil, err
+	}
+	rebuilt := make([][]byte, len(usable))
+	copy(rebuilt, usable)
+	rebuilt[i] = nil
+	if err := set.Code.Reconstruct(rebuilt); err != nil {
+		return nil, fmt.Errorf("%w: %v", errNotRebuildable, err)
+	}
+	checks, err := set.checkProofs(rebuilt)
+	if err != nil || !checks[i] {
+		return nil, fmt.Errorf("%w: rebuilt shard doesn't match its recorded proof", errNotRebuildable)
+	}
+	return rebuilt[i], nil
+}
+
+// randomIndexes picks n distinct indexes below total.
+func randomIndexes(total, n int) ([]int, error) {
+	if n > total {
+		n = total
+	}
+	indexes := make([]int, total)
+	for i := range indexes {
+		indexes[i] = i
+	}
+	for i := 0; i < n; i++ {
+		j, err := rand.Int(rand.Reader, big.NewInt(int64(total-i)))
+		if err != nil {
+			return nil, err
+		}
+		k := i + int(j.Int64())
+		indexes[i], indexes[k] = indexes[k], indexes[i]
+	}
+	return indexes[:n], nil
+}
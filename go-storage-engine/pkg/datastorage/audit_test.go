@@ -0,0 +1,87 @@
+package datastorage
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+func TestAuditDataFetchesOnlyChallengedRanges(t *testing.T) {
+	v := newTestVault(t)
+	metadatafile := v.storeObject(t, "object.bin", randomBytes(t, 200_000))
+
+	store := &countingStore{InMemoryShardStore: sharding.NewInMemoryShardStore()}
+	for audit := 0; audit < auditChallenges; audit++ {
+		results, err := AuditData(metadatafile, store, 3, v.logger)
+		if err != nil {
+			t.Fatalf("AuditData: %v", err)
+		}
+		if len(results) != 3 {
+			t.Fatalf("%d results, expected 3", len(results))
+		}
+		for _, result := range results {
+			if !result.Passed || result.Err != nil {
+				t.Fatalf("shard %d failed its audit: %v", result.Index, result.Err)
+			}
+		}
+	}
+	if n := store.retrieved.Load(); n != 0 {
+		t.Fatalf("audits downloaded %d whole shards, expected none", n)
+	}
+
+	// Every recorded challenge is used up, so the next audit rebuilds
+	contents, err := os.ReadFile(metadatafile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(contents), "Audit challenge") {
+		t.Fatal("used audit challenges left in the metadata")
+	}
+	results, err := AuditData(metadatafile, store, 1, v.logger)
+	if err != nil {
+		t.Fatalf("AuditData: %v", err)
+	}
+	if len(results) != 1 || !results[0].Passed {
+		t.Fatalf("rebuilt audit: %+v", results)
+	}
+	if n := store.retrieved.Load(); n == 0 {
+		t.Fatal("audit without challenges left didn't rebuild from the shards")
+	}
+}
+
+func TestAuditDataFailsCorruptShard(t *testing.T) {
+	v := newTestVault(t)
+	metadatafile := v.storeObject(t, "object.bin", randomBytes(t, 2_000))
+
+	// Small shards are challenged whole, so any flipped byte is caught
+	var shards []string
+	if err := filepath.Walk(v.locations[0], func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			shards = append(shards, path)
+		}
+		return err
+	}); err != nil || len(shards) != 1 {
+		t.Fatalf("expected one shard at %s, found %v (%v)", v.locations[0], shards, err)
+	}
+	data, err := os.ReadFile(shards[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 0xff
+	if err := os.WriteFile(shards[0], data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := AuditData(metadatafile, sharding.NewInMemoryShardStore(), len(v.locations), v.logger)
+	if err != nil {
+		t.Fatalf("AuditData: %v", err)
+	}
+	for _, result := range results {
+		if passed := result.Index != 0; result.Passed != passed {
+			t.Fatalf("shard %d passed %t, expected %t (%v)", result.Index, result.Passed, passed, result.Err)
+		}
+	}
+}
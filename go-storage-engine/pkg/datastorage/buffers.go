@@ -0,0 +1,42 @@
+package datastorage
+
+import (
+	"math/bits"
+	"sync"
+
+	"github.com/techninja8/getvault.io/pkg/config"
+)
+
+// bufferPools recycle the large buffers of the store and retrieve paths:
+// cipher text with room for its parity shards, and the buffers shards are
+// decoded into. There is a pool per power-of-two size class, so buffers
+// sized for one segment size or shard size are reused for the next object
+// of that size. Only buffers that never leave the package are pooled;
+// anything handed to a caller is allocated as before.
+var bufferPools [64]sync.Pool
+
+// getBuffer returns an empty buffer with room for n bytes, from the pool
+// when cfg.BufferPoolMax allows buffers that large.
+func getBuffer(cfg *config.Config, n int) []byte {
+	if n <= 0 || int64(n) > cfg.BufferPoolMax {
+		return make([]byte, 0, n)
+	}
+	class := bits.Len(uint(n - 1))
+	if buf, ok := bufferPools[class].Get().(*[]byte); ok {
+		return (*buf)[:0]
+	}
+	return make([]byte, 0, 1<<class)
+}
+
+// putBuffer hands a buffer back for reuse. It is cleared first, since it
+// held plain or cipher text; nothing may refer to it afterwards.
+func putBuffer(cfg *config.Config, buf []byte) {
+	if cap(buf) == 0 || int64(cap(buf)) > cfg.BufferPoolMax {
+		return
+	}
+	buf = buf[:cap(buf)]
+	clear(buf)
+	// A buffer that grew past its class goes to the class it fills
+	class := bits.Len(uint(cap(buf))) - 1
+	bufferPools[class].Put(&buf)
+}
@@ -0,0 +1,103 @@
+package datastorage
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// TestPutBufferClears checks that buffers come out of the pool empty and
+// zeroed, however they went in, and that none are pooled past
+// BufferPoolMax.
+func TestPutBufferClears(t *testing.T) {
+	v := newTestVault(t)
+	v.cfg.BufferPoolMax = 1 << 20
+	for _, n := range []int{1, 1000, 4096, 1 << 20} {
+		for range 10 {
+			buf := getBuffer(v.cfg, n)
+			if len(buf) != 0 || cap(buf) < n {
+				t.Fatalf("getBuffer(%d) has length %d and capacity %d", n, len(buf), cap(buf))
+			}
+			buf = append(buf, bytes.Repeat([]byte{0xff}, n)...)
+			putBuffer(v.cfg, buf)
+			reused := getBuffer(v.cfg, n)
+			if i := bytes.IndexByte(reused[:cap(reused)], 0xff); i >= 0 {
+				t.Fatalf("buffer of %d bytes reused with byte %d left as it was", n, i)
+			}
+			putBuffer(v.cfg, reused)
+		}
+	}
+
+	// Past the limit buffers are allocated to size and dropped when put
+	buf := getBuffer(v.cfg, 1<<20+1)
+	if cap(buf) != 1<<20+1 {
+		t.Fatalf("buffer past BufferPoolMax allocated with capacity %d", cap(buf))
+	}
+	buf = append(buf, 0xff)
+	putBuffer(v.cfg, buf)
+	if buf[0] != 0xff {
+		t.Fatal("buffer past BufferPoolMax cleared as if pooled")
+	}
+}
+
+// TestRetrievedDataIsNotPooled checks that the data RetrieveData returns
+// is the caller's: retrievals after it, which reuse pooled buffers, leave
+// it as it was.
+func TestRetrievedDataIsNotPooled(t *testing.T) {
+	v := newTestVault(t)
+	v.cfg.BufferPoolMax = 256 << 20
+	data := randomBytes(t, 300_000)
+	metadatafile := v.storeObject(t, "object.bin", data)
+	got, err := RetrieveData(metadatafile, v.store, v.cfg, v.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 5 {
+		v.storeObject(t, "other.bin", randomBytes(t, len(data)))
+		var out bytes.Buffer
+		if _, err := RetrieveTo(metadatafile, &out, v.store, v.cfg, v.logger); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out.Bytes(), data) {
+			t.Fatal("RetrieveTo returned other data")
+		}
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("data returned by RetrieveData changed by later retrievals")
+	}
+}
+
+// BenchmarkStoreRetrievePooling stores an object in memory and retrieves
+// one, with buffers pooled and without. B/op and allocs/op are what
+// pooling saves.
+func BenchmarkStoreRetrievePooling(b *testing.B) {
+	for _, bench := range []struct {
+		name    string
+		poolMax int64
+	}{
+		{"unpooled", 0},
+		{"pooled", 256 << 20},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			v := newTestVault(b)
+			v.cfg.BufferPoolMax = bench.poolMax
+			data := make([]byte, 8<<20)
+			_, metadatafile, err := StoreData(data, v.store, v.cfg, v.locations, v.logger, "object.bin")
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ReportAllocs()
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// Shards stored nowhere, so the store keeps no copies
+				if _, _, err := StoreData(data, discardShardStore{}, v.cfg, v.locations, v.logger, "copy.bin"); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := RetrieveTo(metadatafile, io.Discard, v.store, v.cfg, v.logger); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
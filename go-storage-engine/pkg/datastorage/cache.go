@@ -0,0 +1,113 @@
+package datastorage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"strconv"
+
+	"go.uber.org/zap"
+
+	"github.com/techninja8/getvault.io/pkg/config"
+	"github.com/techninja8/getvault.io/pkg/metadata"
+	"github.com/techninja8/getvault.io/pkg/objectcache"
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+// cacheKeyLabel is what the object cache key is derived from the master
+// key with.
+const cacheKeyLabel = "vault cache key"
+
+// OpenObjectCache opens the object cache in cfg.CacheDir, or returns nil if
+// the cache isn't enabled. An encrypted cache needs the master key.
+func OpenObjectCache(cfg *config.Config) (*objectcache.Cache, error) {
+	if cfg.CacheDir == "" {
+		return nil, nil
+	}
+	var key []byte
+	if cfg.CacheEncrypt {
+		masterKey, err := GetEncryptionKey(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("the object cache is encrypted: %w", err)
+		}
+		mac := hmac.New(sha256.New, masterKey)
+		mac.Write([]byte(cacheKeyLabel))
+		key = mac.Sum(nil)
+	}
+	return objectcache.Open(cfg.CacheDir, cfg.CacheMaxBytes, key)
+}
+
+// RetrieveTo writes an object's plaintext to w and returns the number of
+// bytes written. With the object cache enabled, a cached copy that checks
+// out is used without touching the shards, and an object retrieved from
+// its shards is cached. A cache that can't be used is logged and skipped.
+func RetrieveTo(metadatafile string, w io.Writer, store sharding.ShardStore, cfg *config.Config, logger *zap.Logger) (int64, error) {
+	return RetrieveToContext(context.Background(), metadatafile, w, store, cfg, logger)
+}
+
+// RetrieveToContext is RetrieveTo drawing its retries from the budget in
+// ctx, as set up by NewOperationContext, if there is one.
+func RetrieveToContext(ctx context.Context, metadatafile string, w io.Writer, store sharding.ShardStore, cfg *config.Config, logger *zap.Logger) (int64, error) {
+	if cfg.VerifyOnly {
+		return 0, ErrVerifyOnly
+	}
+	release, err := useObject(metadatafile)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	cache, err := OpenObjectCache(cfg)
+	if err != nil {
+		logger.Warn("Object cache unavailable", zap.Error(err))
+	}
+	if cache == nil {
+		return retrieveTo(ctx, metadatafile, w, store, cfg, logger)
+	}
+	values, err := metadata.ReadValues(metadatafile)
+	if err != nil {
+		return 0, fmt.Errorf("error reading metadata file: %w", err)
+	}
+	dataID := values["dataID"]
+	size, err := strconv.ParseInt(values["filesize"], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid filesize in metadata: %q", values["filesize"])
+	}
+
+	counter := &countingWriter{w: w}
+	hit, err := cache.Get(dataID, size, counter)
+	if err != nil {
+		logger.Warn("Cached object unusable", zap.String("dataID", dataID), zap.Error(err))
+	}
+	if hit {
+		logger.Info("Object served from cache", zap.String("dataID", dataID))
+		return counter.n, nil
+	}
+	if counter.n > 0 {
+		return counter.n, err // The cache failed partway through writing
+	}
+
+	entry := cache.Writer(dataID)
+	n, err := retrieveTo(ctx, metadatafile, io.MultiWriter(w, entry), store, cfg, logger)
+	if err != nil {
+		entry.Abort()
+		return n, err
+	}
+	if err := entry.Commit(); err != nil {
+		logger.Warn("Failed to cache object", zap.String("dataID", dataID), zap.Error(err))
+	}
+	return n, nil
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
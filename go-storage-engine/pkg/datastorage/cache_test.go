@@ -0,0 +1,81 @@
+package datastorage
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+// TestRetrieveToCache retrieves an object three times with the object
+// cache on, in plaintext and encrypted: the second retrieval must read no
+// shards, and after its cache entry is tampered with the third must
+// discard it and fetch the object from its shards again.
+func TestRetrieveToCache(t *testing.T) {
+	for _, encrypt := range []bool{false, true} {
+		v := newTestVault(t)
+		v.cfg.CacheDir = filepath.Join(t.TempDir(), "cache")
+		v.cfg.CacheEncrypt = encrypt
+		data := randomBytes(t, 50_000)
+		metadatafile := v.storeObject(t, "artifact.tar", data)
+		dataID, err := MetadataFileReader(metadatafile, "dataID")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		retrieve := func() int64 {
+			t.Helper()
+			store := &countingStore{InMemoryShardStore: sharding.NewInMemoryShardStore()}
+			var out bytes.Buffer
+			if _, err := RetrieveTo(metadatafile, &out, store, v.cfg, v.logger); err != nil {
+				t.Fatalf("encrypt %t: RetrieveTo: %v", encrypt, err)
+			}
+			if !bytes.Equal(out.Bytes(), data) {
+				t.Fatalf("encrypt %t: retrieved %d bytes that differ from the object", encrypt, out.Len())
+			}
+			return store.retrieved.Load()
+		}
+		if n := retrieve(); n == 0 {
+			t.Fatalf("encrypt %t: first retrieval read no shards", encrypt)
+		}
+		if n := retrieve(); n != 0 {
+			t.Fatalf("encrypt %t: cached retrieval read %d shards", encrypt, n)
+		}
+
+		entry := filepath.Join(v.cfg.CacheDir, dataID+".obj")
+		cached, err := os.ReadFile(entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if encrypt && bytes.Contains(cached, data[:64]) {
+			t.Fatal("encrypted cache entry holds the plaintext")
+		}
+		cached[len(cached)/2] ^= 0xff
+		if err := os.WriteFile(entry, cached, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if n := retrieve(); n == 0 {
+			t.Fatalf("encrypt %t: retrieval from a tampered entry read no shards", encrypt)
+		}
+		// The refetched object replaced the tampered entry
+		if n := retrieve(); n != 0 {
+			t.Fatalf("encrypt %t: retrieval after the refetch read %d shards", encrypt, n)
+		}
+	}
+}
+
+func TestRetrieveToCacheRefusedVerifyOnly(t *testing.T) {
+	v := newTestVault(t)
+	v.cfg.CacheDir = filepath.Join(t.TempDir(), "cache")
+	metadatafile := v.storeObject(t, "artifact.tar", randomBytes(t, 1000))
+	if _, err := RetrieveTo(metadatafile, &bytes.Buffer{}, v.store, v.cfg, v.logger); err != nil {
+		t.Fatal(err)
+	}
+	v.cfg.VerifyOnly = true
+	if _, err := RetrieveTo(metadatafile, &bytes.Buffer{}, v.store, v.cfg, v.logger); !errors.Is(err, ErrVerifyOnly) {
+		t.Fatalf("serving the cache to a verify-only instance: %v", err)
+	}
+}
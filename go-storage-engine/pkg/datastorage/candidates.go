@@ -0,0 +1,119 @@
+package datastorage
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/techninja8/getvault.io/pkg/metadata"
+)
+
+// A shard's recorded location is where it was written. Copies made later,
+// by a rebalance or replication, are listed on an optional
+// "shard_<i>_candidates" line and tried in order when the recorded
+// location doesn't have the shard.
+
+// readShardCandidates returns, for every shard, its recorded location
+// followed by its candidate locations. Every operation on an object's
+// shards starts here, so this is also where objects needing a later vault
+// are refused.
+func readShardCandidates(metadatafile string) ([][]string, error) {
+	values, err := metadata.ReadValues(metadatafile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading metadata file: %w", err)
+	}
+	if err := checkReaderVersion(values); err != nil {
+		return nil, err
+	}
+	code, err := readCode(values)
+	if err != nil {
+		return nil, err
+	}
+	candidates := make([][]string, code.Total())
+	for i := range candidates {
+		location, ok := values[fmt.Sprintf("shard_%d", i)]
+		if !ok {
+			return nil, fmt.Errorf("error reading shard location from metadata file: shard_%d not found", i)
+		}
+		candidates[i] = []string{location}
+		if extra, ok := values[fmt.Sprintf("shard_%d_candidates", i)]; ok {
+			candidates[i] = append(candidates[i], splitCandidates(extra)...)
+		}
+	}
+	return candidates, nil
+}
+
+func splitCandidates(value string) []string {
+	var locations []string
+	for _, location := range strings.Split(value, ",") {
+		if location = strings.TrimSpace(location); location != "" {
+			locations = append(locations, location)
+		}
+	}
+	return locations
+}
+
+// AddShardCandidate records another location holding a copy of a shard.
+func AddShardCandidate(metadatafile string, index int, location string) error {
+	values, err := metadata.ReadValues(metadatafile)
+	if err != nil {
+		return fmt.Errorf("error reading metadata file: %w", err)
+	}
+	code, err := readCode(values)
+	if err != nil {
+		return err
+	}
+	if index < 0 || index >= code.Total() {
+		return fmt.Errorf("invalid shard index %d", index)
+	}
+	location = strings.TrimSpace(location)
+	if location == "" || strings.Contains(location, ",") {
+		return fmt.Errorf("invalid candidate location %q", location)
+	}
+
+	primaryKey := fmt.Sprintf("shard_%d", index)
+	candidatesKey := primaryKey + "_candidates"
+	return rewriteMetadataFile(metadatafile, func(in []string) ([]string, error) {
+		var (
+			lines      []string
+			primary    = -1
+			primaryLoc string
+			existing   []string
+		)
+		for _, line := range in {
+			k, v, _ := strings.Cut(line, ": ")
+			switch strings.TrimSpace(k) {
+			case primaryKey:
+				if primary < 0 {
+					primary = len(lines)
+					primaryLoc = strings.TrimSpace(v)
+				}
+			case candidatesKey:
+				existing = append(existing, splitCandidates(v)...)
+				continue
+			}
+			lines = append(lines, line)
+		}
+		if primary < 0 {
+			return nil, fmt.Errorf("no location recorded for shard %d", index)
+		}
+		if location == primaryLoc || slices.Contains(existing, location) {
+			return nil, nil
+		}
+
+		candidatesLine := fmt.Sprintf("  %s: %s", candidatesKey, strings.Join(append(existing, location), ", "))
+		return slices.Insert(lines, primary+1, candidatesLine), nil
+	})
+}
+
+// rewriteMetadataFile rewrites a metadata file with metadata.Rewrite,
+// updating the vault version needed to read it.
+func rewriteMetadataFile(metadatafile string, edit func(lines []string) ([]string, error)) error {
+	return metadata.Rewrite(metadatafile, func(lines []string) ([]string, error) {
+		lines, err := edit(lines)
+		if err != nil || lines == nil {
+			return nil, err
+		}
+		return stampReaderVersion(lines), nil
+	})
+}
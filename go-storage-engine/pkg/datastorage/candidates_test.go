@@ -0,0 +1,88 @@
+package datastorage
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/techninja8/getvault.io/pkg/erasurecoding"
+	"github.com/techninja8/getvault.io/pkg/metadata"
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+// TestRetrieveFromCandidateLocation copies more shards than there is
+// parity to a secondary location and removes their primaries. Erasure
+// coding can't make up for that many, so retrieval fails until the copies
+// are recorded as candidates, and succeeds from the copies after.
+func TestRetrieveFromCandidateLocation(t *testing.T) {
+	v := newTestVault(t)
+	data := randomBytes(t, 100_000)
+	metadatafile := v.storeObject(t, "object.bin", data)
+	secondary := filepath.Join(t.TempDir(), "secondary")
+	if err := os.MkdirAll(secondary, 0755); err != nil {
+		t.Fatal(err)
+	}
+	moved := erasurecoding.ParityShards + 1
+	for index := 0; index < moved; index++ {
+		primary := v.shardFile(t, metadatafile, index)
+		if err := os.Rename(primary, filepath.Join(secondary, filepath.Base(primary))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := RetrieveData(metadatafile, sharding.NewInMemoryShardStore(), v.cfg, v.logger); !errors.Is(err, ErrInsufficientShards) {
+		t.Fatalf("RetrieveData without candidates: %v", err)
+	}
+
+	for index := 0; index < moved; index++ {
+		if err := AddShardCandidate(metadatafile, index, secondary); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := RetrieveData(metadatafile, sharding.NewInMemoryShardStore(), v.cfg, v.logger)
+	if err != nil {
+		t.Fatalf("RetrieveData with candidates: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("retrieved data differs from the stored data")
+	}
+}
+
+func TestAddShardCandidate(t *testing.T) {
+	v := newTestVault(t)
+	metadatafile := v.storeObject(t, "object.bin", randomBytes(t, 1000))
+	for _, location := range []string{"/mnt/b", "/mnt/c", "/mnt/b", v.locations[3]} {
+		if err := AddShardCandidate(metadatafile, 3, location); err != nil {
+			t.Fatalf("adding %s: %v", location, err)
+		}
+	}
+	// Already recorded locations, the primary among them, aren't repeated
+	values, err := metadata.ReadValues(metadatafile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := values["shard_3_candidates"]; got != "/mnt/b, /mnt/c" {
+		t.Fatalf("shard_3_candidates is %q", got)
+	}
+	candidates, err := readShardCandidates(metadatafile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(candidates[3], " "); got != v.locations[3]+" /mnt/b /mnt/c" {
+		t.Fatalf("shard 3 is tried at %s", got)
+	}
+	if len(candidates[2]) != 1 {
+		t.Fatalf("shard 2 has candidates %v", candidates[2])
+	}
+
+	for _, tc := range []struct {
+		index    int
+		location string
+	}{{-1, "/mnt/b"}, {erasurecoding.DataShards + erasurecoding.ParityShards, "/mnt/b"}, {3, " "}, {3, "/mnt/b,/mnt/c"}} {
+		if err := AddShardCandidate(metadatafile, tc.index, tc.location); err == nil {
+			t.Fatalf("added candidate %q for shard %d", tc.location, tc.index)
+		}
+	}
+}
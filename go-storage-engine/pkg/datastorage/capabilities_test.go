@@ -0,0 +1,99 @@
+package datastorage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+// bareStore only stores and retrieves shards, hiding every optional
+// capability of the store inside.
+type bareStore struct {
+	sharding.ShardStore
+}
+
+func newBareStore() *bareStore {
+	return &bareStore{sharding.NewInMemoryShardStore()}
+}
+
+// TestBareStoreFallbacks runs the operations that consult capabilities
+// against a store with none, and checks that each still works through its
+// fallback: verification downloads shards instead of checksumming them in
+// place, locks are kept in metadata only, demotion rewrites every cold
+// copy, and tuning reports the probe shards it couldn't delete.
+func TestBareStoreFallbacks(t *testing.T) {
+	v := newTestVault(t)
+	if caps := sharding.Probe(newBareStore()); caps != (sharding.Capabilities{}) {
+		t.Fatalf("bare store probed as %s", caps)
+	}
+	data := randomBytes(t, 100_000)
+	_, metadatafile, err := StoreData(data, newBareStore(), v.cfg, v.locations, v.logger, "object.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := RetrieveData(metadatafile, newBareStore(), v.cfg, v.logger)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("RetrieveData returned %d bytes, %v", len(got), err)
+	}
+
+	report, err := CheckData(metadatafile, newBareStore(), CheckOptions{}, v.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Health != ObjectHealthy {
+		t.Fatalf("health %s, expected %s", report.Health, ObjectHealthy)
+	}
+	for _, shard := range report.Shards {
+		if shard.Depth != DepthFull {
+			t.Fatalf("shard %d verified to depth %q without the checksum capability", shard.Index, shard.Depth)
+		}
+	}
+	missing := v.shardFile(t, metadatafile, 3)
+	if err := os.Remove(missing); err != nil {
+		t.Fatal(err)
+	}
+	if report, err := CheckData(metadatafile, newBareStore(), CheckOptions{Heal: true}, v.logger); err != nil || report.Repaired != 1 {
+		t.Fatalf("healing a missing shard: %+v, %v", report, err)
+	}
+	if _, err := os.Stat(missing); err != nil {
+		t.Fatalf("healed shard: %v", err)
+	}
+
+	until := time.Now().Add(time.Hour)
+	if err := LockObject(metadatafile, until, newBareStore(), v.logger); err != nil {
+		t.Fatalf("LockObject: %v", err)
+	}
+	if err := CheckUnlocked(metadatafile, time.Now()); !errors.Is(err, ErrObjectLocked) {
+		t.Fatalf("object locked on a bare store: %v", err)
+	}
+
+	cold := make([]string, len(v.locations))
+	for i := range cold {
+		cold[i] = filepath.Join(t.TempDir(), fmt.Sprintf("cold%d", i))
+	}
+	now := time.Now().Add(100 * 24 * time.Hour)
+	policy := TierPolicy{ColdAfter: 90 * 24 * time.Hour, ColdLocations: cold, Now: func() time.Time { return now }}
+	summary, err := TierRun(context.Background(), v.cfg.MetadataDir, newBareStore(), policy, v.logger)
+	if err != nil || summary.Demoted != 1 {
+		t.Fatalf("tier run on a bare store: %+v, %v", summary, err)
+	}
+	if got, err := RetrieveData(metadatafile, newBareStore(), v.cfg, v.logger); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("retrieving the demoted object: %v", err)
+	}
+
+	opts := TuneOptions{Levels: []int{1, 2}, Probes: 4, ShardSize: 64}
+	result, err := Tune(func() sharding.ShardStore { return newBareStore() }, []string{t.TempDir()}, opts, v.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Leftover != len(opts.Levels)*opts.Probes {
+		t.Fatalf("tuning on a bare store reported %d probe shards left over, expected %d", result.Leftover, len(opts.Levels)*opts.Probes)
+	}
+}
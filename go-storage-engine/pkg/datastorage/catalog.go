@@ -0,0 +1,265 @@
+package datastorage
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/techninja8/getvault.io/pkg/metadata"
+)
+
+// The catalog is the metadata directory. Deleting an object doesn't remove
+// its metadata file: it becomes a tombstone, renamed to
+// "<file>.tombstone" with the time of deletion recorded as deleted. The
+// rename takes it out of every listing of metadata files, while replication
+// and garbage collection can still tell a deleted object from one that
+// was never there. Tombstones are dropped by compaction once they are
+// older than the retention window and their shards have been purged from
+// the trash (see EmptyTrash).
+
+// tombstoneSuffix is added to a metadata file's name when its object is
+// deleted.
+const tombstoneSuffix = ".tombstone"
+
+// historyArchive is the file in the history directory that compaction
+// moves the histories of dropped objects into.
+const historyArchive = "archive.jsonl"
+
+// MarkDeleted turns an object's metadata file into a tombstone recording
+// that it was deleted at the given time, and returns the tombstone's path.
+// The shards are left alone.
+func MarkDeleted(metadatafile string, at time.Time, logger *zap.Logger) (string, error) {
+	values, err := metadata.ReadValues(metadatafile)
+	if err != nil {
+		return "", fmt.Errorf("error reading metadata file: %w", err)
+	}
+	if err := setMetadataValue(metadatafile, "deleted", at.UTC().Format(time.RFC3339)); err != nil {
+		return "", err
+	}
+
+	unlock, err := metadata.Lock(metadatafile, true)
+	if err != nil {
+		return "", err
+	}
+	tombstone := metadatafile + tombstoneSuffix
+	err = os.Rename(metadatafile, tombstone)
+	unlock()
+	if err != nil {
+		return "", fmt.Errorf("failed to mark object deleted: %w", err)
+	}
+	os.Remove(metadatafile + ".lock")
+
+	if err := recordEvent(tombstone, values["dataID"], ObjectEvent{Event: EventDeleted}); err != nil {
+		logger.Warn("Failed to record object history", zap.Error(err))
+	}
+	logger.Info("Object marked deleted", zap.String("tombstone", tombstone))
+	return tombstone, nil
+}
+
+// deletedAt returns when an object was deleted. A tombstone whose time
+// can't be read counts as deleted at the zero time, so compaction drops it
+// rather than keeping it forever.
+func deletedAt(values map[string]string) time.Time {
+	at, _ := time.Parse(time.RFC3339, values["deleted"])
+	return at
+}
+
+// CatalogStats counts the entries in a metadata directory.
+type CatalogStats struct {
+	Objects    int `json:"objects"`
+	Tombstones int `json:"tombstones"`
+}
+
+// TombstoneRatio is the fraction of the catalog's entries that are
+// tombstones.
+func (s CatalogStats) TombstoneRatio() float64 {
+	if s.Objects+s.Tombstones == 0 {
+		return 0
+	}
+	return float64(s.Tombstones) / float64(s.Objects+s.Tombstones)
+}
+
+// ReadCatalogStats counts the objects and tombstones in a metadata
+// directory.
+func ReadCatalogStats(dir string) (CatalogStats, error) {
+	objects, err := listMetadataFiles(dir)
+	if err != nil {
+		return CatalogStats{}, err
+	}
+	tombstones, err := filepath.Glob(filepath.Join(dir, "*"+tombstoneSuffix))
+	if err != nil {
+		return CatalogStats{}, fmt.Errorf("failed to list tombstones: %w", err)
+	}
+	return CatalogStats{Objects: len(objects), Tombstones: len(tombstones)}, nil
+}
+
+// CompactSummary is what a catalog compaction did.
+type CompactSummary struct {
+	Before   CatalogStats `json:"before"`
+	Dropped  int          `json:"dropped"`
+	Kept     int          `json:"kept"`     // Tombstones still inside the retention window
+	Unpurged int          `json:"unpurged"` // Tombstones whose shards are still in the trash
+	Archived int          `json:"archived"` // History events moved to the archive
+}
+
+// ArchivedEvent is an event of a compacted-away object, kept in the
+// history archive.
+type ArchivedEvent struct {
+	DataID   string `json:"data_id"`
+	Filename string `json:"filename,omitempty"`
+	ObjectEvent
+}
+
+// CompactCatalog drops the tombstones in a metadata directory that were
+// deleted more than retention before now and whose shards have been
+// purged. The history of each dropped
+// object is appended to the history archive before its own file is
+// removed, unless another entry in the catalog still shares its dataID.
+func CompactCatalog(dir string, retention time.Duration, now time.Time, logger *zap.Logger) (*CompactSummary, error) {
+	stats, err := ReadCatalogStats(dir)
+	if err != nil {
+		return nil, err
+	}
+	summary := &CompactSummary{Before: stats}
+	tombstones, err := filepath.Glob(filepath.Join(dir, "*"+tombstoneSuffix))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tombstones: %w", err)
+	}
+
+	for _, tombstone := range tombstones {
+		values, err := metadata.ReadValues(tombstone)
+		if err != nil {
+			logger.Warn("Skipping unreadable tombstone", zap.String("tombstone", tombstone), zap.Error(err))
+			continue
+		}
+		if now.Sub(deletedAt(values)) < retention {
+			summary.Kept++
+			continue
+		}
+		if values["purged"] == "" {
+			// Dropping it would leave its shards with nothing pointing at them
+			summary.Unpurged++
+			continue
+		}
+
+		unlock, err := metadata.Lock(tombstone, true)
+		if err != nil {
+			return summary, err
+		}
+		dataID := values["dataID"]
+		archived := 0
+		if dataID != "" && !catalogHasDataID(dir, dataID, tombstone) {
+			archived, err = archiveHistory(dir, dataID, objectFilename(values))
+		}
+		if err == nil {
+			err = os.Remove(tombstone)
+		}
+		unlock()
+		if err != nil {
+			return summary, fmt.Errorf("failed to compact %s: %w", tombstone, err)
+		}
+		os.Remove(tombstone + ".lock")
+		summary.Dropped++
+		summary.Archived += archived
+		logger.Debug("Tombstone dropped", zap.String("tombstone", tombstone), zap.String("dataID", dataID))
+	}
+
+	logger.Info("Catalog compacted", zap.Int("dropped", summary.Dropped), zap.Int("kept", summary.Kept), zap.Int("unpurged", summary.Unpurged), zap.Int("archivedEvents", summary.Archived))
+	return summary, nil
+}
+
+// catalogHasDataID reports whether an entry other than except, live or
+// deleted, has the given dataID, and so still needs its history.
+func catalogHasDataID(dir, dataID, except string) bool {
+	if _, err := FindMetadataFile(dir, dataID); err == nil {
+		return true
+	}
+	tombstones, _ := filepath.Glob(filepath.Join(dir, "*"+tombstoneSuffix))
+	for _, tombstone := range tombstones {
+		if tombstone == except {
+			continue
+		}
+		if id, err := metadata.ReadValue(tombstone, "dataID"); err == nil && id == dataID {
+			return true
+		}
+	}
+	return false
+}
+
+// archiveHistory moves an object's history into the archive and returns
+// how many events it moved. The archive is synced before the history file
+// is removed, so a crash leaves events duplicated rather than lost.
+func archiveHistory(dir, dataID, filename string) (int, error) {
+	historyFile := filepath.Join(dir, historyDir, dataID+".jsonl")
+	if _, err := os.Stat(historyFile); errors.Is(err, os.ErrNotExist) {
+		// ReadHistory would read back what is already archived
+		return 0, nil
+	}
+	events, err := ReadHistory(dir, dataID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read history: %w", err)
+	}
+	if len(events) == 0 {
+		os.Remove(historyFile)
+		return 0, nil
+	}
+
+	var lines strings.Builder
+	for _, event := range events {
+		line, err := json.Marshal(ArchivedEvent{DataID: dataID, Filename: filename, ObjectEvent: event})
+		if err != nil {
+			return 0, err
+		}
+		lines.Write(line)
+		lines.WriteByte('\n')
+	}
+	file, err := os.OpenFile(filepath.Join(dir, historyDir, historyArchive), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return 0, fmt.Errorf("failed to archive history: %w", err)
+	}
+	if _, err := file.WriteString(lines.String()); err != nil {
+		file.Close()
+		return 0, fmt.Errorf("failed to archive history: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return 0, fmt.Errorf("failed to archive history: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return 0, fmt.Errorf("failed to archive history: %w", err)
+	}
+	if err := os.Remove(historyFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return 0, fmt.Errorf("failed to remove archived history: %w", err)
+	}
+	return len(events), nil
+}
+
+// readArchivedHistory returns the archived events of an object, oldest
+// first.
+func readArchivedHistory(metadataDir, dataID string) ([]ObjectEvent, error) {
+	file, err := os.Open(filepath.Join(metadataDir, historyDir, historyArchive))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var events []ObjectEvent
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var event ArchivedEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err == nil && event.DataID == dataID {
+			events = append(events, event.ObjectEvent)
+		}
+	}
+	return events, scanner.Err()
+}
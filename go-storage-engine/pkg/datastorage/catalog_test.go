@@ -0,0 +1,118 @@
+package datastorage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+// TestCompactCatalog populates a catalog, deletes most of it at various
+// ages, and compacts it. Only tombstones past the retention window whose
+// shards are purged may go; their histories must still read back from
+// the archive, and a second compaction must find nothing more to do.
+func TestCompactCatalog(t *testing.T) {
+	v := newTestVault(t)
+	now := time.Now()
+	const retention = 30 * 24 * time.Hour
+	objects := make([]string, 6)
+	dataIDs := make([]string, len(objects))
+	for i := range objects {
+		objects[i] = v.storeObject(t, fmt.Sprintf("object%d.bin", i), randomBytes(t, 1000))
+		id, err := MetadataFileReader(objects[i], "dataID")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dataIDs[i] = id
+	}
+
+	tombstones := make([]string, 4)
+	for i, deleted := range []struct {
+		age    time.Duration
+		purged bool
+	}{
+		{100 * 24 * time.Hour, true},  // Dropped
+		{40 * 24 * time.Hour, true},   // Dropped
+		{100 * 24 * time.Hour, false}, // Shards still in the trash
+		{time.Hour, true},             // Within retention
+	} {
+		tombstone, err := MarkDeleted(objects[i], now.Add(-deleted.age), v.logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if deleted.purged {
+			if _, err := PurgeObject(context.Background(), tombstone, sharding.NewInMemoryShardStore(), now, v.logger); err != nil {
+				t.Fatal(err)
+			}
+		}
+		tombstones[i] = tombstone
+	}
+
+	stats, err := ReadCatalogStats(v.cfg.MetadataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Objects != 2 || stats.Tombstones != 4 {
+		t.Fatalf("catalog counts %+v, expected 2 objects and 4 tombstones", stats)
+	}
+	if listed, err := ListObjects(v.cfg.MetadataDir); err != nil || len(listed) != 2 {
+		t.Fatalf("listing the catalog found %d objects, %v", len(listed), err)
+	}
+
+	summary, err := CompactCatalog(v.cfg.MetadataDir, retention, now, v.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Dropped != 2 || summary.Kept != 1 || summary.Unpurged != 1 || summary.Archived == 0 {
+		t.Fatalf("compaction %+v, expected 2 dropped, 1 kept and 1 unpurged", *summary)
+	}
+	for i, tombstone := range tombstones {
+		_, err := os.Stat(tombstone)
+		if dropped := i < 2; dropped != os.IsNotExist(err) {
+			t.Fatalf("tombstone %d: dropped %t, stat %v", i, dropped, err)
+		}
+	}
+	if stats, err := ReadCatalogStats(v.cfg.MetadataDir); err != nil || stats.Objects != 2 || stats.Tombstones != 2 {
+		t.Fatalf("compacted catalog counts %+v, %v", stats, err)
+	}
+
+	// Dropped objects' histories read back from the archive
+	for _, dataID := range dataIDs[:2] {
+		history, err := ReadHistory(v.cfg.MetadataDir, dataID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(history) < 3 || history[0].Event != EventStored || history[len(history)-1].Event != EventPurged {
+			t.Fatalf("archived history of %s: %+v", dataID, history)
+		}
+	}
+
+	again, err := CompactCatalog(v.cfg.MetadataDir, retention, now, v.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Dropped != 0 || again.Archived != 0 {
+		t.Fatalf("second compaction %+v", *again)
+	}
+	if history, err := ReadHistory(v.cfg.MetadataDir, dataIDs[0]); err != nil || history[0].Event != EventStored {
+		t.Fatalf("archived history after a second compaction: %+v, %v", history, err)
+	}
+}
+
+func TestTombstoneRatio(t *testing.T) {
+	for _, tc := range []struct {
+		stats CatalogStats
+		want  float64
+	}{
+		{CatalogStats{}, 0},
+		{CatalogStats{Objects: 3, Tombstones: 1}, 0.25},
+		{CatalogStats{Tombstones: 2}, 1},
+	} {
+		if got := tc.stats.TombstoneRatio(); got != tc.want {
+			t.Fatalf("%+v: ratio %v, expected %v", tc.stats, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package datastorage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/techninja8/getvault.io/pkg/config"
+	"github.com/techninja8/getvault.io/pkg/metadata"
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+// External checksums cross-check retrieved plaintext against a source of
+// truth outside the vault, such as the SHA256SUMS file of a backup set.
+
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+var checksumAlgos = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// NewChecksumHash returns a hash for one of md5, sha1, sha256 or sha512.
+func NewChecksumHash(algo string) (hash.Hash, error) {
+	newHash, ok := checksumAlgos[strings.ToLower(algo)]
+	if !ok {
+		return nil, fmt.Errorf("unsupported checksum algorithm %q", algo)
+	}
+	return newHash(), nil
+}
+
+// Checksum is an expected digest, written <algo>:<hex>.
+type Checksum struct {
+	Algo string
+	Sum  []byte
+}
+
+// ParseChecksum parses a checksum written <algo>:<hex>.
+func ParseChecksum(spec string) (Checksum, error) {
+	algo, value, ok := strings.Cut(spec, ":")
+	if !ok {
+		return Checksum{}, fmt.Errorf("invalid checksum %q, expected <algo>:<hex>", spec)
+	}
+	algo = strings.ToLower(algo)
+	h, err := NewChecksumHash(algo)
+	if err != nil {
+		return Checksum{}, err
+	}
+	sum, err := hex.DecodeString(value)
+	if err != nil || len(sum) != h.Size() {
+		return Checksum{}, fmt.Errorf("invalid %s checksum %q", algo, value)
+	}
+	return Checksum{Algo: algo, Sum: sum}, nil
+}
+
+// New returns a hash of the checksum's algorithm.
+func (c Checksum) New() hash.Hash {
+	return checksumAlgos[c.Algo]()
+}
+
+// Verify compares the digest of h with the checksum.
+func (c Checksum) Verify(h hash.Hash) error {
+	if got := h.Sum(nil); !bytes.Equal(got, c.Sum) {
+		return fmt.Errorf("%w: expected %s:%x, got %x", ErrChecksumMismatch, c.Algo, c.Sum, got)
+	}
+	return nil
+}
+
+// ManifestEntry is one line of a sums file.
+type ManifestEntry struct {
+	Sum      []byte
+	Filename string
+}
+
+// ReadManifest reads a sums file in the format written by sha256sum and
+// friends: a hex digest, a space, then a space or "*" and the filename.
+// Blank lines and "#" comments are skipped.
+func ReadManifest(path string) ([]ManifestEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening manifest: %w", err)
+	}
+	defer file.Close()
+
+	var entries []ManifestEntry
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		value, name, ok := strings.Cut(line, " ")
+		if !ok || len(name) < 2 || (name[0] != ' ' && name[0] != '*') {
+			return nil, fmt.Errorf("invalid manifest line %d", n)
+		}
+		sum, err := hex.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid checksum on manifest line %d", n)
+		}
+		entries = append(entries, ManifestEntry{Sum: sum, Filename: name[1:]})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	return entries, nil
+}
+
+// Manifest check outcomes, as printed by sha256sum -c.
+const (
+	ManifestOK      = "OK"
+	ManifestFailed  = "FAILED"
+	ManifestMissing = "MISSING"
+)
+
+// ManifestResult is the outcome of checking one manifest entry.
+type ManifestResult struct {
+	Filename     string
+	MetadataFile string
+	Status       string
+	Err          error
+}
+
+// VerifyManifest retrieves every object named in a manifest and compares
+// the algo digest of its plaintext with the listed one. Objects are matched
+// to entries by filename; when several objects share a name the most
+// recently created is checked.
+func VerifyManifest(entries []ManifestEntry, algo, metadataDir string, store sharding.ShardStore, cfg *config.Config, logger *zap.Logger) ([]ManifestResult, error) {
+	if _, err := NewChecksumHash(algo); err != nil {
+		return nil, err
+	}
+	byName, err := metadataFilesByName(metadataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]ManifestResult, len(entries))
+	for i, entry := range entries {
+		result := &results[i]
+		result.Filename = entry.Filename
+		metadataFile, ok := byName[filepath.Base(entry.Filename)]
+		if !ok {
+			result.Status = ManifestMissing
+			continue
+		}
+		result.MetadataFile = metadataFile
+
+		checksum := Checksum{Algo: strings.ToLower(algo), Sum: entry.Sum}
+		h := checksum.New()
+		if _, err := retrieveTo(context.Background(), metadataFile, h, store, cfg, logger); err != nil {
+			result.Status, result.Err = ManifestFailed, err
+			continue
+		}
+		if err := checksum.Verify(h); err != nil {
+			result.Status, result.Err = ManifestFailed, err
+			continue
+		}
+		result.Status = ManifestOK
+	}
+	return results, nil
+}
+
+// metadataFilesByName maps object filenames to their newest metadata file.
+func metadataFilesByName(dir string) (map[string]string, error) {
+	files, err := listMetadataFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	byName := make(map[string]string)
+	created := make(map[string]string)
+	for _, file := range files {
+		values, err := metadata.ReadValues(file)
+		if err != nil {
+			continue
+		}
+		name, date := objectFilename(values), values["creation_date"]
+		if _, ok := byName[name]; !ok || date > created[name] {
+			byName[name], created[name] = file, date
+		}
+	}
+	return byName, nil
+}
@@ -0,0 +1,138 @@
+package datastorage
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+func TestParseChecksum(t *testing.T) {
+	sum := sha256.Sum256([]byte("data"))
+	for _, spec := range []string{"sha256:" + hex.EncodeToString(sum[:]), "SHA256:" + hex.EncodeToString(sum[:])} {
+		checksum, err := ParseChecksum(spec)
+		if err != nil || checksum.Algo != "sha256" || !bytes.Equal(checksum.Sum, sum[:]) {
+			t.Fatalf("%s parsed as %+v, %v", spec, checksum, err)
+		}
+	}
+	for _, spec := range []string{
+		hex.EncodeToString(sum[:]),
+		"crc32:" + hex.EncodeToString(sum[:4]),
+		"md5:" + hex.EncodeToString(sum[:]),
+		"sha256:" + hex.EncodeToString(sum[:])[1:],
+		"sha256:zz" + hex.EncodeToString(sum[1:]),
+	} {
+		if checksum, err := ParseChecksum(spec); err == nil {
+			t.Fatalf("%s parsed as %+v", spec, checksum)
+		}
+	}
+}
+
+// TestRetrieveMatchesExternalChecksum hashes objects as they are
+// retrieved, in memory and streamed, and checks them against a matching
+// and a mismatching external checksum in every algorithm.
+func TestRetrieveMatchesExternalChecksum(t *testing.T) {
+	for _, layout := range []string{"in-memory", "streamed"} {
+		v := newTestVault(t)
+		if layout == "streamed" {
+			v.cfg.StreamingThreshold = 1
+			v.cfg.MaxShardSize = 4096
+		}
+		data := randomBytes(t, 50_001)
+		metadatafile := v.storeObject(t, "object.bin", data)
+		for algo := range checksumAlgos {
+			h, err := NewChecksumHash(algo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			h.Write(data)
+			sum := h.Sum(nil)
+			wrong := bytes.Clone(sum)
+			wrong[0] ^= 1
+
+			for _, tc := range []struct {
+				sum  []byte
+				want error
+			}{{sum, nil}, {wrong, ErrChecksumMismatch}} {
+				checksum, err := ParseChecksum(algo + ":" + hex.EncodeToString(tc.sum))
+				if err != nil {
+					t.Fatal(err)
+				}
+				h := checksum.New()
+				var out bytes.Buffer
+				if _, err := RetrieveTo(metadatafile, io.MultiWriter(&out, h), sharding.NewInMemoryShardStore(), v.cfg, v.logger); err != nil {
+					t.Fatal(err)
+				}
+				if err := checksum.Verify(h); !errors.Is(err, tc.want) {
+					t.Fatalf("%s, %s checksum %x of %d bytes retrieved: %v, expected %v", layout, algo, tc.sum, out.Len(), err, tc.want)
+				}
+			}
+		}
+	}
+}
+
+// TestVerifyManifest checks objects against a sha256sum-style manifest
+// with a matching entry, a mismatching one and one for a file never
+// stored, and against a sha1 manifest.
+func TestVerifyManifest(t *testing.T) {
+	v := newTestVault(t)
+	good, bad := randomBytes(t, 10_000), randomBytes(t, 20_000)
+	v.storeObject(t, "good.bin", good)
+	v.storeObject(t, "bad.bin", bad)
+	goodSum, badSum := sha256.Sum256(good), sha256.Sum256(append(bytes.Clone(bad), 0))
+	missingSum := sha256.Sum256(nil)
+
+	manifest := filepath.Join(t.TempDir(), "SHA256SUMS")
+	contents := fmt.Sprintf("# backup set\n%x  good.bin\n\n%x *backups/bad.bin\n%x  missing.bin\n", goodSum, badSum, missingSum)
+	if err := os.WriteFile(manifest, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ReadManifest(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 || entries[1].Filename != "backups/bad.bin" {
+		t.Fatalf("manifest read as %+v", entries)
+	}
+	results, err := VerifyManifest(entries, "sha256", v.cfg.MetadataDir, v.store, v.cfg, v.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []string{ManifestOK, ManifestFailed, ManifestMissing} {
+		if results[i].Status != want {
+			t.Fatalf("%s: %s (%v), expected %s", results[i].Filename, results[i].Status, results[i].Err, want)
+		}
+	}
+	if !errors.Is(results[1].Err, ErrChecksumMismatch) {
+		t.Fatalf("mismatching entry failed with %v", results[1].Err)
+	}
+
+	sha1Sum := sha1.Sum(good)
+	results, err = VerifyManifest([]ManifestEntry{{Sum: sha1Sum[:], Filename: "good.bin"}}, "SHA1", v.cfg.MetadataDir, v.store, v.cfg, v.logger)
+	if err != nil || results[0].Status != ManifestOK {
+		t.Fatalf("sha1 manifest: %+v, %v", results, err)
+	}
+	if _, err := VerifyManifest(entries, "crc32", v.cfg.MetadataDir, v.store, v.cfg, v.logger); err == nil {
+		t.Fatal("verified a manifest with an unsupported algorithm")
+	}
+}
+
+func TestReadManifestRefusesMalformedLines(t *testing.T) {
+	for _, line := range []string{"not-hex  file.bin", "abcd", "abcd file.bin", "abcd  "} {
+		manifest := filepath.Join(t.TempDir(), "SUMS")
+		if err := os.WriteFile(manifest, []byte(line+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if entries, err := ReadManifest(manifest); err == nil {
+			t.Fatalf("%q read as %+v", line, entries)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package datastorage
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/techninja8/getvault.io/pkg/chunking"
+	"github.com/techninja8/getvault.io/pkg/erasurecoding"
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+// A chunked object is a streamed object whose segments are cut where the
+// content says (see package chunking) rather than every segment size
+// bytes, so an edit only changes the chunks around it. Chunks are
+// encrypted with a key derived from the object key and an IV derived from
+// their contents, which makes equal chunks encrypt to equal cipher text
+// and so get the same segment ID. A chunk whose shards are already all
+// at their locations, stored by an earlier version of the file or any
+// other object under the same key, isn't stored again; the object's
+// metadata lists it like any other segment. Objects with recipients have
+// a random key each, so their chunks are only shared within the object.
+//
+// Shared shards are protected the same way as those of objects stored
+// twice: the trash only purges shard sets no other object refers to.
+
+// chunkingGear is the chunking line of objects cut by package chunking.
+const chunkingGear = "gear"
+
+// minChunkSize is the smallest average chunk size accepted. Smaller chunks
+// spend more on shard files and proofs than dedup can save.
+const minChunkSize = 4 << 10
+
+// chunkKeyLabel is what the chunk key is derived from the object key with.
+const chunkKeyLabel = "vault chunk key"
+
+// chunkKey derives the key chunks are encrypted with from an object key.
+// Chunks are encrypted deterministically, so they get a key of their own
+// rather than sharing one with randomly encrypted data.
+func chunkKey(objectKey []byte) []byte {
+	mac := hmac.New(sha256.New, objectKey)
+	mac.Write([]byte(chunkKeyLabel))
+	return mac.Sum(nil)
+}
+
+// readChunkSize returns the average chunk size a chunked object was cut
+// with, or 0 if it was cut into fixed segments.
+func readChunkSize(values map[string]string) (int64, error) {
+	value, ok := values["chunking"]
+	if !ok {
+		return 0, nil
+	}
+	fields := strings.Fields(value)
+	if len(fields) != 2 || fields[0] != chunkingGear {
+		return 0, fmt.Errorf("unsupported chunking in metadata: %q", value)
+	}
+	size, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || size < minChunkSize {
+		return 0, fmt.Errorf("invalid chunk size in metadata: %q", fields[1])
+	}
+	return size, nil
+}
+
+// chunkSet tracks the chunks stored while storing or appending to an
+// object, so repeats within it are only looked up once. Segments are
+// stored concurrently, so it is safe for concurrent use; two copies of a
+// chunk stored at once both write the same shards.
+type chunkSet struct {
+	mu          sync.Mutex
+	stored      map[string]bool
+	reused      int
+	reusedBytes int64
+}
+
+func newChunkSet() *chunkSet {
+	return &chunkSet{stored: make(map[string]bool)}
+}
+
+// has reports whether the shards of a chunk are already all stored at
+// their locations. Any shard that can't be found means the chunk is
+// stored again, which rewrites identical shards.
+func (c *chunkSet) has(chunkID string, shards int, locations []string, store sharding.ShardStore) bool {
+	c.mu.Lock()
+	stored := c.stored[chunkID]
+	c.mu.Unlock()
+	if stored {
+		return true
+	}
+	for i := 0; i < shards; i++ {
+		exists, err := sharding.HasShard(store, chunkID, i, locations[i])
+		if err != nil || !exists {
+			return false
+		}
+	}
+	c.add(chunkID)
+	return true
+}
+
+// add records a chunk as stored.
+func (c *chunkSet) add(chunkID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stored[chunkID] = true
+}
+
+// reuse counts a chunk of size bytes of plaintext found already stored.
+func (c *chunkSet) reuse(size int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reused++
+	c.reusedBytes += int64(size)
+}
+
+// segmentSource returns a streamed object one segment at a time, and
+// io.EOF after the last.
+type segmentSource interface {
+	Next() (*sourceSegment, error)
+	MaxSize() int
+	// Memory is the most memory a segment holds from being read until its
+	// shards are stored, in bytes.
+	Memory() int64
+}
+
+// sourceSegment is a segment as a segmentSource reads it: the plaintext of
+// a chunk, for storeSegment to encrypt and code, or a fixed segment
+// encrypted and coded as it was read.
+type sourceSegment struct {
+	plainText []byte
+	encoded   *encodedSegment
+	size      int // Plaintext bytes
+}
+
+// newSegmentSource cuts r into the segments of choice: chunks if it has a
+// chunk size, and fixed segments encrypted under key and coded under code
+// otherwise, their cipher text written to digest as they are read.
+func newSegmentSource(r io.Reader, segmentSize, chunkSize int64, key []byte, indexed bool, code erasurecoding.Code, digest io.Writer) (segmentSource, error) {
+	if chunkSize > 0 {
+		chunker, err := chunking.New(r, int(chunkSize), int(segmentSize))
+		if err != nil {
+			return nil, err
+		}
+		return chunkSegments{Chunker: chunker, indexed: indexed, code: code}, nil
+	}
+	return &encodingSegments{r: r, segmentSize: segmentSize, key: key, indexed: indexed, code: code, digest: digest}, nil
+}
+
+// chunkSegments returns the chunks of a chunking.Chunker as segments.
+type chunkSegments struct {
+	*chunking.Chunker
+	indexed bool
+	code    erasurecoding.Code
+}
+
+// Memory counts a chunk's plaintext, its cipher text and its shards,
+// which storeSegment holds at once.
+func (c chunkSegments) Memory() int64 {
+	return int64(c.MaxSize()) + int64(aes.BlockSize+c.MaxSize()) + storedShardsSize(c.code, aes.BlockSize+c.MaxSize(), c.indexed)
+}
+
+func (c chunkSegments) Next() (*sourceSegment, error) {
+	chunk, err := c.Chunker.Next()
+	if err != nil {
+		return nil, err
+	}
+	// The chunker reuses its buffer for the next chunk
+	return &sourceSegment{plainText: bytes.Clone(chunk), size: len(chunk)}, nil
+}
@@ -0,0 +1,65 @@
+package datastorage
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"slices"
+	"testing"
+
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+// TestChunkReuseAfterEdit stores a file in content-defined chunks, then
+// a copy with a few bytes inserted in the middle: only the chunks around
+// the edit are new, the rest reuse the shards already stored.
+func TestChunkReuseAfterEdit(t *testing.T) {
+	v := newTestVault(t)
+	v.cfg.ChunkSize = 16 << 10
+	data := randomBytes(t, 1<<20)
+	original := v.storeObject(t, "disk.img", data)
+	before := v.shardFiles(t)
+
+	edited := slices.Concat(data[:len(data)/2], []byte("a small edit"), data[len(data)/2:])
+	version := v.storeObject(t, "disk.img", edited)
+
+	dataID, err := MetadataFileReader(version, "dataID")
+	if err != nil {
+		t.Fatal(err)
+	}
+	history, err := ReadHistory(v.cfg.MetadataDir, dataID)
+	if err != nil || len(history) == 0 || history[0].Event != EventStored {
+		t.Fatalf("history of the edited copy: %+v, %v", history, err)
+	}
+	var size int64
+	var reused, chunks int
+	if _, err := fmt.Sscanf(history[0].Detail, "%d bytes, %d of %d chunks", &size, &reused, &chunks); err != nil {
+		t.Fatalf("stored event %q: %v", history[0].Detail, err)
+	}
+	if chunks < 32 || chunks-reused > 3 {
+		t.Fatalf("%d of %d chunks reused, expected all but those around the edit", reused, chunks)
+	}
+	if added := len(v.shardFiles(t)) - len(before); added != chunks-reused {
+		t.Fatalf("storing the edited copy added %d shards to a location, expected %d", added, chunks-reused)
+	}
+
+	for metadatafile, want := range map[string][]byte{original: data, version: edited} {
+		if got, err := RetrieveData(metadatafile, sharding.NewInMemoryShardStore(), v.cfg, v.logger); err != nil || !bytes.Equal(got, want) {
+			t.Fatalf("RetrieveData of %s returned %d bytes, %v", metadatafile, len(got), err)
+		}
+	}
+}
+
+// shardFiles lists the shard files at the first location.
+func (v *testVault) shardFiles(t *testing.T) []string {
+	t.Helper()
+	entries, err := os.ReadDir(v.locations[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
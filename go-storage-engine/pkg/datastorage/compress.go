@@ -0,0 +1,191 @@
+package datastorage
+
+import (
+	"compress/flate"
+	"fmt"
+	"strconv"
+
+	"github.com/techninja8/getvault.io/pkg/metadata"
+)
+
+// Plaintext is sampled as it is stored: one block of compressSampleSize
+// in every compressSampleEvery is compressed at flate's fastest level to
+// estimate how well the object would compress, which keeps the cost to
+// about 3% of the bytes stored. The first block is always sampled, so
+// small objects are too; after it the block sampled in each group varies,
+// so data repeating with the group's period isn't always sampled at the
+// same point of it.
+const (
+	compressSampleSize  = 64 << 10
+	compressSampleEvery = 32
+)
+
+// Compressibility is an estimate of how well an object compresses.
+type Compressibility struct {
+	Sampled    int64 `json:"sampled"`    // Bytes of plaintext compressed
+	Compressed int64 `json:"compressed"` // Bytes they compressed to
+}
+
+// Ratio is the size the samples compressed to as a fraction of their own,
+// 1 if nothing was sampled.
+func (c Compressibility) Ratio() float64 {
+	if c.Sampled == 0 {
+		return 1
+	}
+	return float64(c.Compressed) / float64(c.Sampled)
+}
+
+// compressLines formats the compressibility metadata lines.
+func compressLines(c Compressibility) string {
+	return fmt.Sprintf("compress_sampled: %d\ncompress_size: %d\n", c.Sampled, c.Compressed)
+}
+
+// ReadCompressibility returns the compressibility recorded for an object,
+// or nil if it was stored before compressibility was recorded.
+func ReadCompressibility(metadatafile string) (*Compressibility, error) {
+	values, err := metadata.ReadValues(metadatafile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading metadata file: %w", err)
+	}
+	return readCompressibility(values), nil
+}
+
+// readCompressibility returns the compressibility recorded in metadata
+// values, or nil for objects stored without one.
+func readCompressibility(values map[string]string) *Compressibility {
+	sampled, err := strconv.ParseInt(values["compress_sampled"], 10, 64)
+	if err != nil {
+		return nil
+	}
+	compressed, err := strconv.ParseInt(values["compress_size"], 10, 64)
+	if err != nil {
+		return nil
+	}
+	return &Compressibility{Sampled: sampled, Compressed: compressed}
+}
+
+// compressSampler is an io.Writer estimating the compressibility of what
+// is written to it.
+type compressSampler struct {
+	written int64
+	block   []byte // Of the block being sampled, what has been written
+	est     Compressibility
+	fw      *flate.Writer
+	out     byteCounter
+}
+
+type byteCounter int64
+
+func (n *byteCounter) Write(p []byte) (int, error) {
+	*n += byteCounter(len(p))
+	return len(p), nil
+}
+
+func (s *compressSampler) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		index, at := s.written/compressSampleSize, int(s.written%compressSampleSize)
+		take := min(len(p), compressSampleSize-at)
+		if sampledBlock(index) {
+			s.block = append(s.block, p[:take]...)
+			if len(s.block) == compressSampleSize {
+				s.sample()
+			}
+		}
+		s.written += int64(take)
+		p = p[take:]
+	}
+	return n, nil
+}
+
+// sampledBlock reports whether the block at index is sampled.
+func sampledBlock(index int64) bool {
+	group := uint64(index / compressSampleEvery)
+	if group == 0 {
+		return index == 0
+	}
+	// splitmix64 of the group picks its block
+	x := group * 0x9e3779b97f4a7c15
+	x = (x ^ x>>30) * 0xbf58476d1ce4e5b9
+	x = (x ^ x>>27) * 0x94d049bb133111eb
+	x ^= x >> 31
+	return uint64(index%compressSampleEvery) == x%compressSampleEvery
+}
+
+// sample compresses the block.
+func (s *compressSampler) sample() {
+	if s.fw == nil {
+		s.fw, _ = flate.NewWriter(&s.out, flate.BestSpeed)
+	} else {
+		s.fw.Reset(&s.out)
+	}
+	s.out = 0
+	s.fw.Write(s.block)
+	s.fw.Close()
+	s.est.Sampled += int64(len(s.block))
+	s.est.Compressed += int64(s.out)
+	s.block = s.block[:0]
+}
+
+// Estimate returns the compressibility of everything written, sampling a
+// last block cut short by the end of the data.
+func (s *compressSampler) Estimate() Compressibility {
+	if len(s.block) > 0 {
+		s.sample()
+	}
+	return s.est
+}
+
+// CompressStats sums the compressibility of the objects of a vault.
+type CompressStats struct {
+	Objects    int   `json:"objects"`    // Objects with an estimate
+	Unsampled  int   `json:"unsampled"`  // Objects stored before estimates were recorded
+	Bytes      int64 `json:"bytes"`      // Size of the objects with an estimate
+	Sampled    int64 `json:"sampled"`    // Bytes of them compressed
+	Compressed int64 `json:"compressed"` // Bytes those compressed to
+}
+
+// SummarizeCompressibility sums the compressibility of objects.
+func SummarizeCompressibility(objects []ObjectInfo) CompressStats {
+	var stats CompressStats
+	for _, object := range objects {
+		if object.Error != "" {
+			continue
+		}
+		if object.Compressibility == nil {
+			stats.Unsampled++
+			continue
+		}
+		stats.Objects++
+		stats.Bytes += object.Size
+		stats.Sampled += object.Compressibility.Sampled
+		stats.Compressed += object.Compressibility.Compressed
+	}
+	return stats
+}
+
+// Ratio is the size the vault's samples compressed to as a fraction of
+// their own, 1 if nothing was sampled.
+func (s CompressStats) Ratio() float64 {
+	return Compressibility{Sampled: s.Sampled, Compressed: s.Compressed}.Ratio()
+}
+
+// Savings estimates the bytes compressing the objects would save.
+func (s CompressStats) Savings() int64 {
+	return int64(float64(s.Bytes) * (1 - s.Ratio()))
+}
+
+// compressWorthRatio is the ratio at or under which CompressionHint
+// suggests compressing an object.
+const compressWorthRatio = 0.5
+
+// CompressionHint returns a suggestion when how well an object compresses
+// disagrees strongly with whether it was compressed, or "" when it
+// doesn't. No transform compresses, so objects are stored uncompressed
+// and the hint is to compress them first.
+func CompressionHint(c Compressibility) string {
+	if c.Sampled == 0 || c.Ratio() > compressWorthRatio {
+		return ""
+	}
+	return fmt.Sprintf("the data compresses to about %.0f%% of its size; compressing it before storing would save space", 100*c.Ratio())
+}
@@ -0,0 +1,207 @@
+package datastorage
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/sha256"
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/techninja8/getvault.io/pkg/encryption"
+	"github.com/techninja8/getvault.io/pkg/erasurecoding"
+)
+
+// textFixture returns n bytes of repetitive log lines, which compress well.
+func textFixture(n int) []byte {
+	r := rand.New(rand.NewSource(1))
+	var b bytes.Buffer
+	for b.Len() < n {
+		fmt.Fprintf(&b, "2026-10-16T12:%02d:%02dZ INFO request served path=/objects/%d status=200 bytes=%d\n", r.Intn(60), r.Intn(60), r.Intn(1000), r.Intn(1<<20))
+	}
+	return b.Bytes()[:n]
+}
+
+// randomFixture returns n bytes that don't compress.
+func randomFixture(n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(2)).Read(data)
+	return data
+}
+
+// flateRatio compresses all of data at flate's fastest level.
+func flateRatio(t testing.TB, data []byte) float64 {
+	var out bytes.Buffer
+	fw, err := flate.NewWriter(&out, flate.BestSpeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(data)
+	fw.Close()
+	return float64(out.Len()) / float64(len(data))
+}
+
+func sampleOf(data []byte, writes int) Compressibility {
+	var s compressSampler
+	step := (len(data) + writes - 1) / writes
+	for len(data) > 0 {
+		n := min(step, len(data))
+		s.Write(data[:n])
+		data = data[n:]
+	}
+	return s.Estimate()
+}
+
+func TestCompressibilityEstimate(t *testing.T) {
+	text := textFixture(8 << 20)
+	random := randomFixture(8 << 20)
+	// Half text, half random, in 256 KiB stripes: 64 MiB, so 32 blocks
+	// are sampled
+	const stripe = 256 << 10
+	var mixed []byte
+	for i := 0; len(mixed) < 64<<20; i++ {
+		from := text
+		if i%2 == 1 {
+			from = random
+		}
+		at := i * stripe % len(from)
+		mixed = append(mixed, from[at:at+stripe]...)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		data     []byte
+		min, max float64
+	}{
+		{"text", text, 0, 0.5},
+		{"random", random, 0.98, 1.01},
+		{"mixed", mixed, 0.5, 0.85},
+	} {
+		// The estimate doesn't depend on how the data is written
+		est := sampleOf(tc.data, 1)
+		if other := sampleOf(tc.data, 777); other != est {
+			t.Fatalf("%s: written at once %+v, in pieces %+v", tc.name, est, other)
+		}
+		ratio := est.Ratio()
+		if ratio < tc.min || ratio > tc.max {
+			t.Fatalf("%s: estimated ratio %.3f, expected %.2f-%.2f", tc.name, ratio, tc.min, tc.max)
+		}
+		if whole := flateRatio(t, tc.data); math.Abs(ratio-whole) > 0.12 {
+			t.Fatalf("%s: estimated ratio %.3f, compressing everything gives %.3f", tc.name, ratio, whole)
+		}
+		if hint := CompressionHint(est); (hint != "") != (tc.name == "text") {
+			t.Fatalf("%s: hint %q", tc.name, hint)
+		}
+	}
+}
+
+func TestCompressSamplingIsCapped(t *testing.T) {
+	for _, size := range []int{0, 1, compressSampleSize, 10 << 20, 64<<20 + 12345} {
+		est := sampleOf(randomFixture(size), 3)
+		// The first block, and one in compressSampleEvery after it
+		blocks := (size + compressSampleSize - 1) / compressSampleSize
+		limit := int64((blocks+compressSampleEvery-1)/compressSampleEvery) * compressSampleSize
+		if est.Sampled > limit || est.Sampled > int64(size) {
+			t.Fatalf("%d bytes: sampled %d, at most %d expected", size, est.Sampled, limit)
+		}
+		if size > 1<<20 && float64(est.Sampled)/float64(size) > 0.04 {
+			t.Fatalf("%d bytes: sampled %.1f%% of them", size, 100*float64(est.Sampled)/float64(size))
+		}
+	}
+	if ratio := (Compressibility{}).Ratio(); ratio != 1 {
+		t.Fatalf("ratio of nothing sampled: %f", ratio)
+	}
+}
+
+func TestStoreRecordsCompressibility(t *testing.T) {
+	for _, streamed := range []bool{false, true} {
+		v := newTestVault(t)
+		if streamed {
+			v.cfg.StreamingThreshold = 1
+		}
+		text := v.storeObject(t, "app.log", textFixture(300_000))
+		random := v.storeObject(t, "random.bin", randomFixture(300_000))
+
+		for metadatafile, compresses := range map[string]bool{text: true, random: false} {
+			est, err := ReadCompressibility(metadatafile)
+			if err != nil || est == nil {
+				t.Fatalf("streamed=%v: ReadCompressibility: %+v, %v", streamed, est, err)
+			}
+			if est.Sampled == 0 || (est.Ratio() < 0.5) != compresses {
+				t.Fatalf("streamed=%v: %s estimated %+v", streamed, metadatafile, est)
+			}
+		}
+
+		objects, err := ListObjects(v.cfg.MetadataDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stats := SummarizeCompressibility(append(objects, ObjectInfo{DataID: "old"}))
+		if stats.Objects != 2 || stats.Unsampled != 1 || stats.Bytes != 600_000 {
+			t.Fatalf("streamed=%v: stats %+v", streamed, stats)
+		}
+		if ratio := stats.Ratio(); ratio < 0.5 || ratio > 0.9 || stats.Savings() <= 0 {
+			t.Fatalf("streamed=%v: vault ratio %.3f, savings %d", streamed, ratio, stats.Savings())
+		}
+	}
+}
+
+// BenchmarkCompressSampling measures sampling against the work a store
+// does to every byte under the default code: encrypting, erasure coding
+// and hashing the shards for their proofs. sample-% is the sampler's time
+// as a percentage of that work's.
+func BenchmarkCompressSampling(b *testing.B) {
+	for _, fixture := range []struct {
+		name string
+		data []byte
+	}{
+		{"text", textFixture(16 << 20)},
+		{"random", randomFixture(16 << 20)},
+	} {
+		b.Run(fixture.name, func(b *testing.B) {
+			key := make([]byte, 32)
+			code := erasurecoding.DefaultCode()
+			buf := make([]byte, 0, code.ShardSetSize(aes.BlockSize+len(fixture.data)))
+
+			b.SetBytes(int64(len(fixture.data)))
+			var sampling, storing time.Duration
+			for i := 0; i < b.N; i++ {
+				start := time.Now()
+				var s compressSampler
+				s.Write(fixture.data)
+				s.Estimate()
+				sampling += time.Since(start)
+
+				start = time.Now()
+				cipherText, err := encryption.AppendEncrypt(buf, fixture.data, key)
+				if err != nil {
+					b.Fatal(err)
+				}
+				shards, err := code.Encode(cipherText)
+				if err != nil {
+					b.Fatal(err)
+				}
+				for _, shard := range shards {
+					sha256.Sum256(shard)
+				}
+				storing += time.Since(start)
+			}
+			b.ReportMetric(100*float64(sampling)/float64(storing), "sample-%")
+		})
+	}
+}
+
+func TestCompressionHintWording(t *testing.T) {
+	if hint := CompressionHint(Compressibility{Sampled: 100, Compressed: 30}); !strings.Contains(hint, "30%") {
+		t.Fatalf("hint %q", hint)
+	}
+	for _, est := range []Compressibility{{}, {Sampled: 100, Compressed: 99}} {
+		if hint := CompressionHint(est); hint != "" {
+			t.Fatalf("hint for %+v: %q", est, hint)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package datastorage
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/techninja8/getvault.io/pkg/config"
+)
+
+// ErrTargetExists is returned for a file retrieve would write that exists
+// already, under the fail conflict policy.
+var ErrTargetExists = errors.New("file exists already")
+
+// Conflicts decides what happens to a file retrieve writes, on its own or
+// extracted from an archive, that exists already: Policy, one of
+// config.ConflictPolicies, decides for all of them, unless Ask is set, in
+// which case it is asked about each and returns the policy for it. Summary
+// records what was done.
+type Conflicts struct {
+	Policy  string
+	Ask     func(path string) (string, error)
+	Summary ConflictSummary
+}
+
+// ConflictSummary is what Conflicts did about files that existed already.
+type ConflictSummary struct {
+	Overwritten []string
+	Skipped     []string
+	Renamed     []RenamedFile
+}
+
+// RenamedFile is a file written under another name than its own, Path,
+// since a file by that name existed already.
+type RenamedFile struct {
+	Path      string
+	RenamedTo string
+}
+
+// Empty reports whether no file existed already.
+func (s ConflictSummary) Empty() bool {
+	return len(s.Overwritten) == 0 && len(s.Skipped) == 0 && len(s.Renamed) == 0
+}
+
+// NewConflicts returns Conflicts following policy.
+func NewConflicts(policy string) (*Conflicts, error) {
+	if !slices.Contains(config.ConflictPolicies, policy) {
+		return nil, fmt.Errorf("unknown conflict policy %q, expected one of %s", policy, strings.Join(config.ConflictPolicies, ", "))
+	}
+	return &Conflicts{Policy: policy}, nil
+}
+
+// Resolve returns the path a file meant for path is to be written to:
+// path itself unless something is there already, in which case the policy
+// decides. It returns "" for a file to be skipped, and an error wrapping
+// ErrTargetExists under the fail policy.
+func (c *Conflicts) Resolve(path string) (string, error) {
+	if exists, err := pathExists(path); err != nil || !exists {
+		return path, err
+	}
+	policy := c.Policy
+	if c.Ask != nil {
+		var err error
+		if policy, err = c.Ask(path); err != nil {
+			return "", err
+		}
+	}
+	switch policy {
+	case config.ConflictOverwrite:
+		c.Summary.Overwritten = append(c.Summary.Overwritten, path)
+		return path, nil
+	case config.ConflictSkipExisting:
+		c.Summary.Skipped = append(c.Summary.Skipped, path)
+		return "", nil
+	case config.ConflictRenameNew:
+		renamed, err := restoredName(path)
+		if err != nil {
+			return "", err
+		}
+		c.Summary.Renamed = append(c.Summary.Renamed, RenamedFile{Path: path, RenamedTo: renamed})
+		return renamed, nil
+	}
+	return "", fmt.Errorf("%w: %s", ErrTargetExists, path)
+}
+
+// Check fails, under the fail policy with no one to ask, if any of paths
+// exists already, so that nothing is written rather than some of the
+// files before the first that exists. Under other policies it does
+// nothing: those conflicts are resolved as the files are written.
+func (c *Conflicts) Check(paths []string) error {
+	if c.Policy != config.ConflictFail || c.Ask != nil {
+		return nil
+	}
+	for _, path := range paths {
+		exists, err := pathExists(path)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return fmt.Errorf("%w: %s", ErrTargetExists, path)
+		}
+	}
+	return nil
+}
+
+// pathExists reports whether anything, even a dangling symlink, is at path.
+func pathExists(path string) (bool, error) {
+	_, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to check %s: %w", path, err)
+	}
+	return true, nil
+}
+
+// restoredName returns the first of "name (restored).ext",
+// "name (restored 2).ext" and so on next to path that is free.
+func restoredName(path string) (string, error) {
+	dir, base := filepath.Split(path)
+	ext := filepath.Ext(base)
+	stem := strings.TrimSuffix(base, ext)
+	if stem == "" {
+		// A dotfile is all name
+		stem, ext = base, ""
+	}
+	suffix := " (restored)"
+	for n := 2; ; n++ {
+		candidate := filepath.Join(dir, stem+suffix+ext)
+		exists, err := pathExists(candidate)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return candidate, nil
+		}
+		suffix = fmt.Sprintf(" (restored %d)", n)
+	}
+}
+
+// NewConflictPrompt returns an Ask for Conflicts asking on out about every
+// file that exists already and reading the answer from in, a line at a
+// time: o to overwrite it, s to skip it, r to write the new file next to
+// it, f to fail. Anything else is asked again; in ending fails.
+func NewConflictPrompt(in io.Reader, out io.Writer) func(path string) (string, error) {
+	answers := bufio.NewReader(in)
+	return func(path string) (string, error) {
+		for {
+			fmt.Fprintf(out, "%s exists already: [o]verwrite, [s]kip, [r]ename the new file, [f]ail? ", path)
+			line, err := answers.ReadString('\n')
+			switch strings.ToLower(strings.TrimSpace(line)) {
+			case "o", "overwrite":
+				return config.ConflictOverwrite, nil
+			case "s", "skip":
+				return config.ConflictSkipExisting, nil
+			case "r", "rename":
+				return config.ConflictRenameNew, nil
+			case "f", "fail":
+				return config.ConflictFail, nil
+			}
+			if err != nil {
+				fmt.Fprintln(out)
+				return config.ConflictFail, nil
+			}
+		}
+	}
+}
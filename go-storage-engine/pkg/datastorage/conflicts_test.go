@@ -0,0 +1,185 @@
+package datastorage
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/techninja8/getvault.io/pkg/config"
+)
+
+// conflictArchive writes an archive of three files, two of which
+// conflictTarget already has, and returns its path.
+func conflictArchive(t *testing.T) string {
+	t.Helper()
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for _, name := range []string{"a.txt", "sub/b.txt", "c.txt"} {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte("new " + name))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	archive := filepath.Join(t.TempDir(), "tree.zip")
+	if err := os.WriteFile(archive, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return archive
+}
+
+// conflictTarget returns a directory already holding a.txt and sub/b.txt,
+// and a.txt's first restored name.
+func conflictTarget(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"a.txt":            "old a.txt",
+		"a (restored).txt": "restored before",
+		"sub/b.txt":        "old sub/b.txt",
+	} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// readTree returns the contents of every file under dir by slash path.
+func readTree(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	files := make(map[string]string)
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		files[filepath.ToSlash(rel)] = string(content)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestUnzipConflictPolicies(t *testing.T) {
+	for _, test := range []struct {
+		policy string
+		files  map[string]string
+		// Files extracted, and the summary's overwritten, skipped and renamed
+		extracted, overwritten, skipped, renamed int
+	}{
+		{
+			policy: config.ConflictOverwrite,
+			files: map[string]string{
+				"a.txt": "new a.txt", "a (restored).txt": "restored before", "sub/b.txt": "new sub/b.txt", "c.txt": "new c.txt",
+			},
+			extracted: 3, overwritten: 2,
+		},
+		{
+			policy: config.ConflictSkipExisting,
+			files: map[string]string{
+				"a.txt": "old a.txt", "a (restored).txt": "restored before", "sub/b.txt": "old sub/b.txt", "c.txt": "new c.txt",
+			},
+			extracted: 1, skipped: 2,
+		},
+		{
+			// a.txt's first restored name is taken, so it cascades to the next
+			policy: config.ConflictRenameNew,
+			files: map[string]string{
+				"a.txt": "old a.txt", "a (restored).txt": "restored before", "a (restored 2).txt": "new a.txt",
+				"sub/b.txt": "old sub/b.txt", "sub/b (restored).txt": "new sub/b.txt", "c.txt": "new c.txt",
+			},
+			extracted: 3, renamed: 2,
+		},
+	} {
+		t.Run(test.policy, func(t *testing.T) {
+			target := conflictTarget(t)
+			conflicts, err := NewConflicts(test.policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stats, err := UnzipWithConflicts(conflictArchive(t), target, DefaultUnzipLimits, conflicts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := readTree(t, target); !maps.Equal(got, test.files) {
+				t.Fatalf("extracted to %v, expected %v", got, test.files)
+			}
+			summary := conflicts.Summary
+			if stats.Files != int64(test.extracted) || len(summary.Overwritten) != test.overwritten || len(summary.Skipped) != test.skipped || len(summary.Renamed) != test.renamed {
+				t.Fatalf("%d files extracted, summary %+v", stats.Files, summary)
+			}
+		})
+	}
+}
+
+func TestUnzipConflictFailsBeforeWriting(t *testing.T) {
+	target := conflictTarget(t)
+	before := readTree(t, target)
+	// UnzipWithLimits, and so Unzip, fail on conflicts too
+	if _, err := UnzipWithLimits(conflictArchive(t), target, DefaultUnzipLimits); !errors.Is(err, ErrTargetExists) {
+		t.Fatalf("extracting over existing files returned %v, expected %v", err, ErrTargetExists)
+	}
+	if got := readTree(t, target); !maps.Equal(got, before) {
+		t.Fatalf("a failed extraction left %v, expected %v untouched", got, before)
+	}
+}
+
+func TestUnzipConflictPrompt(t *testing.T) {
+	target := conflictTarget(t)
+	var out bytes.Buffer
+	conflicts := &Conflicts{Policy: config.ConflictFail}
+	// An answer it doesn't know is asked again
+	conflicts.Ask = NewConflictPrompt(strings.NewReader("x\no\ns\n"), &out)
+	if _, err := UnzipWithConflicts(conflictArchive(t), target, DefaultUnzipLimits, conflicts); err != nil {
+		t.Fatal(err)
+	}
+	got := readTree(t, target)
+	if got["a.txt"] != "new a.txt" || got["sub/b.txt"] != "old sub/b.txt" || got["c.txt"] != "new c.txt" {
+		t.Fatalf("extracted to %v", got)
+	}
+	if n := strings.Count(out.String(), "exists already"); n != 3 {
+		t.Fatalf("asked %d times:\n%s", n, out.String())
+	}
+
+	// Running out of answers fails
+	conflicts = &Conflicts{Policy: config.ConflictOverwrite, Ask: NewConflictPrompt(strings.NewReader(""), &out)}
+	if _, err := UnzipWithConflicts(conflictArchive(t), conflictTarget(t), DefaultUnzipLimits, conflicts); !errors.Is(err, ErrTargetExists) {
+		t.Fatalf("extracting with no answers returned %v", err)
+	}
+}
+
+func TestRestoredNames(t *testing.T) {
+	dir := t.TempDir()
+	for _, test := range []struct{ name, restored string }{
+		{"report.pdf", "report (restored).pdf"},
+		{".env", ".env (restored)"},
+		{"Makefile", "Makefile (restored)"},
+	} {
+		got, err := restoredName(filepath.Join(dir, test.name))
+		if err != nil || got != filepath.Join(dir, test.restored) {
+			t.Fatalf("restoredName(%q) = %q, %v, expected %q", test.name, got, err, test.restored)
+		}
+	}
+	if _, err := NewConflicts("clobber"); err == nil {
+		t.Fatal("NewConflicts took an unknown policy")
+	}
+}
@@ -0,0 +1,110 @@
+package datastorage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+
+	"go.uber.org/zap"
+
+	"github.com/techninja8/getvault.io/pkg/config"
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+// contentIDLabel derives the key content dataIDs are computed under from
+// the master key, so a dataID doesn't give away the sha256 of a file.
+const contentIDLabel = "vault content id"
+
+// Metadata of objects stored with ID_MODE=content. Their dataID no longer
+// names their shards: those of an object stored in memory are named after
+// the sha256 of its ciphertext, as ciphertext dataIDs are, and recorded as
+// shard_set_id. Streamed objects' shards are named after their segments.
+const (
+	idModeKey     = "id_mode"
+	shardSetIDKey = "shard_set_id"
+)
+
+// newContentHash returns the hash content dataIDs are computed with, or
+// nil if cfg gives dataIDs of the ciphertext.
+func newContentHash(cfg *config.Config) (hash.Hash, error) {
+	if cfg.IDMode != config.IDModeContent {
+		return nil, nil
+	}
+	return contentIDHash(cfg)
+}
+
+// contentIDHash returns the hash content dataIDs are computed with,
+// whatever the ID mode of cfg, for objects stored under another.
+func contentIDHash(cfg *config.Config) (hash.Hash, error) {
+	masterKey, err := GetEncryptionKey(cfg)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, masterKey)
+	mac.Write([]byte(contentIDLabel))
+	return hmac.New(sha256.New, mac.Sum(nil)), nil
+}
+
+// ContentID returns the dataID an object with the contents read from r
+// is given under ID_MODE=content, without storing anything. It depends on
+// the master key, so the same file gets another ID under another key.
+func ContentID(cfg *config.Config, r io.Reader) (string, error) {
+	if cfg.IDMode != config.IDModeContent {
+		return "", fmt.Errorf("dataIDs only name contents with ID_MODE=%s", config.IDModeContent)
+	}
+	hash, err := newContentHash(cfg)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(hash, r); err != nil {
+		return "", fmt.Errorf("failed to read data: %w", err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// FindHealthy returns the metadata file of the object with dataID, if the
+// catalog has one and every shard of it checks out. Otherwise it fails
+// with ErrObjectNotFound, so the object is worth storing again.
+func FindHealthy(dataID string, store sharding.ShardStore, cfg *config.Config, logger *zap.Logger) (string, error) {
+	index, err := NewMetadataIndex(cfg.MetadataDir)
+	if err != nil {
+		return "", err
+	}
+	metadatafile, err := index.Lookup(dataID)
+	if err != nil {
+		return "", err
+	}
+	report, err := CheckData(metadatafile, store, CheckOptions{}, logger)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s can't be checked: %v", ErrObjectNotFound, dataID, err)
+	}
+	if report.Health != ObjectHealthy {
+		return "", fmt.Errorf("%w: %s is %s", ErrObjectNotFound, dataID, report.Health)
+	}
+	return metadatafile, nil
+}
+
+// contentIDLines returns the metadata lines recording the dataID mode of an
+// object, with the ID of its shard set if the dataID doesn't name it.
+func contentIDLines(cfg *config.Config, setID string) string {
+	if cfg.IDMode != config.IDModeContent {
+		return ""
+	}
+	lines := fmt.Sprintf("%s: %s\n", idModeKey, config.IDModeContent)
+	if setID != "" {
+		lines += fmt.Sprintf("%s: %s\n", shardSetIDKey, setID)
+	}
+	return lines
+}
+
+// objectSetID returns the ID the shards of an object stored in memory are
+// named after: its dataID, unless the dataID names its contents.
+func objectSetID(values map[string]string, dataID string) string {
+	if id := values[shardSetIDKey]; id != "" {
+		return id
+	}
+	return dataID
+}
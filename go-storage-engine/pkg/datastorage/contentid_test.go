@@ -0,0 +1,102 @@
+package datastorage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/techninja8/getvault.io/pkg/config"
+	"github.com/techninja8/getvault.io/pkg/metadata"
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+func TestContentIDsAreIdempotent(t *testing.T) {
+	v := newTestVault(t)
+	v.cfg.IDMode = config.IDModeContent
+	data := randomBytes(t, 50_000)
+
+	// The ID is known before anything is stored, and nothing is found yet
+	want, err := ContentID(v.cfg, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("ContentID: %v", err)
+	}
+	if _, err := FindHealthy(want, v.store, v.cfg, v.logger); !errors.Is(err, ErrObjectNotFound) {
+		t.Fatalf("FindHealthy before storing: %v", err)
+	}
+
+	first := v.storeObject(t, "object.bin", data)
+	v.cfg.StreamingThreshold = 1 // stored a second time, streamed
+	second := v.storeObject(t, "object.bin", data)
+	for _, metadatafile := range []string{first, second} {
+		if id, _ := MetadataFileReader(metadatafile, "dataID"); id != want {
+			t.Fatalf("stored with ID %s, expected %s", id, want)
+		}
+		got, err := RetrieveData(metadatafile, v.store, v.cfg, v.logger)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("RetrieveData: %v", err)
+		}
+	}
+	found, err := FindHealthy(want, v.store, v.cfg, v.logger)
+	if err != nil || (found != first && found != second) {
+		t.Fatalf("FindHealthy found %q: %v", found, err)
+	}
+
+	// The shards of the object stored in memory are named after its ciphertext
+	setID, err := MetadataFileReader(first, shardSetIDKey)
+	if err != nil || setID == want {
+		t.Fatalf("shard set ID %q: %v", setID, err)
+	}
+	if _, err := RefreshProofs(context.Background(), first, v.store, v.cfg, v.logger); err != nil {
+		t.Fatalf("RefreshProofs: %v", err)
+	}
+	if _, err := AppendReader(second, bytes.NewReader(data), v.store, v.cfg, v.logger); !errors.Is(err, ErrNotAppendable) {
+		t.Fatalf("appending to a content-addressed object: %v", err)
+	}
+
+	// Another master key gives other IDs
+	other := *v.cfg
+	if other.EncryptionKey, err = GenerateEncryptionKey(); err != nil {
+		t.Fatal(err)
+	}
+	if id, err := ContentID(&other, bytes.NewReader(data)); err != nil || id == want {
+		t.Fatalf("ContentID under another key: %s, %v", id, err)
+	}
+}
+
+func TestFindHealthySkipsDegradedObjects(t *testing.T) {
+	v := newTestVault(t)
+	v.cfg.IDMode = config.IDModeContent
+	data := randomBytes(t, 10_000)
+	metadatafile := v.storeObject(t, "object.bin", data)
+	dataID, _ := MetadataFileReader(metadatafile, "dataID")
+	setID, _ := MetadataFileReader(metadatafile, shardSetIDKey)
+
+	if err := sharding.DeleteShard(v.store, setID, 0, v.locations[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := FindHealthy(dataID, v.store, v.cfg, v.logger); !errors.Is(err, ErrObjectNotFound) {
+		t.Fatalf("FindHealthy of a degraded object: %v", err)
+	}
+}
+
+func TestCiphertextIDsUnchanged(t *testing.T) {
+	v := newTestVault(t)
+	data := randomBytes(t, 10_000)
+	first := v.storeObject(t, "object.bin", data)
+	second := v.storeObject(t, "object.bin", data)
+	values, err := metadata.ReadValues(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := MetadataFileReader(second, "dataID")
+	if values["dataID"] == other {
+		t.Fatal("the same data stored twice got the same ciphertext ID")
+	}
+	if values[idModeKey] != "" || values[shardSetIDKey] != "" {
+		t.Fatalf("ciphertext IDs recorded as %q, %q", values[idModeKey], values[shardSetIDKey])
+	}
+	if _, err := ContentID(v.cfg, bytes.NewReader(data)); err == nil {
+		t.Fatal("ContentID worked without ID_MODE=content")
+	}
+}
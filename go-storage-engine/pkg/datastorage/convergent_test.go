@@ -0,0 +1,91 @@
+package datastorage
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+// countFiles counts the files under the locations.
+func countFiles(t *testing.T, locations []string) int {
+	t.Helper()
+	n := 0
+	for _, location := range locations {
+		err := filepath.WalkDir(location, func(path string, d os.DirEntry, err error) error {
+			if err == nil && !d.IsDir() {
+				n++
+			}
+			return err
+		})
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			t.Fatal(err)
+		}
+	}
+	return n
+}
+
+func TestConvergentObjectsShareShards(t *testing.T) {
+	// Two users with master keys and metadata of their own, storing to
+	// the same locations
+	alice := newTestVault(t)
+	bob := newTestVault(t)
+	bob.locations, bob.store = alice.locations, alice.store
+	alice.cfg.Convergent, bob.cfg.Convergent = true, true
+
+	data := randomBytes(t, 200_000)
+	aliceFile := alice.storeObject(t, "report.pdf", data)
+	shards := countFiles(t, alice.locations)
+	bobFile := bob.storeObject(t, "my-copy.pdf", data)
+
+	aliceID, _ := MetadataFileReader(aliceFile, "dataID")
+	bobID, _ := MetadataFileReader(bobFile, "dataID")
+	if aliceID != bobID {
+		t.Fatalf("the same content stored as %s and %s", aliceID, bobID)
+	}
+	if n := countFiles(t, alice.locations); n != shards {
+		t.Fatalf("%d shard files after the second store, %d after the first", n, shards)
+	}
+	if mode, _ := MetadataFileReader(bobFile, "encryption"); mode != convergentEncryption {
+		t.Fatalf("encryption recorded as %q", mode)
+	}
+
+	// Each reads the object with their own key, and only with it
+	for _, user := range []struct {
+		v            *testVault
+		metadatafile string
+	}{{alice, aliceFile}, {bob, bobFile}} {
+		got, err := RetrieveData(user.metadatafile, sharding.NewInMemoryShardStore(), user.v.cfg, user.v.logger)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("RetrieveData: %d bytes, %v", len(got), err)
+		}
+	}
+	if _, err := RetrieveData(bobFile, alice.store, alice.cfg, alice.logger); err == nil {
+		t.Fatal("retrieved another user's object with one's own key")
+	}
+
+	// Other content, and the same content stored without --convergent,
+	// get shards of their own
+	alice.storeObject(t, "other.pdf", randomBytes(t, 200_000))
+	alice.cfg.Convergent = false
+	plain := alice.storeObject(t, "report.pdf", data)
+	if id, _ := MetadataFileReader(plain, "dataID"); id == aliceID {
+		t.Fatal("a non-convergent store shares the convergent object's dataID")
+	}
+	if n := countFiles(t, alice.locations); n != 3*shards {
+		t.Fatalf("%d shard files for three objects, expected %d", n, 3*shards)
+	}
+}
+
+func TestConvergentObjectsAreNotStreamed(t *testing.T) {
+	v := newTestVault(t)
+	v.cfg.Convergent = true
+	v.cfg.StreamingThreshold = 1
+	_, _, err := StoreData(randomBytes(t, 10_000), v.store, v.cfg, v.locations, v.logger, "big.bin")
+	if !errors.Is(err, errConvergentStreaming) {
+		t.Fatalf("StoreData: %v", err)
+	}
+}
@@ -0,0 +1,176 @@
+package datastorage
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"sort"
+
+	"go.uber.org/zap"
+
+	"github.com/techninja8/getvault.io/pkg/chunking"
+	"github.com/techninja8/getvault.io/pkg/config"
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+// DefaultDedupChunkSize is the average chunk size objects are cut into
+// for a dedup report when CHUNK_SIZE isn't set.
+const DefaultDedupChunkSize = 64 << 10
+
+// DedupReport is how much the objects of a metadata directory have in
+// common: their plaintext is cut into content-defined chunks, as storing
+// with CHUNK_SIZE set would cut it, and equal chunks are counted once.
+// Objects stored chunked already share the chunks they have in common
+// under the same key; the report shows what chunking everything would
+// save.
+type DedupReport struct {
+	ChunkSize    int64         `json:"chunk_size"` // Average chunk size objects were cut into
+	Objects      []DedupObject `json:"objects"`
+	Pairs        []DedupPair   `json:"pairs,omitempty"` // Most bytes in common first
+	TotalBytes   int64         `json:"total_bytes"`     // Plaintext of every object read
+	UniqueBytes  int64         `json:"unique_bytes"`    // Plaintext of their distinct chunks
+	Chunks       int           `json:"chunks"`
+	UniqueChunks int           `json:"unique_chunks"`
+}
+
+// SavedBytes returns the bytes storing each distinct chunk once would save.
+func (r *DedupReport) SavedBytes() int64 {
+	return r.TotalBytes - r.UniqueBytes
+}
+
+// DedupObject is one object of a dedup report.
+type DedupObject struct {
+	MetadataFile string `json:"metadata_file"`
+	DataID       string `json:"data_id"`
+	Filename     string `json:"filename"`
+	Size         int64  `json:"size"`
+	Chunks       int    `json:"chunks"`
+	// SharedBytes is the plaintext of the object's chunks that other
+	// objects have too
+	SharedBytes int64  `json:"shared_bytes"`
+	Error       string `json:"error,omitempty"` // Why the object couldn't be read
+}
+
+// DedupPair is two objects with chunks in common, by their index in
+// DedupReport.Objects.
+type DedupPair struct {
+	A           int   `json:"a"`
+	B           int   `json:"b"`
+	SharedBytes int64 `json:"shared_bytes"`
+}
+
+// dedupChunk is a distinct chunk and the objects it is in, in order.
+type dedupChunk struct {
+	size    int64
+	objects []int
+}
+
+// AnalyzeDedup reads every object in dir and reports the chunks they have
+// in common, cut with an average size of chunkSize: cfg.ChunkSize, or
+// DefaultDedupChunkSize if that isn't set either, when zero. Only the
+// sha256 of each chunk is kept. Objects that can't be read are reported
+// with their error and left out of the totals.
+func AnalyzeDedup(ctx context.Context, dir string, chunkSize int64, store sharding.ShardStore, cfg *config.Config, logger *zap.Logger) (*DedupReport, error) {
+	if chunkSize == 0 {
+		chunkSize = cfg.ChunkSize
+	}
+	if chunkSize == 0 {
+		chunkSize = DefaultDedupChunkSize
+	}
+	if chunkSize < minChunkSize {
+		return nil, fmt.Errorf("chunk size must be at least %d bytes, got %d", minChunkSize, chunkSize)
+	}
+	files, err := listMetadataFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	report := &DedupReport{ChunkSize: chunkSize}
+	chunks := make(map[[sha256.Size]byte]*dedupChunk)
+	for _, file := range files {
+		info := readObjectInfo(file)
+		object := DedupObject{MetadataFile: file, DataID: info.DataID, Filename: info.Filename}
+		sums, sizes, err := chunkObject(ctx, file, chunkSize, store, cfg, logger)
+		if err != nil {
+			logger.Warn("Leaving an unreadable object out of the dedup report", zap.String("metadataFile", file), zap.Error(err))
+			object.Error = err.Error()
+			report.Objects = append(report.Objects, object)
+			continue
+		}
+		o := len(report.Objects)
+		for c, sum := range sums {
+			chunk, ok := chunks[sum]
+			if !ok {
+				chunk = &dedupChunk{size: sizes[c]}
+				chunks[sum] = chunk
+				report.UniqueChunks++
+				report.UniqueBytes += chunk.size
+			}
+			if len(chunk.objects) == 0 || chunk.objects[len(chunk.objects)-1] != o {
+				chunk.objects = append(chunk.objects, o)
+			}
+			object.Size += sizes[c]
+		}
+		object.Chunks = len(sums)
+		report.Chunks += len(sums)
+		report.TotalBytes += object.Size
+		report.Objects = append(report.Objects, object)
+	}
+
+	// Chunks in more than one object count towards each of them and each
+	// pair of them
+	pairs := make(map[[2]int]int64)
+	for _, chunk := range chunks {
+		if len(chunk.objects) < 2 {
+			continue
+		}
+		for i, a := range chunk.objects {
+			report.Objects[a].SharedBytes += chunk.size
+			for _, b := range chunk.objects[i+1:] {
+				pairs[[2]int{a, b}] += chunk.size
+			}
+		}
+	}
+	for pair, shared := range pairs {
+		report.Pairs = append(report.Pairs, DedupPair{A: pair[0], B: pair[1], SharedBytes: shared})
+	}
+	sort.Slice(report.Pairs, func(i, j int) bool {
+		p, q := report.Pairs[i], report.Pairs[j]
+		if p.SharedBytes != q.SharedBytes {
+			return p.SharedBytes > q.SharedBytes
+		}
+		return p.A < q.A || (p.A == q.A && p.B < q.B)
+	})
+	return report, nil
+}
+
+// chunkObject retrieves an object's plaintext and returns the sha256 and
+// size of each of its chunks, in order.
+func chunkObject(ctx context.Context, metadatafile string, chunkSize int64, store sharding.ShardStore, cfg *config.Config, logger *zap.Logger) ([][sha256.Size]byte, []int64, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := RetrieveToContext(ctx, metadatafile, pw, store, cfg, logger)
+		pw.CloseWithError(err)
+	}()
+	defer pr.Close() // Stops the retrieve if chunking fails
+
+	chunker, err := chunking.New(pr, int(chunkSize), int(4*chunkSize))
+	if err != nil {
+		return nil, nil, err
+	}
+	var sums [][sha256.Size]byte
+	var sizes []int64
+	for {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
+			return sums, sizes, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		sums = append(sums, sha256.Sum256(chunk))
+		sizes = append(sizes, int64(len(chunk)))
+	}
+}
@@ -0,0 +1,52 @@
+package datastorage
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+func TestDedupReportFindsSharedRegion(t *testing.T) {
+	v := newTestVault(t)
+	shared := randomBytes(t, 300_000)
+	v.storeObject(t, "a.bin", slices.Concat(randomBytes(t, 70_000), shared, randomBytes(t, 30_000)))
+	v.storeObject(t, "b.bin", slices.Concat(randomBytes(t, 50_000), shared))
+	v.storeObject(t, "c.bin", randomBytes(t, 100_000))
+
+	const chunkSize = 8 << 10
+	report, err := AnalyzeDedup(context.Background(), v.cfg.MetadataDir, chunkSize, v.store, v.cfg, v.logger)
+	if err != nil {
+		t.Fatalf("AnalyzeDedup: %v", err)
+	}
+	if len(report.Objects) != 3 || report.TotalBytes != 400_000+350_000+100_000 {
+		t.Fatalf("reported %d objects of %d bytes", len(report.Objects), report.TotalBytes)
+	}
+
+	// The chunks at either end of the shared region take in bytes around it
+	if len(report.Pairs) != 1 {
+		t.Fatalf("reported pairs %+v, expected a and b alone", report.Pairs)
+	}
+	pair := report.Pairs[0]
+	if a, b := report.Objects[pair.A].Filename, report.Objects[pair.B].Filename; a+b != "a.binb.bin" && a+b != "b.bina.bin" {
+		t.Fatalf("%s and %s reported as sharing chunks", a, b)
+	}
+	if pair.SharedBytes > int64(len(shared)) || pair.SharedBytes < int64(len(shared))-8*chunkSize {
+		t.Fatalf("a and b share %d bytes, expected about %d", pair.SharedBytes, len(shared))
+	}
+	if report.SavedBytes() != pair.SharedBytes {
+		t.Fatalf("saved %d bytes, expected the %d shared", report.SavedBytes(), pair.SharedBytes)
+	}
+	for _, object := range report.Objects {
+		want := pair.SharedBytes
+		if object.Filename == "c.bin" {
+			want = 0
+		}
+		if object.SharedBytes != want {
+			t.Fatalf("%s shares %d bytes, expected %d", object.Filename, object.SharedBytes, want)
+		}
+	}
+
+	if _, err := AnalyzeDedup(context.Background(), v.cfg.MetadataDir, 1024, v.store, v.cfg, v.logger); err == nil {
+		t.Fatal("analyzed with chunks smaller than the minimum")
+	}
+}
@@ -0,0 +1,86 @@
+package datastorage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/techninja8/getvault.io/pkg/metadata"
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+// Retrievals hold a shared lock on an object's use lock, a sidecar
+// "<file>.use.lock" apart from the metadata file's own lock, for as long
+// as they read its shards; DeleteData holds it exclusively. A delete so
+// waits for retrievals in progress, and retrievals that start while a
+// delete is going on wait for it and then find the object gone, instead
+// of finding some of its shards missing. The metadata file's own lock
+// can't be held that long: a retrieval may rewrite the metadata.
+const useLockSuffix = ".use"
+
+// lockObjectUse takes an object's use lock and returns the function
+// releasing it.
+func lockObjectUse(metadatafile string, exclusive bool) (func(), error) {
+	return metadata.Lock(metadatafile+useLockSuffix, exclusive)
+}
+
+// useObject takes the shared use lock of an object for a retrieval. An
+// object that doesn't exist isn't locked, so retrieving it fails without
+// leaving a lock file behind.
+func useObject(metadatafile string) (func(), error) {
+	if _, err := os.Stat(metadatafile); err != nil {
+		return nil, fmt.Errorf("error reading metadata file: %w", err)
+	}
+	return lockObjectUse(metadatafile, false)
+}
+
+// DeleteData deletes an object for good: it is moved to the trash, as by
+// TrashObject, and its shards are deleted straight away, as by
+// PurgeObject. It returns how many shard files it deleted. Deleting is
+// idempotent: shards already gone count as deleted, and deleting an
+// object that already has been succeeds without deleting anything more,
+// as long as its tombstone hasn't been compacted away. Deletes of an
+// object wait for its retrievals in progress, and for each other.
+func DeleteData(ctx context.Context, metadatafile string, store sharding.ShardStore, now time.Time, logger *zap.Logger) (int, error) {
+	unlock, err := lockObjectUse(metadatafile, true)
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := deleteData(ctx, metadatafile, store, now, logger)
+	unlock()
+	if err == nil || errors.Is(err, ErrObjectNotFound) {
+		os.Remove(metadatafile + useLockSuffix + ".lock")
+	}
+	return deleted, err
+}
+
+// deleteData is DeleteData under the object's use lock.
+func deleteData(ctx context.Context, metadatafile string, store sharding.ShardStore, now time.Time, logger *zap.Logger) (int, error) {
+	tombstone := metadatafile + tombstoneSuffix
+	if _, err := os.Stat(metadatafile); err == nil {
+		if tombstone, err = TrashObject(metadatafile, now, logger); err != nil {
+			// Trashed by a TrashObject of its own meanwhile, which is
+			// just as good
+			if _, statErr := os.Stat(metadatafile); !errors.Is(statErr, os.ErrNotExist) {
+				return 0, err
+			}
+			tombstone = metadatafile + tombstoneSuffix
+		}
+	}
+
+	purged, err := metadata.ReadValue(tombstone, "purged")
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return 0, fmt.Errorf("%w: %s", ErrObjectNotFound, metadatafile)
+	case err == nil && purged != "":
+		logger.Info("Object already deleted", zap.String("tombstone", tombstone))
+		return 0, nil
+	case err != nil && !errors.Is(err, metadata.ErrKeyNotFound):
+		return 0, fmt.Errorf("error reading tombstone: %w", err)
+	}
+	return PurgeObject(ctx, tombstone, store, now, logger)
+}
@@ -0,0 +1,166 @@
+package datastorage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/techninja8/getvault.io/pkg/metadata"
+)
+
+func TestDeleteDataIsIdempotent(t *testing.T) {
+	v := newTestVault(t)
+	metadatafile := v.storeObject(t, "report.pdf", randomBytes(t, 50_000))
+	shards := countFiles(t, v.locations)
+	// A shard already gone counts as deleted
+	if err := os.RemoveAll(v.locations[3]); err != nil {
+		t.Fatal(err)
+	}
+
+	deleted, err := DeleteData(context.Background(), metadatafile, v.store, time.Now(), v.logger)
+	if err != nil || deleted != shards {
+		t.Fatalf("DeleteData: %d of %d shards, %v", deleted, shards, err)
+	}
+	if n := countFiles(t, v.locations); n != 0 {
+		t.Fatalf("%d shard files left", n)
+	}
+	if _, err := os.Stat(metadatafile); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("metadata file: %v", err)
+	}
+
+	// Again, it is already deleted
+	deleted, err = DeleteData(context.Background(), metadatafile, v.store, time.Now(), v.logger)
+	if err != nil || deleted != 0 {
+		t.Fatalf("second DeleteData: %d, %v", deleted, err)
+	}
+	entries, err := ListTrash(v.cfg.MetadataDir)
+	if err != nil || len(entries) != 1 || !entries[0].Purged {
+		t.Fatalf("trash %+v, %v", entries, err)
+	}
+	if _, err := os.Stat(metadatafile + useLockSuffix + ".lock"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("use lock left behind: %v", err)
+	}
+
+	// An object that never existed is not found, and leaves nothing behind
+	missing := metadatafile + ".missing"
+	if _, err := DeleteData(context.Background(), missing, v.store, time.Now(), v.logger); !errors.Is(err, ErrObjectNotFound) {
+		t.Fatalf("DeleteData of a missing object: %v", err)
+	}
+	if _, err := os.Stat(missing + useLockSuffix + ".lock"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("use lock left behind: %v", err)
+	}
+}
+
+func TestDeleteDataTrashedObject(t *testing.T) {
+	v := newTestVault(t)
+	metadatafile := v.storeObject(t, "report.pdf", randomBytes(t, 50_000))
+	if _, err := TrashObject(metadatafile, time.Now(), v.logger); err != nil {
+		t.Fatal(err)
+	}
+	shards := countFiles(t, v.locations)
+	deleted, err := DeleteData(context.Background(), metadatafile, v.store, time.Now(), v.logger)
+	if err != nil || deleted != shards || countFiles(t, v.locations) != 0 {
+		t.Fatalf("DeleteData of a trashed object: %d of %d shards, %v", deleted, shards, err)
+	}
+}
+
+// TestDeleteRacesRetrieve runs deletes and retrieves of the same object
+// at once, and is meant for -race as much as for its checks: every
+// retrieve gets all of the object or finds it gone, and once they are
+// done the object is gone whole.
+func TestDeleteRacesRetrieve(t *testing.T) {
+	v := newTestVault(t)
+	for round := 0; round < 10; round++ {
+		data := randomBytes(t, 100_000+round)
+		metadatafile := v.storeObject(t, "report.pdf", data)
+		dataID, _ := metadata.ReadValue(metadatafile, "dataID")
+		index, err := NewMetadataIndex(v.cfg.MetadataDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		shards := countFiles(t, v.locations)
+
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		deletedTotal := 0
+		for i := 0; i < 2; i++ {
+			wg.Add(3)
+			go func() {
+				defer wg.Done()
+				deleted, err := DeleteData(context.Background(), metadatafile, v.store, time.Now(), v.logger)
+				if err != nil {
+					t.Errorf("DeleteData: %v", err)
+				}
+				mu.Lock()
+				deletedTotal += deleted
+				mu.Unlock()
+			}()
+			go func() {
+				defer wg.Done()
+				got, err := RetrieveData(metadatafile, v.store, v.cfg, v.logger)
+				if err != nil && !errors.Is(err, os.ErrNotExist) || err == nil && !bytes.Equal(got, data) {
+					t.Errorf("RetrieveData during a delete: %d bytes, %v", len(got), err)
+				}
+			}()
+			go func() {
+				defer wg.Done()
+				var buf bytes.Buffer
+				_, err := RetrieveTo(metadatafile, &buf, v.store, v.cfg, v.logger)
+				if err != nil && !errors.Is(err, os.ErrNotExist) || err == nil && !bytes.Equal(buf.Bytes(), data) {
+					t.Errorf("RetrieveTo during a delete: %d bytes, %v", buf.Len(), err)
+				}
+			}()
+		}
+		wg.Wait()
+		if t.Failed() {
+			t.FailNow()
+		}
+
+		if deletedTotal != shards {
+			t.Fatalf("deletes removed %d of %d shard files", deletedTotal, shards)
+		}
+		if n := countFiles(t, v.locations); n != 0 {
+			t.Fatalf("%d shard files left", n)
+		}
+		if _, err := index.Lookup(dataID); !errors.Is(err, ErrObjectNotFound) {
+			t.Fatalf("index still finds the object: %v", err)
+		}
+	}
+}
+
+func TestDeleteWaitsForOpenReader(t *testing.T) {
+	v := newTestVault(t)
+	data := randomBytes(t, 100_000)
+	metadatafile := v.storeObject(t, "report.pdf", data)
+	r, err := OpenObject(context.Background(), metadatafile, v.store, v.cfg, v.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := DeleteData(context.Background(), metadatafile, v.store, time.Now(), v.logger)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("DeleteData finished with the object open: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	got, err := io.ReadAll(r)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("read %d bytes while deleting, %v", len(got), err)
+	}
+	r.Close()
+	if err := <-done; err != nil {
+		t.Fatalf("DeleteData: %v", err)
+	}
+	if _, err := OpenObject(context.Background(), metadatafile, v.store, v.cfg, v.logger); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("OpenObject after the delete: %v", err)
+	}
+}
@@ -0,0 +1,334 @@
+package datastorage
+
+import (
+	"archive/zip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/techninja8/getvault.io/internal/tmp"
+	"github.com/techninja8/getvault.io/pkg/config"
+	"github.com/techninja8/getvault.io/pkg/metadata"
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+// treeHashLabel derives the key the files of a stored directory are hashed
+// under from the master key, so the metadata doesn't give away the sha256
+// of every file.
+const treeHashLabel = "vault tree hash"
+
+// treeHashesKey opens the metadata block recording the hash of every file
+// of a directory stored as a zip archive, one "file_<n>: <hex> <quoted
+// entry name>" line each.
+const treeHashesKey = "tree_hashes"
+
+// TreeHashes are the hashes of the files of a directory tree by their
+// slash-separated path in it, as entries of its zip archive are named.
+// Directories have none, so empty ones don't show.
+type TreeHashes map[string]string
+
+// NewTreeHash returns the hash the files of a directory are recorded with
+// when it is stored, keyed by the master key.
+func NewTreeHash(cfg *config.Config) (func() hash.Hash, error) {
+	masterKey, err := GetEncryptionKey(cfg)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, masterKey)
+	mac.Write([]byte(treeHashLabel))
+	key := mac.Sum(nil)
+	return func() hash.Hash { return hmac.New(sha256.New, key) }, nil
+}
+
+// SetTreeHashes records the hashes of the files of the directory an object
+// is the zip archive of, replacing any recorded before.
+func SetTreeHashes(metadatafile string, hashes TreeHashes) error {
+	names := make([]string, 0, len(hashes))
+	for name := range hashes {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	block := []string{treeHashesKey + ": {"}
+	for i, name := range names {
+		block = append(block, fmt.Sprintf("  file_%d: %s %s", i, hashes[name], strconv.Quote(name)))
+	}
+	block = append(block, "}")
+	return rewriteMetadataFile(metadatafile, func(lines []string) ([]string, error) {
+		return append(dropBlock(lines, treeHashesKey), block...), nil
+	})
+}
+
+// dropBlock returns lines without the top-level block key opens.
+func dropBlock(lines []string, key string) []string {
+	start := slices.Index(lines, key+": {")
+	if start < 0 {
+		return lines
+	}
+	end := start + 1
+	for end < len(lines) && lines[end] != "}" {
+		end++
+	}
+	return slices.Delete(lines, start, min(end+1, len(lines)))
+}
+
+// readTreeHashes returns the file hashes recorded in an object's metadata,
+// or nil if it isn't a directory or was stored before they were recorded.
+func readTreeHashes(lines []string) (TreeHashes, error) {
+	start := slices.Index(lines, treeHashesKey+": {")
+	if start < 0 {
+		return nil, nil
+	}
+	hashes := make(TreeHashes)
+	for _, line := range lines[start+1:] {
+		if line == "}" {
+			return hashes, nil
+		}
+		_, value, _ := strings.Cut(line, ": ")
+		sum, quoted, ok := strings.Cut(value, " ")
+		name, err := strconv.Unquote(quoted)
+		if !ok || err != nil {
+			return nil, fmt.Errorf("invalid %s line %q", treeHashesKey, line)
+		}
+		hashes[name] = sum
+	}
+	return nil, fmt.Errorf("unterminated %s block", treeHashesKey)
+}
+
+// HashTree hashes the files of a local directory as ZipDirectoryToWriter
+// does when given Hashes.
+func HashTree(dir string, newHash func() hash.Hash) (TreeHashes, error) {
+	hashes := make(TreeHashes)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return fmt.Errorf("error walking directory: %w", err)
+		}
+		if info.IsDir() {
+			return nil
+		}
+		relPath, err := filepath.Rel(dir, path)
+		if err != nil {
+			return fmt.Errorf("failed to get relative path: %w", err)
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("failed to open file: %w", err)
+		}
+		defer file.Close()
+		h := newHash()
+		if _, err := io.Copy(h, file); err != nil {
+			return fmt.Errorf("failed to read file: %w", err)
+		}
+		hashes[filepath.ToSlash(relPath)] = hex.EncodeToString(h.Sum(nil))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return hashes, nil
+}
+
+// hashArchive hashes the files in a zip archive.
+func hashArchive(path string, newHash func() hash.Hash) (TreeHashes, error) {
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open zip file: %w", err)
+	}
+	defer archive.Close()
+	hashes := make(TreeHashes)
+	for _, file := range archive.File {
+		if file.FileInfo().IsDir() {
+			continue
+		}
+		r, err := file.Open()
+		if err != nil {
+			return nil, fmt.Errorf("failed to open file in archive: %w", err)
+		}
+		h := newHash()
+		_, err = io.Copy(h, r)
+		r.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s in archive: %w", file.Name, err)
+		}
+		hashes[file.Name] = hex.EncodeToString(h.Sum(nil))
+	}
+	return hashes, nil
+}
+
+// Changes DiffObject reports of an entry.
+const (
+	DiffAdded   = "added"   // Only in the local tree
+	DiffRemoved = "removed" // Only in the object
+	DiffChanged = "changed" // In both, with other contents
+)
+
+// DiffEntry is a file that differs between a local path and an object.
+type DiffEntry struct {
+	Name   string // Slash-separated path in the directory, or the file's name
+	Change string
+}
+
+// Diff is what differs between a local path and an object, by name.
+type Diff []DiffEntry
+
+// Exit statuses of vault diff, as diff(1) has them.
+const (
+	DiffExitSame    = 0
+	DiffExitDiffers = 1
+	DiffExitTrouble = 2
+)
+
+// ExitCode returns the exit status vault diff reports the diff with.
+func (d Diff) ExitCode() int {
+	if len(d) > 0 {
+		return DiffExitDiffers
+	}
+	return DiffExitSame
+}
+
+// Print writes a line per entry: its change, padded, and its name.
+func (d Diff) Print(w io.Writer) error {
+	for _, entry := range d {
+		if _, err := fmt.Fprintf(w, "%-8s %s\n", entry.Change, entry.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DiffObject compares a local file or directory with a stored object by
+// the hashes of their contents, to tell whether it is worth storing again.
+//
+// A directory is compared with an object stored as its zip archive file
+// by file, from the hashes recorded when it was stored; for objects stored
+// before those were, the archive is retrieved and its files hashed. A file
+// is compared with an object whole: with its dataID, when the dataID names
+// the object's contents, and with the hash of the retrieved object
+// otherwise. Directory entries only count by the files in them, and file
+// modes and times don't count at all.
+func DiffObject(path, metadatafile string, store sharding.ShardStore, cfg *config.Config, logger *zap.Logger) (Diff, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat path: %w", err)
+	}
+	m, err := metadata.Read(metadatafile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading metadata file: %w", err)
+	}
+	values := m.Values()
+	if info.IsDir() {
+		// A file compared with a directory's archive just differs from it
+		if values["format"] != "zip" {
+			return nil, fmt.Errorf("%s is a directory, but the object isn't one", path)
+		}
+		return diffTree(path, metadatafile, m.Lines, store, cfg, logger)
+	}
+
+	same, err := sameContents(path, metadatafile, values, store, cfg, logger)
+	if err != nil || same {
+		return nil, err
+	}
+	return Diff{{Name: filepath.Base(path), Change: DiffChanged}}, nil
+}
+
+// diffTree compares a local directory with an object stored as its zip
+// archive.
+func diffTree(dir, metadatafile string, lines []string, store sharding.ShardStore, cfg *config.Config, logger *zap.Logger) (Diff, error) {
+	newHash, err := NewTreeHash(cfg)
+	if err != nil {
+		return nil, err
+	}
+	stored, err := readTreeHashes(lines)
+	if err != nil {
+		return nil, err
+	}
+	if stored == nil {
+		logger.Info("No file hashes recorded, retrieving the archive", zap.String("metadata", metadatafile))
+		if stored, err = retrieveTreeHashes(metadatafile, newHash, store, cfg, logger); err != nil {
+			return nil, err
+		}
+	}
+	local, err := HashTree(dir, newHash)
+	if err != nil {
+		return nil, err
+	}
+
+	var diff Diff
+	for name, sum := range local {
+		switch storedSum, ok := stored[name]; {
+		case !ok:
+			diff = append(diff, DiffEntry{Name: name, Change: DiffAdded})
+		case storedSum != sum:
+			diff = append(diff, DiffEntry{Name: name, Change: DiffChanged})
+		}
+	}
+	for name := range stored {
+		if _, ok := local[name]; !ok {
+			diff = append(diff, DiffEntry{Name: name, Change: DiffRemoved})
+		}
+	}
+	slices.SortFunc(diff, func(a, b DiffEntry) int { return strings.Compare(a.Name, b.Name) })
+	return diff, nil
+}
+
+// retrieveTreeHashes retrieves a stored archive to a temporary file in
+// the invocation's workspace and hashes the files in it.
+func retrieveTreeHashes(metadatafile string, newHash func() hash.Hash, store sharding.ShardStore, cfg *config.Config, logger *zap.Logger) (TreeHashes, error) {
+	file, err := tmp.CreateTemp("vault-diff-*.zip")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(file.Name())
+	_, err = RetrieveTo(metadatafile, file, store, cfg, logger)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve archive: %w", err)
+	}
+	return hashArchive(file.Name(), newHash)
+}
+
+// sameContents reports whether a local file holds what an object does.
+func sameContents(path, metadatafile string, values map[string]string, store sharding.ShardStore, cfg *config.Config, logger *zap.Logger) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, fmt.Errorf("failed to read file: %w", err)
+	}
+	defer file.Close()
+
+	if values[idModeKey] == config.IDModeContent {
+		h, err := contentIDHash(cfg)
+		if err != nil {
+			return false, err
+		}
+		if _, err := io.Copy(h, file); err != nil {
+			return false, fmt.Errorf("failed to read file: %w", err)
+		}
+		return hex.EncodeToString(h.Sum(nil)) == values["dataID"], nil
+	}
+
+	// The sizes tell most changed files apart without retrieving anything
+	if info, err := file.Stat(); err == nil {
+		if size, err := strconv.ParseInt(values["filesize"], 10, 64); err == nil && size != info.Size() {
+			return false, nil
+		}
+	}
+	local, stored := sha256.New(), sha256.New()
+	if _, err := io.Copy(local, file); err != nil {
+		return false, fmt.Errorf("failed to read file: %w", err)
+	}
+	if _, err := RetrieveTo(metadatafile, stored, store, cfg, logger); err != nil {
+		return false, fmt.Errorf("failed to retrieve object: %w", err)
+	}
+	return hmac.Equal(local.Sum(nil), stored.Sum(nil)), nil
+}
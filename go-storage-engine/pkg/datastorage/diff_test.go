@@ -0,0 +1,149 @@
+package datastorage
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/techninja8/getvault.io/pkg/config"
+	"github.com/techninja8/getvault.io/pkg/metadata"
+)
+
+// storeHashedTree stores a zip archive of dir the way store does a
+// directory, recording the hashes of its files.
+func (v *testVault) storeHashedTree(t *testing.T, dir string) string {
+	t.Helper()
+	newHash, err := NewTreeHash(v.cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var archive bytes.Buffer
+	var stats TreeStats
+	hashes := make(TreeHashes)
+	if err := ZipDirectoryToWriter(dir, &archive, ZipOptions{Stats: &stats, Hashes: hashes, NewHash: newHash}); err != nil {
+		t.Fatalf("ZipDirectoryToWriter: %v", err)
+	}
+	if len(hashes) != int(stats.Files) {
+		t.Fatalf("hashed %d files of %d", len(hashes), stats.Files)
+	}
+	metadatafile := v.storeTree(t, dir, stats)
+	if err := SetTreeHashes(metadatafile, hashes); err != nil {
+		t.Fatalf("SetTreeHashes: %v", err)
+	}
+	return metadatafile
+}
+
+func (v *testVault) diff(t *testing.T, path, metadatafile string) (string, int) {
+	t.Helper()
+	diff, err := DiffObject(path, metadatafile, v.store, v.cfg, v.logger)
+	if err != nil {
+		t.Fatalf("DiffObject: %v", err)
+	}
+	var out bytes.Buffer
+	if err := diff.Print(&out); err != nil {
+		t.Fatal(err)
+	}
+	return out.String(), diff.ExitCode()
+}
+
+func TestDiffTree(t *testing.T) {
+	v := newTestVault(t)
+	dir := t.TempDir()
+	writeTree(t, dir, "")
+	hashed := v.storeHashedTree(t, dir)
+	// Stored before file hashes were recorded: the archive is retrieved
+	unhashed := v.storeTree(t, dir, TreeStats{})
+	if lines, err := os.ReadFile(unhashed); err != nil || bytes.Contains(lines, []byte(treeHashesKey)) {
+		t.Fatalf("file hashes recorded without SetTreeHashes, %v", err)
+	}
+
+	for _, metadatafile := range []string{hashed, unhashed} {
+		if out, code := v.diff(t, dir, metadatafile); out != "" || code != DiffExitSame {
+			t.Fatalf("unchanged tree: %q, exit %d", out, code)
+		}
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "src", "main.go"), []byte("package main\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, metadatafile := range []string{hashed, unhashed} {
+		if out, code := v.diff(t, dir, metadatafile); out != "changed  src/main.go\n" || code != DiffExitDiffers {
+			t.Fatalf("one file changed: %q, exit %d", out, code)
+		}
+	}
+
+	if err := os.Remove(filepath.Join(dir, "readme.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "src", "lib", "new.go"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	want := "removed  readme.txt\nadded    src/lib/new.go\nchanged  src/main.go\n"
+	for _, metadatafile := range []string{hashed, unhashed} {
+		if out, code := v.diff(t, dir, metadatafile); out != want || code != DiffExitDiffers {
+			t.Fatalf("files added, changed and removed: %q, exit %d", out, code)
+		}
+	}
+}
+
+func TestTreeHashesAreReplaced(t *testing.T) {
+	v := newTestVault(t)
+	metadatafile := v.storeObject(t, "tree.zip", randomBytes(t, 100))
+	for _, hashes := range []TreeHashes{
+		{"a": "00", "dir/name with spaces: \"quoted\"\n": "11"},
+		{"b": "22"},
+	} {
+		if err := SetTreeHashes(metadatafile, hashes); err != nil {
+			t.Fatal(err)
+		}
+		m, err := metadata.Read(metadatafile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := readTreeHashes(m.Lines)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(hashes) {
+			t.Fatalf("read %v, recorded %v", got, hashes)
+		}
+		for name, sum := range hashes {
+			if got[name] != sum {
+				t.Fatalf("read %v, recorded %v", got, hashes)
+			}
+		}
+		if !slices.Contains(m.Lines, "storage_locations: {") {
+			t.Fatal("storage locations lost")
+		}
+	}
+}
+
+func TestDiffFile(t *testing.T) {
+	for _, mode := range []string{"", config.IDModeContent} {
+		v := newTestVault(t)
+		v.cfg.IDMode = mode
+		data := randomBytes(t, 50_000)
+		metadatafile := v.storeObject(t, "file.bin", data)
+		path := filepath.Join(t.TempDir(), "file.bin")
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if out, code := v.diff(t, path, metadatafile); out != "" || code != DiffExitSame {
+			t.Fatalf("ID mode %q, unchanged file: %q, exit %d", mode, out, code)
+		}
+
+		// Same size, other contents
+		data[100] ^= 1
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if out, code := v.diff(t, path, metadatafile); out != "changed  file.bin\n" || code != DiffExitDiffers {
+			t.Fatalf("ID mode %q, changed file: %q, exit %d", mode, out, code)
+		}
+		if _, err := DiffObject(t.TempDir(), metadatafile, v.store, v.cfg, v.logger); err == nil {
+			t.Fatalf("ID mode %q: diffed a directory against a file", mode)
+		}
+	}
+}
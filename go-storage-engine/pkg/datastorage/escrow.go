@@ -0,0 +1,127 @@
+package datastorage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/techninja8/getvault.io/internal/shamir"
+	"github.com/techninja8/getvault.io/pkg/config"
+)
+
+// Escrow shares are the master key split with Shamir's secret sharing,
+// printed for offline storage. A share is base32 of
+//
+//	version | threshold | index | key check (4) | share value | checksum (4)
+//
+// where the key check is the start of the sha256 of the key, so a
+// recovered key can be confirmed, and the checksum is the start of the
+// sha256 of everything before it, so a mistyped share is caught on its own.
+// The base32 is split into dash-separated groups of four to ease copying.
+const (
+	escrowVersion       = 1
+	escrowShareHeader   = "VAULT-SHARE-"
+	escrowCheckSize     = 4
+	escrowShareOverhead = 3 + 2*escrowCheckSize
+)
+
+var (
+	ErrEscrowShareCorrupt = errors.New("escrow share is corrupt")
+	ErrEscrowKeyMismatch  = errors.New("escrow shares don't recover the key they were made from")
+)
+
+var escrowEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// ExportEscrow splits the master key into n escrow shares, any k of which
+// recover it.
+func ExportEscrow(cfg *config.Config, n, k int) ([]string, error) {
+	key, err := GetEncryptionKey(cfg)
+	if err != nil {
+		return nil, err
+	}
+	shares, err := shamir.Split(key, n, k)
+	if err != nil {
+		return nil, err
+	}
+	check := sha256.Sum256(key)
+	encoded := make([]string, len(shares))
+	for i, share := range shares {
+		encoded[i] = encodeEscrowShare(share, k, check[:escrowCheckSize])
+	}
+	return encoded, nil
+}
+
+// RecoverEscrow reassembles the master key from escrow shares. It fails if
+// a share is corrupt, the shares come from different keys, or there are
+// fewer of them than the threshold they were made with.
+func RecoverEscrow(encoded []string) ([]byte, error) {
+	var (
+		shares    []shamir.Share
+		threshold int
+		check     []byte
+	)
+	for i, s := range encoded {
+		share, k, shareCheck, err := decodeEscrowShare(s)
+		if err != nil {
+			return nil, fmt.Errorf("share %d: %w", i+1, err)
+		}
+		if check == nil {
+			threshold, check = k, shareCheck
+		} else if k != threshold || !bytes.Equal(shareCheck, check) {
+			return nil, fmt.Errorf("share %d: %w", i+1, ErrEscrowKeyMismatch)
+		}
+		shares = append(shares, share)
+	}
+	if len(shares) < threshold {
+		return nil, fmt.Errorf("%d shares given, %d needed", len(shares), threshold)
+	}
+
+	key, err := shamir.Combine(shares)
+	if err != nil {
+		return nil, err
+	}
+	if sum := sha256.Sum256(key); !bytes.Equal(sum[:escrowCheckSize], check) {
+		return nil, ErrEscrowKeyMismatch
+	}
+	return key, nil
+}
+
+func encodeEscrowShare(share shamir.Share, threshold int, check []byte) string {
+	payload := []byte{escrowVersion, byte(threshold), share.Index}
+	payload = append(payload, check...)
+	payload = append(payload, share.Value...)
+	sum := sha256.Sum256(payload)
+	payload = append(payload, sum[:escrowCheckSize]...)
+
+	text := escrowEncoding.EncodeToString(payload)
+	var groups []string
+	for len(text) > 4 {
+		groups = append(groups, text[:4])
+		text = text[4:]
+	}
+	return escrowShareHeader + strings.Join(append(groups, text), "-")
+}
+
+func decodeEscrowShare(s string) (shamir.Share, int, []byte, error) {
+	s = strings.ToUpper(strings.Join(strings.Fields(s), ""))
+	s, ok := strings.CutPrefix(s, escrowShareHeader)
+	if !ok {
+		return shamir.Share{}, 0, nil, fmt.Errorf("%w: missing %s prefix", ErrEscrowShareCorrupt, escrowShareHeader)
+	}
+	payload, err := escrowEncoding.DecodeString(strings.ReplaceAll(s, "-", ""))
+	if err != nil || len(payload) <= escrowShareOverhead {
+		return shamir.Share{}, 0, nil, ErrEscrowShareCorrupt
+	}
+	body, sum := payload[:len(payload)-escrowCheckSize], payload[len(payload)-escrowCheckSize:]
+	if want := sha256.Sum256(body); !bytes.Equal(sum, want[:escrowCheckSize]) {
+		return shamir.Share{}, 0, nil, fmt.Errorf("%w: checksum mismatch", ErrEscrowShareCorrupt)
+	}
+	if body[0] != escrowVersion {
+		return shamir.Share{}, 0, nil, fmt.Errorf("unsupported escrow share version %d", body[0])
+	}
+	share := shamir.Share{Index: body[2], Value: body[3+escrowCheckSize:]}
+	return share, int(body[1]), body[3 : 3+escrowCheckSize], nil
+}
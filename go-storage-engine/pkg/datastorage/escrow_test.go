@@ -0,0 +1,85 @@
+package datastorage
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestEscrowRoundTrip(t *testing.T) {
+	v := newTestVault(t)
+	key, err := hex.DecodeString(v.cfg.EncryptionKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct{ n, k int }{{2, 2}, {3, 2}, {5, 3}, {7, 7}} {
+		shares, err := ExportEscrow(v.cfg, tc.n, tc.k)
+		if err != nil {
+			t.Fatalf("ExportEscrow(%d, %d): %v", tc.n, tc.k, err)
+		}
+		// The last k shares, in reverse, and with the share typed in lower case
+		var picked []string
+		for i := tc.n - 1; i >= tc.n-tc.k; i-- {
+			picked = append(picked, shares[i])
+		}
+		picked[0] = strings.ToLower(picked[0])
+		recovered, err := RecoverEscrow(picked)
+		if err != nil || !bytes.Equal(recovered, key) {
+			t.Fatalf("%d of %d recovered %x, %v", tc.k, tc.n, recovered, err)
+		}
+		if _, err := RecoverEscrow(picked[:tc.k-1]); err == nil {
+			t.Fatalf("%d of %d: recovered from %d shares", tc.k, tc.n, tc.k-1)
+		}
+	}
+}
+
+func TestEscrowCorruptShare(t *testing.T) {
+	v := newTestVault(t)
+	shares, err := ExportEscrow(v.cfg, 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A mistyped character fails the share's own checksum
+	typo := []byte(shares[0])
+	i := len(escrowShareHeader) + 5
+	if typo[i] == 'A' {
+		typo[i] = 'B'
+	} else {
+		typo[i] = 'A'
+	}
+	if _, _, _, err := decodeEscrowShare(string(typo)); !errors.Is(err, ErrEscrowShareCorrupt) {
+		t.Fatalf("decoding a mistyped share returned %v", err)
+	}
+	if _, err := RecoverEscrow([]string{string(typo), shares[1]}); !errors.Is(err, ErrEscrowShareCorrupt) {
+		t.Fatalf("recovering with a mistyped share returned %v", err)
+	}
+	if _, _, _, err := decodeEscrowShare(strings.TrimPrefix(shares[0], escrowShareHeader)); !errors.Is(err, ErrEscrowShareCorrupt) {
+		t.Fatalf("decoding a share without its prefix returned %v", err)
+	}
+
+	// A share whose value was altered and checksum recomputed gets past
+	// decoding, but not the check of the key it recovers
+	share, k, check, err := decodeEscrowShare(shares[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	share.Value = bytes.Clone(share.Value)
+	share.Value[0] ^= 1
+	tampered := encodeEscrowShare(share, k, check)
+	if _, err := RecoverEscrow([]string{tampered, shares[1]}); !errors.Is(err, ErrEscrowKeyMismatch) {
+		t.Fatalf("recovering with a tampered share returned %v", err)
+	}
+
+	// Shares of another key
+	other := newTestVault(t)
+	foreign, err := ExportEscrow(other.cfg, 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RecoverEscrow([]string{shares[0], foreign[1]}); !errors.Is(err, ErrEscrowKeyMismatch) {
+		t.Fatalf("recovering with shares of two keys returned %v", err)
+	}
+}
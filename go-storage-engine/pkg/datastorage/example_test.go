@@ -0,0 +1,88 @@
+package datastorage_test
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"go.uber.org/zap"
+
+	"github.com/techninja8/getvault.io/pkg/config"
+	"github.com/techninja8/getvault.io/pkg/datastorage"
+	"github.com/techninja8/getvault.io/pkg/erasurecoding"
+	"github.com/techninja8/getvault.io/pkg/metadata"
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+// xorCipher stands in for an embedder's own cipher. It is not encryption.
+type xorCipher struct{}
+
+func (xorCipher) Name() string { return "example-xor" }
+
+func (xorCipher) AppendEncrypt(dst, data, key []byte) ([]byte, error) {
+	for i, b := range data {
+		dst = append(dst, b^key[i%len(key)])
+	}
+	return dst, nil
+}
+
+func (c xorCipher) Decrypt(cipherText, key []byte) ([]byte, error) {
+	return c.AppendEncrypt(nil, cipherText, key)
+}
+
+// Stores an object with a cipher of the embedder's own and retrieves it
+// the standard way, which finds the cipher by the name its metadata
+// records.
+func ExamplePipeline_cipher() {
+	dir, err := os.MkdirTemp("", "example")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	key, err := datastorage.GenerateEncryptionKey()
+	if err != nil {
+		panic(err)
+	}
+	cfg := &config.Config{
+		EncryptionKey:        key,
+		MaxConcurrency:       4,
+		MaxInFlightBytes:     64 << 20,
+		MetadataDir:          filepath.Join(dir, "metadata"),
+		ShardRetryAttempts:   1,
+		MaxRetriesPerOp:      10,
+		MetadataNameTemplate: config.DefaultMetadataNameTemplate,
+		MetadataExt:          config.DefaultMetadataExt,
+		HealthFile:           filepath.Join(dir, "health.json"),
+	}
+	var locations []string
+	for i := range erasurecoding.DataShards + erasurecoding.ParityShards {
+		locations = append(locations, filepath.Join(dir, fmt.Sprintf("location%d", i)))
+	}
+	store := sharding.NewInMemoryShardStore()
+	logger := zap.NewNop()
+
+	if err := datastorage.RegisterCipher(xorCipher{}); err != nil {
+		panic(err)
+	}
+	p := datastorage.NewPipeline(store, cfg, logger)
+	p.Cipher = xorCipher{}
+	_, metadatafile, err := p.Store([]byte("sealed by the embedder"), locations, "note.txt")
+	if err != nil {
+		panic(err)
+	}
+	cipher, err := metadata.ReadValue(metadatafile, "cipher")
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println("cipher:", cipher)
+
+	var out bytes.Buffer
+	if _, err := datastorage.RetrieveTo(metadatafile, &out, store, cfg, logger); err != nil {
+		panic(err)
+	}
+	fmt.Println(out.String())
+	// Output:
+	// cipher: example-xor
+	// sealed by the embedder
+}
@@ -0,0 +1,236 @@
+package datastorage
+
+import (
+	"crypto/aes"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/techninja8/getvault.io/pkg/metadata"
+)
+
+// Explanation is the recipe for reconstructing a stored object, worked out
+// from its metadata alone: how its contents were transformed, encrypted
+// and coded, where each shard is and what it should hash to, and the steps
+// retrieval takes to undo it all. Nothing is read from the locations.
+type Explanation struct {
+	MetadataFile   string         `json:"metadata_file"`
+	DataID         string         `json:"data_id"`
+	Filename       string         `json:"filename"`
+	Size           int64          `json:"size"`        // Bytes retrieved: the zip archive of a directory
+	StoredSize     int64          `json:"stored_size"` // Bytes of every shard of the object as stored
+	Tree           *TreeStats     `json:"tree,omitempty"`
+	Layout         string         `json:"layout"`
+	LayoutReason   string         `json:"layout_reason,omitempty"`
+	Compression    string         `json:"compression"`
+	Transforms     []string       `json:"transforms,omitempty"`
+	Cipher         string         `json:"cipher"`
+	KeySource      string         `json:"key_source"`
+	KeyFingerprint string         `json:"key_fingerprint,omitempty"`
+	Chunking       string         `json:"chunking,omitempty"`
+	Code           string         `json:"erasure_code"` // e.g. "8+6 gf8"
+	ShardFormat    string         `json:"shard_format"`
+	ShardNaming    string         `json:"shard_naming"`
+	ProofScheme    string         `json:"proof_scheme"`
+	MinReader      string         `json:"min_reader_version,omitempty"`
+	Sets           []ExplainedSet `json:"shard_sets"`
+	Steps          []string       `json:"steps"`
+}
+
+// ExplainedSet is one shard set: the whole object, or one segment of a
+// streamed object.
+type ExplainedSet struct {
+	Label       string           `json:"label"` // "object" or "segment <n>"
+	ID          string           `json:"id"`
+	StoredBytes int              `json:"stored_bytes"` // Bytes coded into the set
+	ShardSize   int              `json:"shard_size"`   // Bytes of each shard as stored
+	MerkleRoot  string           `json:"merkle_root,omitempty"`
+	Shards      []ExplainedShard `json:"shards"`
+}
+
+// ExplainedShard is where one shard is and what it should hash to.
+type ExplainedShard struct {
+	Index     int      `json:"index"`
+	Kind      string   `json:"kind"`      // "data" or "parity"
+	Locations []string `json:"locations"` // Recorded location first, then candidates
+	Checksum  string   `json:"checksum,omitempty"`
+	Digest    string   `json:"digest,omitempty"`
+}
+
+// ExplainObject explains how the object of a metadata file is stored and
+// would be retrieved. It is read-only and needs no key.
+func ExplainObject(metadatafile string) (*Explanation, error) {
+	values, err := metadata.ReadValues(metadatafile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading metadata file: %w", err)
+	}
+	size, err := strconv.ParseInt(values["filesize"], 10, 64)
+	if err != nil || size < 0 {
+		return nil, fmt.Errorf("invalid filesize in metadata: %q", values["filesize"])
+	}
+	candidates, err := readShardCandidates(metadatafile)
+	if err != nil {
+		return nil, err
+	}
+	code, err := readCode(values)
+	if err != nil {
+		return nil, err
+	}
+	sets, err := readShardSets(metadatafile, values["dataID"])
+	if err != nil {
+		return nil, err
+	}
+	chunkSize, err := readChunkSize(values)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &Explanation{
+		MetadataFile:   metadatafile,
+		DataID:         values["dataID"],
+		Filename:       objectFilename(values),
+		Size:           size,
+		Layout:         readLayout(metadatafile),
+		LayoutReason:   values["layout_reason"],
+		Compression:    "none",
+		KeyFingerprint: values["key_fingerprint"],
+		Code:           code.String(),
+		ShardFormat:    "raw",
+		ShardNaming:    values["shard_naming"],
+		ProofScheme:    sets[0].Scheme,
+		MinReader:      values[minReaderVersionKey],
+		Tree:           readTreeStats(values),
+	}
+	// Directories are stored as zip archives of their contents
+	if values["format"] == "zip" {
+		e.Compression = "zip archive (deflate)"
+	}
+	if values["transforms"] != "" {
+		e.Transforms = strings.Split(values["transforms"], ",")
+	}
+	if sets[0].Indexed {
+		e.ShardFormat = shardFormatIndexed
+	}
+	if e.ShardNaming == "" {
+		e.ShardNaming = "plain"
+	}
+	switch mode := values["encryption"]; {
+	case storedAsIs(values):
+		e.Cipher, e.KeySource = mode, "none: stored as it is"
+	case mode == envelopeEncryption:
+		e.Cipher = "AES-CFB, random IV"
+		e.KeySource = fmt.Sprintf("per-object data key, wrapped to the master key and %s recipient(s)", values["recipients"])
+	case mode == convergentEncryption:
+		e.Cipher = "AES-CFB, IV derived from the data (HMAC-SHA256)"
+		e.KeySource = fmt.Sprintf("convergent: derived from the data (HKDF of its SHA-256), wrapped to the master key and %s recipient(s)", values["recipients"])
+	default:
+		e.Cipher, e.KeySource = "AES-CFB, random IV", "master key"
+	}
+	if chunkSize > 0 {
+		e.Chunking = fmt.Sprintf("gear, %d bytes on average", chunkSize)
+		e.Cipher = "AES-CFB, IV derived from the chunk (HMAC-SHA256)"
+	}
+	if name := values["cipher"]; name != "" {
+		e.Cipher = name + ", registered by the embedder"
+	}
+
+	var storedBytes []int
+	if e.Layout == layoutStreaming {
+		segments, err := readSegments(values)
+		if err != nil {
+			return nil, err
+		}
+		for _, seg := range segments {
+			storedBytes = append(storedBytes, seg.Size)
+		}
+	} else {
+		storedBytes = []int{storedLength(values, size)}
+	}
+	if len(storedBytes) != len(sets) {
+		return nil, fmt.Errorf("metadata has %d segments but proofs for %d", len(storedBytes), len(sets))
+	}
+	for s, set := range sets {
+		explained := ExplainedSet{Label: "object", ID: set.ID, StoredBytes: storedBytes[s], ShardSize: code.ShardSize(storedBytes[s])}
+		if e.Layout == layoutStreaming {
+			explained.Label = fmt.Sprintf("segment %d", s)
+		}
+		if set.Indexed {
+			explained.ShardSize += shardHeaderSize
+		}
+		if set.Root != nil {
+			explained.MerkleRoot = hex.EncodeToString(set.Root)
+		}
+		for i := 0; i < code.Total(); i++ {
+			shard := ExplainedShard{Index: i, Kind: "data", Locations: candidates[i]}
+			if i >= code.Data {
+				shard.Kind = "parity"
+			}
+			if set.Checksums != nil {
+				shard.Checksum = set.Checksums[i]
+			}
+			if set.Digests != nil {
+				shard.Digest = hex.EncodeToString(set.Digests[i])
+			}
+			explained.Shards = append(explained.Shards, shard)
+		}
+		e.Sets = append(e.Sets, explained)
+		e.StoredSize += int64(explained.ShardSize) * int64(code.Total())
+	}
+	e.Steps = e.retrievalSteps(values, code.Data, code.Total())
+	return e, nil
+}
+
+// retrievalSteps lists what retrieval does with the object, in order.
+func (e *Explanation) retrievalSteps(values map[string]string, needed, total int) []string {
+	var steps []string
+	step := func(format string, args ...any) { steps = append(steps, fmt.Sprintf(format, args...)) }
+
+	if e.MinReader != "" {
+		step("read the metadata and check this vault is at least version %s", e.MinReader)
+	}
+	switch {
+	case storedAsIs(values):
+	case e.KeySource == "master key":
+		step("pick the master key with fingerprint %s from the keyring", e.KeyFingerprint)
+	default:
+		step("unwrap the data key with the master key with fingerprint %s, or else a recipient identity", e.KeyFingerprint)
+	}
+	if e.Chunking != "" {
+		step("derive the chunk key from the object key")
+	}
+
+	// A shard set's steps, done once for the object or for each segment
+	var prefix string
+	if e.Layout == layoutStreaming {
+		prefix = fmt.Sprintf("for each of the %d segments in order: ", len(e.Sets))
+	}
+	step("%sfetch the %d shards, trying each shard's candidate locations in turn; any %d of them are enough", prefix, total, needed)
+	if e.ShardFormat == shardFormatIndexed {
+		step("%sstrip the %d-byte index header of each shard and move shards found in another slot to their own", prefix, shardHeaderSize)
+	}
+	if e.ProofScheme == proofSchemeDigest {
+		step("%sdrop shards whose sha256 digest doesn't match the one recorded under the Merkle root", prefix)
+	} else {
+		step("%sdrop shards that don't match their Merkle proof", prefix)
+	}
+	step("%serasure decode with %s, rebuilding missing shards, and keep the recorded stored bytes", prefix, e.Code)
+	switch {
+	case values["cipher"] != "":
+		step("decrypt with the cipher registered as %s", values["cipher"])
+	case !storedAsIs(values):
+		step("%sdecrypt with %s, the first %d bytes being the IV", prefix, strings.SplitN(e.Cipher, ",", 2)[0], aes.BlockSize)
+	}
+	if e.Layout == layoutStreaming {
+		step("write each segment's plaintext out after the last")
+	}
+
+	if len(e.Transforms) > 0 {
+		step("trim to the transformed size of %s bytes and undo the transforms %s, last first", values["transformed_size"], strings.Join(e.Transforms, ", "))
+	}
+	step("check the result is %d bytes", e.Size)
+	if values["format"] == "zip" {
+		step("extract the zip archive into a directory (retrieve --extract-to)")
+	}
+	return steps
+}
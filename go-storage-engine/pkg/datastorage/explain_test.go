@@ -0,0 +1,79 @@
+package datastorage
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+// expectSteps fails the test unless each stage appears in steps, in order.
+func expectSteps(t *testing.T, steps []string, stages ...string) {
+	t.Helper()
+	next := 0
+	for _, step := range steps {
+		if next < len(stages) && strings.Contains(step, stages[next]) {
+			next++
+		}
+	}
+	if next < len(stages) {
+		t.Fatalf("steps don't include %q in order:\n%s", stages[next], strings.Join(steps, "\n"))
+	}
+}
+
+func TestExplainObjectListsPipeline(t *testing.T) {
+	v := newTestVault(t)
+	metadatafile := v.storeObject(t, "object.bin", randomBytes(t, 10_000))
+
+	e, err := ExplainObject(metadatafile)
+	if err != nil {
+		t.Fatalf("ExplainObject: %v", err)
+	}
+	if e.Layout != layoutInMemory || e.Code != "8+6 gf8" || e.KeySource != "master key" || e.ProofScheme != proofSchemeDigest {
+		t.Fatalf("explained layout %s, code %s, key %q, proofs %s", e.Layout, e.Code, e.KeySource, e.ProofScheme)
+	}
+	expectSteps(t, e.Steps, "master key with fingerprint "+e.KeyFingerprint, "fetch the 14 shards", "index header", "digest",
+		"erasure decode with 8+6 gf8", "decrypt with AES-CFB", "check the result is 10000 bytes")
+
+	if len(e.Sets) != 1 || len(e.Sets[0].Shards) != 14 {
+		t.Fatalf("explained %d shard sets, expected one of 14 shards", len(e.Sets))
+	}
+	set := e.Sets[0]
+	if set.StoredBytes != 10_000+16 || set.MerkleRoot == "" {
+		t.Fatalf("set holds %d bytes with root %q", set.StoredBytes, set.MerkleRoot)
+	}
+	for i, shard := range set.Shards {
+		if want := map[bool]string{true: "data", false: "parity"}[i < 8]; shard.Kind != want {
+			t.Fatalf("shard %d is %s, expected %s", i, shard.Kind, want)
+		}
+		if shard.Locations[0] != v.locations[i] || shard.Checksum == "" || shard.Digest == "" {
+			t.Fatalf("shard %d explained as %+v", i, shard)
+		}
+		// The shard on disk is the size explained
+		info, err := os.Stat(filepath.Join(v.locations[i], sharding.PlainShardName(e.DataID, i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() != int64(set.ShardSize) {
+			t.Fatalf("shard %d is %d bytes, explained as %d", i, info.Size(), set.ShardSize)
+		}
+	}
+}
+
+func TestExplainStreamedObject(t *testing.T) {
+	v := newTestVault(t)
+	v.cfg.StreamingThreshold = 1
+	metadatafile := v.storeObject(t, "object.bin", randomBytes(t, 10_000))
+
+	e, err := ExplainObject(metadatafile)
+	if err != nil {
+		t.Fatalf("ExplainObject: %v", err)
+	}
+	if e.Layout != layoutStreaming || len(e.Sets) != 1 || e.Sets[0].Label != "segment 0" {
+		t.Fatalf("explained layout %s with %d shard sets", e.Layout, len(e.Sets))
+	}
+	expectSteps(t, e.Steps, "for each of the 1 segments in order: fetch", "for each of the 1 segments in order: erasure decode",
+		"write each segment's plaintext out", "check the result")
+}
@@ -0,0 +1,103 @@
+package datastorage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/techninja8/getvault.io/pkg/metadata"
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+// generations reads the shard and proof generations of an object.
+func generations(t *testing.T, metadatafile string) (int, int) {
+	t.Helper()
+	values, err := metadata.ReadValues(metadatafile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shards, proofs, err := readGenerations(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return shards, proofs
+}
+
+// TestStaleProofsDetectedAndRefreshed heals an object, which moves its
+// shards and proofs to generation 1 together, then simulates a repair
+// that rewrites a shard and forgets its proofs. Verification must fail
+// with the generations rather than judge the shard, and refreshing the
+// proofs must bring them level again.
+func TestStaleProofsDetectedAndRefreshed(t *testing.T) {
+	v := newTestVault(t)
+	metadatafile := v.storeObject(t, "object.bin", randomBytes(t, 50_000))
+	if shards, proofs := generations(t, metadatafile); shards != 0 || proofs != 0 {
+		t.Fatalf("new object at generations %d/%d", shards, proofs)
+	}
+
+	path := v.shardFile(t, metadatafile, 2)
+	shard, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if report, err := CheckData(metadatafile, sharding.NewInMemoryShardStore(), CheckOptions{Heal: true}, v.logger); err != nil || report.Repaired != 1 {
+		t.Fatalf("healing: %+v, %v", report, err)
+	}
+	if shards, proofs := generations(t, metadatafile); shards != 1 || proofs != 1 {
+		t.Fatalf("healed object at generations %d/%d, expected 1/1", shards, proofs)
+	}
+
+	// A repair that writes the shard but not its proofs
+	if err := os.WriteFile(path, shard, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := setMetadataValue(metadatafile, shardGenerationKey, "2"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = CheckData(metadatafile, sharding.NewInMemoryShardStore(), CheckOptions{Deep: true}, v.logger)
+	if !errors.Is(err, ErrStaleProofs) || !strings.Contains(err.Error(), "proofs are from generation 1, shards are generation 2 — run verify --refresh-proofs") {
+		t.Fatalf("verifying with stale proofs: %v", err)
+	}
+
+	if _, err := RefreshProofs(context.Background(), metadatafile, sharding.NewInMemoryShardStore(), v.cfg, v.logger); err != nil {
+		t.Fatalf("RefreshProofs: %v", err)
+	}
+	if shards, proofs := generations(t, metadatafile); shards != 2 || proofs != 2 {
+		t.Fatalf("refreshed object at generations %d/%d, expected 2/2", shards, proofs)
+	}
+	if report, err := CheckData(metadatafile, sharding.NewInMemoryShardStore(), CheckOptions{Deep: true}, v.logger); err != nil || report.Health != ObjectHealthy {
+		t.Fatalf("verifying after the refresh: %+v, %v", report, err)
+	}
+}
+
+func TestBumpGeneration(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		lines      []string
+		proofs     bool
+		wantShards string
+		wantProofs string
+	}{
+		{"unrecorded", []string{"dataID: x"}, true, "1", "1"},
+		{"proofs kept", []string{"shard_generation: 3", "proof_generation: 3"}, true, "4", "4"},
+		{"proofs not redone", []string{"shard_generation: 3", "proof_generation: 3"}, false, "4", "3"},
+		{"stale proofs stay behind", []string{"shard_generation: 3", "proof_generation: 1"}, true, "4", "1"},
+	} {
+		lines, err := bumpGeneration(tc.lines, tc.proofs)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		values := topLevelValues(lines)
+		if values[shardGenerationKey] != tc.wantShards || values[proofGenerationKey] != tc.wantProofs {
+			t.Fatalf("%s: bumped to %v", tc.name, lines)
+		}
+	}
+	if _, err := bumpGeneration([]string{"shard_generation: -1"}, true); err == nil {
+		t.Fatal("bumped a negative generation")
+	}
+}
@@ -0,0 +1,112 @@
+package datastorage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+// HealthGauges summarizes the health of the vault after a verify-all run,
+// for monitoring that reads a file rather than scraping serve.
+type HealthGauges struct {
+	Objects       int
+	Degraded      int
+	Unrecoverable int
+	Failed        int // Objects whose verification failed outright
+	// MinRedundancy is the fewest good shards any verified object has
+	// beyond the data shards it needs, negative if one is unrecoverable;
+	// HasRedundancy is false when no object was verified.
+	MinRedundancy int
+	HasRedundancy bool
+	LocationsDown int // Locations scoring below sharding.HealthyScore
+	LastScrub     time.Time
+}
+
+// NewHealthGauges takes the gauges from a verify-all summary and the
+// location health records.
+func NewHealthGauges(summary *VerifyAllSummary, locations map[string]sharding.LocationHealth) HealthGauges {
+	g := HealthGauges{
+		Objects:       summary.Objects,
+		Degraded:      summary.Degraded,
+		Unrecoverable: summary.Unrecoverable,
+		Failed:        summary.Failed,
+		LastScrub:     summary.Finished,
+	}
+	for _, report := range summary.Reports {
+		if report.Error != "" {
+			continue
+		}
+		code, err := ObjectCode(report.MetadataFile)
+		if err != nil {
+			continue
+		}
+		good := 0
+		for _, shard := range report.Shards {
+			if shard.Verified {
+				good++
+			}
+		}
+		if spare := good - code.Data; !g.HasRedundancy || spare < g.MinRedundancy {
+			g.MinRedundancy, g.HasRedundancy = spare, true
+		}
+	}
+	for _, h := range locations {
+		if h.Score() < sharding.HealthyScore {
+			g.LocationsDown++
+		}
+	}
+	return g
+}
+
+// WriteTo writes the gauges in the Prometheus text exposition format.
+func (g HealthGauges) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	for _, m := range []struct {
+		name, help string
+		value      int64
+		present    bool
+	}{
+		{"vault_scrub_objects", "Objects checked by the last verify-all run.", int64(g.Objects), true},
+		{"vault_scrub_objects_degraded", "Objects missing shards but still recoverable.", int64(g.Degraded), true},
+		{"vault_scrub_objects_unrecoverable", "Objects with too few good shards to be recovered.", int64(g.Unrecoverable), true},
+		{"vault_scrub_objects_failed", "Objects whose verification failed outright.", int64(g.Failed), true},
+		{"vault_scrub_min_redundancy_shards", "Fewest good shards any object has beyond those it needs.", int64(g.MinRedundancy), g.HasRedundancy},
+		{"vault_locations_down", "Storage locations scoring as unhealthy.", int64(g.LocationsDown), true},
+		{"vault_scrub_last_timestamp_seconds", "When the last verify-all run finished, in Unix seconds.", g.LastScrub.Unix(), !g.LastScrub.IsZero()},
+	} {
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s gauge\n", m.name, m.help, m.name)
+		if m.present {
+			fmt.Fprintf(&buf, "%s %d\n", m.name, m.value)
+		}
+	}
+	n, err := w.Write(buf.Bytes())
+	return int64(n), err
+}
+
+// WriteHealthTextfile writes the gauges to path for node_exporter's
+// textfile collector, through a temporary file in the same directory and a
+// rename, so the collector never reads a half-written file.
+func WriteHealthTextfile(path string, g HealthGauges) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".health-*.prom.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to write health textfile: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := g.WriteTo(tmp); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write health textfile: %w", err)
+	}
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write health textfile: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write health textfile: %w", err)
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,141 @@
+package datastorage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/techninja8/getvault.io/pkg/metadata"
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+var metricName = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// parseTextfile checks data against the Prometheus text exposition format
+// as the textfile collector reads it, for unlabelled gauges, and returns
+// the value of every sample.
+func parseTextfile(t *testing.T, data []byte) map[string]float64 {
+	t.Helper()
+	samples := make(map[string]float64)
+	helped, typed := make(map[string]bool), make(map[string]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if comment, ok := strings.CutPrefix(text, "# "); ok {
+			kind, rest, _ := strings.Cut(comment, " ")
+			name, value, _ := strings.Cut(rest, " ")
+			if !metricName.MatchString(name) {
+				t.Fatalf("line %d: invalid metric name in %q", line, text)
+			}
+			switch kind {
+			case "HELP":
+				if helped[name] || value == "" {
+					t.Fatalf("line %d: repeated or empty HELP for %s", line, name)
+				}
+				helped[name] = true
+			case "TYPE":
+				if typed[name] || value != "gauge" {
+					t.Fatalf("line %d: repeated TYPE or %s not a gauge", line, name)
+				}
+				if _, ok := samples[name]; ok {
+					t.Fatalf("line %d: TYPE of %s after its sample", line, name)
+				}
+				typed[name] = true
+			default:
+				t.Fatalf("line %d: unknown comment %q", line, text)
+			}
+			continue
+		}
+		name, value, ok := strings.Cut(text, " ")
+		if !ok || !metricName.MatchString(name) || !typed[name] {
+			t.Fatalf("line %d: invalid sample %q", line, text)
+		}
+		if _, ok := samples[name]; ok {
+			t.Fatalf("line %d: repeated sample of %s", line, name)
+		}
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			t.Fatalf("line %d: %v", line, err)
+		}
+		samples[name] = f
+	}
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		t.Fatal("textfile doesn't end in a newline")
+	}
+	return samples
+}
+
+func TestHealthTextfileUpdatesAfterScrub(t *testing.T) {
+	v := newTestVault(t)
+	health := sharding.NewHealthTracker(v.cfg.HealthFile)
+	v.storeObject(t, "a.bin", randomBytes(t, 10_000))
+	damaged := v.storeObject(t, "b.bin", randomBytes(t, 10_000))
+	path := filepath.Join(t.TempDir(), "vault.prom")
+
+	scrub := func() map[string]float64 {
+		t.Helper()
+		summary, err := VerifyAll(context.Background(), v.cfg.MetadataDir, v.store, VerifyAllOptions{}, v.logger)
+		if err != nil {
+			t.Fatalf("VerifyAll: %v", err)
+		}
+		if err := WriteHealthTextfile(path, NewHealthGauges(summary, health.Snapshot())); err != nil {
+			t.Fatalf("WriteHealthTextfile: %v", err)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parseTextfile(t, data)
+	}
+
+	before := scrub()
+	for name, want := range map[string]float64{
+		"vault_scrub_objects":               2,
+		"vault_scrub_objects_degraded":      0,
+		"vault_scrub_objects_unrecoverable": 0,
+		"vault_scrub_min_redundancy_shards": 6,
+		"vault_locations_down":              0,
+	} {
+		if got, ok := before[name]; !ok || got != want {
+			t.Fatalf("%s = %v, expected %v", name, got, want)
+		}
+	}
+
+	// Two shards of one object go missing and a location starts failing
+	dataID, err := metadata.ReadValue(damaged, "dataID")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 2 {
+		if err := sharding.DeleteShard(v.store, dataID, i, v.locations[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for range 20 {
+		health.Record(v.locations[0], 0, os.ErrPermission)
+	}
+
+	after := scrub()
+	for name, want := range map[string]float64{
+		"vault_scrub_objects":               2,
+		"vault_scrub_objects_degraded":      1,
+		"vault_scrub_min_redundancy_shards": 4,
+		"vault_locations_down":              1,
+	} {
+		if got := after[name]; got != want {
+			t.Fatalf("after the scrub, %s = %v, expected %v", name, got, want)
+		}
+	}
+	if after["vault_scrub_last_timestamp_seconds"] < before["vault_scrub_last_timestamp_seconds"] {
+		t.Fatal("last scrub timestamp went back")
+	}
+	if entries, err := os.ReadDir(filepath.Dir(path)); err != nil || len(entries) != 1 {
+		t.Fatalf("temporary files left behind: %v, %v", entries, err)
+	}
+}
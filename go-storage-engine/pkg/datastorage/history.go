@@ -0,0 +1,125 @@
+package datastorage
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"time"
+
+	"github.com/techninja8/getvault.io/pkg/metadata"
+)
+
+// Object events recorded in an object's history.
+const (
+	EventStored      = "stored"
+	EventAppended    = "appended"
+	EventRetrieved   = "retrieved"
+	EventVerified    = "verified"
+	EventRepaired    = "repaired"
+	EventMigrated    = "migrated"
+	EventRekeyed     = "rekeyed"
+	EventDeleted     = "deleted"
+	EventLocked      = "locked"
+	EventAdopted     = "adopted"
+	EventQuarantined = "quarantined"
+	EventRestored    = "restored"
+	EventPurged      = "purged"
+	EventRefreshed   = "refreshed" // Proofs recomputed from the shards
+)
+
+// historyDir is where object histories are kept, inside the metadata
+// directory: one file per dataID, with a JSON event per line.
+const historyDir = ".history"
+
+// ObjectEvent is an entry in an object's history.
+type ObjectEvent struct {
+	Time   time.Time `json:"time"`
+	Event  string    `json:"event"`
+	Host   string    `json:"host,omitempty"`
+	User   string    `json:"user,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+	Shards []int     `json:"shards,omitempty"` // Shard indexes the event concerns
+}
+
+// recordEvent appends an event to the history of the object described by
+// metadatafile, kept next to it. The event is synced to disk, but history
+// is secondary: callers log a failure and carry on.
+func recordEvent(metadatafile, dataID string, event ObjectEvent) error {
+	if dataID == "" {
+		return errors.New("no dataID to record history for")
+	}
+	event.Time = time.Now().UTC()
+	event.Host, _ = os.Hostname()
+	if u, err := user.Current(); err == nil {
+		event.User = u.Username
+	}
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Join(filepath.Dir(metadatafile), historyDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to record history: %w", err)
+	}
+	// Appends of a single short line don't interleave, so no lock is needed
+	file, err := os.OpenFile(filepath.Join(dir, dataID+".jsonl"), os.O_CREATE|os.O_APPEND|os.O_RDWR, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to record history: %w", err)
+	}
+	// A line torn by a crash is ended first, so it doesn't take this one with it
+	if info, err := file.Stat(); err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := file.ReadAt(last, info.Size()-1); err == nil && last[0] != '\n' {
+			line = append([]byte{'\n'}, line...)
+		}
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to record history: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to record history: %w", err)
+	}
+	return file.Close()
+}
+
+// recordObjectEvent is recordEvent for callers that only have the
+// metadata file.
+func recordObjectEvent(metadatafile string, event ObjectEvent) error {
+	dataID, err := metadata.ReadValue(metadatafile, "dataID")
+	if err != nil {
+		return fmt.Errorf("failed to record history: %w", err)
+	}
+	return recordEvent(metadatafile, dataID, event)
+}
+
+// ReadHistory returns the recorded events of an object, oldest first. The
+// history of an object compacted out of the catalog is read from the
+// archive. An object without history has none.
+func ReadHistory(metadataDir, dataID string) ([]ObjectEvent, error) {
+	file, err := os.Open(filepath.Join(metadataDir, historyDir, dataID+".jsonl"))
+	if errors.Is(err, os.ErrNotExist) {
+		return readArchivedHistory(metadataDir, dataID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var events []ObjectEvent
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var event ObjectEvent
+		// A line torn by a crash mid-write is skipped
+		if err := json.Unmarshal(scanner.Bytes(), &event); err == nil {
+			events = append(events, event)
+		}
+	}
+	return events, scanner.Err()
+}
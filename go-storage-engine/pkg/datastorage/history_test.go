@@ -0,0 +1,119 @@
+package datastorage
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+// TestHistoryRecordsOperations runs an object through a scripted sequence
+// of operations and checks its history lists each, in order, with the
+// detail and shards it concerned and the host it ran on.
+func TestHistoryRecordsOperations(t *testing.T) {
+	v := newTestVault(t)
+	metadatafile := v.storeObject(t, "object.bin", randomBytes(t, 10_000))
+	dataID, err := MetadataFileReader(metadatafile, "dataID")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := RecordAccess(metadatafile, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CheckData(metadatafile, sharding.NewInMemoryShardStore(), CheckOptions{}, v.logger); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(v.shardFile(t, metadatafile, 3)); err != nil {
+		t.Fatal(err)
+	}
+	for _, opts := range []CheckOptions{{}, {Heal: true}} {
+		if _, err := CheckData(metadatafile, sharding.NewInMemoryShardStore(), opts, v.logger); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := MarkDeleted(metadatafile, time.Now(), v.logger); err != nil {
+		t.Fatal(err)
+	}
+
+	history, err := ReadHistory(v.cfg.MetadataDir, dataID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ObjectEvent{
+		{Event: EventStored, Detail: "10000 bytes"},
+		{Event: EventRetrieved},
+		{Event: EventVerified, Detail: string(ObjectHealthy)},
+		{Event: EventVerified, Detail: string(ObjectDegraded)},
+		{Event: EventVerified, Detail: string(ObjectHealthy)}, // As healed
+		{Event: EventRepaired, Shards: []int{3}},
+		{Event: EventDeleted},
+	}
+	if len(history) != len(want) {
+		t.Fatalf("history has %d events, expected %d: %+v", len(history), len(want), history)
+	}
+	host, _ := os.Hostname()
+	for i, event := range history {
+		if event.Event != want[i].Event || event.Detail != want[i].Detail || !slices.Equal(event.Shards, want[i].Shards) {
+			t.Fatalf("event %d is %+v, expected %+v", i, event, want[i])
+		}
+		if event.Host != host {
+			t.Fatalf("event %d recorded on host %q, expected %q", i, event.Host, host)
+		}
+		if i > 0 && event.Time.Before(history[i-1].Time) {
+			t.Fatalf("event %d at %s is before event %d at %s", i, event.Time, i-1, history[i-1].Time)
+		}
+	}
+
+	if history, err := ReadHistory(v.cfg.MetadataDir, "unknown"); err != nil || len(history) != 0 {
+		t.Fatalf("history of an unknown object: %+v, %v", history, err)
+	}
+}
+
+// TestHistoryIsBestEffort makes the history directory impossible to
+// create and checks that the operations recording history still succeed.
+func TestHistoryIsBestEffort(t *testing.T) {
+	v := newTestVault(t)
+	if err := os.MkdirAll(v.cfg.MetadataDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(v.cfg.MetadataDir, historyDir), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	metadatafile := v.storeObject(t, "object.bin", randomBytes(t, 10_000))
+	if report, err := CheckData(metadatafile, v.store, CheckOptions{}, v.logger); err != nil || report.Health != ObjectHealthy {
+		t.Fatalf("verifying without history: %v", err)
+	}
+	if _, err := MarkDeleted(metadatafile, time.Now(), v.logger); err != nil {
+		t.Fatalf("deleting without history: %v", err)
+	}
+}
+
+// TestHistoryTornLineIsSkipped appends half an event, as a crash mid-write
+// would leave, and checks that the events on either side of it are read.
+func TestHistoryTornLineIsSkipped(t *testing.T) {
+	v := newTestVault(t)
+	metadatafile := v.storeObject(t, "object.bin", randomBytes(t, 1000))
+	dataID, err := MetadataFileReader(metadatafile, "dataID")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.OpenFile(filepath.Join(v.cfg.MetadataDir, historyDir, dataID+".jsonl"), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"time":"2026-`)
+	file.Close()
+	if err := RecordAccess(metadatafile, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	history, err := ReadHistory(v.cfg.MetadataDir, dataID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 || history[0].Event != EventStored || history[1].Event != EventRetrieved {
+		t.Fatalf("history read as %+v", history)
+	}
+}
@@ -0,0 +1,86 @@
+package datastorage
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/techninja8/getvault.io/pkg/metadata"
+)
+
+// MetadataIndex maps dataIDs to the metadata files in a directory, so an
+// object can be looked up without reading every metadata file. The
+// directory is read once up front, and again only when a lookup misses
+// and the directory has changed since.
+type MetadataIndex struct {
+	dir string
+
+	mu      sync.Mutex
+	files   map[string]string
+	modTime time.Time
+}
+
+// NewMetadataIndex indexes the metadata files in dir.
+func NewMetadataIndex(dir string) (*MetadataIndex, error) {
+	index := &MetadataIndex{dir: dir}
+	if err := index.rebuild(); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// Lookup returns the metadata file of the object with dataID, or
+// ErrObjectNotFound.
+func (x *MetadataIndex) Lookup(dataID string) (string, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if file, ok := x.files[dataID]; ok {
+		if _, err := os.Stat(file); err == nil {
+			return file, nil
+		}
+	} else if !x.changed() {
+		return "", fmt.Errorf("%w: %s", ErrObjectNotFound, dataID)
+	}
+
+	// Deleted, renamed, or stored since the directory was read
+	if err := x.rebuild(); err != nil {
+		return "", err
+	}
+	if file, ok := x.files[dataID]; ok {
+		return file, nil
+	}
+	return "", fmt.Errorf("%w: %s", ErrObjectNotFound, dataID)
+}
+
+// changed reports whether the directory was modified since it was read.
+func (x *MetadataIndex) changed() bool {
+	info, err := os.Stat(x.dir)
+	return err != nil || !info.ModTime().Equal(x.modTime)
+}
+
+// rebuild rereads the directory. Its modification time is taken first, so
+// files added while it is read make the next miss read it again.
+func (x *MetadataIndex) rebuild() error {
+	var modTime time.Time
+	if info, err := os.Stat(x.dir); err == nil {
+		modTime = info.ModTime()
+	}
+	files, err := listMetadataFiles(x.dir)
+	if err != nil {
+		return err
+	}
+	index := make(map[string]string, len(files))
+	for _, file := range files {
+		id, err := metadata.ReadValue(file, "dataID")
+		if err != nil {
+			continue
+		}
+		// Like FindMetadataFile, the first file by name wins
+		if _, ok := index[id]; !ok {
+			index[id] = file
+		}
+	}
+	x.files, x.modTime = index, modTime
+	return nil
+}
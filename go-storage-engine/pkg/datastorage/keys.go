@@ -0,0 +1,247 @@
+package datastorage
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/techninja8/getvault.io/pkg/config"
+	"github.com/techninja8/getvault.io/pkg/encryption"
+	"github.com/techninja8/getvault.io/pkg/metadata"
+)
+
+// envelopeEncryption marks objects whose data is encrypted with a random
+// per-object key. The key is wrapped to the master key and to each recipient.
+const envelopeEncryption = "envelope"
+
+// convergentEncryption marks objects encrypted deterministically under a
+// key derived from their data, wrapped like an envelope key. Everyone
+// storing the same data writes the same shards, whatever their master key;
+// see encryption.ConvergentKey for what that gives away.
+const convergentEncryption = "convergent"
+
+// errConvergentStreaming is returned when a convergent store would stream:
+// the key is derived from the whole object before any of it is encrypted.
+var errConvergentStreaming = errors.New("convergent encryption derives the key from the whole object, so convergent objects can't be streamed; raise STREAMING_THRESHOLD or MAX_SHARD_SIZE")
+
+// Adopted objects whose data vault didn't encrypt record how it is stored
+// instead: as plaintext, or encrypted by the tool that wrote the shards.
+// Either way retrieval hands back the decoded data as it is.
+const (
+	noEncryption       = "none"
+	externalEncryption = "external"
+)
+
+// keyFingerprintLabel is what a master key's fingerprint is computed over.
+const keyFingerprintLabel = "vault key fingerprint"
+
+// ErrNoMatchingKey is returned when neither ENCRYPTION_KEY nor any key in
+// the keyring has the fingerprint recorded for an object.
+var ErrNoMatchingKey = errors.New("no configured key matches the object's key fingerprint")
+
+// KeyFingerprint returns a non-sensitive identifier of a master key: the
+// first 8 bytes of the HMAC-SHA256 of a fixed label under the key, in hex.
+// Objects record the fingerprint of the key they were stored under, so the
+// right key can be picked from a keyring when retrieving them.
+func KeyFingerprint(key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(keyFingerprintLabel))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// keyring returns the master keys objects can be retrieved with:
+// ENCRYPTION_KEY, when set, followed by the keys in cfg.KeyringFile, one
+// hex key per line. Blank lines and lines starting with # are skipped.
+func keyring(cfg *config.Config) ([][]byte, error) {
+	var keys [][]byte
+	key, err := GetEncryptionKey(cfg)
+	if err == nil {
+		keys = append(keys, key)
+	} else if !errors.Is(err, errMissingKey) {
+		return nil, err
+	}
+	if cfg.KeyringFile == "" {
+		if len(keys) == 0 {
+			return nil, errMissingKey
+		}
+		return keys, nil
+	}
+
+	contents, err := os.ReadFile(cfg.KeyringFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keyring: %w", err)
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		key, err := GetEncryptionKey(&config.Config{EncryptionKey: text})
+		if err != nil {
+			return nil, fmt.Errorf("keyring %s: line %d: %w", cfg.KeyringFile, line, err)
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, errMissingKey
+	}
+	return keys, scanner.Err()
+}
+
+// objectMasterKey returns the master key an object was stored under: the
+// key in the keyring with the object's recorded fingerprint. Objects stored
+// before fingerprints were recorded use ENCRYPTION_KEY.
+func objectMasterKey(metadatafile string, cfg *config.Config) ([]byte, error) {
+	fingerprint, err := metadata.ReadValue(metadatafile, "key_fingerprint")
+	if err != nil {
+		return GetEncryptionKey(cfg)
+	}
+	keys, err := keyring(cfg)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		if KeyFingerprint(key) == fingerprint {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrNoMatchingKey, fingerprint)
+}
+
+// newObjectKey chooses the key an object is encrypted with. Without
+// recipients the master key is used directly, as before. With recipients a
+// fresh data key is generated and the returned metadata lines carry its
+// master-key wrap and one stanza per recipient. Either way the lines
+// start with the master key's fingerprint.
+func newObjectKey(cfg *config.Config, masterKey []byte) ([]byte, string, error) {
+	if len(cfg.Recipients) == 0 {
+		return masterKey, fmt.Sprintf("key_fingerprint: %s\n", KeyFingerprint(masterKey)), nil
+	}
+	dataKey, err := encryption.NewDataKey()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to generate data key: %w", err)
+	}
+	return wrapObjectKey(cfg, masterKey, dataKey, envelopeEncryption)
+}
+
+// newConvergentKey is newObjectKey for convergent encryption: the data key
+// is derived from data, and wrapped to the master key and recipients.
+func newConvergentKey(cfg *config.Config, masterKey, data []byte) ([]byte, string, error) {
+	return wrapObjectKey(cfg, masterKey, encryption.ConvergentKey(data), convergentEncryption)
+}
+
+// wrapObjectKey returns the metadata lines of a data key encrypted under
+// mode, wrapped to the master key and each recipient.
+func wrapObjectKey(cfg *config.Config, masterKey, dataKey []byte, mode string) ([]byte, string, error) {
+	wrapped, err := encryption.WrapKey(dataKey, masterKey)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to wrap data key: %w", err)
+	}
+
+	lines := fmt.Sprintf("key_fingerprint: %s\n", KeyFingerprint(masterKey))
+	lines += fmt.Sprintf("encryption: %s\nkey_wrap: %s\nrecipients: %d\n", mode, wrapped, len(cfg.Recipients))
+	for i, r := range cfg.Recipients {
+		recipient, err := encryption.ParseRecipient(r)
+		if err != nil {
+			return nil, "", fmt.Errorf("recipient %q: %w", r, err)
+		}
+		stanza, err := encryption.WrapKeyForRecipient(dataKey, recipient)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to wrap data key for %q: %w", r, err)
+		}
+		lines += fmt.Sprintf("recipient_%d: %s\n", i, stanza)
+	}
+	return dataKey, lines, nil
+}
+
+// storedAsIs reports whether an object's data is stored without vault
+// encryption and so is retrieved without decrypting it.
+func storedAsIs(values map[string]string) bool {
+	mode := values["encryption"]
+	return mode == noEncryption || mode == externalEncryption
+}
+
+// wrappedKey reports whether objects encrypted under mode have a data key
+// of their own, wrapped to their master key and recipients.
+func wrappedKey(mode string) bool {
+	return mode == envelopeEncryption || mode == convergentEncryption
+}
+
+// objectKey returns the key an object was encrypted with. Envelope and
+// convergent objects' keys are unwrapped with their master key when it is
+// configured, and
+// otherwise with the identities in cfg.IdentityFile. In verify-only mode
+// neither is read.
+func objectKey(metadatafile string, cfg *config.Config, logger *zap.Logger) ([]byte, error) {
+	if cfg.VerifyOnly {
+		return nil, ErrVerifyOnly
+	}
+	mode, err := metadata.ReadValue(metadatafile, "encryption")
+	if err != nil || !wrappedKey(mode) {
+		return objectMasterKey(metadatafile, cfg)
+	}
+
+	masterKey, masterErr := objectMasterKey(metadatafile, cfg)
+	if masterErr == nil {
+		wrapped, err := metadata.ReadValue(metadatafile, "key_wrap")
+		if err != nil {
+			return nil, fmt.Errorf("error reading metadata file: %w", err)
+		}
+		dataKey, err := encryption.UnwrapKey(wrapped, masterKey)
+		if err == nil {
+			return dataKey, nil
+		}
+		masterErr = fmt.Errorf("failed to unwrap data key with the master key: %w", err)
+		if cfg.IdentityFile == "" {
+			return nil, masterErr
+		}
+		logger.Warn("Master key did not unwrap the data key, trying identity file", zap.Error(err))
+	}
+	if cfg.IdentityFile == "" {
+		return nil, masterErr
+	}
+
+	contents, err := os.ReadFile(cfg.IdentityFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read identity file: %w", err)
+	}
+	identities, err := encryption.ParseIdentityFile(string(contents))
+	if err != nil {
+		return nil, fmt.Errorf("identity file %s: %w", cfg.IdentityFile, err)
+	}
+
+	value, err := metadata.ReadValue(metadatafile, "recipients")
+	if err != nil {
+		return nil, fmt.Errorf("error reading metadata file: %w", err)
+	}
+	count, err := strconv.Atoi(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid recipient count in metadata: %q", value)
+	}
+	for i := 0; i < count; i++ {
+		stanza, err := metadata.ReadValue(metadatafile, fmt.Sprintf("recipient_%d", i))
+		if err != nil {
+			return nil, fmt.Errorf("error reading metadata file: %w", err)
+		}
+		for _, identity := range identities {
+			dataKey, err := encryption.UnwrapKeyWithIdentity(stanza, identity)
+			if err == nil {
+				return dataKey, nil
+			}
+			if !errors.Is(err, encryption.ErrNoMatchingIdentity) {
+				return nil, fmt.Errorf("recipient_%d: %w", i, err)
+			}
+		}
+	}
+	return nil, encryption.ErrNoMatchingIdentity
+}
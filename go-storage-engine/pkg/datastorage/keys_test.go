@@ -0,0 +1,146 @@
+package datastorage
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/techninja8/getvault.io/pkg/encryption"
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+// identityFile writes a new identity to an identity file and returns the
+// file and the identity's recipient.
+func identityFile(t *testing.T) (string, string) {
+	t.Helper()
+	identity, err := encryption.GenerateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "identity.txt")
+	if err := os.WriteFile(file, []byte("# test identity\n"+encryption.FormatIdentity(identity)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file, encryption.FormatRecipient(identity.PublicKey())
+}
+
+// TestRetrieveWithIdentity stores an object wrapped to a recipient and
+// retrieves it without the master key, first with the recipient's
+// identity and then with an unrelated one, which must be refused.
+func TestRetrieveWithIdentity(t *testing.T) {
+	v := newTestVault(t)
+	identity, recipient := identityFile(t)
+	unrelated, _ := identityFile(t)
+	v.cfg.Recipients = []string{recipient}
+	data := randomBytes(t, 100_000)
+	metadatafile := v.storeObject(t, "object.bin", data)
+	if mode, err := MetadataFileReader(metadatafile, "encryption"); err != nil || mode != envelopeEncryption {
+		t.Fatalf("object stored with encryption %q, %v", mode, err)
+	}
+
+	// Only the identity can unwrap the data key now
+	v.cfg.EncryptionKey = ""
+	v.cfg.IdentityFile = identity
+	got, err := RetrieveData(metadatafile, sharding.NewInMemoryShardStore(), v.cfg, v.logger)
+	if err != nil {
+		t.Fatalf("RetrieveData with the recipient's identity: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("retrieved data differs from the stored data")
+	}
+
+	v.cfg.IdentityFile = unrelated
+	if _, err := RetrieveData(metadatafile, sharding.NewInMemoryShardStore(), v.cfg, v.logger); !errors.Is(err, encryption.ErrNoMatchingIdentity) {
+		t.Fatalf("RetrieveData with an unrelated identity: %v", err)
+	}
+	v.cfg.IdentityFile = ""
+	if _, err := RetrieveData(metadatafile, sharding.NewInMemoryShardStore(), v.cfg, v.logger); err == nil {
+		t.Fatal("retrieved without the master key or an identity")
+	}
+}
+
+// TestRetrieveRecipientObjectWithMasterKey checks that wrapping a data key
+// to recipients leaves the object retrievable with the master key alone.
+func TestRetrieveRecipientObjectWithMasterKey(t *testing.T) {
+	v := newTestVault(t)
+	_, first := identityFile(t)
+	_, second := identityFile(t)
+	v.cfg.Recipients = []string{first, second}
+	data := randomBytes(t, 100_000)
+	metadatafile := v.storeObject(t, "object.bin", data)
+	if count, err := MetadataFileReader(metadatafile, "recipients"); err != nil || count != "2" {
+		t.Fatalf("object records %q recipients, %v", count, err)
+	}
+
+	got, err := RetrieveData(metadatafile, sharding.NewInMemoryShardStore(), v.cfg, v.logger)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("RetrieveData with the master key: %v", err)
+	}
+}
+
+func TestStoreRefusesInvalidRecipient(t *testing.T) {
+	v := newTestVault(t)
+	v.cfg.Recipients = []string{"vault1-not-a-recipient"}
+	if _, _, err := StoreData(randomBytes(t, 1000), v.store, v.cfg, v.locations, v.logger, "object.bin"); err == nil {
+		t.Fatal("stored an object wrapped to an invalid recipient")
+	}
+}
+
+// TestRetrieveFromKeyring stores an object under each of two master keys
+// and retrieves both with one of the keys as ENCRYPTION_KEY and the other
+// in the keyring. Without the keyring the second object's fingerprint
+// matches no key, and retrieval says so rather than decrypting with the
+// wrong one.
+func TestRetrieveFromKeyring(t *testing.T) {
+	v := newTestVault(t)
+	second, err := GenerateEncryptionKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{v.cfg.EncryptionKey, second}
+	metadatafiles := make([]string, len(keys))
+	objects := make([][]byte, len(keys))
+	fingerprints := make([]string, len(keys))
+	for i, key := range keys {
+		v.cfg.EncryptionKey = key
+		objects[i] = randomBytes(t, 100_000)
+		metadatafiles[i] = v.storeObject(t, fmt.Sprintf("object%d.bin", i), objects[i])
+		decoded, err := hex.DecodeString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fingerprints[i] = KeyFingerprint(decoded)
+		if recorded, err := MetadataFileReader(metadatafiles[i], "key_fingerprint"); err != nil || recorded != fingerprints[i] {
+			t.Fatalf("object stored under key %d records fingerprint %q, %v", i, recorded, err)
+		}
+	}
+	if fingerprints[0] == fingerprints[1] {
+		t.Fatal("two keys share a fingerprint")
+	}
+
+	v.cfg.EncryptionKey = keys[0]
+	v.cfg.KeyringFile = filepath.Join(t.TempDir(), "keyring")
+	if err := os.WriteFile(v.cfg.KeyringFile, []byte("# retired tenant key\n\n"+keys[1]+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for i, metadatafile := range metadatafiles {
+		got, err := RetrieveData(metadatafile, sharding.NewInMemoryShardStore(), v.cfg, v.logger)
+		if err != nil || !bytes.Equal(got, objects[i]) {
+			t.Fatalf("object stored under key %d: RetrieveData returned %d bytes, %v", i, len(got), err)
+		}
+	}
+
+	v.cfg.KeyringFile = ""
+	if got, err := RetrieveData(metadatafiles[0], sharding.NewInMemoryShardStore(), v.cfg, v.logger); err != nil || !bytes.Equal(got, objects[0]) {
+		t.Fatalf("object stored under ENCRYPTION_KEY without a keyring: %v", err)
+	}
+	_, err = RetrieveData(metadatafiles[1], sharding.NewInMemoryShardStore(), v.cfg, v.logger)
+	if !errors.Is(err, ErrNoMatchingKey) || !strings.Contains(err.Error(), fingerprints[1]) {
+		t.Fatalf("object stored under a key missing from the keyring: %v", err)
+	}
+}
@@ -0,0 +1,188 @@
+package datastorage
+
+import (
+	"crypto/aes"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/techninja8/getvault.io/pkg/config"
+	"github.com/techninja8/getvault.io/pkg/erasurecoding"
+	"github.com/techninja8/getvault.io/pkg/metadata"
+)
+
+// Metadata keys recording an object's shard counts.
+const (
+	dataShardsKey   = "data_shards"
+	parityShardsKey = "parity_shards"
+)
+
+// Reasons an object is streamed, recorded as its layout_reason.
+const (
+	ReasonStreamingThreshold = "streaming-threshold" // Larger than cfg.StreamingThreshold
+	ReasonUnknownSize        = "unknown-size"        // Size not known up front, as with a pipe
+	ReasonMaxShardSize       = "max-shard-size"      // Shards would exceed cfg.MaxShardSize
+	ReasonChunking           = "chunking"            // Larger than cfg.ChunkSize, so cut into chunks for dedup
+)
+
+// ErrMaxShardSizeTooSmall is returned when MAX_SHARD_SIZE leaves no room
+// for any data in a shard.
+var ErrMaxShardSizeTooSmall = errors.New("MAX_SHARD_SIZE is too small to hold any data")
+
+// errChunkingField is returned when chunking is configured with shards
+// coded other than with the default code. Chunks are shared by their
+// cipher text's hash, which doesn't tell codes apart, so one object's
+// 8+6 gf8 chunk could be taken for another's gf16 or 10+4 one.
+var errChunkingField = errors.New("CHUNK_SIZE can't be used with ERASURE_FIELD gf16, DATA_SHARDS or PARITY_SHARDS")
+
+// LayoutChoice is how an object is stored: the layout, why it was picked
+// when it isn't the default, the erasure code of its shards, and for
+// streamed objects the segment size. Streamed objects with a ChunkSize
+// are cut into content-defined chunks of about that size instead, none
+// larger than the segment size.
+type LayoutChoice struct {
+	Layout      string
+	Reason      string
+	Code        erasurecoding.Code
+	SegmentSize int64
+	ChunkSize   int64
+}
+
+// ChooseLayout picks the layout for an object of size bytes, or of unknown
+// size if negative. Objects are stored in memory unless they are larger
+// than cfg.StreamingThreshold or would be cut into shards larger than
+// cfg.MaxShardSize, in which case they are streamed in segments small
+// enough to keep every shard under the cap. With cfg.ChunkSize set,
+// objects larger than a chunk are streamed too, and streamed objects are
+// chunked. Shards are coded with the code ConfiguredCode returns.
+func ChooseLayout(size int64, cfg *config.Config) (LayoutChoice, error) {
+	code, err := ConfiguredCode(cfg)
+	if err != nil {
+		return LayoutChoice{}, err
+	}
+	segmentSize, err := streamingSegmentSize(cfg, code)
+	if err != nil {
+		return LayoutChoice{}, err
+	}
+	streamed := LayoutChoice{Layout: layoutStreaming, Code: code, SegmentSize: segmentSize}
+	if cfg.ChunkSize > 0 {
+		if code.Data != erasurecoding.DataShards || code.Parity != erasurecoding.ParityShards || code.Field != erasurecoding.FieldGF8 {
+			return LayoutChoice{}, errChunkingField
+		}
+		if cfg.ChunkSize < minChunkSize || cfg.ChunkSize > segmentSize {
+			return LayoutChoice{}, fmt.Errorf("CHUNK_SIZE must be between %d and %d bytes, got %d", minChunkSize, segmentSize, cfg.ChunkSize)
+		}
+		streamed.ChunkSize = cfg.ChunkSize
+	}
+	switch {
+	case size < 0:
+		streamed.Reason = ReasonUnknownSize
+	case cfg.StreamingThreshold > 0 && size > cfg.StreamingThreshold:
+		streamed.Reason = ReasonStreamingThreshold
+	case cfg.MaxShardSize > 0 && storedShardSize(size, code) > cfg.MaxShardSize:
+		streamed.Reason = ReasonMaxShardSize
+	case cfg.ChunkSize > 0 && size > cfg.ChunkSize:
+		streamed.Reason = ReasonChunking
+	default:
+		return LayoutChoice{Layout: layoutInMemory, Code: code}, nil
+	}
+	return streamed, nil
+}
+
+// streamingSegmentSize returns the plaintext segment size for streamed
+// objects coded with code: streamSegmentSize, or less if that would make
+// shards larger than cfg.MaxShardSize.
+func streamingSegmentSize(cfg *config.Config, code erasurecoding.Code) (int64, error) {
+	if cfg.MaxShardSize <= 0 {
+		return streamSegmentSize, nil
+	}
+	// Each segment gains an IV when encrypted and each shard an index
+	// header, and gf16 shards are padded to a multiple of 64 bytes
+	shardData := cfg.MaxShardSize - shardHeaderSize
+	if code.Field == erasurecoding.FieldGF16 {
+		shardData = shardData / 64 * 64
+	}
+	limit := shardData*int64(code.Data) - aes.BlockSize
+	if limit <= 0 {
+		return 0, fmt.Errorf("%w: %d bytes", ErrMaxShardSizeTooSmall, cfg.MaxShardSize)
+	}
+	return min(limit, streamSegmentSize), nil
+}
+
+// storedShardSize returns the size of every shard file written when size
+// bytes of plaintext are stored in one piece, coded with code.
+func storedShardSize(size int64, code erasurecoding.Code) int64 {
+	dataShards := int64(code.Data)
+	shardData := (size + aes.BlockSize + dataShards - 1) / dataShards
+	if code.Field == erasurecoding.FieldGF16 {
+		shardData = (shardData + 63) / 64 * 64
+	}
+	return shardData + shardHeaderSize
+}
+
+// ConfiguredCode returns the erasure code new objects are stored with:
+// cfg.DataShards and cfg.ParityShards over cfg.ErasureField, verifying
+// the parity it encodes with cfg.VerifyOnEncode. A config setting neither
+// shard count gets the default counts.
+func ConfiguredCode(cfg *config.Config) (erasurecoding.Code, error) {
+	field, err := erasurecoding.ParseField(cfg.ErasureField)
+	if err != nil {
+		return erasurecoding.Code{}, err
+	}
+	data, parity := cfg.DataShards, cfg.ParityShards
+	if data == 0 && parity == 0 {
+		data, parity = erasurecoding.DataShards, erasurecoding.ParityShards
+	}
+	code, err := erasurecoding.NewCode(data, parity, field)
+	if err != nil {
+		return erasurecoding.Code{}, fmt.Errorf("invalid DATA_SHARDS, PARITY_SHARDS or ERASURE_FIELD: %w", err)
+	}
+	code.VerifyOnEncode = cfg.VerifyOnEncode
+	return code, nil
+}
+
+// readCode returns the erasure code an object's shards are coded with.
+// Objects without data_shards and parity_shards lines have the default
+// counts, and those without an erasure_field line are coded over GF(2^8).
+func readCode(values map[string]string) (erasurecoding.Code, error) {
+	field, err := erasurecoding.ParseField(values["erasure_field"])
+	if err != nil {
+		return erasurecoding.Code{}, err
+	}
+	if field == erasurecoding.FieldAuto {
+		field = erasurecoding.FieldGF8
+	}
+	data, parity := erasurecoding.DataShards, erasurecoding.ParityShards
+	if values[dataShardsKey] != "" || values[parityShardsKey] != "" {
+		d, errD := strconv.Atoi(values[dataShardsKey])
+		p, errP := strconv.Atoi(values[parityShardsKey])
+		if errD != nil || errP != nil {
+			return erasurecoding.Code{}, fmt.Errorf("invalid shard counts in metadata: %q data and %q parity", values[dataShardsKey], values[parityShardsKey])
+		}
+		data, parity = d, p
+	}
+	return erasurecoding.NewCode(data, parity, field)
+}
+
+// ObjectCode returns the erasure code of the object a metadata file
+// describes.
+func ObjectCode(metadatafile string) (erasurecoding.Code, error) {
+	values, err := metadata.ReadValues(metadatafile)
+	if err != nil {
+		return erasurecoding.Code{}, fmt.Errorf("error reading metadata file: %w", err)
+	}
+	return readCode(values)
+}
+
+// metadataCodeLines returns the metadata lines recording code, leaving out
+// what readCode assumes when they are missing.
+func metadataCodeLines(code erasurecoding.Code) string {
+	var lines string
+	if code.Data != erasurecoding.DataShards || code.Parity != erasurecoding.ParityShards {
+		lines += fmt.Sprintf("%s: %d\n%s: %d\n", dataShardsKey, code.Data, parityShardsKey, code.Parity)
+	}
+	if code.Field == erasurecoding.FieldGF16 {
+		lines += fmt.Sprintf("erasure_field: %s\n", code.Field)
+	}
+	return lines
+}
@@ -0,0 +1,141 @@
+package datastorage
+
+import (
+	"bytes"
+	"crypto/aes"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/techninja8/getvault.io/pkg/erasurecoding"
+	"github.com/techninja8/getvault.io/pkg/metadata"
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+func TestChooseLayoutThreshold(t *testing.T) {
+	v := newTestVault(t)
+	for _, tc := range []struct {
+		threshold, size int64
+		layout, reason  string
+	}{
+		{10_000, 10_000, layoutInMemory, ""},
+		{10_000, 10_001, layoutStreaming, ReasonStreamingThreshold},
+		{10_000, -1, layoutStreaming, ReasonUnknownSize},
+		{0, 1 << 40, layoutInMemory, ""}, // 0 disables streaming
+	} {
+		v.cfg.StreamingThreshold = tc.threshold
+		choice, err := ChooseLayout(tc.size, v.cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if choice.Layout != tc.layout || choice.Reason != tc.reason {
+			t.Fatalf("threshold %d, size %d: chose %s (%q), expected %s (%q)", tc.threshold, tc.size, choice.Layout, choice.Reason, tc.layout, tc.reason)
+		}
+	}
+}
+
+// TestStoreSwitchesLayoutAtThreshold stores an object at the streaming
+// threshold and one a byte over through the same entry points. The first
+// is stored in memory and the second streamed, each records the layout it
+// was stored with, and both read back through RetrieveData and RetrieveTo.
+func TestStoreSwitchesLayoutAtThreshold(t *testing.T) {
+	const threshold = 10_000
+	v := newTestVault(t)
+	v.cfg.StreamingThreshold = threshold
+	for _, tc := range []struct {
+		size           int
+		layout, reason string
+	}{
+		{threshold, layoutInMemory, ""},
+		{threshold + 1, layoutStreaming, ReasonStreamingThreshold},
+	} {
+		data := randomBytes(t, tc.size)
+		_, fromReader, err := StoreReader(bytes.NewReader(data), int64(tc.size), v.store, v.cfg, v.locations, v.logger, "reader.bin")
+		if err != nil {
+			t.Fatalf("StoreReader of %d bytes: %v", tc.size, err)
+		}
+		for _, metadatafile := range []string{v.storeObject(t, "data.bin", data), fromReader} {
+			values, err := metadata.ReadValues(metadatafile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if values["layout"] != tc.layout || values["layout_reason"] != tc.reason {
+				t.Fatalf("%d bytes recorded layout %q (%q), expected %q (%q)", tc.size, values["layout"], values["layout_reason"], tc.layout, tc.reason)
+			}
+
+			got, err := RetrieveData(metadatafile, sharding.NewInMemoryShardStore(), v.cfg, v.logger)
+			if err != nil || !bytes.Equal(got, data) {
+				t.Fatalf("%d bytes stored %s: RetrieveData returned %d bytes, %v", tc.size, tc.layout, len(got), err)
+			}
+			var out bytes.Buffer
+			if _, err := RetrieveTo(metadatafile, &out, sharding.NewInMemoryShardStore(), v.cfg, v.logger); err != nil || !bytes.Equal(out.Bytes(), data) {
+				t.Fatalf("%d bytes stored %s: RetrieveTo wrote %d bytes, %v", tc.size, tc.layout, out.Len(), err)
+			}
+		}
+	}
+
+	// The recorded layout, not the threshold, picks the retrieval path
+	small := v.storeObject(t, "small.bin", randomBytes(t, 1000))
+	v.cfg.StreamingThreshold = 1
+	if _, err := RetrieveData(small, v.store, v.cfg, v.logger); err != nil {
+		t.Fatalf("retrieving an in-memory object after lowering the threshold: %v", err)
+	}
+}
+
+// TestMaxShardSizeSwitchesLayout stores objects straddling the largest
+// size whose shards fit under MAX_SHARD_SIZE in one piece. That size is
+// stored in memory; a byte more is streamed in segments, recording why,
+// and either way every shard file stays under the cap and reads back.
+func TestMaxShardSizeSwitchesLayout(t *testing.T) {
+	const maxShardSize = 4096
+	v := newTestVault(t)
+	v.cfg.MaxShardSize = maxShardSize
+	largest := erasurecoding.DataShards*(maxShardSize-shardHeaderSize) - aes.BlockSize
+	if storedShardSize(int64(largest), erasurecoding.DefaultCode()) != maxShardSize {
+		t.Fatalf("%d bytes would be stored in shards of %d bytes", largest, storedShardSize(int64(largest), erasurecoding.DefaultCode()))
+	}
+	for _, tc := range []struct {
+		size           int
+		layout, reason string
+	}{
+		{largest, layoutInMemory, ""},
+		{largest + 1, layoutStreaming, ReasonMaxShardSize},
+		{10 * largest, layoutStreaming, ReasonMaxShardSize},
+	} {
+		data := randomBytes(t, tc.size)
+		metadatafile := v.storeObject(t, fmt.Sprintf("object-%d.bin", tc.size), data)
+		values, err := metadata.ReadValues(metadatafile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if values["layout"] != tc.layout || values["layout_reason"] != tc.reason {
+			t.Fatalf("%d bytes recorded layout %q (%q), expected %q (%q)", tc.size, values["layout"], values["layout_reason"], tc.layout, tc.reason)
+		}
+		got, err := RetrieveData(metadatafile, sharding.NewInMemoryShardStore(), v.cfg, v.logger)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("%d bytes: RetrieveData returned %d bytes, %v", tc.size, len(got), err)
+		}
+	}
+
+	for _, location := range v.locations {
+		entries, err := os.ReadDir(location)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range entries {
+			info, err := entry.Info()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Size() > maxShardSize {
+				t.Fatalf("%s is %d bytes, over the %d cap", entry.Name(), info.Size(), maxShardSize)
+			}
+		}
+	}
+
+	v.cfg.MaxShardSize = shardHeaderSize + 1
+	if _, err := ChooseLayout(1000, v.cfg); !errors.Is(err, ErrMaxShardSizeTooSmall) {
+		t.Fatalf("ChooseLayout with a cap holding a byte a shard: %v", err)
+	}
+}
@@ -0,0 +1,104 @@
+package datastorage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sort"
+
+	"go.uber.org/zap"
+
+	"github.com/techninja8/getvault.io/pkg/config"
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+// LeaseLocations takes the advisory maintenance lease on every location an
+// operation will touch. Release the returned set when the operation is done,
+// and run the operation under the set's Context so it stops if a lease is
+// lost. steal overrides live leases held by other instances and should only
+// be used once the holder is known to be dead.
+func LeaseLocations(ctx context.Context, locations []string, operation string, cfg *config.Config, steal bool, logger *zap.Logger) (*sharding.LeaseSet, error) {
+	owner := sharding.NewLeaseOwner()
+	if steal {
+		logger.Warn("Stealing location leases", zap.String("operation", operation), zap.String("owner", owner))
+	}
+	leases, err := sharding.AcquireLeases(ctx, locations, owner, operation, cfg.LeaseTTL, steal)
+	if err != nil {
+		logger.Error("Failed to lease locations", zap.String("operation", operation), zap.Error(err))
+		return nil, err
+	}
+	logger.Info("Leased locations", zap.String("operation", operation), zap.String("owner", owner), zap.Int("locations", len(locations)))
+	return leases, nil
+}
+
+// WithLeases runs fn while holding the leases on locations. fn's context is
+// canceled if a lease is lost; the lost lease is then returned as the error
+// even if fn itself succeeded, since its work may have raced another
+// instance's.
+func WithLeases(ctx context.Context, locations []string, operation string, cfg *config.Config, steal bool, logger *zap.Logger, fn func(ctx context.Context) error) error {
+	leases, err := LeaseLocations(ctx, locations, operation, cfg, steal, logger)
+	if err != nil {
+		return err
+	}
+	err = fn(leases.Context())
+	if cause := context.Cause(leases.Context()); cause != nil && ctx.Err() == nil {
+		logger.Error("Lost a location lease", zap.String("operation", operation), zap.Error(cause))
+		err = cause
+	}
+	leases.Release()
+	return err
+}
+
+// MetadataDirLocations returns every location the objects in a metadata
+// directory, including those still in the trash, may have shards at:
+// what maintenance over the whole directory needs to lease.
+func MetadataDirLocations(dir string) ([]string, error) {
+	files, err := listMetadataFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := ListTrash(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !entry.Purged {
+			files = append(files, entry.Tombstone)
+		}
+	}
+
+	seen := make(map[string]bool)
+	var locations []string
+	for _, file := range files {
+		objectLocations, err := ObjectLocations(file)
+		if err != nil {
+			return nil, err
+		}
+		for _, location := range objectLocations {
+			if !seen[location] {
+				seen[location] = true
+				locations = append(locations, location)
+			}
+		}
+	}
+	sort.Strings(locations)
+	return locations, nil
+}
+
+// ObjectLocations returns every location an object's shards may be at,
+// candidates included. Those of a deleted object are read from its
+// tombstone.
+func ObjectLocations(metadatafile string) ([]string, error) {
+	candidates, err := readShardCandidates(metadatafile)
+	if errors.Is(err, os.ErrNotExist) {
+		candidates, err = readShardCandidates(metadatafile + tombstoneSuffix)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var locations []string
+	for _, shard := range candidates {
+		locations = append(locations, shard...)
+	}
+	return locations, nil
+}
@@ -0,0 +1,135 @@
+package datastorage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/techninja8/getvault.io/pkg/config"
+)
+
+// ResolveMetadataFile maps a metadata file argument to a path. A path that
+// exists as given, or that contains a directory component, is used as is;
+// a bare filename is looked up in the configured metadata directory.
+func ResolveMetadataFile(cfg *config.Config, name string) string {
+	if _, err := os.Stat(name); err == nil {
+		return name
+	}
+	if filepath.Base(name) != name || filepath.VolumeName(name) != "" || cfg.MetadataDir == "" {
+		return name
+	}
+	return filepath.Join(cfg.MetadataDir, name)
+}
+
+// listMetadataFiles returns the metadata files in dir, sorted by name.
+// Files named *.vmd are metadata files; under any other name, so that
+// files named after METADATA_EXT are found whatever it is set to now, a
+// file is one if it starts like one. Hidden files, lock files and
+// tombstones are skipped.
+func listMetadataFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list metadata files: %w", err)
+	}
+	var files []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Type().IsRegular() || strings.HasPrefix(name, ".") ||
+			strings.HasSuffix(name, ".lock") || strings.HasSuffix(name, tombstoneSuffix) {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		if strings.HasSuffix(name, config.DefaultMetadataExt) || startsLikeMetadata(path) {
+			files = append(files, path)
+		}
+	}
+	return files, nil
+}
+
+// startsLikeMetadata reports whether a file begins with the dataID line
+// every metadata file starts with.
+func startsLikeMetadata(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	prefix := make([]byte, len("dataID: "))
+	_, err = io.ReadFull(file, prefix)
+	return err == nil && string(prefix) == "dataID: "
+}
+
+// CollectMetadataFiles moves the metadata files found in dir into the
+// configured metadata directory and returns their new paths. A file that
+// would overwrite an existing metadata file is left where it is, and
+// stops the collection with an error.
+func CollectMetadataFiles(cfg *config.Config, dir string) ([]string, error) {
+	files, err := listMetadataFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(cfg.MetadataDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create metadata directory: %w", err)
+	}
+
+	var moved []string
+	for _, file := range files {
+		target, err := filepath.Abs(filepath.Join(cfg.MetadataDir, filepath.Base(file)))
+		if err != nil {
+			return moved, err
+		}
+		source, err := filepath.Abs(file)
+		if err != nil {
+			return moved, err
+		}
+		if source == target {
+			continue
+		}
+		if _, err := os.Stat(target); err == nil {
+			return moved, fmt.Errorf("metadata file %s already exists", target)
+		}
+		if err := moveFile(source, target); err != nil {
+			return moved, fmt.Errorf("failed to move %s: %w", file, err)
+		}
+		moved = append(moved, target)
+	}
+	return moved, nil
+}
+
+// moveFile renames source to target, copying when they are on different filesystems.
+func moveFile(source, target string) error {
+	err := os.Rename(source, target)
+	if err == nil {
+		return nil
+	}
+	var linkErr *os.LinkError
+	if !errors.As(err, &linkErr) {
+		return err
+	}
+
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(target)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(target)
+		return err
+	}
+	return os.Remove(source)
+}
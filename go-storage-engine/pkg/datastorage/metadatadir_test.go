@@ -0,0 +1,120 @@
+package datastorage
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// TestResolveMetadataFilePrecedence checks that a metadata file argument
+// naming an existing file is used as it is, ahead of a file of the same
+// name in the metadata directory, and that a bare name otherwise resolves
+// to the metadata directory, where stores write.
+func TestResolveMetadataFilePrecedence(t *testing.T) {
+	v := newTestVault(t)
+	metadatafile := v.storeObject(t, "object.bin", randomBytes(t, 1_000))
+	if filepath.Dir(metadatafile) != v.cfg.MetadataDir || !filepath.IsAbs(metadatafile) {
+		t.Fatalf("metadata written to %s, expected an absolute path in %s", metadatafile, v.cfg.MetadataDir)
+	}
+	name := filepath.Base(metadatafile)
+
+	wd := t.TempDir()
+	previous, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(wd); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(previous)
+
+	if got := ResolveMetadataFile(v.cfg, name); got != metadatafile {
+		t.Fatalf("ResolveMetadataFile(%q) = %q, expected %q", name, got, metadatafile)
+	}
+	if got := ResolveMetadataFile(v.cfg, metadatafile); got != metadatafile {
+		t.Fatalf("ResolveMetadataFile of the full path = %q", got)
+	}
+	// A file of that name in the working directory is the one meant
+	if err := os.WriteFile(filepath.Join(wd, name), []byte("dataID: other\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := ResolveMetadataFile(v.cfg, name); got != name {
+		t.Fatalf("ResolveMetadataFile(%q) with a file of that name here = %q", name, got)
+	}
+	// Names of missing files with a directory are left as they are
+	missing := filepath.Join("elsewhere", name)
+	if got := ResolveMetadataFile(v.cfg, missing); got != missing {
+		t.Fatalf("ResolveMetadataFile(%q) = %q", missing, got)
+	}
+	v.cfg.MetadataDir = ""
+	if got := ResolveMetadataFile(v.cfg, "missing.vmd"); got != "missing.vmd" {
+		t.Fatalf("ResolveMetadataFile without a metadata directory = %q", got)
+	}
+}
+
+// TestCollectMetadataFiles moves the metadata files stores left in a
+// stray directory into the metadata directory, leaving everything else.
+func TestCollectMetadataFiles(t *testing.T) {
+	v := newTestVault(t)
+	stray := t.TempDir()
+	strayCfg := *v.cfg
+	strayCfg.MetadataDir = stray
+	data := randomBytes(t, 1_000)
+	var names []string
+	for _, object := range []string{"a.bin", "b.bin"} {
+		_, metadatafile, err := StoreData(data, v.store, &strayCfg, v.locations, v.logger, object)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, filepath.Base(metadatafile))
+	}
+	for name, contents := range map[string]string{"notes.txt": "notes", ".hidden.vmd": "dataID: x\n"} {
+		if err := os.WriteFile(filepath.Join(stray, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	moved, err := CollectMetadataFiles(v.cfg, stray)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want []string
+	for _, name := range names {
+		want = append(want, filepath.Join(v.cfg.MetadataDir, name))
+	}
+	slices.Sort(want)
+	if !slices.Equal(moved, want) {
+		t.Fatalf("moved %v, expected %v", moved, want)
+	}
+	for _, metadatafile := range moved {
+		got, err := RetrieveData(metadatafile, v.store, v.cfg, v.logger)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("RetrieveData of collected %s: %v", metadatafile, err)
+		}
+	}
+	for _, name := range []string{"notes.txt", ".hidden.vmd"} {
+		if _, err := os.Stat(filepath.Join(stray, name)); err != nil {
+			t.Fatalf("%s not left where it was: %v", name, err)
+		}
+	}
+	if again, err := CollectMetadataFiles(v.cfg, stray); err != nil || len(again) != 0 {
+		t.Fatalf("collecting again moved %v: %v", again, err)
+	}
+
+	// A file that would overwrite one already collected stays put
+	clash := filepath.Join(stray, names[0])
+	if err := os.WriteFile(clash, []byte("dataID: clash\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CollectMetadataFiles(v.cfg, stray); err == nil {
+		t.Fatal("collected a file over an existing metadata file")
+	}
+	if _, err := os.Stat(clash); err != nil {
+		t.Fatalf("clashing file moved: %v", err)
+	}
+	if id, _ := MetadataFileReader(want[0], "dataID"); id == "clash" {
+		t.Fatal("existing metadata file overwritten")
+	}
+}
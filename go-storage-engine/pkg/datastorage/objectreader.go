@@ -0,0 +1,237 @@
+package datastorage
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+
+	"go.uber.org/zap"
+
+	"github.com/techninja8/getvault.io/pkg/config"
+	"github.com/techninja8/getvault.io/pkg/metadata"
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+// contentDigestKey records the sha256 of an object's plaintext once it
+// has been computed. Appends drop it.
+const contentDigestKey = "content_sha256"
+
+// ObjectReader reads an object's plaintext from any offset. Streamed
+// objects are decoded a segment at a time, and only the segments reads
+// reach; other objects are a single shard set and are decoded whole on
+// the first read.
+type ObjectReader struct {
+	ctx          context.Context
+	metadatafile string
+	store        sharding.ShardStore
+	cfg          *config.Config
+	logger       *zap.Logger
+	release      func() // Of the object's use lock
+
+	size   int64
+	offset int64
+
+	// Streamed objects: starts[s] is the plaintext offset of segment s.
+	stream  *streamedObject
+	starts  []int64
+	current int
+	buf     []byte
+	plain   []byte
+
+	// Other objects, once read.
+	data []byte
+}
+
+// OpenObject returns a reader over an object's plaintext. Nothing is
+// retrieved until the first read. The object can't be deleted until the
+// reader is closed.
+func OpenObject(ctx context.Context, metadatafile string, store sharding.ShardStore, cfg *config.Config, logger *zap.Logger) (*ObjectReader, error) {
+	if cfg.VerifyOnly {
+		return nil, ErrVerifyOnly
+	}
+	release, err := useObject(metadatafile)
+	if err != nil {
+		return nil, err
+	}
+	r, err := openObject(ctx, metadatafile, store, cfg, logger)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	r.release = release
+	return r, nil
+}
+
+// openObject is OpenObject under the object's use lock.
+func openObject(ctx context.Context, metadatafile string, store sharding.ShardStore, cfg *config.Config, logger *zap.Logger) (*ObjectReader, error) {
+	values, err := metadata.ReadValues(metadatafile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading metadata file: %w", err)
+	}
+	size, err := strconv.ParseInt(values["filesize"], 10, 64)
+	if err != nil || size < 0 {
+		return nil, fmt.Errorf("invalid filesize in metadata: %q", values["filesize"])
+	}
+	ctx, logger = startOperation(ctx, cfg, logger, "retrieve")
+	r := &ObjectReader{ctx: ctx, metadatafile: metadatafile, store: store, cfg: cfg, logger: logger, size: size, current: -1}
+	if readLayout(metadatafile) != layoutStreaming {
+		return r, nil
+	}
+
+	if r.stream, err = openStream(metadatafile, cfg, logger); err != nil {
+		return nil, err
+	}
+	// Segments carry an IV each; the rest of the ciphertext is plaintext-sized
+	var offset int64
+	r.starts = make([]int64, len(r.stream.segments))
+	for s, seg := range r.stream.segments {
+		r.starts[s] = offset
+		offset += int64(seg.Size - aes.BlockSize)
+	}
+	if offset != size {
+		return nil, fmt.Errorf("segments hold %d bytes but the object has %d", offset, size)
+	}
+	return r, nil
+}
+
+// Size returns the size of the object's plaintext.
+func (r *ObjectReader) Size() int64 {
+	return r.size
+}
+
+// Read implements io.Reader.
+func (r *ObjectReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if r.stream == nil {
+		if r.data == nil {
+			data, err := retrieveData(r.ctx, r.metadatafile, nil, r.store, r.cfg, r.logger)
+			if err != nil {
+				return 0, err
+			}
+			if int64(len(data)) != r.size {
+				return 0, fmt.Errorf("retrieved %d bytes but the object has %d", len(data), r.size)
+			}
+			r.data = data
+		}
+		n := copy(p, r.data[r.offset:])
+		r.offset += int64(n)
+		return n, nil
+	}
+
+	// The segment holding the offset is the last one starting at or before it
+	s := sort.Search(len(r.starts), func(s int) bool { return r.starts[s] > r.offset }) - 1
+	if s != r.current {
+		plain, buf, err := r.stream.decodeSegment(r.ctx, s, r.buf, r.store, r.cfg, r.logger)
+		r.buf = buf
+		if err != nil {
+			r.current = -1
+			return 0, err
+		}
+		r.plain, r.current = plain, s
+	}
+	n := copy(p, r.plain[r.offset-r.starts[s]:])
+	r.offset += int64(n)
+	return n, nil
+}
+
+// Seek implements io.Seeker. Seeking retrieves nothing.
+func (r *ObjectReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+// Close releases the reader's decode buffer, and the object for deletes.
+func (r *ObjectReader) Close() error {
+	putBuffer(r.cfg, r.buf)
+	r.buf, r.plain, r.data, r.current = nil, nil, nil, -1
+	if r.release != nil {
+		r.release()
+		r.release = nil
+	}
+	return nil
+}
+
+// ContentDigest returns the sha256 of an object's plaintext. It is
+// computed by retrieving the object the first time it is asked for and
+// recorded in the metadata, so later calls read nothing but that.
+func ContentDigest(ctx context.Context, metadatafile string, store sharding.ShardStore, cfg *config.Config, logger *zap.Logger) ([]byte, error) {
+	if sum, ok := RecordedContentDigest(metadatafile, logger); ok {
+		return sum, nil
+	}
+	hash := sha256.New()
+	if _, err := RetrieveToContext(ctx, metadatafile, hash, store, cfg, logger); err != nil {
+		return nil, err
+	}
+	sum := hash.Sum(nil)
+	if err := setMetadataValue(metadatafile, contentDigestKey, hex.EncodeToString(sum)); err != nil {
+		logger.Warn("Failed to record content digest", zap.Error(err))
+	}
+	return sum, nil
+}
+
+// RecordedContentDigest returns the sha256 of an object's plaintext if
+// ContentDigest has recorded it, without retrieving anything.
+func RecordedContentDigest(metadatafile string, logger *zap.Logger) ([]byte, bool) {
+	recorded, err := metadata.ReadValue(metadatafile, contentDigestKey)
+	if err != nil {
+		return nil, false
+	}
+	sum, err := hex.DecodeString(recorded)
+	if err != nil || len(sum) != sha256.Size {
+		logger.Warn("Ignoring invalid recorded content digest", zap.String("metadataFile", metadatafile))
+		return nil, false
+	}
+	return sum, true
+}
+
+// RetrieveMemory estimates the most memory retrieving an object holds at
+// once, in bytes: the shards, ciphertext and plaintext of a segment for a
+// streamed object, which is decoded a segment at a time, and of the whole
+// object for any other.
+func RetrieveMemory(metadatafile string) (int64, error) {
+	values, err := metadata.ReadValues(metadatafile)
+	if err != nil {
+		return 0, fmt.Errorf("error reading metadata file: %w", err)
+	}
+	code, err := readCode(values)
+	if err != nil {
+		return 0, err
+	}
+	if values["layout"] == layoutStreaming {
+		segments, err := readSegments(values)
+		if err != nil {
+			return 0, err
+		}
+		var most int64
+		for _, seg := range segments {
+			most = max(most, int64(code.ShardSetSize(seg.Size))+2*int64(seg.Size))
+		}
+		return most, nil
+	}
+	size, err := strconv.ParseInt(values["filesize"], 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid filesize in metadata: %q", values["filesize"])
+	}
+	stored := storedLength(values, size)
+	return int64(code.ShardSetSize(stored)+stored) + size, nil
+}
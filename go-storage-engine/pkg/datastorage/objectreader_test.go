@@ -0,0 +1,139 @@
+package datastorage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/techninja8/getvault.io/pkg/erasurecoding"
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+func TestObjectReaderRetrievesOnlyTheSegmentsRead(t *testing.T) {
+	v := newTestVault(t)
+	v.cfg.MaxShardSize = 4096 // segments of under 32 KiB
+	data := randomBytes(t, 300_000)
+	metadatafile := v.storeObject(t, "object.bin", data)
+	if readLayout(metadatafile) != layoutStreaming {
+		t.Fatal("object wasn't streamed")
+	}
+
+	store := &countingStore{InMemoryShardStore: sharding.NewInMemoryShardStore()}
+	r, err := OpenObject(context.Background(), metadatafile, store, v.cfg, v.logger)
+	if err != nil {
+		t.Fatalf("OpenObject: %v", err)
+	}
+	defer r.Close()
+	if r.Size() != int64(len(data)) {
+		t.Fatalf("size %d, expected %d", r.Size(), len(data))
+	}
+	if n := store.retrieved.Load(); n != 0 {
+		t.Fatalf("opening retrieved %d shards", n)
+	}
+
+	// A range inside one segment
+	offset := int64(len(data)) - 1000
+	if _, err := r.Seek(offset, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 500)
+	if _, err := io.ReadFull(r, got); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if !bytes.Equal(got, data[offset:offset+500]) {
+		t.Fatal("range read returned the wrong bytes")
+	}
+	if n, total := store.retrieved.Load(), int64(erasurecoding.DataShards+erasurecoding.ParityShards); n == 0 || n > total {
+		t.Fatalf("range read retrieved %d shards, expected at most one segment's %d", n, total)
+	}
+
+	// Reading on across segment boundaries returns the rest in order
+	if _, err := r.Seek(1000, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	rest, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if !bytes.Equal(rest, data[1000:]) {
+		t.Fatal("reading across segments returned the wrong bytes")
+	}
+}
+
+func TestObjectReaderReadsInMemoryObjects(t *testing.T) {
+	v := newTestVault(t)
+	data := randomBytes(t, 20_000)
+	metadatafile := v.storeObject(t, "object.bin", data)
+
+	r, err := OpenObject(context.Background(), metadatafile, v.store, v.cfg, v.logger)
+	if err != nil {
+		t.Fatalf("OpenObject: %v", err)
+	}
+	defer r.Close()
+	if _, err := r.Seek(-100, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if !bytes.Equal(got, data[len(data)-100:]) {
+		t.Fatal("read returned the wrong bytes")
+	}
+}
+
+func TestContentDigestIsRecorded(t *testing.T) {
+	v := newTestVault(t)
+	data := randomBytes(t, 20_000)
+	metadatafile := v.storeObject(t, "object.bin", data)
+
+	want := sha256.Sum256(data)
+	sum, err := ContentDigest(context.Background(), metadatafile, v.store, v.cfg, v.logger)
+	if err != nil {
+		t.Fatalf("ContentDigest: %v", err)
+	}
+	if !bytes.Equal(sum, want[:]) {
+		t.Fatal("digest doesn't match the contents")
+	}
+
+	// Later calls read the recorded digest rather than the shards
+	store := &countingStore{InMemoryShardStore: sharding.NewInMemoryShardStore()}
+	if sum, err = ContentDigest(context.Background(), metadatafile, store, v.cfg, v.logger); err != nil || !bytes.Equal(sum, want[:]) {
+		t.Fatalf("recorded digest: %x, %v", sum, err)
+	}
+	if n := store.retrieved.Load(); n != 0 {
+		t.Fatalf("recorded digest retrieved %d shards", n)
+	}
+}
+
+func TestMetadataIndex(t *testing.T) {
+	v := newTestVault(t)
+	first := v.storeObject(t, "first.bin", randomBytes(t, 1000))
+	index, err := NewMetadataIndex(v.cfg.MetadataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstID, _ := MetadataFileReader(first, "dataID")
+	if file, err := index.Lookup(firstID); err != nil || file != first {
+		t.Fatalf("Lookup = %q, %v", file, err)
+	}
+
+	// Objects stored after the index was built are found
+	second := v.storeObject(t, "second.bin", randomBytes(t, 1000))
+	secondID, _ := MetadataFileReader(second, "dataID")
+	if file, err := index.Lookup(secondID); err != nil || file != second {
+		t.Fatalf("Lookup of a new object = %q, %v", file, err)
+	}
+
+	// And objects whose metadata is gone aren't
+	if err := os.Rename(first, filepath.Join(t.TempDir(), "moved")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := index.Lookup(firstID); err == nil {
+		t.Fatal("found an object whose metadata file is gone")
+	}
+}
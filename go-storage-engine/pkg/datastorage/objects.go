@@ -0,0 +1,131 @@
+package datastorage
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/techninja8/getvault.io/pkg/metadata"
+)
+
+// ErrAmbiguousID is returned when a dataID prefix matches several objects.
+var ErrAmbiguousID = errors.New("dataID prefix matches more than one object")
+
+// ObjectInfo summarizes an object from its metadata file.
+type ObjectInfo struct {
+	MetadataFile    string
+	DataID          string
+	Filename        string
+	Size            int64            // Bytes retrieved: the zip archive of a directory
+	Tree            *TreeStats       // Files and bytes of the directory stored, if the object is one
+	Compressibility *Compressibility // Estimated as the object was stored, if it was
+	Format          string
+	Created         string
+	Layout          string
+	Tier            string
+	LastAccess      *time.Time
+	Preview         string // dataID of the object's preview, if it has one
+	PreviewOf       string // dataID of the object this is the preview of
+	Namespace       string // Namespace of the token the object was stored over serve with
+	Error           string // Set when the metadata file couldn't be read
+}
+
+// ListObjects describes every object in a metadata directory, in metadata
+// file order.
+func ListObjects(dir string) ([]ObjectInfo, error) {
+	files, err := listMetadataFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	objects := make([]ObjectInfo, len(files))
+	for i, file := range files {
+		objects[i] = readObjectInfo(file)
+	}
+	return objects, nil
+}
+
+func readObjectInfo(metadatafile string) ObjectInfo {
+	info := ObjectInfo{MetadataFile: metadatafile}
+	values, err := metadata.ReadValues(metadatafile)
+	if err != nil {
+		info.Error = err.Error()
+		return info
+	}
+	info.DataID = values["dataID"]
+	info.Filename = objectFilename(values)
+	info.Size, _ = strconv.ParseInt(values["filesize"], 10, 64)
+	info.Format = values["format"]
+	info.Tree = readTreeStats(values)
+	info.Compressibility = readCompressibility(values)
+	info.Created = values["creation_date"]
+	info.Layout = values["layout"]
+	if info.Layout == "" {
+		info.Layout = layoutInMemory
+	}
+	info.Tier = values["tier"]
+	if info.Tier == "" {
+		info.Tier = tierHot
+	}
+	if at, err := time.Parse(time.RFC3339, values["last_access"]); err == nil {
+		info.LastAccess = &at
+	}
+	info.Preview = values["preview"]
+	info.PreviewOf = values["preview_of"]
+	info.Namespace = values["namespace"]
+	if info.DataID == "" {
+		info.Error = "metadata file has no dataID"
+	}
+	return info
+}
+
+// SetNamespace records the namespace an object was stored by, which its
+// usage is attributed to.
+func SetNamespace(metadatafile, namespace string) error {
+	return setMetadataValue(metadatafile, "namespace", namespace)
+}
+
+// FindObjects returns the objects in a metadata directory whose dataID or
+// filename is ref. Several objects can share a filename.
+func FindObjects(dir, ref string) ([]ObjectInfo, error) {
+	objects, err := ListObjects(dir)
+	if err != nil {
+		return nil, err
+	}
+	var found []ObjectInfo
+	for _, object := range objects {
+		if object.Error == "" && (object.DataID == ref || object.Filename == ref) {
+			found = append(found, object)
+		}
+	}
+	if len(found) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrObjectNotFound, ref)
+	}
+	return found, nil
+}
+
+// FindObjectByPrefix returns the object in a metadata directory whose
+// dataID starts with prefix, which must match exactly one object.
+func FindObjectByPrefix(dir, prefix string) (ObjectInfo, error) {
+	if prefix == "" {
+		return ObjectInfo{}, fmt.Errorf("%w: empty dataID prefix", ErrObjectNotFound)
+	}
+	objects, err := ListObjects(dir)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	var found []ObjectInfo
+	for _, object := range objects {
+		if object.Error == "" && strings.HasPrefix(object.DataID, prefix) {
+			found = append(found, object)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return ObjectInfo{}, fmt.Errorf("%w: %s", ErrObjectNotFound, prefix)
+	case 1:
+		return found[0], nil
+	}
+	return ObjectInfo{}, fmt.Errorf("%w: %s matches %d objects", ErrAmbiguousID, prefix, len(found))
+}
@@ -0,0 +1,71 @@
+package datastorage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+
+	"go.uber.org/zap"
+
+	"github.com/techninja8/getvault.io/pkg/config"
+)
+
+type operationIDKey struct{}
+
+type operationNameKey struct{}
+
+// WithOperationID returns a context carrying an operation ID.
+func WithOperationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, operationIDKey{}, id)
+}
+
+// OperationIDFrom returns the operation ID carried by ctx, or "".
+func OperationIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(operationIDKey{}).(string)
+	return id
+}
+
+// newOperationID returns a random ID for one top-level operation.
+func newOperationID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// withOperation gives ctx a new operation ID and returns a logger that tags
+// every line with it and the operation's name, so the interleaved lines of
+// concurrent operations can be told apart.
+func withOperation(ctx context.Context, logger *zap.Logger, op string) (context.Context, *zap.Logger) {
+	ctx = context.WithValue(WithOperationID(ctx, newOperationID()), operationNameKey{}, op)
+	return ctx, operationLogger(ctx, logger)
+}
+
+// operationLogger returns logger tagged with the operation ctx carries, for
+// stages that are handed the context of an operation but were built with
+// an untagged logger. Without an operation logger is returned as is.
+func operationLogger(ctx context.Context, logger *zap.Logger) *zap.Logger {
+	id := OperationIDFrom(ctx)
+	if id == "" {
+		return logger
+	}
+	op, _ := ctx.Value(operationNameKey{}).(string)
+	return logger.With(zap.String("op", op), zap.String("op_id", id))
+}
+
+// NewOperationContext returns a context carrying a budget of
+// cfg.MaxRetriesPerOp retries, for callers that retry a whole operation:
+// passed to every attempt, and to RetryWithBudget for the attempts
+// themselves, it caps the retries across attempts rather than per attempt.
+func NewOperationContext(cfg *config.Config) context.Context {
+	return WithRetryBudget(context.Background(), NewRetryBudget(cfg.MaxRetriesPerOp))
+}
+
+// startOperation starts one top-level store or retrieve operation. Its
+// context carries an operation ID and the retry budget of ctx, or a fresh
+// budget of cfg.MaxRetriesPerOp retries if ctx has none.
+func startOperation(ctx context.Context, cfg *config.Config, logger *zap.Logger, op string) (context.Context, *zap.Logger) {
+	if RetryBudgetFrom(ctx) == nil {
+		ctx = WithRetryBudget(ctx, NewRetryBudget(cfg.MaxRetriesPerOp))
+	}
+	return withOperation(ctx, logger, op)
+}
@@ -0,0 +1,85 @@
+package datastorage
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+// TestOperationsTagTheirLogLines stores two objects at once through one
+// logger, then retrieves one of them and deeply verifies it with a shard
+// missing, so that verification has something to log, and checks that every
+// line logged carries an op_id, that each operation's lines share one,
+// and that no two operations share theirs.
+func TestOperationsTagTheirLogLines(t *testing.T) {
+	v := newTestVault(t)
+	core, logs := observer.New(zapcore.DebugLevel)
+	logger := zap.New(core)
+
+	var wg sync.WaitGroup
+	metadatafiles := make([]string, 2)
+	errs := make([]error, 2)
+	for i := range metadatafiles {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, metadatafiles[i], errs[i] = StoreData(randomBytes(t, 100_000), v.store, v.cfg, v.locations, logger, fmt.Sprintf("object%d.bin", i))
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := RetrieveData(metadatafiles[0], sharding.NewInMemoryShardStore(), v.cfg, logger); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(v.shardFile(t, metadatafiles[0], 0)); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyData(metadatafiles[0], sharding.NewInMemoryShardStore(), CheckOptions{Deep: true}, logger); err != nil {
+		t.Fatal(err)
+	}
+
+	// op_id -> op, and op_id -> dataIDs of the shards its lines are about
+	ops := map[string]string{}
+	dataIDs := map[string]map[string]bool{}
+	for _, entry := range logs.All() {
+		fields := entry.ContextMap()
+		id, ok := fields["op_id"].(string)
+		if !ok || id == "" {
+			t.Fatalf("%q logged without an op_id", entry.Message)
+		}
+		op, _ := fields["op"].(string)
+		if seen, ok := ops[id]; ok && seen != op {
+			t.Fatalf("op_id %s tags both %s and %s lines", id, seen, op)
+		}
+		ops[id] = op
+		if dataID, ok := fields["dataID"].(string); ok {
+			if dataIDs[id] == nil {
+				dataIDs[id] = map[string]bool{}
+			}
+			dataIDs[id][dataID] = true
+		}
+	}
+	counts := map[string]int{}
+	for _, op := range ops {
+		counts[op]++
+	}
+	if len(ops) != 4 || counts["store"] != 2 || counts["retrieve"] != 1 || counts["verify"] != 1 {
+		t.Fatalf("log lines tagged with operations %v, expected two stores, a retrieve and a verify", counts)
+	}
+	for id, ids := range dataIDs {
+		if len(ids) > 1 {
+			t.Fatalf("%s %s logged lines about objects %v", ops[id], id, ids)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package datastorage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"runtime"
+
+	"go.uber.org/zap"
+
+	"github.com/techninja8/getvault.io/pkg/config"
+	"github.com/techninja8/getvault.io/pkg/erasurecoding"
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+// cpuWorkers returns how many segments each holding up to memory bytes
+// are encrypted, coded and stored at once: cfg.CPUWorkers, or one per CPU
+// when it is 0 or less, but no more than fit in cfg.MaxInFlightBytes, so
+// large segments don't multiply memory use by the number of CPUs.
+func cpuWorkers(cfg *config.Config, memory int64) int {
+	workers := cfg.CPUWorkers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if cfg.MaxInFlightBytes > 0 && memory > 0 {
+		workers = min(workers, int(max(1, cfg.MaxInFlightBytes/memory)))
+	}
+	return workers
+}
+
+// storedSegments is what storeSegments stored: the lines for the segments
+// and Proofs blocks, in segment order.
+type storedSegments struct {
+	segments string
+	proofs   string
+	count    int
+	size     int64 // Plaintext bytes
+}
+
+// segmentResult is the outcome of storing one segment.
+type segmentResult struct {
+	line, proofs string
+	size         int
+	err          error
+}
+
+// storeSegments stores the segments read from source, numbered from first,
+// with storeSegment, or storeEncodedSegment for those the source encrypted
+// and coded as it read them. Up to cpuWorkers segments are encrypted,
+// coded and stored at once. The memory each holds, as the source reports
+// it, is reserved from cfg.MaxInFlightBytes before the segment is read and
+// released once its shards are stored, so the segments being read, coded
+// and stored never take more than that together. Results are collected in
+// segment order and cipher texts written to digest in segment order, by
+// storeSegment or as the source reads them, so the metadata and dataID
+// don't depend on the number of workers or which finishes first. checkSize
+// is called with the plaintext size read so far after every segment. The
+// first error stops reading and is returned once the segments in flight
+// have finished.
+func storeSegments(ctx context.Context, source segmentSource, first int, key []byte, indexed bool, code erasurecoding.Code, chunks *chunkSet, digest io.Writer, checkSize func(int64) error, locations []string, store sharding.ShardStore, cfg *config.Config, logger *zap.Logger) (storedSegments, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	memory := source.Memory()
+	workers := cpuWorkers(cfg, memory)
+	budget := newByteBudget(cfg.MaxInFlightBytes)
+	logger.Info("Storing segments", zap.Int("workers", workers), zap.Int64("segmentMemory", memory))
+
+	// The collector takes a segment's result channel off pending before the
+	// segment starts, so with workers-1 more queued, no more than workers
+	// segments are being stored at a time
+	pending := make(chan chan segmentResult, workers-1)
+	go func() {
+		defer close(pending)
+		failed := func(err error) {
+			done := make(chan segmentResult, 1)
+			done <- segmentResult{err: err}
+			select {
+			case pending <- done:
+			case <-ctx.Done():
+			}
+		}
+		turn := make(chan struct{})
+		close(turn)
+		var size int64
+		for s := first; ; s++ {
+			reserved := budget.acquire(memory)
+			segment, err := source.Next()
+			if err != nil {
+				budget.release(reserved)
+				if err != io.EOF {
+					failed(fmt.Errorf("failed to read data: %w", err))
+				}
+				return
+			}
+			size += int64(segment.size)
+			if err := checkSize(size); err != nil {
+				budget.release(reserved)
+				failed(err)
+				return
+			}
+
+			done := make(chan segmentResult, 1)
+			select {
+			case pending <- done:
+			case <-ctx.Done():
+				budget.release(reserved)
+				return
+			}
+			if segment.encoded != nil {
+				go func(s int) {
+					defer budget.release(reserved)
+					line, proofs, err := storeEncodedSegment(ctx, s, segment.encoded, segment.size, locations, store, cfg, logger)
+					done <- segmentResult{line: line, proofs: proofs, size: segment.size, err: err}
+				}(s)
+				continue
+			}
+			next := make(chan struct{})
+			w := &orderedWriter{ctx: ctx, w: digest, turn: turn, next: next}
+			turn = next
+			go func(s int) {
+				defer budget.release(reserved)
+				line, proofs, err := storeSegment(ctx, s, segment.plainText, key, indexed, code, chunks, w, locations, store, cfg, logger)
+				done <- segmentResult{line: line, proofs: proofs, size: segment.size, err: err}
+			}(s)
+		}
+	}()
+
+	var (
+		stored   storedSegments
+		firstErr error
+	)
+	for done := range pending {
+		result := <-done
+		if firstErr != nil {
+			continue
+		}
+		if result.err != nil {
+			firstErr = result.err
+			cancel()
+			continue
+		}
+		stored.segments += result.line
+		stored.proofs += result.proofs
+		stored.count++
+		stored.size += int64(result.size)
+	}
+	if budget.limit > 0 {
+		logger.Info("Peak in-flight segment bytes", zap.Int64("bytes", budget.peakUsed()), zap.Int64("limit", budget.limit))
+	}
+	return stored, firstErr
+}
+
+// orderedWriter passes a single Write on to w once the writer of the
+// previous segment has written, by waiting for turn, then hands the turn
+// on by closing next.
+type orderedWriter struct {
+	ctx  context.Context
+	w    io.Writer
+	turn <-chan struct{}
+	next chan struct{}
+}
+
+func (o *orderedWriter) Write(p []byte) (int, error) {
+	select {
+	case <-o.turn:
+	case <-o.ctx.Done():
+		return 0, o.ctx.Err()
+	}
+	defer close(o.next)
+	return o.w.Write(p)
+}
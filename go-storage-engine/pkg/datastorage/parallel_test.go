@@ -0,0 +1,83 @@
+package datastorage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"slices"
+	"testing"
+
+	"github.com/techninja8/getvault.io/pkg/metadata"
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+// TestChunkedStoreIgnoresWorkers stores the same object chunked with
+// different numbers of workers. Chunks are encrypted deterministically,
+// so every store must record the same dataID and the same segments, in
+// the same order, and each must read back.
+func TestChunkedStoreIgnoresWorkers(t *testing.T) {
+	v := newTestVault(t)
+	v.cfg.ChunkSize = 8 << 10
+	v.cfg.MaxInFlightBytes = 0
+	data := randomBytes(t, 1<<20)
+
+	var wantID string
+	var wantSegments []segment
+	for _, workers := range []int{1, 4, 8} {
+		v.cfg.CPUWorkers = workers
+		dataID, metadatafile, err := StoreReader(bytes.NewReader(data), -1, v.store, v.cfg, v.locations, v.logger, fmt.Sprintf("workers%d.bin", workers))
+		if err != nil {
+			t.Fatalf("%d workers: %v", workers, err)
+		}
+		values, err := metadata.ReadValues(metadatafile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		segments, err := readSegments(values)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(segments) < 16 {
+			t.Fatalf("%d workers: 1 MiB cut into %d chunks", workers, len(segments))
+		}
+		if wantID == "" {
+			wantID, wantSegments = dataID, segments
+		} else if dataID != wantID || !slices.Equal(segments, wantSegments) {
+			t.Fatalf("%d workers stored dataID %s with %d segments, 1 worker %s with %d", workers, dataID, len(segments), wantID, len(wantSegments))
+		}
+
+		var got bytes.Buffer
+		if _, err := RetrieveTo(metadatafile, &got, sharding.NewInMemoryShardStore(), v.cfg, v.logger); err != nil {
+			t.Fatalf("%d workers: %v", workers, err)
+		}
+		if !bytes.Equal(got.Bytes(), data) {
+			t.Fatalf("%d workers: retrieved %d bytes that differ from the %d stored", workers, got.Len(), len(data))
+		}
+	}
+}
+
+// BenchmarkChunkedStoreWorkers stores 1 GiB chunked, the path whose
+// segments are encrypted and coded in parallel, with growing numbers of
+// workers. MB/s should grow close to linearly up to 4 workers on a
+// machine with that many CPUs.
+func BenchmarkChunkedStoreWorkers(b *testing.B) {
+	if testing.Short() {
+		b.Skip("skipped with -short")
+	}
+	const size = 1 << 30
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			v := newTestVault(b)
+			v.cfg.ChunkSize = 1 << 20
+			v.cfg.CPUWorkers = workers
+			v.cfg.MaxInFlightBytes = 0
+			b.SetBytes(size)
+			for i := 0; i < b.N; i++ {
+				r := io.LimitReader(zeroReader{}, size)
+				if _, _, err := StoreReader(r, -1, discardShardStore{}, v.cfg, v.locations, v.logger, "object.bin"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,168 @@
+package datastorage
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/techninja8/getvault.io/pkg/metadata"
+)
+
+var ErrUnsafePath = errors.New("unsafe path")
+
+// ErrFilenameTooLong is returned when storing a file whose name no
+// platform could write back on retrieval.
+var ErrFilenameTooLong = errors.New("filename too long")
+
+// MaxFilenameBytes is the longest filename stored, the limit Linux, macOS
+// and Windows file systems share.
+const MaxFilenameBytes = 255
+
+// SafeFilename returns the name a retrieved object is written under. The
+// filename comes from metadata, which may have been tampered with, so
+// absolute paths and ".." segments are rejected and any other directory
+// components are stripped, keeping the file in the output directory.
+//
+// What is left is made a name any platform can write:
+//   - invalid UTF-8, control characters and <>:"|?* are replaced by '_'
+//   - trailing dots and spaces, which Windows drops, are replaced by '_'
+//   - names Windows keeps for devices, like CON or com1.txt, get a
+//     leading '_'
+//   - names over MaxFilenameBytes are cut short before their extension
+func SafeFilename(name string) (string, error) {
+	// Either separator may appear, whatever platform wrote the metadata.
+	slashed := strings.ReplaceAll(name, `\`, "/")
+	if filepath.IsAbs(name) || strings.HasPrefix(slashed, "/") {
+		return "", fmt.Errorf("%w: absolute filename %q", ErrUnsafePath, name)
+	}
+	for _, segment := range strings.Split(slashed, "/") {
+		if segment == ".." {
+			return "", fmt.Errorf("%w: filename %q leaves the output directory", ErrUnsafePath, name)
+		}
+	}
+	base := filepath.Base(slashed)
+	if base == "." || base == "/" || base == "" {
+		return "", fmt.Errorf("%w: empty filename %q", ErrUnsafePath, name)
+	}
+	return portableFilename(base), nil
+}
+
+// portableFilename applies SafeFilename's replacements to a name without
+// separators.
+func portableFilename(name string) string {
+	var clean strings.Builder
+	for i, r := range name {
+		if r == utf8.RuneError {
+			if _, size := utf8.DecodeRuneInString(name[i:]); size == 1 {
+				clean.WriteByte('_')
+				continue
+			}
+		}
+		if unicode.IsControl(r) || strings.ContainsRune(`<>:"|?*`, r) {
+			r = '_'
+		}
+		clean.WriteRune(r)
+	}
+	name = clean.String()
+	if trimmed := strings.TrimRight(name, ". "); len(trimmed) < len(name) {
+		name = trimmed + strings.Repeat("_", len(name)-len(trimmed))
+	}
+	if reservedDeviceName(name) {
+		name = "_" + name
+	}
+	return truncateFilename(name, MaxFilenameBytes)
+}
+
+// reservedDeviceName reports whether Windows keeps name for a device,
+// whatever its case or extension.
+func reservedDeviceName(name string) bool {
+	stem, _, _ := strings.Cut(name, ".")
+	stem = strings.ToUpper(strings.TrimRight(stem, " "))
+	switch stem {
+	case "CON", "PRN", "AUX", "NUL", "CONIN$", "CONOUT$":
+		return true
+	}
+	if len(stem) == 4 && (strings.HasPrefix(stem, "COM") || strings.HasPrefix(stem, "LPT")) {
+		return stem[3] >= '1' && stem[3] <= '9'
+	}
+	return false
+}
+
+// truncateFilename cuts name to at most limit bytes, keeping its extension
+// when that leaves some of the rest, and never splitting a character.
+func truncateFilename(name string, limit int) string {
+	if len(name) <= limit {
+		return name
+	}
+	ext := filepath.Ext(name)
+	if len(ext) >= limit/2 {
+		ext = ""
+	}
+	stem := name[:len(name)-len(ext)]
+	cut := limit - len(ext)
+	for cut > 0 && !utf8.RuneStart(stem[cut]) {
+		cut--
+	}
+	return stem[:cut] + ext
+}
+
+// CheckFilename fails with ErrFilenameTooLong for names retrieval could
+// not write back.
+func CheckFilename(name string) error {
+	if len(name) > MaxFilenameBytes {
+		return fmt.Errorf("%w: %d bytes, at most %d are stored", ErrFilenameTooLong, len(name), MaxFilenameBytes)
+	}
+	return nil
+}
+
+// filenameLines formats the filename metadata lines. Metadata is read a
+// line at a time with values trimmed, so names that don't survive that,
+// or aren't UTF-8, are written escaped as in a Go string, with their bytes
+// kept in filename_b64.
+func filenameLines(name string) string {
+	exact := utf8.ValidString(name) && name == strings.TrimSpace(name) &&
+		strings.IndexFunc(name, unicode.IsControl) < 0
+	if exact {
+		return fmt.Sprintf("filename: %s\n", name)
+	}
+	quoted := strconv.Quote(name)
+	return fmt.Sprintf("filename: %s\nfilename_b64: %s\n", quoted[1:len(quoted)-1], base64.StdEncoding.EncodeToString([]byte(name)))
+}
+
+// objectFilename returns the filename an object was stored under, from
+// filename_b64 when there is one.
+func objectFilename(values map[string]string) string {
+	if encoded, ok := values["filename_b64"]; ok {
+		if name, err := base64.StdEncoding.DecodeString(encoded); err == nil {
+			return string(name)
+		}
+	}
+	return values["filename"]
+}
+
+// ReadFilename returns the filename an object was stored under, byte for
+// byte. It is not safe to write to; see SafeFilename.
+func ReadFilename(metadatafile string) (string, error) {
+	values, err := metadata.ReadValues(metadatafile)
+	if err != nil {
+		return "", fmt.Errorf("error reading metadata file: %w", err)
+	}
+	return objectFilename(values), nil
+}
+
+// SafeJoin joins a relative path from an archive or manifest to target,
+// failing if the result would lie outside target. rel may use either
+// separator; absolute paths, volume names and, on Windows, reserved device
+// names are rejected.
+func SafeJoin(target, rel string) (string, error) {
+	local := filepath.FromSlash(rel)
+	if !filepath.IsLocal(local) {
+		return "", fmt.Errorf("%w: illegal file path: %s", ErrUnsafePath, rel)
+	}
+	return filepath.Join(target, local), nil
+}
@@ -0,0 +1,225 @@
+package datastorage
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/techninja8/getvault.io/pkg/metadata"
+)
+
+// hostileFilenames are names the metadata format and output paths have to
+// survive.
+var hostileFilenames = []string{
+	"report.pdf",
+	"two\nlines.txt",
+	"carriage\rreturn",
+	"key: value.txt",
+	"filesize: 1",
+	" padded ",
+	"tab\there",
+	"latin1-\xe9t\xe9.txt",
+	"\xff\xfe",
+	"CON",
+	"com1.txt",
+	"nul .tar.gz",
+	"trailing dot.",
+	`what?<is>"this"|*.txt`,
+	strings.Repeat("é", 126) + ".x",
+	strings.Repeat("n", MaxFilenameBytes),
+}
+
+// checkPortable fails unless name is a filename SafeFilename could return.
+func checkPortable(t *testing.T, name string) {
+	t.Helper()
+	if !utf8.ValidString(name) || len(name) == 0 || len(name) > MaxFilenameBytes {
+		t.Fatalf("SafeFilename returned %q", name)
+	}
+	if strings.ContainsAny(name, `/\<>:"|?*`) || strings.IndexFunc(name, unicode.IsControl) >= 0 {
+		t.Fatalf("SafeFilename returned %q", name)
+	}
+	if name == "." || name == ".." || strings.HasSuffix(name, ".") || strings.HasSuffix(name, " ") || reservedDeviceName(name) {
+		t.Fatalf("SafeFilename returned %q", name)
+	}
+}
+
+func TestHostileFilenamesRoundTrip(t *testing.T) {
+	v := newTestVault(t)
+	out := t.TempDir()
+	for _, name := range hostileFilenames {
+		data := randomBytes(t, 1_000)
+		metadatafile := v.storeObject(t, name, data)
+
+		stored, err := ReadFilename(metadatafile)
+		if err != nil || stored != name {
+			t.Fatalf("stored %q, read back %q, %v", name, stored, err)
+		}
+		// The name doesn't spill into the lines after it
+		if size, err := MetadataFileReader(metadatafile, "filesize"); err != nil || size != "1000" {
+			t.Fatalf("%q: filesize %q, %v", name, size, err)
+		}
+		if info := readObjectInfo(metadatafile); info.Filename != name {
+			t.Fatalf("%q listed as %q", name, info.Filename)
+		}
+
+		safe, err := SafeFilename(stored)
+		if err != nil {
+			t.Fatalf("SafeFilename(%q): %v", stored, err)
+		}
+		checkPortable(t, safe)
+		path := filepath.Join(out, safe)
+		file, err := os.Create(path)
+		if err != nil {
+			t.Fatalf("%q: %v", name, err)
+		}
+		_, err = RetrieveTo(metadatafile, file, v.store, v.cfg, v.logger)
+		file.Close()
+		if err != nil {
+			t.Fatalf("RetrieveTo %q: %v", name, err)
+		}
+		if got, _ := os.ReadFile(path); !bytes.Equal(got, data) {
+			t.Fatalf("%q retrieved to %q differs", name, safe)
+		}
+	}
+}
+
+func TestOverlongFilenameRejectedAtStore(t *testing.T) {
+	v := newTestVault(t)
+	name := strings.Repeat("a", 300) + ".txt"
+	if _, _, err := StoreData(randomBytes(t, 100), v.store, v.cfg, v.locations, v.logger, name); !errors.Is(err, ErrFilenameTooLong) {
+		t.Fatalf("StoreData with a %d byte name: %v", len(name), err)
+	}
+	if _, _, err := StoreReader(bytes.NewReader(randomBytes(t, 100)), 100, v.store, v.cfg, v.locations, v.logger, name); !errors.Is(err, ErrFilenameTooLong) {
+		t.Fatalf("StoreReader with a %d byte name: %v", len(name), err)
+	}
+	// Only the name counts, not the directories it is in
+	if _, _, err := StoreData(randomBytes(t, 100), v.store, v.cfg, v.locations, v.logger, filepath.Join(strings.Repeat("d", 300), "short.txt")); err != nil {
+		t.Fatalf("StoreData in a long directory: %v", err)
+	}
+}
+
+func TestSafeFilenameReplacements(t *testing.T) {
+	for name, want := range map[string]string{
+		"report.pdf":       "report.pdf",
+		"dir/sub/file.txt": "file.txt",
+		"a:b.txt":          "a_b.txt",
+		"two\nlines":       "two_lines",
+		"\xffname":         "_name",
+		"trailing. .":      "trailing___",
+		"CON":              "_CON",
+		"lpt9.log":         "_lpt9.log",
+		"COM0.txt":         "COM0.txt",
+		"console.txt":      "console.txt",
+	} {
+		if got, err := SafeFilename(name); err != nil || got != want {
+			t.Fatalf("SafeFilename(%q) = %q, %v, expected %q", name, got, err, want)
+		}
+	}
+	long, err := SafeFilename(strings.Repeat("é", 200) + ".tar")
+	if err != nil || !strings.HasSuffix(long, ".tar") || len(long) > MaxFilenameBytes {
+		t.Fatalf("SafeFilename of a long name = %q, %v", long, err)
+	}
+	for _, name := range []string{"/etc/passwd", "../up", "a/../../b", ""} {
+		if _, err := SafeFilename(name); !errors.Is(err, ErrUnsafePath) {
+			t.Fatalf("SafeFilename(%q): %v", name, err)
+		}
+	}
+}
+
+// TestSafeJoin covers the entries a hostile archive or manifest can hold.
+// Backslashes and drive letters only separate and root paths on Windows;
+// elsewhere they are characters of a name like any other.
+func TestSafeJoin(t *testing.T) {
+	target := t.TempDir()
+	windows := runtime.GOOS == "windows"
+	for _, tc := range []struct {
+		rel  string
+		safe bool
+	}{
+		{"a.txt", true},
+		{"dir/sub/a.txt", true},
+		{"dir/../a.txt", true},
+		{"../a.txt", false},
+		{"dir/../../a.txt", false},
+		{"/etc/passwd", false},
+		{"", false},
+		{`dir\sub\a.txt`, true},
+		{`..\a.txt`, !windows},
+		{`dir\..\..\a.txt`, !windows},
+		{`C:\Windows\win.ini`, !windows},
+		{`C:a.txt`, !windows},
+		{`\\server\share\a.txt`, !windows},
+		{"NUL", !windows},
+		{"dir/com1.txt", !windows},
+	} {
+		path, err := SafeJoin(target, tc.rel)
+		if !tc.safe {
+			if !errors.Is(err, ErrUnsafePath) {
+				t.Fatalf("SafeJoin(%q) = %q, %v, expected it rejected", tc.rel, path, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("SafeJoin(%q): %v", tc.rel, err)
+		}
+		if rel, err := filepath.Rel(target, path); err != nil || !filepath.IsLocal(rel) {
+			t.Fatalf("SafeJoin(%q) = %q, outside %s", tc.rel, path, target)
+		}
+	}
+}
+
+// TestResolveMetadataFile checks that bare names are looked up in the
+// metadata directory and anything with a directory or, on Windows, a
+// volume is taken as a path.
+func TestResolveMetadataFile(t *testing.T) {
+	v := newTestVault(t)
+	windows := runtime.GOOS == "windows"
+	for _, tc := range []struct {
+		name      string
+		inMetaDir bool
+	}{
+		{"object.vmd", true},
+		{"dir/object.vmd", false},
+		{`dir\object.vmd`, !windows},
+		{`C:object.vmd`, !windows},
+		{`C:\vault\object.vmd`, !windows},
+		{`\\server\share\object.vmd`, !windows},
+	} {
+		want := tc.name
+		if tc.inMetaDir {
+			want = filepath.Join(v.cfg.MetadataDir, tc.name)
+		}
+		if got := ResolveMetadataFile(v.cfg, tc.name); got != want {
+			t.Fatalf("ResolveMetadataFile(%q) = %q, expected %q", tc.name, got, want)
+		}
+	}
+}
+
+func FuzzFilenameMetadata(f *testing.F) {
+	for _, name := range hostileFilenames {
+		f.Add(name)
+	}
+	f.Fuzz(func(t *testing.T, name string) {
+		path := filepath.Join(t.TempDir(), "object.vmd")
+		contents := "dataID: abc\n" + filenameLines(name) + "filesize: 7\n"
+		if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		values, err := metadata.ReadValues(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := objectFilename(values); got != name || values["dataID"] != "abc" || values["filesize"] != "7" {
+			t.Fatalf("%q read back as %q with %v", name, got, values)
+		}
+		if safe, err := SafeFilename(name); err == nil {
+			checkPortable(t, safe)
+		}
+	})
+}
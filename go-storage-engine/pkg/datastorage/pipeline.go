@@ -0,0 +1,402 @@
+package datastorage
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"github.com/techninja8/getvault.io/pkg/config"
+	"github.com/techninja8/getvault.io/pkg/encryption"
+	"github.com/techninja8/getvault.io/pkg/erasurecoding"
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+// A Pipeline stores an object in the stages StoreData goes through, each
+// of which an embedder can replace on its own: the Packer turns the data
+// into what is encrypted, the Cipher encrypts it under the object's key,
+// the Coder erasure codes the cipher text into shards, the Placer picks
+// their locations, the Persister writes them there, and the MetadataSink
+// records the metadata retrieval reads them back by. Keys, dataIDs and
+// proofs are worked out between the stages, as StoreData works them out.
+//
+// The stages run on objects stored whole in memory. An object
+// ChooseLayout would stream is streamed as StoreData streams it, which
+// only the default stages can do.
+
+// ErrStagesNotStreamed is returned for an object too large to store in
+// memory by a Pipeline with stages of its own.
+var ErrStagesNotStreamed = errors.New("objects stored with custom pipeline stages must fit in memory")
+
+// ErrUnknownCipher is returned when retrieving an object encrypted with a
+// cipher that hasn't been registered.
+var ErrUnknownCipher = errors.New("object encrypted with an unregistered cipher")
+
+// Packer turns an object's data into the bytes that are encrypted,
+// returning the metadata lines that record how, for retrieval to undo it.
+type Packer interface {
+	Pack(data []byte, filePath string) (packed []byte, lines string, err error)
+}
+
+// Cipher encrypts the packed data of an object under its key. Ciphers
+// other than vault's own record their Name in the object's metadata, and
+// retrieval decrypts with the Cipher registered under it by
+// RegisterCipher.
+type Cipher interface {
+	// Name identifies the cipher in metadata; vault's own cipher is "".
+	Name() string
+	// AppendEncrypt appends the cipher text of data to dst.
+	AppendEncrypt(dst, data, key []byte) ([]byte, error)
+	Decrypt(cipherText, key []byte) ([]byte, error)
+}
+
+// Coder erasure codes the cipher text of an object into the shards of
+// code, which retrieval decodes them with.
+type Coder interface {
+	Encode(code erasurecoding.Code, cipherText []byte) ([][]byte, error)
+}
+
+// Placer picks the location of each shard of a shard set from the
+// locations a store was given, returning one for each shard.
+type Placer interface {
+	Place(setID string, code erasurecoding.Code, locations []string) ([]string, error)
+}
+
+// Persister writes the shards of a shard set, each to its location.
+// cipherSize is the length of the cipher text they code.
+type Persister interface {
+	Persist(ctx context.Context, setID string, code erasurecoding.Code, cipherSize int64, shards [][]byte, locations []string) error
+}
+
+// MetadataSink records the metadata of a stored object of size bytes and
+// returns the metadata file retrieval finds it by.
+type MetadataSink interface {
+	WriteMetadata(ctx context.Context, dataID, filePath string, size int64, contents string) (string, error)
+}
+
+// Pipeline is the stages storing an object. NewPipeline sets every stage
+// to the one StoreData uses.
+type Pipeline struct {
+	Packer       Packer
+	Cipher       Cipher
+	Coder        Coder
+	Placer       Placer
+	Persister    Persister
+	MetadataSink MetadataSink
+
+	shardStore sharding.ShardStore
+	cfg        *config.Config
+	logger     *zap.Logger
+}
+
+// NewPipeline returns the pipeline StoreData stores objects through,
+// configured by cfg and writing shards to store.
+func NewPipeline(store sharding.ShardStore, cfg *config.Config, logger *zap.Logger) *Pipeline {
+	return &Pipeline{
+		Packer:       TransformPacker{Transforms: cfg.Transforms},
+		Cipher:       AESCipher{Deterministic: cfg.Convergent},
+		Coder:        ErasureCoder{},
+		Placer:       FixedPlacer{},
+		Persister:    &ShardPersister{Store: store, Config: cfg, Logger: logger},
+		MetadataSink: &MetadataDirSink{Config: cfg, Logger: logger},
+		shardStore:   store,
+		cfg:          cfg,
+		logger:       logger,
+	}
+}
+
+// Store stores data through the stages, to the given locations, and
+// returns the object's dataID and metadata file, as StoreData does.
+func (p *Pipeline) Store(data []byte, locations []string, filePath string) (string, string, error) {
+	return p.store(context.Background(), data, locations, filePath)
+}
+
+// defaultStages reports whether every stage is the one NewPipeline sets,
+// as the streaming path needs.
+func (p *Pipeline) defaultStages() bool {
+	transforms, packer := p.Packer.(TransformPacker)
+	aes, cipher := p.Cipher.(AESCipher)
+	_, coder := p.Coder.(ErasureCoder)
+	_, placer := p.Placer.(FixedPlacer)
+	_, persister := p.Persister.(*ShardPersister)
+	_, sink := p.MetadataSink.(*MetadataDirSink)
+	return packer && slices.Equal(transforms.Transforms, p.cfg.Transforms) && cipher && aes.Deterministic == p.cfg.Convergent && coder && placer && persister && sink
+}
+
+// store is Store drawing its retries from the budget in ctx, if any.
+func (p *Pipeline) store(ctx context.Context, data []byte, locations []string, filePath string) (string, string, error) {
+	cfg, logger := p.cfg, p.logger
+	if err := checkObjectSize(cfg, int64(len(data))); err != nil {
+		return "", "", err
+	}
+	if err := CheckFilename(filepath.Base(filePath)); err != nil {
+		return "", "", err
+	}
+	choice, err := ChooseLayout(int64(len(data)), cfg)
+	if err != nil {
+		return "", "", err
+	}
+	if choice.Layout != layoutInMemory {
+		if !p.defaultStages() {
+			return "", "", fmt.Errorf("%w: %d bytes are stored %s", ErrStagesNotStreamed, len(data), choice.Layout)
+		}
+		return storeStream(ctx, bytes.NewReader(data), choice, p.shardStore, cfg, locations, logger, filePath)
+	}
+	ctx, logger = startOperation(ctx, cfg, logger, "store")
+	// The metadata file is named once the dataID is known, but a directory
+	// it can't be written to should fail the store before any shard is written
+	if err := ensureMetadataDir(cfg); err != nil {
+		return "", "", err
+	}
+
+	// Log original data size for debugging
+	logger.Info("Original data size before encryption", zap.Int("size", len(data)))
+
+	// Check if the data starts with ZIP signature for debugging
+	if len(data) >= 4 {
+		logger.Info("Data header signature", zap.String("hex", fmt.Sprintf("%x", data[:4])))
+		if string(data[:4]) != "PK\x03\x04" && strings.HasSuffix(filePath, ".zip") {
+			logger.Warn("Expected ZIP file doesn't have proper signature")
+		}
+	}
+
+	size := len(data)
+	contentHash, err := newContentHash(cfg)
+	if err != nil {
+		logger.Error("Failed to get encryption key", zap.Error(err))
+		return "", "", err
+	}
+	if contentHash != nil {
+		contentHash.Write(data)
+	}
+	var sampler compressSampler
+	sampler.Write(data)
+	compressibility := sampler.Estimate()
+	data, packLines, err := p.Packer.Pack(data, filePath)
+	if err != nil {
+		logger.Error("Failed to transform data", zap.Error(err))
+		return "", "", err
+	}
+
+	masterKey, err := GetEncryptionKey(cfg)
+	if err != nil {
+		logger.Error("Failed to get encryption key", zap.Error(err))
+		return "", "", err
+	}
+	var (
+		key      []byte
+		envelope string
+	)
+	if cfg.Convergent {
+		// Identical data gives identical cipher text and so the same shards
+		key, envelope, err = newConvergentKey(cfg, masterKey, data)
+	} else {
+		key, envelope, err = newObjectKey(cfg, masterKey)
+	}
+	if err != nil {
+		logger.Error("Failed to set up object key", zap.Error(err))
+		return "", "", err
+	}
+
+	// The cipher text is encrypted with room for the parity shards, so
+	// the shards share its buffer. Stored shards are copies with headers.
+	buf := getBuffer(cfg, choice.Code.ShardSetSize(aes.BlockSize+len(data)))
+	defer putBuffer(cfg, buf)
+	cipherText, err := p.Cipher.AppendEncrypt(buf, data, key)
+	if err != nil {
+		logger.Error("Encryption failed", zap.Error(err))
+		return "", "", err
+	}
+	cipherLines := ""
+	if name := p.Cipher.Name(); name != "" {
+		cipherLines = fmt.Sprintf("cipher: %s\ncipher_size: %d\n", name, len(cipherText))
+	}
+
+	// Log encrypted data size for debugging
+	logger.Info("Encrypted data size", zap.Int("size", len(cipherText)))
+
+	// The shards are named after the ciphertext, whatever names the object
+	dataID := GenerateDataID(cipherText)
+	setID, idLines := dataID, ""
+	if contentHash != nil {
+		dataID = hex.EncodeToString(contentHash.Sum(nil))
+		idLines = contentIDLines(cfg, setID)
+	}
+
+	shards, err := p.Coder.Encode(choice.Code, cipherText)
+	if err != nil {
+		logger.Error("Erasure coding failed", zap.Error(err))
+		return "", "", err
+	}
+
+	// Log total shards size for debugging
+	totalShardSize := 0
+	for _, shard := range shards {
+		totalShardSize += len(shard)
+	}
+	logger.Info("Total size of all shards", zap.Int("size", totalShardSize))
+
+	locations, err = p.Placer.Place(setID, choice.Code, locations)
+	if err != nil {
+		return "", "", err
+	}
+	if len(locations) != choice.Code.Total() {
+		return "", "", fmt.Errorf("placed %d shards on %d locations", choice.Code.Total(), len(locations))
+	}
+	if err := p.Persister.Persist(ctx, setID, choice.Code, int64(len(cipherText)), shards, locations); err != nil {
+		return "", "", err
+	}
+
+	proofs, err := shardProofLines(shards, "", true)
+	if err != nil {
+		return "", "", err
+	}
+
+	dataToAppend := metadataHeader(dataID, filePath, int64(size), choice, true, envelope+packLines+cipherLines+idLines+compressLines(compressibility), locations, cfg)
+	dataToAppend += "Proofs: {\n" + proofs + "}\n"
+	newmetadatafile, err := p.MetadataSink.WriteMetadata(ctx, dataID, filePath, int64(size), dataToAppend)
+	if err != nil {
+		return "", "", err
+	}
+
+	logger.Info("Data stored successfully", zap.String("dataID", dataID), zap.Float64("compressRatio", compressibility.Ratio()))
+	return dataID, newmetadatafile, nil
+}
+
+// TransformPacker is the default Packer: it applies Transforms, as named
+// in TRANSFORMS.
+type TransformPacker struct {
+	Transforms []string
+}
+
+func (t TransformPacker) Pack(data []byte, filePath string) ([]byte, string, error) {
+	return applyTransforms(t.Transforms, filePath, data)
+}
+
+// AESCipher is the default Cipher: AES-CFB under a random IV, or with
+// Deterministic under one derived from the data, as convergent
+// encryption needs.
+type AESCipher struct {
+	Deterministic bool
+}
+
+func (AESCipher) Name() string { return "" }
+
+func (c AESCipher) AppendEncrypt(dst, data, key []byte) ([]byte, error) {
+	if c.Deterministic {
+		return encryption.AppendEncryptDeterministic(dst, data, key)
+	}
+	return encryption.AppendEncrypt(dst, data, key)
+}
+
+func (AESCipher) Decrypt(cipherText, key []byte) ([]byte, error) {
+	return encryption.Decrypt(cipherText, key)
+}
+
+// ErasureCoder is the default Coder, coding with the code itself.
+type ErasureCoder struct{}
+
+func (ErasureCoder) Encode(code erasurecoding.Code, cipherText []byte) ([][]byte, error) {
+	return code.Encode(cipherText)
+}
+
+// FixedPlacer is the default Placer: shard i goes to the i-th location.
+type FixedPlacer struct{}
+
+func (FixedPlacer) Place(setID string, code erasurecoding.Code, locations []string) ([]string, error) {
+	return locations, nil
+}
+
+// ShardPersister is the default Persister: it writes the shards, with
+// index headers, to Store, as configured by Config.
+type ShardPersister struct {
+	Store  sharding.ShardStore
+	Config *config.Config
+	Logger *zap.Logger
+}
+
+func (s *ShardPersister) Persist(ctx context.Context, setID string, code erasurecoding.Code, cipherSize int64, shards [][]byte, locations []string) error {
+	sharding.DescribeShards(s.Store, setID, code.Data, code.Parity, cipherSize)
+	return storeShards(ctx, setID, encodeShards(true, shards), locations, s.Store, s.Config, operationLogger(ctx, s.Logger))
+}
+
+// MetadataDirSink is the default MetadataSink: it writes a new metadata
+// file to the metadata directory of Config, named after its template, and
+// starts the object's history.
+type MetadataDirSink struct {
+	Config *config.Config
+	Logger *zap.Logger
+}
+
+func (m *MetadataDirSink) WriteMetadata(ctx context.Context, dataID, filePath string, size int64, contents string) (string, error) {
+	logger := operationLogger(ctx, m.Logger)
+	metadatafile, err := newMetadataPath(m.Config, dataID, filePath)
+	if err != nil {
+		return "", err
+	}
+	// Update metadata file with new fields
+	logger.Info("Updating metadata file", zap.String("metadataFile", metadatafile))
+	if err := writeMetadataFile(metadatafile, contents); err != nil {
+		return "", err
+	}
+	if err := recordEvent(metadatafile, dataID, ObjectEvent{Event: EventStored, Detail: fmt.Sprintf("%d bytes", size)}); err != nil {
+		logger.Warn("Failed to record object history", zap.Error(err))
+	}
+	return metadatafile, nil
+}
+
+var (
+	ciphersMu sync.RWMutex
+	ciphers   = make(map[string]Cipher)
+)
+
+// RegisterCipher makes a Cipher of an embedder's own known to retrieval
+// by its name, which mustn't be empty or taken already.
+func RegisterCipher(c Cipher) error {
+	name := c.Name()
+	if name == "" || strings.ContainsAny(name, ":\n") {
+		return fmt.Errorf("invalid cipher name %q", name)
+	}
+	ciphersMu.Lock()
+	defer ciphersMu.Unlock()
+	if _, ok := ciphers[name]; ok {
+		return fmt.Errorf("cipher %q is registered already", name)
+	}
+	ciphers[name] = c
+	return nil
+}
+
+// decryptObject decrypts the cipher text of an object stored in memory,
+// with the cipher its metadata values name.
+func decryptObject(values map[string]string, cipherText, key []byte) ([]byte, error) {
+	name := values["cipher"]
+	if name == "" {
+		return encryption.Decrypt(cipherText, key)
+	}
+	ciphersMu.RLock()
+	c, ok := ciphers[name]
+	ciphersMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownCipher, name)
+	}
+	return c.Decrypt(cipherText, key)
+}
+
+// cipherSize returns the recorded cipher text length of an object
+// encrypted with a registered cipher, whose overhead vault can't know.
+func cipherSize(values map[string]string) (int, bool) {
+	if values["cipher"] == "" {
+		return 0, false
+	}
+	n, err := strconv.Atoi(values["cipher_size"])
+	return n, err == nil
+}
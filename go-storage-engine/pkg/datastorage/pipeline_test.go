@@ -0,0 +1,216 @@
+package datastorage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/techninja8/getvault.io/pkg/erasurecoding"
+	"github.com/techninja8/getvault.io/pkg/metadata"
+)
+
+func TestTransformPacker(t *testing.T) {
+	data := []byte("hello, packer")
+	packed, lines, err := TransformPacker{}.Pack(bytes.Clone(data), "a.txt")
+	if err != nil || !bytes.Equal(packed, data) || lines != "" {
+		t.Fatalf("packed without transforms to %q, %q, %v", packed, lines, err)
+	}
+	packed, lines, err = TransformPacker{Transforms: []string{"rotate"}}.Pack(bytes.Clone(data), "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(packed, data) || !strings.Contains(lines, "transforms: rotate\n") {
+		t.Fatalf("rotated to %q, recorded %q", packed, lines)
+	}
+	if _, _, err := (TransformPacker{Transforms: []string{"nope"}}).Pack(data, "a.txt"); !errors.Is(err, ErrUnknownTransform) {
+		t.Fatalf("packing with an unknown transform returned %v", err)
+	}
+}
+
+func TestAESCipher(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	data := []byte("hello, cipher")
+	for _, deterministic := range []bool{false, true} {
+		c := AESCipher{Deterministic: deterministic}
+		if c.Name() != "" {
+			t.Fatalf("vault's own cipher is named %q, so it would be recorded", c.Name())
+		}
+		first, err := c.AppendEncrypt(nil, data, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		second, err := c.AppendEncrypt(nil, data, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Equal(first, second) != deterministic {
+			t.Fatalf("deterministic %t encrypted the same data the same way: %t", deterministic, bytes.Equal(first, second))
+		}
+		plain, err := c.Decrypt(first, key)
+		if err != nil || !bytes.Equal(plain, data) {
+			t.Fatalf("decrypted to %q, %v", plain, err)
+		}
+	}
+}
+
+func TestErasureCoder(t *testing.T) {
+	code := erasurecoding.DefaultCode()
+	data := bytes.Repeat([]byte("coder"), 1000)
+	got, err := ErasureCoder{}.Encode(code, bytes.Clone(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := code.Encode(bytes.Clone(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.EqualFunc(got, want, bytes.Equal) {
+		t.Fatal("the coder's shards differ from the code's")
+	}
+}
+
+func TestFixedPlacer(t *testing.T) {
+	v := newTestVault(t)
+	placed, err := FixedPlacer{}.Place("set", erasurecoding.DefaultCode(), v.locations)
+	if err != nil || !slices.Equal(placed, v.locations) {
+		t.Fatalf("placed on %v, %v, expected the locations in order", placed, err)
+	}
+}
+
+func TestShardPersister(t *testing.T) {
+	v := newTestVault(t)
+	code := erasurecoding.DefaultCode()
+	shards, err := code.Encode(bytes.Repeat([]byte("persister"), 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	persister := &ShardPersister{Store: v.store, Config: v.cfg, Logger: v.logger}
+	if err := persister.Persist(context.Background(), "set", code, 900, shards, v.locations); err != nil {
+		t.Fatal(err)
+	}
+	for i, location := range v.locations {
+		stored, err := v.store.RetrieveShard("set", i, location)
+		if err != nil {
+			t.Fatalf("shard %d: %v", i, err)
+		}
+		// Stored with its index header
+		if !bytes.HasSuffix(stored, shards[i]) || len(stored) == len(shards[i]) {
+			t.Fatalf("shard %d stored as %d bytes, not with a header in front of its %d", i, len(stored), len(shards[i]))
+		}
+	}
+}
+
+func TestMetadataDirSink(t *testing.T) {
+	v := newTestVault(t)
+	sink := &MetadataDirSink{Config: v.cfg, Logger: v.logger}
+	first, err := sink.WriteMetadata(context.Background(), "abc", "notes.txt", 5, "dataID: abc\nfilesize: 5\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Dir(first) != v.cfg.MetadataDir {
+		t.Fatalf("metadata written to %s, expected %s", first, v.cfg.MetadataDir)
+	}
+	if id, err := metadata.ReadValue(first, "dataID"); err != nil || id != "abc" {
+		t.Fatalf("metadata records dataID %q, %v", id, err)
+	}
+	second, err := sink.WriteMetadata(context.Background(), "abc", "notes.txt", 5, "dataID: abc\nfilesize: 5\n")
+	if err != nil || second == first {
+		t.Fatalf("second object's metadata went to %s, %v", second, err)
+	}
+	if history, err := ReadHistory(v.cfg.MetadataDir, "abc"); err != nil || len(history) != 2 || history[0].Event != EventStored {
+		t.Fatalf("history %+v, %v", history, err)
+	}
+}
+
+// TestDefaultPipelineIsStoreData checks that objects stored through the
+// default pipeline are what StoreData stores.
+func TestDefaultPipelineIsStoreData(t *testing.T) {
+	v := newTestVault(t)
+	data := randomBytes(t, 100_000)
+	_, viaStoreData, err := StoreData(data, v.store, v.cfg, v.locations, v.logger, "a.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, viaPipeline, err := NewPipeline(v.store, v.cfg, v.logger).Store(data, v.locations, "a.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := func(path string) []string {
+		values, err := metadata.ReadValues(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var keys []string
+		for key := range values {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		return keys
+	}
+	if got, want := keys(viaPipeline), keys(viaStoreData); !slices.Equal(got, want) {
+		t.Fatalf("pipeline metadata has %v, StoreData's %v", got, want)
+	}
+	retrieved, err := RetrieveData(viaPipeline, v.store, v.cfg, v.logger)
+	if err != nil || !bytes.Equal(retrieved, data) {
+		t.Fatalf("retrieved %d bytes, %v", len(retrieved), err)
+	}
+}
+
+// reversedCipher "encrypts" by reversing the data, which is enough to
+// tell it was used.
+type reversedCipher struct{ name string }
+
+func (c reversedCipher) Name() string { return c.name }
+
+func (reversedCipher) AppendEncrypt(dst, data, key []byte) ([]byte, error) {
+	out := append(dst[:0], data...)
+	slices.Reverse(out)
+	return out, nil
+}
+
+func (reversedCipher) Decrypt(cipherText, key []byte) ([]byte, error) {
+	out := bytes.Clone(cipherText)
+	slices.Reverse(out)
+	return out, nil
+}
+
+func TestPipelineCustomCipher(t *testing.T) {
+	v := newTestVault(t)
+	data := []byte("stored with a cipher of the embedder's own")
+	p := NewPipeline(v.store, v.cfg, v.logger)
+	p.Cipher = reversedCipher{name: "test-reversed"}
+	_, metadatafile, err := p.Store(data, v.locations, "custom.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, err := metadata.ReadValues(metadatafile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values["cipher"] != "test-reversed" || values["cipher_size"] != "42" {
+		t.Fatalf("metadata records cipher %q of %q bytes", values["cipher"], values["cipher_size"])
+	}
+	if _, err := RetrieveData(metadatafile, v.store, v.cfg, v.logger); !errors.Is(err, ErrUnknownCipher) {
+		t.Fatalf("retrieving before the cipher is registered returned %v", err)
+	}
+	if err := RegisterCipher(p.Cipher); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterCipher(p.Cipher); err == nil {
+		t.Fatal("a cipher was registered twice")
+	}
+	var out bytes.Buffer
+	if _, err := RetrieveTo(metadatafile, &out, v.store, v.cfg, v.logger); err != nil || !bytes.Equal(out.Bytes(), data) {
+		t.Fatalf("retrieved %q, %v", out.Bytes(), err)
+	}
+
+	// Objects too large for memory are only streamed by the default stages
+	v.cfg.StreamingThreshold = 1
+	if _, _, err := p.Store(data, v.locations, "large.txt"); !errors.Is(err, ErrStagesNotStreamed) {
+		t.Fatalf("streaming through a custom cipher returned %v", err)
+	}
+}
@@ -0,0 +1,128 @@
+package datastorage
+
+import (
+	"context"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"github.com/techninja8/getvault.io/pkg/config"
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+// byteBudget is a semaphore weighted by bytes. storeSegments reserves the
+// memory of each segment from it before reading the segment, so the
+// segments in memory at once stay within it however many workers there are.
+type byteBudget struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	limit int64
+	used  int64
+	peak  int64
+}
+
+func newByteBudget(limit int64) *byteBudget {
+	b := &byteBudget{limit: limit}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// acquire blocks until n bytes fit in the budget. A request larger than the
+// whole budget is admitted once nothing else is in flight, so it can't
+// deadlock. It returns the amount actually reserved.
+func (b *byteBudget) acquire(n int64) int64 {
+	if b.limit <= 0 {
+		return 0
+	}
+	if n > b.limit {
+		n = b.limit
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.used+n > b.limit {
+		b.cond.Wait()
+	}
+	b.used += n
+	if b.used > b.peak {
+		b.peak = b.used
+	}
+	return n
+}
+
+// peakUsed returns the most bytes reserved at once.
+func (b *byteBudget) peakUsed() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.peak
+}
+
+func (b *byteBudget) release(n int64) {
+	if n == 0 {
+		return
+	}
+	b.mu.Lock()
+	b.used -= n
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
+
+// storeShards writes shards to their locations with up to cfg.MaxConcurrency
+// writes running at once. The shards are in memory already, accounted for
+// by storeSegments for streamed objects. Failed writes are retried up to cfg.ShardRetryAttempts times,
+// drawing on the retry budget in ctx. No new writes start after the first
+// failure.
+func storeShards(ctx context.Context, dataID string, shards [][]byte, locations []string, store sharding.ShardStore, cfg *config.Config, logger *zap.Logger) error {
+	concurrency := cfg.MaxConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var (
+		mu       sync.Mutex
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	failed := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return firstErr != nil
+	}
+
+	jobs := make(chan int)
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range jobs {
+				shard := shards[idx]
+				location := locations[idx] // Use locations from the configuration file
+
+				if failed() {
+					continue
+				}
+				logger.Info("Storing shard", zap.Int("shard", idx), zap.String("location", location), zap.Int("size", len(shard)))
+				err := RetryWithBudget(ctx, cfg.ShardRetryAttempts, cfg.ShardRetryDelay, logger, func() error {
+					return sharding.NewShardError("store", dataID, idx, location, store.StoreShard(dataID, idx, shard, location))
+				})
+				if err != nil {
+					logger.Error("Storing shard failed", zap.Int("shard", idx), zap.String("location", location), zap.Error(err))
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	for idx := range shards {
+		if failed() {
+			break
+		}
+		jobs <- idx
+	}
+	close(jobs)
+	wg.Wait()
+	return firstErr
+}
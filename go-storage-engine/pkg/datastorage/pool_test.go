@@ -0,0 +1,122 @@
+package datastorage
+
+import (
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/techninja8/getvault.io/pkg/erasurecoding"
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+func TestByteBudgetBoundsPeak(t *testing.T) {
+	budget := newByteBudget(100)
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(n int64) {
+			defer wg.Done()
+			reserved := budget.acquire(n)
+			time.Sleep(time.Millisecond)
+			budget.release(reserved)
+		}(int64(10 + i%40))
+	}
+	wg.Wait()
+	if peak := budget.peakUsed(); peak > 100 || peak == 0 {
+		t.Fatalf("peak of %d bytes reserved, limit 100", peak)
+	}
+	// More than the whole budget is admitted on its own rather than never
+	if reserved := budget.acquire(1000); reserved != 100 {
+		t.Fatalf("reserved %d bytes of a 1000 byte request, expected the whole budget", reserved)
+	}
+}
+
+// liveSegments counts the segments read by fixedSegments whose shards
+// slowCountingStore hasn't all stored yet, and the most there were at once.
+type liveSegments struct {
+	mu     sync.Mutex
+	live   int
+	peak   int
+	stored map[string]int
+	total  int
+}
+
+func (l *liveSegments) read() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.live++
+	l.peak = max(l.peak, l.live)
+}
+
+func (l *liveSegments) storedShard(setID string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stored[setID]++; l.stored[setID] == l.total {
+		l.live--
+	}
+}
+
+// fixedSegments is a segment source of count segments of size bytes, each
+// said to hold memory bytes.
+type fixedSegments struct {
+	count, size int
+	memory      int64
+	live        *liveSegments
+	n           int
+}
+
+func (f *fixedSegments) MaxSize() int  { return f.size }
+func (f *fixedSegments) Memory() int64 { return f.memory }
+
+func (f *fixedSegments) Next() (*sourceSegment, error) {
+	if f.n == f.count {
+		return nil, io.EOF
+	}
+	f.n++
+	f.live.read()
+	plainText := make([]byte, f.size)
+	plainText[0] = byte(f.n) // Segments are stored under their own IDs
+	return &sourceSegment{plainText: plainText, size: f.size}, nil
+}
+
+// slowCountingStore is a slow shard store telling live of stored shards.
+type slowCountingStore struct {
+	sharding.ShardStore
+	live *liveSegments
+}
+
+func (s *slowCountingStore) StoreShard(dataID string, index int, data []byte, location string) error {
+	time.Sleep(time.Millisecond)
+	err := s.ShardStore.StoreShard(dataID, index, data, location)
+	s.live.storedShard(dataID)
+	return err
+}
+
+// TestStoreSegmentsBoundsMemory checks that the memory of a segment is
+// reserved before it is read, so no more segments are in memory at once
+// than fit in MaxInFlightBytes, however many workers there are.
+func TestStoreSegmentsBoundsMemory(t *testing.T) {
+	v := newTestVault(t)
+	const memory = 1 << 20
+	v.cfg.MaxInFlightBytes = 2*memory + memory/2
+	v.cfg.CPUWorkers = 8
+	v.cfg.MaxConcurrency = 14
+	code := erasurecoding.DefaultCode()
+	live := &liveSegments{stored: map[string]int{}, total: code.Total()}
+	source := &fixedSegments{count: 12, size: 4096, memory: memory, live: live}
+	store := &slowCountingStore{ShardStore: v.store, live: live}
+	key := make([]byte, 32)
+
+	stored, err := storeSegments(context.Background(), source, 0, key, true, code, nil, io.Discard, func(int64) error { return nil }, v.locations, store, v.cfg, v.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.count != source.count {
+		t.Fatalf("stored %d segments, expected %d", stored.count, source.count)
+	}
+	if limit := int(v.cfg.MaxInFlightBytes / memory); live.peak > limit || live.peak == 0 {
+		t.Fatalf("%d segments of %d bytes in memory at once, %d fit in MaxInFlightBytes", live.peak, memory, limit)
+	}
+}
@@ -0,0 +1,153 @@
+package datastorage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif" // Decoders for the formats previews are made of
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/techninja8/getvault.io/pkg/config"
+	"github.com/techninja8/getvault.io/pkg/metadata"
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+// ErrNoPreview is returned when an object has no preview, or a preview
+// can't be made of its contents.
+var ErrNoPreview = errors.New("no preview")
+
+// A preview is a small PNG thumbnail of an image object, stored as an
+// object of its own with the same key and locations, so a UI can show
+// what an object is without retrieving and decrypting all of it. The
+// object's metadata links to the preview with a preview line holding its
+// dataID, and the preview's metadata links back with preview_of.
+
+// Limits on the images previews are made of, so a hostile file can't
+// exhaust memory while being decoded.
+const (
+	maxPreviewSource = 64 << 20 // Bytes read of the image
+	maxPreviewPixels = 64 << 20 // Pixels of the decoded image
+)
+
+// MakePreview returns a PNG thumbnail of a PNG, JPEG or GIF image, scaled
+// down so its longer side is at most size pixels. Other contents, video
+// included, fail with ErrNoPreview.
+func MakePreview(data []byte, size int) ([]byte, error) {
+	if size < 1 {
+		return nil, fmt.Errorf("invalid preview size %d", size)
+	}
+	header, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: not a recognized image", ErrNoPreview)
+	}
+	if header.Width < 1 || header.Height < 1 || int64(header.Width)*int64(header.Height) > maxPreviewPixels {
+		return nil, fmt.Errorf("%w: %dx%d %s image is too large to decode", ErrNoPreview, header.Width, header.Height, format)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNoPreview, err)
+	}
+
+	var out bytes.Buffer
+	if err := png.Encode(&out, thumbnail(img, size)); err != nil {
+		return nil, fmt.Errorf("failed to encode preview: %w", err)
+	}
+	return out.Bytes(), nil
+}
+
+// thumbnail scales an image down to fit a size by size box, averaging the
+// source pixels under each thumbnail pixel. Images that already fit are
+// only copied.
+func thumbnail(src image.Image, size int) *image.NRGBA {
+	bounds := src.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	tw, th := w, h
+	if w > size || h > size {
+		if w >= h {
+			tw, th = size, max(1, h*size/w)
+		} else {
+			tw, th = max(1, w*size/h), size
+		}
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, tw, th))
+	for y := 0; y < th; y++ {
+		y0, y1 := bounds.Min.Y+y*h/th, bounds.Min.Y+max((y+1)*h/th, y*h/th+1)
+		for x := 0; x < tw; x++ {
+			x0, x1 := bounds.Min.X+x*w/tw, bounds.Min.X+max((x+1)*w/tw, x*w/tw+1)
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := src.At(sx, sy).RGBA()
+					r, g, b, a, n = r+uint64(pr), g+uint64(pg), b+uint64(pb), a+uint64(pa), n+1
+				}
+			}
+			dst.Set(x, y, color.RGBA64{R: uint16(r / n), G: uint16(g / n), B: uint16(b / n), A: uint16(a / n)})
+		}
+	}
+	return dst
+}
+
+// StorePreview makes a preview of an object's contents, read from r,
+// stores it next to the object and links the two in their metadata. It
+// returns the preview's dataID. Contents that aren't a recognized image,
+// or are larger than an image a preview is made of, fail with
+// ErrNoPreview and leave the object as it is.
+func StorePreview(metadatafile string, r io.Reader, store sharding.ShardStore, cfg *config.Config, locations []string, logger *zap.Logger) (string, error) {
+	values, err := metadata.ReadValues(metadatafile)
+	if err != nil {
+		return "", fmt.Errorf("error reading metadata file: %w", err)
+	}
+	data, err := io.ReadAll(io.LimitReader(r, maxPreviewSource+1))
+	if err != nil {
+		return "", fmt.Errorf("failed to read object contents: %w", err)
+	}
+	if len(data) > maxPreviewSource {
+		return "", fmt.Errorf("%w: images over %d bytes aren't previewed", ErrNoPreview, maxPreviewSource)
+	}
+	preview, err := MakePreview(data, cfg.PreviewSize)
+	if err != nil {
+		return "", err
+	}
+
+	filename := objectFilename(values)
+	name := truncateFilename(strings.TrimSuffix(filename, filepath.Ext(filename)), MaxFilenameBytes-len(".preview.png")) + ".preview.png"
+	previewID, previewFile, err := StoreData(preview, store, cfg, locations, logger, name)
+	if err != nil {
+		return "", fmt.Errorf("failed to store preview: %w", err)
+	}
+	if err := setMetadataValue(previewFile, "preview_of", values["dataID"]); err != nil {
+		return "", err
+	}
+	if err := setMetadataValue(metadatafile, "preview", previewID); err != nil {
+		return "", err
+	}
+	logger.Info("Preview stored", zap.String("dataID", values["dataID"]), zap.String("preview", previewID), zap.Int("size", len(preview)))
+	return previewID, nil
+}
+
+// RetrievePreview returns the PNG preview of an object, failing with
+// ErrNoPreview if it has none.
+func RetrievePreview(metadatafile string, store sharding.ShardStore, cfg *config.Config, logger *zap.Logger) ([]byte, error) {
+	values, err := metadata.ReadValues(metadatafile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading metadata file: %w", err)
+	}
+	previewID := values["preview"]
+	if previewID == "" {
+		return nil, fmt.Errorf("%w: %s", ErrNoPreview, metadatafile)
+	}
+	previewFile, err := FindMetadataFile(filepath.Dir(metadatafile), previewID)
+	if err != nil {
+		return nil, fmt.Errorf("preview %s is missing: %w", previewID, err)
+	}
+	return RetrieveData(previewFile, store, cfg, logger)
+}
@@ -0,0 +1,127 @@
+package datastorage
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+// testPNG encodes a w by h PNG whose left half is red and right half blue.
+func testPNG(t *testing.T, w, h int) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := range h {
+		for x := range w {
+			c := color.RGBA{R: 255, A: 255}
+			if x >= w/2 {
+				c = color.RGBA{B: 255, A: 255}
+			}
+			img.Set(x, y, c)
+		}
+	}
+	var out bytes.Buffer
+	if err := png.Encode(&out, img); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+// TestStorePreview stores a PNG with a preview and checks that the preview
+// is an object of its own, linked both ways, that retrieves as a
+// thumbnail of the image.
+func TestStorePreview(t *testing.T) {
+	v := newTestVault(t)
+	v.cfg.PreviewSize = 256
+	data := testPNG(t, 800, 600)
+	metadatafile := v.storeObject(t, "photo.png", data)
+	previewID, err := StorePreview(metadatafile, bytes.NewReader(data), v.store, v.cfg, v.locations, v.logger)
+	if err != nil {
+		t.Fatalf("StorePreview: %v", err)
+	}
+
+	objects, err := ListObjects(v.cfg.MetadataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataID, err := MetadataFileReader(metadatafile, "dataID")
+	if err != nil {
+		t.Fatal(err)
+	}
+	links := map[string]ObjectInfo{}
+	for _, object := range objects {
+		links[object.DataID] = object
+	}
+	if len(objects) != 2 || links[dataID].Preview != previewID || links[previewID].PreviewOf != dataID || links[previewID].Filename != "photo.preview.png" {
+		t.Fatalf("catalog lists %+v", objects)
+	}
+
+	preview, err := RetrievePreview(metadatafile, sharding.NewInMemoryShardStore(), v.cfg, v.logger)
+	if err != nil {
+		t.Fatalf("RetrievePreview: %v", err)
+	}
+	img, err := png.Decode(bytes.NewReader(preview))
+	if err != nil {
+		t.Fatalf("preview isn't a PNG: %v", err)
+	}
+	if size := img.Bounds().Size(); size != image.Pt(256, 192) {
+		t.Fatalf("preview is %v, expected 256x192", size)
+	}
+	if r, _, b, _ := img.At(10, 100).RGBA(); r>>8 != 255 || b != 0 {
+		t.Fatal("left of the preview isn't red")
+	}
+	if r, _, b, _ := img.At(245, 100).RGBA(); r != 0 || b>>8 != 255 {
+		t.Fatal("right of the preview isn't blue")
+	}
+	// The object itself is unchanged
+	if got, err := RetrieveData(metadatafile, sharding.NewInMemoryShardStore(), v.cfg, v.logger); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("RetrieveData: %v", err)
+	}
+}
+
+func TestStorePreviewOfNonImage(t *testing.T) {
+	v := newTestVault(t)
+	v.cfg.PreviewSize = 256
+	data := randomBytes(t, 10_000)
+	metadatafile := v.storeObject(t, "clip.mp4", data)
+	if _, err := StorePreview(metadatafile, bytes.NewReader(data), v.store, v.cfg, v.locations, v.logger); !errors.Is(err, ErrNoPreview) {
+		t.Fatalf("StorePreview of random bytes: %v", err)
+	}
+	if _, err := RetrievePreview(metadatafile, v.store, v.cfg, v.logger); !errors.Is(err, ErrNoPreview) {
+		t.Fatalf("RetrievePreview of an object without one: %v", err)
+	}
+	if objects, err := ListObjects(v.cfg.MetadataDir); err != nil || len(objects) != 1 {
+		t.Fatalf("catalog lists %d objects, %v", len(objects), err)
+	}
+}
+
+func TestMakePreviewSizes(t *testing.T) {
+	for _, tc := range []struct {
+		w, h int
+		want image.Point
+	}{
+		{800, 600, image.Pt(64, 48)},
+		{600, 800, image.Pt(48, 64)},
+		{1000, 5, image.Pt(64, 1)},
+		{40, 30, image.Pt(40, 30)}, // Already small enough
+	} {
+		preview, err := MakePreview(testPNG(t, tc.w, tc.h), 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config, err := png.DecodeConfig(bytes.NewReader(preview))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := image.Pt(config.Width, config.Height); got != tc.want {
+			t.Fatalf("%dx%d previewed as %v, expected %v", tc.w, tc.h, got, tc.want)
+		}
+	}
+	if _, err := MakePreview(testPNG(t, 10, 10), 0); err == nil {
+		t.Fatal("made a preview of size 0")
+	}
+}
@@ -0,0 +1,257 @@
+package datastorage
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/techninja8/getvault.io/pkg/erasurecoding"
+	"github.com/techninja8/getvault.io/pkg/proofofinclusion"
+)
+
+// Proof schemes. Objects stored before the "proof_scheme" line existed
+// have raw-shard proofs: a tree over the shards themselves, which can only
+// be checked by rebuilding it from the full set of shards. New objects use
+// shard-digest proofs, where every shard's sha256 is recorded along with
+// its path to the Merkle root and can be checked on its own. Indexed
+// shards also have the checksum of their stored form recorded, so a store
+// that checksums in place can vouch for a shard without sending it back;
+// without headers the digest is that checksum.
+const (
+	proofSchemeRaw    = "raw-shards"
+	proofSchemeDigest = "shard-digest"
+)
+
+// shardSet is a group of shards erasure coded together, the whole of an
+// in-memory object or one segment of a streamed one, and its proofs.
+type shardSet struct {
+	ID      string
+	Scheme  string
+	Root    []byte   // shard-digest only
+	Digests [][]byte // shard-digest only
+	// Checksums of the stored shards, recorded for indexed shards only
+	Checksums []string
+	Proofs    []string
+	Indexed   bool // Shards carry index headers
+	Code      erasurecoding.Code
+}
+
+// label prefixes the proof keys of a shard set, e.g. "segment 3 ".
+func proofKey(label string, i int) string    { return fmt.Sprintf("Proof for %sshard %d", label, i) }
+func digestKey(label string, i int) string   { return fmt.Sprintf("Digest for %sshard %d", label, i) }
+func checksumKey(label string, i int) string { return fmt.Sprintf("Checksum for %sshard %d", label, i) }
+func rootKey(label string) string {
+	if label == "" {
+		return "Merkle root"
+	}
+	return "Merkle root for " + strings.TrimSpace(label)
+}
+
+// shardProofLines computes shard-digest proofs for a freshly encoded shard
+// set, along with its audit challenges, and formats them for the metadata
+// Proofs block.
+func shardProofLines(shards [][]byte, label string, indexed bool) (string, error) {
+	digests := proofofinclusion.ShardDigests(shards)
+	tree, err := proofofinclusion.BuildDigestTree(digests)
+	if err != nil {
+		return "", fmt.Errorf("failed to build Merkle tree: %w", err)
+	}
+
+	lines := fmt.Sprintf("  %s: %x\n", rootKey(label), tree.MerkleRoot())
+	for i, digest := range digests {
+		path, err := proofofinclusion.DigestPath(tree, i)
+		if err != nil {
+			return "", fmt.Errorf("failed to get proof for shard %d: %w", i, err)
+		}
+		lines += fmt.Sprintf("  %s: %x\n", digestKey(label, i), digest)
+		if indexed {
+			lines += fmt.Sprintf("  %s: %s\n", checksumKey(label, i), storedChecksum(true, i, shards[i]))
+		}
+		lines += fmt.Sprintf("  %s: %s\n", proofKey(label, i), path)
+	}
+	challenges, err := auditChallengeLines(shards, label, indexed)
+	if err != nil {
+		return "", err
+	}
+	return lines + challenges, nil
+}
+
+// readProofScheme returns the proof scheme recorded in metadata values.
+func readProofScheme(values map[string]string) (string, error) {
+	scheme, ok := values["proof_scheme"]
+	if !ok {
+		return proofSchemeRaw, nil
+	}
+	switch scheme {
+	case proofSchemeRaw, proofSchemeDigest:
+		return scheme, nil
+	}
+	return "", fmt.Errorf("unsupported proof scheme %q", scheme)
+}
+
+// readShardSet reads the proofs of one shard set from metadata values.
+func readShardSet(values map[string]string, scheme, id, label string) (shardSet, error) {
+	code, err := readCode(values)
+	if err != nil {
+		return shardSet{}, err
+	}
+	total := code.Total()
+	set := shardSet{ID: id, Scheme: scheme, Proofs: make([]string, total), Indexed: readShardIndexed(values), Code: code}
+	for i := range set.Proofs {
+		proof, ok := values[proofKey(label, i)]
+		if !ok {
+			return set, fmt.Errorf("failed to read proof from metadata file: %s not found", proofKey(label, i))
+		}
+		set.Proofs[i] = proof
+	}
+	if scheme != proofSchemeDigest {
+		return set, nil
+	}
+
+	root, err := hex.DecodeString(values[rootKey(label)])
+	if err != nil || len(root) == 0 {
+		return set, fmt.Errorf("invalid %s in metadata file", rootKey(label))
+	}
+	set.Root = root
+	set.Digests = make([][]byte, total)
+	for i := range set.Digests {
+		digest, err := hex.DecodeString(values[digestKey(label, i)])
+		if err != nil || len(digest) == 0 {
+			return set, fmt.Errorf("invalid %s in metadata file", digestKey(label, i))
+		}
+		set.Digests[i] = digest
+	}
+	// Objects stored before checksums were recorded have none
+	if _, ok := values[checksumKey(label, 0)]; set.Indexed && ok {
+		set.Checksums = make([]string, total)
+		for i := range set.Checksums {
+			set.Checksums[i] = values[checksumKey(label, i)]
+		}
+	}
+	return set, nil
+}
+
+// storedChecksum returns the sharding.TransferChecksum shard i should have
+// where it is stored, or "" when none is recorded.
+func (set shardSet) storedChecksum(i int) string {
+	switch {
+	case set.Scheme != proofSchemeDigest:
+		return ""
+	case !set.Indexed:
+		return base64.StdEncoding.EncodeToString(set.Digests[i])
+	case set.Checksums != nil:
+		return set.Checksums[i]
+	}
+	return ""
+}
+
+// checkProofs reports for each shard whether it matches its recorded proof.
+// Nil shards are reported as not matching.
+func (set shardSet) checkProofs(shards [][]byte) ([]bool, error) {
+	valid := make([]bool, len(shards))
+
+	if set.Scheme == proofSchemeDigest {
+		for i, digest := range proofofinclusion.ShardDigests(shards) {
+			if shards[i] == nil || !bytes.Equal(digest, set.Digests[i]) {
+				continue
+			}
+			ok, err := proofofinclusion.VerifyDigest(digest, set.Proofs[i], set.Root)
+			if err != nil {
+				return nil, fmt.Errorf("proof for shard %d: %w", i, err)
+			}
+			valid[i] = ok
+		}
+		return valid, nil
+	}
+
+	missing := 0
+	for _, shard := range shards {
+		if shard == nil {
+			missing++
+		}
+	}
+	if missing > 0 {
+		return set.checkRawPaths(shards), nil
+	}
+
+	// Raw-shard proofs depend on every shard, so the tree is rebuilt from the set.
+	tree, err := proofofinclusion.BuildMerkleTree(shards)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build Merkle tree: %w", err)
+	}
+	for i, shard := range shards {
+		if shard == nil {
+			continue
+		}
+		proof, err := proofofinclusion.GetProof(tree, shard)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get proof for shard %d: %w", i, err)
+		}
+		valid[i] = proof == set.Proofs[i]
+	}
+	return valid, nil
+}
+
+// checkRawPaths checks raw-shard proofs when shards are missing. The tree
+// can't be rebuilt without them, and a nil shard in their place would make
+// every proof fail, so each present shard's recorded path is followed to a
+// root instead. No root is recorded under the raw scheme: the one most
+// shards lead to, if at least two do and no other root ties with it, is
+// taken as the object's. Corrupt shards each lead somewhere else.
+func (set shardSet) checkRawPaths(shards [][]byte) []bool {
+	roots := make([]string, len(shards))
+	counts := make(map[string]int)
+	for i, shard := range shards {
+		if shard == nil {
+			continue
+		}
+		root, err := proofofinclusion.ProofRoot(shard, set.Proofs[i])
+		if err != nil {
+			continue
+		}
+		roots[i] = string(root)
+		counts[roots[i]]++
+	}
+	var best string
+	bestCount, tied := 0, false
+	for root, count := range counts {
+		switch {
+		case count > bestCount:
+			best, bestCount, tied = root, count, false
+		case count == bestCount:
+			tied = true
+		}
+	}
+
+	valid := make([]bool, len(shards))
+	if bestCount < 2 || tied {
+		return valid
+	}
+	for i, root := range roots {
+		valid[i] = root != "" && root == best
+	}
+	return valid
+}
+
+// usableShards returns the shards fit to reconstruct from. Under the
+// shard-digest scheme each shard is checked by itself, shards failing the
+// check are left out and the per-shard results are returned; raw-shard
+// proofs can't be checked one at a time, so all shards are returned as is.
+func (set shardSet) usableShards(shards [][]byte) ([][]byte, []bool, error) {
+	if set.Scheme != proofSchemeDigest {
+		return shards, nil, nil
+	}
+	checks, err := set.checkProofs(shards)
+	if err != nil {
+		return nil, nil, err
+	}
+	usable := make([][]byte, len(shards))
+	for i, ok := range checks {
+		if ok {
+			usable[i] = shards[i]
+		}
+	}
+	return usable, checks, nil
+}
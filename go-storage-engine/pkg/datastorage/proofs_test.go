@@ -0,0 +1,59 @@
+package datastorage
+
+import (
+	"testing"
+
+	"github.com/techninja8/getvault.io/pkg/proofofinclusion"
+)
+
+func TestRawProofsCheckPresentShardsWhenSomeAreMissing(t *testing.T) {
+	shards := make([][]byte, 14)
+	for i := range shards {
+		shards[i] = randomBytes(t, 1000)
+	}
+	// Zero padding makes the last data shards of a small object equal
+	shards[6], shards[7] = make([]byte, 1000), make([]byte, 1000)
+	tree, err := proofofinclusion.BuildMerkleTree(shards)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Proofs as StoreData recorded them before shard digests
+	set := shardSet{Scheme: proofSchemeRaw, Proofs: make([]string, len(shards))}
+	for i, shard := range shards {
+		if set.Proofs[i], err = proofofinclusion.GetProof(tree, shard); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checks, err := set.checkProofs(shards)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, ok := range checks {
+		if !ok {
+			t.Fatalf("intact shard %d failed its proof", i)
+		}
+	}
+
+	// Missing shards no longer fail the others; a corrupt one still fails
+	damaged := make([][]byte, len(shards))
+	copy(damaged, shards)
+	damaged[0], damaged[7], damaged[9] = nil, nil, nil
+	damaged[3] = randomBytes(t, 1000)
+	checks, err = set.checkProofs(damaged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, ok := range checks {
+		want := damaged[i] != nil && i != 3
+		if ok != want {
+			t.Fatalf("shard %d checked %t, expected %t", i, ok, want)
+		}
+	}
+
+	// One shard alone can't vouch for itself
+	alone := make([][]byte, len(shards))
+	alone[5] = shards[5]
+	if checks, _ := set.checkProofs(alone); checks[5] {
+		t.Fatal("a lone shard was taken as matching")
+	}
+}
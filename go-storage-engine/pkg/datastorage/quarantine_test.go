@@ -0,0 +1,116 @@
+package datastorage
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+// corruptShard flips a byte of a shard's body and returns the shard file
+// and its corrupt contents.
+func (v *testVault) corruptShard(t *testing.T, metadatafile string, index int) (string, []byte) {
+	t.Helper()
+	path := v.shardFile(t, metadatafile, index)
+	shard, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shard[shardHeaderSize+10] ^= 0xff
+	if err := os.WriteFile(path, shard, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path, shard
+}
+
+// TestHealQuarantinesCorruptShards corrupts a shard of one object after
+// another at the same location and heals each. The corrupt copy must be
+// moved to the location's quarantine area, intact, before the repair
+// rewrites it, the history must record it, and the location must count
+// each corruption until its disk is flagged for replacement.
+func TestHealQuarantinesCorruptShards(t *testing.T) {
+	v := newTestVault(t)
+	health := sharding.NewHealthTracker(filepath.Join(t.TempDir(), "health.json"))
+	location := v.locations[5]
+	for n := 1; n <= sharding.ReplaceAfterCorruptions; n++ {
+		metadatafile := v.storeObject(t, "object.bin", randomBytes(t, 100_000))
+		dataID, err := MetadataFileReader(metadatafile, "dataID")
+		if err != nil {
+			t.Fatal(err)
+		}
+		original, err := os.ReadFile(v.shardFile(t, metadatafile, 5))
+		if err != nil {
+			t.Fatal(err)
+		}
+		path, corrupt := v.corruptShard(t, metadatafile, 5)
+
+		store := &sharding.HealthTrackingStore{ShardStore: sharding.NewInMemoryShardStore(), Health: health}
+		report, err := CheckData(metadatafile, store, CheckOptions{Heal: true}, v.logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := report.Shards[5].Quarantined
+		if name == "" || report.Repaired != 1 {
+			t.Fatalf("object %d: healed as %+v", n, report)
+		}
+		quarantined, err := os.ReadFile(filepath.Join(location, sharding.QuarantineDir, name))
+		if err != nil || !bytes.Equal(quarantined, corrupt) {
+			t.Fatalf("object %d: quarantined copy %s differs from the corrupt shard, %v", n, name, err)
+		}
+		if repaired, err := os.ReadFile(path); err != nil || !bytes.Equal(repaired, original) {
+			t.Fatalf("object %d: repaired shard differs from the original, %v", n, err)
+		}
+
+		history, err := ReadHistory(v.cfg.MetadataDir, dataID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.ContainsFunc(history, func(e ObjectEvent) bool {
+			return e.Event == EventQuarantined && slices.Equal(e.Shards, []int{5})
+		}) {
+			t.Fatalf("object %d: history %+v records no quarantine of shard 5", n, history)
+		}
+
+		h := health.Snapshot()[location]
+		if h.Corruptions != int64(n) || h.NeedsReplacing() != (n >= sharding.ReplaceAfterCorruptions) {
+			t.Fatalf("after %d corrupt shards the location counts %d, needing replacing %t", n, h.Corruptions, h.NeedsReplacing())
+		}
+	}
+	if health.Score(location) >= health.Score(v.locations[4]) {
+		t.Fatal("corrupt shards didn't lower the location's score")
+	}
+
+	store := sharding.NewInMemoryShardStore()
+	listed, err := sharding.ListQuarantine(store, location)
+	if err != nil || len(listed) != sharding.ReplaceAfterCorruptions {
+		t.Fatalf("quarantine lists %d shards, %v", len(listed), err)
+	}
+	if purged, err := sharding.PurgeQuarantine(store, location, listed[1].Time); err != nil || purged != 1 {
+		t.Fatalf("purging before the second quarantine removed %d, %v", purged, err)
+	}
+	if purged, err := sharding.PurgeQuarantine(store, location, time.Now().Add(time.Second)); err != nil || purged != 2 {
+		t.Fatalf("purging the rest removed %d, %v", purged, err)
+	}
+}
+
+// TestHealLeavesCorruptShardWithoutQuarantine checks that a store that
+// can't quarantine keeps the corrupt shard rather than overwriting it.
+func TestHealLeavesCorruptShardWithoutQuarantine(t *testing.T) {
+	v := newTestVault(t)
+	metadatafile := v.storeObject(t, "object.bin", randomBytes(t, 100_000))
+	path, corrupt := v.corruptShard(t, metadatafile, 5)
+	report, err := CheckData(metadatafile, newBareStore(), CheckOptions{Heal: true}, v.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Shards[5].Verified || report.Shards[5].Quarantined != "" || report.Repaired != 0 {
+		t.Fatalf("corrupt shard checked as %+v, %d repaired", report.Shards[5], report.Repaired)
+	}
+	if kept, err := os.ReadFile(path); err != nil || !bytes.Equal(kept, corrupt) {
+		t.Fatalf("corrupt shard was overwritten, %v", err)
+	}
+}
@@ -0,0 +1,126 @@
+package datastorage
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/techninja8/getvault.io/pkg/metadata"
+)
+
+// Version is the version of this vault binary.
+const Version = "1.1"
+
+// Metadata records the earliest vault version that can read an object,
+// and the features that make it so, in min_reader_version and
+// reader_features lines. Both are worked out from the metadata itself
+// whenever a metadata file is written, and never lowered: a binary that
+// rewrites an object it doesn't fully understand keeps what a newer one
+// recorded. Objects from before min_reader_version was recorded have
+// neither line and are readable by every version.
+const (
+	minReaderVersionKey = "min_reader_version"
+	readerFeaturesKey   = "reader_features"
+)
+
+// ErrReaderTooOld is returned when an object needs a later version of
+// vault to be read.
+var ErrReaderTooOld = errors.New("object needs a newer vault")
+
+// readerFeature is something in an object's metadata that a vault too old
+// to know it would misread, rather than just ignore.
+type readerFeature struct {
+	Name    string
+	Version string   // First version that reads it
+	Keys    []string // Metadata keys it adds; keys like shard_0_candidates are listed once, for shard 0 or segment 0
+	used    func(values map[string]string) bool
+}
+
+// readerFeatures is every feature a reader has to know about. A feature
+// that adds metadata an older reader would misread belongs here, with the
+// version it is released in. Keys an older reader can safely ignore, such
+// as last_access, tier or locked_until, need no entry.
+var readerFeatures = []readerFeature{
+	{"segmented-layout", "1.1", []string{"layout", "segment_size", "segments", "segment_0"}, func(v map[string]string) bool { return v["layout"] == layoutStreaming }},
+	{"content-defined-chunking", "1.1", []string{"chunking"}, func(v map[string]string) bool { return v["chunking"] != "" }},
+	{"indexed-shards", "1.1", []string{"shard_format"}, readShardIndexed},
+	{"shard-digest-proofs", "1.1", []string{"proof_scheme"}, func(v map[string]string) bool { return v["proof_scheme"] == proofSchemeDigest }},
+	{"hashed-shard-names", "1.1", []string{"shard_naming"}, func(v map[string]string) bool { return v["shard_naming"] == "hmac-sha256" }},
+	{"aes-gcm-envelope", "1.1", []string{"encryption", "key_wrap", "recipients"}, func(v map[string]string) bool { return v["encryption"] == envelopeEncryption }},
+	{"convergent-encryption", "1.1", []string{"encryption", "key_wrap", "recipients"}, func(v map[string]string) bool { return v["encryption"] == convergentEncryption }},
+	{"unencrypted-shards", "1.1", []string{"encryption"}, storedAsIs},
+	{"transforms", "1.1", []string{"transforms", "transformed_size"}, func(v map[string]string) bool { return v["transforms"] != "" }},
+	{"registered-cipher", "1.1", []string{"cipher", "cipher_size"}, func(v map[string]string) bool { return v["cipher"] != "" }},
+	{"gf16-coding", "1.1", []string{"erasure_field"}, func(v map[string]string) bool { return v["erasure_field"] != "" }},
+	{"shard-counts", "1.1", []string{dataShardsKey, parityShardsKey}, func(v map[string]string) bool { return v[dataShardsKey] != "" || v[parityShardsKey] != "" }},
+	{"shard-candidates", "1.1", []string{"shard_0_candidates"}, hasCandidates},
+	{"generations", "1.1", []string{shardGenerationKey, proofGenerationKey}, func(v map[string]string) bool {
+		return v[shardGenerationKey] != "" || v[proofGenerationKey] != ""
+	}},
+}
+
+// hasCandidates reports whether any shard has candidate locations.
+func hasCandidates(values map[string]string) bool {
+	for k := range values {
+		if strings.HasPrefix(k, "shard_") && strings.HasSuffix(k, "_candidates") {
+			return true
+		}
+	}
+	return false
+}
+
+// checkReaderVersion fails with ErrReaderTooOld if an object's metadata
+// records that it needs a later vault than this one, naming the features
+// it uses that this vault doesn't know.
+func checkReaderVersion(values map[string]string) error {
+	required := values[minReaderVersionKey]
+	if metadata.Readable(required, Version) {
+		return nil
+	}
+	features := splitCandidates(values[readerFeaturesKey])
+	var unknown []string
+	for _, name := range features {
+		if !slices.ContainsFunc(readerFeatures, func(f readerFeature) bool { return f.Name == name }) {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) == 0 {
+		unknown = features
+	}
+	uses := ""
+	if len(unknown) > 0 {
+		uses = fmt.Sprintf(" (uses: %s)", strings.Join(unknown, ", "))
+	}
+	return fmt.Errorf("%w: this object requires vault >= %s%s, this is vault %s", ErrReaderTooOld, required, uses, Version)
+}
+
+// stampReaderVersion sets the min_reader_version and reader_features
+// lines of a metadata file to what its other lines call for, keeping a
+// later version and the features recorded with it.
+func stampReaderVersion(lines []string) []string {
+	values := metadata.Values(lines)
+	required, features := "", []string(nil)
+	for _, f := range readerFeatures {
+		if !f.used(values) {
+			continue
+		}
+		features = append(features, f.Name)
+		if required == "" || metadata.CompareVersions(f.Version, required) > 0 {
+			required = f.Version
+		}
+	}
+	if recorded, ok := values[minReaderVersionKey]; ok && (required == "" || metadata.CompareVersions(recorded, required) > 0) {
+		required = recorded
+		for _, name := range splitCandidates(values[readerFeaturesKey]) {
+			if !slices.Contains(features, name) {
+				features = append(features, name)
+			}
+		}
+	}
+	if required == "" {
+		return lines
+	}
+	lines = metadata.SetValue(lines, minReaderVersionKey, required)
+	return metadata.SetValue(lines, readerFeaturesKey, strings.Join(features, ","))
+}
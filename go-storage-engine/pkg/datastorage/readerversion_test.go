@@ -0,0 +1,185 @@
+package datastorage
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/techninja8/getvault.io/pkg/config"
+	"github.com/techninja8/getvault.io/pkg/metadata"
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+// originalKeys are the metadata keys of the first metadata format, which
+// every version reads.
+var originalKeys = []string{"dataID", "filename", "filesize", "format", "creation_date", "storage_locations", "shard_0", "Proofs"}
+
+// ignorableKeys are metadata keys added since that a reader too old to
+// know them can skip without misreading the object, so they have no entry
+// in readerFeatures.
+var ignorableKeys = []string{
+	"compress_sampled", "compress_size", // Estimates for planning
+	"key_fingerprint",     // Checked before decrypting, not needed for it
+	"layout_reason",       // Why the layout was chosen
+	"last_access", "tier", // Tiering bookkeeping
+	"locked_until",          // Enforced on deletes, not reads
+	"preview", "preview_of", // Links between objects
+	"deleted", // Only on tombstones
+	minReaderVersionKey, readerFeaturesKey,
+}
+
+// TestReaderFeaturesCoverMetadataKeys stores objects using each feature
+// that adds metadata, and runs the operations that add more, then checks
+// every key written is either in the first format, known to be
+// safe to ignore, or listed by a reader feature. A new metadata key fails
+// here until it is given a feature, or found safe to ignore.
+func TestReaderFeaturesCoverMetadataKeys(t *testing.T) {
+	v := newTestVault(t)
+	var files []string
+	for name, configure := range map[string]func(cfg *config.Config){
+		"plain":      func(cfg *config.Config) {},
+		"streamed":   func(cfg *config.Config) { cfg.StreamingThreshold = 1 },
+		"chunked":    func(cfg *config.Config) { cfg.ChunkSize = minChunkSize },
+		"transforms": func(cfg *config.Config) { cfg.Transforms = []string{"rotate"} },
+		"convergent": func(cfg *config.Config) { cfg.Convergent = true },
+		"gf16": func(cfg *config.Config) {
+			cfg.ErasureField, cfg.DataShards, cfg.ParityShards = "gf16", 10, 4
+		},
+		"hashed names": func(cfg *config.Config) {
+			cfg.ObfuscateShardPaths, cfg.ShardPathKey = true, strings.Repeat("ab", 32)
+		},
+	} {
+		cfg := *v.cfg
+		configure(&cfg)
+		_, metadatafile, err := StoreData(randomBytes(t, 20_000), v.store, &cfg, v.locations, v.logger, name+".bin")
+		if err != nil {
+			t.Fatalf("%s: StoreData: %v", name, err)
+		}
+		files = append(files, metadatafile)
+	}
+
+	// Operations that add to an object's metadata after it is stored
+	v.cfg.PreviewSize = 32
+	image := testPNG(t, 64, 64)
+	metadatafile := v.storeObject(t, "photo.png", image)
+	if _, err := StorePreview(metadatafile, bytes.NewReader(image), v.store, v.cfg, v.locations, v.logger); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(v.shardFile(t, metadatafile, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CheckData(metadatafile, newBareStore(), CheckOptions{Heal: true}, v.logger); err != nil {
+		t.Fatal(err)
+	}
+	if err := LockObject(metadatafile, time.Now().Add(-time.Hour), newBareStore(), v.logger); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddShardCandidate(metadatafile, 2, v.locations[0]); err != nil {
+		t.Fatal(err)
+	}
+	tombstone, err := TrashObject(metadatafile, time.Now(), v.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files = append(files, tombstone)
+
+	known := slices.Concat(originalKeys, ignorableKeys)
+	for _, f := range readerFeatures {
+		known = append(known, f.Keys...)
+	}
+	digits := regexp.MustCompile(`[0-9]+`)
+	for _, file := range files {
+		values, err := metadata.ReadValues(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for key := range values {
+			// Proofs block entries, such as "Digest for shard 3", come
+			// with the feature that writes the block's scheme
+			if strings.Contains(key, " ") {
+				continue
+			}
+			if !slices.Contains(known, digits.ReplaceAllString(key, "0")) {
+				t.Errorf("%s: metadata key %q has no reader feature and isn't known to be safe to ignore", file, key)
+			}
+		}
+	}
+}
+
+func TestReaderFeaturesTable(t *testing.T) {
+	names := make(map[string]bool)
+	for _, f := range readerFeatures {
+		if names[f.Name] || f.Name == "" || strings.Contains(f.Name, ",") {
+			t.Fatalf("feature name %q is empty, repeated or has a comma", f.Name)
+		}
+		names[f.Name] = true
+		if len(f.Keys) == 0 || f.used == nil {
+			t.Fatalf("feature %s lists no keys or has no test for its use", f.Name)
+		}
+		// A feature this binary records must be one it reads
+		if metadata.CompareVersions(f.Version, Version) > 0 {
+			t.Fatalf("feature %s needs vault %s, this is %s", f.Name, f.Version, Version)
+		}
+	}
+}
+
+// TestReaderTooOld stamps an object as needing a later vault and checks
+// reading it fails, naming the features this vault doesn't know, and
+// that rewriting its metadata keeps the stamp.
+func TestReaderTooOld(t *testing.T) {
+	v := newTestVault(t)
+	metadatafile := v.storeObject(t, "object.bin", randomBytes(t, 1000))
+	if got, err := MetadataFileReader(metadatafile, minReaderVersionKey); err != nil || got != "1.1" {
+		t.Fatalf("min_reader_version %q, %v", got, err)
+	}
+	err := rewriteMetadataFile(metadatafile, func(lines []string) ([]string, error) {
+		lines = metadata.SetValue(lines, minReaderVersionKey, "9.0")
+		return metadata.SetValue(lines, readerFeaturesKey, "indexed-shards,quantum-shards"), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = RetrieveData(metadatafile, sharding.NewInMemoryShardStore(), v.cfg, v.logger)
+	if !errors.Is(err, ErrReaderTooOld) || !strings.Contains(err.Error(), "this object requires vault >= 9.0 (uses: quantum-shards), this is vault "+Version) {
+		t.Fatalf("retrieving an object for a later vault: %v", err)
+	}
+	if _, err := CheckData(metadatafile, sharding.NewInMemoryShardStore(), CheckOptions{Deep: true}, v.logger); !errors.Is(err, ErrReaderTooOld) {
+		t.Fatalf("verifying an object for a later vault: %v", err)
+	}
+
+	// Rewriting the metadata doesn't lower what a later vault recorded
+	if err := setMetadataValue(metadatafile, "filename", "renamed.bin"); err != nil {
+		t.Fatal(err)
+	}
+	values, err := metadata.ReadValues(metadatafile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values[minReaderVersionKey] != "9.0" || !strings.Contains(values[readerFeaturesKey], "quantum-shards") {
+		t.Fatalf("rewritten metadata needs %q for %q", values[minReaderVersionKey], values[readerFeaturesKey])
+	}
+}
+
+func TestStampReaderVersion(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		lines         []string
+		version, uses string
+	}{
+		{"original format", []string{"dataID: x", "filesize: 3"}, "", ""},
+		{"streamed", []string{"layout: streaming", "segment_size: 10"}, "1.1", "segmented-layout"},
+		{"recorded later", []string{"shard_format: indexed", "min_reader_version: 2.0", "reader_features: holographic"}, "2.0", "indexed-shards,holographic"},
+		{"recorded earlier", []string{"shard_format: indexed", "min_reader_version: 1.0", "reader_features: old"}, "1.1", "indexed-shards"},
+	} {
+		values := metadata.Values(stampReaderVersion(tc.lines))
+		if values[minReaderVersionKey] != tc.version || values[readerFeaturesKey] != tc.uses {
+			t.Fatalf("%s: stamped %q for %q, expected %q for %q", tc.name, values[minReaderVersionKey], values[readerFeaturesKey], tc.version, tc.uses)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package datastorage
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"slices"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/techninja8/getvault.io/pkg/erasurecoding"
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+// recoveryProbeBytes is the most read from each location to measure its
+// bandwidth, and coded to measure how fast shards are rebuilt.
+var recoveryProbeBytes int64 = 4 << 20
+
+// BandwidthProbe is the read bandwidth measured from one location.
+type BandwidthProbe struct {
+	Location string        `json:"location"`
+	Bytes    int64         `json:"bytes"`
+	Elapsed  time.Duration `json:"elapsed"`
+	Rate     float64       `json:"rate"` // Bytes per second
+	Error    string        `json:"error,omitempty"`
+}
+
+// RecoveryEstimate is how long repairing an object's missing shards would
+// take, as verify --heal and verify-all --heal repair them: every shard
+// set missing shards has enough of its present shards read to rebuild
+// them, and the rebuilt shards written back.
+type RecoveryEstimate struct {
+	MetadataFile string           `json:"metadata_file"`
+	DataID       string           `json:"data_id"`
+	Code         string           `json:"erasure_code"`
+	Missing      []int            `json:"missing"`        // Shards missing from at least one set
+	SetsToRepair int              `json:"sets_to_repair"` // Shard sets missing shards
+	Recoverable  bool             `json:"recoverable"`
+	ReadBytes    int64            `json:"read_bytes"`  // Bytes of present shards read
+	WriteBytes   int64            `json:"write_bytes"` // Bytes of rebuilt shards written
+	Probes       []BandwidthProbe `json:"probes"`
+	// The rate a set's shards are read at, that of the slowest of the
+	// fastest locations it needs, since they are read all at once
+	ReadRate   float64       `json:"read_rate"`
+	CodingRate float64       `json:"coding_rate"` // Bytes of a set decoded per second
+	Read       time.Duration `json:"read"`
+	Coding     time.Duration `json:"coding"`
+	Write      time.Duration `json:"write"`
+	ETA        time.Duration `json:"eta"`
+}
+
+// EstimateRecovery works out how long repairing the missing shards of an
+// object would take. A shard is missing if its recorded location isn't
+// one of locations, the storage locations configured, or the store
+// doesn't have it there. Each configured location holding a present shard
+// is probed by reading up to recoveryProbeBytes of one, and reconstruction
+// by rebuilding shards of a probe set under the object's code. Rebuilt
+// shards are assumed to be written as fast as the shards they come from
+// are read, as their locations can't be probed without writing to them.
+//
+// Only missing shards are looked for; corrupt ones, which verify finds
+// by checking every shard against its proof, add to the work.
+func EstimateRecovery(metadatafile string, locations []string, store sharding.ShardStore, logger *zap.Logger) (*RecoveryEstimate, error) {
+	_, logger = withOperation(context.Background(), logger, "recovery-estimate")
+	explained, err := ExplainObject(metadatafile)
+	if err != nil {
+		return nil, err
+	}
+	code, err := ObjectCode(metadatafile)
+	if err != nil {
+		return nil, err
+	}
+	estimate := &RecoveryEstimate{
+		MetadataFile: metadatafile,
+		DataID:       explained.DataID,
+		Code:         code.String(),
+		Missing:      []int{},
+		Recoverable:  true,
+	}
+
+	// Which shards of which sets are missing, and a present shard at every
+	// location to probe
+	type probeShard struct {
+		setID     string
+		index     int
+		shardSize int
+	}
+	probes := make(map[string]probeShard)
+	var order []string
+	missing := make([][]int, len(explained.Sets))
+	for s, set := range explained.Sets {
+		for _, shard := range set.Shards {
+			location := shard.Locations[0]
+			present := false
+			if slices.Contains(locations, location) {
+				if present, err = sharding.HasShard(store, set.ID, shard.Index, location); err != nil {
+					logger.Warn("Failed to check for shard", zap.String("setID", set.ID), zap.Int("shard", shard.Index), zap.String("location", location), zap.Error(err))
+				}
+			}
+			if !present {
+				missing[s] = append(missing[s], shard.Index)
+				if !slices.Contains(estimate.Missing, shard.Index) {
+					estimate.Missing = append(estimate.Missing, shard.Index)
+				}
+				continue
+			}
+			if _, ok := probes[location]; !ok {
+				probes[location] = probeShard{set.ID, shard.Index, set.ShardSize}
+				order = append(order, location)
+			}
+		}
+	}
+	slices.Sort(estimate.Missing)
+
+	for _, location := range order {
+		shard := probes[location]
+		estimate.Probes = append(estimate.Probes, probeBandwidth(store, shard.setID, shard.index, location, shard.shardSize))
+	}
+	var rates []float64
+	for _, probe := range estimate.Probes {
+		if probe.Error == "" {
+			rates = append(rates, probe.Rate)
+		}
+	}
+	// Sets are rebuilt from the fastest locations, all read at once
+	slices.Sort(rates)
+	slices.Reverse(rates)
+	if len(rates) >= code.Data {
+		estimate.ReadRate = rates[code.Data-1]
+	}
+
+	for s, set := range explained.Sets {
+		if len(missing[s]) == 0 {
+			continue
+		}
+		estimate.SetsToRepair++
+		if len(missing[s]) > code.Parity {
+			estimate.Recoverable = false
+		}
+		estimate.ReadBytes += int64(set.ShardSize) * int64(code.Data)
+		estimate.WriteBytes += int64(set.ShardSize) * int64(len(missing[s]))
+	}
+	if estimate.SetsToRepair == 0 || !estimate.Recoverable {
+		return estimate, nil
+	}
+	if estimate.ReadRate == 0 {
+		return nil, fmt.Errorf("too few locations could be read to measure a rebuild: %d of %d needed", len(rates), code.Data)
+	}
+	if estimate.CodingRate, err = probeCoding(code, estimate.Missing); err != nil {
+		return nil, err
+	}
+
+	for s, set := range explained.Sets {
+		if len(missing[s]) == 0 {
+			continue
+		}
+		// The shards of a set are read, and the rebuilt ones written, all
+		// at once, and sets one after another
+		shardSize := float64(set.ShardSize)
+		estimate.Read += seconds(shardSize / estimate.ReadRate)
+		estimate.Coding += seconds(shardSize * float64(code.Data) / estimate.CodingRate)
+		estimate.Write += seconds(shardSize / estimate.ReadRate)
+	}
+	estimate.ETA = estimate.Read + estimate.Coding + estimate.Write
+	return estimate, nil
+}
+
+// probeBandwidth reads up to recoveryProbeBytes of a shard of shardSize
+// bytes from location and times it. Stores that can't read ranges are
+// read the whole shard.
+func probeBandwidth(store sharding.ShardStore, setID string, index int, location string, shardSize int) BandwidthProbe {
+	probe := BandwidthProbe{Location: location}
+	start := time.Now()
+	if sharding.Probe(store).Range {
+		probe.Bytes = min(recoveryProbeBytes, int64(shardSize))
+		_, err := sharding.RetrieveShardRange(store, setID, index, location, 0, probe.Bytes)
+		if err != nil {
+			probe.Error = err.Error()
+		}
+	} else {
+		shard, err := store.RetrieveShard(setID, index, location)
+		if err != nil {
+			probe.Error = err.Error()
+		}
+		probe.Bytes = int64(len(shard))
+	}
+	probe.Elapsed = time.Since(start)
+	if probe.Error == "" && probe.Elapsed > 0 {
+		probe.Rate = float64(probe.Bytes) / probe.Elapsed.Seconds()
+	}
+	return probe
+}
+
+// probeCoding times rebuilding the missing shards of a probe set under
+// code and returns the bytes of data shards decoded per second.
+func probeCoding(code erasurecoding.Code, missing []int) (float64, error) {
+	data := make([]byte, recoveryProbeBytes)
+	if _, err := rand.Read(data); err != nil {
+		return 0, err
+	}
+	shards, err := code.Encode(data)
+	if err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	for _, i := range missing {
+		shards[i] = nil
+	}
+	if err := code.Reconstruct(shards); err != nil {
+		return 0, fmt.Errorf("failed to probe reconstruction: %w", err)
+	}
+	elapsed := time.Since(start)
+	if elapsed <= 0 {
+		elapsed = time.Nanosecond
+	}
+	return float64(len(data)) / elapsed.Seconds(), nil
+}
+
+// seconds converts a float number of seconds to a duration.
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
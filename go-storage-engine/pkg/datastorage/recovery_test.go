@@ -0,0 +1,92 @@
+package datastorage
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+// throttledStore reads shards no faster than bandwidth bytes a second. It
+// can't read ranges, so probes read whole shards.
+type throttledStore struct {
+	sharding.ShardStore
+	bandwidth float64
+}
+
+func (s *throttledStore) RetrieveShard(dataID string, index int, location string) ([]byte, error) {
+	start := time.Now()
+	shard, err := s.ShardStore.RetrieveShard(dataID, index, location)
+	time.Sleep(time.Duration(float64(len(shard))/s.bandwidth*float64(time.Second)) - time.Since(start))
+	return shard, err
+}
+
+func (s *throttledStore) HasShard(dataID string, index int, location string) (bool, error) {
+	return sharding.HasShard(s.ShardStore, dataID, index, location)
+}
+
+func TestEstimateRecovery(t *testing.T) {
+	v := newTestVault(t)
+	metadatafile := v.storeObject(t, "degraded.bin", randomBytes(t, 8<<20))
+	explained, err := ExplainObject(metadatafile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := ObjectCode(metadatafile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := explained.Sets[0]
+	for _, i := range []int{0, code.Data} {
+		if err := v.store.DeleteShard(set.ID, i, set.Shards[i].Locations[0]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	const bandwidth = 32 << 20
+	store := &throttledStore{ShardStore: v.store, bandwidth: bandwidth}
+	estimate, err := EstimateRecovery(metadatafile, v.locations, store, v.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !estimate.Recoverable || !slices.Equal(estimate.Missing, []int{0, code.Data}) || estimate.SetsToRepair != 1 {
+		t.Fatalf("estimated %+v, expected shards 0 and %d of one set recoverable", estimate, code.Data)
+	}
+	if len(estimate.Probes) != code.Total()-2 {
+		t.Fatalf("probed %d locations, expected the %d holding shards", len(estimate.Probes), code.Total()-2)
+	}
+	if want := int64(set.ShardSize) * int64(code.Data); estimate.ReadBytes != want {
+		t.Fatalf("reads %d bytes, expected %d", estimate.ReadBytes, want)
+	}
+	if want := int64(set.ShardSize) * 2; estimate.WriteBytes != want {
+		t.Fatalf("writes %d bytes, expected %d", estimate.WriteBytes, want)
+	}
+
+	// Reading a shard from each location at once, and writing the two
+	// rebuilt, takes a shard's worth of the bandwidth each; a slow machine
+	// only measures less of it
+	if estimate.ReadRate > bandwidth*1.05 || estimate.ReadRate < bandwidth/4 {
+		t.Fatalf("measured %.0f bytes/s, backend reads %d", estimate.ReadRate, bandwidth)
+	}
+	transfer := 2 * time.Duration(float64(set.ShardSize)/bandwidth*float64(time.Second))
+	if got := estimate.Read + estimate.Write; got < transfer*95/100 || got > transfer*4 {
+		t.Fatalf("estimated %v reading and writing, expected about %v", got, transfer)
+	}
+	if estimate.Coding <= 0 || estimate.ETA != estimate.Read+estimate.Coding+estimate.Write {
+		t.Fatalf("estimated %v coding and %v in all", estimate.Coding, estimate.ETA)
+	}
+
+	// Past the parity the object can't be rebuilt at all
+	for i := 1; i <= code.Parity; i++ {
+		if err := v.store.DeleteShard(set.ID, i, set.Shards[i].Locations[0]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if estimate, err = EstimateRecovery(metadatafile, v.locations, store, v.logger); err != nil {
+		t.Fatal(err)
+	}
+	if estimate.Recoverable || estimate.ETA != 0 {
+		t.Fatalf("estimated %v to rebuild an unrecoverable object", estimate.ETA)
+	}
+}
@@ -0,0 +1,234 @@
+package datastorage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/techninja8/getvault.io/pkg/config"
+	"github.com/techninja8/getvault.io/pkg/metadata"
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+// ErrRefreshRefused is returned when an object's shards as they are now
+// don't decode and decrypt to the object, so new proofs for them would
+// bless bad data.
+var ErrRefreshRefused = errors.New("shards don't hold the object, proofs not refreshed")
+
+// RefreshReport is what refreshing an object's proofs found.
+type RefreshReport struct {
+	MetadataFile string `json:"metadata_file"`
+	DataID       string `json:"data_id"`
+	ShardSets    int    `json:"shard_sets"`
+	// Shards whose old proofs didn't match them in at least one set
+	Changed []int `json:"changed,omitempty"`
+	// The object had raw-shard proofs and now has shard-digest ones
+	Upgraded bool `json:"upgraded,omitempty"`
+}
+
+// RefreshProofs recomputes the proofs of an object from its shards as
+// they are now and rewrites them in its metadata, for when shards were
+// legitimately replaced out of band and verify keeps flagging them. It
+// never trusts the shards on the strength of the old proofs: every shard
+// must be present and the parity consistent with the data, the shards
+// must decode to the cipher text the object's ID (or each segment's ID)
+// is the sha256 of, and that must decrypt, with any transforms undone,
+// to the object's size. Anything less fails with ErrRefreshRefused and
+// leaves the metadata as it was. Objects with raw-shard proofs come out
+// with shard-digest ones, and the new proofs are recorded as from the
+// current shard generation.
+func RefreshProofs(ctx context.Context, metadatafile string, store sharding.ShardStore, cfg *config.Config, logger *zap.Logger) (*RefreshReport, error) {
+	ctx, logger = startOperation(ctx, cfg, logger, "refresh-proofs")
+	values, err := metadata.ReadValues(metadatafile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading metadata file: %w", err)
+	}
+	size, err := strconv.ParseInt(values["filesize"], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid filesize in metadata: %q", values["filesize"])
+	}
+	candidates, err := readShardCandidates(metadatafile)
+	if err != nil {
+		return nil, err
+	}
+	var key []byte
+	if !storedAsIs(values) {
+		if key, err = objectKey(metadatafile, cfg, logger); err != nil {
+			return nil, err
+		}
+	}
+
+	// Old proofs that can't be read are replaced like wrong ones; the
+	// shards are checked by decrypting them instead
+	sets, err := retrievalShardSets(metadatafile, values, true, logger)
+	if err != nil {
+		return nil, err
+	}
+	streamed := readLayout(metadatafile) == layoutStreaming
+	var segments []segment
+	if streamed {
+		if segments, err = readSegments(values); err != nil {
+			return nil, err
+		}
+		chunkSize, err := readChunkSize(values)
+		if err != nil {
+			return nil, err
+		}
+		if chunkSize > 0 {
+			key = chunkKey(key)
+		}
+	}
+
+	report := &RefreshReport{MetadataFile: metadatafile, DataID: values["dataID"], ShardSets: len(sets)}
+	changed := make(map[int]bool)
+	var (
+		proofs    string
+		plainSize int64
+	)
+	for s, set := range sets {
+		label, length := "", storedLength(values, size)
+		if streamed {
+			label, length = fmt.Sprintf("segment %d ", s), segments[s].Size
+		}
+		shards, err := readRefreshShards(ctx, set, candidates, store, cfg, logger)
+		if err != nil {
+			return nil, err
+		}
+		cipherText, err := checkShardContents(set, shards, length)
+		if err != nil {
+			return nil, err
+		}
+
+		plainText := cipherText
+		if key != nil {
+			if plainText, err = decryptObject(values, cipherText, key); err != nil {
+				return nil, fmt.Errorf("%w: %s doesn't decrypt: %v", ErrRefreshRefused, set.ID, err)
+			}
+		}
+		if !streamed {
+			if plainText, err = reverseTransforms(values, plainText); err != nil {
+				return nil, fmt.Errorf("%w: transforms can't be undone: %v", ErrRefreshRefused, err)
+			}
+		}
+		plainSize += int64(len(plainText))
+
+		lines, err := shardProofLines(shards, label, set.Indexed)
+		if err != nil {
+			return nil, err
+		}
+		proofs += lines
+		if set.Proofs == nil {
+			for i := range shards {
+				changed[i] = true
+			}
+			continue
+		}
+		checks, err := set.checkProofs(shards)
+		if err != nil {
+			return nil, err
+		}
+		for i, ok := range checks {
+			if !ok {
+				changed[i] = true
+			}
+		}
+	}
+	if plainSize != size {
+		return nil, fmt.Errorf("%w: shards hold %d bytes, the object has %d", ErrRefreshRefused, plainSize, size)
+	}
+	for i := range candidates {
+		if changed[i] {
+			report.Changed = append(report.Changed, i)
+		}
+	}
+	report.Upgraded = values["proof_scheme"] != proofSchemeDigest
+
+	logger.Info("Updating metadata file", zap.String("metadataFile", metadatafile))
+	err = rewriteMetadataFile(metadatafile, func(lines []string) ([]string, error) {
+		lines = metadata.SetValue(lines, "proof_scheme", proofSchemeDigest)
+		return catchUpProofs(replaceProofsBlock(lines, proofs))
+	})
+	if err != nil {
+		return nil, err
+	}
+	detail := fmt.Sprintf("%d shard sets", len(sets))
+	if err := recordEvent(metadatafile, report.DataID, ObjectEvent{Event: EventRefreshed, Detail: detail, Shards: report.Changed}); err != nil {
+		logger.Warn("Failed to record object history", zap.Error(err))
+	}
+	logger.Info("Proofs refreshed", zap.String("dataID", report.DataID), zap.Ints("changed", report.Changed))
+	return report, nil
+}
+
+// readRefreshShards fetches every shard of a set, failing if any can't be
+// read: proofs are only rewritten for a complete set.
+func readRefreshShards(ctx context.Context, set shardSet, candidates [][]string, store sharding.ShardStore, cfg *config.Config, logger *zap.Logger) ([][]byte, error) {
+	retrieved := make([][]byte, len(candidates))
+	for i := range candidates {
+		err := RetryWithBudget(ctx, cfg.ShardRetryAttempts, cfg.ShardRetryDelay, logger, func() (err error) {
+			retrieved[i], _, err = sharding.RetrieveShardFrom(store, set.ID, i, candidates[i])
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("%w: shard %d of %s can't be read, repair it first: %v", ErrRefreshRefused, i, set.ID, err)
+		}
+	}
+	shards := placeShards(retrieved, set.Indexed, logger)
+	for i, shard := range shards {
+		if shard == nil {
+			return nil, fmt.Errorf("%w: shard %d of %s is missing or damaged, repair it first", ErrRefreshRefused, i, set.ID)
+		}
+	}
+	return shards, nil
+}
+
+// checkShardContents checks that a complete shard set is consistent and
+// decodes to length bytes of cipher text whose sha256 is the set's ID, and
+// returns the cipher text.
+func checkShardContents(set shardSet, shards [][]byte, length int) ([]byte, error) {
+	consistent, err := set.Code.Verify(shards)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrRefreshRefused, set.ID, err)
+	}
+	if !consistent {
+		return nil, fmt.Errorf("%w: parity of %s doesn't match its data", ErrRefreshRefused, set.ID)
+	}
+	decoded := make([]byte, 0, len(shards[0])*set.Code.Data)
+	for _, shard := range shards[:set.Code.Data] {
+		decoded = append(decoded, shard...)
+	}
+	if length < 0 || length > len(decoded) || GenerateDataID(decoded[:length]) != set.ID {
+		return nil, fmt.Errorf("%w: %s doesn't decode to its ID", ErrRefreshRefused, set.ID)
+	}
+	return decoded[:length], nil
+}
+
+// replaceProofsBlock swaps the contents of the Proofs block for proofs,
+// adding the block if there is none.
+func replaceProofsBlock(lines []string, proofs string) []string {
+	block := strings.Split(strings.TrimSuffix(proofs, "\n"), "\n")
+	out := make([]string, 0, len(lines)+len(block))
+	inProofs, found := false, false
+	for _, line := range lines {
+		switch {
+		case line == "Proofs: {":
+			inProofs, found = true, true
+			out = append(out, line)
+			out = append(out, block...)
+		case inProofs && strings.TrimSpace(line) == "}":
+			inProofs = false
+			out = append(out, line)
+		case !inProofs:
+			out = append(out, line)
+		}
+	}
+	if !found {
+		out = append(out, "Proofs: {")
+		out = append(out, block...)
+		out = append(out, "}")
+	}
+	return out
+}
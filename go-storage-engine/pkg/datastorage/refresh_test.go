@@ -0,0 +1,117 @@
+package datastorage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"regexp"
+	"slices"
+	"testing"
+
+	"github.com/techninja8/getvault.io/pkg/metadata"
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+// TestRefreshProofsAfterShardSwap replaces a shard with a copy restored
+// from a secondary, which the metadata's proofs no longer describe, so
+// verify flags it. Refreshing the proofs must accept the shard, since the
+// object still decodes and decrypts, and verify must pass again.
+func TestRefreshProofsAfterShardSwap(t *testing.T) {
+	v := newTestVault(t)
+	data := randomBytes(t, 50_000)
+	metadatafile := v.storeObject(t, "object.bin", data)
+	original, err := os.ReadFile(metadatafile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proofs, err := metadata.ReadValues(metadatafile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := v.shardFile(t, metadatafile, 3)
+	secondary, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, secondary, 0644); err != nil {
+		t.Fatal(err)
+	}
+	stale := regexp.MustCompile(`(?m)^(  `+digestKey("", 3)+`: )[0-9a-f]+$`).ReplaceAll(original, []byte("${1}"+GenerateDataID([]byte("previous copy"))))
+	if bytes.Equal(stale, original) {
+		t.Fatal("no digest for shard 3 in the metadata")
+	}
+	if err := os.WriteFile(metadatafile, stale, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if report, err := CheckData(metadatafile, sharding.NewInMemoryShardStore(), CheckOptions{Deep: true}, v.logger); err != nil || report.Health == ObjectHealthy {
+		t.Fatalf("verify before refreshing: %+v, %v", report, err)
+	}
+
+	report, err := RefreshProofs(context.Background(), metadatafile, sharding.NewInMemoryShardStore(), v.cfg, v.logger)
+	if err != nil {
+		t.Fatalf("RefreshProofs: %v", err)
+	}
+	if !slices.Equal(report.Changed, []int{3}) || report.Upgraded || report.ShardSets != 1 {
+		t.Fatalf("refresh %+v, expected shard 3 changed", *report)
+	}
+	history, err := ReadHistory(v.cfg.MetadataDir, report.DataID)
+	if err != nil || len(history) == 0 {
+		t.Fatalf("history %+v, %v", history, err)
+	}
+	if last := history[len(history)-1]; last.Event != EventRefreshed || !slices.Equal(last.Shards, []int{3}) {
+		t.Fatalf("last event %+v, expected the refresh of shard 3", last)
+	}
+	refreshed, err := metadata.ReadValues(metadatafile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The shard is the one stored, so its proofs are back to the originals
+	keys := []string{rootKey("")}
+	for i := range v.locations {
+		keys = append(keys, digestKey("", i), checksumKey("", i), proofKey("", i))
+	}
+	for _, key := range keys {
+		if refreshed[key] != proofs[key] {
+			t.Fatalf("refreshed %q is %q, expected %q", key, refreshed[key], proofs[key])
+		}
+	}
+	if report, err := CheckData(metadatafile, sharding.NewInMemoryShardStore(), CheckOptions{Deep: true}, v.logger); err != nil || report.Health != ObjectHealthy {
+		t.Fatalf("verify after refreshing: %+v, %v", report, err)
+	}
+	if got, err := RetrieveData(metadatafile, sharding.NewInMemoryShardStore(), v.cfg, v.logger); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("RetrieveData after refreshing: %v", err)
+	}
+}
+
+// TestRefreshProofsRefusesBadShards checks that proofs can't be refreshed
+// to bless a corrupt shard or a set missing one, and that the metadata is
+// left alone.
+func TestRefreshProofsRefusesBadShards(t *testing.T) {
+	v := newTestVault(t)
+	for name, damage := range map[string]func(metadatafile string){
+		"corrupt": func(metadatafile string) { v.corruptShard(t, metadatafile, 5) },
+		"missing": func(metadatafile string) {
+			if err := os.Remove(v.shardFile(t, metadatafile, 5)); err != nil {
+				t.Fatal(err)
+			}
+		},
+	} {
+		metadatafile := v.storeObject(t, name+".bin", randomBytes(t, 50_000))
+		original, err := os.ReadFile(metadatafile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		damage(metadatafile)
+		if _, err := RefreshProofs(context.Background(), metadatafile, sharding.NewInMemoryShardStore(), v.cfg, v.logger); !errors.Is(err, ErrRefreshRefused) {
+			t.Fatalf("refreshing with a %s shard: %v", name, err)
+		}
+		if after, err := os.ReadFile(metadatafile); err != nil || !bytes.Equal(after, original) {
+			t.Fatalf("refusing with a %s shard changed the metadata, %v", name, err)
+		}
+	}
+}
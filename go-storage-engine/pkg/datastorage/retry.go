@@ -1,19 +1,30 @@
 package datastorage
 
 import (
+	"context"
+	"errors"
+	"sync/atomic"
 	"time"
 
 	"go.uber.org/zap"
+
+	"github.com/techninja8/getvault.io/pkg/erasurecoding"
+	"github.com/techninja8/getvault.io/pkg/sharding"
 )
 
+// permanentErrors are errors a retry can't fix.
+var permanentErrors = []error{ErrObjectTooLarge, ErrMaxShardSizeTooSmall, ErrNoMatchingKey, ErrObjectLocked, ErrVerifyOnly, ErrUnknownTransform, errTransformStreaming, errConvergentStreaming, ErrStaleProofs, ErrReaderTooOld, errChunkingField, erasurecoding.ErrUnknownField}
+
 // Retry executes the given function fn and retries it in case of an error.
-// It uses exponential backoff for the retry intervals.
+// It uses exponential backoff for the retry intervals. Errors a retry
+// can't fix, such as ErrObjectTooLarge or a full location, are returned
+// straight away.
 func Retry(attempts int, sleep time.Duration, logger *zap.Logger, fn func() error) error {
 	var err error
 	for i := 0; i < attempts; i++ {
 		err = fn()
-		if err == nil {
-			return nil
+		if err == nil || isPermanent(err) {
+			return err
 		}
 		logger.Warn("Operation failed, retrying...", zap.Int("attempt", i+1), zap.Error(err))
 		time.Sleep(sleep)
@@ -21,3 +32,96 @@ func Retry(attempts int, sleep time.Duration, logger *zap.Logger, fn func() erro
 	}
 	return err
 }
+
+// isPermanent reports whether err is one of permanentErrors, or a shard
+// error sharding.Classify doesn't consider retryable.
+func isPermanent(err error) bool {
+	if !sharding.Retryable(err) {
+		return true
+	}
+	for _, target := range permanentErrors {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// RetryBudget caps the retries made by all the shards of one operation,
+// so a run of failures can't have every shard burn its own attempts.
+type RetryBudget struct {
+	remaining atomic.Int64
+	used      atomic.Int64
+}
+
+// NewRetryBudget returns a budget of n retries. A negative n is unlimited.
+func NewRetryBudget(n int) *RetryBudget {
+	b := &RetryBudget{}
+	b.remaining.Store(int64(n))
+	return b
+}
+
+// take spends one retry, reporting false once the budget is exhausted.
+// A nil budget never runs out.
+func (b *RetryBudget) take() bool {
+	if b == nil {
+		return true
+	}
+	for {
+		n := b.remaining.Load()
+		if n == 0 {
+			return false
+		}
+		if n < 0 || b.remaining.CompareAndSwap(n, n-1) {
+			b.used.Add(1)
+			return true
+		}
+	}
+}
+
+// Used returns the number of retries spent.
+func (b *RetryBudget) Used() int {
+	if b == nil {
+		return 0
+	}
+	return int(b.used.Load())
+}
+
+type retryBudgetKey struct{}
+
+// WithRetryBudget returns a context carrying b.
+func WithRetryBudget(ctx context.Context, b *RetryBudget) context.Context {
+	return context.WithValue(ctx, retryBudgetKey{}, b)
+}
+
+// RetryBudgetFrom returns the budget carried by ctx, or nil.
+func RetryBudgetFrom(ctx context.Context) *RetryBudget {
+	b, _ := ctx.Value(retryBudgetKey{}).(*RetryBudget)
+	return b
+}
+
+// RetryWithBudget calls fn up to attempts times with exponential backoff,
+// drawing every retry from the budget in ctx. Once the budget is spent the
+// last error is returned at once, as are errors a retry can't fix.
+func RetryWithBudget(ctx context.Context, attempts int, sleep time.Duration, logger *zap.Logger, fn func() error) error {
+	budget := RetryBudgetFrom(ctx)
+	var err error
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			if !budget.take() {
+				logger.Warn("Retry budget exhausted, not retrying", zap.Error(err))
+				return err
+			}
+			select {
+			case <-time.After(sleep):
+			case <-ctx.Done():
+				return err
+			}
+			sleep *= 2
+		}
+		if err = fn(); err == nil || isPermanent(err) {
+			return err
+		}
+	}
+	return err
+}
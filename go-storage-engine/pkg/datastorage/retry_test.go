@@ -0,0 +1,142 @@
+package datastorage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"github.com/techninja8/getvault.io/pkg/config"
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+var errFlaky = errors.New("flaky")
+
+func TestRetryBudgetSharedAcrossAttempts(t *testing.T) {
+	budget := NewRetryBudget(2)
+	ctx := WithRetryBudget(context.Background(), budget)
+	calls := 0
+	err := RetryWithBudget(ctx, 3, 0, zap.NewNop(), func() error {
+		return RetryWithBudget(ctx, 3, 0, zap.NewNop(), func() error {
+			calls++
+			return errFlaky
+		})
+	})
+	if !errors.Is(err, errFlaky) {
+		t.Fatalf("returned %v, expected %v", err, errFlaky)
+	}
+	// One call, then one per retry in the budget
+	if calls != 3 || budget.Used() != 2 {
+		t.Fatalf("%d calls and %d retries, expected 3 and 2", calls, budget.Used())
+	}
+}
+
+func TestStartOperationKeepsBudget(t *testing.T) {
+	cfg := &config.Config{MaxRetriesPerOp: 5}
+	ctx := NewOperationContext(cfg)
+	opCtx, _ := startOperation(ctx, cfg, zap.NewNop(), "store")
+	if RetryBudgetFrom(opCtx) != RetryBudgetFrom(ctx) {
+		t.Fatal("the operation got a fresh budget instead of the caller's")
+	}
+	opCtx, _ = startOperation(context.Background(), cfg, zap.NewNop(), "store")
+	if RetryBudgetFrom(opCtx) == nil {
+		t.Fatal("an operation without a caller's budget got none")
+	}
+}
+
+func TestRetryStopsOnPermanentErrors(t *testing.T) {
+	calls := 0
+	err := RetryWithBudget(context.Background(), 3, 0, zap.NewNop(), func() error {
+		calls++
+		return ErrObjectTooLarge
+	})
+	if !errors.Is(err, ErrObjectTooLarge) || calls != 1 {
+		t.Fatalf("%d calls returning %v, expected one returning %v", calls, err, ErrObjectTooLarge)
+	}
+}
+
+// corruptingTransport stands in for a remote store whose network flips a
+// byte of the first corrupt transfers of each shard. Like a remote store
+// should, it checks what arrives against the checksum of the shard at
+// rest and fails the transfer with sharding.ErrTransferIntegrity.
+type corruptingTransport struct {
+	*sharding.InMemoryShardStore
+	corrupt int
+
+	mu        sync.Mutex
+	transfers map[string]int
+	failed    int
+}
+
+func (c *corruptingTransport) RetrieveShard(dataID string, index int, location string) ([]byte, error) {
+	checksum, err := c.ShardChecksum(dataID, index, location)
+	if err != nil {
+		return nil, err
+	}
+	shard, err := c.InMemoryShardStore.RetrieveShard(dataID, index, location)
+	if err != nil {
+		return nil, err
+	}
+	key := fmt.Sprintf("%s/%d", dataID, index)
+	c.mu.Lock()
+	c.transfers[key]++
+	if c.transfers[key] <= c.corrupt {
+		shard[len(shard)/2] ^= 0xff
+	}
+	c.mu.Unlock()
+	if err := sharding.VerifyTransfer(shard, checksum); err != nil {
+		c.mu.Lock()
+		c.failed++
+		c.mu.Unlock()
+		return nil, err
+	}
+	return shard, nil
+}
+
+func TestRetrieveRetriesCorruptTransfers(t *testing.T) {
+	v := newTestVault(t)
+	v.cfg.ShardRetryAttempts = 3
+	v.cfg.MaxRetriesPerOp = -1
+	data := randomBytes(t, 50_000)
+	metadatafile := v.storeObject(t, "object.bin", data)
+
+	store := &corruptingTransport{InMemoryShardStore: sharding.NewInMemoryShardStore(), corrupt: 2, transfers: make(map[string]int)}
+	got, err := RetrieveData(metadatafile, store, v.cfg, v.logger)
+	if err != nil {
+		t.Fatalf("RetrieveData: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("retrieved data differs from what was stored")
+	}
+	// Every shard fetched failed twice in transit and arrived on the third try
+	for key, transfers := range store.transfers {
+		if transfers != 3 {
+			t.Errorf("shard %s was transferred %d times, expected 3", key, transfers)
+		}
+	}
+	if store.failed != 2*len(store.transfers) {
+		t.Fatalf("%d failed transfers of %d shards, expected two each", store.failed, len(store.transfers))
+	}
+}
+
+func TestRetrieveGivesUpOnPersistentlyCorruptTransfers(t *testing.T) {
+	v := newTestVault(t)
+	v.cfg.ShardRetryAttempts = 2
+	v.cfg.MaxRetriesPerOp = -1
+	metadatafile := v.storeObject(t, "object.bin", randomBytes(t, 50_000))
+
+	// Corruption outlasting the retries leaves every shard missing
+	store := &corruptingTransport{InMemoryShardStore: sharding.NewInMemoryShardStore(), corrupt: 2, transfers: make(map[string]int)}
+	if _, err := RetrieveData(metadatafile, store, v.cfg, v.logger); err == nil {
+		t.Fatal("RetrieveData succeeded with every transfer corrupted")
+	}
+	for key, transfers := range store.transfers {
+		if transfers != 2 {
+			t.Errorf("shard %s was transferred %d times, expected 2", key, transfers)
+		}
+	}
+}
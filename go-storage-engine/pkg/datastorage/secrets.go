@@ -0,0 +1,128 @@
+package datastorage
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// ErrSecretsFound is returned when a secrets scan under the block policy
+// finds something that looks like a credential.
+var ErrSecretsFound = errors.New("possible secrets found")
+
+// Policies for what store does when a secrets scan finds something.
+const (
+	SecretsPolicyWarn  = "warn"  // Report the findings and store anyway
+	SecretsPolicyBlock = "block" // Report the findings and refuse to store
+)
+
+// SecretFinding is a line that looks like it holds a credential. The
+// matched text itself is never kept, so reports don't leak it further.
+type SecretFinding struct {
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+	Detector string `json:"detector"`
+}
+
+func (f SecretFinding) String() string {
+	return fmt.Sprintf("%s:%d: %s", f.File, f.Line, f.Detector)
+}
+
+// secretDetectors are the patterns a secrets scan looks for. They aim at
+// credentials with a recognizable shape; a random-looking password in a
+// config file goes unnoticed.
+var secretDetectors = []struct {
+	name    string
+	pattern *regexp.Regexp
+}{
+	{"AWS access key ID", regexp.MustCompile(`\b(AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{"AWS secret access key", regexp.MustCompile(`(?i)aws_?secret_?access_?key["']?\s*[:=]\s*["']?[A-Za-z0-9/+]{40}\b`)},
+	{"private key", regexp.MustCompile(`-----BEGIN ((RSA|EC|DSA|OPENSSH|ENCRYPTED|PGP) )?PRIVATE KEY( BLOCK)?-----`)},
+	{"GitHub token", regexp.MustCompile(`\bgh[pousr]_[A-Za-z0-9]{36,}\b`)},
+	{"Slack token", regexp.MustCompile(`\bxox[abposr]-[A-Za-z0-9-]{10,}`)},
+	{"Google API key", regexp.MustCompile(`\bAIza[0-9A-Za-z_-]{35}\b`)},
+	{"Stripe secret key", regexp.MustCompile(`\b[sr]k_live_[0-9A-Za-z]{24,}\b`)},
+}
+
+// maxScannedLine is the longest line matched at once; longer lines are
+// matched in pieces of this size.
+const maxScannedLine = 1 << 20
+
+// binarySniffSize is how much of a file is checked for NUL bytes before
+// scanning it. Files with them are binary and skipped, as git does.
+const binarySniffSize = 8000
+
+// ScanSecrets looks through text read from r for credentials and returns
+// where it found them, with name as the file. Binary contents are skipped.
+func ScanSecrets(r io.Reader, name string) ([]SecretFinding, error) {
+	br := bufio.NewReaderSize(r, maxScannedLine)
+	if head, _ := br.Peek(binarySniffSize); bytes.IndexByte(head, 0) >= 0 {
+		return nil, nil
+	}
+
+	var findings []SecretFinding
+	line := 1
+	for {
+		chunk, err := br.ReadSlice('\n')
+		for _, detector := range secretDetectors {
+			if detector.pattern.Match(chunk) {
+				findings = append(findings, SecretFinding{File: name, Line: line, Detector: detector.name})
+			}
+		}
+		switch {
+		case err == nil:
+			line++
+		case errors.Is(err, bufio.ErrBufferFull):
+			// The rest of an overlong line
+		case errors.Is(err, io.EOF):
+			return findings, nil
+		default:
+			return findings, fmt.Errorf("failed to scan %s: %w", name, err)
+		}
+	}
+}
+
+// ScanSecretsPath scans a file, or every file in a directory as store
+// would archive it, and returns the findings with paths relative to the
+// directory.
+func ScanSecretsPath(path string) ([]SecretFinding, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return scanSecretsFile(path, filepath.Base(path))
+	}
+
+	var findings []SecretFinding
+	err = filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return fmt.Errorf("error walking directory: %w", err)
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(path, file)
+		if err != nil {
+			return err
+		}
+		found, err := scanSecretsFile(file, filepath.ToSlash(rel))
+		findings = append(findings, found...)
+		return err
+	})
+	return findings, err
+}
+
+func scanSecretsFile(path, name string) ([]SecretFinding, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", name, err)
+	}
+	defer file.Close()
+	return ScanSecrets(file, name)
+}
@@ -0,0 +1,79 @@
+package datastorage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// TestSetupStorage sets up locations that are all temporary directories,
+// so on one filesystem: it must refuse them until --create, then warn
+// that they share a device, tolerate no device failures, and write a
+// configuration labelling each with its host and device.
+func TestSetupStorage(t *testing.T) {
+	v := newTestVault(t)
+	wd := t.TempDir()
+	previous, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(wd); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(previous)
+
+	if _, err := SetupStorage(v.locations, SetupOptions{}, v.logger); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("setting up missing locations without create: %v", err)
+	}
+	if _, err := SetupStorage(v.locations[:5], SetupOptions{Create: true}, v.logger); err == nil {
+		t.Fatal("set up fewer locations than shards")
+	}
+
+	core, logs := observer.New(zapcore.WarnLevel)
+	setup, err := SetupStorage(v.locations, SetupOptions{Create: true}, zap.New(core))
+	if err != nil {
+		t.Fatalf("SetupStorage: %v", err)
+	}
+	for _, location := range v.locations {
+		if info, err := os.Stat(location); err != nil || !info.IsDir() {
+			t.Fatalf("location %s wasn't created: %v", location, err)
+		}
+	}
+
+	device := setup.Locations[0].Device
+	if device == "" || len(setup.Locations) != len(v.locations) {
+		t.Fatalf("inspected locations %+v", setup.Locations)
+	}
+	for _, info := range setup.Locations {
+		if info.Device != device || info.Total == 0 {
+			t.Fatalf("location %+v, expected device %s with its size", info, device)
+		}
+	}
+	if len(setup.SharedDevices) != 1 {
+		t.Fatalf("shared devices %v, expected all locations on one", setup.SharedDevices)
+	}
+	if warnings := logs.FilterMessage("Storage locations share a device and will fail together").Len(); warnings != 1 {
+		t.Fatalf("logged %d shared-device warnings", warnings)
+	}
+	if d := setup.Domains; d.Devices != 1 || d.MaxShardsPerDevice != len(v.locations) || d.DeviceFailures != 0 || d.HostFailures != 0 {
+		t.Fatalf("fault domains %+v, expected one device holding every shard", d)
+	}
+
+	entries, err := readLocationEntries(filepath.Join(wd, setup.File))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(v.locations) {
+		t.Fatalf("configuration lists %d locations", len(entries))
+	}
+	for i, entry := range entries {
+		if entry.Path != v.locations[i] || entry.Labels["device"] != device || entry.Labels["host"] != setup.Locations[i].Host {
+			t.Fatalf("configuration entry %+v", entry)
+		}
+	}
+}
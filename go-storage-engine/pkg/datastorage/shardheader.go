@@ -0,0 +1,169 @@
+package datastorage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"go.uber.org/zap"
+
+	"github.com/techninja8/getvault.io/pkg/erasurecoding"
+)
+
+// Shards of objects stored with shard_format "indexed" start with a small
+// header recording their index:
+//
+//	"VSH" | version 1 | index (uint16, big endian)
+//
+// Reed-Solomon trusts the position of each shard, so a shard that ends up
+// in another's slot, say after two shard files were swapped between
+// locations, would otherwise decode to garbage without any error. Objects
+// stored before the header was added have no shard_format line and their
+// shards are read as they are.
+const (
+	shardFormatIndexed = "indexed"
+	shardHeaderSize    = 6
+)
+
+var (
+	shardHeaderMagic = []byte("VSH\x01")
+	errShardHeader   = errors.New("shard has no valid index header")
+)
+
+// readShardIndexed reports whether an object's shards carry index headers.
+func readShardIndexed(values map[string]string) bool {
+	return values["shard_format"] == shardFormatIndexed
+}
+
+// encodeShard returns shard i as it is written to a store.
+func encodeShard(indexed bool, i int, shard []byte) []byte {
+	if !indexed {
+		return shard
+	}
+	out := make([]byte, shardHeaderSize+len(shard))
+	copy(out, shardHeaderMagic)
+	binary.BigEndian.PutUint16(out[len(shardHeaderMagic):], uint16(i))
+	copy(out[shardHeaderSize:], shard)
+	return out
+}
+
+// storedChecksum returns the sharding.TransferChecksum of shard i as it is
+// written to a store, without building the encoded copy.
+func storedChecksum(indexed bool, i int, shard []byte) string {
+	h := sha256.New()
+	if indexed {
+		header := make([]byte, shardHeaderSize)
+		copy(header, shardHeaderMagic)
+		binary.BigEndian.PutUint16(header[len(shardHeaderMagic):], uint16(i))
+		h.Write(header)
+	}
+	h.Write(shard)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// encodeShards returns a shard set as it is written to a store.
+func encodeShards(indexed bool, shards [][]byte) [][]byte {
+	out := make([][]byte, len(shards))
+	for i, shard := range shards {
+		out[i] = encodeShard(indexed, i, shard)
+	}
+	return out
+}
+
+// encodeStoredShards erasure codes data under code straight into the
+// shards as they are written to a store, headers and all, with
+// erasurecoding.EncodeStream: the parity is never held anywhere else, and
+// the shards aren't copied again to put headers in front of them. It
+// returns the stored shards and the shards within them.
+func encodeStoredShards(code erasurecoding.Code, data []byte, indexed bool) ([][]byte, [][]byte, error) {
+	header := 0
+	if indexed {
+		header = shardHeaderSize
+	}
+	size := header + code.ShardSize(len(data))
+	backing := make([]byte, 0, size*code.Total())
+	stored := make([]*shardBuffer, code.Total())
+	writers := make([]io.Writer, code.Total())
+	for i := range stored {
+		stored[i] = &shardBuffer{buf: backing[i*size : i*size : (i+1)*size]}
+		if indexed {
+			stored[i].buf = binary.BigEndian.AppendUint16(append(stored[i].buf, shardHeaderMagic...), uint16(i))
+		}
+		writers[i] = stored[i]
+	}
+	if err := code.EncodeStream(writers, bytes.NewReader(data), int64(len(data))); err != nil {
+		return nil, nil, err
+	}
+	out, shards := make([][]byte, len(stored)), make([][]byte, len(stored))
+	for i, s := range stored {
+		out[i], shards[i] = s.buf, s.buf[header:]
+	}
+	return out, shards, nil
+}
+
+// storedShardsSize returns the bytes of the shards encodeStoredShards
+// codes size bytes into.
+func storedShardsSize(code erasurecoding.Code, size int, indexed bool) int64 {
+	header := 0
+	if indexed {
+		header = shardHeaderSize
+	}
+	return int64(header+code.ShardSize(size)) * int64(code.Total())
+}
+
+// shardBuffer is a writer appending to a shard's preallocated memory.
+type shardBuffer struct{ buf []byte }
+
+func (s *shardBuffer) Write(p []byte) (int, error) {
+	s.buf = append(s.buf, p...)
+	return len(p), nil
+}
+
+// decodeShard splits a stored shard into the index in its header and its
+// contents.
+func decodeShard(data []byte) (int, []byte, error) {
+	if len(data) < shardHeaderSize || !bytes.HasPrefix(data, shardHeaderMagic) {
+		return 0, nil, errShardHeader
+	}
+	return int(binary.BigEndian.Uint16(data[len(shardHeaderMagic):])), data[shardHeaderSize:], nil
+}
+
+// placeShards turns shards as retrieved into shards ready to decode. With
+// indexed shards, headers are checked and stripped; a shard found in
+// another's slot is moved to its own slot if that is empty and dropped
+// otherwise, and a shard without a valid header is dropped. Dropped shards
+// are left nil, like missing ones.
+func placeShards(retrieved [][]byte, indexed bool, logger *zap.Logger) [][]byte {
+	if !indexed {
+		return retrieved
+	}
+	placed := make([][]byte, len(retrieved))
+	misplaced := make(map[int][]byte)
+	for slot, data := range retrieved {
+		if data == nil {
+			continue
+		}
+		index, shard, err := decodeShard(data)
+		switch {
+		case err != nil:
+			logger.Warn("Dropping shard", zap.Int("slot", slot), zap.Error(err))
+		case index >= len(retrieved):
+			logger.Warn("Dropping shard with an out of range index", zap.Int("slot", slot), zap.Int("index", index))
+		case index != slot:
+			logger.Warn("Shard found in another shard's slot", zap.Int("slot", slot), zap.Int("index", index))
+			misplaced[index] = shard
+		default:
+			placed[slot] = shard
+		}
+	}
+	for index, shard := range misplaced {
+		if placed[index] == nil {
+			logger.Info("Moved shard back to its own slot", zap.Int("index", index))
+			placed[index] = shard
+		}
+	}
+	return placed
+}
@@ -0,0 +1,137 @@
+package datastorage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/techninja8/getvault.io/pkg/erasurecoding"
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+// shardFile returns the path of shard index of the object stored in
+// metadatafile, at the location it was stored to.
+func (v *testVault) shardFile(t *testing.T, metadatafile string, index int) string {
+	t.Helper()
+	dataID, err := MetadataFileReader(metadatafile, "dataID")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(v.locations[index], sharding.PlainShardName(dataID, index))
+}
+
+// misplacedSlots returns the slots the logs record a shard found in
+// another shard's slot in.
+func misplacedSlots(logs *observer.ObservedLogs) map[int64]int64 {
+	slots := map[int64]int64{}
+	for _, entry := range logs.FilterMessage("Shard found in another shard's slot").All() {
+		fields := entry.ContextMap()
+		slots[fields["slot"].(int64)] = fields["index"].(int64)
+	}
+	return slots
+}
+
+// TestRetrieveSwappedShards swaps the files of shards 0 and 1 between
+// their locations, as a manual move gone wrong would, and checks that
+// retrieval tells them apart by the index in their headers and moves each
+// back to its slot, rather than decoding them in the wrong order.
+func TestRetrieveSwappedShards(t *testing.T) {
+	v := newTestVault(t)
+	data := randomBytes(t, 100_000)
+	metadatafile := v.storeObject(t, "object.bin", data)
+	first, second := v.shardFile(t, metadatafile, 0), v.shardFile(t, metadatafile, 1)
+	shard0, err := os.ReadFile(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shard1, err := os.ReadFile(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(first, shard1, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(second, shard0, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	core, logs := observer.New(zapcore.InfoLevel)
+	got, err := RetrieveData(metadatafile, sharding.NewInMemoryShardStore(), v.cfg, zap.New(core))
+	if err != nil {
+		t.Fatalf("RetrieveData: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("swapped shards decoded to other data")
+	}
+	if slots := misplacedSlots(logs); len(slots) != 2 || slots[0] != 1 || slots[1] != 0 {
+		t.Fatalf("misplaced shards logged in slots %v, expected shard 1 in slot 0 and 0 in 1", slots)
+	}
+}
+
+// TestRetrieveRejectsDuplicatedShards copies shard 0 over more shards
+// than there is parity. Each copy is rejected by its header index, since
+// slot 0 already holds shard 0, which leaves too few shards to decode:
+// retrieval fails instead of decoding copies of one shard as others.
+func TestRetrieveRejectsDuplicatedShards(t *testing.T) {
+	v := newTestVault(t)
+	metadatafile := v.storeObject(t, "object.bin", randomBytes(t, 100_000))
+	shard0, err := os.ReadFile(v.shardFile(t, metadatafile, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	copies := erasurecoding.ParityShards + 1
+	for index := 1; index <= copies; index++ {
+		if err := os.WriteFile(v.shardFile(t, metadatafile, index), shard0, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	core, logs := observer.New(zapcore.InfoLevel)
+	if _, err := RetrieveData(metadatafile, sharding.NewInMemoryShardStore(), v.cfg, zap.New(core)); !errors.Is(err, ErrInsufficientShards) {
+		t.Fatalf("RetrieveData with %d copies of shard 0: %v", copies, err)
+	}
+	slots := misplacedSlots(logs)
+	if len(slots) != copies {
+		t.Fatalf("misplaced shards logged in slots %v, expected %d", slots, copies)
+	}
+	for slot, index := range slots {
+		if index != 0 {
+			t.Fatalf("slot %d logged holding shard %d, expected 0", slot, index)
+		}
+	}
+}
+
+func TestPlaceShards(t *testing.T) {
+	header := func(index int, body string) []byte {
+		shard := make([]byte, shardHeaderSize, shardHeaderSize+len(body))
+		copy(shard, shardHeaderMagic)
+		binary.BigEndian.PutUint16(shard[len(shardHeaderMagic):], uint16(index))
+		return append(shard, body...)
+	}
+	for _, tc := range []struct {
+		name      string
+		retrieved [][]byte
+		want      []string
+	}{
+		{"in place", [][]byte{header(0, "a"), header(1, "b"), header(2, "c")}, []string{"a", "b", "c"}},
+		{"swapped", [][]byte{header(1, "b"), header(0, "a"), header(2, "c")}, []string{"a", "b", "c"}},
+		{"moved to a missing slot", [][]byte{header(0, "a"), header(2, "c"), nil}, []string{"a", "", "c"}},
+		{"duplicate dropped", [][]byte{header(0, "a"), header(0, "x"), header(2, "c")}, []string{"a", "", "c"}},
+		{"no header dropped", [][]byte{header(0, "a"), []byte("bare"), header(2, "c")}, []string{"a", "", "c"}},
+		{"index out of range dropped", [][]byte{header(0, "a"), header(7, "x"), header(2, "c")}, []string{"a", "", "c"}},
+	} {
+		placed := placeShards(tc.retrieved, true, zap.NewNop())
+		for slot, want := range tc.want {
+			if string(placed[slot]) != want || (want == "") != (placed[slot] == nil) {
+				t.Fatalf("%s: slot %d holds %q, expected %q", tc.name, slot, placed[slot], want)
+			}
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package datastorage
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/techninja8/getvault.io/pkg/config"
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+// ShardStoreBuilder returns a builder with the layers cfg.ShardStoreLayers
+// names, checked to work together. The health layer records into health
+// and the faults layer injects cfg.FaultPlan. cfg.VerifyOnWrite adds the
+// verify-writes layer.
+func ShardStoreBuilder(cfg *config.Config, health *sharding.HealthTracker) (*sharding.StoreBuilder, error) {
+	builder := sharding.NewStoreBuilder()
+	for _, name := range cfg.ShardStoreLayers {
+		var m sharding.Middleware
+		switch name {
+		case "none":
+			continue
+		case sharding.LayerReadOnly:
+			m = sharding.ReadOnly()
+		case sharding.LayerHealth:
+			m = sharding.TrackHealth(health)
+		case sharding.LayerVerifyWrites:
+			m = sharding.VerifyWrites()
+		case sharding.LayerFaults:
+			if cfg.FaultPlan == "" {
+				return nil, fmt.Errorf("the %s layer needs FAULT_PLAN", sharding.LayerFaults)
+			}
+			plan, err := sharding.ParseFaultPlan(cfg.FaultPlan)
+			if err != nil {
+				return nil, fmt.Errorf("invalid FAULT_PLAN: %w", err)
+			}
+			m = sharding.InjectFaults(plan)
+		}
+		if err := builder.Use(name, m); err != nil {
+			return nil, fmt.Errorf("invalid SHARD_STORE_LAYERS: %w", err)
+		}
+	}
+	// VERIFY_ON_WRITE adds the layer unless it was named already
+	if cfg.VerifyOnWrite && !slices.Contains(builder.Chain(), sharding.LayerVerifyWrites) {
+		if err := builder.Use(sharding.LayerVerifyWrites, sharding.VerifyWrites()); err != nil {
+			return nil, err
+		}
+	}
+	if err := builder.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid SHARD_STORE_LAYERS: %w", err)
+	}
+	return builder, nil
+}
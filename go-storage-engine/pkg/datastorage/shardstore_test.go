@@ -0,0 +1,106 @@
+package datastorage
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+func TestShardStoreBuilderFromConfig(t *testing.T) {
+	v := newTestVault(t)
+	health := sharding.NewHealthTracker(v.cfg.HealthFile)
+	metadatafile := v.storeObject(t, "object.bin", randomBytes(t, 10_000))
+
+	for _, tc := range []struct {
+		layers []string
+		plan   string
+		chain  []string
+	}{
+		{layers: nil, chain: nil},
+		{layers: []string{"none"}, chain: nil},
+		{layers: []string{"health"}, chain: []string{sharding.LayerHealth}},
+		{layers: []string{"health", "readonly"}, chain: []string{sharding.LayerReadOnly, sharding.LayerHealth}},
+		{layers: []string{"faults", "readonly"}, plan: "0:drop", chain: []string{sharding.LayerReadOnly, sharding.LayerFaults}},
+	} {
+		v.cfg.ShardStoreLayers, v.cfg.FaultPlan = tc.layers, tc.plan
+		builder, err := ShardStoreBuilder(v.cfg, health)
+		if err != nil {
+			t.Fatalf("layers %v: %v", tc.layers, err)
+		}
+		if chain := builder.Chain(); !slices.Equal(chain, tc.chain) {
+			t.Fatalf("layers %v chained as %v, expected %v", tc.layers, chain, tc.chain)
+		}
+		store, err := builder.Build(v.store)
+		if err != nil {
+			t.Fatalf("layers %v: Build: %v", tc.layers, err)
+		}
+		// Every chain reads the object; only the faults layer loses a shard
+		report, err := CheckData(metadatafile, store, CheckOptions{}, v.logger)
+		if err != nil {
+			t.Fatalf("layers %v: CheckData: %v", tc.layers, err)
+		}
+		if want := tc.plan == ""; (report.Health == ObjectHealthy) != want {
+			t.Fatalf("layers %v: object is %s", tc.layers, report.Health)
+		}
+		err = store.StoreShard("other", 0, []byte("shard"), v.locations[0])
+		if readOnly := slices.Contains(tc.layers, "readonly"); errors.Is(err, sharding.ErrReadOnly) != readOnly {
+			t.Fatalf("layers %v: StoreShard: %v", tc.layers, err)
+		}
+	}
+
+	for _, tc := range []struct {
+		layers []string
+		plan   string
+	}{
+		{layers: []string{"metrics"}},
+		{layers: []string{"faults"}},
+		{layers: []string{"faults"}, plan: "0:melt"},
+		{layers: []string{"health", "faults"}, plan: "0:drop"},
+		{layers: []string{"health", "health"}},
+	} {
+		v.cfg.ShardStoreLayers, v.cfg.FaultPlan = tc.layers, tc.plan
+		if _, err := ShardStoreBuilder(v.cfg, health); err == nil {
+			t.Fatalf("layers %v with plan %q accepted", tc.layers, tc.plan)
+		}
+	}
+}
+
+// corruptingStore hands back every shard with its first byte flipped.
+type corruptingStore struct {
+	sharding.ShardStore
+}
+
+func (s *corruptingStore) RetrieveShard(dataID string, index int, location string) ([]byte, error) {
+	shard, err := s.ShardStore.RetrieveShard(dataID, index, location)
+	if err == nil && len(shard) > 0 {
+		shard[0] ^= 1
+	}
+	return shard, err
+}
+
+func TestVerifyOnWriteFailsStores(t *testing.T) {
+	v := newTestVault(t)
+	v.cfg.VerifyOnWrite = true
+	builder, err := ShardStoreBuilder(v.cfg, sharding.NewHealthTracker(v.cfg.HealthFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chain := builder.Chain(); !slices.Equal(chain, []string{sharding.LayerVerifyWrites}) {
+		t.Fatalf("VERIFY_ON_WRITE chained %v", chain)
+	}
+	store, err := builder.Build(&corruptingStore{ShardStore: v.store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := StoreData(randomBytes(t, 10_000), store, v.cfg, v.locations, v.logger, "object.bin"); !errors.Is(err, sharding.ErrWriteUnconfirmed) {
+		t.Fatalf("store on a disk that reads back wrong: %v", err)
+	}
+
+	// Named in SHARD_STORE_LAYERS as well, the layer is added once
+	v.cfg.ShardStoreLayers = []string{sharding.LayerVerifyWrites}
+	if _, err := ShardStoreBuilder(v.cfg, sharding.NewHealthTracker(v.cfg.HealthFile)); err != nil {
+		t.Fatal(err)
+	}
+}
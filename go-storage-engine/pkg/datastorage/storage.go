@@ -1,15 +1,20 @@
 package datastorage
 
 import (
-	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"io"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -18,18 +23,44 @@ import (
 	"github.com/techninja8/getvault.io/pkg/config"
 	"github.com/techninja8/getvault.io/pkg/encryption"
 	"github.com/techninja8/getvault.io/pkg/erasurecoding"
-	"github.com/techninja8/getvault.io/pkg/proofofinclusion"
+	"github.com/techninja8/getvault.io/pkg/metadata"
 	"github.com/techninja8/getvault.io/pkg/sharding"
 )
 
 var (
 	errMissingKey       = errors.New("encryption key not set in configuration")
 	errInvalidKeyLength = errors.New("invalid encryption key length; must be 32 bytes for AES-256")
-	errInvalidLocations = errors.New("invalid storage location configuration file; must contain 14 locations")
+	errInvalidLocations = errors.New("invalid storage location configuration file")
+
+	// ErrVerifyOnly is returned for anything that needs an encryption key
+	// when VERIFY_ONLY is set.
+	ErrVerifyOnly = errors.New("verify-only mode doesn't use encryption keys, so it can't read or write object contents")
+
+	ErrObjectNotFound     = errors.New("no metadata file found for object")
+	ErrInsufficientShards = errors.New("insufficient shards for reconstruction")
+	ErrObjectTooLarge     = errors.New("object exceeds the maximum object size")
+	// ErrProofsUnreadable is returned when retrieving an object whose
+	// proofs can't be read, so its shards can't be checked.
+	ErrProofsUnreadable = errors.New("object proofs can't be read")
 )
 
+// checkObjectSize fails with ErrObjectTooLarge when size is over
+// cfg.MaxObjectSize. Zero means unlimited.
+func checkObjectSize(cfg *config.Config, size int64) error {
+	if cfg.MaxObjectSize > 0 && size > cfg.MaxObjectSize {
+		return fmt.Errorf("%w: %d bytes, limit %d", ErrObjectTooLarge, size, cfg.MaxObjectSize)
+	}
+	return nil
+}
+
 // GetEncryptionKey converts the configuration key from hex.
 func GetEncryptionKey(cfg *config.Config) ([]byte, error) {
+	if cfg.VerifyOnly {
+		return nil, ErrVerifyOnly
+	}
+	if cfg.EncryptionKey == "" {
+		return nil, errMissingKey
+	}
 	key, err := hex.DecodeString(cfg.EncryptionKey)
 	if err != nil {
 		return nil, err
@@ -40,6 +71,28 @@ func GetEncryptionKey(cfg *config.Config) ([]byte, error) {
 	return key, nil
 }
 
+// GetShardPathKey returns the key shard filenames are obfuscated with. It
+// is SHARD_PATH_KEY when set, otherwise derived from the encryption key.
+func GetShardPathKey(cfg *config.Config) ([]byte, error) {
+	if cfg.ShardPathKey != "" {
+		key, err := hex.DecodeString(cfg.ShardPathKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid shard path key: %w", err)
+		}
+		return key, nil
+	}
+	key, err := GetEncryptionKey(cfg)
+	if errors.Is(err, ErrVerifyOnly) {
+		return nil, fmt.Errorf("%w; set SHARD_PATH_KEY to find obfuscated shards", err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("vault shard path obfuscation"))
+	return mac.Sum(nil), nil
+}
+
 // GenerateEncryptionKey creates a new random encryption key.
 func GenerateEncryptionKey() (string, error) {
 	key := make([]byte, 32)
@@ -55,42 +108,55 @@ func GenerateDataID(data []byte) string {
 	return hex.EncodeToString(hash[:])
 }
 
+// MetadataFileReader reads one key of a metadata file.
+//
+// Deprecated: use metadata.ReadValue.
 func MetadataFileReader(filename string, key string) (string, error) {
-	file, err := os.Open(filename)
+	return metadata.ReadValue(filename, key)
+}
+
+// FindMetadataFile returns the metadata file in dir describing the object with the given dataID.
+func FindMetadataFile(dir, dataID string) (string, error) {
+	files, err := listMetadataFiles(dir)
 	if err != nil {
-		return "", fmt.Errorf("error opening file: %w", err)
+		return "", err
 	}
-	defer file.Close()
-
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		parts := strings.SplitN(line, ": ", 2)
-		// If not key value, pls continue
-		if len(parts) != 2 {
+	for _, file := range files {
+		id, err := metadata.ReadValue(file, "dataID")
+		if err != nil {
 			continue
 		}
-		k, v := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
-		if k == key {
-			return v, nil
+		if id == dataID {
+			return file, nil
 		}
 	}
+	return "", fmt.Errorf("%w: %s", ErrObjectNotFound, dataID)
+}
 
-	if err := scanner.Err(); err != nil {
-		return "", fmt.Errorf("failed to read file: %w", err)
+// MetadataFileCreator names the metadata file of a new object after
+// cfg.MetadataNameTemplate and cfg.MetadataExt.
+func MetadataFileCreator(cfg *config.Config, dataID, filePath string) (string, error) {
+	template, err := config.ParseMetadataNameTemplate(cfg.MetadataNameTemplate, cfg.MetadataExt)
+	if err != nil {
+		return "", err
 	}
-
-	return "", errors.New("key not found in metadata file")
+	return template.Render(config.MetadataName{
+		Time:     time.Now(),
+		DataID:   dataID,
+		Filename: filepath.Base(filePath),
+		Random:   randomName,
+	}), nil
 }
 
-func MetadataFileCreator() string {
+// randomName returns n random letters and digits.
+func randomName(n int) string {
 	const charset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
 	seededRand := rand.New(rand.NewSource(time.Now().UnixNano()))
-	b := make([]byte, 12)
+	b := make([]byte, n)
 	for i := range b {
 		b[i] = charset[seededRand.Intn(len(charset))]
 	}
-	return "vault_session_" + string(b) + ".vmd"
+	return string(b)
 }
 
 func StorageLocationFileCreator() string {
@@ -103,173 +169,211 @@ func StorageLocationFileCreator() string {
 	return "strl_" + string(b) + ".config"
 }
 
-// ReadStorageLocations reads storage locations from a configuration file.
-func ReadStorageLocations(filename string) ([]string, error) {
-	file, err := os.Open(filename)
+// ReadStorageLocations reads storage locations from a configuration file
+// listing one location for each of shards shards.
+func ReadStorageLocations(filename string, shards int) ([]string, error) {
+	locations, err := readLocationFile(filename)
 	if err != nil {
-		return nil, fmt.Errorf("error opening storage location configuration file: %w", err)
+		return nil, err
 	}
-	defer file.Close()
-
-	var locations []string
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		location := strings.TrimSpace(scanner.Text())
-		if location != "" {
-			locations = append(locations, location)
-		}
+	if len(locations) != shards {
+		return nil, fmt.Errorf("%w; must contain %d locations, not %d", errInvalidLocations, shards, len(locations))
 	}
+	return locations, nil
+}
 
-	if err := scanner.Err(); err != nil {
-		return nil, fmt.Errorf("failed to read storage location configuration file: %w", err)
+// ReadStorageLocationPool reads a configuration file listing at least
+// shards locations, of which new objects are placed on the healthiest.
+func ReadStorageLocationPool(filename string, shards int) ([]string, error) {
+	locations, err := readLocationFile(filename)
+	if err != nil {
+		return nil, err
 	}
-
-	if len(locations) != 14 {
-		return nil, errInvalidLocations
+	if len(locations) < shards {
+		return nil, fmt.Errorf("%w; must contain at least %d locations, not %d", errInvalidLocations, shards, len(locations))
 	}
-
 	return locations, nil
 }
 
-// StoreData encrypts data, applies erasure coding, and stores each shard.
-func StoreData(data []byte, store sharding.ShardStore, cfg *config.Config, locations []string, logger *zap.Logger, filePath string) (string, error) {
-	newmetadatafile := MetadataFileCreator()
-
-	// Log original data size for debugging
-	logger.Info("Original data size before encryption", zap.Int("size", len(data)))
-
-	// Check if the data starts with ZIP signature for debugging
-	if len(data) >= 4 {
-		logger.Info("Data header signature", zap.String("hex", fmt.Sprintf("%x", data[:4])))
-		if string(data[:4]) != "PK\x03\x04" && strings.HasSuffix(filePath, ".zip") {
-			logger.Warn("Expected ZIP file doesn't have proper signature")
+// ReadLocationZones reads the zone every location of a storage location
+// configuration file is labelled with, by location. Locations without a
+// zone label are left out, so a file without any gives an empty map.
+func ReadLocationZones(filename string) (map[string]string, error) {
+	entries, err := readLocationEntries(filename)
+	if err != nil {
+		return nil, err
+	}
+	zones := make(map[string]string)
+	for _, entry := range entries {
+		if zone := entry.Labels[sharding.ZoneLabel]; zone != "" {
+			zones[entry.Path] = zone
 		}
 	}
+	return zones, nil
+}
 
-	key, err := GetEncryptionKey(cfg)
+// ReadLocationCapacities reads the capacity of every location of a
+// storage location configuration file, in order, 0 for those without one.
+func ReadLocationCapacities(filename string) ([]int64, error) {
+	entries, err := readLocationEntries(filename)
 	if err != nil {
-		logger.Error("Failed to get encryption key", zap.Error(err))
-		return "", err
+		return nil, err
+	}
+	capacities := make([]int64, len(entries))
+	for i, entry := range entries {
+		capacities[i] = entry.Capacity
 	}
+	return capacities, nil
+}
 
-	cipherText, err := encryption.Encrypt(data, key)
+// readLocationFile reads the locations of a storage location configuration
+// file, in either of the formats config.ParseStorageConfig accepts.
+func readLocationFile(filename string) ([]string, error) {
+	entries, err := readLocationEntries(filename)
 	if err != nil {
-		logger.Error("Encryption failed", zap.Error(err))
-		return "", err
+		return nil, err
+	}
+	locations := make([]string, len(entries))
+	for i, entry := range entries {
+		locations[i] = entry.Path
+	}
+	return locations, nil
+}
+
+// readLocationEntries reads the entries of a storage location
+// configuration file.
+func readLocationEntries(filename string) ([]config.StorageLocation, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error opening storage location configuration file: %w", err)
 	}
+	entries, err := config.ParseStorageConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid storage location configuration file %s: %w", filename, err)
+	}
+	return entries, nil
+}
 
-	// Log encrypted data size for debugging
-	logger.Info("Encrypted data size", zap.Int("size", len(cipherText)))
+// StoreData encrypts data, applies erasure coding, and stores each shard.
+// Data ChooseLayout doesn't keep in memory goes through the streaming path.
+// It returns the object's dataID and the metadata file written for it.
+func StoreData(data []byte, store sharding.ShardStore, cfg *config.Config, locations []string, logger *zap.Logger, filePath string) (string, string, error) {
+	return storeData(context.Background(), data, store, cfg, locations, logger, filePath)
+}
 
-	dataID := GenerateDataID(cipherText)
+// storeData is StoreData drawing its retries from the budget in ctx, if any.
+func storeData(ctx context.Context, data []byte, store sharding.ShardStore, cfg *config.Config, locations []string, logger *zap.Logger, filePath string) (string, string, error) {
+	return NewPipeline(store, cfg, logger).store(ctx, data, locations, filePath)
+}
 
-	shards, err := erasurecoding.Encode(cipherText)
+// newMetadataPath creates the metadata directory and picks a new metadata
+// file in it for an object. A name the template gives an existing file is
+// numbered, as in "name-2.vmd".
+func newMetadataPath(cfg *config.Config, dataID, filePath string) (string, error) {
+	if err := ensureMetadataDir(cfg); err != nil {
+		return "", err
+	}
+	name, err := MetadataFileCreator(cfg, dataID, filePath)
 	if err != nil {
-		logger.Error("Erasure coding failed", zap.Error(err))
 		return "", err
 	}
-
-	// Log total shards size for debugging
-	totalShardSize := 0
-	for _, shard := range shards {
-		totalShardSize += len(shard)
+	stem := strings.TrimSuffix(name, cfg.MetadataExt)
+	path := filepath.Join(cfg.MetadataDir, name)
+	for n := 2; ; n++ {
+		if _, err := os.Lstat(path); errors.Is(err, os.ErrNotExist) {
+			return path, nil
+		}
+		path = filepath.Join(cfg.MetadataDir, fmt.Sprintf("%s-%d%s", stem, n, cfg.MetadataExt))
 	}
-	logger.Info("Total size of all shards", zap.Int("size", totalShardSize))
+}
 
-	// Store each shard.
-	for idx, shard := range shards {
-		location := locations[idx] // Use locations from the configuration file
-		logger.Info("Storing shard", zap.Int("shard", idx), zap.String("location", location), zap.Int("size", len(shard)))
-		if err := store.StoreShard(dataID, idx, shard, location); err != nil {
-			logger.Error("Storing shard failed", zap.Int("shard", idx), zap.String("location", location), zap.Error(err))
-			return "", err
-		}
+// ensureMetadataDir creates the metadata directory.
+func ensureMetadataDir(cfg *config.Config) error {
+	if err := os.MkdirAll(cfg.MetadataDir, 0700); err != nil {
+		return fmt.Errorf("couldn't create metadata directory: %w", err)
 	}
+	return nil
+}
 
+// metadataHeader formats the metadata shared by every layout, up to and
+// including the storage locations. Shards written without index headers,
+// like adopted ones, have no shard_format line.
+func metadataHeader(dataID, filePath string, size int64, choice LayoutChoice, indexed bool, envelope string, locations []string, cfg *config.Config) string {
 	// Extract filename and format
 	filename := filepath.Base(filePath)
 	format := strings.TrimPrefix(filepath.Ext(filePath), ".")
 
-	// Update metadata file with new fields
-	logger.Info("Updating metadata file", zap.String("metadataFile", newmetadatafile))
-	dataToAppend := fmt.Sprintf("dataID: %s\nfilename: %s\nfilesize: %d\nformat: %s\ncreation_date: %s\n", dataID, filename, len(data), format, time.Now().Format(time.RFC3339))
-	dataToAppend += "storage_locations: {\n"
-	for idx, location := range locations {
-		dataToAppend += fmt.Sprintf("  shard_%d: %s\n", idx, location)
+	header := fmt.Sprintf("dataID: %s\n%sfilesize: %d\nformat: %s\ncreation_date: %s\n", dataID, filenameLines(filename), size, format, time.Now().Format(time.RFC3339))
+	header += fmt.Sprintf("layout: %s\n", choice.Layout)
+	if choice.Reason != "" {
+		header += fmt.Sprintf("layout_reason: %s\n", choice.Reason)
 	}
-	dataToAppend += "}\n"
-	dataToAppend += "Proofs: {\n"
-	tree, err := proofofinclusion.BuildMerkleTree(shards)
-	if err != nil {
-		log.Fatal("failed to build Merkle tree: %w", err)
+	header += fmt.Sprintf("proof_scheme: %s\n", proofSchemeDigest)
+	shardNaming := "plain"
+	if cfg.ObfuscateShardPaths {
+		shardNaming = "hmac-sha256"
 	}
-	for i, shard := range shards {
-		if shard == nil {
-			continue
-		}
-		proof, err := proofofinclusion.GetProof(tree, shard)
-		if err != nil {
-			log.Fatal("failed to get proof for shard")
-		}
-		proof_of_shard := fmt.Sprintf("Proof for shard %d: %s\n", i, proof)
-		dataToAppend += "  " + proof_of_shard
+	header += fmt.Sprintf("shard_naming: %s\n", shardNaming)
+	if indexed {
+		header += fmt.Sprintf("shard_format: %s\n", shardFormatIndexed)
 	}
-	dataToAppend += "}\n"
-
-	file, err := os.OpenFile(newmetadatafile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		return "", fmt.Errorf("couldn't open or create a new metadata file: %w", err)
-	}
-	defer file.Close()
-
-	if _, err := file.WriteString(dataToAppend); err != nil {
-		return "", fmt.Errorf("couldn't update metadata content: %w", err)
+	header += metadataCodeLines(choice.Code)
+	header += envelope
+	header += "storage_locations: {\n"
+	for idx, location := range locations {
+		header += fmt.Sprintf("  shard_%d: %s\n", idx, location)
 	}
+	header += "}\n"
+	return header
+}
 
-	logger.Info("Data stored successfully", zap.String("dataID", dataID))
-	return dataID, nil
+// writeMetadataFile writes a new metadata file in one piece, recording the
+// vault version needed to read it.
+func writeMetadataFile(metadatafile, contents string) error {
+	lines := stampReaderVersion(strings.Split(strings.TrimSuffix(contents, "\n"), "\n"))
+	return metadata.Write(metadatafile, &metadata.Metadata{Lines: lines})
 }
 
 // RetrieveData assembles shards, decodes, and decrypts the data.
 // Tolerates missing shards within parity limits.
 func RetrieveData(metadatafile string, store sharding.ShardStore, cfg *config.Config, logger *zap.Logger) ([]byte, error) {
-	metakey := "dataID"
-	dataID, err := MetadataFileReader(metadatafile, metakey)
+	return retrieveData(context.Background(), metadatafile, nil, store, cfg, logger)
+}
+
+// retrieveData is RetrieveData decoding into buf, which the returned data
+// then shares, drawing its retries from the budget in ctx, if any.
+func retrieveData(ctx context.Context, metadatafile string, buf []byte, store sharding.ShardStore, cfg *config.Config, logger *zap.Logger) ([]byte, error) {
+	// Objects stored as they are need no key, but are no more readable here
+	if cfg.VerifyOnly {
+		return nil, ErrVerifyOnly
+	}
+	release, err := useObject(metadatafile)
 	if err != nil {
-		return nil, fmt.Errorf("error reading metadata file: %w", err)
+		return nil, err
 	}
-
-	// Read storage locations from the metadata file
-	locations := make([]string, 14)
-	for i := 0; i < 14; i++ {
-		key := fmt.Sprintf("shard_%d", i)
-		location, err := MetadataFileReader(metadatafile, key)
-		if err != nil {
-			return nil, fmt.Errorf("error reading shard location from metadata file: %w", err)
-		}
-		locations[i] = location
+	defer release()
+	metakey := "dataID"
+	if _, err := metadata.ReadValue(metadatafile, metakey); err != nil {
+		return nil, fmt.Errorf("error reading metadata file: %w", err)
 	}
 
-	totalShards := erasurecoding.DataShards + erasurecoding.ParityShards
-	shards := make([][]byte, totalShards)
-	missing := 0
-	for i := 0; i < totalShards; i++ {
-		location := locations[i] // Retrieve from respective locations
-		shard, err := store.RetrieveShard(dataID, i, location)
-		if err != nil {
-			logger.Warn("Shard retrieval failed", zap.Int("index", i), zap.String("location", location), zap.Error(err))
-			shards[i] = nil
-			missing++
-		} else {
-			logger.Info("Retrieved shard", zap.Int("index", i), zap.String("location", location))
-			shards[i] = shard
+	if readLayout(metadatafile) == layoutStreaming {
+		var buf bytes.Buffer
+		if _, err := retrieveStream(ctx, metadatafile, &buf, store, cfg, logger); err != nil {
+			return nil, err
 		}
+		return buf.Bytes(), nil
 	}
-	if missing > erasurecoding.ParityShards {
-		return nil, errors.New("insufficient shards for reconstruction")
+	ctx, logger = startOperation(ctx, cfg, logger, "retrieve")
+	values, set, shards, err := retrieveObjectShards(ctx, metadatafile, store, cfg, logger)
+	if err != nil {
+		return nil, err
 	}
+	size, _ := strconv.ParseInt(values["filesize"], 10, 64)
 
-	cipherText, err := erasurecoding.Decode(shards)
+	// The stored length comes from the metadata, not from trimming zeros:
+	// data may end in zeros of its own
+	cipherText, err := set.Code.AppendDecodeLength(buf, shards, storedLength(values, size))
 	if err != nil {
 		logger.Error("Erasure decoding failed", zap.Error(err))
 		return nil, err
@@ -278,13 +382,17 @@ func RetrieveData(metadatafile string, store sharding.ShardStore, cfg *config.Co
 	// Debugging: Check the size of the reconstructed cipherText
 	logger.Info("Reconstructed cipherText size", zap.Int("size", len(cipherText)))
 
-	key, err := GetEncryptionKey(cfg)
+	if storedAsIs(values) {
+		return cipherText, nil
+	}
+
+	key, err := objectKey(metadatafile, cfg, logger)
 	if err != nil {
 		logger.Error("Failed to get encryption key", zap.Error(err))
 		return nil, err
 	}
 
-	plainText, err := encryption.Decrypt(cipherText, key)
+	plainText, err := decryptObject(values, cipherText, key)
 	if err != nil {
 		logger.Error("Decryption failed", zap.Error(err))
 		return nil, err
@@ -293,6 +401,14 @@ func RetrieveData(metadatafile string, store sharding.ShardStore, cfg *config.Co
 	// Debugging: Check the size of the decrypted plainText
 	logger.Info("Decrypted plainText size", zap.Int("size", len(plainText)))
 
+	if plainText, err = reverseTransforms(values, plainText); err != nil {
+		logger.Error("Failed to undo transforms", zap.Error(err))
+		return nil, err
+	}
+	if int64(len(plainText)) != size {
+		return nil, fmt.Errorf("retrieved %d bytes, metadata records %d", len(plainText), size)
+	}
+
 	// Validate if this is a ZIP file by checking for ZIP signature (PK header)
 	if len(plainText) >= 4 && string(plainText[:4]) != "PK\x03\x04" {
 		logger.Warn("Retrieved data does not have a valid ZIP file signature",
@@ -302,92 +418,249 @@ func RetrieveData(metadatafile string, store sharding.ShardStore, cfg *config.Co
 	return plainText, nil
 }
 
-// VerifyData verifies the data availability using cryptographic proofs.
-func VerifyData(metadatafile string, store sharding.ShardStore, logger *zap.Logger) error {
-	dataID, err := MetadataFileReader(metadatafile, "dataID")
+// retrieveObjectShards reads the metadata of an object stored in memory
+// and fetches the shards of its single shard set.
+func retrieveObjectShards(ctx context.Context, metadatafile string, store sharding.ShardStore, cfg *config.Config, logger *zap.Logger) (map[string]string, shardSet, [][]byte, error) {
+	// Read storage locations from the metadata file
+	candidates, err := readShardCandidates(metadatafile)
 	if err != nil {
-		return fmt.Errorf("error reading metadata file: %w", err)
+		return nil, shardSet{}, nil, err
 	}
 
-	// Read storage locations from the metadata file
-	locations := make([]string, 14)
-	for i := 0; i < 14; i++ {
-		key := fmt.Sprintf("shard_%d", i)
-		location, err := MetadataFileReader(metadatafile, key)
+	values, err := metadata.ReadValues(metadatafile)
+	if err != nil {
+		return nil, shardSet{}, nil, fmt.Errorf("error reading metadata file: %w", err)
+	}
+	if size, err := strconv.ParseInt(values["filesize"], 10, 64); err != nil || size < 0 {
+		return nil, shardSet{}, nil, fmt.Errorf("invalid filesize in metadata: %q", values["filesize"])
+	}
+	sets, err := retrievalShardSets(metadatafile, values, cfg.RetrieveUnchecked, logger)
+	if err != nil {
+		return nil, shardSet{}, nil, err
+	}
+	shards, err := retrieveShards(ctx, sets[0], candidates, store, cfg, logger)
+	if err != nil {
+		return nil, shardSet{}, nil, err
+	}
+	return values, sets[0], shards, nil
+}
+
+// decodeObjectTo writes the plaintext of an object stored in memory to w,
+// decoding and decrypting the data shards straight into it so the
+// ciphertext is never joined into a buffer of its own. Transforms and
+// registered ciphers work on whole objects, so objects with either are
+// assembled in memory by retrieveData instead; ok is false for them and
+// nothing is written.
+func decodeObjectTo(ctx context.Context, metadatafile string, w io.Writer, store sharding.ShardStore, cfg *config.Config, logger *zap.Logger) (n int64, ok bool, err error) {
+	if cfg.VerifyOnly {
+		return 0, true, ErrVerifyOnly
+	}
+	values, err := metadata.ReadValues(metadatafile)
+	if err == nil && (values["transforms"] != "" || values["cipher"] != "") {
+		return 0, false, nil
+	}
+	ctx, logger = startOperation(ctx, cfg, logger, "retrieve")
+	values, set, shards, err := retrieveObjectShards(ctx, metadatafile, store, cfg, logger)
+	if err != nil {
+		return 0, true, err
+	}
+	size, _ := strconv.ParseInt(values["filesize"], 10, 64)
+
+	out := &countingWriter{w: w}
+	dst := io.Writer(out)
+	var decrypter *encryption.DecryptWriter
+	if !storedAsIs(values) {
+		key, err := objectKey(metadatafile, cfg, logger)
 		if err != nil {
-			return fmt.Errorf("error reading shard location from metadata file: %w", err)
+			logger.Error("Failed to get encryption key", zap.Error(err))
+			return 0, true, err
+		}
+		if decrypter, err = encryption.NewDecryptWriter(out, key); err != nil {
+			return 0, true, err
+		}
+		dst = decrypter
+	}
+	if err := set.Code.DecodeTo(dst, shards, storedLength(values, size)); err != nil {
+		logger.Error("Failed to decode object", zap.Error(err))
+		return out.n, true, err
+	}
+	if decrypter != nil {
+		if err := decrypter.Close(); err != nil {
+			return out.n, true, err
 		}
-		locations[i] = location
 	}
+	if out.n != size {
+		return out.n, true, fmt.Errorf("retrieved %d bytes, metadata records %d", out.n, size)
+	}
+	return out.n, true, nil
+}
 
-	// Retrieve shards from the storage locations
-	shards := make([][]byte, len(locations))
-	for i, location := range locations {
-		shard, err := store.RetrieveShard(dataID, i, location)
+// storedLength returns how many bytes the stored data of an in-memory
+// object of size bytes has: the transformed size if it was transformed,
+// plus the IV if vault encrypted it, or the recorded cipher text size if
+// a registered cipher did.
+func storedLength(values map[string]string, size int64) int {
+	if n, ok := cipherSize(values); ok {
+		return n
+	}
+	length := int(size)
+	if n, err := strconv.Atoi(values["transformed_size"]); err == nil && values["transforms"] != "" {
+		length = n
+	}
+	if !storedAsIs(values) {
+		length += aes.BlockSize
+	}
+	return length
+}
+
+// retrieveShards fetches the shards of set, trying each shard's candidate
+// locations in order, retrying within the budget in ctx, and leaving
+// missing shards nil. Indexed shards are checked against the slot they
+// were fetched for by placeShards, and under the shard-digest scheme
+// shards that don't match their proofs are left out too, so a corrupt
+// shard can't decode to wrong data. It fails if too many are missing to
+// decode.
+func retrieveShards(ctx context.Context, set shardSet, candidates [][]string, store sharding.ShardStore, cfg *config.Config, logger *zap.Logger) ([][]byte, error) {
+	id := set.ID
+	shards := make([][]byte, len(candidates))
+	for i := range candidates {
+		var (
+			shard    []byte
+			location string
+		)
+		err := RetryWithBudget(ctx, cfg.ShardRetryAttempts, cfg.ShardRetryDelay, logger, func() (err error) {
+			shard, location, err = sharding.RetrieveShardFrom(store, id, i, candidates[i])
+			return err
+		})
 		if err != nil {
-			logger.Warn("Shard retrieval failed", zap.Int("index", i), zap.String("location", location), zap.Error(err))
+			logger.Warn("Shard retrieval failed", zap.Int("index", i), zap.Strings("locations", candidates[i]), zap.Error(err))
 			continue
 		}
+		if location != candidates[i][0] {
+			logger.Info("Shard found at a candidate location", zap.Int("index", i), zap.String("location", location))
+		}
+		logger.Info("Retrieved shard", zap.Int("index", i), zap.String("location", location))
 		shards[i] = shard
 	}
-
-	// Build Merkle Tree
-	tree, err := proofofinclusion.BuildMerkleTree(shards)
+	shards = placeShards(shards, set.Indexed, logger)
+	usable, checks, err := set.usableShards(shards)
 	if err != nil {
-		return fmt.Errorf("failed to build Merkle tree: %w", err)
+		return nil, err
 	}
-
-	// Read original proofs from metadata file
-	proofs := make([]string, 14)
-	for i := 0; i < 14; i++ {
-		key := fmt.Sprintf("Proof for shard %d", i)
-		proof, err := MetadataFileReader(metadatafile, key)
-		if err != nil {
-			return fmt.Errorf("failed to read proof from metadata file: %w", err)
+	for i := range checks {
+		if shards[i] != nil && !checks[i] {
+			logger.Warn("Dropping shard that doesn't match its proof", zap.Int("index", i))
 		}
-		proofs[i] = proof
 	}
-
-	// Generate and compare proof for each shard
-	for i, shard := range shards {
+	shards = usable
+	missing := 0
+	for _, shard := range shards {
 		if shard == nil {
-			continue
+			missing++
 		}
-		proof, err := proofofinclusion.GetProof(tree, shard)
-		if err != nil {
-			return fmt.Errorf("failed to get proof for shard %d: %w", i, err)
+	}
+	if missing > set.Code.Parity {
+		return nil, ErrInsufficientShards
+	}
+	return shards, nil
+}
+
+// VerifyData verifies the data availability using cryptographic proofs,
+// or checksums where the store can compute them in place; see CheckData.
+func VerifyData(metadatafile string, store sharding.ShardStore, opts CheckOptions, logger *zap.Logger) error {
+	report, err := CheckData(metadatafile, store, opts, logger)
+	if err != nil {
+		return err
+	}
+
+	for _, shard := range report.Shards {
+		if !shard.Present {
+			continue
 		}
-		fmt.Printf("Shard_%d Verification: %t\n", i, proof == proofs[i])
+		fmt.Printf("Shard_%d Verification: %t (%s)\n", shard.Index, shard.Verified, shard.Depth)
 	}
+	fmt.Printf("Object health: %s\n", report.Health)
 
 	return nil
 }
 
-// SetupStorage sets up the storage location configuration file.
-func SetupStorage(locations []string, logger *zap.Logger) (string, error) {
-	if len(locations) != 14 {
-		return "", fmt.Errorf("storage locations incomplete, requires 14 locations")
+// SetupOptions controls SetupStorage.
+type SetupOptions struct {
+	Create bool               // Create missing location directories
+	Code   erasurecoding.Code // Code objects will be stored with; the default code if zero
+}
+
+// StorageSetup is what SetupStorage found and wrote.
+type StorageSetup struct {
+	File      string                  `json:"file"`
+	Locations []sharding.LocationInfo `json:"locations"`
+	Domains   sharding.FaultDomains   `json:"fault_domains"`
+	// SharedDevices lists the devices that back more than one location
+	SharedDevices map[string][]string `json:"shared_devices,omitempty"`
+}
+
+// SetupStorage inspects the storage locations and writes a storage
+// location configuration file listing them, labelled with the host and
+// device each is on. It warns when locations share a device, since they
+// then fail together and protect less than their number suggests.
+func SetupStorage(locations []string, opts SetupOptions, logger *zap.Logger) (*StorageSetup, error) {
+	code := opts.Code
+	if code == (erasurecoding.Code{}) {
+		code = erasurecoding.DefaultCode()
+	}
+	if len(locations) < code.Total() {
+		return nil, fmt.Errorf("storage locations incomplete, requires at least %d locations", code.Total())
 	}
 
-	for _, location := range locations {
-		if location == "" {
-			return "", fmt.Errorf("invalid storage location: %s", location)
+	setup := &StorageSetup{SharedDevices: make(map[string][]string)}
+	entries := make([]config.StorageLocation, len(locations))
+	byDevice := make(map[string][]string)
+	for i, location := range locations {
+		if err := sharding.ValidateLocation(location); err != nil {
+			return nil, err
 		}
+		info, err := sharding.InspectLocation(location, opts.Create)
+		if err != nil {
+			if !opts.Create && errors.Is(err, os.ErrNotExist) {
+				return nil, fmt.Errorf("%w; use --create to make missing locations", err)
+			}
+			return nil, err
+		}
+		setup.Locations = append(setup.Locations, info)
+		entries[i] = config.StorageLocation{Path: location, Labels: info.Labels()}
+		byDevice[info.Host+" "+info.Device] = append(byDevice[info.Host+" "+info.Device], location)
+	}
+	for device, shared := range byDevice {
+		if len(shared) > 1 {
+			setup.SharedDevices[device] = shared
+			logger.Warn("Storage locations share a device and will fail together", zap.String("device", device), zap.Strings("locations", shared))
+		}
+	}
+	setup.Domains = sharding.SummarizeFaultDomains(setup.Locations, code.Total(), code.Parity)
+
+	contents, err := json.MarshalIndent(struct {
+		Locations []config.StorageLocation `json:"locations"`
+	}{entries}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	contents = append(contents, '\n')
+	if err := config.ValidateStorageConfig(contents); err != nil {
+		return nil, err
 	}
 
-	storageFile := StorageLocationFileCreator()
-	file, err := os.OpenFile(storageFile, os.O_CREATE|os.O_WRONLY, 0644)
+	setup.File = StorageLocationFileCreator()
+	file, err := os.OpenFile(setup.File, os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
-		return "", fmt.Errorf("failed to create storage location configuration file: %w", err)
+		return nil, fmt.Errorf("failed to create storage location configuration file: %w", err)
 	}
 	defer file.Close()
 
-	for _, location := range locations {
-		if _, err := file.WriteString(location + "\n"); err != nil {
-			return "", fmt.Errorf("failed to write to storage location configuration file: %w", err)
-		}
+	if _, err := file.Write(contents); err != nil {
+		return nil, fmt.Errorf("failed to write to storage location configuration file: %w", err)
 	}
 
-	logger.Info("Storage location configuration file created successfully", zap.String("file", storageFile))
-	return storageFile, nil
+	logger.Info("Storage location configuration file created successfully", zap.String("file", setup.File),
+		zap.Int("devices", setup.Domains.Devices), zap.Int("deviceFailuresTolerated", setup.Domains.DeviceFailures))
+	return setup, nil
 }
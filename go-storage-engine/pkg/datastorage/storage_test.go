@@ -0,0 +1,528 @@
+package datastorage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"github.com/techninja8/getvault.io/pkg/config"
+	"github.com/techninja8/getvault.io/pkg/erasurecoding"
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+// testVault is a vault in temporary directories: a configuration, one
+// location directory per shard and a store writing to them.
+type testVault struct {
+	cfg       *config.Config
+	locations []string
+	store     *sharding.InMemoryShardStore
+	logger    *zap.Logger
+}
+
+func newTestVault(t testing.TB) *testVault {
+	t.Helper()
+	dir := t.TempDir()
+	key, err := GenerateEncryptionKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{
+		EncryptionKey:        key,
+		MaxConcurrency:       4,
+		MaxInFlightBytes:     64 << 20,
+		MetadataDir:          filepath.Join(dir, "metadata"),
+		ShardRetryAttempts:   1,
+		MaxRetriesPerOp:      10,
+		MetadataNameTemplate: config.DefaultMetadataNameTemplate,
+		MetadataExt:          config.DefaultMetadataExt,
+		HealthFile:           filepath.Join(dir, "health.json"),
+	}
+	locations := make([]string, erasurecoding.DataShards+erasurecoding.ParityShards)
+	for i := range locations {
+		locations[i] = filepath.Join(dir, fmt.Sprintf("location%d", i))
+	}
+	return &testVault{cfg: cfg, locations: locations, store: sharding.NewInMemoryShardStore(), logger: zap.NewNop()}
+}
+
+// storeObject stores data under name and returns its metadata file.
+func (v *testVault) storeObject(t *testing.T, name string, data []byte) string {
+	t.Helper()
+	_, metadatafile, err := StoreData(data, v.store, v.cfg, v.locations, v.logger, name)
+	if err != nil {
+		t.Fatalf("StoreData: %v", err)
+	}
+	return metadatafile
+}
+
+func randomBytes(t *testing.T, n int) []byte {
+	t.Helper()
+	data := make([]byte, n)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestStoreRetrieveRoundTrip(t *testing.T) {
+	v := newTestVault(t)
+	data := randomBytes(t, 100_000)
+	metadatafile := v.storeObject(t, "object.bin", data)
+
+	// A fresh store reads the shards back from disk
+	got, err := RetrieveData(metadatafile, sharding.NewInMemoryShardStore(), v.cfg, v.logger)
+	if err != nil {
+		t.Fatalf("RetrieveData: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("retrieved %d bytes that differ from the %d stored", len(got), len(data))
+	}
+}
+
+func TestStoreRetrieveConfiguredShardCounts(t *testing.T) {
+	for _, streamed := range []bool{false, true} {
+		t.Run(fmt.Sprintf("streamed=%v", streamed), func(t *testing.T) {
+			v := newTestVault(t)
+			v.cfg.DataShards, v.cfg.ParityShards = 4, 2
+			v.locations = v.locations[:6]
+			if streamed {
+				v.cfg.StreamingThreshold = 1
+			}
+			data := randomBytes(t, 100_000)
+			metadatafile := v.storeObject(t, "object.bin", data)
+
+			code, err := ObjectCode(metadatafile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if code.Data != 4 || code.Parity != 2 {
+				t.Fatalf("object recorded %v, expected 4+2", code)
+			}
+
+			// Losing as many locations as there are parity shards is survivable
+			for _, location := range v.locations[:2] {
+				if err := os.RemoveAll(location); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, err := RetrieveData(metadatafile, sharding.NewInMemoryShardStore(), v.cfg, v.logger)
+			if err != nil {
+				t.Fatalf("RetrieveData: %v", err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatalf("retrieved %d bytes that differ from the %d stored", len(got), len(data))
+			}
+		})
+	}
+}
+
+// TestMaxObjectSize checks that an object of MaxObjectSize bytes is stored
+// and one a byte over is refused with ErrObjectTooLarge, as the store
+// command stores a file of known size or a zip of unknown size, without
+// writing any of its shards when the size is known up front.
+func TestMaxObjectSize(t *testing.T) {
+	const limit = 10_000
+	for _, layout := range []string{"in-memory", "streamed"} {
+		t.Run(layout, func(t *testing.T) {
+			v := newTestVault(t)
+			v.cfg.MaxObjectSize = limit
+			if layout == "streamed" {
+				v.cfg.StreamingThreshold = 1
+				v.cfg.MaxShardSize = 1024 // Segments of under 8 KiB
+			}
+			for _, size := range []int{limit - 1, limit} {
+				data := randomBytes(t, size)
+				for _, declared := range []int64{int64(size), -1} {
+					if _, _, err := StoreReader(bytes.NewReader(data), declared, v.store, v.cfg, v.locations, v.logger, "object.bin"); err != nil {
+						t.Fatalf("storing %d bytes declared as %d: %v", size, declared, err)
+					}
+				}
+				if _, _, err := StoreData(data, v.store, v.cfg, v.locations, v.logger, "object.bin"); err != nil {
+					t.Fatalf("StoreData of %d bytes: %v", size, err)
+				}
+			}
+
+			over := newTestVault(t)
+			over.cfg = v.cfg
+			data := randomBytes(t, limit+1)
+			if _, _, err := StoreReader(bytes.NewReader(data), limit+1, over.store, over.cfg, over.locations, over.logger, "object.bin"); !errors.Is(err, ErrObjectTooLarge) {
+				t.Fatalf("storing %d bytes returned %v, expected %v", limit+1, err, ErrObjectTooLarge)
+			}
+			if _, _, err := StoreData(data, over.store, over.cfg, over.locations, over.logger, "object.bin"); !errors.Is(err, ErrObjectTooLarge) {
+				t.Fatalf("StoreData of %d bytes returned %v, expected %v", limit+1, err, ErrObjectTooLarge)
+			}
+			for _, location := range over.locations {
+				if _, err := os.Stat(location); !os.IsNotExist(err) {
+					t.Fatalf("refused object wrote to %s: %v", location, err)
+				}
+			}
+			if _, _, err := StoreReader(bytes.NewReader(data), -1, over.store, over.cfg, over.locations, over.logger, "object.bin"); !errors.Is(err, ErrObjectTooLarge) {
+				t.Fatalf("storing %d bytes of unknown size returned %v, expected %v", limit+1, err, ErrObjectTooLarge)
+			}
+		})
+	}
+}
+
+// TestVerifyOnEncodeIsPerVault checks that VERIFY_ON_ENCODE is carried by
+// the code of the vault configured with it, so vaults configured either
+// way store side by side, chunked or not.
+func TestVerifyOnEncodeIsPerVault(t *testing.T) {
+	var wg sync.WaitGroup
+	for _, verify := range []bool{false, true} {
+		for _, chunked := range []bool{false, true} {
+			v := newTestVault(t)
+			v.cfg.VerifyOnEncode = verify
+			v.cfg.StreamingThreshold = 1
+			if chunked {
+				v.cfg.ChunkSize = 4096
+			}
+			choice, err := ChooseLayout(100_000, v.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if choice.Code.VerifyOnEncode != verify {
+				t.Fatalf("VERIFY_ON_ENCODE %v stores with a code verifying %v", verify, choice.Code.VerifyOnEncode)
+			}
+			data := randomBytes(t, 100_000)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				dataID, metadatafile, err := StoreData(data, v.store, v.cfg, v.locations, v.logger, "object.bin")
+				if err != nil {
+					t.Errorf("verify %v, chunked %v: StoreData: %v", verify, chunked, err)
+					return
+				}
+				got, err := RetrieveData(metadatafile, v.store, v.cfg, v.logger)
+				if err != nil || !bytes.Equal(got, data) {
+					t.Errorf("verify %v, chunked %v: retrieving %s: %v", verify, chunked, dataID, err)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+}
+
+// TestTrailingZerosSurvive checks that data ending in zeros comes back
+// with them, however the object is laid out.
+func TestTrailingZerosSurvive(t *testing.T) {
+	for _, layout := range []string{"in-memory", "streamed"} {
+		t.Run(layout, func(t *testing.T) {
+			v := newTestVault(t)
+			if layout == "streamed" {
+				v.cfg.MaxShardSize = 4096
+				v.cfg.StreamingThreshold = 1
+			}
+			data := append(randomBytes(t, 1000), make([]byte, 14)...)
+			data[999] = 0xff
+			metadatafile := v.storeObject(t, "zeros.bin", data)
+			got, err := RetrieveData(metadatafile, v.store, v.cfg, v.logger)
+			if err != nil {
+				t.Fatalf("RetrieveData: %v", err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatalf("retrieved %d bytes, expected the %d stored with their trailing zeros", len(got), len(data))
+			}
+			var out bytes.Buffer
+			if _, err := RetrieveTo(metadatafile, &out, v.store, v.cfg, v.logger); err != nil || !bytes.Equal(out.Bytes(), data) {
+				t.Fatalf("RetrieveTo wrote %d bytes, %v", out.Len(), err)
+			}
+		})
+	}
+}
+
+func TestRetrieveRefusesLengthPastShards(t *testing.T) {
+	v := newTestVault(t)
+	metadatafile := v.storeObject(t, "object.bin", randomBytes(t, 1014))
+	if err := setMetadataValue(metadatafile, "filesize", "100000"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RetrieveData(metadatafile, v.store, v.cfg, v.logger); !errors.Is(err, erasurecoding.ErrShortData) {
+		t.Fatalf("RetrieveData returned %v, expected %v", err, erasurecoding.ErrShortData)
+	}
+}
+
+// losingStore is a shard store that has lost the shards at some indexes.
+type losingStore struct {
+	sharding.ShardStore
+	lost map[int]bool
+}
+
+func (s *losingStore) RetrieveShard(dataID string, index int, location string) ([]byte, error) {
+	if s.lost[index] {
+		return nil, fmt.Errorf("shard %d: %w", index, sharding.ErrShardNotFound)
+	}
+	return s.ShardStore.RetrieveShard(dataID, index, location)
+}
+
+func TestRetrieveDataLosingParityShards(t *testing.T) {
+	// Shards 0-7 are data and 8-13 parity; any 6 can go
+	cases := map[string][]int{
+		"all parity":               {8, 9, 10, 11, 12, 13},
+		"first data shards":        {0, 1, 2, 3, 4, 5},
+		"last data shards":         {2, 3, 4, 5, 6, 7},
+		"first and last data":      {0, 7, 8, 9, 10, 11},
+		"first and last data only": {0, 7, 1, 6, 2, 5},
+		"first and last shards":    {0, 1, 2, 11, 12, 13},
+		"across data and parity":   {5, 6, 7, 8, 9, 10},
+		"alternating":              {0, 2, 4, 6, 8, 10},
+		"every other parity":       {1, 3, 5, 9, 11, 13},
+	}
+	for start := 0; start+6 <= 14; start++ {
+		cases[fmt.Sprintf("window %d-%d", start, start+5)] = []int{start, start + 1, start + 2, start + 3, start + 4, start + 5}
+	}
+
+	for _, streamed := range []bool{false, true} {
+		v := newTestVault(t)
+		if streamed {
+			v.cfg.StreamingThreshold = 1
+		}
+		data := randomBytes(t, 50_001)
+		metadatafile := v.storeObject(t, "object.bin", data)
+		for name, indexes := range cases {
+			lost := make(map[int]bool)
+			for _, i := range indexes {
+				lost[i] = true
+			}
+			store := &losingStore{ShardStore: v.store, lost: lost}
+			got, err := RetrieveData(metadatafile, store, v.cfg, v.logger)
+			if err != nil || !bytes.Equal(got, data) {
+				t.Fatalf("streamed=%v, %s %v lost: RetrieveData returned %d bytes, %v", streamed, name, indexes, len(got), err)
+			}
+		}
+
+		// A seventh lost shard is one too many
+		store := &losingStore{ShardStore: v.store, lost: map[int]bool{0: true, 7: true, 8: true, 9: true, 10: true, 11: true, 13: true}}
+		if _, err := RetrieveData(metadatafile, store, v.cfg, v.logger); err == nil {
+			t.Fatalf("streamed=%v: retrieved an object missing 7 of 14 shards", streamed)
+		}
+	}
+}
+
+func TestRetrieveToMatchesRetrieveData(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		transforms []string
+		lost       int
+	}{
+		{"whole", nil, 0},
+		{"degraded", nil, 6},
+		{"transformed", []string{"rotate"}, 6},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			v := newTestVault(t)
+			v.cfg.Transforms = tc.transforms
+			data := randomBytes(t, 100_000)
+			metadatafile := v.storeObject(t, "object.bin", data)
+			for _, location := range v.locations[:tc.lost] {
+				if err := os.RemoveAll(location); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var out bytes.Buffer
+			n, err := RetrieveTo(metadatafile, &out, sharding.NewInMemoryShardStore(), v.cfg, v.logger)
+			if err != nil {
+				t.Fatalf("RetrieveTo: %v", err)
+			}
+			got, err := RetrieveData(metadatafile, sharding.NewInMemoryShardStore(), v.cfg, v.logger)
+			if err != nil {
+				t.Fatalf("RetrieveData: %v", err)
+			}
+			if n != int64(len(data)) || sha256.Sum256(out.Bytes()) != sha256.Sum256(data) || !bytes.Equal(got, data) {
+				t.Fatalf("RetrieveTo wrote %d bytes and RetrieveData returned %d, not the %d stored", n, len(got), len(data))
+			}
+		})
+	}
+}
+
+func TestStoreRetrieveOverMemFS(t *testing.T) {
+	v := newTestVault(t)
+	fsys := sharding.NewMemFS()
+	v.store.FS = fsys
+	// Locations that don't exist on disk, and mustn't once the object is stored
+	for i := range v.locations {
+		v.locations[i] = filepath.Join(string(filepath.Separator), "vault-memfs", fmt.Sprintf("location%d", i))
+	}
+	data := randomBytes(t, 100_000)
+	metadatafile := v.storeObject(t, "object.bin", data)
+	if _, err := os.Stat(v.locations[0]); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("storing over a MemFS touched the disk: %v", err)
+	}
+
+	// A fresh store over the same filesystem, missing as many locations as
+	// there are parity shards
+	for _, location := range v.locations[:6] {
+		entries, err := fsys.ReadDir(location)
+		if err != nil || len(entries) != 1 {
+			t.Fatalf("%s holds %d entries: %v", location, len(entries), err)
+		}
+		if err := fsys.Remove(filepath.Join(location, entries[0].Name())); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store := sharding.NewInMemoryShardStore()
+	store.FS = fsys
+	got, err := RetrieveData(metadatafile, store, v.cfg, v.logger)
+	if err != nil {
+		t.Fatalf("RetrieveData: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("retrieved %d bytes that differ from the %d stored", len(got), len(data))
+	}
+	report, err := CheckData(metadatafile, store, CheckOptions{Deep: true}, v.logger)
+	if err != nil {
+		t.Fatalf("CheckData: %v", err)
+	}
+	for i, shard := range report.Shards {
+		if shard.Present != (i >= 6) {
+			t.Fatalf("shard %d checked as present: %v", i, shard.Present)
+		}
+	}
+}
+
+func TestRetrieveRefusesUnreadableProofs(t *testing.T) {
+	v := newTestVault(t)
+	data := randomBytes(t, 10_000)
+	metadatafile := v.storeObject(t, "object.bin", data)
+	err := rewriteMetadataFile(metadatafile, func(lines []string) ([]string, error) {
+		var out []string
+		for _, line := range lines {
+			if !strings.Contains(line, "Merkle root") {
+				out = append(out, line)
+			}
+		}
+		return out, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := RetrieveData(metadatafile, v.store, v.cfg, v.logger); !errors.Is(err, ErrProofsUnreadable) {
+		t.Fatalf("RetrieveData returned %v, expected %v", err, ErrProofsUnreadable)
+	}
+	v.cfg.RetrieveUnchecked = true
+	got, err := RetrieveData(metadatafile, v.store, v.cfg, v.logger)
+	if err != nil {
+		t.Fatalf("RetrieveData with RetrieveUnchecked: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("unchecked retrieval returned different data")
+	}
+}
+
+func TestStoreReaderReturnsItsMetadataFile(t *testing.T) {
+	v := newTestVault(t)
+	// Chunked objects are encrypted deterministically, so storing the same
+	// contents twice gives the same dataID
+	v.cfg.ChunkSize = minChunkSize
+	data := randomBytes(t, 20_000)
+	var files []string
+	for _, name := range []string{"first.bin", "second.bin"} {
+		_, metadatafile, err := StoreReader(bytes.NewReader(data), int64(len(data)), v.store, v.cfg, v.locations, v.logger, name)
+		if err != nil {
+			t.Fatalf("StoreReader: %v", err)
+		}
+		files = append(files, metadatafile)
+	}
+	if files[0] == files[1] {
+		t.Fatalf("both stores returned %s", files[0])
+	}
+	for i, name := range []string{"first.bin", "second.bin"} {
+		if got, err := MetadataFileReader(files[i], "filename"); err != nil || got != name {
+			t.Fatalf("metadata file %s is for %q, expected %q (%v)", files[i], got, name, err)
+		}
+	}
+}
+
+// TestStoreNamesMetadataAfterTemplate stores objects with a custom
+// metadata name template and extension. A name already taken is numbered,
+// and listings find the objects whatever their extension.
+func TestStoreNamesMetadataAfterTemplate(t *testing.T) {
+	v := newTestVault(t)
+	v.cfg.MetadataNameTemplate = "{filename}-{dataID:8}"
+	v.cfg.MetadataExt = ".meta"
+	metadatafile := v.storeObject(t, "report.pdf", randomBytes(t, 1000))
+	dataID, err := MetadataFileReader(metadatafile, "dataID")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(v.cfg.MetadataDir, "report-"+dataID[:8]+".meta"); metadatafile != want {
+		t.Fatalf("metadata file %s, expected %s", metadatafile, want)
+	}
+
+	v.cfg.MetadataNameTemplate = "{filename}"
+	var files []string
+	for range 2 {
+		files = append(files, filepath.Base(v.storeObject(t, "notes.txt", randomBytes(t, 1000))))
+	}
+	if files[0] != "notes.meta" || files[1] != "notes-2.meta" {
+		t.Fatalf("metadata files %v, expected notes.meta and notes-2.meta", files)
+	}
+
+	// A catalog started under another extension keeps listing
+	v.cfg.MetadataExt = config.DefaultMetadataExt
+	v.cfg.MetadataNameTemplate = config.DefaultMetadataNameTemplate
+	v.storeObject(t, "old.bin", randomBytes(t, 1000))
+	if objects, err := ListObjects(v.cfg.MetadataDir); err != nil || len(objects) != 4 {
+		t.Fatalf("listing found %d objects, %v", len(objects), err)
+	}
+}
+
+// TestObfuscatedShardPaths stores with shard paths obfuscated, as the CLI
+// sets a store up for OBFUSCATE_SHARD_PATHS, and checks that the object
+// round-trips while no file under the locations is named after its
+// dataID.
+func TestObfuscatedShardPaths(t *testing.T) {
+	v := newTestVault(t)
+	v.cfg.ObfuscateShardPaths = true
+	key, err := GetShardPathKey(v.cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.store.PathKey = key
+	data := randomBytes(t, 100_000)
+	metadatafile := v.storeObject(t, "object.bin", data)
+	dataID, err := MetadataFileReader(metadatafile, "dataID")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if naming, _ := MetadataFileReader(metadatafile, "shard_naming"); naming != "hmac-sha256" {
+		t.Fatalf("shard naming recorded as %q", naming)
+	}
+
+	names := 0
+	for _, location := range v.locations {
+		entries, err := os.ReadDir(location)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range entries {
+			if strings.Contains(entry.Name(), dataID) || strings.Contains(entry.Name(), dataID[:16]) {
+				t.Fatalf("shard file %s named after dataID %s", entry.Name(), dataID)
+			}
+			names++
+		}
+	}
+	if names != len(v.locations) {
+		t.Fatalf("%d shard files in %d locations", names, len(v.locations))
+	}
+
+	// Only a store with the key finds the shards on disk
+	keyed := sharding.NewInMemoryShardStore()
+	keyed.PathKey = key
+	got, err := RetrieveData(metadatafile, keyed, v.cfg, v.logger)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("RetrieveData with the path key: %v", err)
+	}
+	if _, err := RetrieveData(metadatafile, sharding.NewInMemoryShardStore(), v.cfg, v.logger); err == nil {
+		t.Fatal("retrieved obfuscated shards without the path key")
+	}
+}
@@ -0,0 +1,567 @@
+package datastorage
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/techninja8/getvault.io/pkg/config"
+	"github.com/techninja8/getvault.io/pkg/encryption"
+	"github.com/techninja8/getvault.io/pkg/erasurecoding"
+	"github.com/techninja8/getvault.io/pkg/metadata"
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+// Layouts record which path stored an object, so retrieval takes the same one.
+const (
+	layoutInMemory  = "in-memory"
+	layoutStreaming = "streaming"
+)
+
+// streamSegmentSize is the amount of plaintext encrypted and erasure coded
+// at a time on the streaming path, unless MAX_SHARD_SIZE calls for less. Each segment is stored like a small
+// object of its own, under the sha256 of its ciphertext. Only the last
+// segment of a store is shorter, but appends add segments after it, so
+// offsets come from the recorded segment sizes rather than this one.
+const streamSegmentSize = 64 << 20
+
+// segment is one segment of a streamed object.
+type segment struct {
+	ID   string
+	Size int // ciphertext bytes
+}
+
+// StoreReader stores size bytes read from r. Objects ChooseLayout keeps in
+// memory are read in full and stored by StoreData; others are streamed so
+// memory use is bounded by the segments in flight (see storeSegments). A
+// negative size means the size isn't known up front, as with a pipe, and
+// the input is always streamed. Like StoreData, it returns the dataID and
+// the metadata file written.
+func StoreReader(r io.Reader, size int64, store sharding.ShardStore, cfg *config.Config, locations []string, logger *zap.Logger, filePath string) (string, string, error) {
+	return StoreReaderContext(context.Background(), r, size, store, cfg, locations, logger, filePath)
+}
+
+// StoreReaderContext is StoreReader drawing its retries from the budget in
+// ctx, as set up by NewOperationContext, if there is one.
+func StoreReaderContext(ctx context.Context, r io.Reader, size int64, store sharding.ShardStore, cfg *config.Config, locations []string, logger *zap.Logger, filePath string) (string, string, error) {
+	if err := checkObjectSize(cfg, size); err != nil {
+		return "", "", err
+	}
+	if err := CheckFilename(filepath.Base(filePath)); err != nil {
+		return "", "", err
+	}
+	choice, err := ChooseLayout(size, cfg)
+	if err != nil {
+		return "", "", err
+	}
+	if choice.Layout == layoutInMemory {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to read data: %w", err)
+		}
+		return storeData(ctx, data, store, cfg, locations, logger, filePath)
+	}
+	return storeStream(ctx, r, choice, store, cfg, locations, logger, filePath)
+}
+
+// retrieveTo writes an object's plaintext to w from its shards and returns
+// the number of bytes written. Streamed objects are fetched, decoded and
+// decrypted a segment at a time; others are decoded and decrypted straight
+// into w, or assembled in memory by RetrieveData if they have transforms
+// or a registered cipher.
+func retrieveTo(ctx context.Context, metadatafile string, w io.Writer, store sharding.ShardStore, cfg *config.Config, logger *zap.Logger) (int64, error) {
+	if readLayout(metadatafile) == layoutStreaming {
+		return retrieveStream(ctx, metadatafile, w, store, cfg, logger)
+	}
+	if n, ok, err := decodeObjectTo(ctx, metadatafile, w, store, cfg, logger); ok {
+		return n, err
+	}
+	size := -1
+	if value, err := metadata.ReadValue(metadatafile, "filesize"); err == nil {
+		if n, err := strconv.Atoi(value); err == nil && n >= 0 {
+			size = n
+		}
+	}
+	// The data never leaves this function, so it is decoded into a pooled
+	// buffer. Should decoding outgrow it, the buffer is still free to reuse.
+	buf := getBuffer(cfg, erasurecoding.ShardSetSize(aes.BlockSize+max(size, 0)))
+	defer putBuffer(cfg, buf)
+	data, err := retrieveData(ctx, metadatafile, buf, store, cfg, logger)
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(data)
+	return int64(n), err
+}
+
+// storeStream encrypts, erasure codes and stores r one segment of
+// choice.SegmentSize at a time, or one chunk at a time if choice has a
+// chunk size. The dataID is the sha256 of all segment ciphertexts in order,
+// or with ID_MODE=content an HMAC of the plaintext.
+func storeStream(ctx context.Context, r io.Reader, choice LayoutChoice, store sharding.ShardStore, cfg *config.Config, locations []string, logger *zap.Logger, filePath string) (string, string, error) {
+	if len(cfg.Transforms) > 0 {
+		return "", "", errTransformStreaming
+	}
+	if cfg.Convergent {
+		return "", "", errConvergentStreaming
+	}
+	ctx, logger = startOperation(ctx, cfg, logger, "store")
+	if err := ensureMetadataDir(cfg); err != nil {
+		return "", "", err
+	}
+
+	masterKey, err := GetEncryptionKey(cfg)
+	if err != nil {
+		logger.Error("Failed to get encryption key", zap.Error(err))
+		return "", "", err
+	}
+	key, envelope, err := newObjectKey(cfg, masterKey)
+	if err != nil {
+		logger.Error("Failed to set up object key", zap.Error(err))
+		return "", "", err
+	}
+
+	var chunks *chunkSet
+	if choice.ChunkSize > 0 {
+		key, chunks = chunkKey(key), newChunkSet()
+	}
+	contentHash, err := newContentHash(cfg)
+	if err != nil {
+		return "", "", err
+	}
+	if contentHash != nil {
+		r = io.TeeReader(r, contentHash)
+	}
+	var sampler compressSampler
+	r = io.TeeReader(r, &sampler)
+	hash := sha256.New()
+	source, err := newSegmentSource(r, choice.SegmentSize, choice.ChunkSize, key, true, choice.Code, hash)
+	if err != nil {
+		return "", "", err
+	}
+
+	// The size of piped input is only known as it is read
+	checkSize := func(size int64) error { return checkObjectSize(cfg, size) }
+	stored, err := storeSegments(ctx, source, 0, key, true, choice.Code, chunks, hash, checkSize, locations, store, cfg, logger)
+	if err != nil {
+		return "", "", err
+	}
+	size, count := stored.size, stored.count
+
+	dataID := hex.EncodeToString(hash.Sum(nil))
+	if contentHash != nil {
+		dataID = hex.EncodeToString(contentHash.Sum(nil))
+	}
+
+	newmetadatafile, err := newMetadataPath(cfg, dataID, filePath)
+	if err != nil {
+		return "", "", err
+	}
+	logger.Info("Updating metadata file", zap.String("metadataFile", newmetadatafile))
+	compressibility := sampler.Estimate()
+	dataToAppend := metadataHeader(dataID, filePath, size, choice, true, envelope+contentIDLines(cfg, "")+compressLines(compressibility), locations, cfg)
+	dataToAppend += fmt.Sprintf("segment_size: %d\n", choice.SegmentSize)
+	if chunks != nil {
+		dataToAppend += fmt.Sprintf("chunking: %s %d\n", chunkingGear, choice.ChunkSize)
+	}
+	dataToAppend += "segments: {\n" + stored.segments + "}\n"
+	dataToAppend += "Proofs: {\n" + stored.proofs + "}\n"
+	if err := writeMetadataFile(newmetadatafile, dataToAppend); err != nil {
+		return "", "", err
+	}
+	detail := fmt.Sprintf("%d bytes, streamed", size)
+	if chunks != nil {
+		detail = fmt.Sprintf("%d bytes, %d of %d chunks (%d bytes) already stored", size, chunks.reused, count, chunks.reusedBytes)
+		logger.Info("Chunks reused", zap.Int("chunks", count), zap.Int("reused", chunks.reused), zap.Int64("reusedBytes", chunks.reusedBytes))
+	}
+	if err := recordEvent(newmetadatafile, dataID, ObjectEvent{Event: EventStored, Detail: detail}); err != nil {
+		logger.Warn("Failed to record object history", zap.Error(err))
+	}
+
+	logger.Info("Data stored successfully", zap.String("dataID", dataID), zap.Int64("size", size), zap.String("layoutReason", choice.Reason), zap.Float64("compressRatio", compressibility.Ratio()))
+	return dataID, newmetadatafile, nil
+}
+
+// storeSegment encrypts, erasure codes and stores segment s of a streamed
+// object, with index headers if indexed, writing its ciphertext to digest.
+// It returns the segment's line for the segments block and its lines for
+// the Proofs block. The segment is erasure coded with code. Segments of
+// a chunked object are given chunks: they are encrypted deterministically,
+// and not stored if chunks finds them already stored. Should storing the
+// shards fail, those already stored are removed.
+func storeSegment(ctx context.Context, s int, plainText, key []byte, indexed bool, code erasurecoding.Code, chunks *chunkSet, digest io.Writer, locations []string, store sharding.ShardStore, cfg *config.Config, logger *zap.Logger) (string, string, error) {
+	// The shards are coded out of the cipher text into memory of their own,
+	// so the cipher text can be in a pooled buffer
+	buf := getBuffer(cfg, aes.BlockSize+len(plainText))
+	defer putBuffer(cfg, buf)
+	encrypt := encryption.AppendEncrypt
+	if chunks != nil {
+		encrypt = encryption.AppendEncryptDeterministic
+	}
+	cipherText, err := encrypt(buf, plainText, key)
+	if err != nil {
+		logger.Error("Encryption failed", zap.Int("segment", s), zap.Error(err))
+		return "", "", err
+	}
+	if _, err := digest.Write(cipherText); err != nil {
+		return "", "", fmt.Errorf("failed to hash segment %d: %w", s, err)
+	}
+	segmentID := GenerateDataID(cipherText)
+
+	stored, shards, err := encodeStoredShards(code, cipherText, indexed)
+	if err != nil {
+		logger.Error("Erasure coding failed", zap.Int("segment", s), zap.Error(err))
+		return "", "", err
+	}
+	if chunks != nil && chunks.has(segmentID, len(shards), locations, store) {
+		logger.Info("Chunk already stored", zap.Int("segment", s), zap.String("segmentID", segmentID), zap.Int("size", len(plainText)))
+		chunks.reuse(len(plainText))
+	} else {
+		logger.Info("Storing segment", zap.Int("segment", s), zap.String("segmentID", segmentID), zap.Int("size", len(plainText)))
+		sharding.DescribeShards(store, segmentID, code.Data, code.Parity, int64(len(cipherText)))
+		if err := storeShards(ctx, segmentID, stored, locations, store, cfg, logger); err != nil {
+			removePartialShards(segmentID, len(stored), locations, store, logger)
+			return "", "", err
+		}
+		if chunks != nil {
+			chunks.add(segmentID)
+		}
+	}
+
+	proofs, err := shardProofLines(shards, fmt.Sprintf("segment %d ", s), indexed)
+	if err != nil {
+		return "", "", err
+	}
+	return fmt.Sprintf("  segment_%d: %s %d\n", s, segmentID, len(cipherText)), proofs, nil
+}
+
+// encodingSegments cuts a reader into segments of the same size, all but
+// the last full, and encrypts and erasure codes each as it reads it: the
+// reader is copied through an encryption.EncryptWriter into an
+// erasurecoding.ShardWriter over the memory the shards are stored from,
+// so neither the plaintext nor the cipher text of a segment is ever held
+// whole, only its shards. The shards are laid out for a full segment, and
+// laid out again in place for a short last one.
+type encodingSegments struct {
+	r           io.Reader
+	segmentSize int64
+	key         []byte
+	indexed     bool
+	code        erasurecoding.Code
+	digest      io.Writer
+	done        bool
+}
+
+// encodedSegment is a segment encodingSegments read: its cipher text is
+// in its data shards, and its parity still to be computed.
+type encodedSegment struct {
+	stored  [][]byte // The shards as stored, index headers and all
+	header  int      // Bytes of index header in front of each shard
+	shards  *erasurecoding.ShardWriter
+	id      string // The sha256 of the cipher text
+	indexed bool
+	code    erasurecoding.Code
+}
+
+func (e *encodingSegments) MaxSize() int {
+	return int(e.segmentSize)
+}
+
+// Memory counts only the shards, which hold the segment's cipher text.
+func (e *encodingSegments) Memory() int64 {
+	return storedShardsSize(e.code, aes.BlockSize+int(e.segmentSize), e.indexed)
+}
+
+func (e *encodingSegments) Next() (*sourceSegment, error) {
+	if e.done {
+		return nil, io.EOF
+	}
+	header := 0
+	if e.indexed {
+		header = shardHeaderSize
+	}
+	bound := aes.BlockSize + int(e.segmentSize)
+	size := header + e.code.ShardSize(bound)
+	backing := make([]byte, size*e.code.Total())
+	stored, shards := make([][]byte, e.code.Total()), make([][]byte, e.code.Total())
+	for i := range stored {
+		stored[i] = backing[i*size : (i+1)*size]
+		if e.indexed {
+			binary.BigEndian.PutUint16(stored[i][copy(stored[i], shardHeaderMagic):], uint16(i))
+		}
+		shards[i] = stored[i][header:]
+	}
+	coder, err := e.code.NewShardWriter(shards, bound)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.New()
+	encrypter, err := encryption.NewEncryptWriter(io.MultiWriter(coder, hash, e.digest), e.key)
+	if err != nil {
+		return nil, err
+	}
+
+	// Nothing is written, not even the IV, until there is plaintext, so an
+	// input ending on a segment boundary ends without an empty segment
+	n, err := io.CopyN(encrypter, e.r, e.segmentSize)
+	switch {
+	case err == io.EOF:
+		e.done = true
+		if n == 0 {
+			return nil, io.EOF
+		}
+	case err != nil:
+		return nil, err
+	}
+	if err := encrypter.Close(); err != nil {
+		return nil, err
+	}
+	return &sourceSegment{
+		encoded: &encodedSegment{stored: stored, header: header, shards: coder, id: hex.EncodeToString(hash.Sum(nil)), indexed: e.indexed, code: e.code},
+		size:    int(n),
+	}, nil
+}
+
+// storeEncodedSegment is storeSegment for a segment encodingSegments
+// encrypted and coded as it read it, whose cipher text went to the digest
+// then: it computes the parity and stores the shards.
+func storeEncodedSegment(ctx context.Context, s int, segment *encodedSegment, size int, locations []string, store sharding.ShardStore, cfg *config.Config, logger *zap.Logger) (string, string, error) {
+	shards, err := segment.shards.Finish()
+	if err != nil {
+		logger.Error("Erasure coding failed", zap.Int("segment", s), zap.Error(err))
+		return "", "", err
+	}
+	stored := make([][]byte, len(shards))
+	for i, shard := range shards {
+		stored[i] = segment.stored[i][:segment.header+len(shard)]
+	}
+	cipherSize := segment.shards.Size()
+
+	logger.Info("Storing segment", zap.Int("segment", s), zap.String("segmentID", segment.id), zap.Int("size", size))
+	sharding.DescribeShards(store, segment.id, segment.code.Data, segment.code.Parity, cipherSize)
+	if err := storeShards(ctx, segment.id, stored, locations, store, cfg, logger); err != nil {
+		removePartialShards(segment.id, len(stored), locations, store, logger)
+		return "", "", err
+	}
+	proofs, err := shardProofLines(shards, fmt.Sprintf("segment %d ", s), segment.indexed)
+	if err != nil {
+		return "", "", err
+	}
+	return fmt.Sprintf("  segment_%d: %s %d\n", s, segment.id, cipherSize), proofs, nil
+}
+
+// removePartialShards deletes the shards of a set that failed to be
+// stored in full, so they aren't left behind unreferenced. A failed
+// delete only leaves that shard behind; a store that can't delete leaves
+// them all.
+func removePartialShards(setID string, shards int, locations []string, store sharding.ShardStore, logger *zap.Logger) {
+	for i := 0; i < shards; i++ {
+		err := sharding.DeleteShard(store, setID, i, locations[i])
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			logger.Warn("Failed to remove partially stored shard", zap.String("setID", setID), zap.Int("shard", i), zap.Error(err))
+		}
+	}
+}
+
+// retrieveStream decodes and decrypts a streamed object segment by segment into w.
+func retrieveStream(ctx context.Context, metadatafile string, w io.Writer, store sharding.ShardStore, cfg *config.Config, logger *zap.Logger) (int64, error) {
+	if cfg.VerifyOnly {
+		return 0, ErrVerifyOnly
+	}
+	ctx, logger = startOperation(ctx, cfg, logger, "retrieve")
+	object, err := openStream(metadatafile, cfg, logger)
+	if err != nil {
+		return 0, err
+	}
+
+	var written int64
+	var buf []byte
+	defer func() { putBuffer(cfg, buf) }()
+	for s := range object.segments {
+		// Segments are decoded one after another into the same buffer
+		var plainText []byte
+		plainText, buf, err = object.decodeSegment(ctx, s, buf, store, cfg, logger)
+		if err != nil {
+			return written, err
+		}
+		n, err := w.Write(plainText)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// streamedObject is what decoding the segments of a streamed object takes.
+type streamedObject struct {
+	segments   []segment
+	sets       []shardSet
+	candidates [][]string
+	key        []byte
+}
+
+// openStream reads the segments, shard sets and key of a streamed object.
+func openStream(metadatafile string, cfg *config.Config, logger *zap.Logger) (*streamedObject, error) {
+	values, err := metadata.ReadValues(metadatafile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading metadata file: %w", err)
+	}
+	segments, err := readSegments(values)
+	if err != nil {
+		return nil, err
+	}
+	candidates, err := readShardCandidates(metadatafile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := objectKey(metadatafile, cfg, logger)
+	if err != nil {
+		logger.Error("Failed to get encryption key", zap.Error(err))
+		return nil, err
+	}
+	if chunkSize, err := readChunkSize(values); err != nil {
+		return nil, err
+	} else if chunkSize > 0 {
+		key = chunkKey(key)
+	}
+
+	sets, err := retrievalShardSets(metadatafile, values, cfg.RetrieveUnchecked, logger)
+	if err != nil {
+		return nil, err
+	}
+	if len(sets) != len(segments) {
+		return nil, fmt.Errorf("metadata has %d segments but proofs for %d", len(segments), len(sets))
+	}
+	return &streamedObject{segments: segments, sets: sets, candidates: candidates, key: key}, nil
+}
+
+// decodeSegment retrieves, decodes and decrypts segment s, decoding into
+// buf. It returns the plaintext, which shares buf's memory, and the buffer
+// to decode the next segment into.
+func (o *streamedObject) decodeSegment(ctx context.Context, s int, buf []byte, store sharding.ShardStore, cfg *config.Config, logger *zap.Logger) ([]byte, []byte, error) {
+	seg, set := o.segments[s], o.sets[s]
+	shards, err := retrieveShards(ctx, set, o.candidates, store, cfg, logger)
+	if err != nil {
+		return nil, buf, fmt.Errorf("segment %d: %w", s, err)
+	}
+	if buf == nil {
+		buf = getBuffer(cfg, set.Code.ShardSetSize(seg.Size))
+	}
+	cipherText, err := set.Code.AppendDecodeLength(buf[:0], shards, seg.Size)
+	if err != nil {
+		logger.Error("Erasure decoding failed", zap.Int("segment", s), zap.Error(err))
+		return nil, buf, fmt.Errorf("segment %d: %w", s, err)
+	}
+	plainText, err := encryption.Decrypt(cipherText, o.key)
+	if err != nil {
+		logger.Error("Decryption failed", zap.Int("segment", s), zap.Error(err))
+		return nil, cipherText[:0], err
+	}
+	return plainText, cipherText[:0], nil
+}
+
+// readLayout returns the layout an object was stored with. Objects written
+// before layouts were recorded were all stored in memory.
+func readLayout(metadatafile string) string {
+	layout, err := metadata.ReadValue(metadatafile, "layout")
+	if err != nil {
+		return layoutInMemory
+	}
+	return layout
+}
+
+// readSegments lists the segments of a streamed object in order.
+func readSegments(values map[string]string) ([]segment, error) {
+	var segments []segment
+	for s := 0; ; s++ {
+		value, ok := values[fmt.Sprintf("segment_%d", s)]
+		if !ok {
+			break
+		}
+		fields := strings.Fields(value)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid segment_%d in metadata: %q", s, value)
+		}
+		size, err := strconv.Atoi(fields[1])
+		if err != nil || size < aes.BlockSize {
+			return nil, fmt.Errorf("invalid segment_%d size in metadata: %q", s, fields[1])
+		}
+		segments = append(segments, segment{ID: fields[0], Size: size})
+	}
+	return segments, nil
+}
+
+// retrievalShardSets returns the shard sets of an object for retrieval.
+// When its proofs can't be read it fails with ErrProofsUnreadable, unless
+// unchecked is set: then the sets are returned without proofs and their
+// shards are decoded unchecked.
+func retrievalShardSets(metadatafile string, values map[string]string, unchecked bool, logger *zap.Logger) ([]shardSet, error) {
+	sets, err := readShardSets(metadatafile, values["dataID"])
+	if err == nil {
+		return sets, nil
+	}
+	if !unchecked {
+		return nil, fmt.Errorf("%w: %v; set RETRIEVE_UNCHECKED to decode the shards without checking them", ErrProofsUnreadable, err)
+	}
+	logger.Warn("Can't read proofs, shards are decoded unchecked", zap.Error(err))
+	code, err := readCode(values)
+	if err != nil {
+		return nil, err
+	}
+	set := shardSet{ID: objectSetID(values, values["dataID"]), Scheme: proofSchemeRaw, Indexed: readShardIndexed(values), Code: code}
+	if readLayout(metadatafile) != layoutStreaming {
+		return []shardSet{set}, nil
+	}
+	segments, _ := readSegments(values)
+	sets = make([]shardSet, len(segments))
+	for s, seg := range segments {
+		sets[s] = set
+		sets[s].ID = seg.ID
+	}
+	return sets, nil
+}
+
+// readShardSets returns the shard sets making up an object together with
+// the proofs recorded for their shards.
+func readShardSets(metadatafile, dataID string) ([]shardSet, error) {
+	values, err := metadata.ReadValues(metadatafile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading metadata file: %w", err)
+	}
+	scheme, err := readProofScheme(values)
+	if err != nil {
+		return nil, err
+	}
+
+	if readLayout(metadatafile) != layoutStreaming {
+		set, err := readShardSet(values, scheme, objectSetID(values, dataID), "")
+		if err != nil {
+			return nil, err
+		}
+		return []shardSet{set}, nil
+	}
+
+	segments, err := readSegments(values)
+	if err != nil {
+		return nil, err
+	}
+	sets := make([]shardSet, len(segments))
+	for s, seg := range segments {
+		if sets[s], err = readShardSet(values, scheme, seg.ID, fmt.Sprintf("segment %d ", s)); err != nil {
+			return nil, err
+		}
+	}
+	return sets, nil
+}
@@ -0,0 +1,255 @@
+package datastorage
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/techninja8/getvault.io/pkg/erasurecoding"
+	"github.com/techninja8/getvault.io/pkg/metadata"
+	"github.com/techninja8/getvault.io/pkg/shardheader"
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+func TestEncodeStoredShardsMatchesEncode(t *testing.T) {
+	code := erasurecoding.DefaultCode()
+	for _, size := range []int{17, 100_000} {
+		data := make([]byte, size)
+		if _, err := rand.Read(data); err != nil {
+			t.Fatal(err)
+		}
+		want, err := code.Encode(bytes.Clone(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, indexed := range []bool{false, true} {
+			stored, shards, err := encodeStoredShards(code, data, indexed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, shard := range encodeShards(indexed, want) {
+				if !bytes.Equal(stored[i], shard) || !bytes.Equal(shards[i], want[i]) {
+					t.Fatalf("%d bytes, indexed %t: shard %d differs from Encode's", size, indexed, i)
+				}
+			}
+		}
+	}
+}
+
+// failingShardStore fails to store shard 5 of every set once it has
+// stored after shards.
+type failingShardStore struct {
+	*sharding.InMemoryShardStore
+	mu     sync.Mutex
+	stored int
+	after  int
+}
+
+func (s *failingShardStore) StoreShard(dataID string, index int, shard []byte, location string) error {
+	s.mu.Lock()
+	fail := index == 5 && s.stored >= s.after
+	s.stored++
+	s.mu.Unlock()
+	if fail {
+		return errors.New("backend went away")
+	}
+	return s.InMemoryShardStore.StoreShard(dataID, index, shard, location)
+}
+
+func TestStreamedStoreRemovesPartialShards(t *testing.T) {
+	for _, after := range []int{0, 20, 60} {
+		t.Run(fmt.Sprintf("after=%d", after), func(t *testing.T) {
+			v := newTestVault(t)
+			v.cfg.MaxShardSize = 16 << 10
+			store := &failingShardStore{InMemoryShardStore: sharding.NewInMemoryShardStore(), after: after}
+			data := randomBytes(t, 1<<20)
+			_, _, err := StoreReader(bytes.NewReader(data), int64(len(data)), store, v.cfg, v.locations, v.logger, "object.bin")
+			if err == nil {
+				t.Fatal("stored with a failing backend")
+			}
+			// Segments are stored whole or not at all
+			total := len(v.locations)
+			if n := countFiles(t, v.locations); n%total != 0 {
+				t.Fatalf("%d shard files left, not whole sets of %d", n, total)
+			}
+		})
+	}
+}
+
+// TestStoredShardsDescribeThemselves stores through a store writing shard
+// headers, which record the code and length of the ciphertext the shards
+// decode to, whole objects or streamed segments alike.
+func TestStoredShardsDescribeThemselves(t *testing.T) {
+	v := newTestVault(t)
+	v.cfg.MaxShardSize = 16 << 10
+	store := sharding.NewInMemoryShardStore()
+	store.Headers = true
+	v.store = store
+	data := randomBytes(t, 300_000)
+	metadatafile := v.storeObject(t, "object.bin", data)
+	if _, _, err := StoreReader(bytes.NewReader(data), int64(len(data)), store, v.cfg, v.locations, v.logger, "streamed.bin"); err != nil {
+		t.Fatal(err)
+	}
+
+	code := erasurecoding.DefaultCode()
+	for i, location := range v.locations {
+		entries, err := os.ReadDir(location)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range entries {
+			file, err := os.ReadFile(filepath.Join(location, entry.Name()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			h, size, err := shardheader.Decode(file)
+			if err != nil {
+				t.Fatalf("%s: %v", entry.Name(), err)
+			}
+			if entry.Name() != sharding.PlainShardName(h.DataID, i) || h.Index != i || h.DataShards != code.Data || h.ParityShards != code.Parity ||
+				h.ShardLength != int64(len(file)-size) || int64(code.ShardSize(int(h.ObjectLength))) > h.ShardLength {
+				t.Fatalf("%s: header %+v", entry.Name(), h)
+			}
+		}
+	}
+	if got, err := RetrieveData(metadatafile, store, v.cfg, v.logger); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("RetrieveData = %d bytes, %v", len(got), err)
+	}
+}
+
+// TestFullyStreamedRoundTrip stores objects through the fully streamed
+// path, known in size or piped, ending short of, on and past segment
+// boundaries, and reads them back.
+func TestFullyStreamedRoundTrip(t *testing.T) {
+	v := newTestVault(t)
+	v.cfg.MaxShardSize = 16 << 10
+	choice, err := ChooseLayout(-1, v.cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	segmentSize := int(choice.SegmentSize)
+	for _, size := range []int{1, 1000, segmentSize, 3 * segmentSize, 3*segmentSize + 12_345} {
+		for _, piped := range []bool{false, true} {
+			data := randomBytes(t, size)
+			var r io.Reader = bytes.NewReader(data)
+			known := int64(size)
+			if piped {
+				r, known = io.MultiReader(r), -1
+			}
+			name := fmt.Sprintf("object-%d-%t.bin", size, piped)
+			_, metadatafile, err := StoreReader(r, known, v.store, v.cfg, v.locations, v.logger, name)
+			if err != nil {
+				t.Fatalf("%d bytes, piped %t: %v", size, piped, err)
+			}
+			if readLayout(metadatafile) != layoutStreaming {
+				continue // Small enough to be stored in memory
+			}
+			values, err := metadata.ReadValues(metadatafile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			segments, err := readSegments(values)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := (size + segmentSize - 1) / segmentSize; len(segments) != want {
+				t.Fatalf("%d bytes, piped %t: %d segments, expected %d", size, piped, len(segments), want)
+			}
+			var out bytes.Buffer
+			if n, err := RetrieveTo(metadatafile, &out, v.store, v.cfg, v.logger); err != nil || n != int64(size) || !bytes.Equal(out.Bytes(), data) {
+				t.Fatalf("%d bytes, piped %t: retrieved %d bytes: %v", size, piped, n, err)
+			}
+		}
+	}
+}
+
+// discardShardStore stores shards nowhere, so storing holds no more
+// memory than the path to the store does.
+type discardShardStore struct{}
+
+func (discardShardStore) StoreShard(dataID string, index int, shard []byte, location string) error {
+	return nil
+}
+
+func (discardShardStore) RetrieveShard(dataID string, index int, location string) ([]byte, error) {
+	return nil, os.ErrNotExist
+}
+
+func (discardShardStore) Close() error { return nil }
+
+// zeroReader reads zeros, which encrypt to cipher text as random as any.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// BenchmarkStreamedStorePeakMemory pipes objects of growing size through
+// the fully streamed path, segments of 1 MiB a worker at a time. peak-B is
+// the most heap in use above what it was before the store, segment-sets
+// the same in shard sets of a segment: it stays within a few of them, the
+// one being read, the one being stored and garbage the collector hasn't
+// caught up with, whatever the size of the object.
+func BenchmarkStreamedStorePeakMemory(b *testing.B) {
+	for _, size := range []int64{4 << 20, 32 << 20, 256 << 20} {
+		b.Run(fmt.Sprintf("%dMiB", size>>20), func(b *testing.B) {
+			v := newTestVault(b)
+			v.cfg.CPUWorkers = 1
+			v.cfg.MaxShardSize = 128<<10 + shardHeaderSize
+			choice, err := ChooseLayout(-1, v.cfg)
+			if err != nil {
+				b.Fatal(err)
+			}
+			setSize := int64(choice.Code.Total() * (shardHeaderSize + choice.Code.ShardSize(aes.BlockSize+int(choice.SegmentSize))))
+
+			// Collecting often keeps the heap in use close to what is live,
+			// rather than what is live plus garbage not collected yet
+			defer debug.SetGCPercent(debug.SetGCPercent(5))
+			b.SetBytes(size)
+			var peak uint64
+			for i := 0; i < b.N; i++ {
+				runtime.GC()
+				var stats runtime.MemStats
+				runtime.ReadMemStats(&stats)
+				base := stats.HeapInuse
+
+				stop, sampled := make(chan struct{}), make(chan uint64)
+				go func() {
+					var most uint64
+					ticker := time.NewTicker(time.Millisecond)
+					defer ticker.Stop()
+					for {
+						var stats runtime.MemStats
+						runtime.ReadMemStats(&stats)
+						most = max(most, stats.HeapInuse-min(stats.HeapInuse, base))
+						select {
+						case <-stop:
+							sampled <- most
+							return
+						case <-ticker.C:
+						}
+					}
+				}()
+				r := io.LimitReader(zeroReader{}, size)
+				if _, _, err := StoreReader(r, -1, discardShardStore{}, v.cfg, v.locations, v.logger, "object.bin"); err != nil {
+					b.Fatal(err)
+				}
+				close(stop)
+				peak = max(peak, <-sampled)
+			}
+			b.ReportMetric(float64(peak), "peak-B")
+			b.ReportMetric(float64(peak)/float64(setSize), "segment-sets")
+		})
+	}
+}
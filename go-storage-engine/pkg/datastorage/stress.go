@@ -0,0 +1,221 @@
+package datastorage
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	mathrand "math/rand"
+	"os"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/techninja8/getvault.io/internal/tmp"
+	"github.com/techninja8/getvault.io/pkg/config"
+	"github.com/techninja8/getvault.io/pkg/erasurecoding"
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+// StressOptions controls a randomized store, verify and retrieve run.
+type StressOptions struct {
+	Iterations int
+	Seed       int64         // Iteration i uses Seed+i, so any one can be rerun alone
+	MaxSize    int           // Largest payload, in bytes
+	MaxDelay   time.Duration // Longest delay injected into a shard retrieval
+}
+
+// StressFailure is an iteration whose outcome was wrong.
+type StressFailure struct {
+	Seed    int64  `json:"seed"`
+	Size    int    `json:"size"`
+	Code    string `json:"erasure_code"` // e.g. "4+2 gf8"
+	Layout  string `json:"layout"`
+	Faults  string `json:"faults"`
+	Problem string `json:"problem"`
+}
+
+// StressResult is the outcome of a stress run.
+type StressResult struct {
+	Iterations    int             `json:"iterations"`
+	Recoverable   int             `json:"recoverable"`   // Iterations whose faults were within parity
+	Unrecoverable int             `json:"unrecoverable"` // Iterations whose faults weren't
+	Failures      []StressFailure `json:"failures,omitempty"`
+	Leftover      int             `json:"leftover_shards,omitempty"` // Shards that couldn't be removed
+}
+
+// Stress stores random payloads on locations and reads them back through
+// a FaultyShardStore that drops, corrupts or delays random shards. Each
+// iteration draws from its own seed the payload's size and contents, an
+// erasure code of up to as many data and parity shards as the configured
+// one, over its field and with parity when it has any, whether the payload
+// is stored in memory or streamed in segments, and a fault plan touching
+// up to twice as many shards as the code has parity. Its shards go to the
+// first locations, one for each. Within parity, verification must call
+// the object healthy or degraded and retrieval must return the payload
+// byte for byte; beyond it, verification must call it unrecoverable and
+// retrieval must fail with ErrInsufficientShards. Anything else is a
+// failure, reported with the seed that reproduces it.
+//
+// open is called for a fresh store to write each payload and another to
+// read it, so any backend can be put through the same run. Objects are
+// stored under a throwaway key and metadata directory, and their shards
+// are deleted afterwards when the store has the delete capability.
+func Stress(open func() sharding.ShardStore, locations []string, opts StressOptions, cfg *config.Config, logger *zap.Logger) (*StressResult, error) {
+	code, err := ConfiguredCode(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Iterations < 1 || opts.MaxSize < 0 || len(locations) < code.Total() {
+		return nil, fmt.Errorf("a stress run needs iterations, a payload size and %d locations", code.Total())
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	dir, err := tmp.MkdirTemp("vault-stress-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	runCfg := *cfg
+	runCfg.EncryptionKey = hex.EncodeToString(key)
+	runCfg.MetadataDir = dir
+	runCfg.VerifyOnly = false
+	runCfg.Transforms = nil
+	runCfg.Recipients = nil
+	runCfg.MaxObjectSize = 0
+	// Injected faults are permanent, so retrying them only slows the run
+	runCfg.ShardRetryAttempts = 1
+
+	result := &StressResult{}
+	for i := 0; i < opts.Iterations; i++ {
+		seed := opts.Seed + int64(i)
+		failure, recoverable, leftover := stressIteration(open, locations, seed, code, opts, runCfg, logger)
+		result.Iterations++
+		result.Leftover += leftover
+		if !recoverable {
+			result.Unrecoverable++
+		} else {
+			result.Recoverable++
+		}
+		if failure != nil {
+			logger.Error("Stress iteration failed", zap.Int64("seed", seed), zap.String("faults", failure.Faults), zap.String("problem", failure.Problem))
+			result.Failures = append(result.Failures, *failure)
+		}
+	}
+	return result, nil
+}
+
+// stressIteration runs the iteration for one seed, drawing its code from
+// within limits, and returns its failure, if any, whether its fault plan
+// left the object recoverable, and how many of its shards were left
+// behind.
+func stressIteration(open func() sharding.ShardStore, locations []string, seed int64, limits erasurecoding.Code, opts StressOptions, cfg config.Config, logger *zap.Logger) (*StressFailure, bool, int) {
+	rng := mathrand.New(mathrand.NewSource(seed))
+	payload := make([]byte, rng.Intn(opts.MaxSize+1))
+	rng.Read(payload)
+
+	// A code without parity has no faults to survive
+	parity := min(1+rng.Intn(max(limits.Parity, 1)), limits.Parity)
+	code, err := erasurecoding.NewCode(1+rng.Intn(limits.Data), parity, limits.Field)
+	if err != nil {
+		return &StressFailure{Seed: seed, Size: len(payload), Problem: err.Error()}, true, 0
+	}
+	cfg.DataShards, cfg.ParityShards = code.Data, code.Parity
+	if code.Data != erasurecoding.DataShards || code.Parity != erasurecoding.ParityShards || code.Field != erasurecoding.FieldGF8 {
+		// Only objects of the default code are chunked
+		cfg.ChunkSize = 0
+	}
+	locations = locations[:code.Total()]
+
+	layout := layoutInMemory
+	switch rng.Intn(3) {
+	case 1:
+		cfg.StreamingThreshold = 1
+		layout = layoutStreaming
+	case 2:
+		// Shards small enough to cut the payload into a few segments
+		segmentSize := len(payload)/(2+rng.Intn(7)) + 1
+		cfg.MaxShardSize = int64(shardHeaderSize + code.ShardSize(segmentSize+aes.BlockSize))
+		layout = layoutStreaming + " (segmented)"
+	default:
+		cfg.StreamingThreshold = 0
+		cfg.MaxShardSize = 0
+	}
+	plan := sharding.RandomFaultPlan(rng, code.Total(), rng.Intn(2*code.Parity+1), opts.MaxDelay)
+	failure := &StressFailure{Seed: seed, Size: len(payload), Code: code.String(), Layout: layout, Faults: plan.String()}
+	lost := plan.Lost()
+	recoverable := lost <= code.Parity
+
+	write := open()
+	dataID, metadatafile, err := StoreReader(bytes.NewReader(payload), int64(len(payload)), write, &cfg, locations, logger, fmt.Sprintf("stress-%d.bin", seed))
+	write.Close()
+	if err != nil {
+		failure.Problem = fmt.Sprintf("store failed: %v", err)
+		return failure, recoverable, 0
+	}
+
+	read := open()
+	defer read.Close()
+	faulty := &sharding.FaultyShardStore{Store: read, Plan: plan}
+	failure.Problem = checkStressObject(metadatafile, faulty, payload, lost, code.Parity, &cfg, logger)
+	leftover := cleanupObject(read, metadatafile, dataID, locations, logger)
+	if failure.Problem == "" {
+		return nil, recoverable, leftover
+	}
+	return failure, recoverable, leftover
+}
+
+// checkStressObject verifies and retrieves a stress object through its
+// faults and describes what went wrong, if anything.
+func checkStressObject(metadatafile string, faulty sharding.ShardStore, payload []byte, lost, parity int, cfg *config.Config, logger *zap.Logger) string {
+	recoverable := lost <= parity
+	report, err := CheckData(metadatafile, faulty, CheckOptions{}, logger)
+	if err != nil {
+		return fmt.Sprintf("verify failed: %v", err)
+	}
+	if recoverable == (report.Health == ObjectUnrecoverable) {
+		return fmt.Sprintf("verify called the object %s with %d shards lost", report.Health, lost)
+	}
+
+	var got bytes.Buffer
+	_, err = retrieveTo(context.Background(), metadatafile, &got, faulty, cfg, logger)
+	switch {
+	case recoverable && err != nil:
+		return fmt.Sprintf("retrieve failed with %d shards lost: %v", lost, err)
+	case recoverable && !bytes.Equal(got.Bytes(), payload):
+		return fmt.Sprintf("retrieved %d bytes that differ from the %d stored", got.Len(), len(payload))
+	case !recoverable && !errors.Is(err, ErrInsufficientShards):
+		return fmt.Sprintf("retrieve with %d shards lost returned %v, expected %v", lost, err, ErrInsufficientShards)
+	}
+	return ""
+}
+
+// cleanupObject deletes the shards of a stress object and returns how many
+// are left behind.
+func cleanupObject(store sharding.ShardStore, metadatafile, dataID string, locations []string, logger *zap.Logger) int {
+	total := len(locations)
+	sets, err := readShardSets(metadatafile, dataID)
+	if err != nil {
+		logger.Warn("Can't read shard sets to clean up", zap.String("dataID", dataID), zap.Error(err))
+		return total
+	}
+	if !sharding.Probe(store).Delete {
+		logger.Warn("Store can't delete shards, leaving stress shards behind", zap.String("dataID", dataID))
+		return total * len(sets)
+	}
+	left := 0
+	for _, set := range sets {
+		for i := 0; i < total; i++ {
+			if err := sharding.DeleteShard(store, set.ID, i, locations[i]); err != nil {
+				left++
+			}
+		}
+	}
+	return left
+}
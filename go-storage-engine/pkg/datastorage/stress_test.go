@@ -0,0 +1,69 @@
+package datastorage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+// TestStress runs a fixed seed through Stress, so a failure is the same
+// one on every run. Rerun a failing seed with vault stress --seed.
+func TestStress(t *testing.T) {
+	v := newTestVault(t)
+	open := func() sharding.ShardStore { return sharding.NewInMemoryShardStore() }
+	iterations := 100
+	if testing.Short() {
+		iterations = 20
+	}
+	result, err := Stress(open, v.locations, StressOptions{Iterations: iterations, Seed: 956, MaxSize: 64 << 10, MaxDelay: time.Millisecond}, v.cfg, v.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, failure := range result.Failures {
+		t.Errorf("seed %d: %d bytes, %s, %s, faults %s: %s", failure.Seed, failure.Size, failure.Code, failure.Layout, failure.Faults, failure.Problem)
+	}
+	if result.Iterations != iterations || result.Recoverable == 0 || result.Unrecoverable == 0 || result.Leftover != 0 {
+		t.Fatalf("%+v", result)
+	}
+}
+
+// shardCounter counts the distinct shard indexes stored through it.
+type shardCounter struct {
+	sharding.ShardStore
+	indexes map[int]bool
+}
+
+func (c *shardCounter) StoreShard(dataID string, index int, data []byte, location string) error {
+	c.indexes[index] = true
+	return c.ShardStore.StoreShard(dataID, index, data, location)
+}
+
+// TestStressDrawsCodes checks that each seed draws a code of its own,
+// within the configured one, and draws the same code again.
+func TestStressDrawsCodes(t *testing.T) {
+	v := newTestVault(t)
+	totals := map[int]bool{}
+	for seed := int64(0); seed < 20; seed++ {
+		var shards []int
+		for range 2 {
+			counter := &shardCounter{indexes: map[int]bool{}}
+			open := func() sharding.ShardStore {
+				counter.ShardStore = sharding.NewInMemoryShardStore()
+				return counter
+			}
+			result, err := Stress(open, v.locations, StressOptions{Iterations: 1, Seed: seed, MaxSize: 1000}, v.cfg, v.logger)
+			if err != nil || len(result.Failures) != 0 {
+				t.Fatalf("seed %d: %+v, %v", seed, result, err)
+			}
+			shards = append(shards, len(counter.indexes))
+		}
+		if shards[0] != shards[1] || shards[0] < 1 || shards[0] > len(v.locations) {
+			t.Fatalf("seed %d stored %d shards, then %d, with %d locations", seed, shards[0], shards[1], len(v.locations))
+		}
+		totals[shards[0]] = true
+	}
+	if len(totals) < 3 {
+		t.Fatalf("20 seeds drew codes of only %d sizes", len(totals))
+	}
+}
@@ -0,0 +1,262 @@
+package datastorage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/techninja8/getvault.io/pkg/config"
+	"github.com/techninja8/getvault.io/pkg/metadata"
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+// Storage tiers. Objects are stored hot; those not retrieved for a while
+// are demoted to the cold tier, whose locations are cheaper but slower to
+// read. Objects without a "tier" line are hot.
+const (
+	tierHot  = "hot"
+	tierCold = "cold"
+)
+
+var ErrColdObject = errors.New("object is in cold storage")
+
+// TierPolicy decides which objects are demoted and where to.
+type TierPolicy struct {
+	ColdAfter     time.Duration
+	ColdLocations []string
+	Now           func() time.Time // time.Now when nil
+}
+
+// TierPolicyFromConfig builds the policy configured by TIER_COLD_AFTER and COLD_LOCATIONS.
+func TierPolicyFromConfig(cfg *config.Config) (TierPolicy, error) {
+	if cfg.ColdLocations == "" {
+		return TierPolicy{}, errors.New("no cold storage locations configured (set COLD_LOCATIONS)")
+	}
+	if cfg.TierColdAfter <= 0 {
+		return TierPolicy{}, errors.New("TIER_COLD_AFTER must be positive")
+	}
+	code, err := ConfiguredCode(cfg)
+	if err != nil {
+		return TierPolicy{}, err
+	}
+	locations, err := ReadStorageLocationPool(cfg.ColdLocations, code.Total())
+	if err != nil {
+		return TierPolicy{}, fmt.Errorf("failed to read cold storage locations: %w", err)
+	}
+	return TierPolicy{ColdAfter: cfg.TierColdAfter, ColdLocations: locations}, nil
+}
+
+func (p TierPolicy) now() time.Time {
+	if p.Now != nil {
+		return p.Now()
+	}
+	return time.Now()
+}
+
+// TierSummary counts the outcome of a tiering run.
+type TierSummary struct {
+	Objects int
+	Demoted int
+	Failed  int
+}
+
+// RecordAccess sets an object's last access time, which tiering policies
+// go by, and adds the retrieval to its history. Objects never retrieved
+// count from their creation date.
+func RecordAccess(metadatafile string, at time.Time) error {
+	err := setMetadataValue(metadatafile, "last_access", at.UTC().Format(time.RFC3339))
+	return errors.Join(err, recordObjectEvent(metadatafile, ObjectEvent{Event: EventRetrieved}))
+}
+
+// ReadTier returns the tier an object is stored in.
+func ReadTier(metadatafile string) string {
+	tier, err := metadata.ReadValue(metadatafile, "tier")
+	if err != nil {
+		return tierHot
+	}
+	return tier
+}
+
+// CheckColdRetrieval warns that retrieving a cold object may be slow. With
+// cfg.TierRequireAllowCold set, it refuses unless allowCold is given.
+func CheckColdRetrieval(metadatafile string, cfg *config.Config, allowCold bool, logger *zap.Logger) error {
+	if ReadTier(metadatafile) != tierCold {
+		return nil
+	}
+	if cfg.TierRequireAllowCold && !allowCold {
+		return fmt.Errorf("%w; retrieval may be slow, pass --allow-cold to proceed", ErrColdObject)
+	}
+	logger.Warn("Object is in cold storage, retrieval may take longer than usual", zap.String("metadataFile", metadatafile))
+	return nil
+}
+
+// TierRun demotes every hot object in metadataDir whose last access is
+// older than the policy allows, moving its shards to the cold locations.
+// It stops between objects once ctx is done.
+func TierRun(ctx context.Context, metadataDir string, store sharding.ShardStore, policy TierPolicy, logger *zap.Logger) (*TierSummary, error) {
+	files, err := listMetadataFiles(metadataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	summary := &TierSummary{}
+	now := policy.now()
+	for _, file := range files {
+		if err := ctx.Err(); err != nil {
+			return summary, err
+		}
+		summary.Objects++
+		due, err := dueForCold(file, policy.ColdAfter, now)
+		if err != nil {
+			logger.Warn("Skipping object", zap.String("metadataFile", file), zap.Error(err))
+			summary.Failed++
+			continue
+		}
+		if !due {
+			continue
+		}
+		if err := CheckUnlocked(file, now); err != nil {
+			logger.Info("Skipping locked object", zap.String("metadataFile", file), zap.Error(err))
+			continue
+		}
+		if err := demoteObject(file, store, policy.ColdLocations, logger); err != nil {
+			logger.Error("Demoting object failed", zap.String("metadataFile", file), zap.Error(err))
+			summary.Failed++
+			continue
+		}
+		logger.Info("Demoted object to cold storage", zap.String("metadataFile", file))
+		summary.Demoted++
+	}
+	return summary, nil
+}
+
+// dueForCold reports whether a hot object has gone unretrieved for coldAfter.
+func dueForCold(metadatafile string, coldAfter time.Duration, now time.Time) (bool, error) {
+	values, err := metadata.ReadValues(metadatafile)
+	if err != nil {
+		return false, err
+	}
+	if tier, ok := values["tier"]; ok && tier != tierHot {
+		return false, nil
+	}
+	accessed, ok := values["last_access"]
+	if !ok {
+		accessed = values["creation_date"]
+	}
+	at, err := time.Parse(time.RFC3339, accessed)
+	if err != nil {
+		return false, fmt.Errorf("invalid access time %q in metadata", accessed)
+	}
+	return now.Sub(at) >= coldAfter, nil
+}
+
+// demoteObject copies every shard of an object to its cold location and
+// then points the metadata at them. Shards are checked against their
+// proofs first, and missing or corrupt ones rebuilt, so only an intact
+// object is moved. The hot copies are left in place.
+func demoteObject(metadatafile string, store sharding.ShardStore, cold []string, logger *zap.Logger) error {
+	dataID, err := metadata.ReadValue(metadatafile, "dataID")
+	if err != nil {
+		return fmt.Errorf("error reading metadata file: %w", err)
+	}
+	candidates, err := readShardCandidates(metadatafile)
+	if err != nil {
+		return err
+	}
+	// Objects with fewer shards than there are cold locations use the first ones
+	if len(cold) < len(candidates) {
+		return fmt.Errorf("need %d cold locations, have %d", len(candidates), len(cold))
+	}
+	cold = cold[:len(candidates)]
+	sets, err := readShardSets(metadatafile, dataID)
+	if err != nil {
+		return err
+	}
+
+	for _, set := range sets {
+		shards, err := intactShards(set, candidates, store, logger)
+		if err != nil {
+			return fmt.Errorf("shard set %s: %w", set.ID, err)
+		}
+		for i, shard := range shards {
+			encoded := encodeShard(set.Indexed, i, shard)
+			// Stores that checksum in place let a rerun skip copies already
+			// made; others are simply written again.
+			if sharding.Probe(store).Checksum {
+				if sum, err := sharding.ShardChecksum(store, set.ID, i, cold[i]); err == nil && sum == sharding.TransferChecksum(encoded) {
+					logger.Info("Cold copy already in place", zap.String("shardSet", set.ID), zap.Int("index", i))
+					continue
+				}
+			}
+			if err := store.StoreShard(set.ID, i, encoded, cold[i]); err != nil {
+				return fmt.Errorf("failed to store shard %d at %s: %w", i, cold[i], err)
+			}
+		}
+	}
+
+	logger.Info("Hot shard copies left in place", zap.String("dataID", dataID))
+	relocated := make(map[string]string, len(cold))
+	for i, location := range cold {
+		relocated[fmt.Sprintf("shard_%d", i)] = location
+	}
+	err = rewriteMetadataFile(metadatafile, func(lines []string) ([]string, error) {
+		var out []string
+		for _, line := range lines {
+			k, _, _ := strings.Cut(strings.TrimSpace(line), ": ")
+			if location, ok := relocated[k]; ok {
+				line = fmt.Sprintf("  %s: %s", k, location)
+			} else if _, ok := relocated[strings.TrimSuffix(k, "_candidates")]; ok {
+				continue // Candidates hold hot copies
+			}
+			out = append(out, line)
+		}
+		// The cold copies are of shards checked against their proofs
+		return bumpGeneration(metadata.SetValue(out, "tier", tierCold), true)
+	})
+	if err != nil {
+		return err
+	}
+	if err := recordEvent(metadatafile, dataID, ObjectEvent{Event: EventMigrated, Detail: "tier " + tierCold}); err != nil {
+		logger.Warn("Failed to record object history", zap.Error(err))
+	}
+	return nil
+}
+
+// intactShards fetches a shard set and rebuilds any missing or corrupt
+// shards, failing unless every shard then matches its proof.
+func intactShards(set shardSet, candidates [][]string, store sharding.ShardStore, logger *zap.Logger) ([][]byte, error) {
+	shards := make([][]byte, len(candidates))
+	for i := range candidates {
+		shards[i], _, _ = sharding.RetrieveShardFrom(store, set.ID, i, candidates[i])
+	}
+	usable, _, err := set.usableShards(placeShards(shards, set.Indexed, logger))
+	if err != nil {
+		return nil, err
+	}
+	rebuilt := slices.Clone(usable)
+	if slices.ContainsFunc(rebuilt, func(shard []byte) bool { return shard == nil }) {
+		if err := set.Code.Reconstruct(rebuilt); err != nil {
+			return nil, fmt.Errorf("failed to rebuild shards: %w", err)
+		}
+	}
+	checks, err := set.checkProofs(rebuilt)
+	if err != nil {
+		return nil, err
+	}
+	if slices.Contains(checks, false) {
+		return nil, errors.New("shards don't match the recorded proofs")
+	}
+	return rebuilt, nil
+}
+
+// setMetadataValue sets a top-level key of a metadata file.
+func setMetadataValue(metadatafile, key, value string) error {
+	return rewriteMetadataFile(metadatafile, func(lines []string) ([]string, error) {
+		return metadata.SetValue(lines, key, value), nil
+	})
+}
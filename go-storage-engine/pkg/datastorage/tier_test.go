@@ -0,0 +1,127 @@
+package datastorage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/techninja8/getvault.io/pkg/metadata"
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+// TestTierRunDemotesIdleObjects stores two objects and, on a clock 100
+// days on, demotes the one never retrieved while leaving the one
+// retrieved the day before hot. The demoted object's metadata points at
+// the cold locations, and it reads back from them with its hot copies
+// gone.
+func TestTierRunDemotesIdleObjects(t *testing.T) {
+	v := newTestVault(t)
+	coldDir := t.TempDir()
+	cold := make([]string, len(v.locations))
+	for i := range cold {
+		cold[i] = filepath.Join(coldDir, fmt.Sprintf("cold%d", i))
+	}
+	now := time.Now().Add(100 * 24 * time.Hour)
+	policy := TierPolicy{ColdAfter: 90 * 24 * time.Hour, ColdLocations: cold, Now: func() time.Time { return now }}
+
+	idleData, busyData := randomBytes(t, 100_000), randomBytes(t, 50_000)
+	idle := v.storeObject(t, "idle.bin", idleData)
+	busy := v.storeObject(t, "busy.bin", busyData)
+	if err := RecordAccess(busy, now.Add(-24*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	summary, err := TierRun(context.Background(), v.cfg.MetadataDir, v.store, policy, v.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Objects != 2 || summary.Demoted != 1 || summary.Failed != 0 {
+		t.Fatalf("tier run %+v, expected 1 of 2 objects demoted", *summary)
+	}
+	if ReadTier(idle) != tierCold || ReadTier(busy) != tierHot {
+		t.Fatalf("idle object is %s and busy one %s", ReadTier(idle), ReadTier(busy))
+	}
+	values, err := metadata.ReadValues(idle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, location := range cold {
+		if got := values[fmt.Sprintf("shard_%d", i)]; got != location {
+			t.Fatalf("demoted shard %d recorded at %s, expected %s", i, got, location)
+		}
+	}
+
+	for i := range v.locations {
+		if err := os.Remove(v.shardFile(t, idle, i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := RetrieveData(idle, sharding.NewInMemoryShardStore(), v.cfg, v.logger)
+	if err != nil {
+		t.Fatalf("retrieving the demoted object: %v", err)
+	}
+	if !bytes.Equal(got, idleData) {
+		t.Fatal("demoted object read back differently")
+	}
+	if got, err := RetrieveData(busy, sharding.NewInMemoryShardStore(), v.cfg, v.logger); err != nil || !bytes.Equal(got, busyData) {
+		t.Fatalf("retrieving the hot object: %v", err)
+	}
+
+	// A later run leaves cold objects alone, and the busy one is not yet due
+	now = now.Add(30 * 24 * time.Hour)
+	summary, err = TierRun(context.Background(), v.cfg.MetadataDir, v.store, policy, v.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Demoted != 0 || summary.Failed != 0 {
+		t.Fatalf("second tier run %+v, expected nothing demoted", *summary)
+	}
+
+	// Once its last access is old enough, the busy object goes too
+	now = now.Add(61 * 24 * time.Hour)
+	summary, err = TierRun(context.Background(), v.cfg.MetadataDir, v.store, policy, v.logger)
+	if err != nil || summary.Demoted != 1 || ReadTier(busy) != tierCold {
+		t.Fatalf("third tier run %+v, %v, left the busy object %s", summary, err, ReadTier(busy))
+	}
+}
+
+func TestTierRunRefusesTooFewColdLocations(t *testing.T) {
+	v := newTestVault(t)
+	idle := v.storeObject(t, "idle.bin", randomBytes(t, 1000))
+	policy := TierPolicy{ColdLocations: []string{t.TempDir()}, Now: func() time.Time { return time.Now().Add(time.Hour) }}
+	summary, err := TierRun(context.Background(), v.cfg.MetadataDir, v.store, policy, v.logger)
+	if err != nil || summary.Failed != 1 || summary.Demoted != 0 {
+		t.Fatalf("tier run with one cold location %+v, %v", summary, err)
+	}
+	if ReadTier(idle) != tierHot {
+		t.Fatal("object demoted to too few locations")
+	}
+}
+
+func TestCheckColdRetrieval(t *testing.T) {
+	v := newTestVault(t)
+	object := v.storeObject(t, "object.bin", randomBytes(t, 1000))
+	v.cfg.TierRequireAllowCold = true
+	if err := CheckColdRetrieval(object, v.cfg, false, v.logger); err != nil {
+		t.Fatalf("hot object refused: %v", err)
+	}
+	if err := setMetadataValue(object, "tier", tierCold); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckColdRetrieval(object, v.cfg, false, v.logger); !errors.Is(err, ErrColdObject) || !strings.Contains(err.Error(), "--allow-cold") {
+		t.Fatalf("cold object without --allow-cold: %v", err)
+	}
+	if err := CheckColdRetrieval(object, v.cfg, true, v.logger); err != nil {
+		t.Fatalf("cold object with --allow-cold: %v", err)
+	}
+	v.cfg.TierRequireAllowCold = false
+	if err := CheckColdRetrieval(object, v.cfg, false, v.logger); err != nil {
+		t.Fatalf("cold object when --allow-cold isn't required: %v", err)
+	}
+}
@@ -0,0 +1,201 @@
+package datastorage
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+
+	"go.uber.org/zap"
+
+	"github.com/techninja8/getvault.io/pkg/metadata"
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+// LocationLoss is what losing one location would do to an object.
+type LocationLoss struct {
+	Location string `json:"location"`
+	Shards   []int  `json:"shards,omitempty"` // Good shards held there
+	// Whether the object still reconstructs from the shards left
+	Survivable bool `json:"survivable"`
+}
+
+// ToleranceReport is the real redundancy of an object: how many location
+// failures it survives given the shards present and good now, rather
+// than the parity count it was stored with.
+type ToleranceReport struct {
+	MetadataFile string         `json:"metadata_file"`
+	DataID       string         `json:"data_id"`
+	GoodShards   int            `json:"good_shards"`   // Fewest good shards in any shard set
+	NeededShards int            `json:"needed_shards"` // Good shards a set needs to be recovered
+	Theoretical  int            `json:"theoretical"`   // Failures survived with every shard good
+	Margin       int            `json:"margin"`        // Failures survived now, -1 if already unrecoverable
+	Losses       []LocationLoss `json:"losses"`
+}
+
+// CheckFaultTolerance works out how many locations an object can lose and
+// still be recovered. Every shard is read and checked against its proof,
+// then the loss of each location holding good shards is simulated by
+// reconstructing without them and checking the rebuilt shards against the
+// proofs. The margin is the largest number of locations that can fail in
+// any combination: the object survives losing the locations with the most
+// good shards first as long as enough good shards remain to decode. Streamed
+// objects are as tolerant as their least tolerant segment. A shard found
+// in another shard's slot counts at the location it was read from.
+func CheckFaultTolerance(metadatafile string, store sharding.ShardStore, logger *zap.Logger) (*ToleranceReport, error) {
+	_, logger = withOperation(context.Background(), logger, "fault-tolerance")
+	dataID, err := metadata.ReadValue(metadatafile, "dataID")
+	if err != nil {
+		return nil, fmt.Errorf("error reading metadata file: %w", err)
+	}
+	candidates, err := readShardCandidates(metadatafile)
+	if err != nil {
+		return nil, err
+	}
+	sets, err := readShardSets(metadatafile, dataID)
+	if err != nil {
+		return nil, err
+	}
+	code, err := ObjectCode(metadatafile)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ToleranceReport{
+		MetadataFile: metadatafile,
+		DataID:       dataID,
+		GoodShards:   len(candidates),
+		NeededShards: code.Data,
+		Theoretical:  code.Parity,
+		Margin:       len(candidates),
+	}
+	losses := make(map[string]*LocationLoss)
+	for _, set := range sets {
+		good, at, err := goodShards(set, candidates, store, logger)
+		if err != nil {
+			return nil, err
+		}
+
+		// Good shards by location, fullest first
+		held := make(map[string][]int)
+		count := 0
+		for i, shard := range good {
+			if shard != nil {
+				held[at[i]] = append(held[at[i]], i)
+				count++
+			}
+		}
+		report.GoodShards = min(report.GoodShards, count)
+		counts := make([]int, 0, len(held))
+		for _, shards := range held {
+			counts = append(counts, len(shards))
+		}
+		slices.SortFunc(counts, func(a, b int) int { return cmp.Compare(b, a) })
+		margin, left := -1, count
+		if count >= code.Data {
+			margin = 0
+			for _, n := range counts {
+				if left -= n; left < code.Data {
+					break
+				}
+				margin++
+			}
+		}
+		report.Margin = min(report.Margin, margin)
+
+		for location, shards := range held {
+			loss, ok := losses[location]
+			if !ok {
+				loss = &LocationLoss{Location: location, Survivable: true}
+				losses[location] = loss
+			}
+			for _, i := range shards {
+				if !slices.Contains(loss.Shards, i) {
+					loss.Shards = append(loss.Shards, i)
+				}
+			}
+			if loss.Survivable && !survivesLoss(set, good, shards, logger) {
+				loss.Survivable = false
+			}
+		}
+	}
+
+	for _, loss := range losses {
+		slices.Sort(loss.Shards)
+		report.Losses = append(report.Losses, *loss)
+	}
+	slices.SortFunc(report.Losses, func(a, b LocationLoss) int { return cmp.Compare(a.Location, b.Location) })
+	logger.Info("Fault tolerance checked", zap.String("dataID", dataID), zap.Int("margin", report.Margin))
+	return report, nil
+}
+
+// goodShards reads the shards of a set and returns those that match their
+// proofs, nil otherwise, with the location each was read from. Raw-shard
+// proofs can only vouch for a whole set, so their shards count as good if
+// the set reconstructed from them matches.
+func goodShards(set shardSet, candidates [][]string, store sharding.ShardStore, logger *zap.Logger) ([][]byte, []string, error) {
+	retrieved := make([][]byte, len(candidates))
+	found := make([]string, len(candidates))
+	for i := range candidates {
+		shard, from, err := sharding.RetrieveShardFrom(store, set.ID, i, candidates[i])
+		if err != nil {
+			logger.Warn("Shard retrieval failed", zap.Int("index", i), zap.Strings("locations", candidates[i]), zap.Error(err))
+			continue
+		}
+		retrieved[i], found[i] = shard, from
+	}
+
+	// Each shard is held where it was read from, even if that was another
+	// shard's slot
+	at := make([]string, len(candidates))
+	for i := range candidates {
+		at[i] = candidates[i][0]
+	}
+	if set.Indexed {
+		for slot, data := range retrieved {
+			if index, _, err := decodeShard(data); data != nil && err == nil && index != slot && index < len(at) && retrieved[index] == nil {
+				at[index] = found[slot]
+			}
+		}
+	}
+	for i, from := range found {
+		if from != "" {
+			at[i] = from
+		}
+	}
+
+	shards := placeShards(retrieved, set.Indexed, logger)
+	usable, ownChecks, err := set.usableShards(shards)
+	if err != nil {
+		return nil, nil, err
+	}
+	if ownChecks == nil && !reconstructsToProofs(set, usable, logger) {
+		return make([][]byte, len(candidates)), at, nil
+	}
+	return usable, at, nil
+}
+
+// survivesLoss reports whether a set still reconstructs to shards matching
+// its proofs without the good shards in lost.
+func survivesLoss(set shardSet, good [][]byte, lost []int, logger *zap.Logger) bool {
+	left := slices.Clone(good)
+	for _, i := range lost {
+		left[i] = nil
+	}
+	return reconstructsToProofs(set, left, logger)
+}
+
+// reconstructsToProofs reports whether shards, with the missing ones
+// rebuilt, all match the set's proofs. The shards are left as they are.
+func reconstructsToProofs(set shardSet, shards [][]byte, logger *zap.Logger) bool {
+	rebuilt := slices.Clone(shards)
+	if err := set.Code.Reconstruct(rebuilt); err != nil {
+		logger.Debug("Shard set doesn't reconstruct", zap.String("shardSet", set.ID), zap.Error(err))
+		return false
+	}
+	checks, err := set.checkProofs(rebuilt)
+	if err != nil {
+		return false
+	}
+	return !slices.Contains(checks, false)
+}
@@ -0,0 +1,86 @@
+package datastorage
+
+import (
+	"os"
+	"testing"
+
+	"github.com/techninja8/getvault.io/pkg/erasurecoding"
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+// TestFaultToleranceMargin removes and corrupts shards of an object one
+// after another, and checks the margin of location failures it survives
+// drops with each, down to -1 once it can't be recovered at all.
+func TestFaultToleranceMargin(t *testing.T) {
+	v := newTestVault(t)
+	metadatafile := v.storeObject(t, "object.bin", randomBytes(t, 50_000))
+	check := func(wantGood, wantMargin int) *ToleranceReport {
+		t.Helper()
+		report, err := CheckFaultTolerance(metadatafile, sharding.NewInMemoryShardStore(), v.logger)
+		if err != nil {
+			t.Fatalf("CheckFaultTolerance: %v", err)
+		}
+		if report.GoodShards != wantGood || report.Margin != wantMargin {
+			t.Fatalf("%d good shards and a margin of %d, expected %d and %d", report.GoodShards, report.Margin, wantGood, wantMargin)
+		}
+		if report.Theoretical != erasurecoding.ParityShards || report.NeededShards != erasurecoding.DataShards {
+			t.Fatalf("theoretical margin %d of %d needed shards", report.Theoretical, report.NeededShards)
+		}
+		return report
+	}
+
+	report := check(14, 6)
+	if len(report.Losses) != len(v.locations) {
+		t.Fatalf("%d losses simulated, expected one per location", len(report.Losses))
+	}
+	for _, loss := range report.Losses {
+		if !loss.Survivable || len(loss.Shards) != 1 {
+			t.Fatalf("loss %+v of a healthy object", loss)
+		}
+	}
+
+	for _, i := range []int{0, 1} {
+		if err := os.Remove(v.shardFile(t, metadatafile, i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(12, 4)
+	v.corruptShard(t, metadatafile, 2)
+	check(11, 3)
+
+	for _, i := range []int{3, 4, 5} {
+		if err := os.Remove(v.shardFile(t, metadatafile, i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	report = check(8, 0)
+	for _, loss := range report.Losses {
+		if loss.Survivable != (len(loss.Shards) == 0) {
+			t.Fatalf("loss %+v with only the needed shards left", loss)
+		}
+	}
+	if err := os.Remove(v.shardFile(t, metadatafile, 6)); err != nil {
+		t.Fatal(err)
+	}
+	check(7, -1)
+}
+
+// TestFaultToleranceSharedLocation stores two shards at one location,
+// which costs the object both when it fails.
+func TestFaultToleranceSharedLocation(t *testing.T) {
+	v := newTestVault(t)
+	v.locations[13] = v.locations[12]
+	metadatafile := v.storeObject(t, "object.bin", randomBytes(t, 50_000))
+	report, err := CheckFaultTolerance(metadatafile, sharding.NewInMemoryShardStore(), v.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.GoodShards != 14 || report.Margin != 5 || len(report.Losses) != 13 {
+		t.Fatalf("report %+v, expected a margin of 5 over 13 locations", *report)
+	}
+	for _, loss := range report.Losses {
+		if loss.Location == v.locations[12] && len(loss.Shards) != 2 {
+			t.Fatalf("shared location holds shards %v", loss.Shards)
+		}
+	}
+}
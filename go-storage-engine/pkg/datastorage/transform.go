@@ -0,0 +1,140 @@
+package datastorage
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ErrUnknownTransform is returned when a transform named in the
+// configuration or in an object's metadata isn't registered.
+var ErrUnknownTransform = errors.New("unknown transform")
+
+// errTransformStreaming is returned when transforms are configured for an
+// object that would be streamed.
+var errTransformStreaming = errors.New("transforms work on whole objects, so objects with transforms can't be streamed; raise STREAMING_THRESHOLD or MAX_SHARD_SIZE")
+
+// Transformer changes an object's data before it is encrypted and changes
+// it back after it is decrypted. name is the object's filename. The
+// transforms applied to an object are recorded in its metadata, so
+// AfterRetrieve must undo BeforeStore exactly for retrieval to return the
+// original data.
+type Transformer interface {
+	BeforeStore(name string, data []byte) ([]byte, error)
+	AfterRetrieve(name string, data []byte) ([]byte, error)
+}
+
+var (
+	transformersMu sync.RWMutex
+	transformers   = map[string]Transformer{
+		"none":   NoopTransformer{},
+		"rotate": ByteRotation{N: 13},
+	}
+)
+
+// RegisterTransformer makes a transform available under a name, for
+// TRANSFORMS to list and retrieval to look up. Names can't hold commas or
+// be registered twice.
+func RegisterTransformer(name string, t Transformer) error {
+	if name == "" || strings.ContainsAny(name, ", \n") {
+		return fmt.Errorf("invalid transform name %q", name)
+	}
+	transformersMu.Lock()
+	defer transformersMu.Unlock()
+	if _, exists := transformers[name]; exists {
+		return fmt.Errorf("transform %q is already registered", name)
+	}
+	transformers[name] = t
+	return nil
+}
+
+func lookupTransformer(name string) (Transformer, error) {
+	transformersMu.RLock()
+	defer transformersMu.RUnlock()
+	t, ok := transformers[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownTransform, name)
+	}
+	return t, nil
+}
+
+// applyTransforms runs data through the named transforms in order. It
+// returns the transformed data and the metadata lines recording the
+// transforms and the transformed size, which retrieval needs to trim the
+// decrypted data before undoing them. Without transforms the data is
+// returned as it is, with no lines.
+func applyTransforms(names []string, filePath string, data []byte) ([]byte, string, error) {
+	if len(names) == 0 {
+		return data, "", nil
+	}
+	name := filepath.Base(filePath)
+	for _, transform := range names {
+		t, err := lookupTransformer(transform)
+		if err != nil {
+			return nil, "", err
+		}
+		if data, err = t.BeforeStore(name, data); err != nil {
+			return nil, "", fmt.Errorf("transform %s failed: %w", transform, err)
+		}
+	}
+	lines := fmt.Sprintf("transforms: %s\ntransformed_size: %d\n", strings.Join(names, ","), len(data))
+	return data, lines, nil
+}
+
+// reverseTransforms undoes the transforms recorded in an object's
+// metadata, last first.
+func reverseTransforms(values map[string]string, data []byte) ([]byte, error) {
+	if values["transforms"] == "" {
+		return data, nil
+	}
+	size, err := strconv.Atoi(values["transformed_size"])
+	if err != nil || size < 0 || size > len(data) {
+		return nil, fmt.Errorf("invalid transformed_size in metadata: %q", values["transformed_size"])
+	}
+	data = data[:size]
+	names := strings.Split(values["transforms"], ",")
+	for i := len(names) - 1; i >= 0; i-- {
+		t, err := lookupTransformer(names[i])
+		if err != nil {
+			return nil, err
+		}
+		if data, err = t.AfterRetrieve(objectFilename(values), data); err != nil {
+			return nil, fmt.Errorf("transform %s failed: %w", names[i], err)
+		}
+	}
+	return data, nil
+}
+
+// NoopTransformer leaves data as it is. It is registered as "none".
+type NoopTransformer struct{}
+
+func (NoopTransformer) BeforeStore(name string, data []byte) ([]byte, error)   { return data, nil }
+func (NoopTransformer) AfterRetrieve(name string, data []byte) ([]byte, error) { return data, nil }
+
+// ByteRotation adds N to every byte, wrapping around, and subtracts it
+// again on retrieval. It hides nothing from anyone who knows it is there,
+// and is registered as "rotate" with N of 13 as an example of a transform.
+type ByteRotation struct {
+	N byte
+}
+
+func (r ByteRotation) BeforeStore(name string, data []byte) ([]byte, error) {
+	return rotateBytes(data, r.N), nil
+}
+
+func (r ByteRotation) AfterRetrieve(name string, data []byte) ([]byte, error) {
+	return rotateBytes(data, -r.N), nil
+}
+
+// rotateBytes returns a copy of data with n added to every byte, so the
+// caller's data is left alone.
+func rotateBytes(data []byte, n byte) []byte {
+	out := make([]byte, len(data))
+	for i, b := range data {
+		out[i] = b + n
+	}
+	return out
+}
@@ -0,0 +1,100 @@
+package datastorage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+// trailerTransformer appends the object's name to its data and checks and
+// strips it again, so it changes the size of what is stored and fails if
+// transforms are undone in the wrong order.
+type trailerTransformer struct{}
+
+func (trailerTransformer) BeforeStore(name string, data []byte) ([]byte, error) {
+	return append(bytes.Clone(data), name...), nil
+}
+
+func (trailerTransformer) AfterRetrieve(name string, data []byte) ([]byte, error) {
+	if !bytes.HasSuffix(data, []byte(name)) {
+		return nil, fmt.Errorf("data doesn't end in %q", name)
+	}
+	return data[:len(data)-len(name)], nil
+}
+
+func init() {
+	if err := RegisterTransformer("trailer", trailerTransformer{}); err != nil {
+		panic(err)
+	}
+}
+
+// TestTransformRoundTrip stores objects through transforms and checks
+// that retrieval undoes them, last first, giving back the original data.
+func TestTransformRoundTrip(t *testing.T) {
+	v := newTestVault(t)
+	data := randomBytes(t, 50_000)
+	for _, transforms := range [][]string{{"rotate"}, {"rotate", "trailer"}, {"trailer", "rotate", "none"}} {
+		v.cfg.Transforms = transforms
+		metadatafile := v.storeObject(t, "object.bin", data)
+		if recorded, err := MetadataFileReader(metadatafile, "transforms"); err != nil || recorded != strings.Join(transforms, ",") {
+			t.Fatalf("%v: object records transforms %q, %v", transforms, recorded, err)
+		}
+		got, err := RetrieveData(metadatafile, sharding.NewInMemoryShardStore(), v.cfg, v.logger)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("%v: RetrieveData returned %d bytes, %v", transforms, len(got), err)
+		}
+
+		// Retrieval follows the metadata, not the configuration
+		v.cfg.Transforms = nil
+		if got, err := RetrieveData(metadatafile, sharding.NewInMemoryShardStore(), v.cfg, v.logger); err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("%v: RetrieveData without TRANSFORMS returned %d bytes, %v", transforms, len(got), err)
+		}
+	}
+}
+
+func TestTransformErrors(t *testing.T) {
+	v := newTestVault(t)
+	v.cfg.Transforms = []string{"missing"}
+	if _, _, err := StoreData(randomBytes(t, 1000), v.store, v.cfg, v.locations, v.logger, "object.bin"); !errors.Is(err, ErrUnknownTransform) {
+		t.Fatalf("storing with an unregistered transform: %v", err)
+	}
+
+	v.cfg.Transforms = []string{"rotate"}
+	v.cfg.StreamingThreshold = 1
+	if _, _, err := StoreData(randomBytes(t, 1000), v.store, v.cfg, v.locations, v.logger, "object.bin"); !errors.Is(err, errTransformStreaming) {
+		t.Fatalf("streaming with a transform: %v", err)
+	}
+
+	v.cfg.StreamingThreshold = 0
+	metadatafile := v.storeObject(t, "object.bin", randomBytes(t, 1000))
+	if err := setMetadataValue(metadatafile, "transforms", "rotate,missing"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RetrieveData(metadatafile, sharding.NewInMemoryShardStore(), v.cfg, v.logger); !errors.Is(err, ErrUnknownTransform) {
+		t.Fatalf("retrieving through an unregistered transform: %v", err)
+	}
+
+	for _, name := range []string{"", "a,b", "trailer", "rotate"} {
+		if err := RegisterTransformer(name, NoopTransformer{}); err == nil {
+			t.Fatalf("registered a transform as %q", name)
+		}
+	}
+}
+
+func TestByteRotation(t *testing.T) {
+	data := []byte{0, 1, 250, 255}
+	rotated, err := ByteRotation{N: 13}.BeforeStore("x", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rotated, []byte{13, 14, 7, 12}) || !bytes.Equal(data, []byte{0, 1, 250, 255}) {
+		t.Fatalf("rotated %v to %v", data, rotated)
+	}
+	if back, err := (ByteRotation{N: 13}).AfterRetrieve("x", rotated); err != nil || !bytes.Equal(back, data) {
+		t.Fatalf("rotated back to %v, %v", back, err)
+	}
+}
@@ -0,0 +1,327 @@
+package datastorage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/techninja8/getvault.io/pkg/metadata"
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+// ErrShardsPurged is returned when restoring an object whose shards have
+// already been purged from the trash.
+var ErrShardsPurged = errors.New("object's shards have been purged")
+
+// Deleting an object moves it to the trash: its metadata file becomes a
+// tombstone (see MarkDeleted) and its shards stay where they are. Within
+// the trash retention window the object can be restored as it was. Once
+// the window has passed, emptying the trash deletes the shards and records
+// the time as purged in the tombstone, and from then on the object is gone
+// for good. Compaction only drops purged tombstones, so shards are never
+// left behind without a catalog entry pointing at them.
+
+// TrashEntry is a deleted object in the trash.
+type TrashEntry struct {
+	Tombstone string    `json:"tombstone"`
+	DataID    string    `json:"data_id"`
+	Filename  string    `json:"filename"`
+	Size      int64     `json:"size"`
+	Deleted   time.Time `json:"deleted"`
+	Purged    bool      `json:"purged"` // Its shards are gone and it can't be restored
+}
+
+// TrashSummary is what emptying the trash did.
+type TrashSummary struct {
+	Purged int `json:"purged"` // Objects whose shards were deleted
+	Kept   int `json:"kept"`   // Objects still inside the retention window
+	Shards int `json:"shards"` // Shard files deleted, or found already gone
+}
+
+// TrashObject deletes an object by moving it to the trash, along with its
+// preview unless another object shares it. It refuses objects whose lock
+// hasn't expired, and returns the tombstone's path.
+func TrashObject(metadatafile string, now time.Time, logger *zap.Logger) (string, error) {
+	values, err := metadata.ReadValues(metadatafile)
+	if err != nil {
+		return "", fmt.Errorf("error reading metadata file: %w", err)
+	}
+	if err := checkUnlocked(values, now); err != nil {
+		return "", err
+	}
+	tombstone, err := MarkDeleted(metadatafile, now, logger)
+	if err != nil {
+		return "", err
+	}
+
+	if preview := values["preview"]; preview != "" && !previewShared(filepath.Dir(metadatafile), preview) {
+		if previewFile, err := FindMetadataFile(filepath.Dir(metadatafile), preview); err == nil {
+			if _, err := MarkDeleted(previewFile, now, logger); err != nil {
+				logger.Warn("Failed to delete preview", zap.String("preview", preview), zap.Error(err))
+			}
+		}
+	}
+	return tombstone, nil
+}
+
+// previewShared reports whether a live object in dir still links to a
+// preview.
+func previewShared(dir, previewID string) bool {
+	objects, err := ListObjects(dir)
+	if err != nil {
+		return true
+	}
+	for _, object := range objects {
+		if object.Preview == previewID {
+			return true
+		}
+	}
+	return false
+}
+
+// ListTrash lists the deleted objects in a metadata directory, most
+// recently deleted first.
+func ListTrash(dir string) ([]TrashEntry, error) {
+	tombstones, err := filepath.Glob(filepath.Join(dir, "*"+tombstoneSuffix))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tombstones: %w", err)
+	}
+	var entries []TrashEntry
+	for _, tombstone := range tombstones {
+		values, err := metadata.ReadValues(tombstone)
+		if err != nil {
+			continue
+		}
+		size, _ := strconv.ParseInt(values["filesize"], 10, 64)
+		entries = append(entries, TrashEntry{
+			Tombstone: tombstone,
+			DataID:    values["dataID"],
+			Filename:  objectFilename(values),
+			Size:      size,
+			Deleted:   deletedAt(values),
+			Purged:    values["purged"] != "",
+		})
+	}
+	sort.SliceStable(entries, func(a, b int) bool { return entries[a].Deleted.After(entries[b].Deleted) })
+	return entries, nil
+}
+
+// RestoreObject brings a deleted object back from the trash, with its
+// preview, and returns its metadata file. ref is the object's dataID or a
+// prefix of it; if the object was deleted more than once, the latest
+// deletion is undone.
+func RestoreObject(dir, ref string, logger *zap.Logger) (string, error) {
+	entries, err := ListTrash(dir)
+	if err != nil {
+		return "", err
+	}
+	var entry *TrashEntry
+	purged := false
+	for i := range entries {
+		if ref == "" || !strings.HasPrefix(entries[i].DataID, ref) {
+			continue
+		}
+		if entry != nil && entry.DataID != entries[i].DataID {
+			return "", fmt.Errorf("%w: %s", ErrAmbiguousID, ref)
+		}
+		if entries[i].Purged {
+			purged = true
+		} else if entry == nil {
+			entry = &entries[i]
+		}
+	}
+	switch {
+	case entry == nil && purged:
+		return "", fmt.Errorf("%w: %s", ErrShardsPurged, ref)
+	case entry == nil:
+		return "", fmt.Errorf("%w in the trash: %s", ErrObjectNotFound, ref)
+	}
+
+	metadatafile := strings.TrimSuffix(entry.Tombstone, tombstoneSuffix)
+	unlock, err := metadata.Lock(entry.Tombstone, true)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(metadatafile); err == nil {
+		unlock()
+		return "", fmt.Errorf("can't restore %s: %s exists", entry.DataID, metadatafile)
+	}
+	err = os.Rename(entry.Tombstone, metadatafile)
+	unlock()
+	if err != nil {
+		return "", fmt.Errorf("failed to restore object: %w", err)
+	}
+	os.Remove(entry.Tombstone + ".lock")
+	err = rewriteMetadataFile(metadatafile, func(lines []string) ([]string, error) {
+		return metadata.DeleteValue(lines, "deleted"), nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if err := recordEvent(metadatafile, entry.DataID, ObjectEvent{Event: EventRestored}); err != nil {
+		logger.Warn("Failed to record object history", zap.Error(err))
+	}
+	logger.Info("Object restored", zap.String("metadataFile", metadatafile))
+
+	if preview, err := metadata.ReadValue(metadatafile, "preview"); err == nil {
+		if _, err := FindMetadataFile(dir, preview); err != nil {
+			if _, err := RestoreObject(dir, preview, logger); err != nil {
+				logger.Warn("Failed to restore preview", zap.String("preview", preview), zap.Error(err))
+			}
+		}
+	}
+	return metadatafile, nil
+}
+
+// EmptyTrash purges the objects in a metadata directory that were deleted
+// at least retention before now: their shards are deleted and their
+// tombstones marked purged, for compaction to drop later. It stops between
+// objects once ctx is done.
+func EmptyTrash(ctx context.Context, dir string, retention time.Duration, now time.Time, store sharding.ShardStore, logger *zap.Logger) (*TrashSummary, error) {
+	entries, err := ListTrash(dir)
+	if err != nil {
+		return nil, err
+	}
+	summary := &TrashSummary{}
+	expired := make(map[string]bool)
+	for _, entry := range entries {
+		switch {
+		case entry.Purged:
+		case now.Sub(entry.Deleted) < retention:
+			summary.Kept++
+		default:
+			expired[entry.Tombstone] = true
+		}
+	}
+	if len(expired) == 0 {
+		return summary, nil
+	}
+
+	inUse, err := shardSetsInUse(dir, func(tombstone string) bool { return expired[tombstone] })
+	if err != nil {
+		return summary, err
+	}
+	for _, entry := range entries {
+		if !expired[entry.Tombstone] {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return summary, err
+		}
+		deleted, err := purgeShards(entry.Tombstone, entry.DataID, store, inUse, now, logger)
+		summary.Shards += deleted
+		if err != nil {
+			return summary, fmt.Errorf("failed to purge %s: %w", entry.DataID, err)
+		}
+		summary.Purged++
+	}
+	logger.Info("Trash emptied", zap.Int("purged", summary.Purged), zap.Int("kept", summary.Kept), zap.Int("shards", summary.Shards))
+	return summary, nil
+}
+
+// PurgeObject deletes the shards of an object in the trash straight away,
+// whatever the retention window, and returns how many shard files it
+// deleted.
+func PurgeObject(ctx context.Context, tombstone string, store sharding.ShardStore, now time.Time, logger *zap.Logger) (int, error) {
+	dataID, err := metadata.ReadValue(tombstone, "dataID")
+	if err != nil {
+		return 0, fmt.Errorf("error reading tombstone: %w", err)
+	}
+	inUse, err := shardSetsInUse(filepath.Dir(tombstone), func(t string) bool { return t == tombstone })
+	if err != nil {
+		return 0, err
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return purgeShards(tombstone, dataID, store, inUse, now, logger)
+}
+
+// shardSetsInUse returns the IDs of the shard sets that live objects, and
+// tombstones not yet purged other than those skipped, still need. Objects
+// with the same contents share shards, so deleting one mustn't remove
+// shards another can still be retrieved or restored from.
+func shardSetsInUse(dir string, skip func(tombstone string) bool) (map[string]bool, error) {
+	files, err := listMetadataFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := ListTrash(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !entry.Purged && !skip(entry.Tombstone) {
+			files = append(files, entry.Tombstone)
+		}
+	}
+
+	inUse := make(map[string]bool)
+	for _, file := range files {
+		dataID, err := metadata.ReadValue(file, "dataID")
+		if err != nil {
+			continue
+		}
+		sets, err := readShardSets(file, dataID)
+		if err != nil {
+			// Nothing can be known to be unshared then
+			return nil, fmt.Errorf("can't tell which shards %s uses: %w", file, err)
+		}
+		for _, set := range sets {
+			inUse[set.ID] = true
+		}
+	}
+	return inUse, nil
+}
+
+// purgeShards deletes the shards of a tombstone's object, at every
+// candidate location, except sets still in use, and marks the tombstone
+// purged. Shards of an expired lock are unlocked first. Shards that are
+// already gone count as deleted.
+func purgeShards(tombstone, dataID string, store sharding.ShardStore, inUse map[string]bool, now time.Time, logger *zap.Logger) (int, error) {
+	sets, err := readShardSets(tombstone, dataID)
+	if err != nil {
+		return 0, err
+	}
+	candidates, err := readShardCandidates(tombstone)
+	if err != nil {
+		return 0, err
+	}
+	capabilities := sharding.Probe(store)
+	deleted := 0
+	for _, set := range sets {
+		if inUse[set.ID] {
+			logger.Info("Keeping shards another object shares", zap.String("dataID", dataID), zap.String("set", set.ID))
+			continue
+		}
+		for i, locations := range candidates {
+			for _, location := range locations {
+				if capabilities.Lock {
+					store.(sharding.ShardLocker).UnlockShard(set.ID, i, location)
+				}
+				err := sharding.DeleteShard(store, set.ID, i, location)
+				if err != nil && !errors.Is(err, sharding.ErrShardNotFound) && !errors.Is(err, os.ErrNotExist) {
+					return deleted, err
+				}
+				deleted++
+			}
+		}
+	}
+	if err := setMetadataValue(tombstone, "purged", now.UTC().Format(time.RFC3339)); err != nil {
+		return deleted, err
+	}
+	if err := recordEvent(tombstone, dataID, ObjectEvent{Event: EventPurged}); err != nil {
+		logger.Warn("Failed to record object history", zap.Error(err))
+	}
+	logger.Info("Object purged", zap.String("dataID", dataID), zap.Int("shards", deleted))
+	return deleted, nil
+}
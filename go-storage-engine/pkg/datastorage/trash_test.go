@@ -0,0 +1,150 @@
+package datastorage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+// TestTrashRestoreRetrieve deletes an object with a preview, which takes
+// both out of the catalog, then restores it by a prefix of its dataID and
+// retrieves it and its preview as they were.
+func TestTrashRestoreRetrieve(t *testing.T) {
+	v := newTestVault(t)
+	v.cfg.PreviewSize = 64
+	data := testPNG(t, 200, 100)
+	metadatafile := v.storeObject(t, "photo.png", data)
+	if _, err := StorePreview(metadatafile, bytes.NewReader(data), v.store, v.cfg, v.locations, v.logger); err != nil {
+		t.Fatal(err)
+	}
+	dataID, err := MetadataFileReader(metadatafile, "dataID")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := TrashObject(metadatafile, time.Now(), v.logger); err != nil {
+		t.Fatalf("TrashObject: %v", err)
+	}
+	if objects, err := ListObjects(v.cfg.MetadataDir); err != nil || len(objects) != 0 {
+		t.Fatalf("catalog lists %d objects after the delete, %v", len(objects), err)
+	}
+	trash, err := ListTrash(v.cfg.MetadataDir)
+	if err != nil || len(trash) != 2 {
+		t.Fatalf("trash lists %d objects, %v", len(trash), err)
+	}
+
+	restored, err := RestoreObject(v.cfg.MetadataDir, dataID[:8], v.logger)
+	if err != nil {
+		t.Fatalf("RestoreObject: %v", err)
+	}
+	if restored != metadatafile {
+		t.Fatalf("restored to %s, expected %s", restored, metadatafile)
+	}
+	if _, err := MetadataFileReader(restored, "deleted"); err == nil {
+		t.Fatal("restored object is still marked deleted")
+	}
+	got, err := RetrieveData(restored, sharding.NewInMemoryShardStore(), v.cfg, v.logger)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("RetrieveData after the restore returned %d bytes, %v", len(got), err)
+	}
+	if _, err := RetrievePreview(restored, sharding.NewInMemoryShardStore(), v.cfg, v.logger); err != nil {
+		t.Fatalf("RetrievePreview after the restore: %v", err)
+	}
+	if trash, err := ListTrash(v.cfg.MetadataDir); err != nil || len(trash) != 0 {
+		t.Fatalf("trash lists %d objects after the restore, %v", len(trash), err)
+	}
+
+	if _, err := RestoreObject(v.cfg.MetadataDir, dataID, v.logger); !errors.Is(err, ErrObjectNotFound) {
+		t.Fatalf("restoring an object that isn't deleted: %v", err)
+	}
+}
+
+// TestTrashExpiryPurges deletes two objects at different times and
+// empties the trash: only the one deleted before the retention window has
+// its shards purged, and can't be restored any more, while the other
+// restores and retrieves.
+func TestTrashExpiryPurges(t *testing.T) {
+	v := newTestVault(t)
+	now := time.Now()
+	const retention = 7 * 24 * time.Hour
+	oldData, recentData := randomBytes(t, 50_000), randomBytes(t, 50_000)
+	old := v.storeObject(t, "old.bin", oldData)
+	recent := v.storeObject(t, "recent.bin", recentData)
+	oldID, _ := MetadataFileReader(old, "dataID")
+	recentID, _ := MetadataFileReader(recent, "dataID")
+	oldShard := v.shardFile(t, old, 0)
+	if _, err := TrashObject(old, now.Add(-10*24*time.Hour), v.logger); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := TrashObject(recent, now.Add(-24*time.Hour), v.logger); err != nil {
+		t.Fatal(err)
+	}
+
+	summary, err := EmptyTrash(context.Background(), v.cfg.MetadataDir, retention, now, sharding.NewInMemoryShardStore(), v.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Purged != 1 || summary.Kept != 1 || summary.Shards != len(v.locations) {
+		t.Fatalf("emptying the trash %+v, expected 1 object of %d shards purged and 1 kept", *summary, len(v.locations))
+	}
+	if _, err := os.Stat(oldShard); !os.IsNotExist(err) {
+		t.Fatalf("purged object's shard: %v", err)
+	}
+	if _, err := RestoreObject(v.cfg.MetadataDir, oldID, v.logger); !errors.Is(err, ErrShardsPurged) {
+		t.Fatalf("restoring a purged object: %v", err)
+	}
+
+	restored, err := RestoreObject(v.cfg.MetadataDir, recentID, v.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := RetrieveData(restored, sharding.NewInMemoryShardStore(), v.cfg, v.logger); err != nil || !bytes.Equal(got, recentData) {
+		t.Fatalf("RetrieveData after the restore: %v", err)
+	}
+}
+
+// TestTrashKeepsSharedShards deletes and purges one of two objects with
+// the same contents, which share their shards; the other must still
+// retrieve.
+func TestTrashKeepsSharedShards(t *testing.T) {
+	v := newTestVault(t)
+	// Chunked objects are encrypted deterministically, so the same
+	// contents are stored to the same shards
+	v.cfg.ChunkSize = minChunkSize
+	data := randomBytes(t, 20_000)
+	first := v.storeObject(t, "first.bin", data)
+	second := v.storeObject(t, "second.bin", data)
+
+	tombstone, err := TrashObject(first, time.Now(), v.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := PurgeObject(context.Background(), tombstone, sharding.NewInMemoryShardStore(), time.Now(), v.logger); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := RetrieveData(second, sharding.NewInMemoryShardStore(), v.cfg, v.logger); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("RetrieveData of the object sharing the purged one's shards: %v", err)
+	}
+}
+
+// TestTrashRefusesLockedObject locks an object through a store without
+// object locks, so only the metadata holds the lock, and deletes it
+// before and after the lock expires.
+func TestTrashRefusesLockedObject(t *testing.T) {
+	v := newTestVault(t)
+	metadatafile := v.storeObject(t, "object.bin", randomBytes(t, 1000))
+	if err := LockObject(metadatafile, time.Now().Add(time.Hour), newBareStore(), v.logger); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := TrashObject(metadatafile, time.Now(), v.logger); !errors.Is(err, ErrObjectLocked) {
+		t.Fatalf("deleting a locked object: %v", err)
+	}
+	if _, err := TrashObject(metadatafile, time.Now().Add(2*time.Hour), v.logger); err != nil {
+		t.Fatalf("deleting once the lock expired: %v", err)
+	}
+}
@@ -0,0 +1,174 @@
+package datastorage
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+// TuneOptions controls a concurrency tuning run.
+type TuneOptions struct {
+	Levels     []int   // Concurrency levels probed, in order
+	Probes     int     // Shards written and read back at each level
+	ShardSize  int     // Bytes per probe shard
+	ErrorSlack float64 // Error rate a level may exceed the lowest level's by
+}
+
+// TuneLevel is what was measured at one concurrency level.
+type TuneLevel struct {
+	Concurrency int           `json:"concurrency"`
+	Operations  int           `json:"operations"`
+	Errors      int           `json:"errors"`
+	Bytes       int64         `json:"bytes"`
+	Elapsed     time.Duration `json:"elapsed"`
+	Throughput  float64       `json:"throughput"` // Bytes per second
+}
+
+// ErrorRate is the fraction of the level's operations that failed.
+func (l TuneLevel) ErrorRate() float64 {
+	if l.Operations == 0 {
+		return 0
+	}
+	return float64(l.Errors) / float64(l.Operations)
+}
+
+// TuneResult is the outcome of a tuning run.
+type TuneResult struct {
+	Levels      []TuneLevel `json:"levels"`
+	Recommended int         `json:"recommended"`
+	Leftover    int         `json:"leftover_shards,omitempty"` // Probe shards that couldn't be removed
+}
+
+// Tune measures shard throughput at each of opts.Levels and recommends the
+// concurrency with the highest throughput among those whose error rate is
+// no more than opts.ErrorSlack above that of the first level; ties go to
+// the lower concurrency. Each level writes opts.Probes shards spread over
+// locations and reads them back. open is called for a fresh store for
+// every write and read phase, so reads aren't served from a cache filled
+// by the writes. Probe shards are deleted afterwards when the store has the
+// delete capability.
+func Tune(open func() sharding.ShardStore, locations []string, opts TuneOptions, logger *zap.Logger) (*TuneResult, error) {
+	if len(opts.Levels) == 0 || opts.Probes < 1 || opts.ShardSize < 1 || len(locations) == 0 {
+		return nil, errors.New("tuning needs levels, probes, a shard size and locations")
+	}
+	payload := make([]byte, opts.ShardSize)
+	if _, err := rand.Read(payload); err != nil {
+		return nil, err
+	}
+	runID := make([]byte, 4)
+	if _, err := rand.Read(runID); err != nil {
+		return nil, err
+	}
+
+	result := &TuneResult{}
+	for _, level := range opts.Levels {
+		if level < 1 {
+			return nil, fmt.Errorf("invalid concurrency level %d", level)
+		}
+		probeID := fmt.Sprintf("vault-tune-%s-%d", hex.EncodeToString(runID), level)
+		location := func(i int) string { return locations[i%len(locations)] }
+
+		write := open()
+		written, writeLevel := runProbes(level, opts.Probes, func(i int) (int, error) {
+			return len(payload), write.StoreShard(probeID, i, payload, location(i))
+		})
+		write.Close()
+
+		read := open()
+		_, readLevel := runProbes(level, opts.Probes, func(i int) (int, error) {
+			if !written[i] {
+				return 0, errors.New("probe shard was not written")
+			}
+			shard, err := read.RetrieveShard(probeID, i, location(i))
+			return len(shard), err
+		})
+		result.Leftover += cleanupProbes(read, probeID, opts.Probes, location, logger)
+		read.Close()
+
+		measured := TuneLevel{
+			Concurrency: level,
+			Operations:  writeLevel.Operations + readLevel.Operations,
+			Errors:      writeLevel.Errors + readLevel.Errors,
+			Bytes:       writeLevel.Bytes + readLevel.Bytes,
+			Elapsed:     writeLevel.Elapsed + readLevel.Elapsed,
+		}
+		if measured.Elapsed > 0 {
+			measured.Throughput = float64(measured.Bytes) / measured.Elapsed.Seconds()
+		}
+		logger.Info("Tuning level measured", zap.Int("concurrency", level), zap.Float64("throughput", measured.Throughput), zap.Int("errors", measured.Errors))
+		result.Levels = append(result.Levels, measured)
+	}
+
+	baseline := result.Levels[0].ErrorRate()
+	var best *TuneLevel
+	for i := range result.Levels {
+		level := &result.Levels[i]
+		if level.ErrorRate() > baseline+opts.ErrorSlack {
+			continue
+		}
+		if best == nil || level.Throughput > best.Throughput || (level.Throughput == best.Throughput && level.Concurrency < best.Concurrency) {
+			best = level
+		}
+	}
+	result.Recommended = best.Concurrency
+	return result, nil
+}
+
+// runProbes runs op for probes 0..n-1 on the given number of workers and
+// reports which succeeded along with the totals.
+func runProbes(workers, n int, op func(i int) (int, error)) ([]bool, TuneLevel) {
+	var (
+		ok    = make([]bool, n)
+		bytes atomic.Int64
+		errs  atomic.Int64
+		next  atomic.Int64
+		wg    sync.WaitGroup
+		start = time.Now()
+	)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(next.Add(1) - 1)
+				if i >= n {
+					return
+				}
+				moved, err := op(i)
+				if err != nil {
+					errs.Add(1)
+					continue
+				}
+				ok[i] = true
+				bytes.Add(int64(moved))
+			}
+		}()
+	}
+	wg.Wait()
+	return ok, TuneLevel{Operations: n, Errors: int(errs.Load()), Bytes: bytes.Load(), Elapsed: time.Since(start)}
+}
+
+// cleanupProbes deletes a level's probe shards and returns how many are
+// left behind.
+func cleanupProbes(store sharding.ShardStore, probeID string, n int, location func(int) string, logger *zap.Logger) int {
+	if !sharding.Probe(store).Delete {
+		logger.Warn("Store can't delete shards, leaving probe shards behind", zap.String("probeID", probeID))
+		return n
+	}
+	left := 0
+	for i := 0; i < n; i++ {
+		if err := sharding.DeleteShard(store, probeID, i, location(i)); err != nil {
+			logger.Warn("Failed to delete probe shard", zap.String("probeID", probeID), zap.Int("index", i), zap.Error(err))
+			left++
+		}
+	}
+	return left
+}
@@ -0,0 +1,121 @@
+package datastorage
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+// congestedBackend is a shard store that serves each operation in latency
+// while no more than optimal operations are in flight. Past that it slows
+// with the square of the overload, so throughput falls, or, with failAbove
+// set, fails operations once more than failAbove are in flight.
+type congestedBackend struct {
+	latency   time.Duration
+	optimal   int64
+	failAbove int64
+	inFlight  atomic.Int64
+
+	mu     sync.Mutex
+	shards map[string][]byte
+}
+
+func (b *congestedBackend) operate() error {
+	n := b.inFlight.Add(1)
+	defer b.inFlight.Add(-1)
+	if b.failAbove > 0 && n > b.failAbove {
+		return errors.New("throttled")
+	}
+	latency := b.latency
+	if n > b.optimal {
+		latency = latency * time.Duration(n*n) / time.Duration(b.optimal*b.optimal)
+	}
+	time.Sleep(latency)
+	return nil
+}
+
+func (b *congestedBackend) StoreShard(dataID string, index int, shard []byte, location string) error {
+	if err := b.operate(); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.shards[fmt.Sprintf("%s/%s.%d", location, dataID, index)] = shard
+	return nil
+}
+
+func (b *congestedBackend) RetrieveShard(dataID string, index int, location string) ([]byte, error) {
+	if err := b.operate(); err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	shard, ok := b.shards[fmt.Sprintf("%s/%s.%d", location, dataID, index)]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	return shard, nil
+}
+
+func (b *congestedBackend) DeleteShard(dataID string, index int, location string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.shards, fmt.Sprintf("%s/%s.%d", location, dataID, index))
+	return nil
+}
+
+func (b *congestedBackend) Close() error { return nil }
+
+// TestTuneFindsOptimalConcurrency tunes against backends with a known best
+// concurrency: one that slows down past it, and one that keeps its speed
+// but starts failing past it. Either way the tuner must recommend it, and
+// leave no probe shards behind.
+func TestTuneFindsOptimalConcurrency(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		optimal   int64
+		failAbove int64
+		want      int
+	}{
+		{"congestion", 4, 0, 4},
+		{"throttling", 64, 4, 4},
+	} {
+		backend := &congestedBackend{latency: 2 * time.Millisecond, optimal: tc.optimal, failAbove: tc.failAbove, shards: map[string][]byte{}}
+		opts := TuneOptions{Levels: []int{1, 2, 4, 8, 16}, Probes: 32, ShardSize: 1024}
+		result, err := Tune(func() sharding.ShardStore { return backend }, []string{"a", "b", "c"}, opts, zap.NewNop())
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if result.Recommended != tc.want {
+			for _, level := range result.Levels {
+				t.Logf("%s: concurrency %d: %.0f B/s, %d errors", tc.name, level.Concurrency, level.Throughput, level.Errors)
+			}
+			t.Fatalf("%s: recommended concurrency %d, expected %d", tc.name, result.Recommended, tc.want)
+		}
+		if result.Leftover != 0 || len(backend.shards) != 0 {
+			t.Fatalf("%s: %d probe shards reported left over, %d left in the backend", tc.name, result.Leftover, len(backend.shards))
+		}
+	}
+}
+
+func TestTuneRefusesInvalidOptions(t *testing.T) {
+	open := func() sharding.ShardStore { return sharding.NewInMemoryShardStore() }
+	for name, opts := range map[string]TuneOptions{
+		"no levels":     {Probes: 1, ShardSize: 1},
+		"no probes":     {Levels: []int{1}, ShardSize: 1},
+		"zero level":    {Levels: []int{1, 0}, Probes: 1, ShardSize: 1},
+		"no shard size": {Levels: []int{1}, Probes: 1},
+	} {
+		if _, err := Tune(open, []string{t.TempDir()}, opts, zap.NewNop()); err == nil {
+			t.Fatalf("%s: tuned", name)
+		}
+	}
+}
@@ -0,0 +1,443 @@
+package datastorage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+
+	"github.com/techninja8/getvault.io/pkg/metadata"
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+// ObjectHealth classifies an object after verification.
+type ObjectHealth string
+
+const (
+	ObjectHealthy       ObjectHealth = "healthy"
+	ObjectDegraded      ObjectHealth = "degraded"
+	ObjectUnrecoverable ObjectHealth = "unrecoverable"
+)
+
+// Verification depths. A shard checked at DepthChecksum was checksummed
+// by its store in place and matched the checksum recorded at store time,
+// without being downloaded; one checked at DepthFull was downloaded and
+// checked against its proof.
+const (
+	DepthChecksum = "checksum"
+	DepthFull     = "full"
+)
+
+// CheckOptions controls CheckData.
+type CheckOptions struct {
+	Heal bool // Rewrite missing and corrupt shards of recoverable objects
+	// Deep downloads every shard and checks its proof, even when the store
+	// could checksum it in place
+	Deep        bool
+	Concurrency int // Shards checked at once, 0 for every shard of a set
+}
+
+// ShardCheck is the verification result for a single shard.
+type ShardCheck struct {
+	Index    int    `json:"index"`
+	Location string `json:"location"`
+	Present  bool   `json:"present"`
+	Verified bool   `json:"verified"`
+	Depth    string `json:"depth,omitempty"`
+	Repaired bool   `json:"repaired,omitempty"`
+	// Name of the corrupt copy set aside before the repair
+	Quarantined string `json:"quarantined,omitempty"`
+}
+
+// VerifyReport is the verification result for a single object.
+type VerifyReport struct {
+	MetadataFile string       `json:"metadata_file"`
+	DataID       string       `json:"data_id,omitempty"`
+	Health       ObjectHealth `json:"health,omitempty"`
+	Shards       []ShardCheck `json:"shards,omitempty"`
+	Repaired     int          `json:"repaired,omitempty"`
+	Error        string       `json:"error,omitempty"`
+}
+
+// CheckData checks every shard of an object against what was recorded at
+// store time. Unless opts.Deep is set, stores that checksum in place are
+// asked for the checksum of each shard first, and a shard set is only
+// downloaded when a shard doesn't match, or is missing and to be healed.
+// Downloaded shards are compared with their proofs; missing shards are
+// rebuilt from the surviving ones first, so a gap doesn't invalidate its
+// neighbours' proofs. With opts.Heal set, rebuilt shards are written back to their locations, but
+// only when the rebuilt set reproduces every recorded proof; a corrupt
+// shard is first moved to its location's quarantine area, so the bad copy
+// is kept and counted against the location. A streamed object is checked
+// segment by segment; a shard is reported present and verified only if it
+// is in every segment.
+func CheckData(metadatafile string, store sharding.ShardStore, opts CheckOptions, logger *zap.Logger) (*VerifyReport, error) {
+	_, logger = withOperation(context.Background(), logger, "verify")
+	dataID, err := metadata.ReadValue(metadatafile, "dataID")
+	if err != nil {
+		return nil, fmt.Errorf("error reading metadata file: %w", err)
+	}
+
+	values, err := metadata.ReadValues(metadatafile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading metadata file: %w", err)
+	}
+	// Stale proofs would flag every rewritten shard, and healing against
+	// them would undo the rewrite
+	if err := checkGenerations(values); err != nil {
+		return nil, err
+	}
+	candidates, err := readShardCandidates(metadatafile)
+	if err != nil {
+		return nil, err
+	}
+
+	sets, err := readShardSets(metadatafile, dataID)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &VerifyReport{
+		MetadataFile: metadatafile,
+		DataID:       dataID,
+		Health:       ObjectHealthy,
+		Shards:       make([]ShardCheck, len(candidates)),
+	}
+	for i := range candidates {
+		report.Shards[i] = ShardCheck{Index: i, Location: candidates[i][0], Present: true, Verified: true}
+	}
+
+	for _, set := range sets {
+		setReport, err := checkShardSet(set, candidates, store, opts, logger)
+		if err != nil {
+			return nil, err
+		}
+		for i, check := range setReport.Shards {
+			shard := &report.Shards[i]
+			shard.Present = shard.Present && check.Present
+			shard.Verified = shard.Verified && check.Verified
+			shard.Depth = mergeDepth(shard.Depth, check.Depth)
+			shard.Repaired = shard.Repaired || check.Repaired
+			if check.Quarantined != "" {
+				shard.Quarantined = check.Quarantined
+			}
+		}
+		report.Repaired += setReport.Repaired
+		if healthRank[setReport.Health] > healthRank[report.Health] {
+			report.Health = setReport.Health
+		}
+	}
+
+	if err := recordEvent(metadatafile, dataID, ObjectEvent{Event: EventVerified, Detail: string(report.Health)}); err != nil {
+		logger.Warn("Failed to record object history", zap.Error(err))
+	}
+	var quarantined []int
+	for _, shard := range report.Shards {
+		if shard.Quarantined != "" {
+			quarantined = append(quarantined, shard.Index)
+		}
+	}
+	if len(quarantined) > 0 {
+		if err := recordEvent(metadatafile, dataID, ObjectEvent{Event: EventQuarantined, Shards: quarantined}); err != nil {
+			logger.Warn("Failed to record object history", zap.Error(err))
+		}
+	}
+	if report.Repaired > 0 {
+		var repaired []int
+		for _, shard := range report.Shards {
+			if shard.Repaired {
+				repaired = append(repaired, shard.Index)
+			}
+		}
+		// Rebuilt shards are only written when they reproduce the proofs
+		err := rewriteMetadataFile(metadatafile, func(lines []string) ([]string, error) {
+			return bumpGeneration(lines, true)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to record the shard generation: %w", err)
+		}
+		if err := recordEvent(metadatafile, dataID, ObjectEvent{Event: EventRepaired, Shards: repaired}); err != nil {
+			logger.Warn("Failed to record object history", zap.Error(err))
+		}
+	}
+
+	return report, nil
+}
+
+var healthRank = map[ObjectHealth]int{
+	ObjectHealthy:       0,
+	ObjectDegraded:      1,
+	ObjectUnrecoverable: 2,
+}
+
+// mergeDepth combines the depths a shard was checked at in two shard sets
+// into the one vouched for by both.
+func mergeDepth(a, b string) string {
+	switch {
+	case a == "":
+		return b
+	case b == "" || a == b:
+		return a
+	}
+	return DepthChecksum
+}
+
+// setHealth classifies a shard set by how many of its shards are missing
+// or fail their checks.
+func setHealth(set shardSet, bad int) ObjectHealth {
+	switch {
+	case bad == 0:
+		return ObjectHealthy
+	case bad <= set.Code.Parity:
+		return ObjectDegraded
+	}
+	return ObjectUnrecoverable
+}
+
+// forEachShard calls fn for shards 0 to n-1, concurrency at a time, or all
+// at once when concurrency is less than 1. Once ctx is done, shards not yet
+// started are skipped.
+func forEachShard(ctx context.Context, n, concurrency int, fn func(i int)) {
+	if concurrency < 1 || concurrency > n {
+		concurrency = n
+	}
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				fn(i)
+			}
+		}()
+	}
+feed:
+	for i := 0; i < n; i++ {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+// checkShardChecksums checks a shard set without downloading it, by
+// comparing the checksum each shard's store reports with the one recorded
+// for it. It returns false when the set needs downloading instead: the
+// store can't checksum in place, no checksums are recorded, a shard doesn't
+// match, or one is missing and heal is set. The first mismatch stops the
+// remaining checks, since the set is downloaded anyway.
+func checkShardChecksums(set shardSet, candidates [][]string, store sharding.ShardStore, opts CheckOptions, logger *zap.Logger) (*VerifyReport, bool) {
+	if !sharding.Probe(store).Checksum || set.storedChecksum(0) == "" {
+		return nil, false
+	}
+	report := &VerifyReport{
+		DataID: set.ID,
+		Shards: make([]ShardCheck, len(candidates)),
+	}
+	for i := range candidates {
+		report.Shards[i] = ShardCheck{Index: i, Location: candidates[i][0]}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var mismatched atomic.Bool
+	forEachShard(ctx, len(candidates), opts.Concurrency, func(i int) {
+		for _, location := range candidates[i] {
+			sum, err := sharding.ShardChecksum(store, set.ID, i, location)
+			if errors.Is(err, sharding.ErrShardNotFound) {
+				continue
+			}
+			// Only the shard itself tells a corrupt copy from a misplaced
+			// one or a failed request
+			if err != nil || sum != set.storedChecksum(i) {
+				logger.Info("Shard checksum doesn't match, downloading shards", zap.String("shardSet", set.ID), zap.Int("index", i), zap.String("location", location), zap.Error(err))
+				mismatched.Store(true)
+				cancel()
+				return
+			}
+			report.Shards[i].Present = true
+			report.Shards[i].Verified = true
+			report.Shards[i].Depth = DepthChecksum
+			return
+		}
+	})
+	if mismatched.Load() {
+		return nil, false
+	}
+
+	missing := 0
+	for _, shard := range report.Shards {
+		if !shard.Present {
+			missing++
+		}
+	}
+	if missing > 0 && opts.Heal {
+		return nil, false
+	}
+	report.Health = setHealth(set, missing)
+	return report, true
+}
+
+// checkShardSet verifies, and with heal set repairs, one shard set. A
+// shard found only at a candidate location counts as present; healing
+// writes missing shards back to their recorded locations, and corrupt ones
+// back where they were found once they are quarantined. Corrupt shards
+// can only be told apart, and so repaired, with digest proofs. Unless
+// opts.Deep is set, the set is only downloaded when checkShardChecksums
+// can't vouch for it.
+func checkShardSet(set shardSet, candidates [][]string, store sharding.ShardStore, opts CheckOptions, logger *zap.Logger) (*VerifyReport, error) {
+	if !opts.Deep {
+		if report, ok := checkShardChecksums(set, candidates, store, opts, logger); ok {
+			return report, nil
+		}
+	}
+
+	dataID := set.ID
+	heal := opts.Heal
+	report := &VerifyReport{
+		DataID: dataID,
+		Shards: make([]ShardCheck, len(candidates)),
+	}
+	for i := range candidates {
+		report.Shards[i] = ShardCheck{Index: i, Location: candidates[i][0]}
+	}
+
+	// Retrieve shards from the storage locations
+	shards := make([][]byte, len(candidates))
+	found := make([]string, len(candidates)) // Where each shard was read from
+	missing := 0
+	forEachShard(context.Background(), len(candidates), opts.Concurrency, func(i int) {
+		shard, from, err := sharding.RetrieveShardFrom(store, dataID, i, candidates[i])
+		if err != nil {
+			logger.Warn("Shard retrieval failed", zap.Int("index", i), zap.String("location", candidates[i][0]), zap.Error(err))
+			return
+		}
+		shards[i] = shard
+		found[i] = from
+	})
+	// Misplaced shards are moved to their own slots; empty slots are missing
+	retrieved := shards
+	shards = placeShards(shards, set.Indexed, logger)
+	for i, shard := range shards {
+		report.Shards[i].Present = shard != nil
+		if shard == nil {
+			missing++
+		}
+	}
+
+	// Shards that can be checked on their own are checked before
+	// reconstruction, so a corrupt one doesn't poison the rebuilt ones.
+	usable, ownChecks, err := set.usableShards(shards)
+	if err != nil {
+		return nil, err
+	}
+	unusable := 0
+	for _, shard := range usable {
+		if shard == nil {
+			unusable++
+		}
+	}
+
+	rebuilt := usable
+	if unusable > 0 && unusable <= set.Code.Parity {
+		rebuilt = make([][]byte, len(usable))
+		copy(rebuilt, usable)
+		if err := set.Code.Reconstruct(rebuilt); err != nil {
+			logger.Warn("Shard reconstruction failed", zap.Error(err))
+			rebuilt = usable
+		}
+	}
+
+	// Compare each shard with its recorded proof
+	checks, err := set.checkProofs(rebuilt)
+	if err != nil {
+		return nil, err
+	}
+	invalid, corrupt := 0, 0
+	for i := range rebuilt {
+		valid := checks[i]
+		if ownChecks != nil && report.Shards[i].Present {
+			valid = ownChecks[i]
+		} else if rebuilt[i] == nil {
+			continue
+		}
+		if !valid {
+			invalid++
+		}
+		if report.Shards[i].Present {
+			report.Shards[i].Verified = valid
+			report.Shards[i].Depth = DepthFull
+			if !valid {
+				corrupt++
+			}
+		}
+	}
+
+	report.Health = setHealth(set, missing+invalid)
+
+	repairable := missing
+	if ownChecks != nil {
+		repairable += corrupt
+	}
+	if !heal || repairable == 0 || report.Health == ObjectUnrecoverable {
+		return report, nil
+	}
+	// Raw-shard proofs only vouch for the set as a whole; digest proofs
+	// vouch for each rebuilt shard by itself.
+	if invalid > 0 && ownChecks == nil {
+		logger.Warn("Not healing object, rebuilt shards don't match the recorded proofs", zap.String("dataID", dataID))
+		return report, nil
+	}
+
+	quarantine := sharding.Probe(store).Quarantine
+	for i := range report.Shards {
+		if report.Shards[i].Verified || rebuilt[i] == nil || !checks[i] {
+			continue
+		}
+		location := candidates[i][0]
+		if found[i] != "" && corruptCopy(retrieved[i], i, len(retrieved), set.Indexed) {
+			location = found[i]
+			if !quarantine {
+				logger.Warn("Not repairing corrupt shard, the store can't quarantine it", zap.Int("index", i), zap.String("location", location))
+				continue
+			}
+			name, err := store.(sharding.ShardQuarantiner).QuarantineShard(dataID, i, location)
+			if err != nil {
+				logger.Error("Quarantining corrupt shard failed", zap.Int("index", i), zap.String("location", location), zap.Error(err))
+				continue
+			}
+			logger.Warn("Quarantined corrupt shard", zap.Int("index", i), zap.String("location", location), zap.String("name", name))
+			report.Shards[i].Quarantined = name
+		}
+		if err := store.StoreShard(dataID, i, encodeShard(set.Indexed, i, rebuilt[i]), location); err != nil {
+			logger.Error("Healing shard failed", zap.Int("index", i), zap.String("location", location), zap.Error(err))
+			continue
+		}
+		logger.Info("Healed shard", zap.Int("index", i), zap.String("location", location))
+		report.Shards[i].Repaired = true
+		report.Repaired++
+	}
+	if report.Repaired == missing+corrupt {
+		report.Health = ObjectHealthy
+	}
+
+	return report, nil
+}
+
+// corruptCopy reports whether the shard file read for slot i of n holds
+// bad data that repair would overwrite, rather than a good shard that
+// belongs in another slot. Only called for slots that failed to verify.
+func corruptCopy(data []byte, i, n int, indexed bool) bool {
+	if !indexed {
+		return true
+	}
+	index, _, err := decodeShard(data)
+	return err != nil || index == i || index >= n
+}
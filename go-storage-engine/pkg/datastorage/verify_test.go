@@ -0,0 +1,245 @@
+package datastorage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+// countingStore counts the shard bodies downloaded from the store inside.
+// It checksums shards in place through the store inside.
+type countingStore struct {
+	*sharding.InMemoryShardStore
+	retrieved atomic.Int64
+}
+
+func (s *countingStore) RetrieveShard(dataID string, index int, location string) ([]byte, error) {
+	s.retrieved.Add(1)
+	return s.InMemoryShardStore.RetrieveShard(dataID, index, location)
+}
+
+func TestCheckDataShallowDownloadsNothing(t *testing.T) {
+	v := newTestVault(t)
+	metadatafile := v.storeObject(t, "object.bin", randomBytes(t, 50_000))
+
+	store := &countingStore{InMemoryShardStore: sharding.NewInMemoryShardStore()}
+	report, err := CheckData(metadatafile, store, CheckOptions{}, v.logger)
+	if err != nil {
+		t.Fatalf("CheckData: %v", err)
+	}
+	if report.Health != ObjectHealthy {
+		t.Fatalf("health %s, expected %s", report.Health, ObjectHealthy)
+	}
+	if n := store.retrieved.Load(); n != 0 {
+		t.Fatalf("shallow verify downloaded %d shards, expected none", n)
+	}
+	for _, shard := range report.Shards {
+		if !shard.Verified || shard.Depth != DepthChecksum {
+			t.Fatalf("shard %d: verified %t at depth %q, expected verified at %q", shard.Index, shard.Verified, shard.Depth, DepthChecksum)
+		}
+	}
+}
+
+func TestCheckDataDeepDownloadsEveryShard(t *testing.T) {
+	v := newTestVault(t)
+	metadatafile := v.storeObject(t, "object.bin", randomBytes(t, 50_000))
+
+	store := &countingStore{InMemoryShardStore: sharding.NewInMemoryShardStore()}
+	report, err := CheckData(metadatafile, store, CheckOptions{Deep: true}, v.logger)
+	if err != nil {
+		t.Fatalf("CheckData: %v", err)
+	}
+	if report.Health != ObjectHealthy {
+		t.Fatalf("health %s, expected %s", report.Health, ObjectHealthy)
+	}
+	if n := store.retrieved.Load(); n != int64(len(v.locations)) {
+		t.Fatalf("deep verify downloaded %d shards, expected %d", n, len(v.locations))
+	}
+	for _, shard := range report.Shards {
+		if shard.Depth != DepthFull {
+			t.Fatalf("shard %d checked at depth %q, expected %q", shard.Index, shard.Depth, DepthFull)
+		}
+	}
+}
+
+func TestCheckDataFallsBackOnMismatch(t *testing.T) {
+	v := newTestVault(t)
+	metadatafile := v.storeObject(t, "object.bin", randomBytes(t, 50_000))
+	dataID, err := MetadataFileReader(metadatafile, "dataID")
+	if err != nil {
+		t.Fatal(err)
+	}
+	shard := filepath.Join(v.locations[3], sharding.PlainShardName(dataID, 3))
+	data, err := os.ReadFile(shard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 0xff
+	if err := os.WriteFile(shard, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	store := &countingStore{InMemoryShardStore: sharding.NewInMemoryShardStore()}
+	report, err := CheckData(metadatafile, store, CheckOptions{}, v.logger)
+	if err != nil {
+		t.Fatalf("CheckData: %v", err)
+	}
+	if report.Health != ObjectDegraded {
+		t.Fatalf("health %s, expected %s", report.Health, ObjectDegraded)
+	}
+	if store.retrieved.Load() == 0 {
+		t.Fatal("a mismatched checksum didn't fall back to downloading shards")
+	}
+	if report.Shards[3].Verified || report.Shards[3].Depth != DepthFull {
+		t.Fatalf("corrupt shard reported verified %t at depth %q", report.Shards[3].Verified, report.Shards[3].Depth)
+	}
+}
+
+// TestRepairWhileRetrieving runs repair loops, each deleting a shard and
+// healing it, against retrieval loops and access tracking on the same
+// object. Every repair rewrites the metadata file, so a reader seeing a
+// torn file or a writer losing another's update fails it; run it under
+// -race.
+func TestRepairWhileRetrieving(t *testing.T) {
+	v := newTestVault(t)
+	data := randomBytes(t, 200_000)
+	metadatafile := v.storeObject(t, "object.bin", data)
+	dataID, err := MetadataFileReader(metadatafile, "dataID")
+	if err != nil {
+		t.Fatal(err)
+	}
+	repairs := 20
+	if testing.Short() {
+		repairs = 5
+	}
+
+	var (
+		wg       sync.WaitGroup
+		done     = make(chan struct{})
+		accesses atomic.Int64
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(done)
+		for i := range repairs {
+			index := i % len(v.locations)
+			if err := os.Remove(filepath.Join(v.locations[index], sharding.PlainShardName(dataID, index))); err != nil {
+				t.Errorf("repair %d: %v", i, err)
+				return
+			}
+			report, err := CheckData(metadatafile, sharding.NewInMemoryShardStore(), CheckOptions{Heal: true}, v.logger)
+			if err != nil || report.Repaired != 1 {
+				t.Errorf("repair %d: %+v, %v", i, report, err)
+				return
+			}
+		}
+	}()
+	for range 3 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				got, err := RetrieveData(metadatafile, sharding.NewInMemoryShardStore(), v.cfg, v.logger)
+				if err != nil || !bytes.Equal(got, data) {
+					t.Errorf("retrieved %d bytes while repairing: %v", len(got), err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if err := RecordAccess(metadatafile, time.Now()); err != nil {
+				t.Errorf("RecordAccess while repairing: %v", err)
+				return
+			}
+			accesses.Add(1)
+		}
+	}()
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+
+	// No repair lost another's generation bump, nor access tracking a
+	// repair's
+	if generation, err := MetadataFileReader(metadatafile, shardGenerationKey); err != nil || generation != strconv.Itoa(repairs) {
+		t.Fatalf("shard generation %q after %d repairs: %v", generation, repairs, err)
+	}
+	if _, err := MetadataFileReader(metadatafile, "last_access"); err != nil && accesses.Load() > 0 {
+		t.Fatalf("last access lost after %d accesses: %v", accesses.Load(), err)
+	}
+	report, err := CheckData(metadatafile, sharding.NewInMemoryShardStore(), CheckOptions{Deep: true}, v.logger)
+	if err != nil || report.Health != ObjectHealthy {
+		t.Fatalf("after the repairs: %+v, %v", report, err)
+	}
+}
+
+// TestVerifyOnly verifies and heals objects with no encryption key
+// configured, in verify-only mode, and checks that anything reading or
+// writing object contents is refused with ErrVerifyOnly.
+func TestVerifyOnly(t *testing.T) {
+	v := newTestVault(t)
+	inMemory := v.storeObject(t, "small.bin", randomBytes(t, 50_000))
+	v.cfg.StreamingThreshold = 1
+	streamed := v.storeObject(t, "large.bin", randomBytes(t, 200_000))
+
+	v.cfg.EncryptionKey = ""
+	v.cfg.VerifyOnly = true
+	for _, metadatafile := range []string{inMemory, streamed} {
+		for _, opts := range []CheckOptions{{}, {Deep: true}} {
+			report, err := CheckData(metadatafile, sharding.NewInMemoryShardStore(), opts, v.logger)
+			if err != nil || report.Health != ObjectHealthy {
+				t.Fatalf("%s, deep %t: verified as %+v, %v", filepath.Base(metadatafile), opts.Deep, report, err)
+			}
+		}
+		if _, err := RetrieveData(metadatafile, sharding.NewInMemoryShardStore(), v.cfg, v.logger); !errors.Is(err, ErrVerifyOnly) {
+			t.Fatalf("%s: RetrieveData in verify-only mode: %v", filepath.Base(metadatafile), err)
+		}
+		if _, err := RetrieveTo(metadatafile, io.Discard, sharding.NewInMemoryShardStore(), v.cfg, v.logger); !errors.Is(err, ErrVerifyOnly) {
+			t.Fatalf("%s: RetrieveTo in verify-only mode: %v", filepath.Base(metadatafile), err)
+		}
+	}
+
+	missing := v.shardFile(t, inMemory, 2)
+	if err := os.Remove(missing); err != nil {
+		t.Fatal(err)
+	}
+	if report, err := CheckData(inMemory, sharding.NewInMemoryShardStore(), CheckOptions{Heal: true}, v.logger); err != nil || report.Repaired != 1 {
+		t.Fatalf("healing in verify-only mode: %+v, %v", report, err)
+	}
+	if _, err := os.Stat(missing); err != nil {
+		t.Fatalf("healed shard: %v", err)
+	}
+
+	if _, _, err := StoreData(randomBytes(t, 1000), v.store, v.cfg, v.locations, v.logger, "new.bin"); !errors.Is(err, ErrVerifyOnly) {
+		t.Fatalf("StoreData in verify-only mode: %v", err)
+	}
+	// Without verify-only mode the missing key is just missing
+	v.cfg.VerifyOnly = false
+	if _, err := RetrieveData(inMemory, sharding.NewInMemoryShardStore(), v.cfg, v.logger); err == nil || errors.Is(err, ErrVerifyOnly) {
+		t.Fatalf("RetrieveData without a key: %v", err)
+	}
+}
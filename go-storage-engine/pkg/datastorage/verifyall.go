@@ -0,0 +1,218 @@
+package datastorage
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+// VerifyAllOptions controls a verify-all run.
+type VerifyAllOptions struct {
+	Concurrency int     // Objects verified at once
+	Rate        float64 // Objects started per second, 0 for unlimited
+	Heal        bool    // Rewrite missing shards of recoverable objects
+	Deep        bool    // Download every shard, see CheckOptions
+	Checkpoint  string  // Progress file used to resume an interrupted run, "" disables
+}
+
+// VerifyAllSummary aggregates the reports of a verify-all run.
+type VerifyAllSummary struct {
+	Started        time.Time       `json:"started"`
+	Finished       time.Time       `json:"finished"`
+	Objects        int             `json:"objects"`
+	Healthy        int             `json:"healthy"`
+	Degraded       int             `json:"degraded"`
+	Unrecoverable  int             `json:"unrecoverable"`
+	Failed         int             `json:"failed"`
+	ShardsRepaired int             `json:"shards_repaired"`
+	Reports        []*VerifyReport `json:"reports"`
+}
+
+func (s *VerifyAllSummary) add(report *VerifyReport) {
+	s.Objects++
+	s.ShardsRepaired += report.Repaired
+	switch {
+	case report.Error != "":
+		s.Failed++
+	case report.Health == ObjectHealthy:
+		s.Healthy++
+	case report.Health == ObjectDegraded:
+		s.Degraded++
+	default:
+		s.Unrecoverable++
+	}
+	s.Reports = append(s.Reports, report)
+}
+
+// VerifyAll verifies every metadata file in dir. Objects already recorded
+// in the checkpoint file are not verified again; the checkpoint is removed
+// once the run completes. Once ctx is done no further objects are started,
+// and the checkpoint is kept so the run can be resumed.
+func VerifyAll(ctx context.Context, dir string, store sharding.ShardStore, opts VerifyAllOptions, logger *zap.Logger) (*VerifyAllSummary, error) {
+	files, err := listMetadataFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	summary := &VerifyAllSummary{Started: time.Now()}
+
+	done, err := readCheckpoint(opts.Checkpoint)
+	if err != nil {
+		return nil, err
+	}
+	var pending []string
+	for _, file := range files {
+		if report, ok := done[file]; ok {
+			summary.add(report)
+			continue
+		}
+		pending = append(pending, file)
+	}
+	if len(done) > 0 {
+		logger.Info("Resuming verification from checkpoint", zap.Int("done", len(done)), zap.Int("pending", len(pending)))
+	}
+
+	var checkpoint *os.File
+	if opts.Checkpoint != "" {
+		checkpoint, err = os.OpenFile(opts.Checkpoint, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open checkpoint file: %w", err)
+		}
+		defer checkpoint.Close()
+	}
+
+	concurrency := opts.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	jobs := make(chan string)
+	var mu sync.Mutex
+	var checkpointErr error
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for file := range jobs {
+				report, err := CheckData(file, store, CheckOptions{Heal: opts.Heal, Deep: opts.Deep}, logger)
+				if err != nil {
+					logger.Error("Verification failed", zap.String("metadataFile", file), zap.Error(err))
+					report = &VerifyReport{MetadataFile: file, Error: err.Error()}
+				}
+
+				mu.Lock()
+				summary.add(report)
+				if checkpoint != nil && checkpointErr == nil {
+					checkpointErr = writeCheckpoint(checkpoint, report)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	// A single ticker shared by all workers bounds the overall rate.
+	var tick <-chan time.Time
+	if opts.Rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / opts.Rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+feed:
+	for i, file := range pending {
+		if tick != nil && i > 0 {
+			select {
+			case <-tick:
+			case <-ctx.Done():
+				break feed
+			}
+		}
+		select {
+		case jobs <- file:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if checkpointErr != nil {
+		return nil, fmt.Errorf("failed to write checkpoint: %w", checkpointErr)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if checkpoint != nil {
+		checkpoint.Close()
+		os.Remove(opts.Checkpoint)
+	}
+
+	sort.Slice(summary.Reports, func(i, j int) bool {
+		return summary.Reports[i].MetadataFile < summary.Reports[j].MetadataFile
+	})
+	summary.Finished = time.Now()
+	return summary, nil
+}
+
+// WriteVerifyAllReport writes the summary to filename as JSON.
+func WriteVerifyAllReport(summary *VerifyAllSummary, filename string) error {
+	data, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		return fmt.Errorf("failed to write report: %w", err)
+	}
+	return nil
+}
+
+// readCheckpoint loads the reports recorded by an earlier, interrupted run.
+// A torn final line from a crash is ignored.
+func readCheckpoint(filename string) (map[string]*VerifyReport, error) {
+	done := make(map[string]*VerifyReport)
+	if filename == "" {
+		return done, nil
+	}
+	file, err := os.Open(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return done, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open checkpoint file: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var report VerifyReport
+		if err := json.Unmarshal(scanner.Bytes(), &report); err != nil {
+			continue
+		}
+		done[report.MetadataFile] = &report
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read checkpoint file: %w", err)
+	}
+	return done, nil
+}
+
+func writeCheckpoint(file *os.File, report *VerifyReport) error {
+	data, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(data, '\n'))
+	return err
+}
@@ -0,0 +1,203 @@
+package datastorage
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+// damagedVault is a test vault of four objects: a.bin healthy, b.bin with
+// two shards deleted, c.bin with a shard corrupted and d.bin with more
+// shards deleted than there is parity. It returns the metadata file of
+// each by name.
+func damagedVault(t *testing.T) (*testVault, map[string]string) {
+	t.Helper()
+	v := newTestVault(t)
+	files := map[string]string{}
+	for _, name := range []string{"a.bin", "b.bin", "c.bin", "d.bin"} {
+		files[name] = v.storeObject(t, name, randomBytes(t, 20_000))
+	}
+	shard := func(name string, index int) string {
+		dataID, err := MetadataFileReader(files[name], "dataID")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return filepath.Join(v.locations[index], sharding.PlainShardName(dataID, index))
+	}
+	for _, index := range []int{0, 9} {
+		if err := os.Remove(shard("b.bin", index)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := os.ReadFile(shard("c.bin", 4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)/2] ^= 0xff
+	if err := os.WriteFile(shard("c.bin", 4), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for index := range 7 {
+		if err := os.Remove(shard("d.bin", index)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return v, files
+}
+
+// reportsByName returns the reports of a summary by the name of the
+// object of a damagedVault each is of, failing the test unless there is
+// one for each, in metadata file order.
+func reportsByName(t *testing.T, summary *VerifyAllSummary, files map[string]string) map[string]*VerifyReport {
+	t.Helper()
+	if len(summary.Reports) != len(files) || summary.Objects != len(files) {
+		t.Fatalf("%d objects in %d reports, expected %d", summary.Objects, len(summary.Reports), len(files))
+	}
+	reports := map[string]*VerifyReport{}
+	for i, report := range summary.Reports {
+		if i > 0 && report.MetadataFile <= summary.Reports[i-1].MetadataFile {
+			t.Fatalf("report %d, of %s, out of order", i, report.MetadataFile)
+		}
+		for name, file := range files {
+			if report.MetadataFile == file {
+				reports[name] = report
+			}
+		}
+	}
+	if len(reports) != len(files) {
+		t.Fatalf("reports of %d of the %d objects", len(reports), len(files))
+	}
+	return reports
+}
+
+// checkVerifyAll fails the test unless the summary reports every object of
+// a damagedVault with the health given for it, in metadata file order.
+func checkVerifyAll(t *testing.T, summary *VerifyAllSummary, files map[string]string, want map[string]ObjectHealth) {
+	t.Helper()
+	reports := reportsByName(t, summary, files)
+	counts := map[ObjectHealth]int{}
+	for name, report := range reports {
+		if report.Health != want[name] || report.Error != "" {
+			t.Fatalf("%s: health %s, error %q, expected %s", name, report.Health, report.Error, want[name])
+		}
+		counts[want[name]]++
+	}
+	if summary.Healthy != counts[ObjectHealthy] || summary.Degraded != counts[ObjectDegraded] || summary.Unrecoverable != counts[ObjectUnrecoverable] || summary.Failed != 0 {
+		t.Fatalf("summary of %d healthy, %d degraded, %d unrecoverable and %d failed, expected %v",
+			summary.Healthy, summary.Degraded, summary.Unrecoverable, summary.Failed, counts)
+	}
+}
+
+// TestVerifyAllReportsEachObject verifies, heals and verifies again a
+// damagedVault, through new stores, which read the shards from disk rather
+// than the copies the vault's store keeps of those it wrote.
+func TestVerifyAllReportsEachObject(t *testing.T) {
+	v, files := damagedVault(t)
+	summary, err := VerifyAll(context.Background(), v.cfg.MetadataDir, sharding.NewInMemoryShardStore(), VerifyAllOptions{Concurrency: 3}, v.logger)
+	if err != nil {
+		t.Fatalf("VerifyAll: %v", err)
+	}
+	checkVerifyAll(t, summary, files, map[string]ObjectHealth{
+		"a.bin": ObjectHealthy,
+		"b.bin": ObjectDegraded,
+		"c.bin": ObjectDegraded,
+		"d.bin": ObjectUnrecoverable,
+	})
+	if summary.ShardsRepaired != 0 {
+		t.Fatalf("repaired %d shards without --heal", summary.ShardsRepaired)
+	}
+
+	// Healing rewrites the shards of the degraded objects, after which they
+	// verify healthy
+	summary, err = VerifyAll(context.Background(), v.cfg.MetadataDir, sharding.NewInMemoryShardStore(), VerifyAllOptions{Concurrency: 3, Heal: true}, v.logger)
+	if err != nil {
+		t.Fatalf("VerifyAll with heal: %v", err)
+	}
+	healed := reportsByName(t, summary, files)
+	if repaired := healed["b.bin"].Repaired + healed["c.bin"].Repaired; repaired != 3 || summary.ShardsRepaired != 3 {
+		t.Fatalf("healing repaired %d shards of b.bin and c.bin, %d in all, expected 3", repaired, summary.ShardsRepaired)
+	}
+	summary, err = VerifyAll(context.Background(), v.cfg.MetadataDir, sharding.NewInMemoryShardStore(), VerifyAllOptions{}, v.logger)
+	if err != nil {
+		t.Fatalf("VerifyAll after healing: %v", err)
+	}
+	checkVerifyAll(t, summary, files, map[string]ObjectHealth{
+		"a.bin": ObjectHealthy,
+		"b.bin": ObjectHealthy,
+		"c.bin": ObjectHealthy,
+		"d.bin": ObjectUnrecoverable,
+	})
+}
+
+// objectCounter records the objects whose shards are checksummed through
+// it, and calls checked after the first.
+type objectCounter struct {
+	*sharding.InMemoryShardStore
+	mu      sync.Mutex
+	objects map[string]bool
+	checked func()
+}
+
+func (s *objectCounter) ShardChecksum(dataID string, index int, location string) (string, error) {
+	s.mu.Lock()
+	if !s.objects[dataID] {
+		s.objects[dataID] = true
+		if s.checked != nil {
+			s.checked()
+			s.checked = nil
+		}
+	}
+	s.mu.Unlock()
+	return s.InMemoryShardStore.ShardChecksum(dataID, index, location)
+}
+
+// TestVerifyAllResumes interrupts a run after its first object and checks
+// that the resumed run verifies only the objects the checkpoint doesn't
+// record, reports them all, and removes the checkpoint.
+func TestVerifyAllResumes(t *testing.T) {
+	v, files := damagedVault(t)
+	checkpoint := filepath.Join(t.TempDir(), "verify-all.checkpoint")
+	opts := VerifyAllOptions{Concurrency: 1, Checkpoint: checkpoint}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interrupted := &objectCounter{InMemoryShardStore: sharding.NewInMemoryShardStore(), objects: map[string]bool{}, checked: cancel}
+	if _, err := VerifyAll(ctx, v.cfg.MetadataDir, interrupted, opts, v.logger); err != context.Canceled {
+		t.Fatalf("interrupted VerifyAll returned %v, expected %v", err, context.Canceled)
+	}
+	file, err := os.Open(checkpoint)
+	if err != nil {
+		t.Fatalf("checkpoint of the interrupted run: %v", err)
+	}
+	recorded := 0
+	for scanner := bufio.NewScanner(file); scanner.Scan(); {
+		recorded++
+	}
+	file.Close()
+	if recorded < 1 || recorded >= len(files) {
+		t.Fatalf("interrupted run checkpointed %d of %d objects", recorded, len(files))
+	}
+
+	resumed := &objectCounter{InMemoryShardStore: sharding.NewInMemoryShardStore(), objects: map[string]bool{}}
+	summary, err := VerifyAll(context.Background(), v.cfg.MetadataDir, resumed, opts, v.logger)
+	if err != nil {
+		t.Fatalf("resumed VerifyAll: %v", err)
+	}
+	if len(resumed.objects) != len(files)-recorded {
+		t.Fatalf("resumed run checked %d objects, %d of %d were checkpointed", len(resumed.objects), recorded, len(files))
+	}
+	checkVerifyAll(t, summary, files, map[string]ObjectHealth{
+		"a.bin": ObjectHealthy,
+		"b.bin": ObjectDegraded,
+		"c.bin": ObjectDegraded,
+		"d.bin": ObjectUnrecoverable,
+	})
+	if _, err := os.Stat(checkpoint); !os.IsNotExist(err) {
+		t.Fatalf("checkpoint left after the run completed: %v", err)
+	}
+}
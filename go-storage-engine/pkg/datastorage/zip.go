@@ -2,26 +2,137 @@ package datastorage
 
 import (
 	"archive/zip"
+	"context"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"os"
 	"path/filepath"
-	"strings"
+	"strconv"
+
+	"github.com/techninja8/getvault.io/pkg/config"
+	"github.com/techninja8/getvault.io/pkg/metadata"
 )
 
-// ZipDirectory compresses the specified directory into a zip file.
-func ZipDirectory(source, target string) error {
-	// Ensure source path ends with separator to zip contents properly
-	if !strings.HasSuffix(source, string(os.PathSeparator)) {
-		source = source + string(os.PathSeparator)
+// ExtractMode controls what happens when an extraction target already has content.
+type ExtractMode int
+
+const (
+	ExtractRefuse  ExtractMode = iota // Fail if the target is a non-empty directory
+	ExtractMerge                      // Extract into the existing directory
+	ExtractReplace                    // Remove the existing directory first
+)
+
+var ErrExtractTargetExists = errors.New("extraction target already exists and is not empty")
+
+// PrepareExtractTarget checks target before an archive is extracted into
+// it, so that a new tree is never silently mixed into an old one.
+func PrepareExtractTarget(target string, mode ExtractMode) error {
+	entries, err := os.ReadDir(target)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to inspect extraction target: %w", err)
+	}
+	if len(entries) == 0 {
+		return nil
 	}
 
-	// Get absolute paths to avoid any path resolution issues
-	absSource, err := filepath.Abs(source)
+	switch mode {
+	case ExtractMerge:
+		return nil
+	case ExtractReplace:
+		absTarget, err := filepath.Abs(target)
+		if err != nil {
+			return fmt.Errorf("failed to get absolute path for target: %w", err)
+		}
+		wd, err := os.Getwd()
+		if err != nil {
+			return fmt.Errorf("failed to get working directory: %w", err)
+		}
+		// Never remove the working directory or one of its parents.
+		if rel, err := filepath.Rel(absTarget, wd); err == nil && filepath.IsLocal(rel) {
+			return fmt.Errorf("refusing to replace %s, it contains the working directory", target)
+		}
+		if err := os.RemoveAll(absTarget); err != nil {
+			return fmt.Errorf("failed to remove extraction target: %w", err)
+		}
+		return nil
+	default:
+		return fmt.Errorf("%w: %s", ErrExtractTargetExists, target)
+	}
+}
+
+// ZipOptions controls how a directory is archived.
+type ZipOptions struct {
+	Store bool       // Write entries uncompressed instead of deflating them
+	Stats *TreeStats // Filled in with the files archived, if set
+	// Hashes, if set, is filled in with the hash of every file archived,
+	// made with NewHash, by its entry name.
+	Hashes  TreeHashes
+	NewHash func() hash.Hash
+}
+
+// TreeStats is the size of a directory tree: its regular files and the
+// bytes in them. A directory stored as a zip archive records the stats of
+// the tree, as tree_files and tree_size, next to the archive's filesize.
+type TreeStats struct {
+	Files int64 `json:"files"`
+	Bytes int64 `json:"bytes"`
+}
+
+// ErrTreeMismatch is returned by CompareTree when an extracted tree isn't
+// the size of the one stored.
+var ErrTreeMismatch = errors.New("extracted tree doesn't match the directory stored")
+
+// CompareTree checks the stats of an extracted tree against those recorded
+// when the directory was stored.
+func CompareTree(recorded, extracted TreeStats) error {
+	if recorded != extracted {
+		return fmt.Errorf("%w: extracted %d files of %d bytes, stored %d files of %d bytes",
+			ErrTreeMismatch, extracted.Files, extracted.Bytes, recorded.Files, recorded.Bytes)
+	}
+	return nil
+}
+
+// SetTreeStats records the stats of the directory an object is the zip
+// archive of.
+func SetTreeStats(metadatafile string, stats TreeStats) error {
+	return rewriteMetadataFile(metadatafile, func(lines []string) ([]string, error) {
+		lines = metadata.SetValue(lines, "tree_files", strconv.FormatInt(stats.Files, 10))
+		return metadata.SetValue(lines, "tree_size", strconv.FormatInt(stats.Bytes, 10)), nil
+	})
+}
+
+// ReadTreeStats returns the tree stats recorded for an object, or nil if
+// it isn't a directory or was stored before they were recorded.
+func ReadTreeStats(metadatafile string) (*TreeStats, error) {
+	values, err := metadata.ReadValues(metadatafile)
 	if err != nil {
-		return fmt.Errorf("failed to get absolute path for source: %w", err)
+		return nil, fmt.Errorf("error reading metadata file: %w", err)
 	}
+	return readTreeStats(values), nil
+}
 
+// readTreeStats returns the tree stats recorded in metadata values, or nil
+// if the object isn't a directory or was stored before they were recorded.
+func readTreeStats(values map[string]string) *TreeStats {
+	files, err := strconv.ParseInt(values["tree_files"], 10, 64)
+	if err != nil {
+		return nil
+	}
+	bytes, err := strconv.ParseInt(values["tree_size"], 10, 64)
+	if err != nil {
+		return nil
+	}
+	return &TreeStats{Files: files, Bytes: bytes}
+}
+
+// ZipDirectory compresses the specified directory into a zip file.
+func ZipDirectory(source, target string) error {
 	absTarget, err := filepath.Abs(target)
 	if err != nil {
 		return fmt.Errorf("failed to get absolute path for target: %w", err)
@@ -34,15 +145,58 @@ func ZipDirectory(source, target string) error {
 	}
 	defer zipFile.Close()
 
+	if err := ZipDirectoryToWriter(source, zipFile, ZipOptions{}); err != nil {
+		return err
+	}
+	if err := zipFile.Close(); err != nil {
+		return fmt.Errorf("failed to finalize zip file: %w", err)
+	}
+
+	// Verify the created zip
+	zipReader, err := zip.OpenReader(absTarget)
+	if err != nil {
+		return fmt.Errorf("created zip file verification failed: %w", err)
+	}
+	return zipReader.Close()
+}
+
+// ZipDirectoryToWriter streams a zip archive of the source directory into
+// w. Entries are written as the directory is walked, one file at a time,
+// so memory use doesn't grow with the directory and w never needs to seek.
+func ZipDirectoryToWriter(source string, w io.Writer, opts ZipOptions) error {
+	// Get absolute paths to avoid any path resolution issues
+	absSource, err := filepath.Abs(source)
+	if err != nil {
+		return fmt.Errorf("failed to get absolute path for source: %w", err)
+	}
+
 	// Create a new zip archive writer
-	zipWriter := zip.NewWriter(zipFile)
-	defer zipWriter.Close()
+	zipWriter := zip.NewWriter(w)
+	if err := writeZipEntries(context.Background(), absSource, zipWriter, opts, nil, nil); err != nil {
+		return err
+	}
 
+	// Write the central directory
+	if err = zipWriter.Close(); err != nil {
+		return fmt.Errorf("failed to finalize zip archive: %w", err)
+	}
+	return nil
+}
+
+// writeZipEntries writes an entry to zipWriter for everything under
+// absSource, as the directory is walked, leaving out the entries named in
+// skip. Each entry's header is passed to created once it is written, if
+// created is set; the header's sizes and CRC are filled in when the next
+// entry is created or zipWriter is closed.
+func writeZipEntries(ctx context.Context, absSource string, zipWriter *zip.Writer, opts ZipOptions, skip map[string]bool, created func(header *zip.FileHeader) error) error {
 	// Walk through the directory
-	err = filepath.Walk(absSource, func(path string, info os.FileInfo, err error) error {
+	err := filepath.Walk(absSource, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return fmt.Errorf("error walking directory: %w", err)
 		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 
 		// Calculate zip entry name from the source path
 		relPath, err := filepath.Rel(absSource, path)
@@ -65,15 +219,25 @@ func ZipDirectory(source, target string) error {
 		header.Name = filepath.ToSlash(relPath)
 		if info.IsDir() {
 			header.Name += "/"
+		} else if opts.Store {
+			header.Method = zip.Store
 		} else {
 			header.Method = zip.Deflate
 		}
+		if skip[header.Name] {
+			return nil
+		}
 
 		// Create zip entry
 		writer, err := zipWriter.CreateHeader(header)
 		if err != nil {
 			return fmt.Errorf("failed to create zip entry: %w", err)
 		}
+		if created != nil {
+			if err := created(header); err != nil {
+				return err
+			}
+		}
 
 		// For directories, we're done
 		if info.IsDir() {
@@ -87,10 +251,22 @@ func ZipDirectory(source, target string) error {
 		}
 		defer file.Close()
 
-		_, err = io.Copy(writer, file)
+		var h hash.Hash
+		if opts.Hashes != nil {
+			h = opts.NewHash()
+			writer = io.MultiWriter(writer, h)
+		}
+		n, err := io.Copy(writer, file)
 		if err != nil {
 			return fmt.Errorf("failed to write file content: %w", err)
 		}
+		if h != nil {
+			opts.Hashes[header.Name] = hex.EncodeToString(h.Sum(nil))
+		}
+		if opts.Stats != nil {
+			opts.Stats.Files++
+			opts.Stats.Bytes += n
+		}
 
 		return nil
 	})
@@ -98,37 +274,63 @@ func ZipDirectory(source, target string) error {
 	if err != nil {
 		return fmt.Errorf("failed while traversing directory: %w", err)
 	}
+	return nil
+}
 
-	// Ensure the zip is properly closed
-	if err = zipWriter.Close(); err != nil {
-		return fmt.Errorf("failed to finalize zip file: %w", err)
-	}
-
-	// Verify the created zip
-	_, err = zip.OpenReader(absTarget)
-	if err != nil {
-		return fmt.Errorf("created zip file verification failed: %w", err)
-	}
+// UnzipLimits bounds what extracting an archive may consume. Zero leaves a limit unchecked.
+type UnzipLimits struct {
+	MaxFiles     int   // Entries in the archive
+	MaxFileSize  int64 // Uncompressed bytes of a single entry
+	MaxTotalSize int64 // Uncompressed bytes of all entries together
+}
 
-	return nil
+// DefaultUnzipLimits are the limits Unzip applies: generous for the
+// directories people archive into a vault, but small enough that a
+// hostile archive can't fill the disk or exhaust inodes.
+var DefaultUnzipLimits = UnzipLimits{
+	MaxFiles:     100_000,
+	MaxFileSize:  4 << 30,
+	MaxTotalSize: 16 << 30,
 }
 
-// Unzip extracts the contents of a zip file to the specified target directory.
+var errUnzipLimit = errors.New("archive exceeds extraction limits")
+
+// Unzip extracts the contents of a zip file to the specified target
+// directory. It fails, before extracting anything, if any of the files
+// exists already.
 func Unzip(source, target string) error {
+	_, err := UnzipWithLimits(source, target, DefaultUnzipLimits)
+	return err
+}
+
+// UnzipWithLimits is Unzip with explicit resource limits. Entry sizes are
+// checked against the limits before extraction and the bytes actually
+// written are capped at each entry's declared size, so an archive with a
+// forged header can't expand beyond what it claims. It returns the stats
+// of the files extracted.
+func UnzipWithLimits(source, target string, limits UnzipLimits) (TreeStats, error) {
+	return UnzipWithConflicts(source, target, limits, &Conflicts{Policy: config.ConflictFail})
+}
+
+// UnzipWithConflicts is UnzipWithLimits with files that exist already
+// dealt with by conflicts, which records what it did with them. Skipped
+// files aren't counted in the stats.
+func UnzipWithConflicts(source, target string, limits UnzipLimits, conflicts *Conflicts) (TreeStats, error) {
+	var stats TreeStats
 	// First, let's check if the source is an actual zip file
 	fileInfo, err := os.Stat(source)
 	if err != nil {
-		return fmt.Errorf("failed to access source file: %w", err)
+		return stats, fmt.Errorf("failed to access source file: %w", err)
 	}
 
 	if fileInfo.Size() == 0 {
-		return fmt.Errorf("source file is empty (0 bytes)")
+		return stats, fmt.Errorf("source file is empty (0 bytes)")
 	}
 
 	// Read the first few bytes to check the ZIP signature
 	file, err := os.Open(source)
 	if err != nil {
-		return fmt.Errorf("failed to open source file: %w", err)
+		return stats, fmt.Errorf("failed to open source file: %w", err)
 	}
 
 	header := make([]byte, 4)
@@ -136,72 +338,114 @@ func Unzip(source, target string) error {
 	file.Close() // Close the file immediately after reading header
 
 	if err != nil {
-		return fmt.Errorf("failed to read file header: %w", err)
+		return stats, fmt.Errorf("failed to read file header: %w", err)
 	}
 
 	if string(header) != "PK\x03\x04" {
-		return fmt.Errorf("not a valid zip file, missing PK header signature. Found: %x", header)
+		return stats, fmt.Errorf("not a valid zip file, missing PK header signature. Found: %x", header)
 	}
 
 	// Now open with the zip reader
 	zipReader, err := zip.OpenReader(source)
 	if err != nil {
-		return fmt.Errorf("failed to open zip file: %w", err)
+		return stats, fmt.Errorf("failed to open zip file: %w", err)
 	}
 	defer zipReader.Close()
 
+	if limits.MaxFiles > 0 && len(zipReader.File) > limits.MaxFiles {
+		return stats, fmt.Errorf("%w: %d entries, at most %d allowed", errUnzipLimit, len(zipReader.File), limits.MaxFiles)
+	}
+	var totalSize uint64
+	for _, file := range zipReader.File {
+		if limits.MaxFileSize > 0 && file.UncompressedSize64 > uint64(limits.MaxFileSize) {
+			return stats, fmt.Errorf("%w: %s is %d bytes, at most %d allowed", errUnzipLimit, file.Name, file.UncompressedSize64, limits.MaxFileSize)
+		}
+		totalSize += file.UncompressedSize64
+		if limits.MaxTotalSize > 0 && totalSize > uint64(limits.MaxTotalSize) {
+			return stats, fmt.Errorf("%w: more than %d bytes in total", errUnzipLimit, limits.MaxTotalSize)
+		}
+	}
+
+	// Conflicts that fail extraction fail it before anything is written
+	var paths []string
+	for _, file := range zipReader.File {
+		if filePath, err := SafeJoin(target, file.Name); err == nil && !file.FileInfo().IsDir() {
+			paths = append(paths, filePath)
+		}
+	}
+	if err := conflicts.Check(paths); err != nil {
+		return stats, err
+	}
+
 	// Create target directory if it doesn't exist
 	if err := os.MkdirAll(target, os.ModePerm); err != nil {
-		return fmt.Errorf("failed to create target directory: %w", err)
+		return stats, fmt.Errorf("failed to create target directory: %w", err)
 	}
 
 	// Extract files
 	for _, file := range zipReader.File {
-		// Construct the full path for the file
-		filePath := filepath.Join(target, file.Name)
-
-		// Check for ZipSlip vulnerability
-		if !strings.HasPrefix(filePath, filepath.Clean(target)+string(os.PathSeparator)) {
-			return fmt.Errorf("illegal file path: %s", filePath)
+		// Construct the full path for the file, checking for ZipSlip
+		filePath, err := SafeJoin(target, file.Name)
+		if err != nil {
+			return stats, err
 		}
 
 		// Create directory tree
 		if file.FileInfo().IsDir() {
 			if err := os.MkdirAll(filePath, os.ModePerm); err != nil {
-				return fmt.Errorf("failed to create directory: %w", err)
+				return stats, fmt.Errorf("failed to create directory: %w", err)
 			}
 			continue
 		}
 
 		// Create directory path if needed
 		if err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm); err != nil {
-			return fmt.Errorf("failed to create directory: %w", err)
+			return stats, fmt.Errorf("failed to create directory: %w", err)
+		}
+
+		filePath, err = conflicts.Resolve(filePath)
+		if err != nil {
+			return stats, err
+		}
+		if filePath == "" {
+			continue
 		}
 
 		// Open the file in the zip
 		fileInArchive, err := file.Open()
 		if err != nil {
-			return fmt.Errorf("failed to open file in archive: %w", err)
+			return stats, fmt.Errorf("failed to open file in archive: %w", err)
 		}
 
-		// Create the destination file
-		destFile, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, file.Mode())
+		// Create the destination file, without any setuid, setgid or
+		// sticky bits the archive asks for
+		destFile, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, file.Mode().Perm())
 		if err != nil {
 			fileInArchive.Close()
-			return fmt.Errorf("failed to create destination file: %w", err)
+			return stats, fmt.Errorf("failed to create destination file: %w", err)
 		}
 
-		// Copy the contents
-		_, err = io.Copy(destFile, fileInArchive)
+		// Copy the contents, never more than the entry declares
+		n, err := io.Copy(destFile, io.LimitReader(fileInArchive, int64(file.UncompressedSize64)))
+		stats.Files++
+		stats.Bytes += n
+		if err == nil {
+			// Reading on to the end also checks the entry's CRC
+			if n, extra := io.ReadFull(fileInArchive, make([]byte, 1)); n > 0 {
+				err = fmt.Errorf("%w: %s is larger than its header declares", errUnzipLimit, file.Name)
+			} else if extra != io.EOF {
+				err = extra
+			}
+		}
 		destFile.Close()
 		fileInArchive.Close()
 
 		if err != nil {
-			return fmt.Errorf("failed to extract file: %w", err)
+			return stats, fmt.Errorf("failed to extract file: %w", err)
 		}
 	}
 
-	return nil
+	return stats, nil
 }
 
 // IsValidZipFile checks if the given file is a valid ZIP archive
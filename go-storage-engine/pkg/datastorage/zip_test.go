@@ -0,0 +1,317 @@
+package datastorage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeTree creates a fixture directory of files of known sizes, and
+// returns its stats.
+func writeTree(t *testing.T, dir string, skip string) TreeStats {
+	t.Helper()
+	var stats TreeStats
+	for name, size := range map[string]int{
+		"readme.txt":          1_200,
+		"empty":               0,
+		"src/main.go":         30_000,
+		"src/lib/util.go":     8_000,
+		"assets/img/logo.png": 120_000,
+	} {
+		if name == skip {
+			continue
+		}
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, randomBytes(t, size), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		stats.Files++
+		stats.Bytes += int64(size)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "emptydir"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return stats
+}
+
+// storeTree stores a zip archive of dir the way store does a directory,
+// zipping it through a pipe straight into the store, and records want as
+// its tree stats.
+func (v *testVault) storeTree(t *testing.T, dir string, want TreeStats) string {
+	t.Helper()
+	_, metadatafile, err := v.storeTreeThroughPipe(dir, nil)
+	if err != nil {
+		t.Fatalf("storing %s: %v", dir, err)
+	}
+	if err := SetTreeStats(metadatafile, want); err != nil {
+		t.Fatalf("SetTreeStats: %v", err)
+	}
+	return metadatafile
+}
+
+// storeTreeThroughPipe zips dir into a pipe the store reads from, as the
+// store command does, filling in stats if set.
+func (v *testVault) storeTreeThroughPipe(dir string, stats *TreeStats) (string, string, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(ZipDirectoryToWriter(dir, pw, ZipOptions{Stats: stats}))
+	}()
+	dataID, metadatafile, err := StoreReader(pr, -1, v.store, v.cfg, v.locations, v.logger, "tree.zip")
+	pr.CloseWithError(err)
+	return dataID, metadatafile, err
+}
+
+// extractTree retrieves a stored archive and extracts it.
+func (v *testVault) extractTree(t *testing.T, metadatafile string) TreeStats {
+	t.Helper()
+	archive := filepath.Join(t.TempDir(), "tree.zip")
+	file, err := os.Create(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RetrieveTo(metadatafile, file, v.store, v.cfg, v.logger); err != nil {
+		t.Fatalf("RetrieveTo: %v", err)
+	}
+	file.Close()
+	extracted, err := UnzipWithLimits(archive, filepath.Join(t.TempDir(), "tree"), DefaultUnzipLimits)
+	if err != nil {
+		t.Fatalf("UnzipWithLimits: %v", err)
+	}
+	return extracted
+}
+
+func TestDirectoryStoreRecordsTreeSize(t *testing.T) {
+	v := newTestVault(t)
+	dir := t.TempDir()
+	want := writeTree(t, dir, "")
+
+	var archive bytes.Buffer
+	var stats TreeStats
+	if err := ZipDirectoryToWriter(dir, &archive, ZipOptions{Stats: &stats}); err != nil {
+		t.Fatalf("ZipDirectoryToWriter: %v", err)
+	}
+	if stats != want {
+		t.Fatalf("zipping counted %+v, expected %+v", stats, want)
+	}
+	metadatafile := v.storeTree(t, dir, stats)
+
+	// filesize stays the archive's size; the tree and the shards have their own
+	objects, err := ListObjects(v.cfg.MetadataDir)
+	if err != nil || len(objects) != 1 {
+		t.Fatalf("ListObjects: %d objects, %v", len(objects), err)
+	}
+	if object := objects[0]; object.Tree == nil || *object.Tree != want || object.Size == want.Bytes {
+		t.Fatalf("listed size %d, tree %+v, expected tree %+v", object.Size, object.Tree, want)
+	}
+	e, err := ExplainObject(metadatafile)
+	if err != nil {
+		t.Fatalf("ExplainObject: %v", err)
+	}
+	if e.Tree == nil || *e.Tree != want || e.StoredSize <= e.Size {
+		t.Fatalf("explained size %d, stored %d, tree %+v", e.Size, e.StoredSize, e.Tree)
+	}
+
+	extracted := v.extractTree(t, metadatafile)
+	if err := CompareTree(want, extracted); err != nil {
+		t.Fatalf("CompareTree: %v", err)
+	}
+}
+
+// TestStoreDirectoryThroughPipe stores a directory zipped straight into
+// the streaming store, with no temporary archive written, and extracts it
+// back to the same files. A directory that can't be zipped fails the store.
+func TestStoreDirectoryThroughPipe(t *testing.T) {
+	v := newTestVault(t)
+	dir := t.TempDir()
+	want := writeTree(t, dir, "")
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+
+	var stats TreeStats
+	_, metadatafile, err := v.storeTreeThroughPipe(dir, &stats)
+	if err != nil {
+		t.Fatalf("storing through a pipe: %v", err)
+	}
+	if stats != want {
+		t.Fatalf("zipping counted %+v, expected %+v", stats, want)
+	}
+	if layout := readLayout(metadatafile); layout != layoutStreaming {
+		t.Fatalf("directory stored %s, expected it streamed", layout)
+	}
+	if entries, err := os.ReadDir(tmp); err != nil || len(entries) != 0 {
+		t.Fatalf("storing left %d entries in the temporary directory, %v", len(entries), err)
+	}
+
+	var archive bytes.Buffer
+	if _, err := RetrieveTo(metadatafile, &archive, v.store, v.cfg, v.logger); err != nil {
+		t.Fatal(err)
+	}
+	zipFile := filepath.Join(t.TempDir(), "tree.zip")
+	if err := os.WriteFile(zipFile, archive.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	target := filepath.Join(t.TempDir(), "tree")
+	if _, err := UnzipWithLimits(zipFile, target, DefaultUnzipLimits); err != nil {
+		t.Fatal(err)
+	}
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		info, err := os.Stat(filepath.Join(target, rel))
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if !info.IsDir() {
+				t.Errorf("%s extracted as a file", rel)
+			}
+			return nil
+		}
+		original, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		extracted, err := os.ReadFile(filepath.Join(target, rel))
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(original, extracted) {
+			t.Errorf("%s extracted as %d bytes that differ from the %d stored", rel, len(extracted), len(original))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := v.storeTreeThroughPipe(filepath.Join(dir, "missing"), nil); err == nil {
+		t.Fatal("stored a directory that doesn't exist")
+	}
+}
+
+func TestIncompleteExtractionIsReported(t *testing.T) {
+	v := newTestVault(t)
+	// The archive lost a file the recorded tree has
+	want := writeTree(t, t.TempDir(), "")
+	partial := t.TempDir()
+	writeTree(t, partial, "src/lib/util.go")
+	metadatafile := v.storeTree(t, partial, want)
+
+	extracted := v.extractTree(t, metadatafile)
+	if extracted.Files != want.Files-1 || extracted.Bytes != want.Bytes-8_000 {
+		t.Fatalf("extracted %+v of %+v", extracted, want)
+	}
+	if err := CompareTree(want, extracted); !errors.Is(err, ErrTreeMismatch) {
+		t.Fatalf("CompareTree of an incomplete tree: %v", err)
+	}
+
+	// Objects stored without tree stats have none
+	other := v.storeObject(t, "file.bin", randomBytes(t, 100))
+	if tree, err := ReadTreeStats(other); err != nil || tree != nil {
+		t.Fatalf("ReadTreeStats of a file: %+v, %v", tree, err)
+	}
+}
+
+// TestExtractIntoExistingDirectory extracts an archive into a directory
+// holding an old tree, refusing by default, merging the trees with
+// ExtractMerge and replacing the old one with ExtractReplace.
+func TestExtractIntoExistingDirectory(t *testing.T) {
+	source := t.TempDir()
+	writeTree(t, source, "")
+	archive := filepath.Join(t.TempDir(), "tree.zip")
+	if err := ZipDirectory(source, archive); err != nil {
+		t.Fatal(err)
+	}
+	existing := func(t *testing.T) string {
+		target := filepath.Join(t.TempDir(), "tree")
+		if err := os.MkdirAll(target, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(target, "old.txt"), []byte("old"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return target
+	}
+	for _, tc := range []struct {
+		name   string
+		mode   ExtractMode
+		err    error
+		keeps  bool // old.txt is still there
+		merged bool // and the archive was extracted next to it
+	}{
+		{"refuse", ExtractRefuse, ErrExtractTargetExists, true, false},
+		{"merge", ExtractMerge, nil, true, true},
+		{"replace", ExtractReplace, nil, false, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			target := existing(t)
+			err := PrepareExtractTarget(target, tc.mode)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("PrepareExtractTarget: %v, expected %v", err, tc.err)
+			}
+			if err == nil {
+				if _, err := UnzipWithLimits(archive, target, DefaultUnzipLimits); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err := os.Stat(filepath.Join(target, "old.txt")); (err == nil) != tc.keeps {
+				t.Fatalf("old.txt kept %t, expected %t: %v", err == nil, tc.keeps, err)
+			}
+			if _, err := os.Stat(filepath.Join(target, "src", "main.go")); (err == nil) != tc.merged {
+				t.Fatalf("archive extracted %t, expected %t: %v", err == nil, tc.merged, err)
+			}
+		})
+	}
+
+	// Missing and empty targets are extracted into whatever the mode
+	empty := filepath.Join(t.TempDir(), "empty")
+	if err := os.Mkdir(empty, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range []string{filepath.Join(t.TempDir(), "missing"), empty} {
+		if err := PrepareExtractTarget(target, ExtractRefuse); err != nil {
+			t.Fatalf("PrepareExtractTarget(%s): %v", target, err)
+		}
+	}
+}
+
+// TestExtractReplaceSparesWorkingDirectory checks that ExtractReplace
+// never removes the working directory or a directory holding it.
+func TestExtractReplaceSparesWorkingDirectory(t *testing.T) {
+	target := t.TempDir()
+	wd := filepath.Join(target, "work")
+	if err := os.Mkdir(wd, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(wd, "notes.txt"), []byte("notes"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	previous, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(wd); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(previous)
+	for _, dir := range []string{target, wd, "."} {
+		if err := PrepareExtractTarget(dir, ExtractReplace); err == nil {
+			t.Fatalf("replaced %s, which holds the working directory", dir)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(wd, "notes.txt")); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,275 @@
+package datastorage
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// ZipProgressSuffix is added to the name of an archive ZipDirectoryResumable
+// writes to name the file recording its progress.
+const ZipProgressSuffix = ".progress"
+
+// Progress is recorded once an interrupted run would otherwise lose this
+// much archive, or this many entries, whichever comes first. Every record
+// syncs the archive to disk first, so recording after every entry would
+// make small files slow to archive.
+var (
+	zipCheckpointBytes   int64 = 32 << 20
+	zipCheckpointEntries       = 1000
+)
+
+// zipProgress is a line of a progress file: the first names the directory
+// archived, and every other an entry in the archive and where it ends.
+type zipProgress struct {
+	Source string          `json:"source,omitempty"`
+	Header *zip.FileHeader `json:"header,omitempty"`
+	End    int64           `json:"end,omitempty"`
+}
+
+// ZipDirectoryResumable is ZipDirectory for large trees: it records which
+// entries are in the archive so far in a file next to it, named with
+// ZipProgressSuffix, and when run again after being interrupted, by ctx or
+// a crash, it keeps those entries and only archives the rest. The progress
+// file is removed once the archive is complete. Files archived before the
+// interruption aren't read again, so changes made to them since don't make
+// it into the archive.
+//
+// A zip archive's central directory is only written once every entry is
+// in, so an interrupted archive has none: resuming cuts the archive back
+// to the last entry recorded and writes the central directory for the
+// entries already there along with the new ones. An archive whose progress
+// file is missing, names another directory or doesn't match it is started
+// again from scratch.
+func ZipDirectoryResumable(ctx context.Context, source, target string) error {
+	absSource, err := filepath.Abs(source)
+	if err != nil {
+		return fmt.Errorf("failed to get absolute path for source: %w", err)
+	}
+	absTarget, err := filepath.Abs(target)
+	if err != nil {
+		return fmt.Errorf("failed to get absolute path for target: %w", err)
+	}
+	progressPath := absTarget + ZipProgressSuffix
+
+	zipFile, err := os.OpenFile(absTarget, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create zip file: %w", err)
+	}
+	defer zipFile.Close()
+	entries, end := readZipProgress(progressPath, absSource)
+	if info, err := zipFile.Stat(); err != nil || info.Size() < end || !replayable(entries, end) {
+		entries, end = nil, 0
+	}
+	if err := zipFile.Truncate(end); err != nil {
+		return fmt.Errorf("failed to truncate zip file: %w", err)
+	}
+	if _, err := zipFile.Seek(end, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek zip file: %w", err)
+	}
+
+	// The progress file is written afresh with what it held that still
+	// stands, leaving out any line cut short by a crash
+	progress, err := os.Create(progressPath)
+	if err != nil {
+		return fmt.Errorf("failed to create progress file: %w", err)
+	}
+	defer progress.Close()
+	if err := appendZipProgress(progress, append([]zipProgress{{Source: absSource}}, entries...)); err != nil {
+		return err
+	}
+
+	// The entries already in the archive are replayed into the writer, for
+	// its central directory, without writing them again
+	out := &skipWriter{w: zipFile, skip: end}
+	zipWriter := zip.NewWriter(out)
+	skip := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		if err := replayZipEntry(zipWriter, entry.Header); err != nil {
+			return err
+		}
+		skip[entry.Header.Name] = true
+	}
+
+	var (
+		open     *zip.FileHeader // The entry being written
+		done     []zipProgress   // Complete entries not recorded yet
+		recorded = end
+	)
+	created := func(header *zip.FileHeader) error {
+		if err := zipWriter.Flush(); err != nil {
+			return fmt.Errorf("failed to write zip file: %w", err)
+		}
+		// The entry before this one ends where this one's local header starts
+		start := out.n - int64(localHeaderSize(header))
+		if open != nil {
+			done = append(done, zipProgress{Header: open, End: start})
+		}
+		open = header
+		if start-recorded < zipCheckpointBytes && len(done) < zipCheckpointEntries {
+			return nil
+		}
+		if err := zipFile.Sync(); err != nil {
+			return fmt.Errorf("failed to sync zip file: %w", err)
+		}
+		if err := appendZipProgress(progress, done); err != nil {
+			return err
+		}
+		done, recorded = nil, start
+		return nil
+	}
+	if err := writeZipEntries(ctx, absSource, zipWriter, ZipOptions{}, skip, created); err != nil {
+		// Entries complete when interrupted are kept, as far as they can be
+		if len(done) > 0 && zipFile.Sync() == nil {
+			appendZipProgress(progress, done)
+		}
+		return err
+	}
+	if err := zipWriter.Close(); err != nil {
+		return fmt.Errorf("failed to finalize zip archive: %w", err)
+	}
+	if err := zipFile.Close(); err != nil {
+		return fmt.Errorf("failed to finalize zip file: %w", err)
+	}
+
+	// Verify the created zip
+	zipReader, err := zip.OpenReader(absTarget)
+	if err != nil {
+		return fmt.Errorf("created zip file verification failed: %w", err)
+	}
+	zipReader.Close()
+	progress.Close()
+	if err := os.Remove(progressPath); err != nil {
+		return fmt.Errorf("failed to remove progress file: %w", err)
+	}
+	return nil
+}
+
+// localHeaderSize is the size of the local header archive/zip writes in
+// front of an entry: 30 bytes, the name and the extra fields.
+func localHeaderSize(header *zip.FileHeader) int {
+	return 30 + len(header.Name) + len(header.Extra)
+}
+
+// readZipProgress returns the entries a progress file records as in the
+// archive of absSource, and where the last of them ends; none if there is
+// no progress file or it is of another directory.
+func readZipProgress(path, absSource string) ([]zipProgress, int64) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, 0
+	}
+	defer file.Close()
+	var (
+		entries []zipProgress
+		end     int64
+	)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<20)
+	for n := 0; scanner.Scan(); n++ {
+		var line zipProgress
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			break // Cut short by a crash
+		}
+		if n == 0 {
+			if line.Source != absSource {
+				return nil, 0
+			}
+			continue
+		}
+		if line.Header == nil || line.End <= end {
+			return nil, 0
+		}
+		entries = append(entries, line)
+		end = line.End
+	}
+	return entries, end
+}
+
+// appendZipProgress records lines in a progress file and syncs it.
+func appendZipProgress(progress *os.File, lines []zipProgress) error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, line := range lines {
+		if err := encoder.Encode(line); err != nil {
+			return err
+		}
+	}
+	if _, err := progress.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("failed to write progress file: %w", err)
+	}
+	if err := progress.Sync(); err != nil {
+		return fmt.Errorf("failed to sync progress file: %w", err)
+	}
+	return nil
+}
+
+// resumeProbe is the name of the entry replayable creates after the
+// replayed ones, to see where they end.
+const resumeProbe = "resume-probe/"
+
+// replayable reports whether replaying entries into a zip.Writer takes it
+// to end, where they end in the archive, as resuming relies on. It does
+// unless the archive was written by a version of archive/zip that lays
+// entries out otherwise.
+func replayable(entries []zipProgress, end int64) bool {
+	if len(entries) == 0 {
+		return false
+	}
+	counter := &skipWriter{w: io.Discard}
+	zipWriter := zip.NewWriter(counter)
+	for _, entry := range entries {
+		header := *entry.Header
+		if replayZipEntry(zipWriter, &header) != nil {
+			return false
+		}
+	}
+	probe := &zip.FileHeader{Name: resumeProbe}
+	if _, err := zipWriter.CreateRaw(probe); err != nil || zipWriter.Flush() != nil {
+		return false
+	}
+	return counter.n-int64(localHeaderSize(probe)) == end
+}
+
+// replayZipEntry adds an entry already in the archive to zipWriter, with
+// zeros standing in for its data, which the writer's output skips.
+func replayZipEntry(zipWriter *zip.Writer, header *zip.FileHeader) error {
+	w, err := zipWriter.CreateRaw(header)
+	if err != nil {
+		return fmt.Errorf("failed to resume zip entry %s: %w", header.Name, err)
+	}
+	zeros := make([]byte, min(header.CompressedSize64, 32<<10))
+	for remaining := header.CompressedSize64; remaining > 0; {
+		n := min(remaining, uint64(len(zeros)))
+		if _, err := w.Write(zeros[:n]); err != nil {
+			return fmt.Errorf("failed to resume zip entry %s: %w", header.Name, err)
+		}
+		remaining -= n
+	}
+	return nil
+}
+
+// skipWriter drops the first skip bytes written to it, which are already
+// in w, and writes the rest to w. n counts every byte written to it.
+type skipWriter struct {
+	w    io.Writer
+	skip int64
+	n    int64
+}
+
+func (s *skipWriter) Write(p []byte) (int, error) {
+	drop := int(min(max(s.skip-s.n, 0), int64(len(p))))
+	if drop < len(p) {
+		if _, err := s.w.Write(p[drop:]); err != nil {
+			return drop, err
+		}
+	}
+	s.n += int64(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,130 @@
+package datastorage
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+// interruptingContext is cancelled once Err has been asked after entries
+// walked paths, as a store killed partway through zipping would be.
+type interruptingContext struct {
+	context.Context
+	entries atomic.Int64
+}
+
+func (c *interruptingContext) Err() error {
+	if c.entries.Add(-1) < 0 {
+		return context.Canceled
+	}
+	return nil
+}
+
+// readArchive returns the contents of the files in a zip archive by name.
+func readArchive(t *testing.T, path string) map[string][]byte {
+	t.Helper()
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		t.Fatalf("invalid archive: %v", err)
+	}
+	defer archive.Close()
+	files := make(map[string][]byte)
+	for _, file := range archive.File {
+		r, err := file.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(r) // Checks the CRC
+		r.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", file.Name, err)
+		}
+		files[file.Name] = data
+	}
+	return files
+}
+
+func TestZipDirectoryResumes(t *testing.T) {
+	defer func(bytes int64, entries int) { zipCheckpointBytes, zipCheckpointEntries = bytes, entries }(zipCheckpointBytes, zipCheckpointEntries)
+	zipCheckpointBytes, zipCheckpointEntries = 1<<30, 2
+
+	dir := t.TempDir()
+	writeTree(t, dir, "")
+	for i := range 20 {
+		path := filepath.Join(dir, "many", string(rune('a'+i))+".bin")
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, randomBytes(t, 5_000*i), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	whole := filepath.Join(t.TempDir(), "whole.zip")
+	if err := ZipDirectory(dir, whole); err != nil {
+		t.Fatal(err)
+	}
+	want := readArchive(t, whole)
+
+	target := filepath.Join(t.TempDir(), "tree.zip")
+	for _, after := range []int64{3, 9, 17} {
+		ctx := &interruptingContext{Context: context.Background()}
+		ctx.entries.Store(after)
+		if err := ZipDirectoryResumable(ctx, dir, target); !errors.Is(err, context.Canceled) {
+			t.Fatalf("interrupted after %d entries: %v", after, err)
+		}
+		if _, err := os.Stat(target + ZipProgressSuffix); err != nil {
+			t.Fatalf("no progress recorded: %v", err)
+		}
+	}
+	// A crash leaves part of an entry past the last one recorded
+	file, err := os.OpenFile(target, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write(bytes.Repeat([]byte{0xff}, 1000))
+	file.Close()
+	before, err := os.Stat(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	absDir, _ := filepath.Abs(dir)
+	if entries, end := readZipProgress(target+ZipProgressSuffix, absDir); !replayable(entries, end) {
+		t.Fatalf("%d recorded entries ending at %d can't be resumed from", len(entries), end)
+	}
+
+	if err := ZipDirectoryResumable(context.Background(), dir, target); err != nil {
+		t.Fatalf("resuming: %v", err)
+	}
+	got := readArchive(t, target)
+	if len(got) != len(want) {
+		t.Fatalf("resumed archive has %d entries, expected %d", len(got), len(want))
+	}
+	for name, data := range want {
+		if !bytes.Equal(got[name], data) {
+			t.Fatalf("%s differs in the resumed archive", name)
+		}
+	}
+	if _, err := os.Stat(target + ZipProgressSuffix); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("progress file left behind: %v", err)
+	}
+	if whole, err := os.Stat(whole); err != nil || before.Size() < whole.Size()/4 {
+		t.Fatalf("interrupted runs archived %d bytes, less than a quarter of the tree", before.Size())
+	}
+
+	// Without progress to resume from, the archive is started again
+	if err := os.WriteFile(target, []byte("not a zip archive"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ZipDirectoryResumable(context.Background(), dir, target); err != nil {
+		t.Fatal(err)
+	}
+	if got := readArchive(t, target); len(got) != len(want) {
+		t.Fatalf("archive started again has %d entries, expected %d", len(got), len(want))
+	}
+}
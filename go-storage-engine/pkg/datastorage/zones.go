@@ -0,0 +1,58 @@
+package datastorage
+
+import (
+	"go.uber.org/zap"
+
+	"github.com/techninja8/getvault.io/pkg/config"
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+// CheckPlacementZones checks that the locations picked for a new object,
+// shard i going to locations[i], survive the loss of any one zone: that no
+// zone holds more than parity of them. Per ZONE_PLACEMENT a placement that
+// doesn't fails the store or is only warned about. Without zone labels
+// there is nothing to check.
+func CheckPlacementZones(locations []string, zones map[string]string, parity int, cfg *config.Config, logger *zap.Logger) error {
+	if len(zones) == 0 {
+		return nil
+	}
+	check := PlacementZones(locations, zones, parity)
+	if check.OK() {
+		return nil
+	}
+	if cfg.ZonePlacement == config.ZonePlacementError {
+		return check.Err()
+	}
+	logger.Warn("Object won't survive the loss of a zone", zap.Error(check.Err()), zap.Any("zoneShards", check.Shards))
+	return nil
+}
+
+// PlacementZones checks how shards placed on locations, shard i on
+// locations[i], are spread over the zones of those locations.
+func PlacementZones(locations []string, zones map[string]string, parity int) sharding.ZoneCheck {
+	placed := make([]string, len(locations))
+	for i, location := range locations {
+		placed[i] = zones[location]
+	}
+	return sharding.CheckZones(placed, parity)
+}
+
+// CheckObjectZones checks how the shards of a stored object are spread
+// over the zones its locations are labelled with now. Shards on locations
+// without a label, like those of objects stored before zones were labelled,
+// are counted as unlabeled.
+func CheckObjectZones(metadatafile string, zones map[string]string) (sharding.ZoneCheck, error) {
+	candidates, err := readShardCandidates(metadatafile)
+	if err != nil {
+		return sharding.ZoneCheck{}, err
+	}
+	code, err := ObjectCode(metadatafile)
+	if err != nil {
+		return sharding.ZoneCheck{}, err
+	}
+	placed := make([]string, len(candidates))
+	for i, locations := range candidates {
+		placed[i] = zones[locations[0]]
+	}
+	return sharding.CheckZones(placed, code.Parity), nil
+}
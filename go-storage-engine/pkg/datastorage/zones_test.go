@@ -0,0 +1,106 @@
+package datastorage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/techninja8/getvault.io/pkg/config"
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+// writeZoneConfig writes a storage location configuration labelling each
+// location with zone(i), leaving it unlabelled where that is "".
+func writeZoneConfig(t *testing.T, locations []string, zone func(i int) string) string {
+	t.Helper()
+	entries := make([]config.StorageLocation, len(locations))
+	for i, location := range locations {
+		entries[i] = config.StorageLocation{Path: location}
+		if z := zone(i); z != "" {
+			entries[i].Labels = map[string]string{sharding.ZoneLabel: z}
+		}
+	}
+	data, err := json.Marshal(map[string]any{"locations": entries})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "locations.config")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestZonePlacement(t *testing.T) {
+	// The default code of 8+6 shards survives losing 6 of them
+	for _, tc := range []struct {
+		name        string
+		zones       int
+		satisfiable bool
+	}{
+		{"3 zones", 3, true},
+		{"2 zones", 2, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			v := newTestVault(t)
+			file := writeZoneConfig(t, v.locations, func(i int) string { return fmt.Sprintf("zone%d", i%tc.zones) })
+			zones, err := ReadLocationZones(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(zones) != len(v.locations) {
+				t.Fatalf("read %d zone labels of %d locations", len(zones), len(v.locations))
+			}
+			tracker := sharding.NewHealthTracker(v.cfg.HealthFile)
+			locations, err := tracker.PlaceInZones(v.locations, zones, len(v.locations))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			v.cfg.ZonePlacement = config.ZonePlacementWarn
+			if err := CheckPlacementZones(locations, zones, 6, v.cfg, v.logger); err != nil {
+				t.Fatalf("warned placement failed: %v", err)
+			}
+			v.cfg.ZonePlacement = config.ZonePlacementError
+			err = CheckPlacementZones(locations, zones, 6, v.cfg, v.logger)
+			if tc.satisfiable != (err == nil) || err != nil && !errors.Is(err, sharding.ErrZonePlacement) {
+				t.Fatalf("enforced placement: %v", err)
+			}
+
+			v.locations = locations
+			check, err := CheckObjectZones(v.storeObject(t, "object", randomBytes(t, 10_000)), zones)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if check.OK() != tc.satisfiable || check.Unlabeled != 0 || len(check.Shards) != tc.zones {
+				t.Fatalf("stored object placed %v: OK %t", check.Shards, check.OK())
+			}
+		})
+	}
+}
+
+func TestObjectZonesFlagsUnlabeledLocations(t *testing.T) {
+	v := newTestVault(t)
+	metadatafile := v.storeObject(t, "object", randomBytes(t, 10_000))
+	// Labels added since the object was stored, missing some locations
+	file := writeZoneConfig(t, v.locations, func(i int) string {
+		if i < 4 {
+			return ""
+		}
+		return fmt.Sprintf("zone%d", i%3)
+	})
+	zones, err := ReadLocationZones(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check, err := CheckObjectZones(metadatafile, zones)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if check.Unlabeled != 4 || check.OK() || !errors.Is(check.Err(), sharding.ErrZonePlacement) {
+		t.Fatalf("shards on unlabelled locations not flagged: %+v", check)
+	}
+}
@@ -0,0 +1,22 @@
+package encryption
+
+import "crypto/sha256"
+
+// convergentKeyInfo is the HKDF info convergent keys are derived with.
+const convergentKeyInfo = "vault convergent key"
+
+// ConvergentKey derives a data key from the data it encrypts: HKDF-SHA256
+// of the data's SHA-256. The same data always gets the same key, whoever
+// encrypts it, so with AppendEncryptDeterministic it always gives the same
+// cipher text and copies stored by people who don't share keys can be
+// shared.
+//
+// That is also what makes it weak. Anyone who holds a file can derive its
+// key, so they can tell whether a cipher text is that file, and guess the
+// rest of a file they know most of, such as a form letter with a PIN in
+// it, by trying each value. Cipher texts also show which of them hold the
+// same data. Only use it for data whose existence isn't secret.
+func ConvergentKey(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return hkdf(sum[:], nil, []byte(convergentKeyInfo), 32)
+}
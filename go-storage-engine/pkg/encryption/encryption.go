@@ -4,24 +4,59 @@ import (
 	//"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
+	"errors"
 	"io"
+	"slices"
 )
 
+var errShortCipherText = errors.New("cipher text shorter than the IV")
+
 // Encrypt encrypts the given data using AES in CFB mode.
 func Encrypt(data, key []byte) ([]byte, error) {
+	return AppendEncrypt(nil, data, key)
+}
+
+// AppendEncrypt is Encrypt appending the IV and cipher text to dst, so
+// callers can encrypt into a buffer they reuse.
+func AppendEncrypt(dst, data, key []byte) ([]byte, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
 	}
-	cipherText := make([]byte, aes.BlockSize+len(data))
+	dst = slices.Grow(dst, aes.BlockSize+len(data))
+	cipherText := dst[len(dst) : len(dst)+aes.BlockSize+len(data)]
 	iv := cipherText[:aes.BlockSize]
 	if _, err = io.ReadFull(rand.Reader, iv); err != nil {
 		return nil, err
 	}
 	stream := cipher.NewCFBEncrypter(block, iv)
 	stream.XORKeyStream(cipherText[aes.BlockSize:], data)
-	return cipherText, nil
+	return dst[:len(dst)+len(cipherText)], nil
+}
+
+// AppendEncryptDeterministic is AppendEncrypt with the IV derived from
+// the data, as the HMAC-SHA256 of it under the key, instead of drawn at
+// random. The same data under the same key always gives the same cipher
+// text, so stored copies can be shared, at the cost of revealing to anyone
+// holding cipher texts which of them hold the same data. Decrypt reads
+// either kind.
+func AppendEncryptDeterministic(dst, data, key []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	dst = slices.Grow(dst, aes.BlockSize+len(data))
+	cipherText := dst[len(dst) : len(dst)+aes.BlockSize+len(data)]
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	iv := cipherText[:aes.BlockSize]
+	copy(iv, mac.Sum(nil))
+	stream := cipher.NewCFBEncrypter(block, iv)
+	stream.XORKeyStream(cipherText[aes.BlockSize:], data)
+	return dst[:len(dst)+len(cipherText)], nil
 }
 
 // Decrypt decrypts the given cipherText using AES in CFB mode.
@@ -31,7 +66,7 @@ func Decrypt(cipherText, key []byte) ([]byte, error) {
 		return nil, err
 	}
 	if len(cipherText) < aes.BlockSize {
-		return nil, err
+		return nil, errShortCipherText
 	}
 	iv := cipherText[:aes.BlockSize]
 	cipherText = cipherText[aes.BlockSize:]
@@ -41,3 +76,120 @@ func Decrypt(cipherText, key []byte) ([]byte, error) {
 
 	return cipherText, nil
 }
+
+// streamChunk is how much an EncryptWriter or a DecryptWriter encrypts
+// or decrypts at a time.
+const streamChunk = 32 << 10
+
+// EncryptWriter encrypts what is written to it as Encrypt would and writes
+// the IV and cipher text on. Like DecryptWriter, it encrypts through a
+// small buffer of its own, so neither the plaintext nor the cipher text is
+// ever held whole. The IV is written with the first write, or by Close if
+// nothing was written.
+type EncryptWriter struct {
+	w      io.Writer
+	block  cipher.Block
+	stream cipher.Stream
+	buf    []byte
+}
+
+// NewEncryptWriter returns an EncryptWriter writing cipher text to w,
+// under an IV drawn at random.
+func NewEncryptWriter(w io.Writer, key []byte) (*EncryptWriter, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptWriter{w: w, block: block}, nil
+}
+
+// start writes the IV and sets up the stream, once.
+func (e *EncryptWriter) start() error {
+	if e.stream != nil {
+		return nil
+	}
+	iv := make([]byte, aes.BlockSize)
+	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+		return err
+	}
+	if _, err := e.w.Write(iv); err != nil {
+		return err
+	}
+	e.stream = cipher.NewCFBEncrypter(e.block, iv)
+	e.buf = make([]byte, streamChunk)
+	return nil
+}
+
+func (e *EncryptWriter) Write(p []byte) (int, error) {
+	if err := e.start(); err != nil {
+		return 0, err
+	}
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), len(e.buf))
+		e.stream.XORKeyStream(e.buf[:n], p[:n])
+		if _, err := e.w.Write(e.buf[:n]); err != nil {
+			return written, err
+		}
+		p, written = p[n:], written+n
+	}
+	return written, nil
+}
+
+// Close writes the IV if nothing was written, as Encrypt gives an IV
+// alone for no plaintext. It doesn't close the underlying writer.
+func (e *EncryptWriter) Close() error {
+	return e.start()
+}
+
+// DecryptWriter decrypts what Decrypt would as it is written, IV first,
+// and writes the plaintext on. It decrypts through a small buffer of its
+// own, so neither the cipher text nor the plaintext is ever held whole.
+type DecryptWriter struct {
+	w      io.Writer
+	block  cipher.Block
+	iv     []byte
+	stream cipher.Stream
+	buf    []byte
+}
+
+// NewDecryptWriter returns a DecryptWriter writing plaintext to w.
+func NewDecryptWriter(w io.Writer, key []byte) (*DecryptWriter, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &DecryptWriter{w: w, block: block, iv: make([]byte, 0, aes.BlockSize)}, nil
+}
+
+func (d *DecryptWriter) Write(p []byte) (int, error) {
+	written := 0
+	if d.stream == nil {
+		n := min(len(p), aes.BlockSize-len(d.iv))
+		d.iv = append(d.iv, p[:n]...)
+		p, written = p[n:], n
+		if len(d.iv) < aes.BlockSize {
+			return written, nil
+		}
+		d.stream = cipher.NewCFBDecrypter(d.block, d.iv)
+		d.buf = make([]byte, streamChunk)
+	}
+	for len(p) > 0 {
+		n := min(len(p), len(d.buf))
+		d.stream.XORKeyStream(d.buf[:n], p[:n])
+		if _, err := d.w.Write(d.buf[:n]); err != nil {
+			return written, err
+		}
+		p, written = p[n:], written+n
+	}
+	return written, nil
+}
+
+// Close fails if less than an IV was written. It doesn't close the
+// underlying writer.
+func (d *DecryptWriter) Close() error {
+	if d.stream == nil {
+		return errShortCipherText
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/rand"
+	"errors"
+	"testing"
+)
+
+func TestDecryptWriterMatchesDecrypt(t *testing.T) {
+	key := make([]byte, 32)
+	plainText := make([]byte, 100_000)
+	for _, b := range [][]byte{key, plainText} {
+		if _, err := rand.Read(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cipherText, err := Encrypt(plainText, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Writes of every size, splitting the IV and crossing the chunk size
+	for _, step := range []int{1, 7, aes.BlockSize, 4096, streamChunk + 3, len(cipherText)} {
+		var out bytes.Buffer
+		w, err := NewDecryptWriter(&out, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for rest := cipherText; len(rest) > 0; {
+			n := min(step, len(rest))
+			if written, err := w.Write(rest[:n]); err != nil || written != n {
+				t.Fatalf("Write of %d bytes wrote %d: %v", n, written, err)
+			}
+			rest = rest[n:]
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out.Bytes(), plainText) {
+			t.Fatalf("writes of %d bytes decrypted to different plaintext", step)
+		}
+	}
+}
+
+func TestDecryptWriterRefusesShortCipherText(t *testing.T) {
+	w, err := NewDecryptWriter(&bytes.Buffer{}, make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); !errors.Is(err, errShortCipherText) {
+		t.Fatalf("Close returned %v, expected %v", err, errShortCipherText)
+	}
+}
+
+func TestEncryptWriterDecrypts(t *testing.T) {
+	key := make([]byte, 32)
+	plainText := make([]byte, 100_000)
+	for _, b := range [][]byte{key, plainText} {
+		if _, err := rand.Read(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, step := range []int{1, 7, 4096, streamChunk + 3, len(plainText)} {
+		var out bytes.Buffer
+		w, err := NewEncryptWriter(&out, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for rest := plainText; len(rest) > 0; {
+			n := min(step, len(rest))
+			if written, err := w.Write(rest[:n]); err != nil || written != n {
+				t.Fatalf("Write of %d bytes wrote %d: %v", n, written, err)
+			}
+			rest = rest[n:]
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if out.Len() != aes.BlockSize+len(plainText) {
+			t.Fatalf("writes of %d bytes encrypted to %d bytes", step, out.Len())
+		}
+		got, err := Decrypt(out.Bytes(), key)
+		if err != nil || !bytes.Equal(got, plainText) {
+			t.Fatalf("writes of %d bytes don't decrypt to the plaintext: %v", step, err)
+		}
+	}
+
+	// Nothing written still gives an IV, as Encrypt does
+	var out bytes.Buffer
+	w, err := NewEncryptWriter(&out, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil || out.Len() != aes.BlockSize {
+		t.Fatalf("Close wrote %d bytes: %v", out.Len(), err)
+	}
+}
@@ -0,0 +1,248 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	identityPrefix  = "VAULT-SECRET-KEY-"
+	recipientPrefix = "vault1"
+	stanzaType      = "x25519"
+	stanzaInfo      = "vault x25519 key wrap"
+)
+
+var (
+	ErrNoMatchingIdentity = errors.New("no recipient stanza matches the identity")
+
+	errInvalidIdentity  = errors.New("invalid identity")
+	errInvalidRecipient = errors.New("invalid recipient")
+	errInvalidStanza    = errors.New("invalid recipient stanza")
+	errInvalidWrap      = errors.New("invalid wrapped key")
+)
+
+var b64 = base64.RawStdEncoding
+
+// NewDataKey returns a random per-object data key.
+func NewDataKey() ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// WrapKey seals a data key under a key-encryption key with AES-GCM.
+func WrapKey(dataKey, kek []byte) (string, error) {
+	sealed, err := seal(dataKey, kek)
+	if err != nil {
+		return "", err
+	}
+	return b64.EncodeToString(sealed), nil
+}
+
+// UnwrapKey opens a data key sealed by WrapKey. A wrong key is reported
+// as an error rather than producing a garbage data key.
+func UnwrapKey(wrapped string, kek []byte) ([]byte, error) {
+	sealed, err := b64.DecodeString(wrapped)
+	if err != nil {
+		return nil, errInvalidWrap
+	}
+	return open(sealed, kek)
+}
+
+// GenerateIdentity creates a new X25519 identity.
+func GenerateIdentity() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().GenerateKey(rand.Reader)
+}
+
+// FormatIdentity encodes an identity for an identity file.
+func FormatIdentity(identity *ecdh.PrivateKey) string {
+	return identityPrefix + b64.EncodeToString(identity.Bytes())
+}
+
+// ParseIdentity decodes an identity written by FormatIdentity.
+func ParseIdentity(s string) (*ecdh.PrivateKey, error) {
+	encoded, ok := strings.CutPrefix(strings.TrimSpace(s), identityPrefix)
+	if !ok {
+		return nil, errInvalidIdentity
+	}
+	raw, err := b64.DecodeString(encoded)
+	if err != nil {
+		return nil, errInvalidIdentity
+	}
+	identity, err := ecdh.X25519().NewPrivateKey(raw)
+	if err != nil {
+		return nil, errInvalidIdentity
+	}
+	return identity, nil
+}
+
+// ParseIdentityFile reads the identities in an identity file, skipping
+// blank lines and # comments.
+func ParseIdentityFile(contents string) ([]*ecdh.PrivateKey, error) {
+	var identities []*ecdh.PrivateKey
+	for _, line := range strings.Split(contents, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		identity, err := ParseIdentity(line)
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, identity)
+	}
+	if len(identities) == 0 {
+		return nil, errInvalidIdentity
+	}
+	return identities, nil
+}
+
+// FormatRecipient encodes the public half of an identity.
+func FormatRecipient(recipient *ecdh.PublicKey) string {
+	return recipientPrefix + b64.EncodeToString(recipient.Bytes())
+}
+
+// ParseRecipient decodes a recipient written by FormatRecipient.
+func ParseRecipient(s string) (*ecdh.PublicKey, error) {
+	encoded, ok := strings.CutPrefix(strings.TrimSpace(s), recipientPrefix)
+	if !ok {
+		return nil, errInvalidRecipient
+	}
+	raw, err := b64.DecodeString(encoded)
+	if err != nil {
+		return nil, errInvalidRecipient
+	}
+	recipient, err := ecdh.X25519().NewPublicKey(raw)
+	if err != nil {
+		return nil, errInvalidRecipient
+	}
+	return recipient, nil
+}
+
+// WrapKeyForRecipient seals a data key to a recipient. An ephemeral X25519
+// key is agreed with the recipient and the shared secret, run through
+// HKDF-SHA256, seals the data key. The stanza is "x25519 <ephemeral> <sealed>".
+func WrapKeyForRecipient(dataKey []byte, recipient *ecdh.PublicKey) (string, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	kek, err := stanzaKey(ephemeral, recipient, ephemeral.PublicKey())
+	if err != nil {
+		return "", err
+	}
+	sealed, err := seal(dataKey, kek)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s %s %s", stanzaType, b64.EncodeToString(ephemeral.PublicKey().Bytes()), b64.EncodeToString(sealed)), nil
+}
+
+// UnwrapKeyWithIdentity opens a stanza written by WrapKeyForRecipient. It
+// returns ErrNoMatchingIdentity if the stanza was sealed to someone else.
+func UnwrapKeyWithIdentity(stanza string, identity *ecdh.PrivateKey) ([]byte, error) {
+	fields := strings.Fields(stanza)
+	if len(fields) != 3 || fields[0] != stanzaType {
+		return nil, errInvalidStanza
+	}
+	rawEphemeral, err := b64.DecodeString(fields[1])
+	if err != nil {
+		return nil, errInvalidStanza
+	}
+	ephemeral, err := ecdh.X25519().NewPublicKey(rawEphemeral)
+	if err != nil {
+		return nil, errInvalidStanza
+	}
+	sealed, err := b64.DecodeString(fields[2])
+	if err != nil {
+		return nil, errInvalidStanza
+	}
+
+	kek, err := stanzaKey(identity, ephemeral, ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := open(sealed, kek)
+	if err != nil {
+		return nil, ErrNoMatchingIdentity
+	}
+	return dataKey, nil
+}
+
+// stanzaKey derives the key sealing a stanza from the X25519 agreement
+// between private and peer, bound to the ephemeral and recipient keys.
+func stanzaKey(private *ecdh.PrivateKey, peer, ephemeral *ecdh.PublicKey) ([]byte, error) {
+	shared, err := private.ECDH(peer)
+	if err != nil {
+		return nil, err
+	}
+	recipient := private.PublicKey()
+	if private.PublicKey().Equal(ephemeral) {
+		recipient = peer
+	}
+	salt := append(append([]byte{}, ephemeral.Bytes()...), recipient.Bytes()...)
+	return hkdf(shared, salt, []byte(stanzaInfo), 32), nil
+}
+
+// hkdf is HKDF-SHA256 (RFC 5869).
+func hkdf(secret, salt, info []byte, length int) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(secret)
+	prk := extract.Sum(nil)
+
+	var out, block []byte
+	for counter := byte(1); len(out) < length; counter++ {
+		expand := hmac.New(sha256.New, prk)
+		expand.Write(block)
+		expand.Write(info)
+		expand.Write([]byte{counter})
+		block = expand.Sum(nil)
+		out = append(out, block...)
+	}
+	return out[:length]
+}
+
+// seal encrypts plainText with AES-GCM under key, prefixing the nonce.
+func seal(plainText, key []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plainText, nil), nil
+}
+
+// open reverses seal.
+func open(sealed, key []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errInvalidWrap
+	}
+	nonce, cipherText := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, cipherText, nil)
+}
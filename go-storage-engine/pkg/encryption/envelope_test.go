@@ -0,0 +1,106 @@
+package encryption
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestRecipientRoundTrip(t *testing.T) {
+	identity, err := GenerateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := GenerateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipient, err := ParseRecipient(FormatRecipient(identity.PublicKey()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataKey, err := NewDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stanza, err := WrapKeyForRecipient(dataKey, recipient)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := ParseIdentity(FormatIdentity(identity))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := UnwrapKeyWithIdentity(stanza, parsed); err != nil || !bytes.Equal(got, dataKey) {
+		t.Fatalf("unwrapped %x, %v", got, err)
+	}
+	if _, err := UnwrapKeyWithIdentity(stanza, other); !errors.Is(err, ErrNoMatchingIdentity) {
+		t.Fatalf("unwrapping with an unrelated identity returned %v", err)
+	}
+
+	// A stanza is sealed with a fresh ephemeral key every time
+	again, err := WrapKeyForRecipient(dataKey, recipient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again == stanza {
+		t.Fatal("wrapping the same key twice wrote the same stanza")
+	}
+}
+
+func TestParseIdentityFile(t *testing.T) {
+	first, err := GenerateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := GenerateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := "# vault identities\n" + FormatIdentity(first) + "\n\n  " + FormatIdentity(second) + "  \n"
+	identities, err := ParseIdentityFile(contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(identities) != 2 || !identities[0].Equal(first) || !identities[1].Equal(second) {
+		t.Fatalf("parsed %d identities, expected the 2 written", len(identities))
+	}
+
+	for _, contents := range []string{"", "# only a comment\n", FormatRecipient(first.PublicKey())} {
+		if _, err := ParseIdentityFile(contents); err == nil {
+			t.Fatalf("parsed identities from %q", contents)
+		}
+	}
+	if _, err := ParseRecipient(FormatIdentity(first)); err == nil {
+		t.Fatal("parsed an identity as a recipient")
+	}
+}
+
+func TestUnwrapRefusesMalformedStanzas(t *testing.T) {
+	identity, err := GenerateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataKey, err := NewDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stanza, err := WrapKeyForRecipient(dataKey, identity.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := strings.Fields(stanza)
+	for _, malformed := range []string{
+		"",
+		fields[0] + " " + fields[1],
+		"scrypt " + fields[1] + " " + fields[2],
+		fields[0] + " !!! " + fields[2],
+		fields[0] + " " + fields[1] + " !!!",
+	} {
+		if _, err := UnwrapKeyWithIdentity(malformed, identity); !errors.Is(err, errInvalidStanza) {
+			t.Fatalf("unwrapping %q returned %v, expected a malformed stanza", malformed, err)
+		}
+	}
+}
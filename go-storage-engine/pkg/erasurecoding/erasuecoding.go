@@ -1,19 +1,195 @@
 package erasurecoding
 
 import (
-	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
 
 	"github.com/klauspost/reedsolomon"
 )
 
+// DataShards and ParityShards are the shard counts of DefaultCode.
 var (
 	DataShards   = 8
 	ParityShards = 6
 )
 
-// Encode splits and encodes the data into shards.
+var errShardCount = errors.New("wrong number of shards")
+
+// ErrTooFewShards is returned when fewer shards than a code's data shards
+// are present, whichever those are: any Data of the Total shards decode,
+// parity shards alike.
+var ErrTooFewShards = reedsolomon.ErrTooFewShards
+
+// ErrShortData is returned when shards decode to less data than the length
+// recorded for them.
+var ErrShortData = errors.New("shards hold less data than recorded")
+
+// ErrParityMismatch is returned, by a code with VerifyOnEncode set, for
+// parity that doesn't verify against the data shards it was just computed
+// from.
+var ErrParityMismatch = errors.New("encoded parity doesn't match the data shards")
+
+// Field is the Galois field an erasure code works over. GF(2^8) codes are
+// limited to 256 shards in all; GF(2^16) codes take up to 65536, but need
+// shards a multiple of 64 bytes long. The two encode the same data to
+// different parity, so shards must be decoded over the field they were
+// encoded over.
+type Field string
+
+const (
+	// FieldAuto is GF(2^8) for up to 256 shards and GF(2^16) beyond.
+	FieldAuto Field = ""
+	FieldGF8  Field = "gf8"
+	FieldGF16 Field = "gf16"
+)
+
+// ErrUnknownField is returned for a field name that isn't gf8 or gf16.
+var ErrUnknownField = errors.New("unknown erasure coding field")
+
+// The most shards a code can have over each field.
+const (
+	maxGF8Shards  = 256
+	maxGF16Shards = 65536
+)
+
+// ParseField parses a field name; "" and "auto" are FieldAuto.
+func ParseField(name string) (Field, error) {
+	switch Field(name) {
+	case FieldAuto, "auto":
+		return FieldAuto, nil
+	case FieldGF8, FieldGF16:
+		return Field(name), nil
+	}
+	return "", fmt.Errorf("%w: %q", ErrUnknownField, name)
+}
+
+// Code is an erasure code: the number of data shards data is split into,
+// the number of parity shards added, which is how many shards can be lost,
+// and the field they are coded over.
+//
+// With VerifyOnEncode set, encoding checks the parity it computes against
+// the data shards before returning them, so shards that wouldn't
+// reconstruct, from a coding bug or a memory error, fail the store rather
+// than the retrieve. It costs about as much again as the encoding, and
+// doesn't change the shards, so codes differing only in VerifyOnEncode
+// decode each other's shards.
+type Code struct {
+	Data, Parity   int
+	Field          Field // Resolved by NewCode, never FieldAuto
+	VerifyOnEncode bool
+}
+
+// DefaultCode is the code of objects that record no shard counts:
+// DataShards and ParityShards over GF(2^8).
+func DefaultCode() Code {
+	return Code{Data: DataShards, Parity: ParityShards, Field: FieldGF8}
+}
+
+// NewCode returns the code with data and parity shards over field, with
+// FieldAuto resolved to GF(2^8) for up to 256 shards and GF(2^16) beyond.
+func NewCode(data, parity int, field Field) (Code, error) {
+	if data < 1 || parity < 0 {
+		return Code{}, fmt.Errorf("%w: %d data and %d parity shards", errShardCount, data, parity)
+	}
+	total := data + parity
+	switch field {
+	case FieldAuto:
+		field = FieldGF8
+		if total > maxGF8Shards {
+			field = FieldGF16
+		}
+	case FieldGF8:
+		if total > maxGF8Shards {
+			return Code{}, fmt.Errorf("gf8 codes have at most %d shards, not %d; use gf16", maxGF8Shards, total)
+		}
+	case FieldGF16:
+		if total > maxGF16Shards {
+			return Code{}, fmt.Errorf("gf16 codes have at most %d shards, not %d", maxGF16Shards, total)
+		}
+	default:
+		return Code{}, fmt.Errorf("%w: %q", ErrUnknownField, field)
+	}
+	return Code{Data: data, Parity: parity, Field: field}, nil
+}
+
+// Total returns the number of shards, data and parity.
+func (c Code) Total() int {
+	return c.Data + c.Parity
+}
+
+// String describes the code, e.g. "8+6 gf8".
+func (c Code) String() string {
+	return fmt.Sprintf("%d+%d %s", c.Data, c.Parity, c.Field)
+}
+
+var (
+	encodersMu sync.Mutex
+	encoders   = make(map[Code]reedsolomon.Encoder)
+)
+
+// encoder returns the Reed-Solomon encoder for the code. Encoders are safe
+// for concurrent use and costly to build, so each is built once, and
+// shared by codes differing only in VerifyOnEncode.
+func (c Code) encoder() (reedsolomon.Encoder, error) {
+	c.VerifyOnEncode = false
+	encodersMu.Lock()
+	defer encodersMu.Unlock()
+	if enc, ok := encoders[c]; ok {
+		return enc, nil
+	}
+	var opts []reedsolomon.Option
+	switch c.Field {
+	case FieldGF8:
+		if c.Total() > maxGF8Shards {
+			return nil, fmt.Errorf("gf8 codes have at most %d shards, not %d; use gf16", maxGF8Shards, c.Total())
+		}
+	case FieldGF16:
+		opts = append(opts, reedsolomon.WithLeopardGF16(true))
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownField, c.Field)
+	}
+	enc, err := reedsolomon.New(c.Data, c.Parity, opts...)
+	if err != nil {
+		return nil, err
+	}
+	encoders[c] = enc
+	return enc, nil
+}
+
+// ShardSetSize returns the bytes taken by all the shards of n bytes of
+// data under the default code. Encode splits data without allocating when
+// its capacity is at least this.
+func ShardSetSize(n int) int {
+	return DefaultCode().ShardSetSize(n)
+}
+
+// ShardSetSize is ShardSetSize under the code.
+func (c Code) ShardSetSize(n int) int {
+	return c.ShardSize(n) * c.Total()
+}
+
+// ShardSize returns the size of each shard of n bytes of data.
+func (c Code) ShardSize(n int) int {
+	perShard := (n + c.Data - 1) / c.Data
+	if c.Field == FieldGF16 {
+		perShard = (perShard + 63) / 64 * 64
+	}
+	return perShard
+}
+
+// Encode splits and encodes the data into shards under the default code.
+// The shards share data's backing array when its capacity allows, as with
+// a slice of ShardSetSize.
 func Encode(data []byte) ([][]byte, error) {
-	enc, err := reedsolomon.New(DataShards, ParityShards)
+	return DefaultCode().Encode(data)
+}
+
+// Encode is Encode under the code.
+func (c Code) Encode(data []byte) ([][]byte, error) {
+	enc, err := c.encoder()
 	if err != nil {
 		return nil, err
 	}
@@ -21,27 +197,159 @@ func Encode(data []byte) ([][]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	if err = enc.Encode(shards); err != nil {
+	if err = c.encode(enc, shards); err != nil {
 		return nil, err
 	}
 	return shards, nil
 }
 
-// Decode reconstructs the original data from shards.
+// encode computes the parity of shards with enc, the code's encoder, and
+// with VerifyOnEncode set checks it.
+func (c Code) encode(enc reedsolomon.Encoder, shards [][]byte) error {
+	if err := enc.Encode(shards); err != nil {
+		return err
+	}
+	if !c.VerifyOnEncode {
+		return nil
+	}
+	ok, err := enc.Verify(shards)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrParityMismatch, err)
+	}
+	if !ok {
+		return ErrParityMismatch
+	}
+	return nil
+}
+
+// Decode reconstructs the original data from shards under the default code.
 func Decode(shards [][]byte) ([]byte, error) {
-	enc, err := reedsolomon.New(DataShards, ParityShards)
+	return DefaultCode().AppendDecode(nil, shards)
+}
+
+// AppendDecode is Decode appending the data to dst, so callers can decode
+// into a buffer they reuse.
+func AppendDecode(dst []byte, shards [][]byte) ([]byte, error) {
+	return DefaultCode().AppendDecode(dst, shards)
+}
+
+// AppendDecode is AppendDecode under the code.
+func (c Code) AppendDecode(dst []byte, shards [][]byte) ([]byte, error) {
+	if err := c.checkShards(shards); err != nil {
+		return nil, err
+	}
+	enc, err := c.encoder()
 	if err != nil {
 		return nil, err
 	}
 	if err = enc.Reconstruct(shards); err != nil {
 		return nil, err
 	}
-	// Join shards back into a single byte slice.
-	var buf bytes.Buffer
-	if err = enc.Join(&buf, shards, len(shards[0])*DataShards); err != nil {
+	// Join the data shards back into a single byte slice.
+	dst = slices.Grow(dst, len(shards[0])*c.Data)
+	for _, shard := range shards[:c.Data] {
+		dst = append(dst, shard...)
+	}
+	return dst, nil
+}
+
+// AppendDecodeLength is AppendDecode keeping exactly length bytes of data,
+// which drops the zeros Encode pads the last data shard with. The length
+// must be the one recorded when the data was encoded: data can end in
+// zeros of its own, so padding can't be told from data by looking at it.
+func AppendDecodeLength(dst []byte, shards [][]byte, length int) ([]byte, error) {
+	return DefaultCode().AppendDecodeLength(dst, shards, length)
+}
+
+// AppendDecodeLength is AppendDecodeLength under the code.
+func (c Code) AppendDecodeLength(dst []byte, shards [][]byte, length int) ([]byte, error) {
+	start := len(dst)
+	dst, err := c.AppendDecode(dst, shards)
+	if err != nil {
 		return nil, err
 	}
-	//return bytes.Trim(buf.Bytes(), "\x00"), nil
+	if length < 0 || start+length > len(dst) {
+		return nil, fmt.Errorf("%w: %d bytes, expected %d", ErrShortData, len(dst)-start, length)
+	}
+	return dst[:start+length], nil
+}
+
+// DecodeTo writes exactly length bytes of the data the shards hold under
+// the default code to w. Unlike AppendDecodeLength it never joins the data
+// into a buffer of its own: only missing data shards are rebuilt, and the
+// data shards are written out of the shards as they are.
+func DecodeTo(w io.Writer, shards [][]byte, length int) error {
+	return DefaultCode().DecodeTo(w, shards, length)
+}
 
-	return buf.Bytes(), nil
+// DecodeTo is DecodeTo under the code.
+func (c Code) DecodeTo(w io.Writer, shards [][]byte, length int) error {
+	if err := c.checkShards(shards); err != nil {
+		return err
+	}
+	enc, err := c.encoder()
+	if err != nil {
+		return err
+	}
+	if err = enc.ReconstructData(shards); err != nil {
+		return err
+	}
+	if held := len(shards[0]) * c.Data; length < 0 || length > held {
+		return fmt.Errorf("%w: %d bytes, expected %d", ErrShortData, held, length)
+	}
+	return enc.Join(w, shards, length)
+}
+
+// Reconstruct fills in missing (nil) shards in place without joining them.
+func Reconstruct(shards [][]byte) error {
+	return DefaultCode().Reconstruct(shards)
+}
+
+// Reconstruct is Reconstruct under the code.
+func (c Code) Reconstruct(shards [][]byte) error {
+	if err := c.checkShards(shards); err != nil {
+		return err
+	}
+	enc, err := c.encoder()
+	if err != nil {
+		return err
+	}
+	return enc.Reconstruct(shards)
+}
+
+// checkShards fails unless shards has a slot for each shard of the code
+// and enough of them are present to decode. Missing shards are nil or
+// empty.
+func (c Code) checkShards(shards [][]byte) error {
+	if len(shards) != c.Total() {
+		return errShardCount
+	}
+	present := 0
+	for _, shard := range shards {
+		if len(shard) > 0 {
+			present++
+		}
+	}
+	if present < c.Data {
+		return fmt.Errorf("%w: %d of %d present, %d needed", ErrTooFewShards, present, c.Total(), c.Data)
+	}
+	return nil
+}
+
+// Verify reports whether the parity shards are consistent with the data
+// shards. Every shard must be present.
+func Verify(shards [][]byte) (bool, error) {
+	return DefaultCode().Verify(shards)
+}
+
+// Verify is Verify under the code.
+func (c Code) Verify(shards [][]byte) (bool, error) {
+	if len(shards) != c.Total() {
+		return false, errShardCount
+	}
+	enc, err := c.encoder()
+	if err != nil {
+		return false, err
+	}
+	return enc.Verify(shards)
 }
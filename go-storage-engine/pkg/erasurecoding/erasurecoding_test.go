@@ -0,0 +1,394 @@
+package erasurecoding
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"slices"
+	"testing"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+func TestNewCodeResolvesField(t *testing.T) {
+	for _, tc := range []struct {
+		data, parity int
+		field        Field
+		want         Field
+	}{
+		{8, 6, FieldAuto, FieldGF8},
+		{200, 56, FieldAuto, FieldGF8},
+		{200, 57, FieldAuto, FieldGF16},
+		{8, 6, FieldGF16, FieldGF16},
+	} {
+		code, err := NewCode(tc.data, tc.parity, tc.field)
+		if err != nil {
+			t.Fatalf("NewCode(%d, %d, %q): %v", tc.data, tc.parity, tc.field, err)
+		}
+		if code.Field != tc.want {
+			t.Fatalf("NewCode(%d, %d, %q) is over %s, expected %s", tc.data, tc.parity, tc.field, code.Field, tc.want)
+		}
+	}
+	if _, err := NewCode(250, 50, FieldGF8); err == nil {
+		t.Fatal("NewCode accepted 300 shards over gf8")
+	}
+	if _, err := NewCode(0, 6, FieldAuto); err == nil {
+		t.Fatal("NewCode accepted no data shards")
+	}
+}
+
+func TestRoundTrip300Shards(t *testing.T) {
+	code, err := NewCode(200, 100, FieldAuto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code.Field != FieldGF16 {
+		t.Fatalf("300 shards coded over %s, expected gf16", code.Field)
+	}
+	data := make([]byte, 100_000)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+
+	shards, err := code.Encode(bytes.Clone(data))
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	if len(shards) != 300 {
+		t.Fatalf("%d shards, expected 300", len(shards))
+	}
+	if len(shards[0])%64 != 0 {
+		t.Fatalf("gf16 shards of %d bytes, expected a multiple of 64", len(shards[0]))
+	}
+	if ok, err := code.Verify(shards); err != nil || !ok {
+		t.Fatalf("Verify: %t, %v", ok, err)
+	}
+
+	// Lose as many shards as there is parity, data and parity alike
+	for i := 0; i < code.Parity; i++ {
+		shards[i*3] = nil
+	}
+	got, err := code.AppendDecodeLength(nil, shards, len(data))
+	if err != nil {
+		t.Fatalf("AppendDecodeLength: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("decoded data differs from what was encoded")
+	}
+}
+
+func TestDecodeRefusesWrongShardCount(t *testing.T) {
+	code, err := NewCode(4, 2, FieldAuto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shards, err := code.Encode(make([]byte, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DefaultCode().AppendDecode(nil, shards); err == nil {
+		t.Fatal("decoded 6 shards under an 8+6 code")
+	}
+}
+
+func TestDecodeToMatchesAppendDecode(t *testing.T) {
+	for _, size := range []int{1, 1000, 65_537, 1 << 20} {
+		data := make([]byte, size)
+		if _, err := rand.Read(data); err != nil {
+			t.Fatal(err)
+		}
+		shards, err := Encode(bytes.Clone(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Lose as much as parity allows, data shards first
+		for i := 0; i < ParityShards; i++ {
+			shards[i*2] = nil
+		}
+		joined, err := AppendDecodeLength(nil, cloneShards(shards), size)
+		if err != nil {
+			t.Fatalf("AppendDecodeLength: %v", err)
+		}
+		hash := sha256.New()
+		if err := DecodeTo(hash, shards, size); err != nil {
+			t.Fatalf("DecodeTo: %v", err)
+		}
+		if want := sha256.Sum256(data); !bytes.Equal(hash.Sum(nil), want[:]) || sha256.Sum256(joined) != want {
+			t.Fatalf("%d bytes decoded differently by DecodeTo and AppendDecodeLength", size)
+		}
+	}
+}
+
+func TestDecodeToRefusesLengthPastData(t *testing.T) {
+	shards, err := Encode(make([]byte, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := DecodeTo(io.Discard, shards, 10_000); !errors.Is(err, ErrShortData) {
+		t.Fatalf("DecodeTo returned %v, expected %v", err, ErrShortData)
+	}
+}
+
+// TestAppendDecodeLengthKeepsTrailingZeros checks that data ending in
+// zeros of its own keeps them, and only the padding is dropped.
+func TestAppendDecodeLengthKeepsTrailingZeros(t *testing.T) {
+	data := make([]byte, 1014)
+	if _, err := rand.Read(data[:1000]); err != nil {
+		t.Fatal(err)
+	}
+	data[999] = 0xff // the zeros start right after
+	shards, err := Encode(bytes.Clone(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if held := len(shards[0]) * DataShards; held == len(data) {
+		t.Fatalf("%d bytes fill the shards exactly, so there is no padding to drop", held)
+	}
+	got, err := AppendDecodeLength(nil, cloneShards(shards), len(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("decoded %d bytes ending %x, expected %d ending %x", len(got), got[max(len(got)-16, 0):], len(data), data[len(data)-16:])
+	}
+	if _, err := AppendDecodeLength(nil, cloneShards(shards), len(shards[0])*DataShards+1); !errors.Is(err, ErrShortData) {
+		t.Fatalf("AppendDecodeLength past the data returned %v, expected %v", err, ErrShortData)
+	}
+}
+
+// combinations calls f with every k-element subset of 0..n-1, in order.
+func combinations(n, k int, f func([]int)) {
+	subset := make([]int, k)
+	var pick func(start, i int)
+	pick = func(start, i int) {
+		if i == k {
+			f(subset)
+			return
+		}
+		for j := start; j <= n-(k-i); j++ {
+			subset[i] = j
+			pick(j+1, i+1)
+		}
+	}
+	pick(0, 0)
+}
+
+func TestDecodeEveryParityLoss(t *testing.T) {
+	code := DefaultCode()
+	// An odd length, so the last data shard is padded
+	data := make([]byte, 10_007)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	shards, err := code.Encode(bytes.Clone(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := sha256.Sum256(data)
+
+	// Any Parity shards can go: all of it, all data shards it can cover,
+	// the first and last data shards together, and everything between
+	tried := 0
+	combinations(code.Total(), code.Parity, func(lost []int) {
+		tried++
+		degraded := cloneShards(shards)
+		for _, i := range lost {
+			degraded[i] = nil
+		}
+		joined, err := code.AppendDecodeLength(nil, cloneShards(degraded), len(data))
+		if err != nil || sha256.Sum256(joined) != want {
+			t.Fatalf("losing shards %v: AppendDecodeLength: %v", lost, err)
+		}
+		hash := sha256.New()
+		if err := code.DecodeTo(hash, degraded, len(data)); err != nil || !bytes.Equal(hash.Sum(nil), want[:]) {
+			t.Fatalf("losing shards %v: DecodeTo: %v", lost, err)
+		}
+	})
+	if tried != 3003 {
+		t.Fatalf("tried %d combinations of %d lost shards, expected 3003", tried, code.Parity)
+	}
+
+	// One more is one too many, however the shards are lost
+	combinations(code.Total(), code.Parity+1, func(lost []int) {
+		degraded := cloneShards(shards)
+		for _, i := range lost {
+			degraded[i] = nil
+		}
+		if _, err := code.AppendDecode(nil, degraded); !errors.Is(err, ErrTooFewShards) {
+			t.Fatalf("losing shards %v: AppendDecode: %v", lost, err)
+		}
+		if err := code.DecodeTo(io.Discard, degraded, len(data)); !errors.Is(err, ErrTooFewShards) {
+			t.Fatalf("losing shards %v: DecodeTo: %v", lost, err)
+		}
+	})
+}
+
+func cloneShards(shards [][]byte) [][]byte {
+	clone := make([][]byte, len(shards))
+	for i, shard := range shards {
+		clone[i] = bytes.Clone(shard)
+	}
+	return clone
+}
+
+// BenchmarkDecode512MB compares joining a 512 MB object into a buffer of
+// its own with writing it out of the shards. B/op is the extra memory
+// each needs on top of the shards.
+func BenchmarkDecode512MB(b *testing.B) {
+	if testing.Short() {
+		b.Skip("skipped with -short")
+	}
+	const size = 512 << 20
+	shards, err := Encode(make([]byte, size))
+	if err != nil {
+		b.Fatal(err)
+	}
+	lost := shards[0]
+	for _, bench := range []struct {
+		name   string
+		decode func() error
+	}{
+		{"append", func() error {
+			_, err := AppendDecodeLength(nil, shards, size)
+			return err
+		}},
+		{"writer", func() error { return DecodeTo(io.Discard, shards, size) }},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(size)
+			for i := 0; i < b.N; i++ {
+				// One data shard is rebuilt either way
+				shards[0] = nil
+				if err := bench.decode(); err != nil {
+					b.Fatal(err)
+				}
+			}
+			shards[0] = lost
+		})
+	}
+}
+
+// corruptingEncoder flips a bit of the last parity shard after encoding,
+// as a coding bug or a memory error might.
+type corruptingEncoder struct {
+	reedsolomon.Encoder
+}
+
+func (e corruptingEncoder) Encode(shards [][]byte) error {
+	if err := e.Encoder.Encode(shards); err != nil {
+		return err
+	}
+	shards[len(shards)-1][0] ^= 1
+	return nil
+}
+
+func TestVerifyOnEncode(t *testing.T) {
+	code := DefaultCode()
+	enc, err := code.encoder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	split := func() [][]byte {
+		data := make([]byte, 10_000)
+		if _, err := rand.Read(data); err != nil {
+			t.Fatal(err)
+		}
+		shards, err := enc.Split(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return shards
+	}
+
+	if err := code.encode(corruptingEncoder{enc}, split()); err != nil {
+		t.Fatalf("encoding without verification failed: %v", err)
+	}
+	verified := code
+	verified.VerifyOnEncode = true
+	if err := verified.encode(corruptingEncoder{enc}, split()); !errors.Is(err, ErrParityMismatch) {
+		t.Fatalf("encoding corrupted parity returned %v, expected %v", err, ErrParityMismatch)
+	}
+
+	// Verification is the code's alone, and leaves the shards as they were
+	data := split()[0]
+	shards, err := verified.Encode(slices.Clone(data))
+	if err != nil {
+		t.Fatalf("Encode with verification: %v", err)
+	}
+	plain, err := code.Encode(slices.Clone(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range shards {
+		if !bytes.Equal(shards[i], plain[i]) {
+			t.Fatalf("shard %d differs when verified", i)
+		}
+	}
+	if got, err := code.AppendDecodeLength(nil, shards, len(data)); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("decoding verified shards without verification: %v", err)
+	}
+	_, writers := shardBuffers(code.Total())
+	if err := verified.EncodeStream(writers, bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatalf("EncodeStream with verification: %v", err)
+	}
+}
+
+// TestEncodeSharesCapacity checks that Encode carves the shards out of
+// data when it has room for them, rather than allocating them.
+func TestEncodeSharesCapacity(t *testing.T) {
+	data := make([]byte, 100_000, ShardSetSize(100_000))
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	want := bytes.Clone(data)
+	shards, err := Encode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, shard := range shards {
+		if &shard[:1][0] != &data[:cap(data)][i*len(shard)] {
+			t.Fatalf("shard %d isn't in data's backing array", i)
+		}
+	}
+	got, err := AppendDecodeLength(nil, shards, len(want))
+	if err != nil || !bytes.Equal(got, want) {
+		t.Fatalf("shards decode to other data: %v", err)
+	}
+}
+
+// BenchmarkEncodeDecode encodes and decodes 8 MiB, allocating the shards
+// and the decoded data each time, and in buffers reused from one
+// operation to the next as the pooled store and retrieve paths do.
+func BenchmarkEncodeDecode(b *testing.B) {
+	const size = 8 << 20
+	data := make([]byte, size)
+	for _, bench := range []struct {
+		name  string
+		reuse bool
+	}{
+		{"allocating", false},
+		{"reusing", true},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			var encoded, decoded []byte
+			if bench.reuse {
+				encoded = make([]byte, 0, ShardSetSize(size))
+				decoded = make([]byte, 0, ShardSetSize(size))
+			}
+			b.ReportAllocs()
+			b.SetBytes(size)
+			for i := 0; i < b.N; i++ {
+				shards, err := Encode(append(encoded[:0], data...))
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := AppendDecodeLength(decoded[:0], shards, size); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,340 @@
+package erasurecoding
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// StreamError is returned by EncodeStream and DecodeStream when reading or
+// writing a shard fails, with the shard and the offset in it of the block
+// that failed. Everything before Offset went through.
+type StreamError struct {
+	Shard  int
+	Offset int64
+	Err    error
+}
+
+func (e *StreamError) Error() string {
+	return fmt.Sprintf("shard %d at offset %d: %v", e.Shard, e.Offset, e.Err)
+}
+
+func (e *StreamError) Unwrap() error { return e.Err }
+
+// streamBudget bounds the block buffers of a stream, one block for each
+// shard. Blocks are a multiple of 64 bytes, as GF(2^16) codes need.
+const streamBudget = 1 << 20
+
+// blockSize returns the block size shards of shardSize bytes are streamed
+// in under the code.
+func (c Code) blockSize(shardSize int) int {
+	block := max(streamBudget/c.Total()/64*64, 64)
+	return min(block, shardSize)
+}
+
+// EncodeStream is EncodeStream under the default code.
+func EncodeStream(dst []io.Writer, src io.Reader, size int64) error {
+	return DefaultCode().EncodeStream(dst, src, size)
+}
+
+// EncodeStream writes the shards of the size bytes read from src to dst,
+// one writer per shard, without holding them all: the shards are encoded
+// a block at a time and every shard gets each block in turn, so each
+// writer's shard grows along with the others'. The shards are those Encode
+// returns. Data is read in place when src is an io.ReaderAt, such as a
+// bytes.Reader or a file; other readers are read into memory first, since
+// data shards are contiguous runs of the data and parity needs all of them
+// at once.
+//
+// When a write fails, nothing more is written and the error is returned as
+// a *StreamError. Every writer with a CloseWithError method, as an
+// io.PipeWriter has, is then closed with the error, so whatever reads the
+// shards stops too; cleaning up what they already stored is up to the
+// caller. Writers aren't closed otherwise.
+func (c Code) EncodeStream(dst []io.Writer, src io.Reader, size int64) (err error) {
+	if len(dst) != c.Total() {
+		return errShardCount
+	}
+	defer func() {
+		if err != nil {
+			abortWriters(dst, err)
+		}
+	}()
+	data, err := readerAt(src, size)
+	if err != nil {
+		return fmt.Errorf("failed to read data: %w", err)
+	}
+	enc, err := c.encoder()
+	if err != nil {
+		return err
+	}
+
+	shardSize := int64(c.ShardSize(int(size)))
+	block := c.blockSize(int(shardSize))
+	blocks := make([][]byte, c.Total())
+	for i := range blocks {
+		blocks[i] = make([]byte, block)
+	}
+	for offset := int64(0); offset < shardSize; offset += int64(block) {
+		n := int(min(int64(block), shardSize-offset))
+		shards := make([][]byte, len(blocks))
+		for i := range shards {
+			shards[i] = blocks[i][:n]
+		}
+		for i, shard := range shards[:c.Data] {
+			if err := readBlock(data, shard, int64(i)*shardSize+offset, size); err != nil {
+				return fmt.Errorf("failed to read data: %w", err)
+			}
+		}
+		if err := c.encode(enc, shards); err != nil {
+			return err
+		}
+		for i, shard := range shards {
+			if err := writeBlock(dst[i], shard); err != nil {
+				return &StreamError{Shard: i, Offset: offset, Err: err}
+			}
+		}
+	}
+	return nil
+}
+
+// ErrShardWriterFull is returned by a ShardWriter written more data than
+// its shards were laid out for.
+var ErrShardWriterFull = errors.New("more data than the shards were laid out for")
+
+// ShardWriter erasure codes the data written to it, in order, without the
+// data being held anywhere but the shards: writes go straight into the
+// data shards, which are contiguous runs of the data, and Finish computes
+// the parity into the parity shards. Unlike EncodeStream it needs neither
+// the data at hand up front nor its size, only a bound on the size, so
+// data can be coded as it is produced, by an encrypting writer say. The
+// shards are held whole, as they are when they are stored whole.
+type ShardWriter struct {
+	code   Code
+	shards [][]byte
+	size   int // Bytes of each shard the data is laid out in while written
+	n      int64
+}
+
+// NewShardWriter returns a ShardWriter coding up to max bytes into shards,
+// one slice for each shard of the code, each at least ShardSize(max) bytes
+// long; the slices can be the memory the shards are stored from.
+func (c Code) NewShardWriter(shards [][]byte, max int) (*ShardWriter, error) {
+	if len(shards) != c.Total() {
+		return nil, errShardCount
+	}
+	size := c.ShardSize(max)
+	for i, shard := range shards {
+		if len(shard) < size {
+			return nil, fmt.Errorf("shard %d has %d bytes, %d needed for %d bytes of data", i, len(shard), size, max)
+		}
+	}
+	return &ShardWriter{code: c, shards: shards, size: size}, nil
+}
+
+func (w *ShardWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if w.n >= int64(w.size)*int64(w.code.Data) {
+			return written, ErrShardWriterFull
+		}
+		i, offset := int(w.n/int64(w.size)), int(w.n%int64(w.size))
+		n := copy(w.shards[i][offset:w.size], p)
+		p, written, w.n = p[n:], written+n, w.n+int64(n)
+	}
+	return written, nil
+}
+
+// Size returns the bytes of data written so far.
+func (w *ShardWriter) Size() int64 {
+	return w.n
+}
+
+// Finish computes the parity of the data written and returns the shards,
+// the same Encode returns for that data, in the memory NewShardWriter was
+// given. When less data was written than it was given room for, the data
+// shards are first laid out again, in place, for the shorter shards of
+// what was. Nothing should be written after Finish.
+func (w *ShardWriter) Finish() ([][]byte, error) {
+	size := w.code.ShardSize(int(w.n))
+	if size < w.size {
+		w.relayout(size)
+	}
+	shards := make([][]byte, len(w.shards))
+	for i := range shards {
+		shards[i] = w.shards[i][:size]
+	}
+	// Encode pads the last data shards with zeros
+	for i, shard := range shards[:w.code.Data] {
+		clear(shard[max(min(w.n-int64(i)*int64(size), int64(size)), 0):])
+	}
+	enc, err := w.code.encoder()
+	if err != nil {
+		return nil, err
+	}
+	if err := w.code.encode(enc, shards); err != nil {
+		return nil, err
+	}
+	return shards, nil
+}
+
+// relayout moves the data from shards of w.size bytes into shards of size
+// bytes. Data shard i of the new layout comes from no later in the data
+// than it goes to, from at most two of the old shards, so the shards are
+// moved from the last to the first, each from the end of its source to
+// the start, without overwriting data still to be moved.
+func (w *ShardWriter) relayout(size int) {
+	for i := w.code.Data - 1; i >= 0; i-- {
+		from := i * size
+		src, offset := from/w.size, from%w.size
+		head := min(size, w.size-offset)
+		if head < size {
+			copy(w.shards[i][head:size], w.shards[src+1][:size-head])
+		}
+		copy(w.shards[i][:head], w.shards[src][offset:offset+head])
+	}
+}
+
+// DecodeStream is DecodeStream under the default code.
+func DecodeStream(dst io.Writer, src []io.Reader, size int64) error {
+	return DefaultCode().DecodeStream(dst, src, size)
+}
+
+// DecodeStream writes the size bytes of data held by shards read from src,
+// one reader per shard and nil for missing shards, to dst. It is the
+// counterpart of EncodeStream and, like DecodeTo, keeps exactly size
+// bytes. Data shards that are present are copied through a block at a
+// time; blocks of missing ones are rebuilt from the blocks at the same
+// offset of the other shards. Readers are read in place when they are
+// io.ReaderAts and read into memory first otherwise.
+//
+// A shard that can't be read, or holds less than the shards of size bytes
+// do, fails decoding with a *StreamError; so does writing to dst, with a
+// Shard of -1. Writes to dst stop at the first error.
+func (c Code) DecodeStream(dst io.Writer, src []io.Reader, size int64) error {
+	if len(src) != c.Total() {
+		return errShardCount
+	}
+	shardSize := int64(c.ShardSize(int(size)))
+	shards := make([]io.ReaderAt, len(src))
+	present := 0
+	for i, r := range src {
+		if r == nil {
+			continue
+		}
+		var err error
+		if shards[i], err = readerAt(r, shardSize); err != nil {
+			return &StreamError{Shard: i, Err: err}
+		}
+		present++
+	}
+	if present < c.Data {
+		return fmt.Errorf("%w: %d of %d present, %d needed", ErrTooFewShards, present, c.Total(), c.Data)
+	}
+	enc, err := c.encoder()
+	if err != nil {
+		return err
+	}
+
+	block := c.blockSize(int(shardSize))
+	blocks := make([][]byte, c.Total())
+	for i := range blocks {
+		blocks[i] = make([]byte, block)
+	}
+	remaining := size
+	for i := 0; i < c.Data && remaining > 0; i++ {
+		for offset := int64(0); offset < shardSize && remaining > 0; offset += int64(block) {
+			n := int(min(int64(block), shardSize-offset))
+			var out []byte
+			if shards[i] != nil {
+				out = blocks[i][:n]
+				if err := readShardBlock(shards[i], out, offset); err != nil {
+					return &StreamError{Shard: i, Offset: offset, Err: err}
+				}
+			} else {
+				rebuilt := make([][]byte, len(blocks))
+				for j, shard := range shards {
+					if shard == nil {
+						rebuilt[j] = blocks[j][:0]
+						continue
+					}
+					rebuilt[j] = blocks[j][:n]
+					if err := readShardBlock(shard, rebuilt[j], offset); err != nil {
+						return &StreamError{Shard: j, Offset: offset, Err: err}
+					}
+				}
+				if err := enc.ReconstructData(rebuilt); err != nil {
+					return err
+				}
+				out = rebuilt[i]
+			}
+			out = out[:min(int64(len(out)), remaining)]
+			if err := writeBlock(dst, out); err != nil {
+				return &StreamError{Shard: -1, Offset: size - remaining, Err: err}
+			}
+			remaining -= int64(len(out))
+		}
+	}
+	return nil
+}
+
+// readerAt returns r as an io.ReaderAt, reading up to size bytes of it
+// into memory unless it is one already.
+func readerAt(r io.Reader, size int64) (io.ReaderAt, error) {
+	if ra, ok := r.(io.ReaderAt); ok {
+		return ra, nil
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, max(size, 0)))
+	if _, err := io.Copy(buf, io.LimitReader(r, size)); err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(buf.Bytes()), nil
+}
+
+// readBlock fills block with the data at offset, and zeros past size, as
+// Encode pads the last data shards with.
+func readBlock(data io.ReaderAt, block []byte, offset, size int64) error {
+	n := int(max(min(int64(len(block)), size-offset), 0))
+	if n > 0 {
+		read, err := data.ReadAt(block[:n], offset)
+		if read < n {
+			if err == nil || err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+	}
+	clear(block[n:])
+	return nil
+}
+
+// readShardBlock fills block from a shard at offset.
+func readShardBlock(shard io.ReaderAt, block []byte, offset int64) error {
+	n, err := shard.ReadAt(block, offset)
+	if n == len(block) {
+		return nil
+	}
+	if err == nil || err == io.EOF {
+		err = fmt.Errorf("%w: shard ends at %d bytes", ErrShortData, offset+int64(n))
+	}
+	return err
+}
+
+func writeBlock(w io.Writer, block []byte) error {
+	n, err := w.Write(block)
+	if err == nil && n < len(block) {
+		err = io.ErrShortWrite
+	}
+	return err
+}
+
+// abortWriters closes with err the writers that can be, for EncodeStream
+// giving up.
+func abortWriters(dst []io.Writer, err error) {
+	for _, w := range dst {
+		if c, ok := w.(interface{ CloseWithError(error) error }); ok {
+			c.CloseWithError(err)
+		}
+	}
+}
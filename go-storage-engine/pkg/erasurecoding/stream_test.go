@@ -0,0 +1,314 @@
+package erasurecoding
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+)
+
+// plainReader hides the io.ReaderAt of a reader, so it is streamed.
+type plainReader struct{ io.Reader }
+
+// streamCodes are the codes streams are tested under: the default one, a
+// small one and a wide one, whose blocks are small.
+func streamCodes(t *testing.T) []Code {
+	t.Helper()
+	small, err := NewCode(3, 2, FieldGF8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wide, err := NewCode(150, 90, FieldGF8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []Code{DefaultCode(), small, wide}
+}
+
+func shardBuffers(n int) ([]*bytes.Buffer, []io.Writer) {
+	buffers := make([]*bytes.Buffer, n)
+	writers := make([]io.Writer, n)
+	for i := range buffers {
+		buffers[i] = new(bytes.Buffer)
+		writers[i] = buffers[i]
+	}
+	return buffers, writers
+}
+
+func TestEncodeStreamMatchesEncode(t *testing.T) {
+	for _, code := range streamCodes(t) {
+		block := code.blockSize(1 << 30)
+		for _, size := range []int{1, 1000, 65_537, block*code.Data + 1, 3<<20 + 5} {
+			data := make([]byte, size)
+			if _, err := rand.Read(data); err != nil {
+				t.Fatal(err)
+			}
+			want, err := code.Encode(bytes.Clone(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, src := range []io.Reader{bytes.NewReader(data), plainReader{bytes.NewReader(data)}} {
+				buffers, writers := shardBuffers(code.Total())
+				if err := code.EncodeStream(writers, src, int64(size)); err != nil {
+					t.Fatalf("%s, %d bytes: %v", code, size, err)
+				}
+				for i, buf := range buffers {
+					if !bytes.Equal(buf.Bytes(), want[i]) {
+						t.Fatalf("%s, %d bytes: shard %d streamed as %d bytes unlike Encode's %d", code, size, i, buf.Len(), len(want[i]))
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestDecodeStream(t *testing.T) {
+	for _, code := range streamCodes(t) {
+		for _, size := range []int{1, 65_537, 3<<20 + 5} {
+			data := make([]byte, size)
+			if _, err := rand.Read(data); err != nil {
+				t.Fatal(err)
+			}
+			shards, err := code.Encode(bytes.Clone(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, lost := range [][]int{nil, {0}, {1, code.Total() - 1}, firstN(code.Parity)} {
+				src := make([]io.Reader, len(shards))
+				for i, shard := range shards {
+					if i%2 == 0 {
+						src[i] = bytes.NewReader(shard)
+					} else {
+						src[i] = plainReader{bytes.NewReader(shard)}
+					}
+				}
+				for _, i := range lost {
+					src[i] = nil
+				}
+				var out bytes.Buffer
+				if err := code.DecodeStream(&out, src, int64(size)); err != nil {
+					t.Fatalf("%s, %d bytes, lost %v: %v", code, size, lost, err)
+				}
+				if !bytes.Equal(out.Bytes(), data) {
+					t.Fatalf("%s, %d bytes, lost %v: decoded %d bytes of the wrong data", code, size, lost, out.Len())
+				}
+			}
+		}
+	}
+}
+
+func firstN(n int) []int {
+	s := make([]int, n)
+	for i := range s {
+		s[i] = i
+	}
+	return s
+}
+
+func TestDecodeStreamRefuses(t *testing.T) {
+	data := make([]byte, 10_000)
+	shards, err := Encode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := make([]io.Reader, len(shards))
+	for i := range src[:DataShards-1] {
+		src[i] = bytes.NewReader(shards[i])
+	}
+	if err := DecodeStream(io.Discard, src, 10_000); !errors.Is(err, ErrTooFewShards) {
+		t.Fatalf("DecodeStream of too few shards: %v", err)
+	}
+
+	// A short shard, present or read to rebuild another
+	for i := range src {
+		src[i] = bytes.NewReader(shards[i])
+	}
+	src[2] = bytes.NewReader(shards[2][:100])
+	var streamErr *StreamError
+	if err := DecodeStream(io.Discard, src, 10_000); !errors.As(err, &streamErr) || streamErr.Shard != 2 || !errors.Is(err, ErrShortData) {
+		t.Fatalf("DecodeStream of a short shard: %v", err)
+	}
+	src[1] = nil
+	if err := DecodeStream(io.Discard, src, 10_000); !errors.As(err, &streamErr) || streamErr.Shard != 2 {
+		t.Fatalf("DecodeStream rebuilding from a short shard: %v", err)
+	}
+
+	src[2] = bytes.NewReader(shards[2])
+	errFull := errors.New("disk full")
+	if err := DecodeStream(&cutWriter{limit: 5000, err: errFull}, src, 10_000); !errors.As(err, &streamErr) || streamErr.Shard != -1 || !errors.Is(err, errFull) {
+		t.Fatalf("DecodeStream to a failing writer: %v", err)
+	}
+}
+
+// cutWriter takes up to limit bytes and then fails, taking none of the
+// write that would cross it.
+type cutWriter struct {
+	bytes.Buffer
+	limit int
+	err   error
+}
+
+func (w *cutWriter) Write(p []byte) (int, error) {
+	if w.Len()+len(p) > w.limit {
+		return 0, w.err
+	}
+	return w.Buffer.Write(p)
+}
+
+func TestEncodeStreamFailingWriter(t *testing.T) {
+	code := DefaultCode()
+	size := 3<<20 + 5
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	shardSize := code.ShardSize(size)
+	block := code.blockSize(shardSize)
+	errBackend := errors.New("backend went away")
+
+	for _, failing := range []int{0, 5, code.Total() - 1} {
+		for _, limit := range []int{0, 1, block - 1, block, block + 1, 3 * block, shardSize - 1} {
+			buffers, writers := shardBuffers(code.Total())
+			cut := &cutWriter{limit: limit, err: errBackend}
+			writers[failing] = cut
+			err := code.EncodeStream(writers, bytes.NewReader(data), int64(size))
+
+			var streamErr *StreamError
+			if !errors.As(err, &streamErr) || !errors.Is(err, errBackend) {
+				t.Fatalf("shard %d cut at %d: %v", failing, limit, err)
+			}
+			offset := limit / block * block
+			if streamErr.Shard != failing || streamErr.Offset != int64(offset) || cut.Len() != offset {
+				t.Fatalf("shard %d cut at %d failed as shard %d at %d, after %d bytes", failing, limit, streamErr.Shard, streamErr.Offset, cut.Len())
+			}
+			// Nothing is written past the block that failed: shards before
+			// the failing one have it, the ones after don't
+			for i, buf := range buffers {
+				want := offset
+				if i < failing {
+					want = min(offset+block, shardSize)
+				}
+				if i != failing && buf.Len() != want {
+					t.Fatalf("shard %d cut at %d: shard %d got %d bytes, expected %d", failing, limit, i, buf.Len(), want)
+				}
+			}
+		}
+	}
+}
+
+// TestEncodeStreamAbortsPipes streams shards through a pipe each, as to
+// backends, one of which gives up partway: every other reader must see the
+// error rather than a clean end of its shard.
+func TestEncodeStreamAbortsPipes(t *testing.T) {
+	code := DefaultCode()
+	size := 2 << 20
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	shardSize := code.ShardSize(size)
+	errBackend := errors.New("backend went away")
+
+	for _, at := range []int{0, shardSize / 3, shardSize - 1} {
+		writers := make([]io.Writer, code.Total())
+		results := make([]error, code.Total())
+		var wg sync.WaitGroup
+		for i := range writers {
+			pr, pw := io.Pipe()
+			writers[i] = pw
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				var r io.Reader = pr
+				if i == 3 {
+					r = io.LimitReader(pr, int64(at))
+				}
+				_, err := io.Copy(io.Discard, r)
+				if i == 3 {
+					pr.CloseWithError(errBackend)
+					err = errBackend
+				}
+				results[i] = err
+			}()
+		}
+		err := code.EncodeStream(writers, bytes.NewReader(data), int64(size))
+		wg.Wait()
+		var streamErr *StreamError
+		if !errors.As(err, &streamErr) || streamErr.Shard != 3 || !errors.Is(err, errBackend) {
+			t.Fatalf("backend failing at %d: %v", at, err)
+		}
+		for i, result := range results {
+			if !errors.Is(result, errBackend) {
+				t.Fatalf("backend failing at %d: shard %d reader ended with %v", at, i, result)
+			}
+		}
+	}
+}
+
+// TestShardWriterMatchesEncode writes data of every size up to the bound
+// a ShardWriter is laid out for, in writes of odd sizes, into memory that
+// held something else before: short data is laid out again in place.
+func TestShardWriterMatchesEncode(t *testing.T) {
+	for _, code := range streamCodes(t) {
+		bound := 100_000
+		for _, size := range []int{1, 1000, code.Data*code.ShardSize(bound/2) + 1, bound - 1, bound} {
+			data := make([]byte, size)
+			if _, err := rand.Read(data); err != nil {
+				t.Fatal(err)
+			}
+			want, err := code.Encode(bytes.Clone(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			shards := make([][]byte, code.Total())
+			for i := range shards {
+				shards[i] = bytes.Repeat([]byte{0xa5}, code.ShardSize(bound))
+			}
+			w, err := code.NewShardWriter(shards, bound)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for rest := data; len(rest) > 0; {
+				n := min(777, len(rest))
+				if written, err := w.Write(rest[:n]); err != nil || written != n {
+					t.Fatalf("%s, %d bytes: Write of %d bytes wrote %d: %v", code, size, n, written, err)
+				}
+				rest = rest[n:]
+			}
+			if w.Size() != int64(size) {
+				t.Fatalf("%s, %d bytes: Size is %d", code, size, w.Size())
+			}
+			got, err := w.Finish()
+			if err != nil {
+				t.Fatalf("%s, %d bytes: %v", code, size, err)
+			}
+			for i := range want {
+				if !bytes.Equal(got[i], want[i]) {
+					t.Fatalf("%s, %d bytes: shard %d differs from Encode's", code, size, i)
+				}
+			}
+		}
+	}
+}
+
+func TestShardWriterRefusesMoreThanItHasRoomFor(t *testing.T) {
+	code := DefaultCode()
+	bound := 1000
+	shards := make([][]byte, code.Total())
+	for i := range shards {
+		shards[i] = make([]byte, code.ShardSize(bound))
+	}
+	w, err := code.NewShardWriter(shards, bound)
+	if err != nil {
+		t.Fatal(err)
+	}
+	room := code.Data * code.ShardSize(bound)
+	if n, err := w.Write(make([]byte, room+10)); n != room || !errors.Is(err, ErrShardWriterFull) {
+		t.Fatalf("Write of %d bytes into room for %d wrote %d: %v", room+10, room, n, err)
+	}
+	if _, err := code.NewShardWriter(shards, 2*bound); err == nil {
+		t.Fatal("NewShardWriter took shards too small")
+	}
+}
@@ -0,0 +1,138 @@
+package metadata
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Metadata files are only ever replaced whole, through a temporary file
+// and a rename, so a reader sees either the old or the new file. On top of
+// that, readers hold a shared advisory lock and writers an exclusive one,
+// so read-modify-write updates from concurrent commands don't lose each
+// other's changes. The lock is taken on a sidecar "<file>.lock" rather
+// than the metadata file itself, whose inode changes with every rename.
+
+// Lock takes an advisory lock on a metadata file and returns the function
+// releasing it. If the lock file can't be created, as when reading
+// metadata from a read-only directory, the file is used unlocked.
+func Lock(path string, exclusive bool) (func(), error) {
+	lockPath := path + ".lock"
+	file, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		file, err = os.Open(lockPath)
+	}
+	if err != nil {
+		if !exclusive && (errors.Is(err, os.ErrPermission) || errors.Is(err, os.ErrNotExist)) {
+			return func() {}, nil
+		}
+		return nil, fmt.Errorf("failed to lock metadata file: %w", err)
+	}
+	if err := lockFile(file, exclusive); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to lock metadata file: %w", err)
+	}
+	return func() {
+		unlockFile(file)
+		file.Close()
+	}, nil
+}
+
+// Read reads a metadata file, holding the shared lock.
+func Read(path string) (*Metadata, error) {
+	unlock, err := Lock(path, false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return readFile(path)
+}
+
+// readFile reads a metadata file the caller has locked.
+func readFile(path string) (*Metadata, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening file: %w", err)
+	}
+	defer file.Close()
+	return Parse(file)
+}
+
+// ReadValues reads every key of a metadata file in one pass.
+func ReadValues(path string) (map[string]string, error) {
+	m, err := Read(path)
+	if err != nil {
+		return nil, err
+	}
+	return m.Values(), nil
+}
+
+// ReadValue reads one key of a metadata file.
+func ReadValue(path, key string) (string, error) {
+	m, err := Read(path)
+	if err != nil {
+		return "", err
+	}
+	value, ok := m.Get(key)
+	if !ok {
+		return "", ErrKeyNotFound
+	}
+	return value, nil
+}
+
+// Write writes a metadata file in one piece, as text.
+func Write(path string, m *Metadata) error {
+	unlock, err := Lock(path, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return replace(path, m.Bytes())
+}
+
+// Rewrite passes the lines of a metadata file to edit and atomically
+// replaces the file with the result, as text, holding the exclusive lock
+// throughout. A nil result leaves the file as it is.
+func Rewrite(path string, edit func(lines []string) ([]string, error)) error {
+	unlock, err := Lock(path, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	m, err := readFile(path)
+	if err != nil {
+		return err
+	}
+	lines, err := edit(m.Lines)
+	if err != nil || lines == nil {
+		return err
+	}
+	return replace(path, (&Metadata{Lines: lines}).Bytes())
+}
+
+// replace atomically replaces a metadata file with contents. The caller
+// holds the exclusive lock.
+func replace(path string, contents []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".vmd-*")
+	if err != nil {
+		return fmt.Errorf("couldn't update metadata file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(contents); err != nil {
+		tmp.Close()
+		return fmt.Errorf("couldn't update metadata content: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("couldn't update metadata content: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("couldn't update metadata content: %w", err)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return fmt.Errorf("couldn't update metadata file: %w", err)
+	}
+	return os.Rename(tmp.Name(), path)
+}
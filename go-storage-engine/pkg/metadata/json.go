@@ -0,0 +1,142 @@
+package metadata
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// jsonVersion is the version of the JSON form written, and the only one
+// read.
+const jsonVersion = 1
+
+// ErrUnsupportedFormat is returned for JSON metadata of a version this
+// vault doesn't know.
+var ErrUnsupportedFormat = errors.New("unsupported metadata format")
+
+// Entry is a line of metadata in the JSON form: a key and its value, a key
+// and the block it opens, or a line that is neither, as it is.
+type Entry struct {
+	Key   string   `json:"key,omitempty"`
+	Value string   `json:"value,omitempty"`
+	Block *[]Entry `json:"block,omitempty"`
+	Line  string   `json:"line,omitempty"`
+}
+
+// document is the JSON form of a metadata file.
+type document struct {
+	Version int     `json:"version"`
+	Entries []Entry `json:"entries"`
+}
+
+// MarshalJSON returns the JSON form of the metadata, which converts back
+// to the same lines. Metadata whose lines can't be taken apart that way,
+// as when a block isn't indented the way vault writes them, is given as a
+// list of lines. Lines that aren't valid UTF-8 have no JSON form.
+func (m *Metadata) MarshalJSON() ([]byte, error) {
+	for _, line := range m.Lines {
+		if !utf8.ValidString(line) {
+			return nil, fmt.Errorf("metadata line %q isn't valid UTF-8", line)
+		}
+	}
+	entries, _ := toEntries(m.Lines, 0)
+	if !slices.Equal(renderEntries(nil, entries, 0), m.Lines) {
+		entries = entries[:0]
+		for _, line := range m.Lines {
+			entries = append(entries, Entry{Line: line})
+		}
+	}
+	if entries == nil {
+		entries = []Entry{}
+	}
+	return json.Marshal(document{Version: jsonVersion, Entries: entries})
+}
+
+// UnmarshalJSON reads metadata from its JSON form.
+func (m *Metadata) UnmarshalJSON(data []byte) error {
+	var doc document
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("invalid metadata: %w", err)
+	}
+	if doc.Version != jsonVersion {
+		return fmt.Errorf("%w: version %d", ErrUnsupportedFormat, doc.Version)
+	}
+	if err := checkEntries(doc.Entries); err != nil {
+		return err
+	}
+	m.Lines = renderEntries(nil, doc.Entries, 0)
+	return nil
+}
+
+// toEntries takes lines at the given block depth apart into entries,
+// returning them and the lines after the block's closing line.
+func toEntries(lines []string, depth int) ([]Entry, []string) {
+	indent := strings.Repeat("  ", depth)
+	var entries []Entry
+	for len(lines) > 0 {
+		line := lines[0]
+		lines = lines[1:]
+		if depth > 0 && line == indent[2:]+"}" {
+			return entries, lines
+		}
+		k, v, ok := splitLine(line)
+		switch {
+		case !ok || k == "" || line != indent+k+": "+v:
+			entries = append(entries, Entry{Line: line})
+		case v == "{":
+			block, rest := toEntries(lines, depth+1)
+			if block == nil {
+				block = []Entry{}
+			}
+			entries = append(entries, Entry{Key: k, Block: &block})
+			lines = rest
+		default:
+			entries = append(entries, Entry{Key: k, Value: v})
+		}
+	}
+	return entries, nil
+}
+
+// renderEntries appends the lines of entries at the given block depth.
+func renderEntries(lines []string, entries []Entry, depth int) []string {
+	indent := strings.Repeat("  ", depth)
+	for _, e := range entries {
+		switch {
+		case e.Block != nil:
+			lines = append(lines, indent+e.Key+": {")
+			lines = renderEntries(lines, *e.Block, depth+1)
+			lines = append(lines, indent+"}")
+		case e.Key != "":
+			lines = append(lines, indent+e.Key+": "+e.Value)
+		default:
+			lines = append(lines, e.Line)
+		}
+	}
+	return lines
+}
+
+// checkEntries fails for entries that don't make a line each, as one with
+// a newline in it would not.
+func checkEntries(entries []Entry) error {
+	for _, e := range entries {
+		valid := !strings.Contains(e.Key+e.Value+e.Line, "\n")
+		if e.Key != "" {
+			valid = valid && e.Line == "" && e.Key == strings.TrimSpace(e.Key) && !strings.Contains(e.Key, ": ") &&
+				e.Value == strings.TrimSpace(e.Value) && (e.Block == nil || e.Value == "")
+		} else {
+			valid = valid && e.Value == "" && e.Block == nil
+		}
+		if !valid {
+			return fmt.Errorf("invalid metadata entry %+v", e)
+		}
+		if e.Block != nil {
+			if err := checkEntries(*e.Block); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,12 @@
+//go:build !unix && !windows
+
+package metadata
+
+import "os"
+
+// Advisory locks are only implemented on unix and Windows; elsewhere
+// metadata relies on atomic replacement alone.
+
+func lockFile(file *os.File, exclusive bool) error { return nil }
+
+func unlockFile(file *os.File) error { return nil }
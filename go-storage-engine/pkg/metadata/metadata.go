@@ -0,0 +1,146 @@
+// Package metadata reads and writes vault metadata files.
+//
+// A metadata file is a list of "key: value" lines. A value of "{" opens a
+// block of indented lines closed by a "}" line, as storage_locations is.
+// Keys and values are trimmed, and the first occurrence of a key wins,
+// whether it is indented or not; lines that aren't "key: value" are kept
+// but otherwise ignored. Files can also be read in the JSON form of
+// Metadata, and are always written as text.
+package metadata
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+)
+
+// MaxLineSize bounds a single metadata line. Long location URLs and proofs
+// don't fit bufio's 64 KiB default.
+const MaxLineSize = 4 << 20
+
+// ErrKeyNotFound is returned when a metadata file has no line for a key.
+var ErrKeyNotFound = errors.New("key not found in metadata file")
+
+// Metadata is the contents of a metadata file, line by line, so edits keep
+// what they don't touch as it was.
+type Metadata struct {
+	Lines []string
+}
+
+// Parse reads metadata in either form.
+func Parse(r io.Reader) (*Metadata, error) {
+	br := bufio.NewReader(r)
+	if first, err := br.Peek(1); err == nil && first[0] == '{' {
+		data, err := io.ReadAll(br)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read file: %w", err)
+		}
+		m := new(Metadata)
+		if err := m.UnmarshalJSON(data); err != nil {
+			return nil, err
+		}
+		return m, nil
+	}
+
+	var lines []string
+	scanner := bufio.NewScanner(br)
+	scanner.Buffer(make([]byte, 0, 64*1024), MaxLineSize)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+	return &Metadata{Lines: lines}, nil
+}
+
+// Bytes returns the text form of the metadata.
+func (m *Metadata) Bytes() []byte {
+	var b bytes.Buffer
+	for _, line := range m.Lines {
+		b.WriteString(line)
+		b.WriteByte('\n')
+	}
+	return b.Bytes()
+}
+
+// Get returns the value of key.
+func (m *Metadata) Get(key string) (string, bool) {
+	for _, line := range m.Lines {
+		if k, v, ok := splitLine(line); ok && k == key {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// Values returns the value of every key.
+func (m *Metadata) Values() map[string]string {
+	return Values(m.Lines)
+}
+
+// Set sets the top-level line for key.
+func (m *Metadata) Set(key, value string) {
+	m.Lines = SetValue(m.Lines, key, value)
+}
+
+// Delete drops the top-level line for key.
+func (m *Metadata) Delete(key string) {
+	m.Lines = DeleteValue(m.Lines, key)
+}
+
+// splitLine splits a "key: value" line, indented or not.
+func splitLine(line string) (key, value string, ok bool) {
+	k, v, ok := strings.Cut(line, ": ")
+	if !ok {
+		return "", "", false
+	}
+	return strings.TrimSpace(k), strings.TrimSpace(v), true
+}
+
+// Values reads the key: value lines of a metadata file, indented or not.
+func Values(lines []string) map[string]string {
+	values := make(map[string]string)
+	for _, line := range lines {
+		k, v, ok := splitLine(line)
+		if !ok {
+			continue
+		}
+		if _, ok := values[k]; !ok {
+			values[k] = v
+		}
+	}
+	return values
+}
+
+// SetValue replaces the top-level line for key, or adds one before the
+// storage locations block.
+func SetValue(lines []string, key, value string) []string {
+	line := key + ": " + value
+	insert := len(lines)
+	for i, l := range lines {
+		if strings.HasPrefix(l, key+": ") {
+			lines[i] = line
+			return lines
+		}
+		if strings.HasPrefix(l, "storage_locations:") && insert == len(lines) {
+			insert = i
+		}
+	}
+	return slices.Insert(lines, insert, line)
+}
+
+// DeleteValue drops the top-level line for key, undoing SetValue.
+func DeleteValue(lines []string, key string) []string {
+	kept := lines[:0]
+	for _, line := range lines {
+		if !strings.HasPrefix(line, key+": ") {
+			kept = append(kept, line)
+		}
+	}
+	return kept
+}
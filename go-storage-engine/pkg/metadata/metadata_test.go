@@ -0,0 +1,311 @@
+package metadata
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"unicode/utf8"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden JSON files")
+
+// goldenFiles are the text metadata files in testdata, each with the JSON
+// form it converts to alongside.
+func goldenFiles(t *testing.T) []string {
+	t.Helper()
+	files, err := filepath.Glob("testdata/*.vmd")
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no golden files: %v", err)
+	}
+	return files
+}
+
+func parseFile(t *testing.T, path string) *Metadata {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	m, err := Parse(file)
+	if err != nil {
+		t.Fatalf("Parse %s: %v", path, err)
+	}
+	return m
+}
+
+func TestGoldenFiles(t *testing.T) {
+	for _, textFile := range goldenFiles(t) {
+		jsonFile := strings.TrimSuffix(textFile, ".vmd") + ".json"
+		text, err := os.ReadFile(textFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		m := parseFile(t, textFile)
+		if !bytes.Equal(m.Bytes(), text) {
+			t.Fatalf("%s written back as\n%s", textFile, m.Bytes())
+		}
+		encoded, err := json.MarshalIndent(m, "", "  ")
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoded = append(encoded, '\n')
+		if *update {
+			if err := os.WriteFile(jsonFile, encoded, 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		golden, err := os.ReadFile(jsonFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(encoded, golden) {
+			t.Fatalf("%s encoded as\n%s\nexpected %s", textFile, encoded, jsonFile)
+		}
+
+		// The JSON form reads back as the same lines, and so as the same
+		// values
+		fromJSON := parseFile(t, jsonFile)
+		if !slices.Equal(fromJSON.Lines, m.Lines) {
+			t.Fatalf("%s read back as\n%s", jsonFile, fromJSON.Bytes())
+		}
+	}
+}
+
+func TestLegacyValues(t *testing.T) {
+	m := parseFile(t, "testdata/legacy.vmd")
+	values := m.Values()
+	for key, want := range map[string]string{
+		"dataID":        "5d41402abc4b2a76b9719d911017c592",
+		"filename":      "report.pdf",
+		"shard_3":       "/var/vault/d",
+		"proof_shard_1": "2e,b1",
+	} {
+		if values[key] != want {
+			t.Fatalf("%s = %q, expected %q", key, values[key], want)
+		}
+		if got, ok := m.Get(key); !ok || got != want {
+			t.Fatalf("Get(%s) = %q, %t", key, got, ok)
+		}
+	}
+	if _, ok := values["min_reader_version"]; ok {
+		t.Fatal("a legacy file records a reader version")
+	}
+
+	irregular := parseFile(t, "testdata/irregular.vmd").Values()
+	if irregular["filesize"] != "12" || irregular["shard_0"] != "/tabbed" || irregular["unclosed"] != "yes" {
+		t.Fatalf("irregular values %v", irregular)
+	}
+}
+
+func TestFirstKeyWins(t *testing.T) {
+	m := &Metadata{Lines: []string{"a: 1", "  b: 2", "a: 3", "b: 4", "c:5", "d: x: y"}}
+	values := m.Values()
+	if values["a"] != "1" || values["b"] != "2" || values["d"] != "x: y" {
+		t.Fatalf("values %v", values)
+	}
+	if _, ok := values["c"]; ok {
+		t.Fatal("read a line without \": \"")
+	}
+	if got, _ := m.Get("b"); got != "2" {
+		t.Fatalf("Get(b) = %q", got)
+	}
+}
+
+func TestSetAndDelete(t *testing.T) {
+	m := parseFile(t, "testdata/legacy.vmd")
+	m.Set("filesize", "1")
+	m.Set("tier", "cold")
+	if got, _ := m.Get("filesize"); got != "1" {
+		t.Fatalf("filesize %q", got)
+	}
+	// New keys go before the storage locations, not into them
+	at := slices.Index(m.Lines, "tier: cold")
+	if at < 0 || m.Lines[at+1] != "storage_locations: {" {
+		t.Fatalf("tier set at line %d of\n%s", at, m.Bytes())
+	}
+	// Only top-level lines are set or deleted: setting a key only in a block
+	// adds one in front of it
+	m.Set("shard_0", "/elsewhere")
+	if !slices.Contains(m.Lines, "  shard_0: /var/vault/a") || !slices.Contains(m.Lines, "shard_0: /elsewhere") {
+		t.Fatalf("shard_0 set in\n%s", m.Bytes())
+	}
+	m.Delete("shard_0")
+	m.Delete("tier")
+	if got, _ := m.Get("shard_0"); got != "/var/vault/a" {
+		t.Fatalf("shard_0 in the block became %q", got)
+	}
+	if _, ok := m.Get("tier"); ok {
+		t.Fatal("tier still set")
+	}
+}
+
+func TestParseLongLines(t *testing.T) {
+	long := strings.Repeat("p", 1<<20)
+	m, err := Parse(strings.NewReader("dataID: x\nproof: " + long + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := m.Get("proof"); got != long {
+		t.Fatalf("proof of %d bytes read as %d", len(long), len(got))
+	}
+	if _, err := Parse(strings.NewReader("proof: " + strings.Repeat("p", MaxLineSize))); err == nil {
+		t.Fatal("parsed a line longer than MaxLineSize")
+	}
+}
+
+func TestUnmarshalRejects(t *testing.T) {
+	for _, doc := range []string{
+		`{"version": 2, "entries": []}`,
+		`{"entries": []}`,
+		`{"version": 1, "entries": [{"key": "a\nb: c", "value": "d"}]}`,
+		`{"version": 1, "entries": [{"key": "a", "value": "b\nfilesize: 1"}]}`,
+		`{"version": 1, "entries": [{"line": "a\nb"}]}`,
+		`{"version": 1, "entries": [{"key": " a", "value": "b"}]}`,
+		`{"version": 1, "entries": [{"key": "a: b", "value": "c"}]}`,
+		`{"version": 1, "entries": [{"value": "orphan"}]}`,
+		`{"version": 1, "entries": [{"key": "a", "value": "b", "block": []}]}`,
+		`{"version": 1, "entries": [{"key": "a", "block": [{"line": "x\ny"}]}]}`,
+		`{"version": 1, "entries": [`,
+	} {
+		if _, err := Parse(strings.NewReader(doc)); err == nil {
+			t.Fatalf("parsed %s", doc)
+		}
+	}
+	_, err := Parse(strings.NewReader(`{"version": 2, "entries": []}`))
+	if !errors.Is(err, ErrUnsupportedFormat) {
+		t.Fatalf("version 2: %v", err)
+	}
+}
+
+func TestMigrateJSONToText(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "object.vmd")
+	golden, err := os.ReadFile("testdata/current.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, golden, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ReadValue(path, "shard_1"); err != nil || got != "s3://bucket/vault?region=eu-west-1" {
+		t.Fatalf("ReadValue from JSON: %q, %v", got, err)
+	}
+
+	// Rewriting a file writes it as text, whatever it was read as
+	err = Rewrite(path, func(lines []string) ([]string, error) {
+		return SetValue(lines, "tier", "hot"), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	text, _ := os.ReadFile(path)
+	want, _ := os.ReadFile("testdata/current.vmd")
+	want = bytes.Replace(want, []byte("tier: cold"), []byte("tier: hot"), 1)
+	if !bytes.Equal(text, want) {
+		t.Fatalf("rewritten as\n%s", text)
+	}
+}
+
+func TestFileIO(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "object.vmd")
+	if _, err := ReadValue(path, "dataID"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("ReadValue of a missing file: %v", err)
+	}
+	if err := Write(path, &Metadata{Lines: []string{"dataID: abc", "filesize: 3"}}); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ReadValue(path, "filesize"); err != nil || got != "3" {
+		t.Fatalf("ReadValue: %q, %v", got, err)
+	}
+	if _, err := ReadValue(path, "tier"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("ReadValue of a missing key: %v", err)
+	}
+
+	// A nil edit leaves the file alone, and a failed one too
+	before, _ := os.ReadFile(path)
+	Rewrite(path, func([]string) ([]string, error) { return nil, nil })
+	Rewrite(path, func(lines []string) ([]string, error) { return lines[:1], errors.New("no") })
+	if after, _ := os.ReadFile(path); !bytes.Equal(before, after) {
+		t.Fatalf("file changed to\n%s", after)
+	}
+
+	// Concurrent read-modify-writes don't lose each other's changes
+	const writers = 20
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := Rewrite(path, func(lines []string) ([]string, error) {
+				return append(lines, "written: yes"), nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	m, err := Read(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Lines) != 2+writers {
+		t.Fatalf("%d lines after %d writers:\n%s", len(m.Lines), writers, m.Bytes())
+	}
+}
+
+func TestVersions(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		cmp  int
+	}{
+		{"1.1", "1.1", 0},
+		{"1.0", "1.1", -1},
+		{"1.10", "1.9", 1},
+		{"2.0", "1.99", 1},
+		{"x", "1.0", 1},
+		{"1.0", "1", -1},
+		{"x", "y", 0},
+	} {
+		if got := CompareVersions(tc.a, tc.b); got != tc.cmp {
+			t.Fatalf("CompareVersions(%q, %q) = %d", tc.a, tc.b, got)
+		}
+	}
+	if !Readable("", "1.0") || !Readable("1.0", "1.1") || Readable("1.2", "1.1") || Readable("bogus", "1.1") {
+		t.Fatal("Readable")
+	}
+}
+
+func FuzzJSONRoundTrip(f *testing.F) {
+	f.Add("dataID: abc\nstorage_locations: {\n  shard_0: /a\n}\n")
+	f.Add("a: {\n  b: {\n    c: d\n  }\n}\n}\n  e: f\n")
+	f.Add("\n\n: \n{\n")
+	f.Fuzz(func(t *testing.T, text string) {
+		m, err := Parse(strings.NewReader(text))
+		if err != nil || len(text) > 0 && text[0] == '{' {
+			return
+		}
+		encoded, err := json.Marshal(m)
+		if (err != nil) != !utf8.ValidString(text) {
+			t.Fatalf("%q encoded as %s: %v", text, encoded, err)
+		}
+		if err != nil {
+			return
+		}
+		var back Metadata
+		if err := json.Unmarshal(encoded, &back); err != nil {
+			t.Fatalf("%q encoded as %s: %v", text, encoded, err)
+		}
+		if !slices.Equal(back.Lines, m.Lines) {
+			t.Fatalf("%q read back as %q", m.Lines, back.Lines)
+		}
+	})
+}
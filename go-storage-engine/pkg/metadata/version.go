@@ -0,0 +1,43 @@
+package metadata
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Vault versions, as recorded in min_reader_version, are "major.minor".
+
+// ParseVersion splits a "major.minor" version.
+func ParseVersion(version string) ([2]int, error) {
+	major, minor, ok := strings.Cut(version, ".")
+	x, errX := strconv.Atoi(major)
+	y, errY := strconv.Atoi(minor)
+	if !ok || errX != nil || errY != nil || x < 0 || y < 0 {
+		return [2]int{}, fmt.Errorf("invalid version %q", version)
+	}
+	return [2]int{x, y}, nil
+}
+
+// CompareVersions compares two versions like cmp.Compare. Invalid ones
+// sort after every valid one, so they are never taken as readable.
+func CompareVersions(a, b string) int {
+	va, errA := ParseVersion(a)
+	vb, errB := ParseVersion(b)
+	switch {
+	case errA != nil && errB != nil:
+		return 0
+	case errA != nil:
+		return 1
+	case errB != nil:
+		return -1
+	}
+	return slices.Compare(va[:], vb[:])
+}
+
+// Readable reports whether a reader of version reader can read metadata
+// that requires version required, "" for metadata that records none.
+func Readable(required, reader string) bool {
+	return required == "" || CompareVersions(required, reader) <= 0
+}
@@ -0,0 +1,390 @@
+// Package objectcache keeps the plaintext of retrieved objects on local
+// disk, so retrieving the same object again skips fetching, decoding and
+// decrypting its shards. Entries are keyed by dataID and object size, and
+// every entry's content hash is recorded when it is written and checked
+// before it is used: an entry that doesn't match is discarded. The least
+// recently used entries are evicted past the size cap, except pinned ones.
+//
+// Cached plaintext on disk is what an attacker with access to the
+// directory would go for, so the directory is kept at 0700. With a key,
+// entries are encrypted at rest (AES-CFB with a random IV, as shards are)
+// and their hashes are HMACs under the key, so neither the entries nor
+// the index give the contents away, and a tampered entry can't be made
+// to check out without the key.
+package objectcache
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/techninja8/getvault.io/internal/tmp"
+)
+
+// indexFile holds the cache's entries, in the cache directory.
+const indexFile = "index.json"
+
+var (
+	// ErrCorruptEntry is returned by Get for an entry that doesn't match its
+	// recorded hash. The entry has been removed.
+	ErrCorruptEntry = errors.New("cached object doesn't match its hash")
+	// ErrNotCached is returned when pinning an object that isn't cached.
+	ErrNotCached = errors.New("object is not cached")
+)
+
+// Entry is one cached object.
+type Entry struct {
+	DataID   string    `json:"data_id"`
+	Size     int64     `json:"size"`
+	Hash     string    `json:"hash"` // sha256 of the plaintext, or its HMAC under the key
+	LastUsed time.Time `json:"last_used"`
+	Pinned   bool      `json:"pinned,omitempty"`
+}
+
+// Cache is an object cache in a directory. Its index is saved as JSON;
+// concurrent processes don't merge their changes, the last to save wins,
+// and an entry the index lost track of is simply written again.
+type Cache struct {
+	mu       sync.Mutex
+	dir      string
+	maxBytes int64
+	key      []byte
+	entries  map[string]*Entry
+}
+
+// Open opens the cache in dir, creating it with 0700 permissions, and
+// tightening them if they are looser. Entries are encrypted under key
+// unless it is nil. maxBytes caps the size of the unpinned entries.
+func Open(dir string, maxBytes int64, key []byte) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open cache directory: %w", err)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		if err := os.Chmod(dir, 0700); err != nil {
+			return nil, fmt.Errorf("cache directory %s is open to other users: %w", dir, err)
+		}
+	}
+	// Entries and the index are written through temporary files renamed
+	// into place, which a crashed write leaves behind
+	for _, pattern := range []string{".entry-*", ".index-*"} {
+		if _, err := tmp.RemoveStale(dir, pattern, tmp.DefaultMaxAge); err != nil {
+			return nil, err
+		}
+	}
+	c := &Cache{dir: dir, maxBytes: maxBytes, key: key, entries: make(map[string]*Entry)}
+	data, err := os.ReadFile(filepath.Join(dir, indexFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cache index: %w", err)
+	}
+	var entries []*Entry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("invalid cache index %s: %w", filepath.Join(dir, indexFile), err)
+	}
+	for _, e := range entries {
+		c.entries[e.DataID] = e
+	}
+	return c, nil
+}
+
+// path returns the file an entry is kept in.
+func (c *Cache) path(dataID string) string {
+	return filepath.Join(c.dir, dataID+".obj")
+}
+
+// validID reports whether dataID is fit to name a file: dataIDs are hex,
+// and anything else read from a metadata file isn't cached.
+func validID(dataID string) bool {
+	_, err := hex.DecodeString(dataID)
+	return dataID != "" && err == nil
+}
+
+// newHash returns the hash entries are checked with.
+func (c *Cache) newHash() hash.Hash {
+	if c.key != nil {
+		return hmac.New(sha256.New, c.key)
+	}
+	return sha256.New()
+}
+
+// Get writes the cached object to w and reports whether it was cached. An
+// entry of another size, left by an earlier version of an appended object,
+// counts as missing. The entry is checked against its hash in full before
+// anything is written, so w only ever gets intact data; one that fails is
+// removed, and ErrCorruptEntry returned.
+func (c *Cache) Get(dataID string, size int64, w io.Writer) (bool, error) {
+	c.mu.Lock()
+	e, ok := c.entries[dataID]
+	c.mu.Unlock()
+	if !ok || e.Size != size || !validID(dataID) {
+		return false, nil
+	}
+
+	h := c.newHash()
+	if err := c.read(dataID, h); errors.Is(err, os.ErrNotExist) {
+		return false, c.discard(dataID, nil) // Removed behind the index's back
+	} else if err != nil {
+		return false, c.discard(dataID, err)
+	}
+	if hex.EncodeToString(h.Sum(nil)) != e.Hash {
+		return false, c.discard(dataID, ErrCorruptEntry)
+	}
+	if err := c.read(dataID, w); err != nil {
+		return false, err
+	}
+
+	c.mu.Lock()
+	e.LastUsed = time.Now().UTC()
+	c.evict() // In case the cap was lowered
+	err := c.save()
+	c.mu.Unlock()
+	return true, err
+}
+
+// read decrypts the file of an entry into w.
+func (c *Cache) read(dataID string, w io.Writer) error {
+	file, err := os.Open(c.path(dataID))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var r io.Reader = file
+	if c.key != nil {
+		iv := make([]byte, aes.BlockSize)
+		if _, err := io.ReadFull(file, iv); err != nil {
+			return fmt.Errorf("%w: %v", ErrCorruptEntry, err)
+		}
+		block, err := aes.NewCipher(c.key)
+		if err != nil {
+			return err
+		}
+		r = cipher.StreamReader{S: cipher.NewCFBDecrypter(block, iv), R: file}
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+// discard removes an entry that couldn't be used, returning why.
+func (c *Cache) discard(dataID string, cause error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, dataID)
+	os.Remove(c.path(dataID))
+	return errors.Join(cause, c.save())
+}
+
+// Writer is a cache entry being written. Whatever is written to it is
+// only cached once Commit is called.
+type Writer struct {
+	c      *Cache
+	dataID string
+	file   *os.File
+	w      io.Writer
+	hash   hash.Hash
+	size   int64
+	err    error
+}
+
+// Writer starts caching an object. Write errors don't fail the write the
+// Writer is teed from; they are returned by Commit.
+func (c *Cache) Writer(dataID string) *Writer {
+	cw := &Writer{c: c, dataID: dataID, hash: c.newHash()}
+	if !validID(dataID) {
+		cw.err = fmt.Errorf("invalid dataID %q", dataID)
+		return cw
+	}
+	cw.file, cw.err = os.CreateTemp(c.dir, ".entry-*")
+	if cw.err != nil {
+		return cw
+	}
+	cw.w = cw.file
+	if c.key != nil {
+		iv := make([]byte, aes.BlockSize)
+		block, err := aes.NewCipher(c.key)
+		if err == nil {
+			_, err = rand.Read(iv)
+		}
+		if err == nil {
+			_, err = cw.file.Write(iv)
+		}
+		if err != nil {
+			cw.err = err
+			return cw
+		}
+		cw.w = cipher.StreamWriter{S: cipher.NewCFBEncrypter(block, iv), W: cw.file}
+	}
+	return cw
+}
+
+// Write caches p, always reporting success.
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.err == nil {
+		w.hash.Write(p)
+		w.size += int64(len(p))
+		if w.c.maxBytes > 0 && w.size > w.c.maxBytes {
+			w.err = fmt.Errorf("object is larger than the cache")
+		} else {
+			_, w.err = w.w.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+// Abort drops the entry.
+func (w *Writer) Abort() {
+	if w.file != nil {
+		w.file.Close()
+		os.Remove(w.file.Name())
+	}
+}
+
+// Commit adds the entry to the cache, evicting the least recently used
+// entries if the cache is over its size cap.
+func (w *Writer) Commit() error {
+	if w.err != nil {
+		w.Abort()
+		return w.err
+	}
+	if err := w.file.Close(); err != nil {
+		os.Remove(w.file.Name())
+		return err
+	}
+	c := w.c
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := os.Rename(w.file.Name(), c.path(w.dataID)); err != nil {
+		os.Remove(w.file.Name())
+		return err
+	}
+	pinned := false
+	if e, ok := c.entries[w.dataID]; ok {
+		pinned = e.Pinned
+	}
+	c.entries[w.dataID] = &Entry{
+		DataID:   w.dataID,
+		Size:     w.size,
+		Hash:     hex.EncodeToString(w.hash.Sum(nil)),
+		LastUsed: time.Now().UTC(),
+		Pinned:   pinned,
+	}
+	c.evict()
+	return c.save()
+}
+
+// evict removes the least recently used unpinned entries until those left
+// fit the size cap.
+func (c *Cache) evict() {
+	if c.maxBytes <= 0 {
+		return
+	}
+	var (
+		unpinned []*Entry
+		total    int64
+	)
+	for _, e := range c.entries {
+		if !e.Pinned {
+			unpinned = append(unpinned, e)
+			total += e.Size
+		}
+	}
+	slices.SortFunc(unpinned, func(a, b *Entry) int { return a.LastUsed.Compare(b.LastUsed) })
+	for _, e := range unpinned {
+		if total <= c.maxBytes {
+			break
+		}
+		delete(c.entries, e.DataID)
+		os.Remove(c.path(e.DataID))
+		total -= e.Size
+	}
+}
+
+// List returns the cached entries, most recently used first.
+func (c *Cache) List() []Entry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entries := make([]Entry, 0, len(c.entries))
+	for _, e := range c.entries {
+		entries = append(entries, *e)
+	}
+	slices.SortFunc(entries, func(a, b Entry) int { return b.LastUsed.Compare(a.LastUsed) })
+	return entries
+}
+
+// Pin keeps a cached object from being evicted, or with pinned unset lets
+// it be evicted again.
+func (c *Cache) Pin(dataID string, pinned bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[dataID]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNotCached, dataID)
+	}
+	e.Pinned = pinned
+	c.evict()
+	return c.save()
+}
+
+// Clear removes the cached objects, keeping pinned ones unless all is
+// set, and returns how many it removed.
+func (c *Cache) Clear(all bool) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	removed := 0
+	for id, e := range c.entries {
+		if e.Pinned && !all {
+			continue
+		}
+		if err := os.Remove(c.path(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return removed, err
+		}
+		delete(c.entries, id)
+		removed++
+	}
+	return removed, c.save()
+}
+
+// save writes the index through a temporary file and a rename. The caller
+// holds c.mu.
+func (c *Cache) save() error {
+	entries := make([]*Entry, 0, len(c.entries))
+	for _, e := range c.entries {
+		entries = append(entries, e)
+	}
+	slices.SortFunc(entries, func(a, b *Entry) int { return a.LastUsed.Compare(b.LastUsed) })
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(c.dir, ".index-*")
+	if err != nil {
+		return fmt.Errorf("failed to write cache index: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write cache index: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write cache index: %w", err)
+	}
+	return os.Rename(tmp.Name(), filepath.Join(c.dir, indexFile))
+}
@@ -0,0 +1,149 @@
+package objectcache
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// put caches data under its own sha256 and returns the dataID.
+func put(t *testing.T, c *Cache, data []byte) string {
+	t.Helper()
+	sum := sha256.Sum256(data)
+	dataID := hex.EncodeToString(sum[:])
+	w := c.Writer(dataID)
+	w.Write(data)
+	if err := w.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	return dataID
+}
+
+func randomBytes(t *testing.T, n int) []byte {
+	t.Helper()
+	data := make([]byte, n)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// TestCacheHitAndCorruptEntry caches an object, reads it back, then
+// tampers with it: the tampered entry must be refused before anything is
+// written out, removed, and cached afresh by the next write.
+func TestCacheHitAndCorruptEntry(t *testing.T) {
+	for _, key := range [][]byte{nil, bytes.Repeat([]byte{7}, 32)} {
+		dir := filepath.Join(t.TempDir(), "cache")
+		c, err := Open(dir, 0, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := randomBytes(t, 10_000)
+		dataID := put(t, c, data)
+
+		var out bytes.Buffer
+		if hit, err := c.Get(dataID, int64(len(data)), &out); err != nil || !hit || !bytes.Equal(out.Bytes(), data) {
+			t.Fatalf("key %t: Get returned hit %t with %d bytes, %v", key != nil, hit, out.Len(), err)
+		}
+		// Another size is an older or newer version of the object
+		if hit, err := c.Get(dataID, int64(len(data))+1, &out); err != nil || hit {
+			t.Fatalf("key %t: Get of another size: hit %t, %v", key != nil, hit, err)
+		}
+
+		// Reopened, the index still has the entry
+		if c, err = Open(dir, 0, key); err != nil {
+			t.Fatal(err)
+		}
+		entry := filepath.Join(dir, dataID+".obj")
+		cached, err := os.ReadFile(entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cached[len(cached)-1] ^= 1
+		if err := os.WriteFile(entry, cached, 0600); err != nil {
+			t.Fatal(err)
+		}
+		out.Reset()
+		if hit, err := c.Get(dataID, int64(len(data)), &out); !errors.Is(err, ErrCorruptEntry) || hit || out.Len() != 0 {
+			t.Fatalf("key %t: Get of a tampered entry: hit %t with %d bytes written, %v", key != nil, hit, out.Len(), err)
+		}
+		if _, err := os.Stat(entry); !errors.Is(err, os.ErrNotExist) || len(c.List()) != 0 {
+			t.Fatalf("key %t: tampered entry kept: %v", key != nil, err)
+		}
+
+		put(t, c, data)
+		if hit, err := c.Get(dataID, int64(len(data)), &out); err != nil || !hit || !bytes.Equal(out.Bytes(), data) {
+			t.Fatalf("key %t: Get of the refetched entry: hit %t, %v", key != nil, hit, err)
+		}
+	}
+}
+
+// TestCacheEviction fills a cache past its cap and checks the least
+// recently used unpinned entries go first.
+func TestCacheEviction(t *testing.T) {
+	c, err := Open(t.TempDir(), 25_000, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for i := range 3 {
+		ids = append(ids, put(t, c, randomBytes(t, 10_000)))
+		// Pinned entries don't count towards the cap
+		if i == 0 {
+			if err := c.Pin(ids[0], true); err != nil {
+				t.Fatal(err)
+			}
+		}
+		time.Sleep(time.Millisecond) // Distinct LastUsed times
+	}
+	// Using the second makes the third the least recently used unpinned
+	if hit, err := c.Get(ids[1], 10_000, &bytes.Buffer{}); err != nil || !hit {
+		t.Fatalf("Get: hit %t, %v", hit, err)
+	}
+	time.Sleep(time.Millisecond)
+	fourth := put(t, c, randomBytes(t, 10_000))
+
+	cached := make(map[string]bool)
+	for _, e := range c.List() {
+		cached[e.DataID] = true
+	}
+	if len(cached) != 3 || !cached[ids[0]] || !cached[ids[1]] || cached[ids[2]] || !cached[fourth] {
+		t.Fatalf("cached %v after eviction, expected the pinned, the recently used and the new entry", c.List())
+	}
+	if _, err := os.Stat(c.path(ids[2])); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("evicted entry's file: %v", err)
+	}
+
+	// Objects bigger than the cap aren't cached at all
+	w := c.Writer(ids[2])
+	w.Write(make([]byte, 25_001))
+	if err := w.Commit(); err == nil {
+		t.Fatal("cached an object bigger than the cache")
+	}
+
+	if removed, err := c.Clear(false); err != nil || removed != 2 || len(c.List()) != 1 {
+		t.Fatalf("Clear removed %d, %v", removed, err)
+	}
+	if err := c.Pin(ids[2], true); !errors.Is(err, ErrNotCached) {
+		t.Fatalf("pinning an uncached object: %v", err)
+	}
+}
+
+func TestOpenTightensPermissions(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Chmod(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(dir, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(dir); err != nil || info.Mode().Perm() != 0700 {
+		t.Fatalf("cache directory mode %v, %v", info.Mode().Perm(), err)
+	}
+}
@@ -0,0 +1,221 @@
+package planning
+
+import (
+	"crypto/aes"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var (
+	errInvalidSize        = errors.New("invalid size")
+	errInvalidShards      = errors.New("data shards must be at least 1 and parity shards at least 0")
+	errInvalidReplication = errors.New("replication must be at least 1")
+	errInvalidCompression = errors.New("invalid compression; use none or <algo>:estimated-ratio=<ratio>")
+)
+
+// Params describes how an object would be stored.
+type Params struct {
+	DataShards       int
+	ParityShards     int
+	Replication      int     // Copies of every shard, each on its own location
+	Compression      string  // Compression algorithm, "" or "none" for none
+	CompressionRatio float64 // Expected compressed size divided by input size
+	SegmentSize      int64   // Bytes encrypted and coded at a time when streamed, 0 for one piece
+}
+
+// Plan is the storage footprint of an input under a set of Params.
+type Plan struct {
+	InputBytes             int64   `json:"input_bytes"`
+	Layout                 string  `json:"layout,omitempty"`
+	LayoutReason           string  `json:"layout_reason,omitempty"`
+	Segments               int64   `json:"segments,omitempty"`
+	CompressedBytes        int64   `json:"compressed_bytes"`
+	EncryptedBytes         int64   `json:"encrypted_bytes"`
+	ShardBytes             int64   `json:"shard_bytes"`
+	PaddingBytes           int64   `json:"padding_bytes"`
+	Locations              int     `json:"locations"`
+	StoredBytesPerLocation int64   `json:"stored_bytes_per_location"`
+	TotalStoredBytes       int64   `json:"total_stored_bytes"`
+	OverheadFactor         float64 `json:"overhead_factor"`
+	FaultTolerance         int     `json:"fault_tolerance"`
+	LocationsWithRoom      int     `json:"locations_with_room,omitempty"`
+	Fits                   *bool   `json:"fits,omitempty"`
+}
+
+// Validate checks that the parameters describe a storable layout.
+func (p Params) Validate() error {
+	if p.DataShards < 1 || p.ParityShards < 0 {
+		return errInvalidShards
+	}
+	if p.Replication < 1 {
+		return errInvalidReplication
+	}
+	if p.CompressionRatio <= 0 {
+		return errInvalidCompression
+	}
+	return nil
+}
+
+// ShardSize returns the size of every shard produced for an encoded input
+// of n bytes. The erasure coder splits the input into DataShards equal
+// shards, zero-padding the last one.
+func ShardSize(n int64, dataShards int) int64 {
+	if n <= 0 {
+		return 0
+	}
+	return (n + int64(dataShards) - 1) / int64(dataShards)
+}
+
+// Compute works out the footprint of storing size input bytes.
+func Compute(size int64, p Params) (*Plan, error) {
+	if size < 0 {
+		return nil, errInvalidSize
+	}
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+
+	plan := &Plan{InputBytes: size}
+	plan.CompressedBytes = int64(math.Ceil(float64(size) * p.CompressionRatio))
+	if p.SegmentSize > 0 {
+		plan.computeSegments(p)
+	} else {
+		// Encryption prepends the IV.
+		plan.EncryptedBytes = plan.CompressedBytes + aes.BlockSize
+		plan.ShardBytes = ShardSize(plan.EncryptedBytes, p.DataShards)
+		plan.StoredBytesPerLocation = plan.ShardBytes
+	}
+	plan.PaddingBytes = plan.StoredBytesPerLocation*int64(p.DataShards) - plan.EncryptedBytes
+
+	shards := p.DataShards + p.ParityShards
+	plan.Locations = shards * p.Replication
+	plan.TotalStoredBytes = plan.StoredBytesPerLocation * int64(plan.Locations)
+	if size > 0 {
+		plan.OverheadFactor = float64(plan.TotalStoredBytes) / float64(size)
+	}
+
+	// The object is lost once every copy of ParityShards+1 distinct shards is gone.
+	plan.FaultTolerance = (p.ParityShards+1)*p.Replication - 1
+	return plan, nil
+}
+
+// computeSegments fills in the sizes of a streamed input, where every
+// segment is encrypted with its own IV and coded into shards of its own.
+// ShardBytes is then the largest shard, that of a full segment.
+func (plan *Plan) computeSegments(p Params) {
+	full := plan.CompressedBytes / p.SegmentSize
+	rest := plan.CompressedBytes % p.SegmentSize
+	plan.Segments = full
+	if full > 0 {
+		plan.ShardBytes = ShardSize(p.SegmentSize+aes.BlockSize, p.DataShards)
+		plan.StoredBytesPerLocation = full * plan.ShardBytes
+	}
+	if rest > 0 || full == 0 {
+		plan.Segments++
+		last := ShardSize(rest+aes.BlockSize, p.DataShards)
+		plan.ShardBytes = max(plan.ShardBytes, last)
+		plan.StoredBytesPerLocation += last
+	}
+	plan.EncryptedBytes = plan.CompressedBytes + plan.Segments*aes.BlockSize
+}
+
+// CheckCapacities records whether the plan fits locations with the given
+// capacities, one for each location of the pool, 0 for those whose
+// capacity isn't known, which are taken to have room. Every shard goes to
+// a location of its own, so it fits when there are Locations locations
+// with room for StoredBytesPerLocation. Without any known capacity the
+// plan is left unchecked.
+func (plan *Plan) CheckCapacities(capacities []int64) {
+	known := false
+	plan.LocationsWithRoom = 0
+	for _, capacity := range capacities {
+		known = known || capacity > 0
+		if capacity <= 0 || plan.StoredBytesPerLocation <= capacity {
+			plan.LocationsWithRoom++
+		}
+	}
+	if !known {
+		plan.LocationsWithRoom = 0
+		return
+	}
+	fits := plan.LocationsWithRoom >= plan.Locations
+	plan.Fits = &fits
+}
+
+// ParseCompression parses "none" or "<algo>:estimated-ratio=<ratio>".
+func ParseCompression(s string) (string, float64, error) {
+	if s == "" || s == "none" {
+		return "none", 1, nil
+	}
+	algo, opts, ok := strings.Cut(s, ":")
+	if !ok || algo == "" {
+		return "", 0, errInvalidCompression
+	}
+	value, ok := strings.CutPrefix(opts, "estimated-ratio=")
+	if !ok {
+		return "", 0, errInvalidCompression
+	}
+	ratio, err := strconv.ParseFloat(value, 64)
+	if err != nil || ratio <= 0 {
+		return "", 0, errInvalidCompression
+	}
+	return algo, ratio, nil
+}
+
+var sizeUnits = []struct {
+	suffix string
+	scale  float64
+}{
+	{"KiB", 1 << 10},
+	{"MiB", 1 << 20},
+	{"GiB", 1 << 30},
+	{"TiB", 1 << 40},
+	{"PiB", 1 << 50},
+	{"KB", 1e3},
+	{"MB", 1e6},
+	{"GB", 1e9},
+	{"TB", 1e12},
+	{"PB", 1e15},
+	{"B", 1},
+}
+
+// ParseSize parses a byte count such as "500GiB", "1.5TB" or "1024".
+// Counts that don't fit in an int64 are rejected.
+func ParseSize(input string) (int64, error) {
+	s := strings.TrimSpace(input)
+	scale := 1.0
+	for _, unit := range sizeUnits {
+		if strings.HasSuffix(s, unit.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, unit.suffix))
+			scale = unit.scale
+			break
+		}
+	}
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil || value < 0 || math.IsNaN(value) {
+		return 0, fmt.Errorf("%w: %q", errInvalidSize, input)
+	}
+	// 2^63 is the first float64 past the largest int64
+	n := math.Round(value * scale)
+	if n >= math.MaxInt64 {
+		return 0, fmt.Errorf("%w: %q is more bytes than can be counted", errInvalidSize, input)
+	}
+	return int64(n), nil
+}
+
+// FormatSize renders a byte count using binary units.
+func FormatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.2f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
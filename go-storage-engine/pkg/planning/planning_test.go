@@ -0,0 +1,157 @@
+package planning
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestShardSize(t *testing.T) {
+	for _, tc := range []struct {
+		n, want int64
+		data    int
+	}{
+		{0, 0, 8},
+		{1, 1, 8},
+		{79, 10, 8}, // k·data - 1
+		{80, 10, 8}, // k·data
+		{81, 11, 8}, // k·data + 1
+		{13, 1, 14},
+		{15, 2, 14},
+	} {
+		if got := ShardSize(tc.n, tc.data); got != tc.want {
+			t.Fatalf("ShardSize(%d, %d) = %d, expected %d", tc.n, tc.data, got, tc.want)
+		}
+	}
+}
+
+// TestComputePadding pins the footprint of inputs around the boundaries
+// where the encrypted input, with its 16 byte IV, fills a whole number of
+// shard rows: at n = k·data the shards hold no padding, one byte short of
+// it one byte, and one byte past it a row of padding less one.
+func TestComputePadding(t *testing.T) {
+	p := Params{DataShards: 8, ParityShards: 6, Replication: 1, CompressionRatio: 1}
+	for _, tc := range []struct {
+		size                       int64
+		shard, padding, perLoc     int64
+		segments                   int64
+		segmentSize, encryptedSize int64
+	}{
+		// One piece: 10 shard bytes a location hold 80 encrypted bytes
+		{size: 63, shard: 10, padding: 1, perLoc: 10, encryptedSize: 79},
+		{size: 64, shard: 10, padding: 0, perLoc: 10, encryptedSize: 80},
+		{size: 65, shard: 11, padding: 7, perLoc: 11, encryptedSize: 81},
+		{size: 0, shard: 2, padding: 0, perLoc: 2, encryptedSize: 16},
+		// Segments of 64 bytes, each with an IV of its own
+		{size: 127, segmentSize: 64, segments: 2, shard: 10, padding: 1, perLoc: 20, encryptedSize: 159},
+		{size: 128, segmentSize: 64, segments: 2, shard: 10, padding: 0, perLoc: 20, encryptedSize: 160},
+		{size: 129, segmentSize: 64, segments: 3, shard: 10, padding: 7, perLoc: 23, encryptedSize: 177},
+		{size: 0, segmentSize: 64, segments: 1, shard: 2, padding: 0, perLoc: 2, encryptedSize: 16},
+	} {
+		p.SegmentSize = tc.segmentSize
+		plan, err := Compute(tc.size, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if plan.ShardBytes != tc.shard || plan.PaddingBytes != tc.padding || plan.StoredBytesPerLocation != tc.perLoc ||
+			plan.Segments != tc.segments || plan.EncryptedBytes != tc.encryptedSize {
+			t.Fatalf("%d bytes in segments of %d: %+v, expected shards of %d, %d padding, %d per location, %d segments, %d encrypted",
+				tc.size, tc.segmentSize, plan, tc.shard, tc.padding, tc.perLoc, tc.segments, tc.encryptedSize)
+		}
+		if plan.Locations != 14 || plan.TotalStoredBytes != 14*tc.perLoc || plan.FaultTolerance != 6 {
+			t.Fatalf("%d bytes: %d locations storing %d, tolerating %d", tc.size, plan.Locations, plan.TotalStoredBytes, plan.FaultTolerance)
+		}
+	}
+}
+
+func TestComputeReplicationAndCompression(t *testing.T) {
+	plan, err := Compute(1000, Params{DataShards: 4, ParityShards: 2, Replication: 2, CompressionRatio: 0.5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 500 compressed bytes, 516 encrypted, in shards of 129
+	if plan.CompressedBytes != 500 || plan.EncryptedBytes != 516 || plan.ShardBytes != 129 {
+		t.Fatalf("compressed %d, encrypted %d, shards of %d", plan.CompressedBytes, plan.EncryptedBytes, plan.ShardBytes)
+	}
+	if plan.Locations != 12 || plan.TotalStoredBytes != 12*129 || plan.OverheadFactor != 12*129/1000.0 {
+		t.Fatalf("%d locations storing %d, overhead %v", plan.Locations, plan.TotalStoredBytes, plan.OverheadFactor)
+	}
+	// Every copy of 3 distinct shards has to go
+	if plan.FaultTolerance != 5 {
+		t.Fatalf("tolerates %d lost locations, expected 5", plan.FaultTolerance)
+	}
+}
+
+func TestComputeRejects(t *testing.T) {
+	for _, p := range []Params{
+		{DataShards: 0, ParityShards: 6, Replication: 1, CompressionRatio: 1},
+		{DataShards: 8, ParityShards: -1, Replication: 1, CompressionRatio: 1},
+		{DataShards: 8, ParityShards: 6, Replication: 0, CompressionRatio: 1},
+		{DataShards: 8, ParityShards: 6, Replication: 1, CompressionRatio: 0},
+	} {
+		if _, err := Compute(100, p); err == nil {
+			t.Fatalf("Compute accepted %+v", p)
+		}
+	}
+	if _, err := Compute(-1, Params{DataShards: 8, Replication: 1, CompressionRatio: 1}); !errors.Is(err, errInvalidSize) {
+		t.Fatalf("Compute of a negative size returned %v", err)
+	}
+}
+
+func TestCheckCapacities(t *testing.T) {
+	plan, err := Compute(64, Params{DataShards: 2, ParityShards: 1, Replication: 1, CompressionRatio: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 3 locations of 40 bytes each needed
+	for _, tc := range []struct {
+		capacities []int64
+		fits       *bool
+		withRoom   int
+	}{
+		{nil, nil, 0},
+		{[]int64{0, 0, 0, 0}, nil, 0},
+		{[]int64{40, 40, 40}, ptr(true), 3},
+		{[]int64{40, 39, 40}, ptr(false), 2},
+		{[]int64{40, 39, 40, 100}, ptr(true), 3},
+		{[]int64{40, 0, 40}, ptr(true), 3},
+	} {
+		plan.Fits = nil
+		plan.CheckCapacities(tc.capacities)
+		if (plan.Fits == nil) != (tc.fits == nil) || (plan.Fits != nil && *plan.Fits != *tc.fits) || plan.LocationsWithRoom != tc.withRoom {
+			t.Fatalf("capacities %v: fits %v with %d locations with room, expected %v with %d", tc.capacities, plan.Fits, plan.LocationsWithRoom, tc.fits, tc.withRoom)
+		}
+	}
+}
+
+func ptr[T any](v T) *T { return &v }
+
+func TestParseSize(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want int64
+	}{
+		{"1024", 1024},
+		{"500GiB", 500 << 30},
+		{"1.5TB", 1_500_000_000_000},
+		{" 2 MiB ", 2 << 20},
+		{"7B", 7},
+		{"8EiB", 0}, // No such unit
+		{"8191PiB", 8191 << 50},
+	} {
+		got, err := ParseSize(tc.in)
+		if tc.want == 0 {
+			if err == nil {
+				t.Fatalf("ParseSize(%q) = %d, expected an error", tc.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Fatalf("ParseSize(%q) = %d, %v, expected %d", tc.in, got, err, tc.want)
+		}
+	}
+	for _, in := range []string{"", "-1", "GiB", "NaN", "Inf", "8192PiB", "1e30PiB", "1e19"} {
+		if got, err := ParseSize(in); !errors.Is(err, errInvalidSize) {
+			t.Fatalf("ParseSize(%q) = %d, %v, expected it rejected", in, got, err)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+// Package plumbing defines the records `vault plumbing` writes for other
+// programs. Each command writes newline-delimited JSON, one record per
+// line, and every record carries "schema_version" and "type" fields.
+//
+// Schema version 1:
+//
+//	type "object" (plumbing list), one per metadata file:
+//	  metadata_file, data_id, filename, filename_b64 (the filename's bytes
+//	  in base64 when they aren't UTF-8; omitted otherwise), size (of the
+//	  zip archive for a directory), tree_files and tree_size (files and
+//	  bytes of a directory stored; omitted otherwise), format, created,
+//	  layout, tier,
+//	  last_access (omitted if never retrieved), preview (dataID of
+//	  the object's preview; omitted if none), preview_of (dataID of the
+//	  object a preview belongs to; omitted unless it is a preview), error
+//	  (omitted unless the metadata couldn't be read)
+//
+//	type "object_health" (plumbing health), one per metadata file:
+//	  metadata_file, data_id, health ("healthy", "degraded" or
+//	  "unrecoverable"; omitted on error), shards (index, location,
+//	  present, verified), error
+//
+//	type "location" (plumbing locations), one per location with history:
+//	  location, status ("healthy" or "unhealthy"), score, success_rate,
+//	  latency_ms, successes, failures, last_failure (omitted if none),
+//	  corruptions (corrupt shards quarantined), replace_disk (true once
+//	  enough were found that the disk should be replaced; omitted
+//	  otherwise)
+//
+// testdata/records.ndjson has a record of each type as written.
+//
+// Within a schema version fields are only ever added, never renamed,
+// removed or given a new meaning, so consumers should ignore fields they
+// don't know. Anything else bumps SchemaVersion.
+package plumbing
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"time"
+	"unicode/utf8"
+
+	"github.com/techninja8/getvault.io/pkg/datastorage"
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+// SchemaVersion is the version of the record schema described above.
+const SchemaVersion = 1
+
+// ObjectRecord describes a stored object.
+type ObjectRecord struct {
+	SchemaVersion int        `json:"schema_version"`
+	Type          string     `json:"type"`
+	MetadataFile  string     `json:"metadata_file"`
+	DataID        string     `json:"data_id"`
+	Filename      string     `json:"filename"`
+	FilenameB64   string     `json:"filename_b64,omitempty"` // Bytes of a filename that isn't UTF-8, which filename can't hold
+	Size          int64      `json:"size"`
+	TreeFiles     *int64     `json:"tree_files,omitempty"` // Files of the directory a zip archive was made of
+	TreeSize      *int64     `json:"tree_size,omitempty"`  // Bytes in those files
+	Format        string     `json:"format"`
+	Created       string     `json:"created"`
+	Layout        string     `json:"layout"`
+	Tier          string     `json:"tier"`
+	LastAccess    *time.Time `json:"last_access,omitempty"`
+	Preview       string     `json:"preview,omitempty"`
+	PreviewOf     string     `json:"preview_of,omitempty"`
+	Error         string     `json:"error,omitempty"`
+}
+
+// Object converts a catalog entry to its record.
+func Object(info datastorage.ObjectInfo) ObjectRecord {
+	record := ObjectRecord{
+		SchemaVersion: SchemaVersion,
+		Type:          "object",
+		MetadataFile:  info.MetadataFile,
+		DataID:        info.DataID,
+		Filename:      info.Filename,
+		Size:          info.Size,
+		Format:        info.Format,
+		Created:       info.Created,
+		Layout:        info.Layout,
+		Tier:          info.Tier,
+		LastAccess:    info.LastAccess,
+		Preview:       info.Preview,
+		PreviewOf:     info.PreviewOf,
+		Error:         info.Error,
+	}
+	if !utf8.ValidString(info.Filename) {
+		record.FilenameB64 = base64.StdEncoding.EncodeToString([]byte(info.Filename))
+	}
+	if info.Tree != nil {
+		record.TreeFiles, record.TreeSize = &info.Tree.Files, &info.Tree.Bytes
+	}
+	return record
+}
+
+// ShardRecord is the health of one shard of an object.
+type ShardRecord struct {
+	Index    int    `json:"index"`
+	Location string `json:"location"`
+	Present  bool   `json:"present"`
+	Verified bool   `json:"verified"`
+}
+
+// HealthRecord is the verification result of an object.
+type HealthRecord struct {
+	SchemaVersion int           `json:"schema_version"`
+	Type          string        `json:"type"`
+	MetadataFile  string        `json:"metadata_file"`
+	DataID        string        `json:"data_id"`
+	Health        string        `json:"health,omitempty"`
+	Shards        []ShardRecord `json:"shards"`
+	Error         string        `json:"error,omitempty"`
+}
+
+// Health converts a verification report to its record.
+func Health(report *datastorage.VerifyReport) HealthRecord {
+	record := HealthRecord{
+		SchemaVersion: SchemaVersion,
+		Type:          "object_health",
+		MetadataFile:  report.MetadataFile,
+		DataID:        report.DataID,
+		Health:        string(report.Health),
+		Shards:        make([]ShardRecord, len(report.Shards)),
+		Error:         report.Error,
+	}
+	for i, shard := range report.Shards {
+		record.Shards[i] = ShardRecord{Index: shard.Index, Location: shard.Location, Present: shard.Present, Verified: shard.Verified}
+	}
+	return record
+}
+
+// LocationRecord is the health of a storage location.
+type LocationRecord struct {
+	SchemaVersion int        `json:"schema_version"`
+	Type          string     `json:"type"`
+	Location      string     `json:"location"`
+	Status        string     `json:"status"`
+	Score         float64    `json:"score"`
+	SuccessRate   float64    `json:"success_rate"`
+	LatencyMs     float64    `json:"latency_ms"`
+	Successes     int64      `json:"successes"`
+	Failures      int64      `json:"failures"`
+	LastFailure   *time.Time `json:"last_failure,omitempty"`
+	Corruptions   int64      `json:"corruptions"`
+	ReplaceDisk   bool       `json:"replace_disk,omitempty"` // Enough corrupt shards were found that the disk should go
+}
+
+// Location converts a location's health record to its record.
+func Location(location string, h sharding.LocationHealth) LocationRecord {
+	record := LocationRecord{
+		SchemaVersion: SchemaVersion,
+		Type:          "location",
+		Location:      location,
+		Status:        "healthy",
+		Score:         h.Score(),
+		SuccessRate:   h.SuccessRate,
+		LatencyMs:     h.LatencyMs,
+		Successes:     h.Successes,
+		Failures:      h.Failures,
+		Corruptions:   h.Corruptions,
+		ReplaceDisk:   h.NeedsReplacing(),
+	}
+	if record.Score < sharding.HealthyScore {
+		record.Status = "unhealthy"
+	}
+	if !h.LastFailure.IsZero() {
+		lastFailure := h.LastFailure
+		record.LastFailure = &lastFailure
+	}
+	return record
+}
+
+// Encoder writes records as newline-delimited JSON.
+type Encoder struct {
+	enc *json.Encoder
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{enc: json.NewEncoder(w)}
+}
+
+// Encode writes one record on its own line.
+func (e *Encoder) Encode(record any) error {
+	return e.enc.Encode(record)
+}
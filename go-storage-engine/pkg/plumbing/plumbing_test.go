@@ -0,0 +1,121 @@
+package plumbing
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/techninja8/getvault.io/pkg/datastorage"
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden NDJSON file")
+
+// goldenFile holds the records of goldenRecords as the commands write
+// them. It only changes when fields are added, or with SchemaVersion.
+const goldenFile = "testdata/records.ndjson"
+
+// goldenRecords are a record of each type with every field set, and with
+// every field that can be left out left out.
+func goldenRecords() []any {
+	created := time.Date(2026, 3, 1, 12, 30, 0, 0, time.UTC)
+	return []any{
+		Object(datastorage.ObjectInfo{
+			MetadataFile: "/vault/metadata/report.vmd",
+			DataID:       "5d41402abc4b2a76b9719d911017c592",
+			Filename:     "report.pdf",
+			Size:         1 << 20,
+			Format:       "text",
+			Created:      "2026-03-01T12:00:00Z",
+			Layout:       "streaming",
+			Tier:         "hot",
+			LastAccess:   &created,
+			Preview:      "7d793037a0760186574b0282f2f435e7",
+		}),
+		Object(datastorage.ObjectInfo{
+			MetadataFile: "/vault/metadata/photos.vmd",
+			DataID:       "7d793037a0760186574b0282f2f435e7",
+			Filename:     "caf\xe9.zip",
+			Size:         5000,
+			Tree:         &datastorage.TreeStats{Files: 3, Bytes: 4096},
+			Format:       "json",
+			Created:      "2026-03-01T12:10:00Z",
+			Layout:       "in-memory",
+			Tier:         "cold",
+			PreviewOf:    "5d41402abc4b2a76b9719d911017c592",
+		}),
+		Object(datastorage.ObjectInfo{MetadataFile: "/vault/metadata/broken.vmd", Error: "invalid metadata"}),
+		Health(&datastorage.VerifyReport{
+			MetadataFile: "/vault/metadata/report.vmd",
+			DataID:       "5d41402abc4b2a76b9719d911017c592",
+			Health:       datastorage.ObjectDegraded,
+			Shards: []datastorage.ShardCheck{
+				{Index: 0, Location: "/mnt/disk0", Present: true, Verified: true, Depth: "checksum"},
+				{Index: 1, Location: "/mnt/disk1", Present: false},
+			},
+		}),
+		Health(&datastorage.VerifyReport{MetadataFile: "/vault/metadata/broken.vmd", Error: "invalid metadata"}),
+		Location("/mnt/disk0", sharding.LocationHealth{Successes: 990, Failures: 10, SuccessRate: 0.99, LatencyMs: 2.5, LastFailure: created, Corruptions: sharding.ReplaceAfterCorruptions}),
+		Location("/mnt/disk1", sharding.LocationHealth{Successes: 0, Failures: 20, SuccessRate: 0, LatencyMs: 0}),
+	}
+}
+
+// TestGoldenRecords locks the records' format: field names, order and
+// which are left out when empty. Run with -update to rewrite the golden
+// file after adding a field.
+func TestGoldenRecords(t *testing.T) {
+	var out bytes.Buffer
+	enc := NewEncoder(&out)
+	for _, record := range goldenRecords() {
+		if err := enc.Encode(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if *update {
+		if err := os.WriteFile(goldenFile, out.Bytes(), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	golden, err := os.ReadFile(goldenFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), golden) {
+		t.Fatalf("records encoded as\n%s\nexpected %s", out.Bytes(), goldenFile)
+	}
+}
+
+// TestRecordsAreVersioned checks that every line of the golden file is a
+// JSON object of its own with the schema version and a record type.
+func TestRecordsAreVersioned(t *testing.T) {
+	file, err := os.Open(goldenFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	types := map[string]int{}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		var record struct {
+			SchemaVersion *int   `json:"schema_version"`
+			Type          string `json:"type"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("line %d: %v", line, err)
+		}
+		if record.SchemaVersion == nil || *record.SchemaVersion != SchemaVersion {
+			t.Fatalf("line %d: schema_version %v, expected %d", line, record.SchemaVersion, SchemaVersion)
+		}
+		types[record.Type]++
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(types) != 3 || types["object"] != 3 || types["object_health"] != 2 || types["location"] != 2 {
+		t.Fatalf("record types %v", types)
+	}
+}
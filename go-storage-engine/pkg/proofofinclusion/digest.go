@@ -0,0 +1,78 @@
+package proofofinclusion
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// The digest scheme builds the tree over the sha256 of each shard rather
+// than the shards themselves. A path then proves a digest, so checking a
+// shard only takes hashing it and walking its path to the root; nobody
+// needs the other shards, or even the shard, to check a digest.
+
+var errInvalidPath = errors.New("invalid Merkle path")
+
+// ShardDigests returns the sha256 of every shard, hashing large inputs concurrently.
+func ShardDigests(shards [][]byte) [][]byte {
+	return hashLeaves(shards)
+}
+
+// BuildDigestTree constructs a Merkle tree over shard digests.
+func BuildDigestTree(digests [][]byte) (*Tree, error) {
+	return newTree(digests)
+}
+
+// DigestPath returns the path from leaf i to the tree root, formatted as
+// space-separated "L:<hex>" or "R:<hex>" siblings from the leaf up.
+func DigestPath(tree *Tree, i int) (string, error) {
+	if i < 0 || i >= tree.Leaves() {
+		return "", fmt.Errorf("leaf %d is not in the tree", i)
+	}
+	path, indices := tree.path(i)
+	steps := make([]string, len(path))
+	for i, sibling := range path {
+		side := "L"
+		if indices[i] == 1 {
+			side = "R"
+		}
+		steps[i] = side + ":" + hex.EncodeToString(sibling)
+	}
+	return strings.Join(steps, " "), nil
+}
+
+// VerifyDigest reports whether path leads from digest to root.
+func VerifyDigest(digest []byte, path string, root []byte) (bool, error) {
+	current := digest
+	for _, step := range strings.Fields(path) {
+		side, value, ok := strings.Cut(step, ":")
+		if !ok {
+			return false, errInvalidPath
+		}
+		sibling, err := hex.DecodeString(value)
+		if err != nil {
+			return false, errInvalidPath
+		}
+		var joined []byte
+		switch side {
+		case "L":
+			joined = append(append(joined, sibling...), current...)
+		case "R":
+			joined = append(append(joined, current...), sibling...)
+		default:
+			return false, errInvalidPath
+		}
+		sum := sha256.Sum256(joined)
+		current = sum[:]
+	}
+	return bytes.Equal(current, root), nil
+}
+
+// VerifyShard hashes a shard and reports whether path leads from its digest to root.
+func VerifyShard(shard []byte, path string, root []byte) (bool, error) {
+	digest := sha256.Sum256(shard)
+	return VerifyDigest(digest[:], path, root)
+}
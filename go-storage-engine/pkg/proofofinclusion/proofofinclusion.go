@@ -3,42 +3,144 @@ package proofofinclusion
 import (
 	"crypto/sha256"
 	"fmt"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+)
 
-	"github.com/cbergoon/merkletree"
+// parallelHashBytes is the total leaf size above which leaves are hashed
+// concurrently; parallelHashLeaves does the same for many small leaves.
+const (
+	parallelHashBytes  = 1 << 20
+	parallelHashLeaves = 256
 )
 
-// Content implements the merkletree.Content interface.
-type Content struct {
-	data []byte
+// BuildMerkleTree constructs a Merkle tree from the provided data slices.
+// Leaf hashes are computed up front, concurrently for large inputs, since
+// hashing the leaves is what dominates for shard-sized data. A nil slice is
+// a leaf like any other, the sha256 of no bytes, the same as an empty one.
+func BuildMerkleTree(dataSlices [][]byte) (*Tree, error) {
+	return newTree(hashLeaves(dataSlices))
 }
 
-func (c Content) CalculateHash() ([]byte, error) {
-	h := sha256.Sum256(c.data)
-	return h[:], nil
+// GetProof returns a textual representation of the Merkle proof for a given
+// content, or of an empty proof if the content isn't in the tree. Content
+// is found by its hash, so leaves with the same content, such as several
+// nil or empty slices, all get the proof of the first of them; GetProofAt
+// tells them apart.
+func GetProof(tree *Tree, content []byte) (string, error) {
+	hash := sha256.Sum256(content)
+	return formatProof(tree.path(tree.leafIndex(hash[:])))
 }
 
-func (c Content) Equals(other merkletree.Content) (bool, error) {
-	return string(c.data) == string(other.(Content).data), nil
+// GetProofAt returns the proof of leaf i in GetProof's format.
+func GetProofAt(tree *Tree, i int) (string, error) {
+	if i < 0 || i >= tree.Leaves() {
+		return "", fmt.Errorf("leaf %d is not in the tree", i)
+	}
+	return formatProof(tree.path(i))
 }
 
-// BuildMerkleTree constructs a Merkle tree from the provided data slices.
-func BuildMerkleTree(dataSlices [][]byte) (*merkletree.MerkleTree, error) {
-	var list []merkletree.Content
-	for _, d := range dataSlices {
-		list = append(list, Content{data: d})
+func formatProof(proof [][]byte, indices []int64) (string, error) {
+	return fmt.Sprintf("proof: %v, indices: %v", proof, indices), nil
+}
+
+// ProofRoot returns the root a proof in GetProof's format leads to from
+// content. Checking a leaf this way needs neither the tree nor the other
+// leaves, only a root to compare with.
+func ProofRoot(content []byte, proof string) ([]byte, error) {
+	rest, ok := strings.CutPrefix(proof, "proof: [")
+	if !ok {
+		return nil, errInvalidPath
+	}
+	siblingsText, indicesText, ok := strings.Cut(rest, "], indices: [")
+	if !ok {
+		return nil, errInvalidPath
+	}
+	if indicesText, ok = strings.CutSuffix(indicesText, "]"); !ok {
+		return nil, errInvalidPath
+	}
+	var siblings [][]byte
+	if siblingsText != "" {
+		if !strings.HasPrefix(siblingsText, "[") || !strings.HasSuffix(siblingsText, "]") {
+			return nil, errInvalidPath
+		}
+		for _, text := range strings.Split(siblingsText[1:len(siblingsText)-1], "] [") {
+			var sibling []byte
+			for _, field := range strings.Fields(text) {
+				b, err := strconv.ParseUint(field, 10, 8)
+				if err != nil {
+					return nil, errInvalidPath
+				}
+				sibling = append(sibling, byte(b))
+			}
+			siblings = append(siblings, sibling)
+		}
 	}
-	tree, err := merkletree.NewTree(list)
-	if err != nil {
-		return nil, err
+	sides := strings.Fields(indicesText)
+	if len(sides) != len(siblings) {
+		return nil, errInvalidPath
 	}
-	return tree, nil
+
+	current := sha256.Sum256(content)
+	for i, sibling := range siblings {
+		var joined []byte
+		switch sides[i] {
+		case "1":
+			joined = append(append(joined, current[:]...), sibling...)
+		case "0":
+			joined = append(append(joined, sibling...), current[:]...)
+		default:
+			return nil, errInvalidPath
+		}
+		current = sha256.Sum256(joined)
+	}
+	return current[:], nil
 }
 
-// GetProof returns a textual representation of the Merkle proof for a given content.
-func GetProof(tree *merkletree.MerkleTree, content []byte) (string, error) {
-	proof, indices, err := tree.GetMerklePath(Content{data: content})
-	if err != nil {
-		return "", err
+// hashLeaves returns the sha256 of every data slice, in one preallocated
+// buffer. Each hash has its capacity capped at its length, so appending to
+// one can't clobber the next.
+func hashLeaves(dataSlices [][]byte) [][]byte {
+	buf := make([]byte, len(dataSlices)*sha256.Size)
+	hashes := make([][]byte, len(dataSlices))
+	hashOne := func(i int) {
+		h := sha256.Sum256(dataSlices[i])
+		hashes[i] = buf[i*sha256.Size : (i+1)*sha256.Size : (i+1)*sha256.Size]
+		copy(hashes[i], h[:])
 	}
-	return fmt.Sprintf("proof: %v, indices: %v", proof, indices), nil
+
+	total := 0
+	for _, d := range dataSlices {
+		total += len(d)
+	}
+	workers := runtime.GOMAXPROCS(0)
+	if workers < 2 || len(dataSlices) < 2 || (total < parallelHashBytes && len(dataSlices) < parallelHashLeaves) {
+		for i := range dataSlices {
+			hashOne(i)
+		}
+		return hashes
+	}
+	if workers > len(dataSlices) {
+		workers = len(dataSlices)
+	}
+
+	var wg sync.WaitGroup
+	jobs := make(chan int, len(dataSlices))
+	for i := range dataSlices {
+		jobs <- i
+	}
+	close(jobs)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				hashOne(i)
+			}
+		}()
+	}
+	wg.Wait()
+	return hashes
 }
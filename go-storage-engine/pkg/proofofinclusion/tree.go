@@ -0,0 +1,122 @@
+package proofofinclusion
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"runtime"
+	"sync"
+)
+
+// parallelTreeNodes is the number of nodes in a level above which the
+// level's parents are hashed concurrently.
+const parallelTreeNodes = 4096
+
+var errEmptyTree = errors.New("cannot construct a Merkle tree with no leaves")
+
+// Tree is a Merkle tree over leaf hashes, kept as a slice of levels from
+// the leaves up to the root. Each level is hashed into a single
+// preallocated buffer, and parents are written into their own slots rather
+// than appended, so no hash ever shares spare capacity with another.
+//
+// It is built the way merkletree.NewTree builds its trees: an odd node at
+// the end of a level is paired with itself. Roots and paths match those of
+// trees built with it, so proofs recorded before Tree existed still check.
+type Tree struct {
+	levels [][][]byte
+}
+
+// newTree builds the tree over leaf hashes.
+func newTree(leaves [][]byte) (*Tree, error) {
+	if len(leaves) == 0 {
+		return nil, errEmptyTree
+	}
+	t := &Tree{levels: [][][]byte{leaves}}
+	for level := leaves; len(level) > 1 || len(t.levels) == 1; {
+		level = hashLevel(level)
+		t.levels = append(t.levels, level)
+	}
+	return t, nil
+}
+
+// hashLevel returns the parents of a level's nodes.
+func hashLevel(level [][]byte) [][]byte {
+	n := (len(level) + 1) / 2
+	buf := make([]byte, n*sha256.Size)
+	parents := make([][]byte, n)
+	hashRange := func(from, to int) {
+		var pair [2 * sha256.Size]byte
+		for p := from; p < to; p++ {
+			left, right := level[2*p], level[2*p]
+			if 2*p+1 < len(level) {
+				right = level[2*p+1]
+			}
+			joined := append(append(pair[:0], left...), right...)
+			sum := sha256.Sum256(joined)
+			parents[p] = buf[p*sha256.Size : (p+1)*sha256.Size : (p+1)*sha256.Size]
+			copy(parents[p], sum[:])
+		}
+	}
+
+	workers := runtime.GOMAXPROCS(0)
+	if workers < 2 || len(level) < parallelTreeNodes {
+		hashRange(0, n)
+		return parents
+	}
+	chunk := (n + workers - 1) / workers
+	var wg sync.WaitGroup
+	for from := 0; from < n; from += chunk {
+		wg.Add(1)
+		go func(from, to int) {
+			defer wg.Done()
+			hashRange(from, to)
+		}(from, min(from+chunk, n))
+	}
+	wg.Wait()
+	return parents
+}
+
+// MerkleRoot returns the root hash.
+func (t *Tree) MerkleRoot() []byte {
+	return t.levels[len(t.levels)-1][0]
+}
+
+// Leaves returns the number of leaves.
+func (t *Tree) Leaves() int {
+	return len(t.levels[0])
+}
+
+// path returns the siblings on the way from leaf i to the root, with 1
+// for a sibling on the right and 0 for one on the left, or none if i is
+// -1. Like merkletree's GetMerklePath, a node equal to its left sibling
+// counts as the left node.
+func (t *Tree) path(i int) ([][]byte, []int64) {
+	if i < 0 {
+		return nil, nil
+	}
+	var siblings [][]byte
+	var sides []int64
+	for _, level := range t.levels[:len(t.levels)-1] {
+		left, right := level[i&^1], level[i&^1]
+		if i|1 < len(level) {
+			right = level[i|1]
+		}
+		if bytes.Equal(left, level[i]) {
+			siblings, sides = append(siblings, right), append(sides, 1)
+		} else {
+			siblings, sides = append(siblings, left), append(sides, 0)
+		}
+		i /= 2
+	}
+	return siblings, sides
+}
+
+// leafIndex returns the first leaf with hash, or -1.
+func (t *Tree) leafIndex(hash []byte) int {
+	for i, leaf := range t.levels[0] {
+		if bytes.Equal(leaf, hash) {
+			return i
+		}
+	}
+	return -1
+}
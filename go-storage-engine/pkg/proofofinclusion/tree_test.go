@@ -0,0 +1,214 @@
+package proofofinclusion
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	"github.com/cbergoon/merkletree"
+)
+
+// leaf is a merkletree.Content holding a precomputed hash, for building
+// the sequential reference trees.
+type leaf []byte
+
+func (l leaf) CalculateHash() ([]byte, error) { return l, nil }
+func (l leaf) Equals(other merkletree.Content) (bool, error) {
+	return bytes.Equal(l, other.(leaf)), nil
+}
+
+// testDigests returns n distinct digests, each in its own array.
+func testDigests(n int) [][]byte {
+	digests := make([][]byte, n)
+	for i := range digests {
+		var seed [8]byte
+		binary.BigEndian.PutUint64(seed[:], uint64(i))
+		sum := sha256.Sum256(seed[:])
+		digests[i] = sum[:]
+	}
+	return digests
+}
+
+func referenceTree(t testing.TB, digests [][]byte) *merkletree.MerkleTree {
+	t.Helper()
+	list := make([]merkletree.Content, len(digests))
+	for i, digest := range digests {
+		list[i] = leaf(bytes.Clone(digest))
+	}
+	tree, err := merkletree.NewTree(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tree
+}
+
+func TestTreeMatchesSequentialTree(t *testing.T) {
+	sizes := []int{1, 2, 3, 4, 5, 7, 8, 9, 31, 33, 100, parallelTreeNodes - 1, parallelTreeNodes + 3, 3 * parallelTreeNodes}
+	for _, n := range sizes {
+		t.Run(fmt.Sprint(n), func(t *testing.T) {
+			digests := testDigests(n)
+			reference := referenceTree(t, digests)
+			tree, err := BuildDigestTree(digests)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(tree.MerkleRoot(), reference.MerkleRoot()) {
+				t.Fatalf("root %x, sequential tree has %x", tree.MerkleRoot(), reference.MerkleRoot())
+			}
+			for i := 0; i < n; i += max(1, n/50) {
+				path, sides := tree.path(i)
+				want, wantSides, err := reference.GetMerklePath(leaf(digests[i]))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if fmt.Sprint(path, sides) != fmt.Sprint(want, wantSides) {
+					t.Fatalf("leaf %d: path differs from the sequential tree's", i)
+				}
+				text, err := DigestPath(tree, i)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if ok, err := VerifyDigest(digests[i], text, tree.MerkleRoot()); err != nil || !ok {
+					t.Fatalf("leaf %d: path doesn't verify (%v)", i, err)
+				}
+			}
+		})
+	}
+}
+
+func TestRawProofsMatchSequentialTree(t *testing.T) {
+	shards := [][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("a"), nil}
+	list := make([]merkletree.Content, len(shards))
+	for i, shard := range shards {
+		sum := sha256.Sum256(shard)
+		list[i] = leaf(sum[:])
+	}
+	reference, err := merkletree.NewTree(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := BuildMerkleTree(shards)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, shard := range shards {
+		// Proofs recorded under the raw scheme are compared as text
+		proof, indices, _ := reference.GetMerklePath(list[i])
+		want := fmt.Sprintf("proof: %v, indices: %v", proof, indices)
+		if got, _ := GetProof(tree, shard); got != want {
+			t.Fatalf("shard %d: proof %q, sequential tree gives %q", i, got, want)
+		}
+	}
+}
+
+func TestTreeDoesNotAliasLeaves(t *testing.T) {
+	// Digests packed into one array, each with the rest of the array as
+	// spare capacity: appending to any of them would overwrite the next.
+	const n = 9
+	packed := make([]byte, n*sha256.Size)
+	digests := make([][]byte, n)
+	for i, digest := range testDigests(n) {
+		copy(packed[i*sha256.Size:], digest)
+		digests[i] = packed[i*sha256.Size : (i+1)*sha256.Size]
+	}
+	before := bytes.Clone(packed)
+	reference := referenceTree(t, digests)
+
+	tree, err := BuildDigestTree(digests)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(packed, before) {
+		t.Fatal("building the tree wrote into the leaf buffers")
+	}
+	if !bytes.Equal(tree.MerkleRoot(), reference.MerkleRoot()) {
+		t.Fatal("root differs from the sequential tree's")
+	}
+
+	// Hashes the tree hands out don't share capacity with each other
+	for _, level := range tree.levels[1:] {
+		for i, hash := range level {
+			if cap(hash) != len(hash) {
+				t.Fatalf("node %d has capacity %d beyond its %d bytes", i, cap(hash), len(hash))
+			}
+		}
+	}
+	for i, hash := range hashLeaves(make([][]byte, n)) {
+		if cap(hash) != len(hash) {
+			t.Fatalf("leaf hash %d has capacity %d beyond its %d bytes", i, cap(hash), len(hash))
+		}
+	}
+}
+
+func BenchmarkBuildDigestTree(b *testing.B) {
+	for _, n := range []int{1_000, 10_000, 100_000} {
+		digests := testDigests(n)
+		b.Run(fmt.Sprintf("leaves=%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := BuildDigestTree(digests); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("leaves=%d/sequential", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				referenceTree(b, digests)
+			}
+		})
+	}
+}
+
+func TestProofsWithNilLeaves(t *testing.T) {
+	shards := [][]byte{[]byte("a"), nil, []byte("b"), nil, {}, []byte("c")}
+	tree, err := BuildMerkleTree(shards)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := BuildMerkleTree(shards)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(tree.MerkleRoot(), again.MerkleRoot()) {
+		t.Fatal("the same shards built different roots")
+	}
+
+	proofs := make([]string, len(shards))
+	for i, shard := range shards {
+		if proofs[i], err = GetProofAt(tree, i); err != nil {
+			t.Fatalf("GetProofAt(%d): %v", i, err)
+		}
+		if proof, _ := GetProofAt(again, i); proof != proofs[i] {
+			t.Fatalf("leaf %d: proof changed between builds", i)
+		}
+		root, err := ProofRoot(shard, proofs[i])
+		if err != nil || !bytes.Equal(root, tree.MerkleRoot()) {
+			t.Fatalf("leaf %d: proof leads to %x, not the root (%v)", i, root, err)
+		}
+	}
+	// Empty leaves are told apart by position only
+	if proofs[1] == proofs[3] || proofs[3] == proofs[4] {
+		t.Fatal("empty leaves share a proof")
+	}
+	if proof, _ := GetProof(tree, nil); proof != proofs[1] {
+		t.Fatal("GetProof of nil isn't the first empty leaf's proof")
+	}
+	if proof, _ := GetProof(tree, []byte("b")); proof != proofs[2] {
+		t.Fatal("GetProof and GetProofAt disagree on a unique leaf")
+	}
+
+	if _, err := GetProofAt(tree, len(shards)); err == nil {
+		t.Fatal("got a proof for a leaf past the end")
+	}
+	if root, _ := ProofRoot([]byte("x"), proofs[0]); bytes.Equal(root, tree.MerkleRoot()) {
+		t.Fatal("another shard's proof led to the root")
+	}
+	for _, bad := range []string{"", "proof: [[1 2], indices: [1]", "proof: [[1 2]], indices: [1 0]", "proof: [[1 300]], indices: [1]", "proof: [[1 2]], indices: [2]"} {
+		if _, err := ProofRoot(nil, bad); err == nil {
+			t.Fatalf("ProofRoot accepted %q", bad)
+		}
+	}
+}
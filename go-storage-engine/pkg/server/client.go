@@ -0,0 +1,237 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/techninja8/getvault.io/internal/tmp"
+)
+
+var errDigestMismatch = errors.New("downloaded content does not match the server's digest")
+
+// Download fetches an object from the server at baseURL into dir and
+// returns the path of the saved file. Data is written to <id>.part in the
+// staging directory first; with resume set, a part file left by an
+// interrupted download is continued with a ranged request instead of
+// starting over. The finished file is checked against the digest the
+// server reports. token is sent as the bearer token.
+func Download(baseURL, dataID, dir, staging, token string, resume bool, logger *zap.Logger) (string, error) {
+	objectURL := strings.TrimSuffix(baseURL, "/") + "/objects/" + url.PathEscape(dataID)
+	part := filepath.Join(staging, dataID+".part")
+	etagFile := part + ".etag"
+
+	var offset int64
+	var etag string
+	if resume {
+		if info, err := os.Stat(part); err == nil {
+			offset = info.Size()
+			// Picked up again, so a sweep doesn't take it for abandoned
+			now := time.Now()
+			os.Chtimes(part, now, now)
+		}
+		if b, err := os.ReadFile(etagFile); err == nil {
+			etag = string(b)
+		}
+		if etag == "" {
+			offset = 0
+		}
+	}
+
+	resp, err := get(objectURL, token, offset, etag)
+	if err != nil {
+		return "", err
+	}
+	// The part file may already hold the whole object.
+	if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		resp.Body.Close()
+		offset = 0
+		if resp, err = get(objectURL, token, 0, ""); err != nil {
+			return "", err
+		}
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_CREATE | os.O_WRONLY
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		var start int64
+		if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-", &start); err != nil || start != offset {
+			return "", fmt.Errorf("unexpected content range: %q", resp.Header.Get("Content-Range"))
+		}
+		logger.Info("Resuming download", zap.String("dataID", dataID), zap.Int64("offset", offset))
+		flags |= os.O_APPEND
+	case http.StatusOK:
+		if offset > 0 {
+			logger.Warn("Object changed since the partial download, starting over", zap.String("dataID", dataID))
+		}
+		flags |= os.O_TRUNC
+	default:
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("server returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	if err := os.WriteFile(etagFile, []byte(resp.Header.Get("ETag")), 0644); err != nil {
+		return "", fmt.Errorf("failed to record ETag: %w", err)
+	}
+
+	file, err := os.OpenFile(part, flags, 0644)
+	if err != nil {
+		return "", fmt.Errorf("failed to open partial download: %w", err)
+	}
+	_, err = io.Copy(file, resp.Body)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", fmt.Errorf("download interrupted, rerun with --resume to continue: %w", err)
+	}
+
+	if err := checkDigest(part, resp.Header.Get("Repr-Digest")); err != nil {
+		os.Remove(part)
+		os.Remove(etagFile)
+		return "", err
+	}
+
+	target := filepath.Join(dir, downloadName(resp, dataID))
+	if err := tmp.Move(part, target); err != nil {
+		return "", fmt.Errorf("failed to save download: %w", err)
+	}
+	os.Remove(etagFile)
+	return target, nil
+}
+
+func get(objectURL, token string, offset int64, etag string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, objectURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", etag)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %w", err)
+	}
+	return resp, nil
+}
+
+// checkDigest compares the sha-256 of the file with a Repr-Digest header value.
+func checkDigest(filename, header string) error {
+	value, ok := strings.CutPrefix(header, "sha-256=:")
+	if !ok {
+		return fmt.Errorf("server did not send a sha-256 digest")
+	}
+	want, err := base64.StdEncoding.DecodeString(strings.TrimSuffix(value, ":"))
+	if err != nil {
+		return fmt.Errorf("invalid digest from server: %w", err)
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return fmt.Errorf("failed to hash download: %w", err)
+	}
+	if string(hash.Sum(nil)) != string(want) {
+		return errDigestMismatch
+	}
+	return nil
+}
+
+// downloadName takes the filename from Content-Disposition, keeping only
+// its base name, and falls back to the dataID.
+func downloadName(resp *http.Response, dataID string) string {
+	_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition"))
+	if err != nil {
+		return dataID
+	}
+	name := filepath.Base(params["filename"])
+	if name == "." || name == ".." || name == string(filepath.Separator) {
+		return dataID
+	}
+	return name
+}
+
+// CreateToken has the server at baseURL create a managed token, using an
+// admin token.
+func CreateToken(baseURL, adminToken string, req TokenRequest) (*CreatedToken, error) {
+	var created CreatedToken
+	if err := adminCall(http.MethodPost, baseURL, "/tokens", adminToken, req, &created); err != nil {
+		return nil, err
+	}
+	return &created, nil
+}
+
+// ListTokens lists the managed tokens of the server at baseURL.
+func ListTokens(baseURL, adminToken string) ([]ManagedToken, error) {
+	var tokens []ManagedToken
+	if err := adminCall(http.MethodGet, baseURL, "/tokens", adminToken, nil, &tokens); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// RevokeToken revokes a managed token of the server at baseURL.
+func RevokeToken(baseURL, adminToken, id string) error {
+	return adminCall(http.MethodDelete, baseURL, "/tokens/"+url.PathEscape(id), adminToken, nil, nil)
+}
+
+// adminCall makes a request to an admin endpoint, sending body and
+// decoding the response into out where they aren't nil.
+func adminCall(method, baseURL, path, token string, body, out any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(baseURL, "/")+path, reader)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("server returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("invalid response from server: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Compression is a content coding responses can be sent in. NewWriter
+// returns a writer compressing into w; closing it must flush everything
+// written without closing w.
+type Compression struct {
+	NewWriter func(w io.Writer) io.WriteCloser
+}
+
+var (
+	compressionsMu sync.RWMutex
+	compressions   = map[string]Compression{
+		"gzip": {NewWriter: func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }},
+	}
+)
+
+// RegisterCompression makes a content coding available under its
+// Accept-Encoding name, for SERVE_COMPRESSION to pick. Names can't be
+// registered twice, and "none" is taken to mean no compression.
+func RegisterCompression(name string, c Compression) error {
+	if name == "" || name == "none" || strings.ContainsAny(name, ",; \n") {
+		return fmt.Errorf("invalid compression name %q", name)
+	}
+	compressionsMu.Lock()
+	defer compressionsMu.Unlock()
+	if _, exists := compressions[name]; exists {
+		return fmt.Errorf("compression %q is already registered", name)
+	}
+	compressions[name] = c
+	return nil
+}
+
+// lookupCompression returns the compression SERVE_COMPRESSION names, or
+// nil for none.
+func lookupCompression(name string) (*Compression, error) {
+	if name == "" || name == "none" {
+		return nil, nil
+	}
+	compressionsMu.RLock()
+	defer compressionsMu.RUnlock()
+	c, ok := compressions[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown compression %q in SERVE_COMPRESSION", name)
+	}
+	return &c, nil
+}
+
+// accepts reports whether an Accept-Encoding header lists coding, or *,
+// with a nonzero weight.
+func accepts(header, coding string) bool {
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if name != coding && name != "*" {
+			continue
+		}
+		q := 1.0
+		if weight, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			q, _ = strconv.ParseFloat(weight, 64)
+		}
+		return q > 0
+	}
+	return false
+}
+
+// compress sends the responses of next in the server's compression, to
+// clients that accept it. It wraps the control endpoints, whose JSON and
+// metrics compress well; object bodies are served as they are, since
+// ranges, ETags and digests are of their plain bytes, and the encrypted
+// shards behind them were never compressible in the first place. Go's
+// HTTP client asks for gzip by itself and decodes it transparently.
+func (s *Server) compress(next http.HandlerFunc) http.HandlerFunc {
+	if s.compression == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !accepts(r.Header.Get("Accept-Encoding"), s.cfg.ServeCompression) {
+			next(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, coding: s.cfg.ServeCompression, newWriter: s.compression.NewWriter}
+		defer cw.close()
+		next(cw, r)
+	}
+}
+
+// compressWriter compresses a response body. Responses that can't have
+// one, like 204s, go out without a Content-Encoding.
+type compressWriter struct {
+	http.ResponseWriter
+	coding      string
+	newWriter   func(io.Writer) io.WriteCloser
+	compressor  io.WriteCloser
+	wroteHeader bool
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.wroteHeader {
+		return
+	}
+	cw.wroteHeader = true
+	if status != http.StatusNoContent && status != http.StatusNotModified && cw.Header().Get("Content-Encoding") == "" {
+		cw.Header().Set("Content-Encoding", cw.coding)
+		cw.Header().Del("Content-Length")
+		cw.compressor = cw.newWriter(cw.ResponseWriter)
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if !cw.wroteHeader {
+		// Sniffed from the plain bytes, as net/http would otherwise sniff
+		// the compressed ones
+		if cw.Header().Get("Content-Type") == "" {
+			cw.Header().Set("Content-Type", http.DetectContentType(p))
+		}
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.compressor == nil {
+		return cw.ResponseWriter.Write(p)
+	}
+	return cw.compressor.Write(p)
+}
+
+func (cw *compressWriter) close() {
+	if cw.compressor != nil {
+		cw.compressor.Close()
+	}
+}
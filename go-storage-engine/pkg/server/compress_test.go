@@ -0,0 +1,84 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+)
+
+func TestAccepts(t *testing.T) {
+	for header, want := range map[string]bool{
+		"":                       false,
+		"gzip":                   true,
+		"deflate, gzip;q=0.5":    true,
+		"br, *":                  true,
+		"gzip;q=0":               false,
+		"gzip; q=0.000, deflate": false,
+		"x-gzip":                 false,
+	} {
+		if got := accepts(header, "gzip"); got != want {
+			t.Fatalf("accepts(%q) = %t", header, got)
+		}
+	}
+}
+
+func TestControlResponsesCompressed(t *testing.T) {
+	ts := newTestServer(t)
+	ts.cfg.ServeCompression = "gzip"
+	ts.start(t)
+	admin := ts.bootstrapAdmin(t)
+	data := bytes.Repeat([]byte("compressible "), 10_000)
+	stored := ts.post(t, "alpha-token", data)
+	gzipped := http.Header{"Accept-Encoding": {"gzip"}}
+
+	// Usage is negotiated into gzip, and decodes to the same JSON
+	resp := ts.do(t, http.MethodGet, "/usage", admin, nil, gzipped)
+	if resp.Header.Get("Content-Encoding") != "gzip" || resp.Header.Get("Content-Type") == "application/x-gzip" {
+		t.Fatalf("usage sent with %v", resp.Header)
+	}
+	zr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var usage map[string]NamespaceUsage
+	if err := json.NewDecoder(zr).Decode(&usage); err != nil || usage["alpha"].Stores != 1 {
+		t.Fatalf("usage %v, %v", usage, err)
+	}
+	// Not for clients that don't ask for it
+	resp = ts.do(t, http.MethodGet, "/usage", admin, nil, nil)
+	if resp.Header.Get("Content-Encoding") != "" {
+		t.Fatalf("usage sent with %v without Accept-Encoding", resp.Header)
+	}
+	// The client gets it by itself
+	if _, err := ListTokens(ts.http.URL, admin); err != nil {
+		t.Fatalf("ListTokens: %v", err)
+	}
+
+	// Object bodies go as they are, even to clients accepting gzip, and
+	// even when they would compress
+	resp = ts.do(t, http.MethodGet, "/objects/"+stored.DataID, "alpha-token", nil, gzipped)
+	body, err := io.ReadAll(resp.Body)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d, %v", resp.StatusCode, err)
+	}
+	if resp.Header.Get("Content-Encoding") != "" || !bytes.Equal(body, data) {
+		t.Fatalf("object sent as %d bytes with %v", len(body), resp.Header)
+	}
+}
+
+func TestCompressionOff(t *testing.T) {
+	ts := newTestServer(t)
+	admin := ts.bootstrapAdmin(t)
+	resp := ts.do(t, http.MethodGet, "/metrics", admin, nil, http.Header{"Accept-Encoding": {"gzip"}})
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Encoding") != "" {
+		t.Fatalf("metrics: status %d with %v", resp.StatusCode, resp.Header)
+	}
+
+	ts.cfg.ServeCompression = "zstd"
+	if _, err := NewServer(ts.store, ts.cfg, ts.cfg.MetadataDir, ts.locations, nil); err == nil {
+		t.Fatal("NewServer with an unknown compression")
+	}
+}
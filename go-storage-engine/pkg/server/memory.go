@@ -0,0 +1,104 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// memoryBudget is a semaphore weighted by bytes bounding the memory the
+// retrievals being served hold between them. Each reserves what
+// datastorage.RetrieveMemory estimates for its object before retrieving
+// anything, and waits while that doesn't fit. A reservation larger than
+// the whole budget is admitted once nothing else is reserved, so it can't
+// wait forever. A limit of 0 or less admits everything, only keeping
+// count.
+type memoryBudget struct {
+	mu       sync.Mutex
+	limit    int64
+	reserved int64
+	peak     int64
+	waiting  int
+	rejected int64
+	released chan struct{} // Closed, and replaced, whenever memory is released
+}
+
+func newMemoryBudget(limit int64) *memoryBudget {
+	return &memoryBudget{limit: limit, released: make(chan struct{})}
+}
+
+// acquire reserves n bytes, waiting until they fit or ctx is done.
+func (b *memoryBudget) acquire(ctx context.Context, n int64) error {
+	b.mu.Lock()
+	for b.limit > 0 && b.reserved > 0 && b.reserved+n > b.limit {
+		released := b.released
+		b.waiting++
+		b.mu.Unlock()
+		select {
+		case <-released:
+		case <-ctx.Done():
+			b.mu.Lock()
+			b.waiting--
+			b.rejected++
+			b.mu.Unlock()
+			return ctx.Err()
+		}
+		b.mu.Lock()
+		b.waiting--
+	}
+	b.reserved += n
+	b.peak = max(b.peak, b.reserved)
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *memoryBudget) release(n int64) {
+	b.mu.Lock()
+	b.reserved -= n
+	close(b.released)
+	b.released = make(chan struct{})
+	b.mu.Unlock()
+}
+
+// reject counts a retrieval refused without waiting.
+func (b *memoryBudget) reject() {
+	b.mu.Lock()
+	b.rejected++
+	b.mu.Unlock()
+}
+
+// MemoryStats is the state of a server's retrieval memory budget.
+type MemoryStats struct {
+	Limit    int64 `json:"limit"`    // 0 for unlimited
+	Reserved int64 `json:"reserved"` // Held by retrievals being served
+	Peak     int64 `json:"peak"`     // Most ever held at once
+	Waiting  int   `json:"waiting"`  // Retrievals waiting for memory
+	Rejected int64 `json:"rejected"` // Retrievals refused for want of memory
+}
+
+// MemoryStats returns the state of the server's retrieval memory budget.
+func (s *Server) MemoryStats() MemoryStats {
+	return s.memory.stats()
+}
+
+func (b *memoryBudget) stats() MemoryStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return MemoryStats{Limit: b.limit, Reserved: b.reserved, Peak: b.peak, Waiting: b.waiting, Rejected: b.rejected}
+}
+
+func writeMemoryMetrics(w io.Writer, stats MemoryStats) {
+	for _, m := range []struct {
+		name, kind, help string
+		value            int64
+	}{
+		{"vault_retrieve_memory_limit_bytes", "gauge", "Memory retrievals may reserve between them; 0 for unlimited.", stats.Limit},
+		{"vault_retrieve_memory_reserved_bytes", "gauge", "Memory reserved by retrievals being served.", stats.Reserved},
+		{"vault_retrieve_memory_peak_bytes", "gauge", "Most memory retrievals have reserved at once.", stats.Peak},
+		{"vault_retrieve_memory_waiting", "gauge", "Retrievals waiting for memory.", int64(stats.Waiting)},
+		{"vault_retrieve_memory_rejected_total", "counter", "Retrievals refused for want of memory.", stats.Rejected},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", m.name, m.help, m.name, m.kind, m.name, m.value)
+	}
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/techninja8/getvault.io/pkg/datastorage"
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+// slowStore delays every shard read, so retrievals overlap.
+type slowStore struct {
+	sharding.ShardStore
+	delay time.Duration
+}
+
+func (s slowStore) RetrieveShard(dataID string, index int, location string) ([]byte, error) {
+	time.Sleep(s.delay)
+	return s.ShardStore.RetrieveShard(dataID, index, location)
+}
+
+func TestMemoryBudget(t *testing.T) {
+	b := newMemoryBudget(100)
+	if err := b.acquire(context.Background(), 60); err != nil {
+		t.Fatal(err)
+	}
+	// What doesn't fit waits, and gives up when the context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := b.acquire(ctx, 50); err == nil {
+		t.Fatal("acquired past the limit")
+	}
+
+	done := make(chan error)
+	go func() { done <- b.acquire(context.Background(), 50) }()
+	time.Sleep(10 * time.Millisecond)
+	if stats := b.stats(); stats.Waiting != 1 || stats.Rejected != 1 {
+		t.Fatalf("stats %+v", stats)
+	}
+	b.release(60)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	b.release(50)
+
+	// More than the whole budget is admitted alone
+	if err := b.acquire(context.Background(), 1000); err != nil {
+		t.Fatal(err)
+	}
+	b.release(1000)
+	if stats := b.stats(); stats.Reserved != 0 || stats.Peak != 1000 || stats.Waiting != 0 {
+		t.Fatalf("stats %+v", stats)
+	}
+}
+
+// loadTest fires concurrent retrievals of one object at a server whose
+// shard reads are slow, and returns the responses' status codes and
+// Retry-After headers. Every successful response must carry the object.
+func loadTest(t *testing.T, ts *testServer, dataID string, data []byte, clients int) (codes []int, retryAfter []string) {
+	t.Helper()
+	server, err := NewServer(slowStore{ts.store, 5 * time.Millisecond}, ts.cfg, ts.cfg.MetadataDir, ts.locations, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.server = server
+	ts.http = httptest.NewServer(server.Handler())
+	t.Cleanup(ts.http.Close)
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest("GET", ts.http.URL+"/objects/"+dataID, nil)
+			req.Header.Set("Authorization", "Bearer alpha-token")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if resp.StatusCode == http.StatusOK && !bytes.Equal(body, data) {
+				t.Errorf("served %d bytes of the wrong data", len(body))
+			}
+			mu.Lock()
+			codes = append(codes, resp.StatusCode)
+			retryAfter = append(retryAfter, resp.Header.Get("Retry-After"))
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return codes, retryAfter
+}
+
+// settledMemory returns the server's memory stats once the retrievals
+// served have released their memory, which they do just after the
+// response is sent.
+func settledMemory(t *testing.T, server *Server) MemoryStats {
+	t.Helper()
+	for i := 0; ; i++ {
+		stats := server.MemoryStats()
+		if stats.Reserved == 0 || i == 100 {
+			return stats
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRetrievalsQueueWithinBudget(t *testing.T) {
+	ts := newTestServer(t)
+	data := randomBytes(t, 1<<20)
+	dataID := ts.storeObject(t, data)
+	metadataFile, err := ts.server.index.Lookup(dataID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	need, err := datastorage.RetrieveMemory(metadataFile)
+	if err != nil || need < int64(len(data)) {
+		t.Fatalf("RetrieveMemory: %d, %v", need, err)
+	}
+
+	// Room for two at once; the rest queue, and wait long enough
+	ts.cfg.ServeMemoryBudget = 2*need + need/2
+	ts.cfg.ServeMemoryWait = time.Minute
+	codes, _ := loadTest(t, ts, dataID, data, 8)
+	for _, code := range codes {
+		if code != http.StatusOK {
+			t.Fatalf("status %d with time to wait", code)
+		}
+	}
+	stats := settledMemory(t, ts.server)
+	if stats.Peak > ts.cfg.ServeMemoryBudget || stats.Peak < 2*need || stats.Reserved != 0 || stats.Rejected != 0 {
+		t.Fatalf("stats %+v, need %d per retrieval", stats, need)
+	}
+}
+
+func TestRetrievalsOverBudgetGet503(t *testing.T) {
+	ts := newTestServer(t)
+	data := randomBytes(t, 1<<20)
+	dataID := ts.storeObject(t, data)
+
+	// Room for one at once, and no waiting for it
+	ts.cfg.ServeMemoryBudget = 1
+	ts.cfg.ServeMemoryWait = 0
+	codes, retryAfter := loadTest(t, ts, dataID, data, 8)
+	ok, busy := 0, 0
+	for i, code := range codes {
+		switch code {
+		case http.StatusOK:
+			ok++
+		case http.StatusServiceUnavailable:
+			busy++
+			if retryAfter[i] != "1" {
+				t.Fatalf("Retry-After %q", retryAfter[i])
+			}
+		default:
+			t.Fatalf("status %d", code)
+		}
+	}
+	stats := settledMemory(t, ts.server)
+	if ok == 0 || busy == 0 || stats.Rejected != int64(busy) || stats.Reserved != 0 {
+		t.Fatalf("%d served, %d refused, stats %+v", ok, busy, stats)
+	}
+
+	var metrics bytes.Buffer
+	writeMemoryMetrics(&metrics, stats)
+	if !strings.Contains(metrics.String(), "vault_retrieve_memory_reserved_bytes 0\n") {
+		t.Fatalf("metrics:\n%s", metrics.String())
+	}
+}
+
+func TestRetrievalOverRequestMaxRefused(t *testing.T) {
+	ts := newTestServer(t)
+	data := randomBytes(t, 100_000)
+	dataID := ts.storeObject(t, data)
+	ts.cfg.ServeRequestMemoryMax = 1000
+	ts.start(t)
+
+	resp := ts.do(t, "GET", "/objects/"+dataID, "alpha-token", nil, nil)
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") != "" {
+		t.Fatalf("status %d, Retry-After %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	if stats := ts.server.MemoryStats(); stats.Rejected != 1 {
+		t.Fatalf("stats %+v", stats)
+	}
+}
@@ -0,0 +1,314 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/techninja8/getvault.io/pkg/config"
+	"github.com/techninja8/getvault.io/pkg/datastorage"
+	"github.com/techninja8/getvault.io/pkg/metadata"
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+// Server exposes stored objects over HTTP.
+type Server struct {
+	store       sharding.ShardStore
+	cfg         *config.Config
+	metadataDir string
+	locations   []string
+	index       *datastorage.MetadataIndex
+	tokens      Tokens
+	managed     *TokenStore
+	usage       *Usage
+	memory      *memoryBudget
+	compression *Compression // nil for none
+	logger      *zap.Logger
+}
+
+// NewServer returns a server for the objects in metadataDir, storing new
+// objects at locations; without locations objects can't be stored. Usage
+// counters are kept alongside the metadata, in .usage.json, and so are
+// managed tokens, in .tokens.json. Object requests must bear a token from
+// cfg.TokensFile, the admin token or a managed token.
+func NewServer(store sharding.ShardStore, cfg *config.Config, metadataDir string, locations []string, logger *zap.Logger) (*Server, error) {
+	usage, err := LoadUsage(filepath.Join(metadataDir, ".usage.json"))
+	if err != nil {
+		return nil, err
+	}
+	tokens, err := LoadTokens(cfg.TokensFile)
+	if err != nil {
+		return nil, err
+	}
+	managed, err := OpenTokenStore(TokenStorePath(metadataDir))
+	if err != nil {
+		return nil, err
+	}
+	index, err := datastorage.NewMetadataIndex(metadataDir)
+	if err != nil {
+		return nil, err
+	}
+	compression, err := lookupCompression(cfg.ServeCompression)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{
+		store:       store,
+		cfg:         cfg,
+		metadataDir: metadataDir,
+		locations:   locations,
+		index:       index,
+		tokens:      tokens,
+		managed:     managed,
+		usage:       usage,
+		memory:      newMemoryBudget(cfg.ServeMemoryBudget),
+		compression: compression,
+		logger:      logger,
+	}, nil
+}
+
+// Handler returns the HTTP handler serving the object API.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /objects/{id}", s.requireToken(s.countRetrievals(s.handleGetObject)))
+	mux.HandleFunc("POST /objects", s.requireToken(s.compress(s.handlePostObject)))
+	mux.HandleFunc("DELETE /objects/{id}", s.requireToken(s.handleDeleteObject))
+	mux.HandleFunc("GET /usage", s.requireAdmin(s.compress(s.handleUsage)))
+	mux.HandleFunc("GET /metrics", s.requireAdmin(s.compress(s.handleMetrics)))
+	mux.HandleFunc("POST /tokens", s.requireAdmin(s.compress(s.handleCreateToken)))
+	mux.HandleFunc("GET /tokens", s.requireAdmin(s.compress(s.handleListTokens)))
+	mux.HandleFunc("DELETE /tokens/{id}", s.requireAdmin(s.handleRevokeToken))
+	return mux
+}
+
+// handleGetObject serves an object's plaintext. Range and If-Range
+// requests are honoured so interrupted downloads can be resumed; the
+// dataID doubles as a strong ETag since it never changes for an object.
+// Only the segments a range covers are retrieved. The digest of the whole
+// object is sent with every response that needs it, so the first such
+// request for an object retrieves it in full to compute it; a Range
+// without If-Range, as players seeking into media send, gets the digest
+// only once it is recorded, since retrieving everything would defeat the
+// seek. Resumed downloads send If-Range and always get it, to check the
+// whole download against. Requests wait for the memory
+// their retrieval takes to fit in the server's budget, and get 503 with
+// Retry-After if it doesn't in time.
+func (s *Server) handleGetObject(w http.ResponseWriter, r *http.Request) {
+	dataID := r.PathValue("id")
+	logger := s.logger.With(zap.String("dataID", dataID))
+
+	metadataFile, err := s.index.Lookup(dataID)
+	if errors.Is(err, datastorage.ErrObjectNotFound) {
+		http.Error(w, "object not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to look up object", zap.Error(err))
+		http.Error(w, "failed to look up object", http.StatusInternalServerError)
+		return
+	}
+
+	filename, err := datastorage.ReadFilename(metadataFile)
+	if err != nil {
+		logger.Error("Failed to read metadata", zap.Error(err))
+		http.Error(w, "failed to read metadata", http.StatusInternalServerError)
+		return
+	}
+	if filename, err = datastorage.SafeFilename(filename); err != nil {
+		logger.Warn("Unsafe filename in metadata, using the dataID", zap.Error(err))
+		filename = dataID
+	}
+	var modTime time.Time
+	if value, err := metadata.ReadValue(metadataFile, "creation_date"); err == nil {
+		modTime, _ = time.Parse(time.RFC3339, value)
+	}
+
+	release, ok := s.reserveMemory(w, r, metadataFile, logger)
+	if !ok {
+		return
+	}
+	defer release()
+
+	// Clients can't opt in to cold retrievals, so they are only logged.
+	datastorage.CheckColdRetrieval(metadataFile, s.cfg, true, logger)
+	object, err := datastorage.OpenObject(r.Context(), metadataFile, s.store, s.cfg, logger)
+	if errors.Is(err, datastorage.ErrVerifyOnly) {
+		http.Error(w, "this server is verify-only and can't serve object contents", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to open object", zap.Error(err))
+		http.Error(w, "failed to retrieve object", http.StatusInternalServerError)
+		return
+	}
+	defer object.Close()
+	sum, ok := datastorage.RecordedContentDigest(metadataFile, logger)
+	if !ok && (r.Header.Get("Range") == "" || r.Header.Get("If-Range") != "") {
+		if sum, err = datastorage.ContentDigest(r.Context(), metadataFile, s.store, s.cfg, logger); err != nil {
+			logger.Error("Retrieve failed", zap.Error(err))
+			http.Error(w, "failed to retrieve object", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := datastorage.RecordAccess(metadataFile, time.Now()); err != nil {
+		logger.Warn("Failed to record object access", zap.Error(err))
+	}
+	w.Header().Set("ETag", `"`+dataID+`"`)
+	if sum != nil {
+		w.Header().Set("Repr-Digest", "sha-256=:"+base64.StdEncoding.EncodeToString(sum)+":")
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	http.ServeContent(w, r, filename, modTime, object)
+}
+
+// reserveMemory reserves the memory retrieving an object takes, waiting
+// up to cfg.ServeMemoryWait for it, and returns the function releasing
+// it. If it can't, it answers the request and returns false.
+func (s *Server) reserveMemory(w http.ResponseWriter, r *http.Request, metadataFile string, logger *zap.Logger) (func(), bool) {
+	need, err := datastorage.RetrieveMemory(metadataFile)
+	if err != nil {
+		logger.Error("Failed to read metadata", zap.Error(err))
+		http.Error(w, "failed to read metadata", http.StatusInternalServerError)
+		return nil, false
+	}
+	if most := s.cfg.ServeRequestMemoryMax; most > 0 && need > most {
+		s.memory.reject()
+		logger.Warn("Object too large to retrieve within the memory limit", zap.Int64("need", need), zap.Int64("limit", most))
+		http.Error(w, "object too large to retrieve within the server's memory limit", http.StatusServiceUnavailable)
+		return nil, false
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), s.cfg.ServeMemoryWait)
+	err = s.memory.acquire(ctx, need)
+	cancel()
+	if err != nil {
+		logger.Warn("Retrieval refused for want of memory", zap.Int64("need", need), zap.Error(err))
+		w.Header().Set("Retry-After", strconv.Itoa(max(1, int(math.Ceil(s.cfg.ServeMemoryWait.Seconds())))))
+		http.Error(w, "server busy, retry later", http.StatusServiceUnavailable)
+		return nil, false
+	}
+	return func() { s.memory.release(need) }, true
+}
+
+// storedObject is the response to a store.
+type storedObject struct {
+	DataID string `json:"data_id"`
+	Size   int64  `json:"size"`
+}
+
+// handlePostObject stores the request body as a new object named after
+// the filename query parameter, attributing it to the token's namespace.
+func (s *Server) handlePostObject(w http.ResponseWriter, r *http.Request) {
+	if len(s.locations) == 0 {
+		http.Error(w, "storing is disabled (serve was started without storage locations)", http.StatusForbidden)
+		return
+	}
+	namespace := requestNamespace(r)
+	logger := s.logger.With(zap.String("namespace", namespace))
+	filename := r.URL.Query().Get("filename")
+	if filename == "" {
+		filename = "object"
+	}
+	filename, err := datastorage.SafeFilename(filename)
+	if err != nil {
+		http.Error(w, "invalid filename", http.StatusBadRequest)
+		return
+	}
+
+	// A body over the limit is refused by its Content-Length up front, or
+	// cut off once read past it when sent without one
+	body := r.Body
+	if s.cfg.MaxObjectSize > 0 {
+		body = http.MaxBytesReader(w, r.Body, s.cfg.MaxObjectSize)
+	}
+	dataID, metadataFile, err := datastorage.StoreReaderContext(r.Context(), body, r.ContentLength, s.store, s.cfg, s.locations, logger, filename)
+	var tooLarge *http.MaxBytesError
+	if errors.Is(err, datastorage.ErrObjectTooLarge) || errors.As(err, &tooLarge) {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		logger.Error("Store failed", zap.Error(err))
+		http.Error(w, "failed to store object", http.StatusInternalServerError)
+		return
+	}
+	if err := datastorage.SetNamespace(metadataFile, namespace); err != nil {
+		logger.Error("Failed to record the object's namespace", zap.Error(err))
+	}
+	size, err := objectSize(metadataFile)
+	if err != nil {
+		logger.Error("Failed to read metadata", zap.Error(err))
+	}
+	if err := s.usage.RecordStore(namespace, size); err != nil {
+		logger.Error("Failed to record usage", zap.Error(err))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(storedObject{DataID: dataID, Size: size})
+}
+
+// handleDeleteObject moves an object to the trash, taking it off the
+// footprint of the namespace that stored it. Only that namespace, or the
+// admin token, can delete it.
+func (s *Server) handleDeleteObject(w http.ResponseWriter, r *http.Request) {
+	dataID := r.PathValue("id")
+	logger := s.logger.With(zap.String("dataID", dataID))
+
+	metadataFile, err := s.index.Lookup(dataID)
+	if errors.Is(err, datastorage.ErrObjectNotFound) {
+		http.Error(w, "object not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to look up object", zap.Error(err))
+		http.Error(w, "failed to look up object", http.StatusInternalServerError)
+		return
+	}
+	owner, err := metadata.ReadValue(metadataFile, "namespace")
+	if err != nil {
+		owner = defaultNamespace
+	}
+	if namespace := requestNamespace(r); namespace != owner && namespace != defaultNamespace {
+		http.Error(w, "object belongs to another namespace", http.StatusForbidden)
+		return
+	}
+	size, err := objectSize(metadataFile)
+	if err != nil {
+		logger.Error("Failed to read metadata", zap.Error(err))
+		http.Error(w, "failed to read metadata", http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := datastorage.TrashObject(metadataFile, time.Now(), logger); err != nil {
+		if errors.Is(err, datastorage.ErrObjectLocked) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		logger.Error("Delete failed", zap.Error(err))
+		http.Error(w, "failed to delete object", http.StatusInternalServerError)
+		return
+	}
+	if err := s.usage.RecordDelete(owner, size); err != nil {
+		logger.Error("Failed to record usage", zap.Error(err))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// objectSize reads an object's size from its metadata.
+func objectSize(metadataFile string) (int64, error) {
+	value, err := metadata.ReadValue(metadataFile, "filesize")
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
@@ -0,0 +1,482 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"github.com/techninja8/getvault.io/pkg/config"
+	"github.com/techninja8/getvault.io/pkg/datastorage"
+	"github.com/techninja8/getvault.io/pkg/erasurecoding"
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+// testServer is a server over a vault in temporary directories, accepting
+// the tokens "alpha-token" for namespace alpha and "beta-token" for beta.
+type testServer struct {
+	cfg       *config.Config
+	locations []string
+	store     *sharding.InMemoryShardStore
+	server    *Server
+	http      *httptest.Server
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	dir := t.TempDir()
+	key, err := datastorage.GenerateEncryptionKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens := filepath.Join(dir, "tokens")
+	if err := os.WriteFile(tokens, []byte("# namespace token\nalpha alpha-token\nbeta beta-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{
+		EncryptionKey:        key,
+		MaxConcurrency:       4,
+		MaxInFlightBytes:     64 << 20,
+		MetadataDir:          filepath.Join(dir, "metadata"),
+		ShardRetryAttempts:   1,
+		MaxRetriesPerOp:      10,
+		MetadataNameTemplate: config.DefaultMetadataNameTemplate,
+		MetadataExt:          config.DefaultMetadataExt,
+		HealthFile:           filepath.Join(dir, "health.json"),
+		TokensFile:           tokens,
+	}
+	if err := os.MkdirAll(cfg.MetadataDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	locations := make([]string, erasurecoding.DataShards+erasurecoding.ParityShards)
+	for i := range locations {
+		locations[i] = filepath.Join(dir, fmt.Sprintf("location%d", i))
+	}
+	ts := &testServer{cfg: cfg, locations: locations, store: sharding.NewInMemoryShardStore()}
+	ts.start(t)
+	return ts
+}
+
+// start serves the vault with a new Server, as after a restart.
+func (ts *testServer) start(t *testing.T) {
+	t.Helper()
+	if ts.http != nil {
+		ts.http.Close()
+	}
+	server, err := NewServer(ts.store, ts.cfg, ts.cfg.MetadataDir, ts.locations, zap.NewNop())
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	ts.server = server
+	ts.http = httptest.NewServer(server.Handler())
+	t.Cleanup(ts.http.Close)
+}
+
+func (ts *testServer) storeObject(t *testing.T, data []byte) string {
+	t.Helper()
+	dataID, _, err := datastorage.StoreData(data, ts.store, ts.cfg, ts.locations, zap.NewNop(), "object.bin")
+	if err != nil {
+		t.Fatalf("StoreData: %v", err)
+	}
+	return dataID
+}
+
+func (ts *testServer) do(t *testing.T, method, path, token string, body []byte, header http.Header) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, ts.http.URL+path, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func randomBytes(t *testing.T, n int) []byte {
+	t.Helper()
+	data := make([]byte, n)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestGetObjectRequiresToken(t *testing.T) {
+	ts := newTestServer(t)
+	dataID := ts.storeObject(t, randomBytes(t, 1000))
+	for _, token := range []string{"", "wrong-token"} {
+		if resp := ts.do(t, http.MethodGet, "/objects/"+dataID, token, nil, nil); resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("token %q: status %d, expected %d", token, resp.StatusCode, http.StatusUnauthorized)
+		}
+	}
+	if resp := ts.do(t, http.MethodGet, "/objects/"+dataID, "alpha-token", nil, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d, expected %d", resp.StatusCode, http.StatusOK)
+	}
+}
+
+func TestGetObjectServesRanges(t *testing.T) {
+	ts := newTestServer(t)
+	ts.cfg.MaxShardSize = 4096 // streamed in segments of under 32 KiB
+	data := randomBytes(t, 200_000)
+	dataID := ts.storeObject(t, data)
+
+	resp := ts.do(t, http.MethodGet, "/objects/"+dataID, "alpha-token", nil, http.Header{"Range": {"bytes=100000-100999"}})
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("status %d, expected %d", resp.StatusCode, http.StatusPartialContent)
+	}
+	got, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data[100000:101000]) {
+		t.Fatal("range returned the wrong bytes")
+	}
+
+	// The whole object, through the resumable client
+	file, err := Download(ts.http.URL, dataID, t.TempDir(), t.TempDir(), "beta-token", false, zap.NewNop())
+	if err != nil {
+		t.Fatalf("Download: %v", err)
+	}
+	downloaded, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(downloaded, data) {
+		t.Fatal("download doesn't match the stored object")
+	}
+}
+
+// cutResponse passes on the first left bytes of a response, then drops
+// the connection, as a network failure partway through a download would.
+type cutResponse struct {
+	http.ResponseWriter
+	left int
+}
+
+func (c *cutResponse) Write(p []byte) (int, error) {
+	if len(p) <= c.left {
+		c.left -= len(p)
+		return c.ResponseWriter.Write(p)
+	}
+	c.ResponseWriter.Write(p[:c.left])
+	c.ResponseWriter.(http.Flusher).Flush()
+	panic(http.ErrAbortHandler)
+}
+
+// cuttingServer serves ts, cutting the first response after cut bytes, and
+// records the Range and If-Range headers of every request.
+func cuttingServer(t *testing.T, ts *testServer, cut int) (*httptest.Server, *[]http.Header) {
+	t.Helper()
+	var (
+		requests []http.Header
+		cuts     = 1
+	)
+	handler := ts.server.Handler()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, http.Header{"Range": r.Header.Values("Range"), "If-Range": r.Header.Values("If-Range")})
+		if cuts > 0 {
+			cuts--
+			w = &cutResponse{ResponseWriter: w, left: cut}
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+// TestDownloadResumesAfterCut checks that a download cut partway through
+// is continued from where it stopped, with a ranged request naming the
+// ETag it started under, to a file matching the server's digest.
+func TestDownloadResumesAfterCut(t *testing.T) {
+	ts := newTestServer(t)
+	ts.cfg.MaxShardSize = 4096
+	data := randomBytes(t, 200_000)
+	dataID := ts.storeObject(t, data)
+	server, requests := cuttingServer(t, ts, 70_000)
+	dir, staging := t.TempDir(), t.TempDir()
+
+	if _, err := Download(server.URL, dataID, dir, staging, "alpha-token", true, zap.NewNop()); err == nil {
+		t.Fatal("a cut download succeeded")
+	}
+	part := filepath.Join(staging, dataID+".part")
+	if info, err := os.Stat(part); err != nil || info.Size() != 70_000 {
+		t.Fatalf("part file after the cut: %v, %v", info, err)
+	}
+
+	file, err := Download(server.URL, dataID, dir, staging, "alpha-token", true, zap.NewNop())
+	if err != nil {
+		t.Fatalf("resumed Download: %v", err)
+	}
+	if got := (*requests)[1]; got.Get("Range") != "bytes=70000-" || got.Get("If-Range") != `"`+dataID+`"` {
+		t.Fatalf("resumed with Range %q and If-Range %q", got.Get("Range"), got.Get("If-Range"))
+	}
+	downloaded, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(downloaded, data) {
+		t.Fatal("resumed download doesn't match the stored object")
+	}
+	if _, err := os.Stat(part); !os.IsNotExist(err) {
+		t.Fatalf("part file left after the download: %v", err)
+	}
+}
+
+// TestDownloadResumeIfRangeMismatch checks that a part file recorded under
+// another ETag, as when the object changed since, is started over from
+// the whole object rather than continued, and that a part file whose bytes
+// differ from the object's fails the digest check rather than being saved.
+func TestDownloadResumeIfRangeMismatch(t *testing.T) {
+	ts := newTestServer(t)
+	ts.cfg.MaxShardSize = 4096
+	data := randomBytes(t, 200_000)
+	dataID := ts.storeObject(t, data)
+	server, requests := cuttingServer(t, ts, 70_000)
+	dir, staging := t.TempDir(), t.TempDir()
+	part := filepath.Join(staging, dataID+".part")
+
+	if _, err := Download(server.URL, dataID, dir, staging, "alpha-token", true, zap.NewNop()); err == nil {
+		t.Fatal("a cut download succeeded")
+	}
+	if err := os.WriteFile(part+".etag", []byte(`"changed"`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := Download(server.URL, dataID, dir, staging, "alpha-token", true, zap.NewNop())
+	if err != nil {
+		t.Fatalf("resumed Download: %v", err)
+	}
+	if got := (*requests)[1]; got.Get("If-Range") != `"changed"` {
+		t.Fatalf("resumed with If-Range %q", got.Get("If-Range"))
+	}
+	downloaded, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(downloaded, data) {
+		t.Fatal("download started over doesn't match the stored object")
+	}
+
+	// The ETag matches, but the bytes already downloaded don't
+	if err := os.WriteFile(part, make([]byte, 70_000), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(part+".etag", []byte(`"`+dataID+`"`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Download(server.URL, dataID, t.TempDir(), staging, "alpha-token", true, zap.NewNop()); !errors.Is(err, errDigestMismatch) {
+		t.Fatalf("resuming a corrupt part file returned %v, expected %v", err, errDigestMismatch)
+	}
+	if _, err := os.Stat(part); !os.IsNotExist(err) {
+		t.Fatalf("corrupt part file kept: %v", err)
+	}
+}
+
+func TestGetObjectAcceptsRanges(t *testing.T) {
+	ts := newTestServer(t)
+	dataID := ts.storeObject(t, randomBytes(t, 1000))
+	resp := ts.do(t, http.MethodGet, "/objects/"+dataID, "alpha-token", nil, nil)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Accept-Ranges") != "bytes" {
+		t.Fatalf("status %d with Accept-Ranges %q", resp.StatusCode, resp.Header.Get("Accept-Ranges"))
+	}
+}
+
+func TestGetObjectServesMultipleRanges(t *testing.T) {
+	ts := newTestServer(t)
+	ts.cfg.MaxShardSize = 4096
+	data := randomBytes(t, 200_000)
+	dataID := ts.storeObject(t, data)
+
+	resp := ts.do(t, http.MethodGet, "/objects/"+dataID, "alpha-token", nil, http.Header{"Range": {"bytes=0-99, 150000-150499, -10"}})
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("status %d, expected %d", resp.StatusCode, http.StatusPartialContent)
+	}
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/byteranges" {
+		t.Fatalf("content type %q, %v", resp.Header.Get("Content-Type"), err)
+	}
+	want := []struct {
+		contentRange string
+		data         []byte
+	}{
+		{"bytes 0-99/200000", data[:100]},
+		{"bytes 150000-150499/200000", data[150000:150500]},
+		{"bytes 199990-199999/200000", data[199990:]},
+	}
+	parts := multipart.NewReader(resp.Body, params["boundary"])
+	for i, w := range want {
+		part, err := parts.NextPart()
+		if err != nil {
+			t.Fatalf("part %d: %v", i, err)
+		}
+		if got := part.Header.Get("Content-Range"); got != w.contentRange {
+			t.Fatalf("part %d has range %q, expected %q", i, got, w.contentRange)
+		}
+		got, err := io.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, w.data) {
+			t.Fatalf("part %d returned the wrong bytes", i)
+		}
+	}
+	if _, err := parts.NextPart(); err != io.EOF {
+		t.Fatalf("more parts than ranges: %v", err)
+	}
+}
+
+func TestGetObjectUnsatisfiableRange(t *testing.T) {
+	ts := newTestServer(t)
+	dataID := ts.storeObject(t, randomBytes(t, 1000))
+	resp := ts.do(t, http.MethodGet, "/objects/"+dataID, "alpha-token", nil, http.Header{"Range": {"bytes=5000-5999"}})
+	if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		t.Fatalf("status %d, expected %d", resp.StatusCode, http.StatusRequestedRangeNotSatisfiable)
+	}
+	if got := resp.Header.Get("Content-Range"); got != "bytes */1000" {
+		t.Fatalf("Content-Range %q, expected the object's size", got)
+	}
+}
+
+// TestGetObjectSeekSkipsDigest checks that a range without If-Range, as a
+// player seeking sends, doesn't retrieve the whole object for its digest.
+func TestGetObjectSeekSkipsDigest(t *testing.T) {
+	ts := newTestServer(t)
+	ts.cfg.MaxShardSize = 4096
+	dataID := ts.storeObject(t, randomBytes(t, 200_000))
+	metadataFile, err := ts.server.index.Lookup(dataID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := ts.do(t, http.MethodGet, "/objects/"+dataID, "alpha-token", nil, http.Header{"Range": {"bytes=100000-100999"}})
+	if resp.StatusCode != http.StatusPartialContent || resp.Header.Get("Repr-Digest") != "" {
+		t.Fatalf("status %d with Repr-Digest %q", resp.StatusCode, resp.Header.Get("Repr-Digest"))
+	}
+	if _, ok := datastorage.RecordedContentDigest(metadataFile, zap.NewNop()); ok {
+		t.Fatal("seeking computed the object's digest")
+	}
+
+	// Resuming, with If-Range, gets the digest to check the download against
+	resp = ts.do(t, http.MethodGet, "/objects/"+dataID, "alpha-token", nil, http.Header{"Range": {"bytes=100000-"}, "If-Range": {`"` + dataID + `"`}})
+	if resp.StatusCode != http.StatusPartialContent || resp.Header.Get("Repr-Digest") == "" {
+		t.Fatalf("status %d with Repr-Digest %q", resp.StatusCode, resp.Header.Get("Repr-Digest"))
+	}
+	if _, ok := datastorage.RecordedContentDigest(metadataFile, zap.NewNop()); !ok {
+		t.Fatal("resuming didn't record the object's digest")
+	}
+	resp = ts.do(t, http.MethodGet, "/objects/"+dataID, "alpha-token", nil, http.Header{"Range": {"bytes=0-9"}})
+	if resp.Header.Get("Repr-Digest") == "" {
+		t.Fatal("seeking after the digest was recorded got no digest")
+	}
+}
+
+func TestGetObjectNotFound(t *testing.T) {
+	ts := newTestServer(t)
+	if resp := ts.do(t, http.MethodGet, "/objects/missing", "alpha-token", nil, nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("status %d, expected %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
+
+// postUnsized posts data as the body of a new object without a
+// Content-Length, as a chunked upload sends it.
+func (ts *testServer) postUnsized(t *testing.T, token string, data []byte) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, ts.http.URL+"/objects?filename=object.bin", io.MultiReader(bytes.NewReader(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// TestPostObjectSizeLimit checks that an upload of exactly MaxObjectSize
+// bytes is stored and one a byte over is refused with 413, whether the
+// limit is checked against its Content-Length or the body is cut off by
+// the limit when sent without one.
+func TestPostObjectSizeLimit(t *testing.T) {
+	const limit = 10_000
+	for _, streamed := range []bool{false, true} {
+		t.Run(fmt.Sprintf("streamed=%v", streamed), func(t *testing.T) {
+			ts := newTestServer(t)
+			ts.cfg.MaxObjectSize = limit
+			if streamed {
+				ts.cfg.StreamingThreshold = 1
+				ts.cfg.MaxShardSize = 1024 // Segments of under 8 KiB
+			}
+			post := []struct {
+				name string
+				send func(data []byte) *http.Response
+			}{
+				{"sized", func(data []byte) *http.Response {
+					return ts.do(t, http.MethodPost, "/objects?filename=object.bin", "alpha-token", data, nil)
+				}},
+				{"unsized", func(data []byte) *http.Response { return ts.postUnsized(t, "alpha-token", data) }},
+			}
+			for _, p := range post {
+				for _, size := range []int{limit - 1, limit} {
+					if resp := p.send(randomBytes(t, size)); resp.StatusCode != http.StatusCreated {
+						body, _ := io.ReadAll(resp.Body)
+						t.Fatalf("%s upload of %d bytes: status %d: %s", p.name, size, resp.StatusCode, body)
+					}
+				}
+				for _, size := range []int{limit + 1, 3 * limit} {
+					if resp := p.send(randomBytes(t, size)); resp.StatusCode != http.StatusRequestEntityTooLarge {
+						t.Fatalf("%s upload of %d bytes: status %d, expected %d", p.name, size, resp.StatusCode, http.StatusRequestEntityTooLarge)
+					}
+				}
+			}
+			// A body longer than its Content-Length says, as a handler behind
+			// something other than net/http's server can be sent, is refused
+			// by its size all the same
+			req := httptest.NewRequest(http.MethodPost, "/objects?filename=object.bin", bytes.NewReader(randomBytes(t, 2*limit)))
+			req.ContentLength = limit
+			req.Header.Set("Authorization", "Bearer alpha-token")
+			rec := httptest.NewRecorder()
+			ts.server.Handler().ServeHTTP(rec, req)
+			if rec.Code != http.StatusRequestEntityTooLarge {
+				t.Fatalf("understated upload: status %d, expected %d: %s", rec.Code, http.StatusRequestEntityTooLarge, rec.Body)
+			}
+
+			files, err := filepath.Glob(filepath.Join(ts.cfg.MetadataDir, "*"+ts.cfg.MetadataExt))
+			if err != nil || len(files) != 4 {
+				t.Fatalf("%d objects stored, expected the 4 within the limit: %v", len(files), err)
+			}
+		})
+	}
+}
+
+// TestGetObjectVerifyOnly checks that a verify-only server refuses to
+// serve object contents with 403 rather than failing to decrypt them.
+func TestGetObjectVerifyOnly(t *testing.T) {
+	ts := newTestServer(t)
+	dataID := ts.storeObject(t, randomBytes(t, 1000))
+	ts.cfg.EncryptionKey = ""
+	ts.cfg.VerifyOnly = true
+	ts.start(t)
+	if resp := ts.do(t, http.MethodGet, "/objects/"+dataID, "alpha-token", nil, nil); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("status %d, expected %d", resp.StatusCode, http.StatusForbidden)
+	}
+}
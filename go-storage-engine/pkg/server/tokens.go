@@ -0,0 +1,138 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Tokens are the bearer tokens the object endpoints accept, each with the
+// namespace its requests are attributed to.
+type Tokens []Token
+
+// Token is one accepted bearer token.
+type Token struct {
+	Namespace string
+	Secret    string
+}
+
+// LoadTokens reads a tokens file: one "<namespace> <token>" pair per line.
+// Blank lines and lines starting with # are skipped. An empty path loads
+// no tokens.
+func LoadTokens(path string) (Tokens, error) {
+	if path == "" {
+		return nil, nil
+	}
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tokens: %w", err)
+	}
+	var tokens Tokens
+	for i, line := range strings.Split(string(contents), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("tokens %s: line %d: want <namespace> <token>", path, i+1)
+		}
+		tokens = append(tokens, Token{Namespace: fields[0], Secret: fields[1]})
+	}
+	return tokens, nil
+}
+
+// namespace returns the namespace of secret, comparing it with every
+// token in constant time.
+func (t Tokens) namespace(secret string) (string, bool) {
+	found := ""
+	for _, token := range t {
+		if subtle.ConstantTimeCompare([]byte(secret), []byte(token.Secret)) == 1 && found == "" {
+			found = token.Namespace
+		}
+	}
+	return found, found != ""
+}
+
+type namespaceKey struct{}
+
+// requestNamespace returns the namespace of the token requireToken
+// accepted for a request.
+func requestNamespace(r *http.Request) string {
+	if ns, ok := r.Context().Value(namespaceKey{}).(string); ok {
+		return ns
+	}
+	return defaultNamespace
+}
+
+var errNoTokens = errors.New("object endpoints are disabled (set TOKENS_FILE or ADMIN_TOKEN, or create a token)")
+
+// caller is who a request's bearer token identifies.
+type caller struct {
+	namespace string
+	admin     bool
+	objects   bool
+}
+
+// authenticate identifies the caller by the request's bearer token: one
+// of the tokens file, the admin token or a managed token. Managed tokens
+// are looked up afresh for every request, so a revoked token is refused
+// from the next request on.
+func (s *Server) authenticate(r *http.Request) (caller, bool) {
+	secret, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || secret == "" {
+		return caller{}, false
+	}
+	if namespace, ok := s.tokens.namespace(secret); ok {
+		return caller{namespace: namespace, objects: true}, true
+	}
+	if s.cfg.AdminToken != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(s.cfg.AdminToken)) == 1 {
+		return caller{namespace: defaultNamespace, admin: true, objects: true}, true
+	}
+	if token, ok := s.managed.Authenticate(secret, time.Now()); ok {
+		admin := token.HasScope(ScopeAdmin)
+		return caller{namespace: token.Namespace, admin: admin, objects: admin || token.HasScope(ScopeObjects)}, true
+	}
+	return caller{}, false
+}
+
+// requireToken only lets through requests bearing a token that can use
+// the object endpoints, and attributes them to the token's namespace.
+// Admin requests count towards defaultNamespace. Without any token
+// configured, the object endpoints are disabled.
+func (s *Server) requireToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(s.tokens) == 0 && s.cfg.AdminToken == "" && s.managed.Empty() {
+			http.Error(w, errNoTokens.Error(), http.StatusForbidden)
+			return
+		}
+		who, ok := s.authenticate(r)
+		if !ok || !who.objects {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), namespaceKey{}, who.namespace)))
+	}
+}
+
+// requireAdmin only lets through requests bearing the admin token or a
+// managed token with the admin scope. Without either, admin endpoints are
+// disabled.
+func (s *Server) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.cfg.AdminToken == "" && s.managed.Empty() {
+			http.Error(w, "admin endpoints are disabled (set ADMIN_TOKEN, or create an admin token with token create --local)", http.StatusForbidden)
+			return
+		}
+		if who, ok := s.authenticate(r); !ok || !who.admin {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,346 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Scopes a managed token can be given. Admin tokens can also use the
+// object endpoints.
+const (
+	ScopeObjects = "objects"
+	ScopeAdmin   = "admin"
+)
+
+// ErrTokenNotFound is returned when revoking a token the store doesn't hold.
+var ErrTokenNotFound = errors.New("token not found")
+
+// TokenStorePath returns where the managed tokens of a server over
+// metadataDir are kept.
+func TokenStorePath(metadataDir string) string {
+	return filepath.Join(metadataDir, ".tokens.json")
+}
+
+// ManagedToken is a token created through a TokenStore. Only the sha256 of
+// its secret is kept; the secret itself is shown once, when it is created.
+type ManagedToken struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Hash      string     `json:"hash,omitempty"` // hex sha256 of the secret
+	Scopes    []string   `json:"scopes"`
+	Namespace string     `json:"namespace"`
+	Created   time.Time  `json:"created"`
+	Expires   *time.Time `json:"expires,omitempty"`
+	Revoked   *time.Time `json:"revoked,omitempty"`
+}
+
+// HasScope reports whether the token was given scope.
+func (t ManagedToken) HasScope(scope string) bool {
+	return slices.Contains(t.Scopes, scope)
+}
+
+// Valid reports whether the token is accepted at now: it is neither
+// revoked nor expired.
+func (t ManagedToken) Valid(now time.Time) bool {
+	return t.Revoked == nil && (t.Expires == nil || now.Before(*t.Expires))
+}
+
+// TokenStore keeps managed tokens in a JSON file, rewritten through a
+// temporary file and a rename like the usage counters. Tokens are looked
+// up in memory; the file is read again whenever it changes, so tokens
+// created or revoked by another process, such as token create --local,
+// take effect with the next request.
+type TokenStore struct {
+	mu      sync.Mutex
+	path    string
+	tokens  []ManagedToken
+	byHash  map[string]int
+	modTime time.Time
+	size    int64
+}
+
+// OpenTokenStore reads the tokens kept at path, starting with none if the
+// file doesn't exist yet.
+func OpenTokenStore(path string) (*TokenStore, error) {
+	ts := &TokenStore{path: path}
+	if err := ts.refresh(); err != nil {
+		return nil, err
+	}
+	return ts, nil
+}
+
+// refresh reads the file again if it has changed since it was last read
+// or written, with ts.mu held.
+func (ts *TokenStore) refresh() error {
+	info, err := os.Stat(ts.path)
+	if errors.Is(err, os.ErrNotExist) {
+		ts.load(nil)
+		ts.modTime, ts.size = time.Time{}, 0
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read tokens: %w", err)
+	}
+	if ts.byHash != nil && info.ModTime().Equal(ts.modTime) && info.Size() == ts.size {
+		return nil
+	}
+	data, err := os.ReadFile(ts.path)
+	if err != nil {
+		return fmt.Errorf("failed to read tokens: %w", err)
+	}
+	var tokens []ManagedToken
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return fmt.Errorf("invalid tokens file %s: %w", ts.path, err)
+	}
+	ts.load(tokens)
+	ts.modTime, ts.size = info.ModTime(), info.Size()
+	return nil
+}
+
+// load replaces the tokens held in memory, with ts.mu held.
+func (ts *TokenStore) load(tokens []ManagedToken) {
+	ts.tokens = tokens
+	ts.byHash = make(map[string]int, len(tokens))
+	for i, token := range tokens {
+		ts.byHash[token.Hash] = i
+	}
+}
+
+// save writes tokens to the file and, once they are written, keeps them
+// in memory, with ts.mu held.
+func (ts *TokenStore) save(tokens []ManagedToken) error {
+	data, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(ts.path, data, 0600); err != nil {
+		return fmt.Errorf("failed to write tokens: %w", err)
+	}
+	ts.load(tokens)
+	if info, err := os.Stat(ts.path); err == nil {
+		ts.modTime, ts.size = info.ModTime(), info.Size()
+	}
+	return nil
+}
+
+// Create adds a token named name for namespace with the given scopes,
+// expiring after ttl unless ttl is zero, and returns it along with its
+// secret.
+func (ts *TokenStore) Create(name, namespace string, scopes []string, ttl time.Duration, now time.Time) (ManagedToken, string, error) {
+	if name == "" {
+		return ManagedToken{}, "", errors.New("a token needs a name")
+	}
+	if len(scopes) == 0 {
+		scopes = []string{ScopeObjects}
+	}
+	for _, scope := range scopes {
+		if scope != ScopeObjects && scope != ScopeAdmin {
+			return ManagedToken{}, "", fmt.Errorf("unknown token scope %q (want %s or %s)", scope, ScopeObjects, ScopeAdmin)
+		}
+	}
+	if ttl < 0 {
+		return ManagedToken{}, "", fmt.Errorf("invalid token lifetime %s", ttl)
+	}
+	if namespace == "" {
+		namespace = defaultNamespace
+	}
+	random := make([]byte, 38)
+	if _, err := rand.Read(random); err != nil {
+		return ManagedToken{}, "", err
+	}
+	secret := hex.EncodeToString(random[6:])
+	token := ManagedToken{
+		ID:        hex.EncodeToString(random[:6]),
+		Name:      name,
+		Hash:      hashSecret(secret),
+		Scopes:    slices.Compact(slices.Sorted(slices.Values(scopes))),
+		Namespace: namespace,
+		Created:   now.UTC(),
+	}
+	if ttl > 0 {
+		expires := now.Add(ttl).UTC()
+		token.Expires = &expires
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if err := ts.refresh(); err != nil {
+		return ManagedToken{}, "", err
+	}
+	if err := ts.save(append(slices.Clone(ts.tokens), token)); err != nil {
+		return ManagedToken{}, "", err
+	}
+	token.Hash = ""
+	return token, secret, nil
+}
+
+// List returns every token, revoked and expired ones included, oldest
+// first. Hashes are left out.
+func (ts *TokenStore) List() ([]ManagedToken, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if err := ts.refresh(); err != nil {
+		return nil, err
+	}
+	tokens := slices.Clone(ts.tokens)
+	for i := range tokens {
+		tokens[i].Hash = ""
+	}
+	return tokens, nil
+}
+
+// Revoke stops the token with the given ID from being accepted. Requests
+// it has already authenticated carry on; later ones are refused.
+func (ts *TokenStore) Revoke(id string, now time.Time) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if err := ts.refresh(); err != nil {
+		return err
+	}
+	i := slices.IndexFunc(ts.tokens, func(t ManagedToken) bool { return t.ID == id })
+	if i < 0 {
+		return fmt.Errorf("%w: %s", ErrTokenNotFound, id)
+	}
+	if ts.tokens[i].Revoked != nil {
+		return nil
+	}
+	tokens := slices.Clone(ts.tokens)
+	revoked := now.UTC()
+	tokens[i].Revoked = &revoked
+	return ts.save(tokens)
+}
+
+// Empty reports whether the store holds no tokens at all.
+func (ts *TokenStore) Empty() bool {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.refresh()
+	return len(ts.tokens) == 0
+}
+
+// Authenticate returns the token whose secret is secret, if it is valid
+// at now. The file is only read again if it has changed.
+func (ts *TokenStore) Authenticate(secret string, now time.Time) (ManagedToken, bool) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if err := ts.refresh(); err != nil {
+		// Keep going with the tokens last read rather than locking everyone out
+		ts.modTime = time.Time{}
+	}
+	i, ok := ts.byHash[hashSecret(secret)]
+	if !ok || !ts.tokens[i].Valid(now) {
+		return ManagedToken{}, false
+	}
+	return ts.tokens[i], true
+}
+
+// hashSecret is how token secrets are kept. Secrets are random, so a
+// plain sha256 is as good as a password hash and cheap on every request.
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// writeFileAtomic replaces the file at path with data through a temporary
+// file and a rename, so a crash never leaves it torn.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// TokenRequest is the body of a request to create a token.
+type TokenRequest struct {
+	Name      string   `json:"name"`
+	Namespace string   `json:"namespace,omitempty"`
+	Scopes    []string `json:"scopes,omitempty"`
+	TTL       string   `json:"ttl,omitempty"` // e.g. "720h"; empty never expires
+}
+
+// CreatedToken is the response to a token being created. The secret is
+// never shown again.
+type CreatedToken struct {
+	Token  ManagedToken `json:"token"`
+	Secret string       `json:"secret"`
+}
+
+// handleCreateToken creates a managed token.
+func (s *Server) handleCreateToken(w http.ResponseWriter, r *http.Request) {
+	var req TokenRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		http.Error(w, "invalid token request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	var ttl time.Duration
+	if req.TTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(req.TTL); err != nil {
+			http.Error(w, "invalid ttl: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	token, secret, err := s.managed.Create(req.Name, req.Namespace, req.Scopes, ttl, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.logger.Info("Token created", zap.String("id", token.ID), zap.String("name", token.Name), zap.String("namespace", token.Namespace), zap.Strings("scopes", token.Scopes))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(CreatedToken{Token: token, Secret: secret})
+}
+
+// handleListTokens lists the managed tokens as JSON.
+func (s *Server) handleListTokens(w http.ResponseWriter, r *http.Request) {
+	tokens, err := s.managed.List()
+	if err != nil {
+		s.logger.Error("Failed to list tokens", zap.Error(err))
+		http.Error(w, "failed to list tokens", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// handleRevokeToken revokes a managed token.
+func (s *Server) handleRevokeToken(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	err := s.managed.Revoke(id, time.Now())
+	if errors.Is(err, ErrTokenNotFound) {
+		http.Error(w, "token not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.logger.Error("Failed to revoke token", zap.Error(err))
+		http.Error(w, "failed to revoke token", http.StatusInternalServerError)
+		return
+	}
+	s.logger.Info("Token revoked", zap.String("id", id))
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// bootstrapAdmin creates an admin token the way token create --local does,
+// next to the running server rather than through it.
+func (ts *testServer) bootstrapAdmin(t *testing.T) string {
+	t.Helper()
+	store, err := OpenTokenStore(TokenStorePath(ts.cfg.MetadataDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, secret, err := store.Create("root", "", []string{ScopeAdmin}, 0, time.Now())
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	return secret
+}
+
+func TestManagedTokensCreateUseRevoke(t *testing.T) {
+	ts := newTestServer(t)
+	if resp := ts.do(t, http.MethodGet, "/tokens", "alpha-token", nil, nil); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("admin endpoint without an admin token: status %d, expected %d", resp.StatusCode, http.StatusForbidden)
+	}
+	admin := ts.bootstrapAdmin(t)
+
+	created, err := CreateToken(ts.http.URL, admin, TokenRequest{Name: "ci", Namespace: "gamma"})
+	if err != nil {
+		t.Fatalf("CreateToken: %v", err)
+	}
+	if created.Token.Namespace != "gamma" || len(created.Token.Scopes) != 1 || created.Token.Scopes[0] != ScopeObjects {
+		t.Fatalf("created %+v", created.Token)
+	}
+	// Only the hash of the secret is kept
+	data, err := os.ReadFile(TokenStorePath(ts.cfg.MetadataDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), created.Secret) || !strings.Contains(string(data), hashSecret(created.Secret)) {
+		t.Fatal("the tokens file doesn't hold the secret's hash alone")
+	}
+
+	ts.post(t, created.Secret, randomBytes(t, 1000))
+	if got := ts.server.usage.Snapshot()["gamma"]; got.Stores != 1 {
+		t.Fatalf("gamma usage %+v, expected one store", got)
+	}
+	if resp := ts.do(t, http.MethodGet, "/tokens", created.Secret, nil, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("objects token on an admin endpoint: status %d, expected %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+
+	tokens, err := ListTokens(ts.http.URL, admin)
+	if err != nil {
+		t.Fatalf("ListTokens: %v", err)
+	}
+	if len(tokens) != 2 || tokens[1].ID != created.Token.ID || tokens[1].Hash != "" {
+		t.Fatalf("listed %+v", tokens)
+	}
+
+	if err := RevokeToken(ts.http.URL, admin, created.Token.ID); err != nil {
+		t.Fatalf("RevokeToken: %v", err)
+	}
+	if resp := ts.do(t, http.MethodPost, "/objects", created.Secret, []byte("data"), nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("revoked token: status %d, expected %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+	if err := RevokeToken(ts.http.URL, admin, "missing"); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("revoking an unknown token: %v", err)
+	}
+
+	// Revocations outlive the server
+	ts.start(t)
+	if resp := ts.do(t, http.MethodPost, "/objects", created.Secret, []byte("data"), nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("revoked token after a restart: status %d, expected %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+	ts.post(t, admin, randomBytes(t, 10))
+}
+
+func TestManagedTokensExpire(t *testing.T) {
+	ts := newTestServer(t)
+	admin := ts.bootstrapAdmin(t)
+	created, err := CreateToken(ts.http.URL, admin, TokenRequest{Name: "short", TTL: "1h"})
+	if err != nil {
+		t.Fatalf("CreateToken: %v", err)
+	}
+	if created.Token.Expires == nil || !created.Token.Expires.After(time.Now()) {
+		t.Fatalf("token expires at %v", created.Token.Expires)
+	}
+	ts.post(t, created.Secret, randomBytes(t, 10))
+
+	if _, ok := ts.server.managed.Authenticate(created.Secret, created.Token.Expires.Add(-time.Second)); !ok {
+		t.Fatal("token refused before it expired")
+	}
+	if _, ok := ts.server.managed.Authenticate(created.Secret, *created.Token.Expires); ok {
+		t.Fatal("token accepted once it expired")
+	}
+	if _, _, err := ts.server.managed.Create("bad", "", []string{"root"}, 0, time.Now()); err == nil {
+		t.Fatal("created a token with an unknown scope")
+	}
+}
+
+// blockingBody signals when its first read is made and blocks it until
+// released.
+type blockingBody struct {
+	io.Reader
+	reading chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingBody) Read(p []byte) (int, error) {
+	if b.reading != nil {
+		close(b.reading)
+		b.reading = nil
+		<-b.release
+	}
+	return b.Reader.Read(p)
+}
+
+func TestRevokeLetsInFlightRequestFinish(t *testing.T) {
+	ts := newTestServer(t)
+	admin := ts.bootstrapAdmin(t)
+	created, err := CreateToken(ts.http.URL, admin, TokenRequest{Name: "uploader", Namespace: "alpha"})
+	if err != nil {
+		t.Fatalf("CreateToken: %v", err)
+	}
+
+	// An upload whose body is being read has been authenticated
+	data := randomBytes(t, 100_000)
+	body := &blockingBody{Reader: bytes.NewReader(data), reading: make(chan struct{}), release: make(chan struct{})}
+	reading := body.reading
+	req := httptest.NewRequest(http.MethodPost, "/objects?filename=upload.bin", body)
+	req.Header.Set("Authorization", "Bearer "+created.Secret)
+	rec := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ts.server.Handler().ServeHTTP(rec, req)
+	}()
+	<-reading
+
+	if err := RevokeToken(ts.http.URL, admin, created.Token.ID); err != nil {
+		t.Fatalf("RevokeToken: %v", err)
+	}
+	close(body.release)
+	<-done
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("in-flight upload: status %d, expected %d: %s", rec.Code, http.StatusCreated, rec.Body)
+	}
+	if resp := ts.do(t, http.MethodPost, "/objects", created.Secret, data, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("next upload: status %d, expected %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// defaultNamespace is the namespace of requests made with the admin
+// token, and of objects stored before namespaces were recorded.
+const defaultNamespace = "default"
+
+// NamespaceUsage is the usage attributed to one namespace.
+type NamespaceUsage struct {
+	BytesStored    int64 `json:"bytes_stored"`
+	BytesRetrieved int64 `json:"bytes_retrieved"`
+	Stores         int64 `json:"stores"`
+	Retrievals     int64 `json:"retrievals"`
+	Objects        int64 `json:"objects"`
+	StoredBytes    int64 `json:"stored_bytes"` // current footprint
+}
+
+// Usage keeps per-namespace counters in a JSON file, rewritten through a
+// temporary file and a rename after every update so a restart or crash
+// never loses or tears them.
+type Usage struct {
+	mu         sync.Mutex
+	path       string
+	namespaces map[string]*NamespaceUsage
+}
+
+// LoadUsage reads the counters persisted at path, starting from zero if
+// the file doesn't exist yet.
+func LoadUsage(path string) (*Usage, error) {
+	u := &Usage{path: path, namespaces: make(map[string]*NamespaceUsage)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return u, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read usage file: %w", err)
+	}
+	if err := json.Unmarshal(data, &u.namespaces); err != nil {
+		return nil, fmt.Errorf("invalid usage file %s: %w", path, err)
+	}
+	return u, nil
+}
+
+// RecordStore counts a stored object of size bytes.
+func (u *Usage) RecordStore(namespace string, size int64) error {
+	return u.update(namespace, func(n *NamespaceUsage) {
+		n.BytesStored += size
+		n.Stores++
+		n.Objects++
+		n.StoredBytes += size
+	})
+}
+
+// RecordDelete removes a deleted object of size bytes from the footprint.
+func (u *Usage) RecordDelete(namespace string, size int64) error {
+	return u.update(namespace, func(n *NamespaceUsage) {
+		n.Objects = max(n.Objects-1, 0)
+		n.StoredBytes = max(n.StoredBytes-size, 0)
+	})
+}
+
+// RecordRetrieve counts size bytes served.
+func (u *Usage) RecordRetrieve(namespace string, size int64) error {
+	return u.update(namespace, func(n *NamespaceUsage) {
+		n.BytesRetrieved += size
+		n.Retrievals++
+	})
+}
+
+// Snapshot returns a copy of every namespace's counters.
+func (u *Usage) Snapshot() map[string]NamespaceUsage {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	snapshot := make(map[string]NamespaceUsage, len(u.namespaces))
+	for name, n := range u.namespaces {
+		snapshot[name] = *n
+	}
+	return snapshot
+}
+
+// update applies fn and persists the result, rolling back if it can't be written.
+func (u *Usage) update(namespace string, fn func(*NamespaceUsage)) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	n, ok := u.namespaces[namespace]
+	if !ok {
+		n = &NamespaceUsage{}
+		u.namespaces[namespace] = n
+	}
+	before := *n
+	fn(n)
+	if err := u.save(); err != nil {
+		*n = before
+		if !ok {
+			delete(u.namespaces, namespace)
+		}
+		return err
+	}
+	return nil
+}
+
+func (u *Usage) save() error {
+	data, err := json.MarshalIndent(u.namespaces, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(u.path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write usage file: %w", err)
+	}
+	return nil
+}
+
+// countingWriter records the status and body bytes of a response.
+type countingWriter struct {
+	http.ResponseWriter
+	status int
+	n      int64
+}
+
+func (w *countingWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// countRetrievals attributes the bytes of successful responses to the
+// namespace of the request's token.
+func (s *Server) countRetrievals(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cw := &countingWriter{ResponseWriter: w}
+		next(cw, r)
+		if cw.status < 200 || cw.status >= 300 || r.Method == http.MethodHead {
+			return
+		}
+		if err := s.usage.RecordRetrieve(requestNamespace(r), cw.n); err != nil {
+			s.logger.Error("Failed to record usage", zap.Error(err))
+		}
+	}
+}
+
+// handleUsage reports every namespace's usage as JSON.
+func (s *Server) handleUsage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.usage.Snapshot())
+}
+
+// handleMetrics reports usage in the Prometheus text format.
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeUsageMetrics(w, s.usage.Snapshot())
+	writeMemoryMetrics(w, s.memory.stats())
+}
+
+func writeUsageMetrics(w io.Writer, usage map[string]NamespaceUsage) {
+	names := make([]string, 0, len(usage))
+	for name := range usage {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	metrics := []struct {
+		name, kind, help string
+		value            func(NamespaceUsage) int64
+	}{
+		{"vault_stored_bytes_total", "counter", "Bytes stored.", func(n NamespaceUsage) int64 { return n.BytesStored }},
+		{"vault_retrieved_bytes_total", "counter", "Bytes retrieved.", func(n NamespaceUsage) int64 { return n.BytesRetrieved }},
+		{"vault_stores_total", "counter", "Objects stored.", func(n NamespaceUsage) int64 { return n.Stores }},
+		{"vault_retrievals_total", "counter", "Objects retrieved.", func(n NamespaceUsage) int64 { return n.Retrievals }},
+		{"vault_objects", "gauge", "Objects currently stored.", func(n NamespaceUsage) int64 { return n.Objects }},
+		{"vault_footprint_bytes", "gauge", "Bytes currently stored.", func(n NamespaceUsage) int64 { return n.StoredBytes }},
+	}
+	for _, m := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+		for _, name := range names {
+			fmt.Fprintf(w, "%s{namespace=%q} %d\n", m.name, name, m.value(usage[name]))
+		}
+	}
+}
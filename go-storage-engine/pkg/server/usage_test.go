@@ -0,0 +1,62 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func (ts *testServer) post(t *testing.T, token string, data []byte) storedObject {
+	t.Helper()
+	resp := ts.do(t, http.MethodPost, "/objects?filename=object.bin", token, data, nil)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("store: status %d, expected %d", resp.StatusCode, http.StatusCreated)
+	}
+	var stored storedObject
+	if err := json.NewDecoder(resp.Body).Decode(&stored); err != nil {
+		t.Fatal(err)
+	}
+	return stored
+}
+
+func TestUsageFollowsTokensAcrossRestarts(t *testing.T) {
+	ts := newTestServer(t)
+	alpha1 := ts.post(t, "alpha-token", randomBytes(t, 1000))
+	ts.post(t, "alpha-token", randomBytes(t, 2000))
+	beta := ts.post(t, "beta-token", randomBytes(t, 3000))
+
+	// A namespace can't delete another's objects
+	if resp := ts.do(t, http.MethodDelete, "/objects/"+alpha1.DataID, "beta-token", nil, nil); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("cross-namespace delete: status %d, expected %d", resp.StatusCode, http.StatusForbidden)
+	}
+	for _, del := range []struct{ id, token string }{{alpha1.DataID, "alpha-token"}, {beta.DataID, "beta-token"}} {
+		if resp := ts.do(t, http.MethodDelete, "/objects/"+del.id, del.token, nil, nil); resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("delete: status %d, expected %d", resp.StatusCode, http.StatusNoContent)
+		}
+	}
+
+	// A header naming another namespace changes nothing
+	if resp := ts.do(t, http.MethodGet, "/objects/"+beta.DataID, "alpha-token", nil, http.Header{"X-Vault-Namespace": {"beta"}}); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("get of a deleted object: status %d", resp.StatusCode)
+	}
+
+	want := map[string]NamespaceUsage{
+		"alpha": {BytesStored: 3000, Stores: 2, Objects: 1, StoredBytes: 2000},
+		"beta":  {BytesStored: 3000, Stores: 1, Objects: 0, StoredBytes: 0},
+	}
+	check := func(when string) {
+		t.Helper()
+		got := ts.server.usage.Snapshot()
+		if len(got) != len(want) {
+			t.Fatalf("%s: usage of %d namespaces, expected %d: %+v", when, len(got), len(want), got)
+		}
+		for namespace, usage := range want {
+			if got[namespace] != usage {
+				t.Fatalf("%s: %s usage %+v, expected %+v", when, namespace, got[namespace], usage)
+			}
+		}
+	}
+	check("before restart")
+	ts.start(t)
+	check("after restart")
+}
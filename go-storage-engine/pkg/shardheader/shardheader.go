@@ -0,0 +1,138 @@
+// Package shardheader defines the self-describing header shard files can
+// start with, so that a shard found without its object's metadata still
+// says what it is a part of: which shard set, which shard of how many, and
+// how much data the set holds. The header is versioned on its own, apart
+// from the metadata format.
+//
+// A header is laid out big endian as
+//
+//	"VSHD" | version (uint8) | dataID length (uint16) | dataID |
+//	index (uint32) | data shards (uint32) | parity shards (uint32) |
+//	shard length (uint64) | object length (uint64) | CRC-32C (uint32)
+//
+// where the CRC, Castagnoli, covers every byte of the header before it.
+package shardheader
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+)
+
+// Version is the header version Encode writes.
+const Version = 1
+
+// PrefixSize is the size of the magic, version and dataID length, which
+// HeaderSize tells the size of the whole header from.
+const PrefixSize = 4 + 1 + 2
+
+// fixedSize is the size of a header with an empty dataID.
+const fixedSize = PrefixSize + 4 + 4 + 4 + 8 + 8 + 4
+
+var magic = []byte("VSHD")
+
+var (
+	// ErrNoHeader is returned by Decode for data that doesn't start with a
+	// header, like shards written before headers were.
+	ErrNoHeader = errors.New("no shard header")
+	// ErrCorrupt is returned by Decode for a header whose CRC doesn't match
+	// or that is cut short.
+	ErrCorrupt = errors.New("corrupt shard header")
+	// ErrUnsupportedVersion is returned by Decode for a header written by a
+	// newer version than this one reads.
+	ErrUnsupportedVersion = errors.New("unsupported shard header version")
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Header describes a shard. DataShards, ParityShards and ObjectLength are 0
+// when whoever wrote the shard didn't know them.
+type Header struct {
+	DataID       string // The shard set's ID, which the shard is stored under
+	Index        int
+	DataShards   int
+	ParityShards int
+	ShardLength  int64 // Bytes following the header
+	ObjectLength int64 // Bytes the shard set decodes to, before padding
+}
+
+// Encode returns the header as it is written in front of a shard.
+func Encode(h Header) ([]byte, error) {
+	if len(h.DataID) > math.MaxUint16 {
+		return nil, fmt.Errorf("dataID of %d bytes is too long for a shard header", len(h.DataID))
+	}
+	for _, n := range []int{h.Index, h.DataShards, h.ParityShards} {
+		if n < 0 || int64(n) > math.MaxUint32 {
+			return nil, fmt.Errorf("shard count or index %d doesn't fit a shard header", n)
+		}
+	}
+	if h.ShardLength < 0 || h.ObjectLength < 0 {
+		return nil, fmt.Errorf("negative length in shard header")
+	}
+	out := make([]byte, 0, Size(h.DataID))
+	out = append(out, magic...)
+	out = append(out, Version)
+	out = binary.BigEndian.AppendUint16(out, uint16(len(h.DataID)))
+	out = append(out, h.DataID...)
+	out = binary.BigEndian.AppendUint32(out, uint32(h.Index))
+	out = binary.BigEndian.AppendUint32(out, uint32(h.DataShards))
+	out = binary.BigEndian.AppendUint32(out, uint32(h.ParityShards))
+	out = binary.BigEndian.AppendUint64(out, uint64(h.ShardLength))
+	out = binary.BigEndian.AppendUint64(out, uint64(h.ObjectLength))
+	return binary.BigEndian.AppendUint32(out, crc32.Checksum(out, castagnoli)), nil
+}
+
+// Size returns the size of the header of a shard stored under dataID.
+func Size(dataID string) int {
+	return fixedSize + len(dataID)
+}
+
+// HeaderSize returns the size of the header a shard starts with from its
+// first PrefixSize bytes, so the header can be read without reading the
+// shard. It fails
+// with ErrNoHeader if prefix doesn't start a header, and checks nothing
+// past it.
+func HeaderSize(prefix []byte) (int, error) {
+	if len(prefix) < PrefixSize || !bytes.HasPrefix(prefix, magic) {
+		return 0, ErrNoHeader
+	}
+	if prefix[len(magic)] != Version {
+		return 0, fmt.Errorf("%w: %d", ErrUnsupportedVersion, prefix[len(magic)])
+	}
+	return fixedSize + int(binary.BigEndian.Uint16(prefix[len(magic)+1:])), nil
+}
+
+// Decode reads the header data starts with and returns it with its size,
+// which is where the shard starts. It fails with ErrNoHeader if data
+// doesn't start with one, and ErrCorrupt if its CRC doesn't match.
+func Decode(data []byte) (Header, int, error) {
+	size, err := HeaderSize(data)
+	if err != nil {
+		return Header{}, 0, err
+	}
+	if len(data) < size {
+		return Header{}, 0, fmt.Errorf("%w: %d bytes of a %d byte header", ErrCorrupt, len(data), size)
+	}
+	body, sum := data[:size-4], binary.BigEndian.Uint32(data[size-4:size])
+	if crc32.Checksum(body, castagnoli) != sum {
+		return Header{}, 0, fmt.Errorf("%w: CRC mismatch", ErrCorrupt)
+	}
+
+	idLength := size - fixedSize
+	fields := body[PrefixSize+idLength:]
+	h := Header{
+		DataID:       string(body[PrefixSize : PrefixSize+idLength]),
+		Index:        int(binary.BigEndian.Uint32(fields)),
+		DataShards:   int(binary.BigEndian.Uint32(fields[4:])),
+		ParityShards: int(binary.BigEndian.Uint32(fields[8:])),
+		ShardLength:  int64(binary.BigEndian.Uint64(fields[12:])),
+		ObjectLength: int64(binary.BigEndian.Uint64(fields[20:])),
+	}
+	if h.ShardLength < 0 || h.ObjectLength < 0 {
+		return Header{}, 0, fmt.Errorf("%w: negative length", ErrCorrupt)
+	}
+	return h, size, nil
+}
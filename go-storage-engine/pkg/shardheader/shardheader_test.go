@@ -0,0 +1,75 @@
+package shardheader
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	for _, h := range []Header{
+		{DataID: "4f2a9c", Index: 13, DataShards: 10, ParityShards: 4, ShardLength: 1 << 20, ObjectLength: 10<<20 - 7},
+		{DataID: "", Index: 0},
+		{DataID: string(make([]byte, 1000)), Index: 299, DataShards: 200, ParityShards: 100, ShardLength: 64, ObjectLength: 1 << 40},
+	} {
+		data, err := Encode(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) != Size(h.DataID) {
+			t.Fatalf("encoded %d bytes, Size says %d", len(data), Size(h.DataID))
+		}
+		if size, err := HeaderSize(data[:PrefixSize]); err != nil || size != len(data) {
+			t.Fatalf("HeaderSize = %d, %v; encoded %d bytes", size, err, len(data))
+		}
+		got, size, err := Decode(append(data, "shard"...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != h || size != len(data) {
+			t.Fatalf("decoded %+v of %d bytes, encoded %+v of %d", got, size, h, len(data))
+		}
+	}
+}
+
+func TestEncodeRefuses(t *testing.T) {
+	for _, h := range []Header{
+		{DataID: string(make([]byte, 1<<16))},
+		{Index: -1},
+		{ShardLength: -1},
+	} {
+		if _, err := Encode(h); err == nil {
+			t.Fatalf("encoded %+v", h)
+		}
+	}
+}
+
+func TestDecodeRejectsCorruptHeaders(t *testing.T) {
+	data, err := Encode(Header{DataID: "obj", Index: 3, DataShards: 10, ParityShards: 4, ShardLength: 100, ObjectLength: 900})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A flipped bit anywhere past the magic and version, CRC included
+	for i := PrefixSize - 2; i < len(data); i++ {
+		corrupt := append([]byte(nil), data...)
+		corrupt[i] ^= 0x10
+		if _, _, err := Decode(corrupt); !errors.Is(err, ErrCorrupt) {
+			t.Fatalf("byte %d flipped: %v", i, err)
+		}
+	}
+	for _, n := range []int{PrefixSize, len(data) - 1} {
+		if _, _, err := Decode(data[:n]); !errors.Is(err, ErrCorrupt) {
+			t.Fatalf("cut to %d bytes: %v", n, err)
+		}
+	}
+
+	newer := append([]byte(nil), data...)
+	newer[len(magic)] = Version + 1
+	if _, _, err := Decode(newer); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Fatalf("newer version: %v", err)
+	}
+	for _, plain := range [][]byte{nil, []byte("VSH"), []byte("an old shard without a header")} {
+		if _, _, err := Decode(plain); !errors.Is(err, ErrNoHeader) {
+			t.Fatalf("%q: %v", plain, err)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package sharding
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrShardExists is returned by CreateShard when the shard is already there.
+	ErrShardExists = errors.New("shard already exists")
+	// ErrShardNotFound is wrapped by stores when a shard isn't at a location.
+	ErrShardNotFound = errors.New("shard not found")
+)
+
+// Optional capabilities. A ShardStore only has to store and retrieve
+// shards; backends that can do more implement these interfaces, and higher
+// layers go through Probe and the helpers below rather than type
+// assertions, so every missing capability has one documented fallback.
+
+// ShardExister is implemented by stores that can tell whether a shard is
+// there without fetching it.
+type ShardExister interface {
+	HasShard(dataID string, index int, location string) (bool, error)
+}
+
+// ShardLister is implemented by stores that can list the shards at a
+// location.
+type ShardLister interface {
+	ListShards(location string) ([]ShardRef, error)
+}
+
+// ShardCreator is implemented by stores that can write a shard only if it
+// doesn't exist yet, atomically.
+type ShardCreator interface {
+	CreateShard(dataID string, index int, shard []byte, location string) error
+}
+
+// ShardChecksummer is implemented by stores that can checksum a shard
+// where it is stored, without sending it back.
+type ShardChecksummer interface {
+	ShardChecksum(dataID string, index int, location string) (string, error)
+}
+
+// ShardRangeReader is implemented by stores that can send back part of a
+// shard as stored, header included, without the rest.
+type ShardRangeReader interface {
+	RetrieveShardRange(dataID string, index int, location string, offset, length int64) ([]byte, error)
+}
+
+// ShardLocker is implemented by stores that can make a shard unchangeable
+// until it is unlocked again.
+type ShardLocker interface {
+	LockShard(dataID string, index int, location string) error
+	UnlockShard(dataID string, index int, location string) error
+}
+
+// ShardRef names a shard found by listing a location. Shards stored under
+// obfuscated names can't be traced back to their object and have only a
+// Name, with an Index of -1.
+type ShardRef struct {
+	Name   string
+	DataID string
+	Index  int
+}
+
+// Capabilities records which optional interfaces a store implements.
+type Capabilities struct {
+	Prove        bool // RetrievabilityProver
+	Delete       bool // ShardDeleter
+	Exists       bool // ShardExister
+	List         bool // ShardLister
+	AtomicCreate bool // ShardCreator
+	Checksum     bool // ShardChecksummer
+	Lock         bool // ShardLocker
+	Quarantine   bool // ShardQuarantiner
+	Compact      bool // ShardCompacter
+	Range        bool // ShardRangeReader
+}
+
+// String lists the capabilities present, like "prove,delete", or "none".
+func (c Capabilities) String() string {
+	var names []string
+	for _, capability := range []struct {
+		name    string
+		present bool
+	}{
+		{"prove", c.Prove},
+		{"delete", c.Delete},
+		{"exists", c.Exists},
+		{"list", c.List},
+		{"atomic-create", c.AtomicCreate},
+		{"checksum", c.Checksum},
+		{"lock", c.Lock},
+		{"quarantine", c.Quarantine},
+		{"compact", c.Compact},
+		{"range", c.Range},
+	} {
+		if capability.present {
+			names = append(names, capability.name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
+// unwrapper is implemented by stores that wrap another, like
+// HealthTrackingStore. Wrappers forward every optional method, so what a
+// wrapped store can do is decided by the store inside.
+type unwrapper interface {
+	Unwrap() ShardStore
+}
+
+// Probe reports the optional capabilities of a store.
+func Probe(store ShardStore) Capabilities {
+	for {
+		wrapper, ok := store.(unwrapper)
+		if !ok {
+			break
+		}
+		store = wrapper.Unwrap()
+	}
+	_, prove := store.(RetrievabilityProver)
+	_, remove := store.(ShardDeleter)
+	_, exists := store.(ShardExister)
+	_, list := store.(ShardLister)
+	_, create := store.(ShardCreator)
+	_, checksum := store.(ShardChecksummer)
+	_, lock := store.(ShardLocker)
+	_, quarantine := store.(ShardQuarantiner)
+	_, compact := store.(ShardCompacter)
+	_, ranged := store.(ShardRangeReader)
+	return Capabilities{Prove: prove, Delete: remove, Exists: exists, List: list, AtomicCreate: create, Checksum: checksum, Lock: lock, Quarantine: quarantine, Compact: compact, Range: ranged}
+}
+
+// HasShard reports whether a shard is at a location. Without the exists
+// capability the shard is fetched, and any failure to fetch it counts as
+// the shard not being there.
+func HasShard(store ShardStore, dataID string, index int, location string) (bool, error) {
+	if Probe(store).Exists {
+		return store.(ShardExister).HasShard(dataID, index, location)
+	}
+	_, err := store.RetrieveShard(dataID, index, location)
+	return err == nil, nil
+}
+
+// CreateShard writes a shard unless it already exists, failing with
+// ErrShardExists if it does. Without the atomic-create capability this is
+// HasShard followed by StoreShard, which a concurrent writer can race.
+func CreateShard(store ShardStore, dataID string, index int, shard []byte, location string) error {
+	if Probe(store).AtomicCreate {
+		return store.(ShardCreator).CreateShard(dataID, index, shard, location)
+	}
+	exists, err := HasShard(store, dataID, index, location)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("%w: shard %d of %s at %s", ErrShardExists, index, dataID, location)
+	}
+	return store.StoreShard(dataID, index, shard, location)
+}
+
+// ShardChecksum returns the TransferChecksum of a shard. Without the
+// checksum capability the shard is fetched and checksummed locally.
+func ShardChecksum(store ShardStore, dataID string, index int, location string) (string, error) {
+	if Probe(store).Checksum {
+		return store.(ShardChecksummer).ShardChecksum(dataID, index, location)
+	}
+	shard, err := store.RetrieveShard(dataID, index, location)
+	if err != nil {
+		return "", err
+	}
+	return TransferChecksum(shard), nil
+}
+
+// RetrieveShardRange returns length bytes of a shard as stored, from
+// offset. Without the range capability the whole shard is fetched and the
+// range cut from it. A range past the end of the shard is an error.
+func RetrieveShardRange(store ShardStore, dataID string, index int, location string, offset, length int64) ([]byte, error) {
+	if offset < 0 || length < 0 {
+		return nil, fmt.Errorf("invalid range %d+%d", offset, length)
+	}
+	if Probe(store).Range {
+		return store.(ShardRangeReader).RetrieveShardRange(dataID, index, location, offset, length)
+	}
+	shard, err := store.RetrieveShard(dataID, index, location)
+	if err != nil {
+		return nil, err
+	}
+	if offset+length > int64(len(shard)) {
+		return nil, fmt.Errorf("range %d+%d is past the end of shard %d of %s (%d bytes)", offset, length, index, dataID, len(shard))
+	}
+	return shard[offset : offset+length], nil
+}
+
+// DeleteShard removes a shard. There is no fallback: without the delete
+// capability it fails with errors.ErrUnsupported and the shard is left for
+// the operator to remove.
+func DeleteShard(store ShardStore, dataID string, index int, location string) error {
+	if Probe(store).Delete {
+		return store.(ShardDeleter).DeleteShard(dataID, index, location)
+	}
+	return fmt.Errorf("%T can't delete shards: %w", store, errors.ErrUnsupported)
+}
+
+// ListShards lists the shards at a location. There is no fallback: without
+// the list capability it fails with errors.ErrUnsupported, and callers work
+// from the shards recorded in metadata instead.
+func ListShards(store ShardStore, location string) ([]ShardRef, error) {
+	if Probe(store).List {
+		return store.(ShardLister).ListShards(location)
+	}
+	return nil, fmt.Errorf("%T can't list shards: %w", store, errors.ErrUnsupported)
+}
+
+// ListQuarantine lists the shards quarantined at a location. There is no
+// fallback: without the quarantine capability it fails with
+// errors.ErrUnsupported.
+func ListQuarantine(store ShardStore, location string) ([]QuarantinedShard, error) {
+	if Probe(store).Quarantine {
+		return store.(ShardQuarantiner).ListQuarantine(location)
+	}
+	return nil, fmt.Errorf("%T can't quarantine shards: %w", store, errors.ErrUnsupported)
+}
+
+// PurgeQuarantine removes the shards quarantined at a location before
+// before. There is no fallback: without the quarantine capability it fails
+// with errors.ErrUnsupported.
+func PurgeQuarantine(store ShardStore, location string, before time.Time) (int, error) {
+	if Probe(store).Quarantine {
+		return store.(ShardQuarantiner).PurgeQuarantine(location, before)
+	}
+	return 0, fmt.Errorf("%T can't quarantine shards: %w", store, errors.ErrUnsupported)
+}
+
+// Compact compacts a store over locations. There is no fallback: without
+// the compact capability it fails with errors.ErrUnsupported.
+func Compact(store ShardStore, locations []string) (CompactReport, error) {
+	if Probe(store).Compact {
+		return store.(ShardCompacter).Compact(locations)
+	}
+	return CompactReport{}, fmt.Errorf("%T can't compact: %w", store, errors.ErrUnsupported)
+}
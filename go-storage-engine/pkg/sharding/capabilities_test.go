@@ -0,0 +1,101 @@
+package sharding
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// minimalStore only stores and retrieves shards: embedding the interface
+// hides every optional method of the store inside.
+type minimalStore struct {
+	ShardStore
+}
+
+func TestProbe(t *testing.T) {
+	full := Probe(NewInMemoryShardStore())
+	if !full.Delete || !full.Exists || !full.List || !full.AtomicCreate || !full.Checksum {
+		t.Fatalf("InMemoryShardStore probed as %s", full)
+	}
+	health := NewHealthTracker(filepath.Join(t.TempDir(), "health.json"))
+	for name, tc := range map[string]struct {
+		store ShardStore
+		want  Capabilities
+	}{
+		"minimal":         {&minimalStore{NewInMemoryShardStore()}, Capabilities{}},
+		"wrapped minimal": {&HealthTrackingStore{ShardStore: &minimalStore{NewInMemoryShardStore()}, Health: health}, Capabilities{}},
+		"wrapped":         {&HealthTrackingStore{ShardStore: NewInMemoryShardStore(), Health: health}, full},
+	} {
+		if got := Probe(tc.store); got != tc.want {
+			t.Fatalf("%s store probed as %s, expected %s", name, got, tc.want)
+		}
+	}
+	if s := (Capabilities{}).String(); s != "none" {
+		t.Fatalf("no capabilities listed as %q", s)
+	}
+	if s := (Capabilities{Prove: true, AtomicCreate: true}).String(); s != "prove,atomic-create" {
+		t.Fatalf("capabilities listed as %q", s)
+	}
+}
+
+// TestCapabilityFallbacks runs each helper against a store with every
+// capability and one with none. Where there is a fallback both must give
+// the same answers; where there isn't, the minimal store must fail with
+// errors.ErrUnsupported rather than pretend.
+func TestCapabilityFallbacks(t *testing.T) {
+	shard := []byte("shard contents")
+	for name, store := range map[string]ShardStore{
+		"full":    NewInMemoryShardStore(),
+		"minimal": &minimalStore{NewInMemoryShardStore()},
+	} {
+		location := t.TempDir()
+		if ok, err := HasShard(store, "data", 0, location); ok || err != nil {
+			t.Fatalf("%s: HasShard before storing: %t, %v", name, ok, err)
+		}
+		if err := CreateShard(store, "data", 0, shard, location); err != nil {
+			t.Fatalf("%s: CreateShard: %v", name, err)
+		}
+		if ok, err := HasShard(store, "data", 0, location); !ok || err != nil {
+			t.Fatalf("%s: HasShard after storing: %t, %v", name, ok, err)
+		}
+		if err := CreateShard(store, "data", 0, []byte("other"), location); !errors.Is(err, ErrShardExists) {
+			t.Fatalf("%s: CreateShard over a shard: %v", name, err)
+		}
+		if sum, err := ShardChecksum(store, "data", 0, location); err != nil || sum != TransferChecksum(shard) {
+			t.Fatalf("%s: ShardChecksum %q, %v", name, sum, err)
+		}
+		if part, err := RetrieveShardRange(store, "data", 0, location, 6, 4); err != nil || !bytes.Equal(part, []byte("cont")) {
+			t.Fatalf("%s: RetrieveShardRange %q, %v", name, part, err)
+		}
+		if _, err := RetrieveShardRange(store, "data", 0, location, 10, 10); err == nil {
+			t.Fatalf("%s: read a range past the end of the shard", name)
+		}
+
+		if name == "full" {
+			if err := DeleteShard(store, "data", 0, location); err != nil {
+				t.Fatalf("DeleteShard: %v", err)
+			}
+			continue
+		}
+		if err := DeleteShard(store, "data", 0, location); !errors.Is(err, errors.ErrUnsupported) {
+			t.Fatalf("DeleteShard on a minimal store: %v", err)
+		}
+		if ok, _ := HasShard(store, "data", 0, location); !ok {
+			t.Fatal("a failed delete removed the shard")
+		}
+		if _, err := ListShards(store, location); !errors.Is(err, errors.ErrUnsupported) {
+			t.Fatalf("ListShards on a minimal store: %v", err)
+		}
+		if _, err := ListQuarantine(store, location); !errors.Is(err, errors.ErrUnsupported) {
+			t.Fatalf("ListQuarantine on a minimal store: %v", err)
+		}
+		if _, err := PurgeQuarantine(store, location, time.Now()); !errors.Is(err, errors.ErrUnsupported) {
+			t.Fatalf("PurgeQuarantine on a minimal store: %v", err)
+		}
+		if _, err := Compact(store, []string{location}); !errors.Is(err, errors.ErrUnsupported) {
+			t.Fatalf("Compact on a minimal store: %v", err)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package sharding
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// bufferedStore holds writes in memory until Close flushes them to the
+// store below, the way a DB-backed or batching backend would.
+type bufferedStore struct {
+	ShardStore
+	mu      sync.Mutex
+	pending map[string][]byte
+	order   []pendingShard
+	closed  bool
+}
+
+type pendingShard struct {
+	dataID   string
+	index    int
+	location string
+}
+
+func (p pendingShard) key() string {
+	return filepath.Join(p.location, PlainShardName(p.dataID, p.index))
+}
+
+func newBufferedStore(store ShardStore) *bufferedStore {
+	return &bufferedStore{ShardStore: store, pending: make(map[string][]byte)}
+}
+
+func (b *bufferedStore) StoreShard(dataID string, index int, shard []byte, location string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return errors.New("store is closed")
+	}
+	p := pendingShard{dataID, index, location}
+	if _, ok := b.pending[p.key()]; !ok {
+		b.order = append(b.order, p)
+	}
+	b.pending[p.key()] = bytes.Clone(shard)
+	return nil
+}
+
+func (b *bufferedStore) RetrieveShard(dataID string, index int, location string) ([]byte, error) {
+	b.mu.Lock()
+	shard, ok := b.pending[pendingShard{dataID, index, location}.key()]
+	b.mu.Unlock()
+	if ok {
+		return bytes.Clone(shard), nil
+	}
+	return b.ShardStore.RetrieveShard(dataID, index, location)
+}
+
+func (b *bufferedStore) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	var errs []error
+	for _, p := range b.order {
+		errs = append(errs, b.ShardStore.StoreShard(p.dataID, p.index, b.pending[p.key()], p.location))
+	}
+	b.pending, b.order = nil, nil
+	return errors.Join(append(errs, b.ShardStore.Close())...)
+}
+
+// TestCloseFlushesBufferedWrites checks that shards written to a buffered
+// backend reach the disk only once it is closed, and are then read back
+// by a store of their own.
+func TestCloseFlushesBufferedWrites(t *testing.T) {
+	location := t.TempDir()
+	store := newBufferedStore(NewInMemoryShardStore())
+	for index := range 3 {
+		if err := store.StoreShard("abc123", index, []byte{byte(index), 1, 2, 3}, location); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, err := store.RetrieveShard("abc123", 1, location); err != nil || !bytes.Equal(got, []byte{1, 1, 2, 3}) {
+		t.Fatalf("pending shard read back as %v, %v", got, err)
+	}
+	if _, err := NewInMemoryShardStore().RetrieveShard("abc123", 1, location); !errors.Is(err, ErrShardNotFound) {
+		t.Fatalf("pending shard found on disk before Close: %v", err)
+	}
+
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	reader := NewInMemoryShardStore()
+	for index := range 3 {
+		if got, err := reader.RetrieveShard("abc123", index, location); err != nil || !bytes.Equal(got, []byte{byte(index), 1, 2, 3}) {
+			t.Fatalf("shard %d read back after Close as %v, %v", index, got, err)
+		}
+	}
+	if err := store.StoreShard("abc123", 0, []byte("late"), location); err == nil {
+		t.Fatal("stored a shard after Close")
+	}
+}
+
+// TestLayersCloseTheStoreBelow closes a buffered backend through the
+// layers the commands chain around a store, and checks that closing the
+// outermost flushes its writes and saves the health tracker.
+func TestLayersCloseTheStoreBelow(t *testing.T) {
+	location := t.TempDir()
+	healthFile := filepath.Join(t.TempDir(), "health.json")
+	builder := NewStoreBuilder()
+	if err := builder.Use(LayerHealth, TrackHealth(NewHealthTracker(healthFile))); err != nil {
+		t.Fatal(err)
+	}
+	if err := builder.Use(LayerVerifyWrites, VerifyWrites()); err != nil {
+		t.Fatal(err)
+	}
+	store, err := builder.Build(newBufferedStore(NewInMemoryShardStore()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.StoreShard("abc123", 0, []byte("shard"), location); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if got, err := NewInMemoryShardStore().RetrieveShard("abc123", 0, location); err != nil || string(got) != "shard" {
+		t.Fatalf("shard read back after Close as %q, %v", got, err)
+	}
+	if _, err := os.Stat(healthFile); err != nil {
+		t.Fatalf("health tracker not saved on Close: %v", err)
+	}
+
+	faulty := InjectFaults(FaultPlan{})(newBufferedStore(NewInMemoryShardStore()))
+	if err := faulty.StoreShard("abc123", 1, []byte("shard"), location); err != nil {
+		t.Fatal(err)
+	}
+	if err := faulty.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if _, err := NewInMemoryShardStore().RetrieveShard("abc123", 1, location); err != nil {
+		t.Fatalf("fault layer didn't close the store below: %v", err)
+	}
+}
@@ -0,0 +1,113 @@
+package sharding
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/techninja8/getvault.io/pkg/shardheader"
+)
+
+// leftoverAge is how old a temporary file at a location has to be before
+// compaction takes it for one left by a crashed process. Probes and lease
+// updates rename or remove theirs within moments.
+const leftoverAge = time.Hour
+
+// ShardCompacter is implemented by stores that keep state about shards
+// besides the shards themselves, which goes stale as shards are deleted
+// or rewritten behind their back.
+type ShardCompacter interface {
+	// Compact drops what the store holds for shards that are gone and
+	// tidies the given locations.
+	Compact(locations []string) (CompactReport, error)
+}
+
+// CompactReport is what a compaction reclaimed.
+type CompactReport struct {
+	Entries   int   // Shards dropped from memory
+	Bytes     int64 // Memory they took up
+	Leftovers int   // Temporary files removed from locations
+	DiskBytes int64 // Disk space those took up
+}
+
+// Compact drops the cached shards whose files are gone, or have been
+// replaced by a shard of another size, header aside, and removes the temporary files
+// that probes and lease updates of crashed processes left at locations.
+// Shards are stored flat in their location directories, so there are no
+// shard directories to coalesce; empty quarantine directories are removed
+// instead, and made again when a shard is next quarantined.
+func (ims *InMemoryShardStore) Compact(locations []string) (CompactReport, error) {
+	var report CompactReport
+	ims.mu.Lock()
+	for key, shards := range ims.ShardStore {
+		location, dataID, _ := strings.Cut(key, "\x00")
+		for index, shard := range shards {
+			path, err := ims.existingShardPath(dataID, index, location)
+			if err == nil {
+				info, statErr := ims.fsys().Stat(path)
+				size := int64(len(shard))
+				if statErr != nil || info.Size() == size || info.Size() == size+int64(shardheader.Size(dataID)) {
+					continue
+				}
+			}
+			delete(shards, index)
+			report.Entries++
+			report.Bytes += int64(len(shard))
+		}
+		if len(shards) == 0 {
+			delete(ims.ShardStore, key)
+		}
+	}
+	ims.mu.Unlock()
+
+	var errs []error
+	cutoff := time.Now().Add(-leftoverAge)
+	for _, location := range locations {
+		if IsObjectLocation(location) {
+			continue
+		}
+		if err := compactLocation(ims.fsys(), location, cutoff, &report); err != nil {
+			errs = append(errs, fmt.Errorf("failed to compact %s: %w", location, err))
+		}
+	}
+	return report, errors.Join(errs...)
+}
+
+// compactLocation removes the leftover temporary files older than cutoff
+// from a location directory, and its quarantine directory if it is empty.
+func compactLocation(fsys ShardFS, location string, cutoff time.Time, report *CompactReport) error {
+	entries, err := fsys.ReadDir(location)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !isLeftover(name) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || !info.ModTime().Before(cutoff) {
+			continue
+		}
+		if err := fsys.Remove(filepath.Join(location, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		report.Leftovers++
+		report.DiskBytes += info.Size()
+	}
+	// Fails, as it should, unless the directory is empty
+	fsys.Remove(filepath.Join(location, QuarantineDir))
+	return nil
+}
+
+// isLeftover reports whether a file name is one of the temporary files
+// ProbeWritable and lease updates create.
+func isLeftover(name string) bool {
+	return strings.HasPrefix(name, ".vault-probe-") || strings.HasPrefix(name, LeaseFileName+".")
+}
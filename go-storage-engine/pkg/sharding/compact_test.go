@@ -0,0 +1,118 @@
+package sharding
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestCompactDropsDeletedShards caches the shards of several objects,
+// deletes some behind the store's back and rewrites one at another size,
+// and checks compaction drops exactly those entries from memory.
+func TestCompactDropsDeletedShards(t *testing.T) {
+	location := t.TempDir()
+	store := NewInMemoryShardStore()
+	shard := bytes.Repeat([]byte("s"), 100)
+	for i := range 5 {
+		for index := range 2 {
+			if err := store.StoreShard(fmt.Sprintf("obj%d", i), index, shard, location); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for i := range 3 {
+		for index := range 2 {
+			path, err := store.existingShardPath(fmt.Sprintf("obj%d", i), index, location)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Remove(path); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	path, err := store.existingShardPath("obj3", 1, location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, bytes.Repeat([]byte("r"), 200), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := store.Compact([]string{location})
+	if err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+	if report.Entries != 7 || report.Bytes != 700 {
+		t.Fatalf("compaction %+v, expected 7 entries of 100 bytes dropped", report)
+	}
+	store.mu.Lock()
+	cached := len(store.ShardStore)
+	store.mu.Unlock()
+	if cached != 2 {
+		t.Fatalf("%d objects still cached, expected the 2 with shards left", cached)
+	}
+	for dataID, want := range map[string][]byte{"obj3": shard, "obj4": shard} {
+		if got, err := store.RetrieveShard(dataID, 0, location); err != nil || !bytes.Equal(got, want) {
+			t.Fatalf("RetrieveShard of %s after compaction: %v", dataID, err)
+		}
+	}
+	if got, err := store.RetrieveShard("obj3", 1, location); err != nil || len(got) != 200 {
+		t.Fatalf("rewritten shard retrieved as %d bytes, %v", len(got), err)
+	}
+	if _, err := store.RetrieveShard("obj0", 0, location); err == nil {
+		t.Fatal("retrieved a deleted shard after compaction")
+	}
+
+	if again, err := store.Compact([]string{location}); err != nil || again != (CompactReport{}) {
+		t.Fatalf("second compaction %+v, %v", again, err)
+	}
+}
+
+// TestCompactRemovesLeftovers checks compaction removes temporary files
+// crashed processes left at a location once they are old enough, and an
+// empty quarantine directory, and leaves everything else alone.
+func TestCompactRemovesLeftovers(t *testing.T) {
+	location := t.TempDir()
+	old := time.Now().Add(-2 * leftoverAge)
+	files := map[string]bool{ // Whether compaction removes the file
+		".vault-probe-123":      true,
+		LeaseFileName + ".tmp1": true,
+		".vault-probe-456":      false, // Too recent
+		LeaseFileName:           false,
+		"obj_0.shard":           false,
+	}
+	for name := range files {
+		path := filepath.Join(location, name)
+		if err := os.WriteFile(path, []byte("12345"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if name != ".vault-probe-456" {
+			if err := os.Chtimes(path, old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := os.Mkdir(filepath.Join(location, QuarantineDir), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := NewInMemoryShardStore().Compact([]string{location, filepath.Join(location, "missing")})
+	if err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+	if report.Leftovers != 2 || report.DiskBytes != 10 {
+		t.Fatalf("compaction %+v, expected 2 leftovers of 5 bytes removed", report)
+	}
+	for name, leftover := range files {
+		if _, err := os.Stat(filepath.Join(location, name)); os.IsNotExist(err) != leftover {
+			t.Fatalf("%s: removed %t, expected %t", name, os.IsNotExist(err), leftover)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(location, QuarantineDir)); !os.IsNotExist(err) {
+		t.Fatalf("empty quarantine directory kept: %v", err)
+	}
+}
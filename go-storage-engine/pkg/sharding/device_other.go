@@ -0,0 +1,16 @@
+//go:build !(linux || darwin)
+
+package sharding
+
+import "errors"
+
+// Filesystem IDs and free space are only read on Linux and macOS;
+// elsewhere every directory location counts as its own device.
+
+func deviceOf(path string) (string, error) {
+	return "", errors.ErrUnsupported
+}
+
+func diskSpace(path string) (uint64, uint64, error) {
+	return 0, 0, errors.ErrUnsupported
+}
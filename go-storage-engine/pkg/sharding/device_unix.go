@@ -0,0 +1,27 @@
+//go:build linux || darwin
+
+package sharding
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// deviceOf returns the ID of the filesystem a path is on.
+func deviceOf(path string) (string, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return "", err
+	}
+	return fmt.Sprint(uint64(st.Dev)), nil
+}
+
+// diskSpace returns the bytes free to unprivileged users and the size of
+// the filesystem a path is on.
+func diskSpace(path string) (uint64, uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, 0, err
+	}
+	return st.Bavail * uint64(st.Bsize), st.Blocks * uint64(st.Bsize), nil
+}
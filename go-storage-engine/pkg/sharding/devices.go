@@ -0,0 +1,132 @@
+package sharding
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// LocationInfo describes what physically backs a storage location.
+type LocationInfo struct {
+	Location string `json:"location"`
+	Host     string `json:"host"`
+	// Device names the filesystem a directory location is on, or the
+	// bucket of an object store location. Locations sharing a device fail
+	// together.
+	Device string `json:"device"`
+	Free   uint64 `json:"free_bytes,omitempty"`
+	Total  uint64 `json:"total_bytes,omitempty"`
+}
+
+// Labels returns the info as labels for a storage location configuration.
+func (i LocationInfo) Labels() map[string]string {
+	return map[string]string{"host": i.Host, "device": i.Device}
+}
+
+// InspectLocation finds the host, device and free space of a location.
+// With create, a missing directory location is created first; without it,
+// a missing directory is an error.
+func InspectLocation(location string, create bool) (LocationInfo, error) {
+	info := LocationInfo{Location: location}
+	if IsObjectLocation(location) {
+		l, err := ParseObjectLocation(location)
+		if err != nil {
+			return info, err
+		}
+		info.Host, info.Device = "s3", "s3://"+l.Bucket
+		return info, nil
+	}
+
+	if create {
+		if err := os.MkdirAll(location, 0755); err != nil {
+			return info, fmt.Errorf("failed to create %s: %w", location, unwritableError(location, err))
+		}
+	}
+	stat, err := os.Stat(location)
+	if err != nil {
+		return info, fmt.Errorf("storage location %s: %w", location, err)
+	}
+	if !stat.IsDir() {
+		return info, fmt.Errorf("storage location %s is not a directory", location)
+	}
+	info.Host, _ = os.Hostname()
+	info.Device, err = deviceOf(location)
+	if errors.Is(err, errors.ErrUnsupported) {
+		abs, _ := filepath.Abs(location)
+		info.Device = "path:" + abs
+	} else if err != nil {
+		return info, fmt.Errorf("storage location %s: %w", location, err)
+	}
+	info.Free, info.Total, _ = diskSpace(location)
+	return info, nil
+}
+
+// FaultDomains summarizes how the shards of an object can be spread over
+// the hosts and devices behind a set of locations.
+type FaultDomains struct {
+	Hosts   int `json:"hosts"`
+	Devices int `json:"devices"`
+	// Most shards of one object that can land on a single host or device
+	MaxShardsPerHost   int `json:"max_shards_per_host"`
+	MaxShardsPerDevice int `json:"max_shards_per_device"`
+	// Host or device failures every object survives, with its shards
+	// placed on the locations as unevenly as they allow
+	HostFailures   int `json:"host_failures_tolerated"`
+	DeviceFailures int `json:"device_failures_tolerated"`
+}
+
+// SummarizeFaultDomains works out how many host and device failures
+// objects of shards shards, parity of them parity, survive on the given
+// locations. Each location takes at most one shard of an object; when
+// there are more locations than shards, the worst placement is assumed.
+func SummarizeFaultDomains(infos []LocationInfo, shards, parity int) FaultDomains {
+	var hosts, devices []string
+	for _, info := range infos {
+		hosts = append(hosts, info.Host)
+		devices = append(devices, info.Host+"\x00"+info.Device)
+	}
+	summary := FaultDomains{}
+	summary.Hosts, summary.MaxShardsPerHost, summary.HostFailures = domainTolerance(hosts, shards, parity)
+	summary.Devices, summary.MaxShardsPerDevice, summary.DeviceFailures = domainTolerance(devices, shards, parity)
+	return summary
+}
+
+// domainTolerance returns how many distinct domains there are, the most
+// shards one can hold, and how many whole domains can fail without losing
+// more than parity shards, when shards are packed onto the largest
+// domains first.
+func domainTolerance(domains []string, shards, parity int) (int, int, int) {
+	counts := make(map[string]int)
+	for _, domain := range domains {
+		counts[domain]++
+	}
+	sizes := make([]int, 0, len(counts))
+	for _, n := range counts {
+		sizes = append(sizes, n)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(sizes)))
+
+	var placed []int
+	for _, n := range sizes {
+		if shards <= 0 {
+			break
+		}
+		n = min(n, shards)
+		placed = append(placed, n)
+		shards -= n
+	}
+	if len(placed) == 0 {
+		return len(counts), 0, 0
+	}
+	tolerated, lost := 0, 0
+	for _, n := range placed {
+		if lost+n > parity {
+			break
+		}
+		lost += n
+		tolerated++
+	}
+	return len(counts), placed[0], tolerated
+}
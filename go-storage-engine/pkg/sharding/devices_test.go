@@ -0,0 +1,74 @@
+package sharding
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSummarizeFaultDomains(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		devices []int // Locations on each device, all on one host
+		shards  int
+		parity  int
+		want    FaultDomains
+	}{
+		{"one device each", []int{1, 1, 1, 1, 1, 1}, 6, 2, FaultDomains{Hosts: 1, Devices: 6, MaxShardsPerHost: 6, MaxShardsPerDevice: 1, DeviceFailures: 2}},
+		{"shared device", []int{3, 1, 1, 1}, 6, 2, FaultDomains{Hosts: 1, Devices: 4, MaxShardsPerHost: 6, MaxShardsPerDevice: 3}},
+		{"pairs", []int{2, 2, 2, 2}, 6, 4, FaultDomains{Hosts: 1, Devices: 4, MaxShardsPerHost: 6, MaxShardsPerDevice: 2, DeviceFailures: 2}},
+		{"spare locations", []int{4, 4, 4}, 6, 2, FaultDomains{Hosts: 1, Devices: 3, MaxShardsPerHost: 6, MaxShardsPerDevice: 4}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var infos []LocationInfo
+			for d, n := range tc.devices {
+				for i := range n {
+					infos = append(infos, LocationInfo{Location: fmt.Sprintf("/dev%d/loc%d", d, i), Host: "host", Device: fmt.Sprint(d)})
+				}
+			}
+			if got := SummarizeFaultDomains(infos, tc.shards, tc.parity); got != tc.want {
+				t.Fatalf("summary %+v, expected %+v", got, tc.want)
+			}
+		})
+	}
+
+	// The same device ID on two hosts is two devices
+	infos := []LocationInfo{{Host: "a", Device: "1"}, {Host: "b", Device: "1"}, {Host: "b", Device: "2"}}
+	if got := SummarizeFaultDomains(infos, 3, 1); got.Hosts != 2 || got.Devices != 3 || got.HostFailures != 0 || got.DeviceFailures != 1 {
+		t.Fatalf("summary over two hosts %+v", got)
+	}
+}
+
+func TestInspectLocation(t *testing.T) {
+	dir := t.TempDir()
+	missing := filepath.Join(dir, "a", "b")
+	if _, err := InspectLocation(missing, false); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("inspecting a missing location: %v", err)
+	}
+	info, err := InspectLocation(missing, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sibling, err := InspectLocation(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Device == "" || info.Device != sibling.Device || info.Host != sibling.Host {
+		t.Fatalf("locations on one filesystem inspected as %+v and %+v", info, sibling)
+	}
+
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := InspectLocation(file, false); err == nil {
+		t.Fatal("inspected a file as a location")
+	}
+
+	bucket, err := InspectLocation("s3://backups/vault/", false)
+	if err != nil || bucket.Device != "s3://backups" {
+		t.Fatalf("inspecting a bucket: %+v, %v", bucket, err)
+	}
+}
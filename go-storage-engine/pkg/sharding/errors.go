@@ -0,0 +1,211 @@
+package sharding
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"syscall"
+)
+
+// ErrorCategory is what kind of failure a shard operation ran into, which
+// decides whether it is worth retrying, whether it counts against the
+// location's health and what the user is told to do about it.
+type ErrorCategory string
+
+const (
+	// CategoryAuth is a backend that doesn't accept vault's credentials.
+	CategoryAuth ErrorCategory = "auth"
+	// CategoryNotFound is a shard, bucket or directory that isn't there.
+	CategoryNotFound ErrorCategory = "not-found"
+	// CategoryPermission is a location vault may not write to or read from,
+	// including read-only filesystems.
+	CategoryPermission ErrorCategory = "permission"
+	// CategoryFull is a location out of space or over its quota.
+	CategoryFull ErrorCategory = "full"
+	// CategoryTimeout is a backend that didn't answer in time, reset the
+	// connection or asked vault to slow down.
+	CategoryTimeout ErrorCategory = "network-timeout"
+	// CategoryIntegrity is a shard that didn't match its checksum, or didn't
+	// read back as it was written.
+	CategoryIntegrity ErrorCategory = "integrity"
+	// CategoryUnknown is anything else.
+	CategoryUnknown ErrorCategory = "unknown"
+)
+
+// errorCodes maps the error codes object stores return to categories. SDK
+// errors carry them through an ErrorCode method.
+var errorCodes = map[string]ErrorCategory{
+	"InvalidAccessKeyId":    CategoryAuth,
+	"SignatureDoesNotMatch": CategoryAuth,
+	"ExpiredToken":          CategoryAuth,
+	"InvalidToken":          CategoryAuth,
+	"AccessDenied":          CategoryPermission,
+	"AllAccessDisabled":     CategoryPermission,
+	"AccountProblem":        CategoryPermission,
+	"NoSuchKey":             CategoryNotFound,
+	"NoSuchBucket":          CategoryNotFound,
+	"NotFound":              CategoryNotFound,
+	"QuotaExceeded":         CategoryFull,
+	"EntityTooLarge":        CategoryFull,
+	"RequestTimeout":        CategoryTimeout,
+	"SlowDown":              CategoryTimeout,
+	"ServiceUnavailable":    CategoryTimeout,
+	"InternalError":         CategoryTimeout,
+	"BadDigest":             CategoryIntegrity,
+}
+
+// Classify returns the category of err. An error already classified by a
+// ShardError keeps its category.
+func Classify(err error) ErrorCategory {
+	if err == nil {
+		return ""
+	}
+	var shardErr *ShardError
+	if errors.As(err, &shardErr) {
+		return shardErr.Category
+	}
+	var coded interface{ ErrorCode() string }
+	if errors.As(err, &coded) {
+		if category, ok := errorCodes[coded.ErrorCode()]; ok {
+			return category
+		}
+	}
+	var netErr net.Error
+	switch {
+	case errors.Is(err, ErrTransferIntegrity), errors.Is(err, ErrWriteUnconfirmed):
+		return CategoryIntegrity
+	case errors.Is(err, syscall.ENOSPC), errors.Is(err, syscall.EDQUOT):
+		return CategoryFull
+	case errors.Is(err, syscall.EROFS), errors.Is(err, fs.ErrPermission), errors.Is(err, ErrReadOnly):
+		return CategoryPermission
+	case errors.Is(err, ErrShardNotFound), errors.Is(err, fs.ErrNotExist):
+		return CategoryNotFound
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded),
+		errors.Is(err, syscall.ETIMEDOUT), errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.ECONNREFUSED),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return CategoryTimeout
+	}
+	return CategoryUnknown
+}
+
+// Retryable reports whether trying again can fix a failure of the
+// category: the network recovering, or a shard corrupted on the way
+// arriving intact. Missing shards, refused credentials and full or
+// read-only locations stay that way.
+func (c ErrorCategory) Retryable() bool {
+	switch c {
+	case CategoryTimeout, CategoryIntegrity, CategoryUnknown:
+		return true
+	}
+	return false
+}
+
+// Retryable reports whether trying err again can help: it isn't a
+// ShardError, or it is one of a retryable category. Of the errors joined
+// from several locations, any retryable one is enough.
+func Retryable(err error) bool {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		for _, err := range joined.Unwrap() {
+			if Retryable(err) {
+				return true
+			}
+		}
+		return false
+	}
+	var shardErr *ShardError
+	if errors.As(err, &shardErr) {
+		return shardErr.Category.Retryable()
+	}
+	return true
+}
+
+// LocationFault reports whether a failure of the category says something
+// about the location's health. A missing shard doesn't: candidate
+// locations are tried in turn and most of them don't hold it.
+func (c ErrorCategory) LocationFault() bool {
+	return c != "" && c != CategoryNotFound
+}
+
+// Hint returns a one-line suggestion for a failure of the category at
+// location, or "" if there is nothing better to suggest than the error.
+func (c ErrorCategory) Hint(location string) string {
+	switch c {
+	case CategoryAuth:
+		return fmt.Sprintf("location %s rejected vault's credentials — check the access key and that it hasn't expired", location)
+	case CategoryNotFound:
+		return fmt.Sprintf("location %s doesn't hold the shard — run verify --heal to repair the object", location)
+	case CategoryPermission:
+		return fmt.Sprintf("location %s refused access — check its permissions, or that it isn't mounted read-only", location)
+	case CategoryFull:
+		return fmt.Sprintf("location %s appears full — free space or mark it readonly", location)
+	case CategoryTimeout:
+		return fmt.Sprintf("location %s isn't answering in time — check the network, or raise the shard retries", location)
+	case CategoryIntegrity:
+		return fmt.Sprintf("location %s returned a damaged shard — check its disk, or the network path to it", location)
+	}
+	return ""
+}
+
+// ShardError is a failed operation on one shard, classified.
+type ShardError struct {
+	Op       string // "store" or "retrieve"
+	DataID   string
+	Index    int
+	Location string
+	Category ErrorCategory
+	Err      error
+}
+
+// NewShardError classifies err and wraps it, leaving errors that are
+// already ShardErrors as they are.
+func NewShardError(op, dataID string, index int, location string, err error) error {
+	var shardErr *ShardError
+	if err == nil || errors.As(err, &shardErr) {
+		return err
+	}
+	return &ShardError{Op: op, DataID: dataID, Index: index, Location: location, Category: Classify(err), Err: err}
+}
+
+// Error returns the wrapped error's message, which the stores already
+// give the shard and location in.
+func (e *ShardError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ShardError) Unwrap() error {
+	return e.Err
+}
+
+// Hint returns the hint for the error's category at its location.
+func (e *ShardError) Hint() string {
+	return e.Category.Hint(e.Location)
+}
+
+// Hints returns the hints of the ShardErrors in err, including those
+// joined from several locations, without repeats.
+func Hints(err error) []string {
+	var hints []string
+	seen := make(map[string]bool)
+	var walk func(error)
+	walk = func(err error) {
+		switch e := err.(type) {
+		case nil:
+		case *ShardError:
+			if hint := e.Hint(); hint != "" && !seen[hint] {
+				seen[hint] = true
+				hints = append(hints, hint)
+			}
+		case interface{ Unwrap() []error }:
+			for _, err := range e.Unwrap() {
+				walk(err)
+			}
+		case interface{ Unwrap() error }:
+			walk(e.Unwrap())
+		}
+	}
+	walk(err)
+	return hints
+}
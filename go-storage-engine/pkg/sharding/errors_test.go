@@ -0,0 +1,39 @@
+package sharding
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestClassify(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want ErrorCategory
+	}{
+		{fmt.Errorf("%w: shard 0", ErrShardNotFound), CategoryNotFound},
+		{os.ErrNotExist, CategoryNotFound},
+		{syscall.ENOSPC, CategoryFull},
+		{syscall.EROFS, CategoryPermission},
+		{syscall.ETIMEDOUT, CategoryTimeout},
+		{fmt.Errorf("%w: bad sum", ErrTransferIntegrity), CategoryIntegrity},
+		{errors.New("something else"), CategoryUnknown},
+	} {
+		if got := Classify(tc.err); got != tc.want {
+			t.Errorf("Classify(%v) = %s, expected %s", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestNotFoundHintNamesHeal(t *testing.T) {
+	err := NewShardError("retrieve", "id", 0, "/loc", fmt.Errorf("%w: shard 0", ErrShardNotFound))
+	hints := Hints(errors.Join(err))
+	if len(hints) != 1 || !strings.Contains(hints[0], "verify --heal") {
+		t.Fatalf("hints %q don't suggest verify --heal", hints)
+	}
+}
+
+var errTestFault = errors.New("disk on fire")
@@ -0,0 +1,172 @@
+package sharding
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInjectedFault is returned by a FaultyShardStore for a shard its plan
+// drops.
+var ErrInjectedFault = errors.New("shard dropped by fault plan")
+
+// Faults a FaultPlan can inject into a shard's retrieval.
+const (
+	FaultDrop    = "drop"    // The shard can't be retrieved
+	FaultCorrupt = "corrupt" // One byte of the shard is flipped
+	FaultDelay   = "delay"   // The shard is retrieved late, but intact
+)
+
+// Fault is what happens when a shard is retrieved.
+type Fault struct {
+	Kind   string
+	Offset int           // FaultCorrupt: byte flipped, modulo the shard's length
+	Delay  time.Duration // FaultDelay
+}
+
+// FaultPlan maps shard indexes to the fault injected into them. Shards not
+// in the plan are retrieved normally.
+type FaultPlan map[int]Fault
+
+// RandomFaultPlan picks n distinct shards of total and gives each a random
+// fault. Only the random source decides the plan, so a seed reproduces it.
+func RandomFaultPlan(rng *rand.Rand, total, n int, maxDelay time.Duration) FaultPlan {
+	plan := make(FaultPlan)
+	for _, index := range rng.Perm(total)[:min(n, total)] {
+		fault := Fault{Offset: rng.Int()}
+		switch rng.Intn(3) {
+		case 0:
+			fault.Kind = FaultDrop
+		case 1:
+			fault.Kind = FaultCorrupt
+		default:
+			fault.Kind = FaultDelay
+			if maxDelay > 0 {
+				fault.Delay = time.Duration(rng.Int63n(int64(maxDelay)))
+			}
+		}
+		plan[index] = fault
+	}
+	return plan
+}
+
+// Lost counts the shards the plan makes unusable. Delayed shards still
+// arrive, so they don't count.
+func (p FaultPlan) Lost() int {
+	lost := 0
+	for _, fault := range p {
+		if fault.Kind != FaultDelay {
+			lost++
+		}
+	}
+	return lost
+}
+
+// String describes the plan, like "2:drop 5:corrupt 9:delay(3ms)".
+func (p FaultPlan) String() string {
+	indexes := make([]int, 0, len(p))
+	for index := range p {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	parts := make([]string, len(indexes))
+	for i, index := range indexes {
+		fault := p[index]
+		parts[i] = fmt.Sprintf("%d:%s", index, fault.Kind)
+		if fault.Kind == FaultDelay {
+			parts[i] += fmt.Sprintf("(%s)", fault.Delay)
+		}
+	}
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, " ")
+}
+
+// ParseFaultPlan reads a plan written the way String writes them, like
+// "2:drop 5:corrupt 9:delay(3ms)", with faults separated by spaces or
+// commas. Corrupt faults flip the first byte of the shard.
+func ParseFaultPlan(s string) (FaultPlan, error) {
+	plan := make(FaultPlan)
+	if strings.TrimSpace(s) == "none" {
+		return plan, nil
+	}
+	for _, part := range strings.Fields(strings.ReplaceAll(s, ",", " ")) {
+		index, kind, ok := strings.Cut(part, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid fault %q: want <index>:<fault>", part)
+		}
+		i, err := strconv.Atoi(index)
+		if err != nil || i < 0 {
+			return nil, fmt.Errorf("invalid shard index in fault %q", part)
+		}
+		if _, ok := plan[i]; ok {
+			return nil, fmt.Errorf("shard %d given two faults", i)
+		}
+		var fault Fault
+		switch {
+		case kind == FaultDrop || kind == FaultCorrupt:
+			fault.Kind = kind
+		case strings.HasPrefix(kind, FaultDelay+"(") && strings.HasSuffix(kind, ")"):
+			fault.Kind = FaultDelay
+			if fault.Delay, err = time.ParseDuration(kind[len(FaultDelay)+1 : len(kind)-1]); err != nil {
+				return nil, fmt.Errorf("invalid delay in fault %q: %w", part, err)
+			}
+		default:
+			return nil, fmt.Errorf("unknown fault %q (want %s, %s or %s(<duration>))", kind, FaultDrop, FaultCorrupt, FaultDelay)
+		}
+		plan[i] = fault
+	}
+	return plan, nil
+}
+
+// FaultyShardStore wraps a store and injects the faults of its plan into
+// shard retrievals, whatever the dataID or location. Writes go straight
+// through. It has no optional capabilities, and deliberately doesn't
+// unwrap, so every read goes through RetrieveShard and meets the plan.
+type FaultyShardStore struct {
+	Store ShardStore
+	Plan  FaultPlan
+}
+
+// InjectFaults returns the middleware of the faults layer, injecting plan.
+func InjectFaults(plan FaultPlan) Middleware {
+	return func(store ShardStore) ShardStore {
+		return &FaultyShardStore{Store: store, Plan: plan}
+	}
+}
+
+func (f *FaultyShardStore) StoreShard(dataID string, index int, shard []byte, location string) error {
+	return f.Store.StoreShard(dataID, index, shard, location)
+}
+
+func (f *FaultyShardStore) RetrieveShard(dataID string, index int, location string) ([]byte, error) {
+	fault, ok := f.Plan[index]
+	if !ok {
+		return f.Store.RetrieveShard(dataID, index, location)
+	}
+	switch fault.Kind {
+	case FaultDrop:
+		return nil, fmt.Errorf("%w: shard %d of %s at %s", ErrInjectedFault, index, dataID, location)
+	case FaultDelay:
+		time.Sleep(fault.Delay)
+		return f.Store.RetrieveShard(dataID, index, location)
+	}
+	shard, err := f.Store.RetrieveShard(dataID, index, location)
+	if err != nil || len(shard) == 0 {
+		return shard, err
+	}
+	// The wrapped store may hand out its own copy
+	corrupt := make([]byte, len(shard))
+	copy(corrupt, shard)
+	corrupt[fault.Offset%len(corrupt)] ^= 0xff
+	return corrupt, nil
+}
+
+func (f *FaultyShardStore) Close() error {
+	return f.Store.Close()
+}
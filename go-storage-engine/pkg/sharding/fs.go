@@ -0,0 +1,96 @@
+package sharding
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+)
+
+// ShardFS is the filesystem an InMemoryShardStore keeps its shard files
+// in. Reads go through io/fs; io/fs has no writes, so WritableFS adds the
+// few the store makes. Names are the paths the store joins onto its
+// locations, absolute ones included, rather than fs.ValidPath names: OSFS
+// hands them to the os package as they are.
+type ShardFS interface {
+	fs.ReadFileFS
+	fs.ReadDirFS
+	fs.StatFS
+	WritableFS
+}
+
+// WritableFS is what a ShardFS adds to io/fs to change files.
+type WritableFS interface {
+	MkdirAll(name string, perm fs.FileMode) error
+	WriteFile(name string, data []byte, perm fs.FileMode) error
+	// CreateFile writes a new file, failing with fs.ErrExist if there
+	// already is one.
+	CreateFile(name string, data []byte, perm fs.FileMode) error
+	Remove(name string) error
+	Rename(oldname, newname string) error
+	Chmod(name string, mode fs.FileMode) error
+}
+
+// OSFS is the ShardFS of the real filesystem, used by stores without one
+// of their own.
+type OSFS struct{}
+
+func (OSFS) Open(name string) (fs.File, error)            { return os.Open(name) }
+func (OSFS) ReadFile(name string) ([]byte, error)         { return os.ReadFile(name) }
+func (OSFS) ReadDir(name string) ([]fs.DirEntry, error)   { return os.ReadDir(name) }
+func (OSFS) Stat(name string) (fs.FileInfo, error)        { return os.Stat(name) }
+func (OSFS) MkdirAll(name string, perm fs.FileMode) error { return os.MkdirAll(name, perm) }
+func (OSFS) Remove(name string) error                     { return os.Remove(name) }
+func (OSFS) Rename(oldname, newname string) error         { return os.Rename(oldname, newname) }
+func (OSFS) Chmod(name string, mode fs.FileMode) error    { return os.Chmod(name, mode) }
+func (OSFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	return os.WriteFile(name, data, perm)
+}
+
+func (OSFS) CreateFile(name string, data []byte, perm fs.FileMode) error {
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// fsys returns the filesystem the store's shard files are in.
+func (ims *InMemoryShardStore) fsys() ShardFS {
+	if ims.FS == nil {
+		return OSFS{}
+	}
+	return ims.FS
+}
+
+// readFileRange reads length bytes of a file from offset, without reading
+// the rest where the file can be read at an offset.
+func readFileRange(fsys fs.FS, name string, offset, length int64) ([]byte, error) {
+	file, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	data := make([]byte, length)
+	if at, ok := file.(io.ReaderAt); ok {
+		// A read that fills data may still report io.EOF
+		if n, err := at.ReadAt(data, offset); n < len(data) {
+			return nil, err
+		}
+		return data, nil
+	}
+	if _, err := io.CopyN(io.Discard, file, offset); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(file, data); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			err = io.EOF
+		}
+		return nil, err
+	}
+	return data, nil
+}
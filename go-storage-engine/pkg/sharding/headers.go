@@ -0,0 +1,136 @@
+package sharding
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+
+	"github.com/techninja8/getvault.io/pkg/shardheader"
+)
+
+// ShardDescriber is implemented by stores that write shardheader headers,
+// to be told the code and object length of a shard set before its shards
+// are stored, which the shards alone don't tell.
+type ShardDescriber interface {
+	DescribeShards(dataID string, data, parity int, objectLength int64)
+}
+
+// DescribeShards tells a store that writes shard headers the code and
+// object length of a shard set about to be stored. It is only a hint, so
+// it goes to the store inside any wrappers, and stores that don't write
+// headers ignore it.
+func DescribeShards(store ShardStore, dataID string, data, parity int, objectLength int64) {
+	for {
+		if describer, ok := store.(ShardDescriber); ok {
+			describer.DescribeShards(dataID, data, parity, objectLength)
+			return
+		}
+		wrapper, ok := store.(unwrapper)
+		if !ok {
+			return
+		}
+		store = wrapper.Unwrap()
+	}
+}
+
+// maxDescribed bounds the shard sets an InMemoryShardStore holds
+// descriptions of. Descriptions are dropped once every shard of their set
+// is stored, so only stores that fail leave theirs behind; past the bound
+// they are all forgotten, and shards stored meanwhile get headers with a
+// code and object length of 0.
+const maxDescribed = 1024
+
+// shardSetDescription is what DescribeShards told a store about a set.
+type shardSetDescription struct {
+	data, parity int
+	objectLength int64
+	stored       map[int]bool
+}
+
+// DescribeShards records the code and object length of a shard set for
+// the headers of its shards, when the store writes headers.
+func (ims *InMemoryShardStore) DescribeShards(dataID string, data, parity int, objectLength int64) {
+	if !ims.Headers {
+		return
+	}
+	ims.mu.Lock()
+	defer ims.mu.Unlock()
+	if ims.described == nil || len(ims.described) >= maxDescribed {
+		ims.described = make(map[string]*shardSetDescription)
+	}
+	ims.described[dataID] = &shardSetDescription{data: data, parity: parity, objectLength: objectLength, stored: make(map[int]bool)}
+}
+
+// withHeader returns a shard as it is written to disk: as it is, or after
+// a header if the store writes headers. Callers hold ims.mu.
+func (ims *InMemoryShardStore) withHeader(dataID string, index int, shard []byte) ([]byte, error) {
+	if !ims.Headers {
+		return shard, nil
+	}
+	h := shardheader.Header{DataID: dataID, Index: index, ShardLength: int64(len(shard))}
+	if d, ok := ims.described[dataID]; ok {
+		h.DataShards, h.ParityShards, h.ObjectLength = d.data, d.parity, d.objectLength
+		if d.stored[index] = true; len(d.stored) >= d.data+d.parity {
+			delete(ims.described, dataID)
+		}
+	}
+	header, err := shardheader.Encode(h)
+	if err != nil {
+		return nil, err
+	}
+	return append(header, shard...), nil
+}
+
+// stripHeader returns the shard in a shard file, checking its header if it
+// has one. Files without a header, written before headers were, are the
+// shard as they are. A header that is corrupt or describes another shard
+// fails the read, as the shard can't be trusted.
+func stripHeader(dataID string, index int, data []byte) ([]byte, error) {
+	h, size, err := shardheader.Decode(data)
+	if errors.Is(err, shardheader.ErrNoHeader) {
+		return data, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if h.DataID != dataID || h.Index != index {
+		return nil, fmt.Errorf("%w: header is of shard %d of %s", shardheader.ErrCorrupt, h.Index, h.DataID)
+	}
+	shard := data[size:]
+	if int64(len(shard)) != h.ShardLength {
+		return nil, fmt.Errorf("shard of %d bytes where its header records %d", len(shard), h.ShardLength)
+	}
+	return shard, nil
+}
+
+// headerSize returns the size of the header a shard file starts with, 0
+// if it has none, without reading the shard.
+func headerSize(fsys fs.FS, name string) (int64, error) {
+	file, err := fsys.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	prefix := make([]byte, shardheader.PrefixSize)
+	n, err := io.ReadFull(file, prefix)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return 0, err
+	}
+	size, err := shardheader.HeaderSize(prefix[:n])
+	if errors.Is(err, shardheader.ErrNoHeader) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	header := make([]byte, size)
+	copy(header, prefix)
+	if _, err := io.ReadFull(file, header[n:]); err != nil {
+		return 0, fmt.Errorf("%w: %v", shardheader.ErrCorrupt, err)
+	}
+	if _, _, err := shardheader.Decode(header); err != nil {
+		return 0, err
+	}
+	return int64(size), nil
+}
@@ -0,0 +1,92 @@
+package sharding
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/techninja8/getvault.io/pkg/shardheader"
+)
+
+func TestShardHeaders(t *testing.T) {
+	location := t.TempDir()
+	store := NewInMemoryShardStore()
+	store.Headers = true
+	shard := bytes.Repeat([]byte("shard"), 100)
+	DescribeShards(store, "obj", 2, 1, 1000)
+	if err := store.StoreShard("obj", 1, shard, location); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.ReadFile(filepath.Join(location, PlainShardName("obj", 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, size, err := shardheader.Decode(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := shardheader.Header{DataID: "obj", Index: 1, DataShards: 2, ParityShards: 1, ShardLength: int64(len(shard)), ObjectLength: 1000}
+	if h != want || !bytes.Equal(file[size:], shard) {
+		t.Fatalf("header %+v, expected %+v", h, want)
+	}
+
+	// Reads from disk get the shard without its header
+	fresh := NewInMemoryShardStore()
+	if got, err := fresh.RetrieveShard("obj", 1, location); err != nil || !bytes.Equal(got, shard) {
+		t.Fatalf("RetrieveShard = %d bytes, %v", len(got), err)
+	}
+	if got, err := fresh.RetrieveShardRange("obj", 1, location, 10, 20); err != nil || !bytes.Equal(got, shard[10:30]) {
+		t.Fatalf("RetrieveShardRange = %q, %v", got, err)
+	}
+	if sum, err := fresh.ShardChecksum("obj", 1, location); err != nil || sum != TransferChecksum(shard) {
+		t.Fatalf("ShardChecksum = %s, %v", sum, err)
+	}
+
+	// Shards without a header, from before headers, still read
+	if err := NewInMemoryShardStore().StoreShard("old", 0, shard, location); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := NewInMemoryShardStore().RetrieveShard("old", 0, location); err != nil || !bytes.Equal(got, shard) {
+		t.Fatalf("RetrieveShard of a shard without a header = %d bytes, %v", len(got), err)
+	}
+}
+
+func TestCorruptShardHeaderFailsReads(t *testing.T) {
+	location := t.TempDir()
+	store := NewInMemoryShardStore()
+	store.Headers = true
+	if err := store.StoreShard("obj", 0, []byte("shard"), location); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(location, PlainShardName("obj", 0))
+	file, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file[shardheader.PrefixSize+1] ^= 1 // In the dataID
+	if err := os.WriteFile(path, file, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fresh := NewInMemoryShardStore()
+	if _, err := fresh.RetrieveShard("obj", 0, location); !errors.Is(err, shardheader.ErrCorrupt) {
+		t.Fatalf("RetrieveShard of a corrupt header: %v", err)
+	}
+	if _, err := fresh.RetrieveShardRange("obj", 0, location, 0, 1); !errors.Is(err, shardheader.ErrCorrupt) {
+		t.Fatalf("RetrieveShardRange of a corrupt header: %v", err)
+	}
+
+	// A good header of another shard, as a misplaced file has
+	if err := store.StoreShard("obj", 1, []byte("shard"), location); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(location, PlainShardName("obj", 1)), path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fresh.RetrieveShard("obj", 0, location); !errors.Is(err, shardheader.ErrCorrupt) {
+		t.Fatalf("RetrieveShard of another shard's file: %v", err)
+	}
+}
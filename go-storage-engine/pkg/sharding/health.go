@@ -0,0 +1,379 @@
+package sharding
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// healthWeight is the weight of the newest observation in a location's
+	// running success rate and latency, so recent behaviour dominates.
+	healthWeight = 0.1
+	// healthyLatency is the average latency above which a location's
+	// score starts to drop.
+	healthyLatency = 250 * time.Millisecond
+	// HealthyScore is the score below which a location counts as unhealthy.
+	HealthyScore = 0.8
+	// ReplaceAfterCorruptions is the number of corrupt shards found at a
+	// location after which its disk should be replaced.
+	ReplaceAfterCorruptions = 3
+)
+
+// LocationHealth is the running health record of one location.
+type LocationHealth struct {
+	Successes   int64     `json:"successes"`
+	Failures    int64     `json:"failures"`
+	SuccessRate float64   `json:"success_rate"`
+	LatencyMs   float64   `json:"latency_ms"`
+	LastFailure time.Time `json:"last_failure,omitzero"`
+	Corruptions int64     `json:"corruptions,omitempty"` // Corrupt shards quarantined
+}
+
+// NeedsReplacing reports whether enough corrupt shards have been found at
+// the location that its disk should be replaced.
+func (h LocationHealth) NeedsReplacing() bool {
+	return h.Corruptions >= ReplaceAfterCorruptions
+}
+
+// Score rates a location between 0 and 1: its recent success rate, scaled
+// down when its average latency is above healthyLatency. Locations
+// without history score 1.
+func (h LocationHealth) Score() float64 {
+	if h.Successes+h.Failures == 0 {
+		return 1
+	}
+	score := h.SuccessRate
+	if limit := float64(healthyLatency.Milliseconds()); h.LatencyMs > limit {
+		score *= limit / h.LatencyMs
+	}
+	return score
+}
+
+// HealthTracker records the health of shard locations across runs. It is
+// saved as JSON; concurrent processes don't merge, the last to save wins.
+type HealthTracker struct {
+	mu        sync.Mutex
+	path      string
+	locations map[string]*LocationHealth
+}
+
+// NewHealthTracker returns an empty tracker saved to path.
+func NewHealthTracker(path string) *HealthTracker {
+	return &HealthTracker{path: path, locations: make(map[string]*LocationHealth)}
+}
+
+// LoadHealth reads the tracker saved at path, or returns an empty one if
+// there is none yet.
+func LoadHealth(path string) (*HealthTracker, error) {
+	t := NewHealthTracker(path)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read health file: %w", err)
+	}
+	if err := json.Unmarshal(data, &t.locations); err != nil {
+		return nil, fmt.Errorf("invalid health file %s: %w", path, err)
+	}
+	return t, nil
+}
+
+// Record adds the outcome of one operation against location. Errors that
+// aren't the location's fault, such as a missing shard, count as neither
+// success nor failure.
+func (t *HealthTracker) Record(location string, latency time.Duration, err error) {
+	if err != nil && !Classify(err).LocationFault() {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	h, ok := t.locations[location]
+	if !ok {
+		h = &LocationHealth{SuccessRate: 1, LatencyMs: float64(latency.Milliseconds())}
+		t.locations[location] = h
+	}
+	outcome := 1.0
+	if err != nil {
+		outcome = 0
+		h.Failures++
+		h.LastFailure = time.Now().UTC()
+	} else {
+		h.Successes++
+	}
+	h.SuccessRate += healthWeight * (outcome - h.SuccessRate)
+	h.LatencyMs += healthWeight * (float64(latency.Milliseconds()) - h.LatencyMs)
+}
+
+// RecordCorruption counts a corrupt shard found at location. It counts as
+// a failure too, so a disk returning bad data loses score like one
+// returning errors.
+func (t *HealthTracker) RecordCorruption(location string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	h, ok := t.locations[location]
+	if !ok {
+		h = &LocationHealth{SuccessRate: 1}
+		t.locations[location] = h
+	}
+	h.Corruptions++
+	h.Failures++
+	h.LastFailure = time.Now().UTC()
+	h.SuccessRate += healthWeight * (0 - h.SuccessRate)
+}
+
+// Score returns the score of location.
+func (t *HealthTracker) Score(location string) float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if h, ok := t.locations[location]; ok {
+		return h.Score()
+	}
+	return 1
+}
+
+// Snapshot returns a copy of every location's record.
+func (t *HealthTracker) Snapshot() map[string]LocationHealth {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	snapshot := make(map[string]LocationHealth, len(t.locations))
+	for location, h := range t.locations {
+		snapshot[location] = *h
+	}
+	return snapshot
+}
+
+// Place picks the n healthiest locations of pool for a new object's
+// shards. Ties, including locations without history, go to those listed
+// first, and the picked locations keep their order in pool.
+func (t *HealthTracker) Place(pool []string, n int) ([]string, error) {
+	return t.PlaceInZones(pool, nil, n)
+}
+
+// Save writes the tracker through a temporary file and a rename.
+func (t *HealthTracker) Save() error {
+	t.mu.Lock()
+	data, err := json.MarshalIndent(t.locations, "", "  ")
+	t.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(t.path), 0755); err != nil {
+		return fmt.Errorf("failed to write health file: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(t.path), ".health-*")
+	if err != nil {
+		return fmt.Errorf("failed to write health file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write health file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write health file: %w", err)
+	}
+	return os.Rename(tmp.Name(), t.path)
+}
+
+// HealthTrackingStore records the outcome and latency of every shard
+// operation on the wrapped store, and saves the tracker when closed.
+type HealthTrackingStore struct {
+	ShardStore
+	Health *HealthTracker
+}
+
+// TrackHealth returns the middleware of the health layer, recording into
+// health.
+func TrackHealth(health *HealthTracker) Middleware {
+	return func(store ShardStore) ShardStore {
+		return &HealthTrackingStore{ShardStore: store, Health: health}
+	}
+}
+
+// record passes the outcome of an operation started at start on to the
+// tracker. Candidate probing and dedup checks look for shards that mostly
+// aren't there, so a shard not being found is left out altogether rather
+// than counted.
+func (s *HealthTrackingStore) record(location string, start time.Time, err error) {
+	if Classify(err) == CategoryNotFound {
+		return
+	}
+	s.Health.Record(location, time.Since(start), err)
+}
+
+func (s *HealthTrackingStore) StoreShard(dataID string, index int, shard []byte, location string) error {
+	start := time.Now()
+	err := s.ShardStore.StoreShard(dataID, index, shard, location)
+	s.record(location, start, err)
+	return err
+}
+
+func (s *HealthTrackingStore) RetrieveShard(dataID string, index int, location string) ([]byte, error) {
+	start := time.Now()
+	shard, err := s.ShardStore.RetrieveShard(dataID, index, location)
+	s.record(location, start, err)
+	return shard, err
+}
+
+// ProveRetrievability passes challenges on to the wrapped store.
+func (s *HealthTrackingStore) ProveRetrievability(dataID string, index int, location string, nonce []byte) ([]byte, error) {
+	prover, ok := s.ShardStore.(RetrievabilityProver)
+	if !ok {
+		return nil, fmt.Errorf("%T can't prove retrievability: %w", s.ShardStore, errors.ErrUnsupported)
+	}
+	start := time.Now()
+	proof, err := prover.ProveRetrievability(dataID, index, location, nonce)
+	s.record(location, start, err)
+	return proof, err
+}
+
+// DeleteShard passes deletions on to the wrapped store.
+func (s *HealthTrackingStore) DeleteShard(dataID string, index int, location string) error {
+	deleter, ok := s.ShardStore.(ShardDeleter)
+	if !ok {
+		return fmt.Errorf("%T can't delete shards: %w", s.ShardStore, errors.ErrUnsupported)
+	}
+	start := time.Now()
+	err := deleter.DeleteShard(dataID, index, location)
+	s.record(location, start, err)
+	return err
+}
+
+// HasShard passes existence checks on to the wrapped store.
+func (s *HealthTrackingStore) HasShard(dataID string, index int, location string) (bool, error) {
+	exister, ok := s.ShardStore.(ShardExister)
+	if !ok {
+		return false, fmt.Errorf("%T can't check for shards: %w", s.ShardStore, errors.ErrUnsupported)
+	}
+	start := time.Now()
+	exists, err := exister.HasShard(dataID, index, location)
+	s.record(location, start, err)
+	return exists, err
+}
+
+// CreateShard passes atomic creates on to the wrapped store. A shard that
+// already exists isn't held against the location's health.
+func (s *HealthTrackingStore) CreateShard(dataID string, index int, shard []byte, location string) error {
+	creator, ok := s.ShardStore.(ShardCreator)
+	if !ok {
+		return fmt.Errorf("%T can't create shards atomically: %w", s.ShardStore, errors.ErrUnsupported)
+	}
+	start := time.Now()
+	err := creator.CreateShard(dataID, index, shard, location)
+	if errors.Is(err, ErrShardExists) {
+		s.record(location, start, nil)
+	} else {
+		s.record(location, start, err)
+	}
+	return err
+}
+
+// ShardChecksum passes checksum requests on to the wrapped store.
+func (s *HealthTrackingStore) ShardChecksum(dataID string, index int, location string) (string, error) {
+	checksummer, ok := s.ShardStore.(ShardChecksummer)
+	if !ok {
+		return "", fmt.Errorf("%T can't checksum shards: %w", s.ShardStore, errors.ErrUnsupported)
+	}
+	start := time.Now()
+	checksum, err := checksummer.ShardChecksum(dataID, index, location)
+	s.record(location, start, err)
+	return checksum, err
+}
+
+func (s *HealthTrackingStore) RetrieveShardRange(dataID string, index int, location string, offset, length int64) ([]byte, error) {
+	reader, ok := s.ShardStore.(ShardRangeReader)
+	if !ok {
+		return nil, fmt.Errorf("%T can't read shard ranges: %w", s.ShardStore, errors.ErrUnsupported)
+	}
+	start := time.Now()
+	data, err := reader.RetrieveShardRange(dataID, index, location, offset, length)
+	s.record(location, start, err)
+	return data, err
+}
+
+// ListShards passes listings on to the wrapped store.
+func (s *HealthTrackingStore) ListShards(location string) ([]ShardRef, error) {
+	lister, ok := s.ShardStore.(ShardLister)
+	if !ok {
+		return nil, fmt.Errorf("%T can't list shards: %w", s.ShardStore, errors.ErrUnsupported)
+	}
+	start := time.Now()
+	refs, err := lister.ListShards(location)
+	s.record(location, start, err)
+	return refs, err
+}
+
+// LockShard passes locks on to the wrapped store.
+func (s *HealthTrackingStore) LockShard(dataID string, index int, location string) error {
+	locker, ok := s.ShardStore.(ShardLocker)
+	if !ok {
+		return fmt.Errorf("%T can't lock shards: %w", s.ShardStore, errors.ErrUnsupported)
+	}
+	return locker.LockShard(dataID, index, location)
+}
+
+// UnlockShard passes unlocks on to the wrapped store.
+func (s *HealthTrackingStore) UnlockShard(dataID string, index int, location string) error {
+	locker, ok := s.ShardStore.(ShardLocker)
+	if !ok {
+		return fmt.Errorf("%T can't lock shards: %w", s.ShardStore, errors.ErrUnsupported)
+	}
+	return locker.UnlockShard(dataID, index, location)
+}
+
+// QuarantineShard passes quarantines on to the wrapped store and counts
+// the corrupt shard against the location.
+func (s *HealthTrackingStore) QuarantineShard(dataID string, index int, location string) (string, error) {
+	quarantiner, ok := s.ShardStore.(ShardQuarantiner)
+	if !ok {
+		return "", fmt.Errorf("%T can't quarantine shards: %w", s.ShardStore, errors.ErrUnsupported)
+	}
+	name, err := quarantiner.QuarantineShard(dataID, index, location)
+	if err == nil {
+		s.Health.RecordCorruption(location)
+	}
+	return name, err
+}
+
+// ListQuarantine passes quarantine listings on to the wrapped store.
+func (s *HealthTrackingStore) ListQuarantine(location string) ([]QuarantinedShard, error) {
+	quarantiner, ok := s.ShardStore.(ShardQuarantiner)
+	if !ok {
+		return nil, fmt.Errorf("%T can't quarantine shards: %w", s.ShardStore, errors.ErrUnsupported)
+	}
+	return quarantiner.ListQuarantine(location)
+}
+
+// PurgeQuarantine passes quarantine purges on to the wrapped store.
+func (s *HealthTrackingStore) PurgeQuarantine(location string, before time.Time) (int, error) {
+	quarantiner, ok := s.ShardStore.(ShardQuarantiner)
+	if !ok {
+		return 0, fmt.Errorf("%T can't quarantine shards: %w", s.ShardStore, errors.ErrUnsupported)
+	}
+	return quarantiner.PurgeQuarantine(location, before)
+}
+
+// Compact passes compactions on to the wrapped store.
+func (s *HealthTrackingStore) Compact(locations []string) (CompactReport, error) {
+	compacter, ok := s.ShardStore.(ShardCompacter)
+	if !ok {
+		return CompactReport{}, fmt.Errorf("%T can't compact: %w", s.ShardStore, errors.ErrUnsupported)
+	}
+	return compacter.Compact(locations)
+}
+
+// Unwrap returns the wrapped store, whose capabilities are the ones Probe
+// reports.
+func (s *HealthTrackingStore) Unwrap() ShardStore {
+	return s.ShardStore
+}
+
+func (s *HealthTrackingStore) Close() error {
+	return errors.Join(s.Health.Save(), s.ShardStore.Close())
+}
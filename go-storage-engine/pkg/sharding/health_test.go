@@ -0,0 +1,36 @@
+package sharding
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestHealthIgnoresMissingShards(t *testing.T) {
+	location := t.TempDir()
+	store := &HealthTrackingStore{ShardStore: NewInMemoryShardStore(), Health: NewHealthTracker(filepath.Join(t.TempDir(), "health.json"))}
+	for i := 0; i < 20; i++ {
+		if _, err := store.RetrieveShard("missing", i, location); err == nil {
+			t.Fatal("retrieved a shard that was never stored")
+		}
+		if _, err := store.ShardChecksum("missing", i, location); err == nil {
+			t.Fatal("checksummed a shard that was never stored")
+		}
+		if exists, err := HasShard(store, "missing", i, location); err != nil || exists {
+			t.Fatalf("HasShard = %t, %v", exists, err)
+		}
+	}
+	h := store.Health.Snapshot()[location]
+	if h.Failures != 0 || store.Health.Score(location) < 1 {
+		t.Fatalf("missing shards counted against the location: %d failures, score %.2f", h.Failures, store.Health.Score(location))
+	}
+}
+
+func TestHealthCountsLocationFaults(t *testing.T) {
+	tracker := NewHealthTracker(filepath.Join(t.TempDir(), "health.json"))
+	for i := 0; i < 20; i++ {
+		tracker.Record("/loc", 0, errTestFault)
+	}
+	if score := tracker.Score("/loc"); score >= HealthyScore {
+		t.Fatalf("score %.2f after repeated failures, expected below %.2f", score, HealthyScore)
+	}
+}
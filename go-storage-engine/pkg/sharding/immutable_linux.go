@@ -0,0 +1,40 @@
+//go:build linux
+
+package sharding
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	fsIocGetFlags = 0x80086601
+	fsIocSetFlags = 0x40086602
+	fsImmutableFl = 0x00000010
+)
+
+// setImmutable sets or clears the immutable attribute of a file, as
+// chattr +i does. It needs CAP_LINUX_IMMUTABLE and a filesystem that
+// supports the attribute.
+func setImmutable(path string, immutable bool) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var flags int32
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), fsIocGetFlags, uintptr(unsafe.Pointer(&flags))); errno != 0 {
+		return errno
+	}
+	if immutable {
+		flags |= fsImmutableFl
+	} else {
+		flags &^= fsImmutableFl
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), fsIocSetFlags, uintptr(unsafe.Pointer(&flags))); errno != 0 {
+		return errno
+	}
+	return nil
+}
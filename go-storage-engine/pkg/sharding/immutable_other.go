@@ -0,0 +1,12 @@
+//go:build !linux
+
+package sharding
+
+import "errors"
+
+// The immutable attribute is only set on Linux; elsewhere locked shards
+// rely on their read-only mode.
+
+func setImmutable(path string, immutable bool) error {
+	return errors.ErrUnsupported
+}
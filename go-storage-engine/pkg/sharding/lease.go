@@ -0,0 +1,306 @@
+package sharding
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// LeaseFileName is the name of the advisory lease file kept at a location.
+const LeaseFileName = ".vault.lease"
+
+var ErrLeaseHeld = errors.New("location is leased by another vault instance")
+
+// Lease is an advisory claim on a storage location. Maintenance operations
+// hold a lease on every location they touch so that two vault instances
+// sharing the same locations don't interleave destructive work. Normal
+// store and retrieve never look at leases.
+type Lease struct {
+	Owner     string    `json:"owner"`
+	Operation string    `json:"operation"`
+	Acquired  time.Time `json:"acquired"`
+	Expiry    time.Time `json:"expiry"`
+
+	location string
+}
+
+// Live reports whether the lease has not yet expired.
+func (l *Lease) Live() bool {
+	return time.Now().Before(l.Expiry)
+}
+
+// Location returns the location the lease was read from or acquired at.
+func (l *Lease) Location() string {
+	return l.location
+}
+
+// NewLeaseOwner returns an owner id unique to this process.
+func NewLeaseOwner() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	b := make([]byte, 4)
+	rand.Read(b)
+	return fmt.Sprintf("%s/%d/%s", host, os.Getpid(), hex.EncodeToString(b))
+}
+
+// ReadLease returns the lease currently recorded at location, or nil if there is none.
+func ReadLease(location string) (*Lease, error) {
+	data, err := os.ReadFile(filepath.Join(location, LeaseFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read lease: %w", err)
+	}
+	var lease Lease
+	if err := json.Unmarshal(data, &lease); err != nil {
+		return nil, fmt.Errorf("failed to parse lease at %s: %w", location, err)
+	}
+	lease.location = location
+	return &lease, nil
+}
+
+// AcquireLease claims location for owner. It fails with ErrLeaseHeld if a
+// live lease from another owner exists, unless steal is set. Expired leases
+// are taken over.
+func AcquireLease(location, owner, operation string, ttl time.Duration, steal bool) (*Lease, error) {
+	if err := os.MkdirAll(location, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	lease := &Lease{
+		Owner:     owner,
+		Operation: operation,
+		Acquired:  time.Now(),
+		Expiry:    time.Now().Add(ttl),
+		location:  location,
+	}
+
+	// Two attempts: the second runs after clearing an expired or stolen lease.
+	for attempt := 0; attempt < 2; attempt++ {
+		err := lease.create()
+		if err == nil {
+			return lease, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, err
+		}
+
+		current, err := ReadLease(location)
+		if err != nil {
+			return nil, err
+		}
+		if current == nil {
+			continue
+		}
+		if current.Owner == owner {
+			return lease, lease.write()
+		}
+		if current.Live() && !steal {
+			return nil, fmt.Errorf("%w: %s held by %s for %s until %s", ErrLeaseHeld, location, current.Owner, current.Operation, current.Expiry.Format(time.RFC3339))
+		}
+		if err := clearLease(location, current); err != nil {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("%w: %s changed hands while acquiring", ErrLeaseHeld, location)
+}
+
+// Refresh extends the lease by ttl. It fails if another owner has taken
+// the lease over in the meantime.
+func (l *Lease) Refresh(ttl time.Duration) error {
+	current, err := ReadLease(l.location)
+	if err != nil {
+		return err
+	}
+	if current == nil || current.Owner != l.Owner {
+		return fmt.Errorf("%w: lease at %s was lost", ErrLeaseHeld, l.location)
+	}
+	l.Expiry = time.Now().Add(ttl)
+	return l.write()
+}
+
+// Release removes the lease if it is still held by its owner.
+func (l *Lease) Release() error {
+	current, err := ReadLease(l.location)
+	if err != nil {
+		return err
+	}
+	if current == nil || current.Owner != l.Owner {
+		return nil
+	}
+	if err := os.Remove(l.path()); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to release lease: %w", err)
+	}
+	return nil
+}
+
+func (l *Lease) path() string {
+	return filepath.Join(l.location, LeaseFileName)
+}
+
+// create publishes the lease only if no lease file exists, by writing it
+// to a private file and hard-linking that into place.
+func (l *Lease) create() error {
+	tmp, err := l.writeTemp()
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	if err := os.Link(tmp, l.path()); err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return err
+		}
+		return fmt.Errorf("failed to create lease: %w", err)
+	}
+	return nil
+}
+
+// write replaces the lease file atomically.
+func (l *Lease) write() error {
+	tmp, err := l.writeTemp()
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, l.path()); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write lease: %w", err)
+	}
+	return nil
+}
+
+func (l *Lease) writeTemp() (string, error) {
+	data, err := json.Marshal(l)
+	if err != nil {
+		return "", err
+	}
+	file, err := os.CreateTemp(l.location, LeaseFileName+".*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create lease: %w", err)
+	}
+	defer file.Close()
+	if _, err := file.Write(data); err != nil {
+		os.Remove(file.Name())
+		return "", fmt.Errorf("failed to write lease: %w", err)
+	}
+	return file.Name(), nil
+}
+
+// clearLease moves the expected lease out of the way. If another instance
+// replaced it after it was read, the replacement is put back untouched.
+func clearLease(location string, expected *Lease) error {
+	path := filepath.Join(location, LeaseFileName)
+	stale := fmt.Sprintf("%s.stale.%d", path, time.Now().UnixNano())
+	if err := os.Rename(path, stale); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("failed to clear lease: %w", err)
+	}
+	data, err := os.ReadFile(stale)
+	if err == nil {
+		var moved Lease
+		if json.Unmarshal(data, &moved) == nil && (moved.Owner != expected.Owner || !moved.Acquired.Equal(expected.Acquired)) {
+			os.Link(stale, path)
+		}
+	}
+	os.Remove(stale)
+	return nil
+}
+
+// LeaseSet holds leases on several locations and keeps them refreshed
+// until released.
+type LeaseSet struct {
+	leases []*Lease
+	ttl    time.Duration
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	stop   chan struct{}
+	done   sync.WaitGroup
+}
+
+// AcquireLeases leases every location or none of them. Locations listed
+// more than once are leased once. The set's Context is derived from ctx.
+func AcquireLeases(ctx context.Context, locations []string, owner, operation string, ttl time.Duration, steal bool) (*LeaseSet, error) {
+	if ttl <= 0 {
+		return nil, fmt.Errorf("lease ttl must be positive, got %s", ttl)
+	}
+	set := &LeaseSet{ttl: ttl, stop: make(chan struct{})}
+	seen := make(map[string]bool)
+	for _, location := range locations {
+		if seen[location] {
+			continue
+		}
+		seen[location] = true
+		lease, err := AcquireLease(location, owner, operation, ttl, steal)
+		if err != nil {
+			set.releaseAll()
+			return nil, err
+		}
+		set.leases = append(set.leases, lease)
+	}
+
+	set.ctx, set.cancel = context.WithCancelCause(ctx)
+	set.done.Add(1)
+	go set.keepAlive()
+	return set, nil
+}
+
+// Context is canceled once any lease in the set can't be refreshed, with
+// the refresh error as its cause. Work done under the leases should stop
+// then: another instance may already be working on the same locations.
+func (s *LeaseSet) Context() context.Context {
+	return s.ctx
+}
+
+// minLeaseRefresh is the shortest interval leases are refreshed at, so
+// that a ttl of a few nanoseconds doesn't make a zero one.
+const minLeaseRefresh = time.Millisecond
+
+// keepAlive refreshes the leases at a third of their ttl, until released
+// or a refresh fails.
+func (s *LeaseSet) keepAlive() {
+	defer s.done.Done()
+	ticker := time.NewTicker(max(s.ttl/3, minLeaseRefresh))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			for _, lease := range s.leases {
+				if err := lease.Refresh(s.ttl); err != nil {
+					s.cancel(fmt.Errorf("failed to refresh lease at %s: %w", lease.Location(), err))
+					return
+				}
+			}
+		}
+	}
+}
+
+// Release stops refreshing and removes every lease in the set.
+func (s *LeaseSet) Release() error {
+	close(s.stop)
+	s.done.Wait()
+	s.cancel(nil)
+	return s.releaseAll()
+}
+
+func (s *LeaseSet) releaseAll() error {
+	var errs []error
+	for _, lease := range s.leases {
+		if err := lease.Release(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,177 @@
+package sharding
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAcquireLeasesRejectsNonPositiveTTL(t *testing.T) {
+	for _, ttl := range []time.Duration{0, -time.Second} {
+		if _, err := AcquireLeases(context.Background(), []string{t.TempDir()}, "owner", "test", ttl, false); err == nil {
+			t.Fatalf("ttl %s accepted", ttl)
+		}
+	}
+}
+
+func TestLostLeaseCancelsContext(t *testing.T) {
+	location := t.TempDir()
+	ttl := 60 * time.Millisecond
+	set, err := AcquireLeases(context.Background(), []string{location}, "first", "test", ttl, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer set.Release()
+
+	// Another instance takes the location over
+	if _, err := AcquireLease(location, "second", "test", time.Minute, true); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-set.Context().Done():
+	case <-time.After(10 * ttl):
+		t.Fatal("context still live after the lease was lost")
+	}
+	if cause := context.Cause(set.Context()); !errors.Is(cause, ErrLeaseHeld) {
+		t.Fatalf("cause = %v, want ErrLeaseHeld", cause)
+	}
+}
+
+func TestHeldLeaseKeepsContextLive(t *testing.T) {
+	ttl := 60 * time.Millisecond
+	set, err := AcquireLeases(context.Background(), []string{t.TempDir()}, "owner", "test", ttl, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(3 * ttl)
+	if err := set.Context().Err(); err != nil {
+		t.Fatalf("context canceled while the lease was held: %v", err)
+	}
+	if err := set.Release(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTinyTTLDoesNotPanic(t *testing.T) {
+	set, err := AcquireLeases(context.Background(), []string{t.TempDir()}, "owner", "test", 2*time.Nanosecond, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := set.Release(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLiveLeaseOfAnotherOwnerIsHeld(t *testing.T) {
+	location := t.TempDir()
+	first, err := AcquireLease(location, "first", "gc", time.Minute, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := AcquireLease(location, "second", "gc", time.Minute, false); !errors.Is(err, ErrLeaseHeld) {
+		t.Fatalf("acquiring a live lease of another owner returned %v, expected ErrLeaseHeld", err)
+	}
+	if lease, err := ReadLease(location); err != nil || lease.Owner != "first" {
+		t.Fatalf("lease now held by %+v, %v", lease, err)
+	}
+	// Its owner acquires it again, as a restart would
+	if _, err := AcquireLease(location, "first", "gc", time.Minute, false); err != nil {
+		t.Fatalf("owner reacquiring its lease: %v", err)
+	}
+	if err := first.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := AcquireLease(location, "second", "gc", time.Minute, false); err != nil {
+		t.Fatalf("acquiring a released lease: %v", err)
+	}
+}
+
+func TestExpiredLeaseIsTakenOver(t *testing.T) {
+	location := t.TempDir()
+	if _, err := AcquireLease(location, "first", "gc", time.Millisecond, false); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if _, err := AcquireLease(location, "second", "gc", time.Minute, false); err != nil {
+		t.Fatalf("acquiring an expired lease: %v", err)
+	}
+}
+
+// TestInstancesContendForGC runs two instances sharing locations, each
+// leasing them all to garbage collect, over and over: at no time do both
+// hold them, and each gets its turn.
+func TestInstancesContendForGC(t *testing.T) {
+	shared := t.TempDir()
+	locations := []string{filepath.Join(shared, "a"), filepath.Join(shared, "b"), filepath.Join(shared, "c")}
+	var (
+		mu      sync.Mutex
+		holding int
+		ran     = map[string]int{}
+		wg      sync.WaitGroup
+	)
+	for i := range 2 {
+		owner := fmt.Sprintf("instance-%d", i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			deadline := time.Now().Add(10 * time.Second)
+			for runs := 0; runs < 20 && time.Now().Before(deadline); {
+				set, err := AcquireLeases(context.Background(), locations, owner, "gc", time.Minute, false)
+				if errors.Is(err, ErrLeaseHeld) {
+					time.Sleep(100 * time.Microsecond)
+					continue
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				mu.Lock()
+				holding++
+				if holding > 1 {
+					t.Error("both instances hold the locations")
+				}
+				ran[owner]++
+				runs++
+				mu.Unlock()
+				time.Sleep(200 * time.Microsecond) // Collecting
+				mu.Lock()
+				holding--
+				mu.Unlock()
+				if err := set.Release(); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if ran["instance-0"] != 20 || ran["instance-1"] != 20 {
+		t.Fatalf("garbage collections run %v, expected 20 by each instance", ran)
+	}
+
+	// The loser of a contended lease sees who holds it and can steal it
+	holder, err := AcquireLeases(context.Background(), locations, "instance-0", "gc", time.Minute, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := AcquireLeases(context.Background(), locations, "instance-1", "gc", time.Minute, false); !errors.Is(err, ErrLeaseHeld) {
+		t.Fatalf("second instance acquiring held locations returned %v", err)
+	}
+	stolen, err := AcquireLeases(context.Background(), locations, "instance-1", "gc", time.Minute, true)
+	if err != nil {
+		t.Fatalf("stealing: %v", err)
+	}
+	defer stolen.Release()
+	if err := holder.Release(); err != nil {
+		t.Fatal(err)
+	}
+	for _, location := range locations {
+		if lease, err := ReadLease(location); err != nil || lease == nil || lease.Owner != "instance-1" {
+			t.Fatalf("%s leased by %+v after the first instance released, %v", location, lease, err)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package sharding
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// ErrLocationUnwritable is returned for a directory location shards can't
+// be written to, such as a read-only mount.
+var ErrLocationUnwritable = errors.New("storage location is not writable")
+
+// ValidateLocation checks that a storage location is an object store
+// location or a directory path usable on this platform. On Windows, drive
+// letters and UNC paths (\\server\share\dir) are accepted, but a
+// drive-relative path such as C:shards is not, since what it names
+// depends on the current directory of that drive. Commas are reserved as
+// the separator of candidate location lists.
+func ValidateLocation(location string) error {
+	if location == "" {
+		return fmt.Errorf("invalid storage location: %s", location)
+	}
+	if IsObjectLocation(location) {
+		_, err := ParseObjectLocation(location)
+		return err
+	}
+	if strings.ContainsRune(location, 0) || strings.Contains(location, ",") {
+		return fmt.Errorf("invalid storage location: %q", location)
+	}
+	if filepath.VolumeName(location) != "" && !filepath.IsAbs(location) {
+		return fmt.Errorf("invalid storage location %q: drive-relative paths are ambiguous, use an absolute path", location)
+	}
+	return nil
+}
+
+// ProbeWritable checks that shards can be written to a directory location
+// by creating and removing a file in it; a stat can't tell that a mount is
+// read-only. Object store locations aren't probed.
+func ProbeWritable(location string) error {
+	if IsObjectLocation(location) {
+		return nil
+	}
+	if err := os.MkdirAll(location, 0755); err != nil {
+		return unwritableError(location, err)
+	}
+	file, err := os.CreateTemp(location, ".vault-probe-*")
+	if err != nil {
+		return unwritableError(location, err)
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+// WritableLocations splits a pool into the locations that pass
+// ProbeWritable and the errors of those that don't.
+func WritableLocations(pool []string) ([]string, []error) {
+	var (
+		writable []string
+		errs     []error
+	)
+	for _, location := range pool {
+		if err := ProbeWritable(location); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		writable = append(writable, location)
+	}
+	return writable, errs
+}
+
+// RequireWritable is WritableLocations for a store needing needed
+// locations: it returns the writable locations of the pool, so spares
+// stand in for unwritable ones, and the errors of those left out, failing
+// with all of them when fewer than needed are writable.
+func RequireWritable(pool []string, needed int) ([]string, []error, error) {
+	writable, unwritable := WritableLocations(pool)
+	if len(writable) < needed {
+		return nil, unwritable, fmt.Errorf("only %d of %d storage locations are writable, %d needed: %w",
+			len(writable), len(pool), needed, errors.Join(unwritable...))
+	}
+	return writable, unwritable, nil
+}
+
+// unwritableError explains why writing to a location failed, singling out
+// read-only filesystems, missing permissions and full disks. The cause
+// stays wrapped for Classify.
+func unwritableError(location string, err error) error {
+	switch {
+	case errors.Is(err, syscall.EROFS):
+		return fmt.Errorf("%w: %s is on a read-only filesystem%w", ErrLocationUnwritable, location, quiet{err})
+	case errors.Is(err, fs.ErrPermission):
+		return fmt.Errorf("%w: permission denied writing to %s%w", ErrLocationUnwritable, location, quiet{err})
+	case errors.Is(err, syscall.ENOSPC), errors.Is(err, syscall.EDQUOT):
+		return fmt.Errorf("%w: %s is out of space%w", ErrLocationUnwritable, location, quiet{err})
+	}
+	return fmt.Errorf("%w: %s: %w", ErrLocationUnwritable, location, err)
+}
+
+// quiet wraps an error without adding to the message, for causes the
+// message already explains.
+type quiet struct{ err error }
+
+func (q quiet) Error() string { return "" }
+func (q quiet) Unwrap() error { return q.err }
@@ -0,0 +1,139 @@
+package sharding
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// TestValidateLocation covers drive-letter and UNC locations, which only
+// root paths on Windows; elsewhere they are relative paths like any other.
+func TestValidateLocation(t *testing.T) {
+	windows := runtime.GOOS == "windows"
+	for _, tc := range []struct {
+		location string
+		valid    bool
+	}{
+		{"/mnt/disk0/shards", true},
+		{"shards", true},
+		{"", false},
+		{"/mnt/a,/mnt/b", false},
+		{"/mnt/disk\x000", false},
+		{`C:\shards`, true},
+		{`C:/shards`, true},
+		{`\\server\share\shards`, true},
+		{`C:shards`, !windows},
+		{`D:`, !windows},
+	} {
+		if err := ValidateLocation(tc.location); (err == nil) != tc.valid {
+			t.Fatalf("ValidateLocation(%q): %v, expected valid %t", tc.location, err, tc.valid)
+		}
+	}
+}
+
+// readOnlyDir returns a directory chmod'd 0555, skipping the test where
+// that doesn't stop writes: on Windows, and for root.
+func readOnlyDir(t *testing.T) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("directory modes don't stop writes on Windows")
+	}
+	if os.Geteuid() == 0 {
+		t.Skip("root writes to read-only directories")
+	}
+	dir := filepath.Join(t.TempDir(), "readonly")
+	if err := os.Mkdir(dir, 0555); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chmod(dir, 0755) })
+	return dir
+}
+
+func TestProbeWritableReadOnlyDirectory(t *testing.T) {
+	dir := readOnlyDir(t)
+	for _, location := range []string{dir, filepath.Join(dir, "shards")} {
+		err := ProbeWritable(location)
+		want := fmt.Sprintf("storage location is not writable: permission denied writing to %s", location)
+		if !errors.Is(err, ErrLocationUnwritable) || !errors.Is(err, fs.ErrPermission) || err.Error() != want {
+			t.Fatalf("ProbeWritable(%s): %v", location, err)
+		}
+	}
+	if err := ProbeWritable(t.TempDir()); err != nil {
+		t.Fatalf("ProbeWritable of a writable directory: %v", err)
+	}
+
+	// A write failing past the probe is explained the same way
+	err := NewInMemoryShardStore().StoreShard("obj", 0, []byte("shard"), dir)
+	if !errors.Is(err, ErrLocationUnwritable) || !strings.Contains(err.Error(), "permission denied writing to "+dir) {
+		t.Fatalf("StoreShard to a read-only directory: %v", err)
+	}
+}
+
+func TestUnwritableErrorMessages(t *testing.T) {
+	for _, tc := range []struct {
+		cause error
+		want  string
+	}{
+		{syscall.EROFS, "storage location is not writable: /mnt/ro is on a read-only filesystem"},
+		{fs.ErrPermission, "storage location is not writable: permission denied writing to /mnt/ro"},
+		{syscall.ENOSPC, "storage location is not writable: /mnt/ro is out of space"},
+		{syscall.ENOTDIR, "storage location is not writable: /mnt/ro: mkdir /mnt/ro: " + syscall.ENOTDIR.Error()},
+	} {
+		err := unwritableError("/mnt/ro", &fs.PathError{Op: "mkdir", Path: "/mnt/ro", Err: tc.cause})
+		if err.Error() != tc.want || !errors.Is(err, ErrLocationUnwritable) || !errors.Is(err, tc.cause) {
+			t.Fatalf("%v explained as %q", tc.cause, err)
+		}
+	}
+}
+
+// TestRequireWritableRoutesAround checks that unwritable locations are
+// left out while enough remain, and named in the error once too few do.
+// A file stands in for a location everyone, root included, fails to write
+// to; a 0555 directory joins it where the platform allows.
+func TestRequireWritableRoutesAround(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "not-a-directory")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	unwritable := []string{file}
+	if runtime.GOOS != "windows" && os.Geteuid() != 0 {
+		readOnly := filepath.Join(dir, "readonly")
+		if err := os.Mkdir(readOnly, 0555); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { os.Chmod(readOnly, 0755) })
+		unwritable = append(unwritable, readOnly)
+	}
+	pool := []string{filepath.Join(dir, "a"), filepath.Join(dir, "b"), filepath.Join(dir, "c")}
+	pool = append(pool, unwritable...)
+
+	writable, skipped, err := RequireWritable(pool, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(writable) != 3 || len(skipped) != len(unwritable) {
+		t.Fatalf("writable %v, skipped %v", writable, skipped)
+	}
+	for i, err := range skipped {
+		if !errors.Is(err, ErrLocationUnwritable) || !strings.Contains(err.Error(), unwritable[i]) {
+			t.Fatalf("skipped %s with %v", unwritable[i], err)
+		}
+	}
+
+	_, _, err = RequireWritable(pool, 4)
+	if !errors.Is(err, ErrLocationUnwritable) || !strings.HasPrefix(err.Error(), fmt.Sprintf("only 3 of %d storage locations are writable, 4 needed: ", len(pool))) {
+		t.Fatalf("RequireWritable with too few writable: %v", err)
+	}
+	for _, location := range unwritable {
+		if !strings.Contains(err.Error(), location) {
+			t.Fatalf("error doesn't name %s: %v", location, err)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package sharding
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemFS is a ShardFS held entirely in memory, for tests and for embedding
+// a store without touching the disk. Like a filesystem used by anyone but
+// root, it refuses to write over a file whose mode has no owner write
+// bit.
+type MemFS struct {
+	mu    sync.RWMutex
+	files map[string]*memFile
+}
+
+// memFile is a file or directory of a MemFS.
+type memFile struct {
+	data    []byte
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+// NewMemFS returns an empty MemFS. Its root directory exists.
+func NewMemFS() *MemFS {
+	return &MemFS{files: map[string]*memFile{string(filepath.Separator): {mode: fs.ModeDir | 0755, modTime: time.Now()}}}
+}
+
+// memPath cleans a name the way the files are keyed. Relative names are
+// taken from the root.
+func memPath(name string) string {
+	return filepath.Join(string(filepath.Separator), name)
+}
+
+func (m *MemFS) Open(name string) (fs.File, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	path := memPath(name)
+	file, ok := m.files[path]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	info := memInfo{name: filepath.Base(path), size: int64(len(file.data)), mode: file.mode, modTime: file.modTime}
+	if file.mode.IsDir() {
+		entries, _ := m.readDir(path)
+		return &memDir{info: info, entries: entries}, nil
+	}
+	// Files are replaced rather than changed in place, so an open file
+	// keeps reading what was there when it was opened
+	return &memOpenFile{Reader: bytes.NewReader(file.data), info: info}, nil
+}
+
+func (m *MemFS) ReadFile(name string) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	file, ok := m.files[memPath(name)]
+	if !ok {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: fs.ErrNotExist}
+	}
+	if file.mode.IsDir() {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: fs.ErrInvalid}
+	}
+	return bytes.Clone(file.data), nil
+}
+
+func (m *MemFS) Stat(name string) (fs.FileInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	path := memPath(name)
+	file, ok := m.files[path]
+	if !ok {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return memInfo{name: filepath.Base(path), size: int64(len(file.data)), mode: file.mode, modTime: file.modTime}, nil
+}
+
+func (m *MemFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	path := memPath(name)
+	if file, ok := m.files[path]; !ok || !file.mode.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	return m.readDir(path)
+}
+
+// readDir lists the directory at path by name, with m.mu held.
+func (m *MemFS) readDir(path string) ([]fs.DirEntry, error) {
+	prefix := strings.TrimSuffix(path, string(filepath.Separator)) + string(filepath.Separator)
+	var entries []fs.DirEntry
+	for name, file := range m.files {
+		rest, ok := strings.CutPrefix(name, prefix)
+		if !ok || rest == "" || strings.ContainsRune(rest, filepath.Separator) {
+			continue
+		}
+		entries = append(entries, fs.FileInfoToDirEntry(memInfo{name: rest, size: int64(len(file.data)), mode: file.mode, modTime: file.modTime}))
+	}
+	sort.Slice(entries, func(a, b int) bool { return entries[a].Name() < entries[b].Name() })
+	return entries, nil
+}
+
+func (m *MemFS) MkdirAll(name string, perm fs.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for path := memPath(name); ; path = filepath.Dir(path) {
+		if file, ok := m.files[path]; ok {
+			if !file.mode.IsDir() {
+				return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
+			}
+			break
+		}
+		m.files[path] = &memFile{mode: fs.ModeDir | perm.Perm(), modTime: time.Now()}
+	}
+	return nil
+}
+
+func (m *MemFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	return m.write("write", name, data, perm, false)
+}
+
+func (m *MemFS) CreateFile(name string, data []byte, perm fs.FileMode) error {
+	return m.write("create", name, data, perm, true)
+}
+
+// write writes a whole file, in a directory that must exist. exclusive
+// refuses to replace a file already there.
+func (m *MemFS) write(op, name string, data []byte, perm fs.FileMode, exclusive bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	path := memPath(name)
+	if dir, ok := m.files[filepath.Dir(path)]; !ok || !dir.mode.IsDir() {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	mode := perm.Perm()
+	if file, ok := m.files[path]; ok {
+		switch {
+		case exclusive:
+			return &fs.PathError{Op: op, Path: name, Err: fs.ErrExist}
+		case file.mode.IsDir():
+			return &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+		case file.mode&0200 == 0:
+			return &fs.PathError{Op: op, Path: name, Err: fs.ErrPermission}
+		}
+		mode = file.mode
+	}
+	m.files[path] = &memFile{data: bytes.Clone(data), mode: mode, modTime: time.Now()}
+	return nil
+}
+
+func (m *MemFS) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	path := memPath(name)
+	file, ok := m.files[path]
+	if !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	if file.mode.IsDir() {
+		if entries, _ := m.readDir(path); len(entries) > 0 {
+			return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrInvalid}
+		}
+	}
+	delete(m.files, path)
+	return nil
+}
+
+// Rename moves a file. Directories can't be renamed.
+func (m *MemFS) Rename(oldname, newname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	oldpath, newpath := memPath(oldname), memPath(newname)
+	file, ok := m.files[oldpath]
+	if !ok {
+		return &fs.PathError{Op: "rename", Path: oldname, Err: fs.ErrNotExist}
+	}
+	if dir, ok := m.files[filepath.Dir(newpath)]; file.mode.IsDir() || !ok || !dir.mode.IsDir() {
+		return &fs.PathError{Op: "rename", Path: oldname, Err: fs.ErrInvalid}
+	}
+	delete(m.files, oldpath)
+	m.files[newpath] = file
+	return nil
+}
+
+func (m *MemFS) Chmod(name string, mode fs.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	file, ok := m.files[memPath(name)]
+	if !ok {
+		return &fs.PathError{Op: "chmod", Path: name, Err: fs.ErrNotExist}
+	}
+	file.mode = file.mode.Type() | mode.Perm()
+	return nil
+}
+
+// memInfo describes a MemFS file.
+type memInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (i memInfo) Name() string       { return i.name }
+func (i memInfo) Size() int64        { return i.size }
+func (i memInfo) Mode() fs.FileMode  { return i.mode }
+func (i memInfo) ModTime() time.Time { return i.modTime }
+func (i memInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i memInfo) Sys() any           { return nil }
+
+// memOpenFile is an open MemFS file. It reads at offsets, which
+// RetrieveShardRange relies on.
+type memOpenFile struct {
+	*bytes.Reader
+	info memInfo
+}
+
+func (f *memOpenFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *memOpenFile) Close() error               { return nil }
+
+// memDir is an open MemFS directory.
+type memDir struct {
+	info    memInfo
+	entries []fs.DirEntry
+}
+
+func (d *memDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *memDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: fs.ErrInvalid}
+}
+func (d *memDir) Close() error { return nil }
+
+func (d *memDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(d.entries))
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
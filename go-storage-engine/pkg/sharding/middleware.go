@@ -0,0 +1,105 @@
+package sharding
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Middleware wraps a store in another that adds to what it does, like
+// recording location health or injecting faults.
+type Middleware func(ShardStore) ShardStore
+
+// Layers a StoreBuilder can put around a store.
+const (
+	// LayerReadOnly refuses every change to shards.
+	LayerReadOnly = "readonly"
+	// LayerHealth records the outcome and latency of every operation.
+	LayerHealth = "health"
+	// LayerVerifyWrites reads every shard written back to confirm it.
+	LayerVerifyWrites = "verify-writes"
+	// LayerFaults injects a fault plan into retrievals.
+	LayerFaults = "faults"
+)
+
+// LayerOrder is the order layers are chained in, outermost first, however
+// they were added:
+//
+//   - readonly is outermost, so refused writes never reach a location and
+//     never count against its health;
+//   - health records what callers see of each location, writes that don't
+//     read back included;
+//   - verify-writes reads writes back from the store below it, so a
+//     misbehaving disk fails the write it mangled;
+//   - faults is innermost and stands in for a misbehaving disk, so every
+//     layer above meets its faults as it would a real one's.
+var LayerOrder = []string{LayerReadOnly, LayerHealth, LayerVerifyWrites, LayerFaults}
+
+// layerConflicts lists layers that can't be chained together, and why.
+var layerConflicts = []struct {
+	a, b   string
+	reason string
+}{
+	{LayerHealth, LayerFaults, "injected faults would be recorded and saved as real failures of the locations"},
+}
+
+// StoreBuilder chains layers around a store in LayerOrder.
+type StoreBuilder struct {
+	layers map[string]Middleware
+}
+
+// NewStoreBuilder returns a builder with no layers.
+func NewStoreBuilder() *StoreBuilder {
+	return &StoreBuilder{layers: make(map[string]Middleware)}
+}
+
+// Use adds the layer name, one of LayerOrder, made by m. Each layer can be
+// added once.
+func (b *StoreBuilder) Use(name string, m Middleware) error {
+	if !slices.Contains(LayerOrder, name) {
+		return fmt.Errorf("unknown shard store layer %q (want one of %s)", name, strings.Join(LayerOrder, ", "))
+	}
+	if _, ok := b.layers[name]; ok {
+		return fmt.Errorf("shard store layer %s added twice", name)
+	}
+	b.layers[name] = m
+	return nil
+}
+
+// Chain returns the names of the layers added, outermost first.
+func (b *StoreBuilder) Chain() []string {
+	var chain []string
+	for _, name := range LayerOrder {
+		if _, ok := b.layers[name]; ok {
+			chain = append(chain, name)
+		}
+	}
+	return chain
+}
+
+// Validate fails if layers that can't be chained together were added.
+func (b *StoreBuilder) Validate() error {
+	var errs []error
+	for _, conflict := range layerConflicts {
+		_, hasA := b.layers[conflict.a]
+		_, hasB := b.layers[conflict.b]
+		if hasA && hasB {
+			errs = append(errs, fmt.Errorf("shard store layers %s and %s can't be used together: %s", conflict.a, conflict.b, conflict.reason))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Build wraps store in the layers added, innermost first, so calls go
+// through them in LayerOrder before reaching it.
+func (b *StoreBuilder) Build(store ShardStore) (ShardStore, error) {
+	if err := b.Validate(); err != nil {
+		return nil, err
+	}
+	chain := b.Chain()
+	for i := len(chain) - 1; i >= 0; i-- {
+		store = b.layers[chain[i]](store)
+	}
+	return store, nil
+}
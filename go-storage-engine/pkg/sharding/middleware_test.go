@@ -0,0 +1,127 @@
+package sharding
+
+import (
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// probeStore records the name of each layer a call goes through.
+type probeStore struct {
+	ShardStore
+	name  string
+	calls *[]string
+}
+
+func (p *probeStore) StoreShard(dataID string, index int, shard []byte, location string) error {
+	*p.calls = append(*p.calls, p.name)
+	return p.ShardStore.StoreShard(dataID, index, shard, location)
+}
+
+func (p *probeStore) RetrieveShard(dataID string, index int, location string) ([]byte, error) {
+	*p.calls = append(*p.calls, p.name)
+	return p.ShardStore.RetrieveShard(dataID, index, location)
+}
+
+func probe(name string, calls *[]string) Middleware {
+	return func(store ShardStore) ShardStore {
+		return &probeStore{ShardStore: store, name: name, calls: calls}
+	}
+}
+
+func TestStoreBuilderChainsInLayerOrder(t *testing.T) {
+	var calls []string
+	builder := NewStoreBuilder()
+	// Added innermost first; the builder puts them in order
+	for _, name := range []string{LayerFaults, LayerReadOnly} {
+		if err := builder.Use(name, probe(name, &calls)); err != nil {
+			t.Fatalf("Use(%s): %v", name, err)
+		}
+	}
+	if chain := builder.Chain(); !slices.Equal(chain, []string{LayerReadOnly, LayerFaults}) {
+		t.Fatalf("chain %v", chain)
+	}
+	store, err := builder.Build(probe("disk", &calls)(NewInMemoryShardStore()))
+	if err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+	location := t.TempDir()
+	if err := store.StoreShard("data", 0, []byte("shard"), location); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.RetrieveShard("data", 0, location); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{LayerReadOnly, LayerFaults, "disk", LayerReadOnly, LayerFaults, "disk"}
+	if !slices.Equal(calls, want) {
+		t.Fatalf("calls went through %v, expected %v", calls, want)
+	}
+}
+
+func TestStoreBuilderRejectsBadChains(t *testing.T) {
+	builder := NewStoreBuilder()
+	if err := builder.Use("metrics", ReadOnly()); err == nil {
+		t.Fatal("added an unknown layer")
+	}
+	if err := builder.Use(LayerHealth, TrackHealth(NewHealthTracker(filepath.Join(t.TempDir(), "health.json")))); err != nil {
+		t.Fatal(err)
+	}
+	if err := builder.Use(LayerHealth, ReadOnly()); err == nil {
+		t.Fatal("added a layer twice")
+	}
+	if err := builder.Use(LayerFaults, InjectFaults(FaultPlan{0: {Kind: FaultDrop}})); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := builder.Build(NewInMemoryShardStore()); err == nil {
+		t.Fatal("built a store recording injected faults as location health")
+	}
+}
+
+func TestReadOnlyStoreRefusesChanges(t *testing.T) {
+	location := t.TempDir()
+	inner := NewInMemoryShardStore()
+	if err := inner.StoreShard("data", 0, []byte("shard"), location); err != nil {
+		t.Fatal(err)
+	}
+	store := ReadOnly()(inner)
+
+	if shard, err := store.RetrieveShard("data", 0, location); err != nil || string(shard) != "shard" {
+		t.Fatalf("RetrieveShard = %q, %v", shard, err)
+	}
+	if exists, err := HasShard(store, "data", 0, location); err != nil || !exists {
+		t.Fatalf("HasShard = %t, %v", exists, err)
+	}
+	for op, err := range map[string]error{
+		"store":  store.StoreShard("data", 1, []byte("shard"), location),
+		"create": CreateShard(store, "data", 1, []byte("shard"), location),
+		"delete": DeleteShard(store, "data", 0, location),
+	} {
+		if !errors.Is(err, ErrReadOnly) || Classify(err) != CategoryPermission {
+			t.Fatalf("%s through a read-only store: %v", op, err)
+		}
+	}
+	if _, err := PurgeQuarantine(store, location, time.Now()); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("PurgeQuarantine: %v", err)
+	}
+	if exists, _ := HasShard(inner, "data", 0, location); !exists {
+		t.Fatal("the shard was deleted through a read-only store")
+	}
+}
+
+func TestParseFaultPlanReadsString(t *testing.T) {
+	plan := FaultPlan{2: {Kind: FaultDrop}, 5: {Kind: FaultCorrupt}, 9: {Kind: FaultDelay, Delay: 3 * time.Millisecond}}
+	parsed, err := ParseFaultPlan(plan.String())
+	if err != nil {
+		t.Fatalf("ParseFaultPlan(%q): %v", plan, err)
+	}
+	if parsed.String() != plan.String() {
+		t.Fatalf("parsed %q as %q", plan, parsed)
+	}
+	for _, bad := range []string{"2", "x:drop", "2:melt", "2:drop,2:corrupt", "1:delay(soon)"} {
+		if _, err := ParseFaultPlan(bad); err == nil {
+			t.Fatalf("parsed %q", bad)
+		}
+	}
+}
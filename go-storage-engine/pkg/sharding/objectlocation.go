@@ -0,0 +1,94 @@
+package sharding
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	ErrUnscopedLocation = errors.New("location has no key prefix")
+
+	errInvalidPrefix = errors.New("invalid key prefix")
+)
+
+// ObjectLocation is a location on an object store, written
+// s3://bucket/prefix/. The prefix namespaces every key a vault writes, so
+// several vaults can share a bucket without seeing each other's objects.
+type ObjectLocation struct {
+	Scheme string
+	Bucket string
+	Prefix string // empty, or ends with "/"
+}
+
+// IsObjectLocation reports whether a location names an object store rather than a directory.
+func IsObjectLocation(location string) bool {
+	return strings.HasPrefix(location, "s3://")
+}
+
+// ParseObjectLocation parses s3://bucket[/prefix/]. A prefix must end with
+// "/" and may not contain empty, "." or ".." segments.
+func ParseObjectLocation(location string) (ObjectLocation, error) {
+	scheme, rest, ok := strings.Cut(location, "://")
+	if !ok || scheme != "s3" {
+		return ObjectLocation{}, fmt.Errorf("unsupported object location %q", location)
+	}
+	bucket, prefix, _ := strings.Cut(rest, "/")
+	if bucket == "" {
+		return ObjectLocation{}, fmt.Errorf("object location %q has no bucket", location)
+	}
+	if err := validatePrefix(prefix); err != nil {
+		return ObjectLocation{}, fmt.Errorf("%w in %q: %v", errInvalidPrefix, location, err)
+	}
+	return ObjectLocation{Scheme: scheme, Bucket: bucket, Prefix: prefix}, nil
+}
+
+func validatePrefix(prefix string) error {
+	if prefix == "" {
+		return nil
+	}
+	if !strings.HasSuffix(prefix, "/") {
+		return errors.New(`prefix must end with "/"`)
+	}
+	for _, segment := range strings.Split(strings.TrimSuffix(prefix, "/"), "/") {
+		switch segment {
+		case "":
+			return errors.New("prefix has an empty segment")
+		case ".", "..":
+			return fmt.Errorf("prefix may not contain %q", segment)
+		}
+	}
+	return nil
+}
+
+// Key returns the full key of name within the location's prefix.
+func (l ObjectLocation) Key(name string) string {
+	return l.Prefix + name
+}
+
+// Scoped reports whether the location has its own key prefix.
+func (l ObjectLocation) Scoped() bool {
+	return l.Prefix != ""
+}
+
+func (l ObjectLocation) String() string {
+	return l.Scheme + "://" + l.Bucket + "/" + l.Prefix
+}
+
+// RequireScoped returns ErrUnscopedLocation for an object location without
+// a key prefix, unless allowUnscoped is set. Operations that delete or
+// enumerate everything they find, like garbage collection, call it first
+// so they can't touch another vault's keys in a shared bucket.
+func RequireScoped(location string, allowUnscoped bool) error {
+	if !IsObjectLocation(location) {
+		return nil
+	}
+	l, err := ParseObjectLocation(location)
+	if err != nil {
+		return err
+	}
+	if !l.Scoped() && !allowUnscoped {
+		return fmt.Errorf("%w: %s", ErrUnscopedLocation, location)
+	}
+	return nil
+}
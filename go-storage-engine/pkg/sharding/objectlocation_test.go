@@ -0,0 +1,195 @@
+package sharding
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeBucket is an ObjectClient holding the objects of every bucket in
+// memory.
+type fakeBucket struct {
+	mu      sync.Mutex
+	objects map[string][]byte // bucket + "\x00" + key
+}
+
+func newFakeBucket() *fakeBucket {
+	return &fakeBucket{objects: make(map[string][]byte)}
+}
+
+func (f *fakeBucket) PutObject(bucket, key string, body []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[bucket+"\x00"+key] = body
+	return nil
+}
+
+func (f *fakeBucket) GetObject(bucket, key string) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	body, ok := f.objects[bucket+"\x00"+key]
+	if !ok {
+		return nil, fmt.Errorf("NoSuchKey %s: %w", key, fs.ErrNotExist)
+	}
+	return body, nil
+}
+
+func (f *fakeBucket) ListObjects(bucket, prefix string) ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var keys []string
+	for name := range f.objects {
+		b, key, _ := strings.Cut(name, "\x00")
+		if rest, ok := strings.CutPrefix(key, prefix); b == bucket && ok && !strings.Contains(rest, "/") {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	return keys, nil
+}
+
+func (f *fakeBucket) DeleteObject(bucket, key string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.objects, bucket+"\x00"+key)
+	return nil
+}
+
+func TestParseObjectLocation(t *testing.T) {
+	for _, tc := range []struct {
+		location, bucket, prefix string
+	}{
+		{"s3://shared", "shared", ""},
+		{"s3://shared/", "shared", ""},
+		{"s3://shared/team-a/", "shared", "team-a/"},
+		{"s3://shared/teams/a/", "shared", "teams/a/"},
+	} {
+		l, err := ParseObjectLocation(tc.location)
+		if err != nil || l.Bucket != tc.bucket || l.Prefix != tc.prefix {
+			t.Fatalf("%s parsed as %+v, %v", tc.location, l, err)
+		}
+	}
+	for _, location := range []string{
+		"gs://shared/team-a/",
+		"s3:///team-a/",
+		"s3://shared/team-a",
+		"s3://shared/team-a//",
+		"s3://shared/../team-b/",
+		"s3://shared/team-a/../team-b/",
+		"s3://shared/./",
+	} {
+		if l, err := ParseObjectLocation(location); err == nil {
+			t.Fatalf("%s parsed as %+v", location, l)
+		}
+	}
+}
+
+// collectGarbage deletes the shards listed at location whose objects
+// aren't in live, the way gc sweeps a location, and returns how many it
+// deleted.
+func collectGarbage(t *testing.T, store *S3ShardStore, location string, allowUnscoped bool, live map[string]bool) (int, error) {
+	t.Helper()
+	if err := RequireScoped(location, allowUnscoped); err != nil {
+		return 0, err
+	}
+	refs, err := ListShards(store, location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleted := 0
+	for _, ref := range refs {
+		if !live[ref.DataID] {
+			if err := store.DeleteShard(ref.DataID, ref.Index, location); err != nil {
+				t.Fatal(err)
+			}
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// TestPrefixedVaultsShareABucket runs two vaults under their own prefixes
+// of one bucket, storing shards of the same dataIDs. Each reads back only
+// its own shards, lists only its own (as du counts them), and a sweep of
+// one vault's location (as gc makes) leaves the other's shards alone.
+func TestPrefixedVaultsShareABucket(t *testing.T) {
+	bucket := newFakeBucket()
+	teamA, teamB := "s3://shared/team-a/", "s3://shared/team-b/"
+	a := &S3ShardStore{Client: bucket, Bucket: "default"}
+	b := &S3ShardStore{Client: bucket, Bucket: "default"}
+	for index := range 3 {
+		for _, dataID := range []string{"kept", "deleted"} {
+			if err := a.StoreShard(dataID, index, []byte("a "+dataID), teamA); err != nil {
+				t.Fatal(err)
+			}
+			if err := b.StoreShard(dataID, index, []byte("b "+dataID), teamB); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if got, err := a.RetrieveShard("kept", 0, teamA); err != nil || string(got) != "a kept" {
+		t.Fatalf("team a read back %q, %v", got, err)
+	}
+	if got, err := b.RetrieveShard("kept", 0, teamB); err != nil || string(got) != "b kept" {
+		t.Fatalf("team b read back %q, %v", got, err)
+	}
+
+	for _, location := range []string{teamA, teamB} {
+		if refs, err := ListShards(a, location); err != nil || len(refs) != 6 {
+			t.Fatalf("%s lists %d shards, %v, expected its own 6", location, len(refs), err)
+		}
+	}
+
+	// Team a deleted one object; team b still has both
+	deleted, err := collectGarbage(t, a, teamA, false, map[string]bool{"kept": true})
+	if err != nil || deleted != 3 {
+		t.Fatalf("gc of team a deleted %d shards, %v, expected 3", deleted, err)
+	}
+	if _, err := a.RetrieveShard("deleted", 0, teamA); !errors.Is(err, ErrShardNotFound) {
+		t.Fatalf("team a's collected shard read back: %v", err)
+	}
+	for index := range 3 {
+		if got, err := b.RetrieveShard("deleted", index, teamB); err != nil || string(got) != "b deleted" {
+			t.Fatalf("gc of team a took team b's shard %d: %q, %v", index, got, err)
+		}
+	}
+	if refs, err := ListShards(b, teamB); err != nil || len(refs) != 6 {
+		t.Fatalf("team b lists %d shards after team a's gc, %v", len(refs), err)
+	}
+}
+
+// TestUnscopedLocationIsGuarded checks that gc refuses a location without
+// a prefix unless unscoped locations are allowed, and that even then the
+// bucket's root doesn't list the keys of vaults under prefixes.
+func TestUnscopedLocationIsGuarded(t *testing.T) {
+	bucket := newFakeBucket()
+	store := &S3ShardStore{Client: bucket, Bucket: "default"}
+	root, teamA := "s3://shared/", "s3://shared/team-a/"
+	for _, location := range []string{root, teamA} {
+		if err := store.StoreShard("object", 0, []byte(location), location); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := collectGarbage(t, store, root, false, nil); !errors.Is(err, ErrUnscopedLocation) {
+		t.Fatalf("gc of an unscoped location returned %v", err)
+	}
+	if err := RequireScoped(teamA, false); err != nil {
+		t.Fatalf("a prefixed location was refused: %v", err)
+	}
+	if err := RequireScoped(t.TempDir(), false); err != nil {
+		t.Fatalf("a directory location was refused: %v", err)
+	}
+
+	deleted, err := collectGarbage(t, store, root, true, nil)
+	if err != nil || deleted != 1 {
+		t.Fatalf("allowed gc of the bucket root deleted %d shards, %v, expected its 1", deleted, err)
+	}
+	if got, err := store.RetrieveShard("object", 0, teamA); err != nil || string(got) != teamA {
+		t.Fatalf("gc of the bucket root took team a's shard: %q, %v", got, err)
+	}
+}
@@ -0,0 +1,136 @@
+package sharding
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// QuarantineDir is the directory at each location that corrupt shards are
+// moved into before being repaired, so the bad bytes survive for forensics.
+const QuarantineDir = ".quarantine"
+
+// quarantineTimeFormat stamps quarantined shard names. It has no dots or
+// underscores, so a name splits back into dataID, index and time.
+const quarantineTimeFormat = "20060102T150405,000000000Z"
+
+// ShardQuarantiner is implemented by stores that can set a corrupt shard
+// aside instead of overwriting it.
+type ShardQuarantiner interface {
+	// QuarantineShard moves a shard into the location's quarantine area
+	// and returns its name there.
+	QuarantineShard(dataID string, index int, location string) (string, error)
+	ListQuarantine(location string) ([]QuarantinedShard, error)
+	// PurgeQuarantine removes shards quarantined before a time and returns
+	// how many it removed.
+	PurgeQuarantine(location string, before time.Time) (int, error)
+}
+
+// QuarantinedShard is a shard found in a location's quarantine area.
+type QuarantinedShard struct {
+	Name   string    `json:"name"`
+	DataID string    `json:"data_id"`
+	Index  int       `json:"index"`
+	Time   time.Time `json:"time"`
+	Size   int64     `json:"size"`
+}
+
+// quarantineName names a shard quarantined at t: <dataID>_<index>.<time>.
+func quarantineName(dataID string, index int, t time.Time) string {
+	return fmt.Sprintf("%s_%d.%s", dataID, index, t.UTC().Format(quarantineTimeFormat))
+}
+
+// parseQuarantineName splits a quarantined shard's name.
+func parseQuarantineName(name string) (QuarantinedShard, bool) {
+	base, stamp, ok := strings.Cut(name, ".")
+	if !ok {
+		return QuarantinedShard{}, false
+	}
+	sep := strings.LastIndex(base, "_")
+	if sep <= 0 {
+		return QuarantinedShard{}, false
+	}
+	index, err := strconv.Atoi(base[sep+1:])
+	if err != nil {
+		return QuarantinedShard{}, false
+	}
+	t, err := time.Parse(quarantineTimeFormat, stamp)
+	if err != nil {
+		return QuarantinedShard{}, false
+	}
+	return QuarantinedShard{Name: name, DataID: base[:sep], Index: index, Time: t}, true
+}
+
+// QuarantineShard moves a shard file into the location's .quarantine
+// directory and drops any copy held in memory, so the next read goes to
+// disk.
+func (ims *InMemoryShardStore) QuarantineShard(dataID string, index int, location string) (string, error) {
+	ims.mu.Lock()
+	defer ims.mu.Unlock()
+
+	path, err := ims.existingShardPath(dataID, index, location)
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(location, QuarantineDir)
+	if err := ims.fsys().MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create quarantine directory: %w", err)
+	}
+	name := quarantineName(dataID, index, time.Now())
+	if err := ims.fsys().Rename(path, filepath.Join(dir, name)); err != nil {
+		return "", fmt.Errorf("failed to quarantine shard: %w", err)
+	}
+	ims.gen++
+	ims.uncache(dataID, index, location)
+	return name, nil
+}
+
+// ListQuarantine lists the shards in a location's quarantine area, oldest
+// first. A location without one has none.
+func (ims *InMemoryShardStore) ListQuarantine(location string) ([]QuarantinedShard, error) {
+	entries, err := ims.fsys().ReadDir(filepath.Join(location, QuarantineDir))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var shards []QuarantinedShard
+	for _, entry := range entries {
+		shard, ok := parseQuarantineName(entry.Name())
+		if !ok || entry.IsDir() {
+			continue
+		}
+		if info, err := entry.Info(); err == nil {
+			shard.Size = info.Size()
+		}
+		shards = append(shards, shard)
+	}
+	sort.SliceStable(shards, func(a, b int) bool { return shards[a].Time.Before(shards[b].Time) })
+	return shards, nil
+}
+
+// PurgeQuarantine removes the shards quarantined at a location before a
+// time.
+func (ims *InMemoryShardStore) PurgeQuarantine(location string, before time.Time) (int, error) {
+	shards, err := ims.ListQuarantine(location)
+	if err != nil {
+		return 0, err
+	}
+	purged := 0
+	for _, shard := range shards {
+		if !shard.Time.Before(before) {
+			continue
+		}
+		if err := ims.fsys().Remove(filepath.Join(location, QuarantineDir, shard.Name)); err != nil {
+			return purged, fmt.Errorf("failed to purge %s: %w", shard.Name, err)
+		}
+		purged++
+	}
+	return purged, nil
+}
@@ -0,0 +1,120 @@
+package sharding
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrReadOnly is returned by a ReadOnlyStore for any change to shards.
+var ErrReadOnly = errors.New("shard store is read-only")
+
+// ReadOnlyStore passes reads on to the wrapped store and refuses every
+// write, deletion, lock, quarantine and compaction with ErrReadOnly, so an
+// audit or an inspection can't change a location even by mistake.
+type ReadOnlyStore struct {
+	ShardStore
+}
+
+// ReadOnly returns the middleware of the readonly layer.
+func ReadOnly() Middleware {
+	return func(store ShardStore) ShardStore {
+		return &ReadOnlyStore{ShardStore: store}
+	}
+}
+
+func refuse(op, dataID string, index int, location string) error {
+	return fmt.Errorf("%w: can't %s shard %d of %s at %s", ErrReadOnly, op, index, dataID, location)
+}
+
+func (s *ReadOnlyStore) StoreShard(dataID string, index int, shard []byte, location string) error {
+	return refuse("store", dataID, index, location)
+}
+
+func (s *ReadOnlyStore) CreateShard(dataID string, index int, shard []byte, location string) error {
+	return refuse("create", dataID, index, location)
+}
+
+func (s *ReadOnlyStore) DeleteShard(dataID string, index int, location string) error {
+	return refuse("delete", dataID, index, location)
+}
+
+func (s *ReadOnlyStore) LockShard(dataID string, index int, location string) error {
+	return refuse("lock", dataID, index, location)
+}
+
+func (s *ReadOnlyStore) UnlockShard(dataID string, index int, location string) error {
+	return refuse("unlock", dataID, index, location)
+}
+
+func (s *ReadOnlyStore) QuarantineShard(dataID string, index int, location string) (string, error) {
+	return "", refuse("quarantine", dataID, index, location)
+}
+
+func (s *ReadOnlyStore) PurgeQuarantine(location string, before time.Time) (int, error) {
+	return 0, fmt.Errorf("%w: can't purge the quarantine at %s", ErrReadOnly, location)
+}
+
+func (s *ReadOnlyStore) Compact(locations []string) (CompactReport, error) {
+	return CompactReport{}, fmt.Errorf("%w: can't compact", ErrReadOnly)
+}
+
+// ProveRetrievability passes challenges on to the wrapped store.
+func (s *ReadOnlyStore) ProveRetrievability(dataID string, index int, location string, nonce []byte) ([]byte, error) {
+	prover, ok := s.ShardStore.(RetrievabilityProver)
+	if !ok {
+		return nil, fmt.Errorf("%T can't prove retrievability: %w", s.ShardStore, errors.ErrUnsupported)
+	}
+	return prover.ProveRetrievability(dataID, index, location, nonce)
+}
+
+// HasShard passes existence checks on to the wrapped store.
+func (s *ReadOnlyStore) HasShard(dataID string, index int, location string) (bool, error) {
+	exister, ok := s.ShardStore.(ShardExister)
+	if !ok {
+		return false, fmt.Errorf("%T can't check for shards: %w", s.ShardStore, errors.ErrUnsupported)
+	}
+	return exister.HasShard(dataID, index, location)
+}
+
+// ShardChecksum passes checksum requests on to the wrapped store.
+func (s *ReadOnlyStore) ShardChecksum(dataID string, index int, location string) (string, error) {
+	checksummer, ok := s.ShardStore.(ShardChecksummer)
+	if !ok {
+		return "", fmt.Errorf("%T can't checksum shards: %w", s.ShardStore, errors.ErrUnsupported)
+	}
+	return checksummer.ShardChecksum(dataID, index, location)
+}
+
+func (s *ReadOnlyStore) RetrieveShardRange(dataID string, index int, location string, offset, length int64) ([]byte, error) {
+	reader, ok := s.ShardStore.(ShardRangeReader)
+	if !ok {
+		return nil, fmt.Errorf("%T can't read shard ranges: %w", s.ShardStore, errors.ErrUnsupported)
+	}
+	return reader.RetrieveShardRange(dataID, index, location, offset, length)
+}
+
+// ListShards passes listings on to the wrapped store.
+func (s *ReadOnlyStore) ListShards(location string) ([]ShardRef, error) {
+	lister, ok := s.ShardStore.(ShardLister)
+	if !ok {
+		return nil, fmt.Errorf("%T can't list shards: %w", s.ShardStore, errors.ErrUnsupported)
+	}
+	return lister.ListShards(location)
+}
+
+// ListQuarantine passes quarantine listings on to the wrapped store.
+func (s *ReadOnlyStore) ListQuarantine(location string) ([]QuarantinedShard, error) {
+	quarantiner, ok := s.ShardStore.(ShardQuarantiner)
+	if !ok {
+		return nil, fmt.Errorf("%T can't quarantine shards: %w", s.ShardStore, errors.ErrUnsupported)
+	}
+	return quarantiner.ListQuarantine(location)
+}
+
+// Unwrap returns the wrapped store, whose capabilities are the ones Probe
+// reports; the refused ones fail with ErrReadOnly rather than being
+// missing.
+func (s *ReadOnlyStore) Unwrap() ShardStore {
+	return s.ShardStore
+}
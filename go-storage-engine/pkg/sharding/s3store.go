@@ -1,20 +1,47 @@
 package sharding
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"strings"
 	// Uncomment and import AWS SDK packages if you intend to implement S3 integration.
 	// "github.com/aws/aws-sdk-go/aws"
 	// "github.com/aws/aws-sdk-go/aws/session"
 	// "github.com/aws/aws-sdk-go/service/s3"
 )
 
-// S3ShardStore is a skeleton for an S3-based shard store.
+// S3ShardStore is a skeleton for an S3-based shard store. Shards go
+// through Client, which the AWS SDK's client is to be adapted to; without
+// one, stores and retrieves are only logged. Besides list and delete, S3
+// could provide exists (HeadObject), atomic-create (PutObject with
+// If-None-Match: *) and checksum (GetObjectAttributes with ChecksumSHA256).
 type S3ShardStore struct {
 	// client *s3.S3
+	Client   ObjectClient
 	Bucket   string
 	Endpoint string
+	// Log, when set, gets a line for every shard stored or retrieved.
+	Log io.Writer
 }
 
+// ObjectClient is the part of an object store client S3ShardStore uses.
+// Missing keys are reported with errors wrapping fs.ErrNotExist.
+type ObjectClient interface {
+	PutObject(bucket, key string, body []byte) error
+	GetObject(bucket, key string) ([]byte, error)
+	// ListObjects lists the keys directly under prefix, as ListObjectsV2
+	// does with a "/" delimiter: keys under a longer prefix are left out.
+	ListObjects(bucket, prefix string) ([]string, error)
+	DeleteObject(bucket, key string) error
+}
+
+// errNoClient is returned by the operations that can't be faked without
+// an ObjectClient.
+var errNoClient = errors.New("S3 store has no client")
+
 func NewS3ShardStore(bucket, endpoint string) *S3ShardStore {
 	// Initialize AWS session and S3 client here.
 	return &S3ShardStore{
@@ -23,15 +50,120 @@ func NewS3ShardStore(bucket, endpoint string) *S3ShardStore {
 	}
 }
 
-func (s *S3ShardStore) StoreShard(dataID string, index int, shard []byte) error {
-	// Implement S3 PutObject logic here.
-	fmt.Printf("S3: Stored shard %d for DataID: %s in bucket %s\n", index, dataID, s.Bucket)
+// locationPrefix returns the bucket and key prefix of a location. An s3://
+// location picks both; any other location falls back to s.Bucket, unprefixed.
+func (s *S3ShardStore) locationPrefix(location string) (string, string, error) {
+	if !IsObjectLocation(location) {
+		return s.Bucket, "", nil
+	}
+	l, err := ParseObjectLocation(location)
+	if err != nil {
+		return "", "", err
+	}
+	return l.Bucket, l.Prefix, nil
+}
+
+// shardKey returns the bucket and key of a shard.
+func (s *S3ShardStore) shardKey(dataID string, index int, location string) (string, string, error) {
+	bucket, prefix, err := s.locationPrefix(location)
+	if err != nil {
+		return "", "", err
+	}
+	return bucket, prefix + PlainShardName(dataID, index), nil
+}
+
+func (s *S3ShardStore) StoreShard(dataID string, index int, shard []byte, location string) error {
+	bucket, key, err := s.shardKey(dataID, index, location)
+	if err != nil {
+		return err
+	}
+	// Implement S3 PutObject logic here, sending checksum as ChecksumSHA256
+	// so S3 rejects an upload corrupted on the way with BadDigest, which
+	// should be returned wrapped in ErrTransferIntegrity.
+	checksum := TransferChecksum(shard)
+	if s.Client != nil {
+		if err := s.Client.PutObject(bucket, key, bytes.Clone(shard)); err != nil {
+			return fmt.Errorf("failed to put %s in bucket %s: %w", key, bucket, err)
+		}
+	}
+	s.logf("S3: Stored shard %d for DataID: %s in bucket %s as %s (sha256 %s)\n", index, dataID, bucket, key, checksum)
+	return nil
+}
+
+func (s *S3ShardStore) RetrieveShard(dataID string, index int, location string) ([]byte, error) {
+	bucket, key, err := s.shardKey(dataID, index, location)
+	if err != nil {
+		return nil, err
+	}
+	// Implement S3 GetObject logic here, with ChecksumMode enabled, and
+	// check the body against the returned ChecksumSHA256 with
+	// VerifyTransfer before returning it. NoSuchKey should be returned
+	// wrapped in ErrShardNotFound.
+	s.logf("S3: Retrieved shard %d for DataID: %s from bucket %s as %s\n", index, dataID, bucket, key)
+	if s.Client == nil {
+		// Return a dummy value for demonstration.
+		return []byte("dummy"), nil
+	}
+	shard, err := s.Client.GetObject(bucket, key)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w: shard %d of %s at %s", ErrShardNotFound, index, dataID, location)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %s from bucket %s: %w", key, bucket, err)
+	}
+	return bytes.Clone(shard), nil
+}
+
+// ListShards lists the shards under a location's key prefix, and none
+// under longer prefixes, so a vault sharing the bucket under a prefix of
+// its own is never listed.
+func (s *S3ShardStore) ListShards(location string) ([]ShardRef, error) {
+	if s.Client == nil {
+		return nil, errNoClient
+	}
+	bucket, prefix, err := s.locationPrefix(location)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := s.Client.ListObjects(bucket, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list bucket %s under %q: %w", bucket, prefix, err)
+	}
+	var refs []ShardRef
+	for _, key := range keys {
+		name, ok := strings.CutPrefix(key, prefix)
+		if !ok || strings.Contains(name, "/") || !strings.HasSuffix(name, ".shard") {
+			continue
+		}
+		refs = append(refs, shardRef(name))
+	}
+	return refs, nil
+}
+
+// DeleteShard removes a shard's key. Removing a shard that isn't there is
+// not an error.
+func (s *S3ShardStore) DeleteShard(dataID string, index int, location string) error {
+	if s.Client == nil {
+		return errNoClient
+	}
+	bucket, key, err := s.shardKey(dataID, index, location)
+	if err != nil {
+		return err
+	}
+	if err := s.Client.DeleteObject(bucket, key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to delete %s from bucket %s: %w", key, bucket, err)
+	}
 	return nil
 }
 
-func (s *S3ShardStore) RetrieveShard(dataID string, index int) ([]byte, error) {
-	// Implement S3 GetObject logic here.
-	fmt.Printf("S3: Retrieved shard %d for DataID: %s from bucket %s\n", index, dataID, s.Bucket)
-	// Return a dummy value for demonstration.
-	return []byte("dummy"), nil
+// logf writes a line to s.Log, if set.
+func (s *S3ShardStore) logf(format string, args ...any) {
+	if s.Log != nil {
+		fmt.Fprintf(s.Log, format, args...)
+	}
+}
+
+func (s *S3ShardStore) Close() error {
+	// Release the S3 client's pooled connections here.
+	return nil
 }
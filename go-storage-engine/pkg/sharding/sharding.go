@@ -1,21 +1,54 @@
 package sharding
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 )
 
+// ShardStore is a backend shards are written to and read from. Close
+// flushes pending writes and releases the backend's resources; the store
+// must not be used afterwards.
 type ShardStore interface {
 	StoreShard(dataID string, index int, shard []byte, location string) error
 	RetrieveShard(dataID string, index int, location string) ([]byte, error)
+	io.Closer
 }
 
 // InMemoryShardStore with file persistence
 type InMemoryShardStore struct {
+	// ShardStore caches shards by cacheKey and index.
 	ShardStore map[string]map[int][]byte
-	mu         sync.RWMutex
+	// PathKey, when set, names shard files by an HMAC of the dataID and
+	// index so the filesystem doesn't reveal which objects are stored.
+	PathKey []byte
+	// Log, when set, receives a line for every shard stored or retrieved,
+	// from concurrent retrieves at once. Stores never write to stdout,
+	// which belongs to the objects and records commands print.
+	Log io.Writer
+	// FS, when set, is the filesystem shard files are kept in instead of
+	// the real one.
+	FS ShardFS
+	// Headers, when set, writes a shardheader header in front of every
+	// shard file, so a shard found on its own says what it is. Shard files
+	// are read with or without one either way, and their headers checked.
+	Headers bool
+	mu      sync.RWMutex
+	// gen counts the shards stored and removed, so a retrieve can tell
+	// whether the shard it read from disk without the lock is still current.
+	gen uint64
+	// described holds what DescribeShards was told of shard sets being
+	// stored, for their headers.
+	described map[string]*shardSetDescription
 }
 
 func NewInMemoryShardStore() *InMemoryShardStore {
@@ -31,72 +64,372 @@ func (ims *InMemoryShardStore) StoreShard(dataID string, index int, shard []byte
 	ims.mu.Lock()
 	defer ims.mu.Unlock()
 
-	// Store in memory
-	if _, exists := ims.ShardStore[dataID]; !exists {
-		ims.ShardStore[dataID] = make(map[int][]byte)
-	}
-	ims.ShardStore[dataID][index] = shard
+	ims.gen++
+	// Store a copy in memory, so the caller is free to reuse its buffer
+	shard = bytes.Clone(shard)
+	ims.cache(dataID, index, location, shard)
 
 	// Create the directory if it doesn't exist
-	if err := os.MkdirAll(location, 0755); err != nil {
-		return fmt.Errorf("failed to create directory: %w", err)
+	if err := ims.fsys().MkdirAll(location, 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", unwritableError(location, err))
 	}
 
 	// Store to disk
 	if err := ims.writeShardToDisk(dataID, index, shard, location); err != nil {
-		return fmt.Errorf("failed to persist shard: %w", err)
+		return fmt.Errorf("failed to persist shard: %w", unwritableError(location, err))
 	}
 
-	fmt.Printf("Stored shard %d for DataID: %s in location: %s\n", index, dataID, location)
+	ims.logf("Stored shard %d for DataID: %s in location: %s\n", index, dataID, location)
+	return nil
+}
+
+// Close is a no-op: shards are written through to disk as they are stored.
+func (ims *InMemoryShardStore) Close() error {
 	return nil
 }
 
-// RetrieveShard gets a shard from memory or disk if available
+// RetrieveShard gets a shard from memory or disk if available. The caller
+// gets its own copy, which it may change without touching the cache.
 func (ims *InMemoryShardStore) RetrieveShard(dataID string, index int, location string) ([]byte, error) {
+	key := cacheKey(dataID, location)
 	ims.mu.RLock()
-	defer ims.mu.RUnlock()
-
-	// Try to get from memory first
-	shards, exists := ims.ShardStore[dataID]
+	shard, exists := ims.ShardStore[key][index]
+	gen := ims.gen
+	ims.mu.RUnlock()
 	if exists {
-		shard, exists := shards[index]
-		if exists {
-			fmt.Printf("Retrieved shard %d for DataID: %s from memory\n", index, dataID)
-			return shard, nil
-		}
+		ims.logf("Retrieved shard %d for DataID: %s from memory\n", index, dataID)
+		return bytes.Clone(shard), nil
 	}
 
-	// If not in memory, try to load from disk
+	// Read from disk without the lock, so retrieves of other shards, or
+	// of this one, don't queue up behind the disk
 	shard, err := ims.readShardFromDisk(dataID, index, location)
 	if err != nil {
-		return nil, fmt.Errorf("no shards found for DataID: %s", dataID)
+		return nil, shardReadError(dataID, index, location, err)
+	}
+
+	// Cache what was read unless a shard was stored or removed while it was
+	// read, as what was read may predate it
+	ims.mu.Lock()
+	if ims.gen == gen {
+		ims.cache(dataID, index, location, shard)
 	}
+	ims.mu.Unlock()
+
+	ims.logf("Retrieved shard %d for DataID: %s from location: %s\n", index, dataID, location)
+	return bytes.Clone(shard), nil
+}
 
-	// Store in memory for future use
-	if _, exists := ims.ShardStore[dataID]; !exists {
-		ims.ShardStore[dataID] = make(map[int][]byte)
+// logf writes a line to ims.Log, if set.
+func (ims *InMemoryShardStore) logf(format string, args ...any) {
+	if ims.Log != nil {
+		fmt.Fprintf(ims.Log, format, args...)
 	}
-	ims.ShardStore[dataID][index] = shard
+}
 
-	fmt.Printf("Retrieved shard %d for DataID: %s from location: %s\n", index, dataID, location)
-	return shard, nil
+// cacheKey keys the cache by location as well as dataID, since the same
+// shard can be stored at several locations with different contents, such
+// as while it is being moved or repaired.
+func cacheKey(dataID, location string) string {
+	return location + "\x00" + dataID
+}
+
+// cache keeps a shard in memory. The caller holds the write lock.
+func (ims *InMemoryShardStore) cache(dataID string, index int, location string, shard []byte) {
+	key := cacheKey(dataID, location)
+	if _, exists := ims.ShardStore[key]; !exists {
+		ims.ShardStore[key] = make(map[int][]byte)
+	}
+	ims.ShardStore[key][index] = shard
+}
+
+// uncache drops a shard kept in memory. The caller holds the write lock.
+func (ims *InMemoryShardStore) uncache(dataID string, index int, location string) {
+	key := cacheKey(dataID, location)
+	if shards, exists := ims.ShardStore[key]; exists {
+		delete(shards, index)
+		if len(shards) == 0 {
+			delete(ims.ShardStore, key)
+		}
+	}
 }
 
 // Helper functions for persistence
 
 // getShardPath returns the path for a specific shard file
 func (ims *InMemoryShardStore) getShardPath(dataID string, index int, location string) string {
-	return filepath.Join(location, fmt.Sprintf("%s_%d.shard", dataID, index))
+	if ims.PathKey != nil {
+		return filepath.Join(location, ObfuscatedShardName(ims.PathKey, dataID, index))
+	}
+	return ims.getPlainShardPath(dataID, index, location)
 }
 
-// writeShardToDisk writes a shard to disk
+// getPlainShardPath returns the path a shard is written to without a PathKey
+func (ims *InMemoryShardStore) getPlainShardPath(dataID string, index int, location string) string {
+	return filepath.Join(location, PlainShardName(dataID, index))
+}
+
+// writeShardToDisk writes a shard to disk, after its header if the store
+// writes headers. Callers hold ims.mu.
 func (ims *InMemoryShardStore) writeShardToDisk(dataID string, index int, data []byte, location string) error {
+	data, err := ims.withHeader(dataID, index, data)
+	if err != nil {
+		return err
+	}
 	path := ims.getShardPath(dataID, index, location)
-	return os.WriteFile(path, data, 0644)
+	return ims.fsys().WriteFile(path, data, 0644)
 }
 
-// readShardFromDisk reads a shard from disk
+// readShardFromDisk reads a shard from disk, falling back to the plain
+// name for shards written before a PathKey was configured, and strips its
+// header
 func (ims *InMemoryShardStore) readShardFromDisk(dataID string, index int, location string) ([]byte, error) {
 	path := ims.getShardPath(dataID, index, location)
-	return os.ReadFile(path)
+	data, err := ims.fsys().ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) && ims.PathKey != nil {
+		data, err = ims.fsys().ReadFile(ims.getPlainShardPath(dataID, index, location))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return stripHeader(dataID, index, data)
+}
+
+// shardReadError describes a failure to read a shard file, wrapping
+// ErrShardNotFound when there is no such file.
+func shardReadError(dataID string, index int, location string, err error) error {
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%w: shard %d of %s at %s", ErrShardNotFound, index, dataID, location)
+	}
+	return fmt.Errorf("failed to read shard %d of %s at %s: %w", index, dataID, location, err)
+}
+
+// PlainShardName returns the on-disk name of a shard without a PathKey.
+func PlainShardName(dataID string, index int) string {
+	return fmt.Sprintf("%s_%d.shard", dataID, index)
+}
+
+// ObfuscatedShardName returns the on-disk name of a shard under key.
+func ObfuscatedShardName(key []byte, dataID string, index int) string {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s:%d", dataID, index)
+	return hex.EncodeToString(mac.Sum(nil)) + ".shard"
+}
+
+// RetrievabilityProver is implemented by stores that can prove they hold a
+// shard without sending it back.
+type RetrievabilityProver interface {
+	ProveRetrievability(dataID string, index int, location string, nonce []byte) ([]byte, error)
+}
+
+// ShardDeleter is implemented by stores that can remove shards.
+type ShardDeleter interface {
+	DeleteShard(dataID string, index int, location string) error
+}
+
+// DeleteShard removes a shard from memory and from disk, under both its
+// obfuscated and plain names. Removing a shard that isn't there is not an
+// error.
+func (ims *InMemoryShardStore) DeleteShard(dataID string, index int, location string) error {
+	ims.mu.Lock()
+	defer ims.mu.Unlock()
+
+	ims.gen++
+	ims.uncache(dataID, index, location)
+	for _, path := range []string{ims.getShardPath(dataID, index, location), ims.getPlainShardPath(dataID, index, location)} {
+		if err := ims.fsys().Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to delete shard: %w", err)
+		}
+	}
+	return nil
+}
+
+// HasShard reports whether a shard is on disk, under either name.
+func (ims *InMemoryShardStore) HasShard(dataID string, index int, location string) (bool, error) {
+	for _, path := range []string{ims.getShardPath(dataID, index, location), ims.getPlainShardPath(dataID, index, location)} {
+		_, err := ims.fsys().Stat(path)
+		if err == nil {
+			return true, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// CreateShard writes a shard to disk unless it is already there, failing
+// with ErrShardExists if it is.
+func (ims *InMemoryShardStore) CreateShard(dataID string, index int, shard []byte, location string) error {
+	ims.mu.Lock()
+	defer ims.mu.Unlock()
+
+	if err := ims.fsys().MkdirAll(location, 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", unwritableError(location, err))
+	}
+	if ims.PathKey != nil {
+		// A shard written before the PathKey was set has the plain name
+		if _, err := ims.fsys().Stat(ims.getPlainShardPath(dataID, index, location)); err == nil {
+			return fmt.Errorf("%w: shard %d of %s at %s", ErrShardExists, index, dataID, location)
+		}
+	}
+	data, err := ims.withHeader(dataID, index, shard)
+	if err != nil {
+		return err
+	}
+	err = ims.fsys().CreateFile(ims.getShardPath(dataID, index, location), data, 0644)
+	if errors.Is(err, os.ErrExist) {
+		return fmt.Errorf("%w: shard %d of %s at %s", ErrShardExists, index, dataID, location)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to persist shard: %w", unwritableError(location, err))
+	}
+
+	ims.gen++
+	ims.cache(dataID, index, location, bytes.Clone(shard))
+	return nil
+}
+
+// ShardChecksum checksums a shard as it is on disk.
+func (ims *InMemoryShardStore) ShardChecksum(dataID string, index int, location string) (string, error) {
+	shard, err := ims.readShardFromDisk(dataID, index, location)
+	if err != nil {
+		return "", shardReadError(dataID, index, location, err)
+	}
+	return TransferChecksum(shard), nil
+}
+
+// ListShards lists the shard files in a location directory.
+func (ims *InMemoryShardStore) ListShards(location string) ([]ShardRef, error) {
+	entries, err := ims.fsys().ReadDir(location)
+	if err != nil {
+		return nil, err
+	}
+	var refs []ShardRef
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".shard") {
+			continue
+		}
+		refs = append(refs, shardRef(name))
+	}
+	return refs, nil
+}
+
+// shardRef describes the shard file name. The dataID and index are only
+// known for plain names; obfuscated ones have an Index of -1.
+func shardRef(name string) ShardRef {
+	ref := ShardRef{Name: name, Index: -1}
+	base := strings.TrimSuffix(name, ".shard")
+	if sep := strings.LastIndex(base, "_"); sep > 0 {
+		if index, err := strconv.Atoi(base[sep+1:]); err == nil {
+			ref.DataID, ref.Index = base[:sep], index
+		}
+	}
+	return ref
+}
+
+// LockShard makes a shard file read-only and, where the filesystem and
+// privileges allow, immutable, so not even its owner can change or remove
+// it. The immutable attribute is best effort: without it the shard is only
+// read-only.
+func (ims *InMemoryShardStore) LockShard(dataID string, index int, location string) error {
+	path, err := ims.existingShardPath(dataID, index, location)
+	if err != nil {
+		return err
+	}
+	if err := ims.fsys().Chmod(path, 0400); err != nil {
+		return fmt.Errorf("failed to lock shard: %w", err)
+	}
+	if ims.FS == nil {
+		setImmutable(path, true)
+	}
+	return nil
+}
+
+// UnlockShard reverses LockShard.
+func (ims *InMemoryShardStore) UnlockShard(dataID string, index int, location string) error {
+	path, err := ims.existingShardPath(dataID, index, location)
+	if err != nil {
+		return err
+	}
+	if ims.FS == nil {
+		setImmutable(path, false)
+	}
+	if err := ims.fsys().Chmod(path, 0644); err != nil {
+		return fmt.Errorf("failed to unlock shard: %w", err)
+	}
+	return nil
+}
+
+// existingShardPath returns the name a shard is on disk under.
+func (ims *InMemoryShardStore) existingShardPath(dataID string, index int, location string) (string, error) {
+	for _, path := range []string{ims.getShardPath(dataID, index, location), ims.getPlainShardPath(dataID, index, location)} {
+		if _, err := ims.fsys().Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("%w: shard %d of %s at %s", ErrShardNotFound, index, dataID, location)
+}
+
+// RetrievabilityProof is the response to a challenge: HMAC-SHA256 of the
+// shard keyed by the challenger's nonce.
+func RetrievabilityProof(shard, nonce []byte) []byte {
+	mac := hmac.New(sha256.New, nonce)
+	mac.Write(shard)
+	return mac.Sum(nil)
+}
+
+// ProveRetrievability answers a challenge from the shard on disk, never
+// from the in-memory copy.
+func (ims *InMemoryShardStore) ProveRetrievability(dataID string, index int, location string, nonce []byte) ([]byte, error) {
+	shard, err := ims.readShardFromDisk(dataID, index, location)
+	if err != nil {
+		return nil, shardReadError(dataID, index, location, err)
+	}
+	return RetrievabilityProof(shard, nonce), nil
+}
+
+// RetrieveShardRange reads part of a shard from disk, never from the
+// in-memory copy, like ProveRetrievability. The offset is into the shard,
+// past any header.
+func (ims *InMemoryShardStore) RetrieveShardRange(dataID string, index int, location string, offset, length int64) ([]byte, error) {
+	data, err := ims.readShardRange(ims.getShardPath(dataID, index, location), offset, length)
+	if errors.Is(err, os.ErrNotExist) && ims.PathKey != nil {
+		data, err = ims.readShardRange(ims.getPlainShardPath(dataID, index, location), offset, length)
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, shardReadError(dataID, index, location, err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read range %d+%d of shard %d of %s at %s: %w", offset, length, index, dataID, location, err)
+	}
+	return data, nil
+}
+
+// readShardRange reads part of the shard in a shard file, skipping its
+// header.
+func (ims *InMemoryShardStore) readShardRange(path string, offset, length int64) ([]byte, error) {
+	size, err := headerSize(ims.fsys(), path)
+	if err != nil {
+		return nil, err
+	}
+	return readFileRange(ims.fsys(), path, size+offset, length)
+}
+
+// RetrieveShardFrom tries each candidate location in order and returns the
+// first copy of the shard found, along with the location it came from.
+func RetrieveShardFrom(store ShardStore, dataID string, index int, locations []string) ([]byte, string, error) {
+	var errs []error
+	for _, location := range locations {
+		shard, err := store.RetrieveShard(dataID, index, location)
+		if err == nil {
+			return shard, location, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", location, NewShardError("retrieve", dataID, index, location, err)))
+	}
+	if len(errs) == 0 {
+		return nil, "", fmt.Errorf("no location recorded for shard %d", index)
+	}
+	return nil, "", errors.Join(errs...)
 }
@@ -0,0 +1,153 @@
+package sharding
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestInMemoryStoreLogsToItsWriter(t *testing.T) {
+	location := t.TempDir()
+	var log bytes.Buffer
+	store := NewInMemoryShardStore()
+	store.Log = &log
+	if err := store.StoreShard("obj", 0, []byte("shard"), location); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.RetrieveShard("obj", 0, location); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(log.String(), "Stored shard 0") || !strings.Contains(log.String(), "Retrieved shard 0") {
+		t.Fatalf("log = %q", log.String())
+	}
+
+	// Without a writer the store stays silent.
+	quiet := NewInMemoryShardStore()
+	if err := quiet.StoreShard("obj", 1, []byte("shard"), location); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestConcurrentRetrievesOfOneShard is meant for -race: retrieves read the
+// disk without the lock and cache what they read under it.
+func TestConcurrentRetrievesOfOneShard(t *testing.T) {
+	location := t.TempDir()
+	shard := bytes.Repeat([]byte("shard"), 1000)
+	if err := NewInMemoryShardStore().StoreShard("obj", 0, shard, location); err != nil {
+		t.Fatal(err)
+	}
+
+	// A fresh store, so the retrieves race to load the shard from disk
+	store := NewInMemoryShardStore()
+	var wg sync.WaitGroup
+	errs := make(chan error, 64+8)
+	for range 64 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got, err := store.RetrieveShard("obj", 0, location)
+			if err == nil && !bytes.Equal(got, shard) {
+				err = fmt.Errorf("retrieved %d bytes that differ from the %d stored", len(got), len(shard))
+			}
+			if err == nil {
+				// The copy is the caller's to change
+				got[0] ^= 0xff
+			}
+			errs <- err
+		}()
+	}
+	// Stores and deletes of other shards change the store meanwhile
+	for i := 1; i <= 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := store.StoreShard("obj", i, shard, location); err != nil {
+				errs <- err
+				return
+			}
+			errs <- store.DeleteShard("obj", i, location)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, err := store.RetrieveShard("obj", 0, location); err != nil || !bytes.Equal(got, shard) {
+		t.Fatalf("retrieve after the race: %v", err)
+	}
+}
+
+func TestObfuscatedShardNames(t *testing.T) {
+	key, other := []byte("path key"), []byte("other key")
+	name := ObfuscatedShardName(key, "abc123", 0)
+	if name != ObfuscatedShardName(key, "abc123", 0) {
+		t.Fatal("the same shard named differently under one key")
+	}
+	for _, different := range []string{
+		ObfuscatedShardName(key, "abc123", 1),
+		ObfuscatedShardName(key, "abc124", 0),
+		ObfuscatedShardName(other, "abc123", 0),
+	} {
+		if different == name {
+			t.Fatalf("%s names two shards", name)
+		}
+	}
+	if strings.Contains(name, "abc123") {
+		t.Fatalf("%s reveals the dataID", name)
+	}
+
+	// Shards written before the key was set are still found under their
+	// plain names
+	location := t.TempDir()
+	if err := NewInMemoryShardStore().StoreShard("abc123", 0, []byte("shard"), location); err != nil {
+		t.Fatal(err)
+	}
+	keyed := NewInMemoryShardStore()
+	keyed.PathKey = key
+	if got, err := keyed.RetrieveShard("abc123", 0, location); err != nil || string(got) != "shard" {
+		t.Fatalf("RetrieveShard of a plainly named shard: %q, %v", got, err)
+	}
+	if err := keyed.StoreShard("abc123", 1, []byte("shard"), location); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(location, ObfuscatedShardName(key, "abc123", 1))); err != nil {
+		t.Fatalf("keyed store didn't write the obfuscated name: %v", err)
+	}
+}
+
+func TestRetrieveShardFrom(t *testing.T) {
+	dir := t.TempDir()
+	primary, secondary, third := filepath.Join(dir, "primary"), filepath.Join(dir, "secondary"), filepath.Join(dir, "third")
+	store := NewInMemoryShardStore()
+	for _, location := range []string{secondary, third} {
+		if err := store.StoreShard("abc123", 2, []byte("shard "+location), location); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The primary never had the shard; the first candidate holding it wins
+	fresh := NewInMemoryShardStore()
+	shard, from, err := RetrieveShardFrom(fresh, "abc123", 2, []string{primary, secondary, third})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from != secondary || string(shard) != "shard "+secondary {
+		t.Fatalf("retrieved %q from %s, expected the copy at %s", shard, from, secondary)
+	}
+
+	_, _, err = RetrieveShardFrom(fresh, "abc123", 2, []string{primary, filepath.Join(dir, "missing")})
+	if !errors.Is(err, ErrShardNotFound) || !strings.Contains(err.Error(), primary) {
+		t.Fatalf("retrieving from locations without the shard returned %v", err)
+	}
+	if _, _, err := RetrieveShardFrom(fresh, "abc123", 2, nil); err == nil {
+		t.Fatal("retrieved a shard from no locations")
+	}
+}
@@ -0,0 +1,718 @@
+// Package storetest checks that a ShardStore behaves the way the rest of
+// vault relies on. A third-party backend runs it from its own tests:
+//
+//	func TestCompliance(t *testing.T) {
+//		storetest.RunComplianceSuite(t, func() sharding.ShardStore {
+//			return mybackend.New(...)
+//		})
+//	}
+//
+// Locations are temporary directories from t.TempDir. A backend that
+// doesn't store shards on the local filesystem should treat them as opaque
+// names, keeping each one apart from the others.
+//
+// Every store must pass the required tests:
+//
+//	round-trip      a stored shard comes back byte for byte
+//	not-found       a missing shard fails with an error wrapping
+//	                sharding.ErrShardNotFound
+//	overwrite       storing a shard again replaces it, and storing the same
+//	                bytes twice is harmless
+//	binary-safe     all 256 byte values and an empty shard survive
+//	no-aliasing     the store keeps neither the caller's buffer nor the one
+//	                it returned, so either can be reused
+//	isolation       shards differing only in dataID, index or location
+//	                don't overwrite each other
+//	persistence     shards written and closed are read back by a new store
+//	large-shard     a 100 MB shard round-trips; skipped with -short
+//	concurrency     50 goroutines storing and retrieving at once, on their
+//	                own shards and on a shared one, see no torn or lost shard
+//	stress          datastorage.Stress, with a fixed seed, stores random
+//	                objects under random codes and reads them back through
+//	                dropped, corrupted and delayed shards, byte for byte
+//	                within parity and failing with ErrInsufficientShards
+//	                beyond it
+//	close           Close succeeds after use
+//
+// The other tests are optional: each one runs only if sharding.Probe finds
+// its capability, and is skipped otherwise.
+//
+//	exists          HasShard is true for a stored shard and false otherwise
+//	delete          a deleted shard is not found, and deleting a missing
+//	                shard is not an error
+//	atomic-create   CreateShard writes a new shard and fails with
+//	                sharding.ErrShardExists, leaving the shard alone, when
+//	                it is there
+//	checksum        ShardChecksum matches sharding.TransferChecksum, and
+//	                wraps ErrShardNotFound for a missing shard
+//	list            ListShards finds every shard stored at a location
+//	lock            a locked shard can still be read, can be rewritten once
+//	                unlocked, and locking a missing shard wraps
+//	                ErrShardNotFound. Whether a locked shard refuses writes
+//	                depends on privileges (root ignores file modes), so it
+//	                isn't checked
+//	quarantine      a quarantined shard is no longer found, is listed in the
+//	                quarantine area, and is purged from it
+//	compact         shards of objects deleted through another store are no
+//	                longer found once the store is compacted, and the rest
+//	                still are
+//	prove           ProveRetrievability answers with
+//	                sharding.RetrievabilityProof of the stored shard
+//	range           RetrieveShardRange returns exactly the bytes asked for,
+//	                fails for a range past the end of the shard, and wraps
+//	                ErrShardNotFound for a missing shard
+//
+// ShardStore takes no context: cancellation and deadlines are applied by
+// the callers' retries around it, so there is nothing for a store to
+// comply with there.
+package storetest
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/techninja8/getvault.io/pkg/config"
+	"github.com/techninja8/getvault.io/pkg/datastorage"
+	"github.com/techninja8/getvault.io/pkg/erasurecoding"
+	"github.com/techninja8/getvault.io/pkg/sharding"
+)
+
+// largeShardSize is the size of the shard the large-shard test stores.
+const largeShardSize = 100 << 20
+
+// concurrency is how many goroutines the concurrency test runs.
+const concurrency = 50
+
+// stressSeed and stressIterations are the seed of the stress test's first
+// iteration and how many it runs; a failing one is rerun alone with
+// vault stress --seed <seed> --iterations 1.
+const (
+	stressSeed       = 956
+	stressIterations = 40
+)
+
+// RunComplianceSuite runs the compliance tests against stores returned by
+// newStore. Each test opens its own stores and closes them; the
+// persistence test opens a second store on the same locations, so
+// newStore must return stores that see each other's closed writes.
+func RunComplianceSuite(t *testing.T, newStore func() sharding.ShardStore) {
+	t.Helper()
+
+	required := []struct {
+		name string
+		run  func(*testing.T, func() sharding.ShardStore)
+	}{
+		{"round-trip", testRoundTrip},
+		{"not-found", testNotFound},
+		{"overwrite", testOverwrite},
+		{"binary-safe", testBinarySafe},
+		{"no-aliasing", testNoAliasing},
+		{"isolation", testIsolation},
+		{"persistence", testPersistence},
+		{"large-shard", testLargeShard},
+		{"concurrency", testConcurrency},
+		{"stress", testStress},
+		{"close", testClose},
+	}
+	for _, test := range required {
+		t.Run(test.name, func(t *testing.T) { test.run(t, newStore) })
+	}
+
+	optional := []struct {
+		name    string
+		present func(sharding.Capabilities) bool
+		run     func(*testing.T, func() sharding.ShardStore)
+	}{
+		{"exists", func(c sharding.Capabilities) bool { return c.Exists }, testExists},
+		{"delete", func(c sharding.Capabilities) bool { return c.Delete }, testDelete},
+		{"atomic-create", func(c sharding.Capabilities) bool { return c.AtomicCreate }, testAtomicCreate},
+		{"checksum", func(c sharding.Capabilities) bool { return c.Checksum }, testChecksum},
+		{"list", func(c sharding.Capabilities) bool { return c.List }, testList},
+		{"lock", func(c sharding.Capabilities) bool { return c.Lock }, testLock},
+		{"quarantine", func(c sharding.Capabilities) bool { return c.Quarantine }, testQuarantine},
+		{"compact", func(c sharding.Capabilities) bool { return c.Compact }, testCompact},
+		{"prove", func(c sharding.Capabilities) bool { return c.Prove }, testProve},
+		{"range", func(c sharding.Capabilities) bool { return c.Range }, testRange},
+	}
+	for _, test := range optional {
+		t.Run(test.name, func(t *testing.T) {
+			store := newStore()
+			capabilities := sharding.Probe(store)
+			store.Close()
+			if !test.present(capabilities) {
+				t.Skipf("store has no %s capability (it has %s)", test.name, capabilities)
+			}
+			test.run(t, newStore)
+		})
+	}
+}
+
+// open returns a new store that is closed when the test ends.
+func open(t *testing.T, newStore func() sharding.ShardStore) sharding.ShardStore {
+	t.Helper()
+	store := newStore()
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// newDataID returns a dataID no other test uses.
+func newDataID(t *testing.T) string {
+	t.Helper()
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		t.Fatal(err)
+	}
+	return hex.EncodeToString(id)
+}
+
+// randomShard returns size random bytes.
+func randomShard(t *testing.T, size int) []byte {
+	t.Helper()
+	shard := make([]byte, size)
+	if _, err := rand.Read(shard); err != nil {
+		t.Fatal(err)
+	}
+	return shard
+}
+
+func mustStore(t *testing.T, store sharding.ShardStore, dataID string, index int, shard []byte, location string) {
+	t.Helper()
+	if err := store.StoreShard(dataID, index, shard, location); err != nil {
+		t.Fatalf("StoreShard(%s, %d): %v", dataID, index, err)
+	}
+}
+
+// expectShard fails the test unless the shard is stored with the given
+// contents.
+func expectShard(t *testing.T, store sharding.ShardStore, dataID string, index int, location string, want []byte) {
+	t.Helper()
+	got, err := store.RetrieveShard(dataID, index, location)
+	if err != nil {
+		t.Fatalf("RetrieveShard(%s, %d): %v", dataID, index, err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("RetrieveShard(%s, %d) returned %d bytes that differ from the %d stored", dataID, index, len(got), len(want))
+	}
+}
+
+// expectNotFound fails the test unless err wraps sharding.ErrShardNotFound.
+func expectNotFound(t *testing.T, what string, err error) {
+	t.Helper()
+	if !errors.Is(err, sharding.ErrShardNotFound) {
+		t.Fatalf("%s returned %v, expected an error wrapping %v", what, err, sharding.ErrShardNotFound)
+	}
+}
+
+func testRoundTrip(t *testing.T, newStore func() sharding.ShardStore) {
+	store := open(t, newStore)
+	location, dataID := t.TempDir(), newDataID(t)
+	for index, size := range []int{1, 17, 4096, 1 << 20} {
+		shard := randomShard(t, size)
+		mustStore(t, store, dataID, index, shard, location)
+		expectShard(t, store, dataID, index, location, shard)
+	}
+}
+
+func testNotFound(t *testing.T, newStore func() sharding.ShardStore) {
+	store := open(t, newStore)
+	location, dataID := t.TempDir(), newDataID(t)
+	_, err := store.RetrieveShard(dataID, 0, location)
+	expectNotFound(t, "RetrieveShard of a shard never stored", err)
+
+	// Another index of a stored object is still missing
+	mustStore(t, store, dataID, 0, []byte("shard"), location)
+	_, err = store.RetrieveShard(dataID, 1, location)
+	expectNotFound(t, "RetrieveShard of an index never stored", err)
+	_, err = store.RetrieveShard(dataID, 0, t.TempDir())
+	expectNotFound(t, "RetrieveShard at a location it wasn't stored at", err)
+}
+
+func testOverwrite(t *testing.T, newStore func() sharding.ShardStore) {
+	store := open(t, newStore)
+	location, dataID := t.TempDir(), newDataID(t)
+	first, second := randomShard(t, 1000), randomShard(t, 10)
+
+	mustStore(t, store, dataID, 0, first, location)
+	mustStore(t, store, dataID, 0, first, location)
+	expectShard(t, store, dataID, 0, location, first)
+
+	// A shorter shard must not leave the tail of the longer one behind
+	mustStore(t, store, dataID, 0, second, location)
+	expectShard(t, store, dataID, 0, location, second)
+	expectShard(t, open(t, newStore), dataID, 0, location, second)
+}
+
+func testBinarySafe(t *testing.T, newStore func() sharding.ShardStore) {
+	store := open(t, newStore)
+	location, dataID := t.TempDir(), newDataID(t)
+	every := make([]byte, 512)
+	for i := range every {
+		every[i] = byte(i)
+	}
+	shards := [][]byte{
+		every,
+		{},
+		{0},
+		[]byte("\r\n\x00\x1a\xff\xfe"),
+		bytes.Repeat([]byte{0}, 4096),
+	}
+	for index, shard := range shards {
+		mustStore(t, store, dataID, index, shard, location)
+	}
+	fresh := open(t, newStore)
+	for index, shard := range shards {
+		expectShard(t, store, dataID, index, location, shard)
+		expectShard(t, fresh, dataID, index, location, shard)
+	}
+}
+
+func testNoAliasing(t *testing.T, newStore func() sharding.ShardStore) {
+	store := open(t, newStore)
+	location, dataID := t.TempDir(), newDataID(t)
+	shard := randomShard(t, 256)
+	want := bytes.Clone(shard)
+
+	mustStore(t, store, dataID, 0, shard, location)
+	for i := range shard {
+		shard[i] ^= 0xff
+	}
+	expectShard(t, store, dataID, 0, location, want)
+
+	got, err := store.RetrieveShard(dataID, 0, location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range got {
+		got[i] = 0
+	}
+	expectShard(t, store, dataID, 0, location, want)
+}
+
+func testIsolation(t *testing.T, newStore func() sharding.ShardStore) {
+	store := open(t, newStore)
+	locations := []string{t.TempDir(), t.TempDir()}
+	dataIDs := []string{newDataID(t), newDataID(t)}
+	shards := make(map[string][]byte)
+	for _, location := range locations {
+		for _, dataID := range dataIDs {
+			for index := 0; index < 3; index++ {
+				shard := randomShard(t, 64)
+				shards[fmt.Sprint(location, dataID, index)] = shard
+				mustStore(t, store, dataID, index, shard, location)
+			}
+		}
+	}
+	fresh := open(t, newStore)
+	for _, location := range locations {
+		for _, dataID := range dataIDs {
+			for index := 0; index < 3; index++ {
+				want := shards[fmt.Sprint(location, dataID, index)]
+				expectShard(t, store, dataID, index, location, want)
+				expectShard(t, fresh, dataID, index, location, want)
+			}
+		}
+	}
+}
+
+func testPersistence(t *testing.T, newStore func() sharding.ShardStore) {
+	location, dataID := t.TempDir(), newDataID(t)
+	shard := randomShard(t, 4096)
+
+	writer := newStore()
+	mustStore(t, writer, dataID, 0, shard, location)
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	expectShard(t, open(t, newStore), dataID, 0, location, shard)
+}
+
+func testLargeShard(t *testing.T, newStore func() sharding.ShardStore) {
+	if testing.Short() {
+		t.Skip("skipping the 100 MB shard in short mode")
+	}
+	store := open(t, newStore)
+	location, dataID := t.TempDir(), newDataID(t)
+	shard := randomShard(t, largeShardSize)
+	want := sha256.Sum256(shard)
+
+	mustStore(t, store, dataID, 0, shard, location)
+	shard = nil
+	for _, reader := range []sharding.ShardStore{store, open(t, newStore)} {
+		got, err := reader.RetrieveShard(dataID, 0, location)
+		if err != nil {
+			t.Fatalf("RetrieveShard: %v", err)
+		}
+		if len(got) != largeShardSize || sha256.Sum256(got) != want {
+			t.Fatalf("retrieved %d bytes that differ from the %d stored", len(got), largeShardSize)
+		}
+	}
+}
+
+func testStress(t *testing.T, newStore func() sharding.ShardStore) {
+	dir := t.TempDir()
+	locations := make([]string, erasurecoding.DataShards+erasurecoding.ParityShards)
+	for i := range locations {
+		locations[i] = t.TempDir()
+	}
+	cfg := &config.Config{
+		MaxConcurrency:       4,
+		MaxInFlightBytes:     64 << 20,
+		ShardRetryAttempts:   1,
+		MaxRetriesPerOp:      10,
+		MetadataNameTemplate: config.DefaultMetadataNameTemplate,
+		MetadataExt:          config.DefaultMetadataExt,
+		HealthFile:           filepath.Join(dir, "health.json"),
+	}
+	opts := datastorage.StressOptions{Iterations: stressIterations, Seed: stressSeed, MaxSize: 64 << 10, MaxDelay: time.Millisecond}
+	result, err := datastorage.Stress(newStore, locations, opts, cfg, zap.NewNop())
+	if err != nil {
+		t.Fatalf("Stress: %v", err)
+	}
+	for _, failure := range result.Failures {
+		t.Errorf("seed %d: %d bytes, %s, %s, faults %s: %s", failure.Seed, failure.Size, failure.Code, failure.Layout, failure.Faults, failure.Problem)
+	}
+	if result.Recoverable == 0 || result.Unrecoverable == 0 {
+		t.Fatalf("%d iterations within parity and %d beyond, expected some of both", result.Recoverable, result.Unrecoverable)
+	}
+}
+
+func testConcurrency(t *testing.T, newStore func() sharding.ShardStore) {
+	store := open(t, newStore)
+	location, dataID, shared := t.TempDir(), newDataID(t), newDataID(t)
+
+	// Every version of the shared shard is one byte value repeated, so a
+	// torn write shows up as a mix of values
+	size := 64 << 10
+	var wg sync.WaitGroup
+	errs := make(chan error, 3*concurrency)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			own := bytes.Repeat([]byte{byte(i)}, size+i)
+			if err := store.StoreShard(dataID, i, own, location); err != nil {
+				errs <- fmt.Errorf("StoreShard(%d): %w", i, err)
+				return
+			}
+			if err := store.StoreShard(shared, 0, bytes.Repeat([]byte{byte(i)}, size), location); err != nil {
+				errs <- fmt.Errorf("StoreShard of the shared shard: %w", err)
+			}
+			got, err := store.RetrieveShard(dataID, i, location)
+			if err != nil {
+				errs <- fmt.Errorf("RetrieveShard(%d): %w", i, err)
+			} else if !bytes.Equal(got, own) {
+				errs <- fmt.Errorf("RetrieveShard(%d) returned another goroutine's shard", i)
+			}
+			if got, err := store.RetrieveShard(shared, 0, location); err == nil && !uniform(got, size) {
+				errs <- errors.New("the shared shard was torn by concurrent writes")
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	got, err := open(t, newStore).RetrieveShard(shared, 0, location)
+	if err != nil {
+		t.Fatalf("RetrieveShard of the shared shard: %v", err)
+	}
+	if !uniform(got, size) {
+		t.Fatal("the shared shard was torn by concurrent writes")
+	}
+}
+
+// uniform reports whether shard is size bytes of one value.
+func uniform(shard []byte, size int) bool {
+	return len(shard) == size && bytes.Count(shard, shard[:1]) == size
+}
+
+func testClose(t *testing.T, newStore func() sharding.ShardStore) {
+	store := newStore()
+	mustStore(t, store, newDataID(t), 0, []byte("shard"), t.TempDir())
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
+
+func testExists(t *testing.T, newStore func() sharding.ShardStore) {
+	store := open(t, newStore)
+	exister := store.(sharding.ShardExister)
+	location, dataID := t.TempDir(), newDataID(t)
+
+	if exists, err := exister.HasShard(dataID, 0, location); err != nil || exists {
+		t.Fatalf("HasShard of a shard never stored returned %v, %v", exists, err)
+	}
+	mustStore(t, store, dataID, 0, []byte("shard"), location)
+	if exists, err := exister.HasShard(dataID, 0, location); err != nil || !exists {
+		t.Fatalf("HasShard of a stored shard returned %v, %v", exists, err)
+	}
+	if exists, err := exister.HasShard(dataID, 1, location); err != nil || exists {
+		t.Fatalf("HasShard of an index never stored returned %v, %v", exists, err)
+	}
+}
+
+func testDelete(t *testing.T, newStore func() sharding.ShardStore) {
+	store := open(t, newStore)
+	location, dataID := t.TempDir(), newDataID(t)
+	mustStore(t, store, dataID, 0, []byte("shard"), location)
+	mustStore(t, store, dataID, 1, []byte("other"), location)
+
+	if err := sharding.DeleteShard(store, dataID, 0, location); err != nil {
+		t.Fatalf("DeleteShard: %v", err)
+	}
+	_, err := store.RetrieveShard(dataID, 0, location)
+	expectNotFound(t, "RetrieveShard of a deleted shard", err)
+	_, err = open(t, newStore).RetrieveShard(dataID, 0, location)
+	expectNotFound(t, "RetrieveShard of a deleted shard from a new store", err)
+	expectShard(t, store, dataID, 1, location, []byte("other"))
+
+	if err := sharding.DeleteShard(store, dataID, 0, location); err != nil {
+		t.Fatalf("DeleteShard of a missing shard: %v", err)
+	}
+}
+
+func testAtomicCreate(t *testing.T, newStore func() sharding.ShardStore) {
+	store := open(t, newStore)
+	creator := store.(sharding.ShardCreator)
+	location, dataID := t.TempDir(), newDataID(t)
+
+	if err := creator.CreateShard(dataID, 0, []byte("first"), location); err != nil {
+		t.Fatalf("CreateShard of a new shard: %v", err)
+	}
+	err := creator.CreateShard(dataID, 0, []byte("second"), location)
+	if !errors.Is(err, sharding.ErrShardExists) {
+		t.Fatalf("CreateShard of an existing shard returned %v, expected an error wrapping %v", err, sharding.ErrShardExists)
+	}
+	expectShard(t, store, dataID, 0, location, []byte("first"))
+	expectShard(t, open(t, newStore), dataID, 0, location, []byte("first"))
+
+	// Of many racing creators exactly one wins
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	won := 0
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := creator.CreateShard(dataID, 1, []byte{byte(i)}, location)
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				won++
+			case !errors.Is(err, sharding.ErrShardExists):
+				t.Errorf("racing CreateShard returned %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if won != 1 {
+		t.Fatalf("%d of %d racing CreateShard calls succeeded, expected 1", won, concurrency)
+	}
+}
+
+func testChecksum(t *testing.T, newStore func() sharding.ShardStore) {
+	store := open(t, newStore)
+	checksummer := store.(sharding.ShardChecksummer)
+	location, dataID := t.TempDir(), newDataID(t)
+	shard := randomShard(t, 4096)
+	mustStore(t, store, dataID, 0, shard, location)
+
+	checksum, err := checksummer.ShardChecksum(dataID, 0, location)
+	if err != nil {
+		t.Fatalf("ShardChecksum: %v", err)
+	}
+	if want := sharding.TransferChecksum(shard); checksum != want {
+		t.Fatalf("ShardChecksum returned %s, expected %s", checksum, want)
+	}
+	_, err = checksummer.ShardChecksum(dataID, 1, location)
+	expectNotFound(t, "ShardChecksum of a missing shard", err)
+}
+
+func testList(t *testing.T, newStore func() sharding.ShardStore) {
+	store := open(t, newStore)
+	lister := store.(sharding.ShardLister)
+	location, dataID := t.TempDir(), newDataID(t)
+	const stored = 5
+	for index := 0; index < stored; index++ {
+		mustStore(t, store, dataID, index, []byte("shard"), location)
+	}
+
+	refs, err := lister.ListShards(location)
+	if err != nil {
+		t.Fatalf("ListShards: %v", err)
+	}
+	// Obfuscated names can't be traced back, so they are only counted
+	found := make(map[int]bool)
+	opaque := 0
+	for _, ref := range refs {
+		switch {
+		case ref.Index == -1:
+			opaque++
+		case ref.DataID == dataID:
+			found[ref.Index] = true
+		}
+	}
+	if len(found)+opaque < stored {
+		t.Fatalf("ListShards found %d of the %d shards stored", len(found)+opaque, stored)
+	}
+	for index := 0; index < stored && opaque == 0; index++ {
+		if !found[index] {
+			t.Fatalf("ListShards didn't list shard %d", index)
+		}
+	}
+	if refs, err := lister.ListShards(t.TempDir()); err != nil || len(refs) != 0 {
+		t.Fatalf("ListShards of an empty location returned %v, %v", refs, err)
+	}
+}
+
+func testLock(t *testing.T, newStore func() sharding.ShardStore) {
+	store := open(t, newStore)
+	locker := store.(sharding.ShardLocker)
+	location, dataID := t.TempDir(), newDataID(t)
+	mustStore(t, store, dataID, 0, []byte("shard"), location)
+
+	if err := locker.LockShard(dataID, 0, location); err != nil {
+		t.Fatalf("LockShard: %v", err)
+	}
+	// Unlock even if the test fails, so t.TempDir can remove the shard
+	unlocked := false
+	t.Cleanup(func() {
+		if !unlocked {
+			locker.UnlockShard(dataID, 0, location)
+		}
+	})
+	expectShard(t, open(t, newStore), dataID, 0, location, []byte("shard"))
+
+	if err := locker.UnlockShard(dataID, 0, location); err != nil {
+		t.Fatalf("UnlockShard: %v", err)
+	}
+	unlocked = true
+	mustStore(t, store, dataID, 0, []byte("rewritten"), location)
+	expectShard(t, open(t, newStore), dataID, 0, location, []byte("rewritten"))
+
+	expectNotFound(t, "LockShard of a missing shard", locker.LockShard(dataID, 1, location))
+}
+
+func testQuarantine(t *testing.T, newStore func() sharding.ShardStore) {
+	store := open(t, newStore)
+	quarantiner := store.(sharding.ShardQuarantiner)
+	location, dataID := t.TempDir(), newDataID(t)
+	mustStore(t, store, dataID, 0, []byte("corrupt"), location)
+
+	name, err := quarantiner.QuarantineShard(dataID, 0, location)
+	if err != nil {
+		t.Fatalf("QuarantineShard: %v", err)
+	}
+	_, err = store.RetrieveShard(dataID, 0, location)
+	expectNotFound(t, "RetrieveShard of a quarantined shard", err)
+
+	shards, err := quarantiner.ListQuarantine(location)
+	if err != nil {
+		t.Fatalf("ListQuarantine: %v", err)
+	}
+	if len(shards) != 1 || shards[0].Name != name || shards[0].DataID != dataID || shards[0].Index != 0 {
+		t.Fatalf("ListQuarantine returned %+v, expected %s", shards, name)
+	}
+
+	if purged, err := quarantiner.PurgeQuarantine(location, shards[0].Time); err != nil || purged != 0 {
+		t.Fatalf("PurgeQuarantine before the shard was quarantined returned %d, %v", purged, err)
+	}
+	if purged, err := quarantiner.PurgeQuarantine(location, time.Now().Add(time.Hour)); err != nil || purged != 1 {
+		t.Fatalf("PurgeQuarantine returned %d, %v, expected 1 shard purged", purged, err)
+	}
+	if shards, err := quarantiner.ListQuarantine(location); err != nil || len(shards) != 0 {
+		t.Fatalf("ListQuarantine after purging returned %+v, %v", shards, err)
+	}
+}
+
+func testCompact(t *testing.T, newStore func() sharding.ShardStore) {
+	store := open(t, newStore)
+	compacter := store.(sharding.ShardCompacter)
+	location := t.TempDir()
+	dataIDs := []string{newDataID(t), newDataID(t), newDataID(t)}
+	for _, dataID := range dataIDs {
+		for index := range 2 {
+			mustStore(t, store, dataID, index, []byte(dataID), location)
+			expectShard(t, store, dataID, index, location, []byte(dataID))
+		}
+	}
+
+	other := open(t, newStore)
+	if !sharding.Probe(other).Delete {
+		t.Skip("store has no delete capability to delete shards through")
+	}
+	for _, dataID := range dataIDs[:2] {
+		for index := range 2 {
+			if err := sharding.DeleteShard(other, dataID, index, location); err != nil {
+				t.Fatalf("DeleteShard: %v", err)
+			}
+		}
+	}
+	if _, err := compacter.Compact([]string{location}); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+	for _, dataID := range dataIDs[:2] {
+		for index := range 2 {
+			_, err := store.RetrieveShard(dataID, index, location)
+			expectNotFound(t, "RetrieveShard of a shard deleted before compaction", err)
+		}
+	}
+	for index := range 2 {
+		expectShard(t, store, dataIDs[2], index, location, []byte(dataIDs[2]))
+	}
+}
+
+func testProve(t *testing.T, newStore func() sharding.ShardStore) {
+	store := open(t, newStore)
+	prover := store.(sharding.RetrievabilityProver)
+	location, dataID := t.TempDir(), newDataID(t)
+	shard, nonce := randomShard(t, 4096), randomShard(t, 32)
+	mustStore(t, store, dataID, 0, shard, location)
+
+	proof, err := prover.ProveRetrievability(dataID, 0, location, nonce)
+	if err != nil {
+		t.Fatalf("ProveRetrievability: %v", err)
+	}
+	if !bytes.Equal(proof, sharding.RetrievabilityProof(shard, nonce)) {
+		t.Fatal("ProveRetrievability returned the wrong proof")
+	}
+	if _, err := prover.ProveRetrievability(dataID, 1, location, nonce); err == nil {
+		t.Fatal("ProveRetrievability of a missing shard succeeded")
+	}
+}
+
+func testRange(t *testing.T, newStore func() sharding.ShardStore) {
+	store := open(t, newStore)
+	reader := store.(sharding.ShardRangeReader)
+	location, dataID := t.TempDir(), newDataID(t)
+	shard := randomShard(t, 4096)
+	mustStore(t, store, dataID, 0, shard, location)
+
+	for _, r := range []struct{ offset, length int64 }{{0, 4096}, {0, 1}, {1000, 96}, {4095, 1}, {4096, 0}} {
+		got, err := reader.RetrieveShardRange(dataID, 0, location, r.offset, r.length)
+		if err != nil {
+			t.Fatalf("RetrieveShardRange %d+%d: %v", r.offset, r.length, err)
+		}
+		if !bytes.Equal(got, shard[r.offset:r.offset+r.length]) {
+			t.Fatalf("RetrieveShardRange %d+%d returned the wrong bytes", r.offset, r.length)
+		}
+	}
+	if _, err := reader.RetrieveShardRange(dataID, 0, location, 4000, 200); err == nil {
+		t.Fatal("RetrieveShardRange past the end of the shard succeeded")
+	}
+	_, err := reader.RetrieveShardRange(dataID, 1, location, 0, 1)
+	expectNotFound(t, "RetrieveShardRange of a missing shard", err)
+}
@@ -0,0 +1,78 @@
+package storetest_test
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/techninja8/getvault.io/pkg/sharding"
+	"github.com/techninja8/getvault.io/pkg/sharding/storetest"
+)
+
+// The stores vault itself ships are held to the same suite as third-party
+// backends.
+
+func TestInMemoryShardStore(t *testing.T) {
+	storetest.RunComplianceSuite(t, func() sharding.ShardStore {
+		return sharding.NewInMemoryShardStore()
+	})
+}
+
+// TestFilesystemShardStore names shard files by an HMAC of the dataID, the
+// layout a configured SHARD_PATH_KEY gives on disk.
+func TestFilesystemShardStore(t *testing.T) {
+	key := []byte("storetest path key")
+	storetest.RunComplianceSuite(t, func() sharding.ShardStore {
+		store := sharding.NewInMemoryShardStore()
+		store.PathKey = key
+		return store
+	})
+}
+
+// TestHeaderShardStore writes a shard header in front of every shard
+// file, as SHARD_HEADERS does.
+func TestHeaderShardStore(t *testing.T) {
+	storetest.RunComplianceSuite(t, func() sharding.ShardStore {
+		store := sharding.NewInMemoryShardStore()
+		store.Headers = true
+		return store
+	})
+}
+
+// TestMemFSShardStore keeps shard files in memory: the store works over
+// any ShardFS as it does over the real filesystem.
+func TestMemFSShardStore(t *testing.T) {
+	fsys := tempDirFS{sharding.NewMemFS()}
+	storetest.RunComplianceSuite(t, func() sharding.ShardStore {
+		store := sharding.NewInMemoryShardStore()
+		store.FS = fsys
+		return store
+	})
+}
+
+// tempDirFS is a MemFS in which the suite's locations, made by t.TempDir
+// on the real filesystem, are there and empty.
+type tempDirFS struct {
+	*sharding.MemFS
+}
+
+func (f tempDirFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := f.MemFS.ReadDir(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		if info, statErr := os.Stat(name); statErr == nil && info.IsDir() {
+			return nil, nil
+		}
+	}
+	return entries, err
+}
+
+// TestHealthTrackingStore runs the suite through the wrapper the commands
+// put around every store.
+func TestHealthTrackingStore(t *testing.T) {
+	health := filepath.Join(t.TempDir(), "health.json")
+	storetest.RunComplianceSuite(t, func() sharding.ShardStore {
+		return &sharding.HealthTrackingStore{ShardStore: sharding.NewInMemoryShardStore(), Health: sharding.NewHealthTracker(health)}
+	})
+}
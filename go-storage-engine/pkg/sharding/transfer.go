@@ -0,0 +1,30 @@
+package sharding
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+// ErrTransferIntegrity is returned by remote stores when a shard doesn't
+// match its checksum after crossing the network. It is retried like any
+// other failed transfer.
+var ErrTransferIntegrity = errors.New("shard transfer integrity check failed")
+
+// TransferChecksum returns the checksum sent with a shard to a remote
+// store: the base64 sha256 of the shard, the form S3 takes as
+// ChecksumSHA256.
+func TransferChecksum(shard []byte) string {
+	sum := sha256.Sum256(shard)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// VerifyTransfer checks a shard received from a remote store against the
+// checksum the store reported for it.
+func VerifyTransfer(shard []byte, checksum string) error {
+	if got := TransferChecksum(shard); got != checksum {
+		return fmt.Errorf("%w: got sha256 %s, expected %s", ErrTransferIntegrity, got, checksum)
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package sharding
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestVerifyTransferDetectsCorruption(t *testing.T) {
+	shard := []byte("a shard crossing the network")
+	checksum := TransferChecksum(shard)
+	if err := VerifyTransfer(shard, checksum); err != nil {
+		t.Fatalf("VerifyTransfer of an intact shard: %v", err)
+	}
+	for i := range shard {
+		corrupt := append([]byte(nil), shard...)
+		corrupt[i] ^= 0x01
+		err := VerifyTransfer(corrupt, checksum)
+		if !errors.Is(err, ErrTransferIntegrity) {
+			t.Fatalf("VerifyTransfer with byte %d flipped returned %v, expected %v", i, err, ErrTransferIntegrity)
+		}
+		if !Retryable(NewShardError("retrieve", "id", 0, "/loc", err)) {
+			t.Fatalf("a corrupted transfer isn't retryable")
+		}
+	}
+	if err := VerifyTransfer(shard[:len(shard)-1], checksum); !errors.Is(err, ErrTransferIntegrity) {
+		t.Fatalf("VerifyTransfer of a truncated shard returned %v, expected %v", err, ErrTransferIntegrity)
+	}
+}
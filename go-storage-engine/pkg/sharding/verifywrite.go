@@ -0,0 +1,173 @@
+package sharding
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrWriteUnconfirmed is returned by a VerifyingStore for a shard that
+// doesn't read back as it was written, or can't be read back at all.
+var ErrWriteUnconfirmed = errors.New("shard write not confirmed by reading it back")
+
+// VerifyingStore reads every shard it writes back as soon as the wrapped
+// store reports it written, and fails the write if what comes back doesn't
+// match, catching disks that fail silently and misconfigured mounts. The
+// shard is checksummed where it is stored when the store can, since a
+// store's cache would only return what it was given; otherwise it is
+// fetched. Everything else passes straight through.
+type VerifyingStore struct {
+	ShardStore
+}
+
+// VerifyWrites returns the middleware of the verify-writes layer.
+func VerifyWrites() Middleware {
+	return func(store ShardStore) ShardStore {
+		return &VerifyingStore{ShardStore: store}
+	}
+}
+
+// readBack checks that the shard at location is shard.
+func (s *VerifyingStore) readBack(dataID string, index int, shard []byte, location string) error {
+	checksum, err := ShardChecksum(s.ShardStore, dataID, index, location)
+	if err != nil {
+		return fmt.Errorf("%w: shard %d of %s at %s: %v", ErrWriteUnconfirmed, index, dataID, location, err)
+	}
+	if want := TransferChecksum(shard); checksum != want {
+		return fmt.Errorf("%w: shard %d of %s at %s reads back with sha256 %s, %s was written", ErrWriteUnconfirmed, index, dataID, location, checksum, want)
+	}
+	return nil
+}
+
+func (s *VerifyingStore) StoreShard(dataID string, index int, shard []byte, location string) error {
+	if err := s.ShardStore.StoreShard(dataID, index, shard, location); err != nil {
+		return err
+	}
+	return s.readBack(dataID, index, shard, location)
+}
+
+// CreateShard passes atomic creates on to the wrapped store and reads the
+// shard back once created.
+func (s *VerifyingStore) CreateShard(dataID string, index int, shard []byte, location string) error {
+	creator, ok := s.ShardStore.(ShardCreator)
+	if !ok {
+		return fmt.Errorf("%T can't create shards atomically: %w", s.ShardStore, errors.ErrUnsupported)
+	}
+	if err := creator.CreateShard(dataID, index, shard, location); err != nil {
+		return err
+	}
+	return s.readBack(dataID, index, shard, location)
+}
+
+// ProveRetrievability passes challenges on to the wrapped store.
+func (s *VerifyingStore) ProveRetrievability(dataID string, index int, location string, nonce []byte) ([]byte, error) {
+	prover, ok := s.ShardStore.(RetrievabilityProver)
+	if !ok {
+		return nil, fmt.Errorf("%T can't prove retrievability: %w", s.ShardStore, errors.ErrUnsupported)
+	}
+	return prover.ProveRetrievability(dataID, index, location, nonce)
+}
+
+// DeleteShard passes deletions on to the wrapped store.
+func (s *VerifyingStore) DeleteShard(dataID string, index int, location string) error {
+	deleter, ok := s.ShardStore.(ShardDeleter)
+	if !ok {
+		return fmt.Errorf("%T can't delete shards: %w", s.ShardStore, errors.ErrUnsupported)
+	}
+	return deleter.DeleteShard(dataID, index, location)
+}
+
+// HasShard passes existence checks on to the wrapped store.
+func (s *VerifyingStore) HasShard(dataID string, index int, location string) (bool, error) {
+	exister, ok := s.ShardStore.(ShardExister)
+	if !ok {
+		return false, fmt.Errorf("%T can't check for shards: %w", s.ShardStore, errors.ErrUnsupported)
+	}
+	return exister.HasShard(dataID, index, location)
+}
+
+// ShardChecksum passes checksum requests on to the wrapped store.
+func (s *VerifyingStore) ShardChecksum(dataID string, index int, location string) (string, error) {
+	checksummer, ok := s.ShardStore.(ShardChecksummer)
+	if !ok {
+		return "", fmt.Errorf("%T can't checksum shards: %w", s.ShardStore, errors.ErrUnsupported)
+	}
+	return checksummer.ShardChecksum(dataID, index, location)
+}
+
+func (s *VerifyingStore) RetrieveShardRange(dataID string, index int, location string, offset, length int64) ([]byte, error) {
+	reader, ok := s.ShardStore.(ShardRangeReader)
+	if !ok {
+		return nil, fmt.Errorf("%T can't read shard ranges: %w", s.ShardStore, errors.ErrUnsupported)
+	}
+	return reader.RetrieveShardRange(dataID, index, location, offset, length)
+}
+
+// ListShards passes listings on to the wrapped store.
+func (s *VerifyingStore) ListShards(location string) ([]ShardRef, error) {
+	lister, ok := s.ShardStore.(ShardLister)
+	if !ok {
+		return nil, fmt.Errorf("%T can't list shards: %w", s.ShardStore, errors.ErrUnsupported)
+	}
+	return lister.ListShards(location)
+}
+
+// LockShard passes locks on to the wrapped store.
+func (s *VerifyingStore) LockShard(dataID string, index int, location string) error {
+	locker, ok := s.ShardStore.(ShardLocker)
+	if !ok {
+		return fmt.Errorf("%T can't lock shards: %w", s.ShardStore, errors.ErrUnsupported)
+	}
+	return locker.LockShard(dataID, index, location)
+}
+
+// UnlockShard passes unlocks on to the wrapped store.
+func (s *VerifyingStore) UnlockShard(dataID string, index int, location string) error {
+	locker, ok := s.ShardStore.(ShardLocker)
+	if !ok {
+		return fmt.Errorf("%T can't lock shards: %w", s.ShardStore, errors.ErrUnsupported)
+	}
+	return locker.UnlockShard(dataID, index, location)
+}
+
+// QuarantineShard passes quarantines on to the wrapped store.
+func (s *VerifyingStore) QuarantineShard(dataID string, index int, location string) (string, error) {
+	quarantiner, ok := s.ShardStore.(ShardQuarantiner)
+	if !ok {
+		return "", fmt.Errorf("%T can't quarantine shards: %w", s.ShardStore, errors.ErrUnsupported)
+	}
+	return quarantiner.QuarantineShard(dataID, index, location)
+}
+
+// ListQuarantine passes quarantine listings on to the wrapped store.
+func (s *VerifyingStore) ListQuarantine(location string) ([]QuarantinedShard, error) {
+	quarantiner, ok := s.ShardStore.(ShardQuarantiner)
+	if !ok {
+		return nil, fmt.Errorf("%T can't quarantine shards: %w", s.ShardStore, errors.ErrUnsupported)
+	}
+	return quarantiner.ListQuarantine(location)
+}
+
+// PurgeQuarantine passes quarantine purges on to the wrapped store.
+func (s *VerifyingStore) PurgeQuarantine(location string, before time.Time) (int, error) {
+	quarantiner, ok := s.ShardStore.(ShardQuarantiner)
+	if !ok {
+		return 0, fmt.Errorf("%T can't quarantine shards: %w", s.ShardStore, errors.ErrUnsupported)
+	}
+	return quarantiner.PurgeQuarantine(location, before)
+}
+
+// Compact passes compactions on to the wrapped store.
+func (s *VerifyingStore) Compact(locations []string) (CompactReport, error) {
+	compacter, ok := s.ShardStore.(ShardCompacter)
+	if !ok {
+		return CompactReport{}, fmt.Errorf("%T can't compact: %w", s.ShardStore, errors.ErrUnsupported)
+	}
+	return compacter.Compact(locations)
+}
+
+// Unwrap returns the wrapped store, whose capabilities are the ones Probe
+// reports.
+func (s *VerifyingStore) Unwrap() ShardStore {
+	return s.ShardStore
+}
@@ -0,0 +1,50 @@
+package sharding
+
+import (
+	"errors"
+	"testing"
+)
+
+// lyingStore reports every write as done but reads shards back wrong, or
+// with drop, doesn't write them at all.
+type lyingStore struct {
+	ShardStore
+	drop bool
+}
+
+func (s *lyingStore) StoreShard(dataID string, index int, shard []byte, location string) error {
+	if s.drop {
+		return nil
+	}
+	return s.ShardStore.StoreShard(dataID, index, shard, location)
+}
+
+func (s *lyingStore) RetrieveShard(dataID string, index int, location string) ([]byte, error) {
+	shard, err := s.ShardStore.RetrieveShard(dataID, index, location)
+	if err == nil && len(shard) > 0 {
+		shard[0] ^= 1
+	}
+	return shard, err
+}
+
+func TestVerifyWritesCatchesBadReadBack(t *testing.T) {
+	location := t.TempDir()
+	store := VerifyWrites()(NewInMemoryShardStore())
+	if err := store.StoreShard("data", 0, []byte("shard"), location); err != nil {
+		t.Fatalf("write to a sound store: %v", err)
+	}
+	if err := CreateShard(store, "data", 1, []byte("shard"), location); err != nil {
+		t.Fatalf("create on a sound store: %v", err)
+	}
+
+	for _, drop := range []bool{false, true} {
+		store := VerifyWrites()(&lyingStore{ShardStore: NewInMemoryShardStore(), drop: drop})
+		err := store.StoreShard("data", 0, []byte("shard"), location)
+		if !errors.Is(err, ErrWriteUnconfirmed) {
+			t.Fatalf("drop %t: write that doesn't read back reported as %v", drop, err)
+		}
+		if category := Classify(err); category != CategoryIntegrity || !category.LocationFault() || !Retryable(err) {
+			t.Fatalf("drop %t: unconfirmed write classified as %s", drop, category)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package sharding
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// ZoneLabel is the storage location label naming the zone a location is
+// in, such as a site or an availability zone. Locations in one zone are
+// expected to fail together.
+const ZoneLabel = "zone"
+
+// ErrZonePlacement is returned for a placement that losing a single zone
+// could leave with too few shards to recover an object.
+var ErrZonePlacement = errors.New("shards not spread over zones to survive the loss of one")
+
+// ZoneCheck is how the shards of an object are spread over zones.
+type ZoneCheck struct {
+	Shards map[string]int `json:"shards"` // Shards in each labelled zone
+	// The zone holding the most shards, and how many
+	MaxZone   string `json:"max_zone,omitempty"`
+	MaxShards int    `json:"max_shards"`
+	Parity    int    `json:"parity"`
+	// Shards on locations without a zone label, such as those of objects
+	// stored before the labels were added
+	Unlabeled int `json:"unlabeled,omitempty"`
+}
+
+// OK reports whether losing any one zone leaves enough shards to recover
+// the object: no zone holds more than parity shards, and every shard is in
+// a known zone.
+func (c ZoneCheck) OK() bool {
+	return c.Unlabeled == 0 && c.MaxShards <= c.Parity
+}
+
+// Err returns why the placement isn't OK, wrapping ErrZonePlacement, or
+// nil if it is.
+func (c ZoneCheck) Err() error {
+	switch {
+	case c.MaxShards > c.Parity:
+		return fmt.Errorf("%w: zone %q holds %d shards, only %d may be lost", ErrZonePlacement, c.MaxZone, c.MaxShards, c.Parity)
+	case c.Unlabeled > 0:
+		return fmt.Errorf("%w: %d shards are on locations without a %q label", ErrZonePlacement, c.Unlabeled, ZoneLabel)
+	}
+	return nil
+}
+
+// CheckZones checks the placement of an object whose shard i is in zone
+// zones[i], "" for a location without a zone label, against a code of
+// parity parity shards.
+func CheckZones(zones []string, parity int) ZoneCheck {
+	check := ZoneCheck{Shards: make(map[string]int), Parity: parity}
+	for _, zone := range zones {
+		if zone == "" {
+			check.Unlabeled++
+			continue
+		}
+		check.Shards[zone]++
+	}
+	for zone, n := range check.Shards {
+		if n > check.MaxShards || n == check.MaxShards && zone < check.MaxZone {
+			check.MaxZone, check.MaxShards = zone, n
+		}
+	}
+	return check
+}
+
+// PlaceInZones is Place spreading the picked locations as evenly over the
+// zones of the pool as it allows, zones mapping locations to their zone.
+// Each pick goes to the healthiest location left in a zone holding the
+// fewest picks so far, so health only decides between locations once the
+// zones are balanced, and the most any zone holds is as low as the pool
+// allows. Locations missing from zones count as one zone of their own;
+// with no zones at all this is Place.
+func (t *HealthTracker) PlaceInZones(pool []string, zones map[string]string, n int) ([]string, error) {
+	if len(pool) < n {
+		return nil, fmt.Errorf("need %d locations, have %d", n, len(pool))
+	}
+	order := make([]int, len(pool))
+	scores := make([]float64, len(pool))
+	for i, location := range pool {
+		order[i] = i
+		scores[i] = t.Score(location)
+	}
+	sort.SliceStable(order, func(a, b int) bool { return scores[order[a]] > scores[order[b]] })
+
+	picked := make([]int, 0, n)
+	taken := make([]bool, len(pool))
+	counts := make(map[string]int)
+	for len(picked) < n {
+		best := -1
+		for _, idx := range order {
+			if !taken[idx] && (best < 0 || counts[zones[pool[idx]]] < counts[zones[pool[best]]]) {
+				best = idx
+			}
+		}
+		taken[best] = true
+		counts[zones[pool[best]]]++
+		picked = append(picked, best)
+	}
+	sort.Ints(picked)
+
+	placed := make([]string, n)
+	for i, idx := range picked {
+		placed[i] = pool[idx]
+	}
+	return placed, nil
+}
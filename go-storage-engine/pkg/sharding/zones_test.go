@@ -0,0 +1,72 @@
+package sharding
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestPlaceInZones(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		zones        []int // Locations in each zone
+		data, parity int
+		maxShards    int
+	}{
+		{"3 zones", []int{4, 3, 3}, 4, 2, 2},
+		{"3 zones, one small", []int{6, 1, 1}, 4, 2, 4},
+		{"2 zones", []int{5, 5}, 4, 4, 4},
+		{"2 zones, too few parity", []int{5, 5}, 4, 2, 3},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tracker := NewHealthTracker(filepath.Join(t.TempDir(), "health.json"))
+			var pool []string
+			zones := make(map[string]string)
+			for z, n := range tc.zones {
+				for i := range n {
+					location := fmt.Sprintf("/zone%d/loc%d", z, i)
+					pool = append(pool, location)
+					zones[location] = fmt.Sprintf("zone%d", z)
+					// The first zone is the healthiest, so health alone would fill it
+					if z > 0 {
+						tracker.Record(location, 0, errTestFault)
+					}
+				}
+			}
+			placed, err := tracker.PlaceInZones(pool, zones, tc.data+tc.parity)
+			if err != nil {
+				t.Fatal(err)
+			}
+			placedZones := make([]string, len(placed))
+			for i, location := range placed {
+				placedZones[i] = zones[location]
+			}
+			check := CheckZones(placedZones, tc.parity)
+			if check.MaxShards != tc.maxShards {
+				t.Fatalf("placed %v, %d in one zone, expected %d", check.Shards, check.MaxShards, tc.maxShards)
+			}
+			if satisfiable := tc.maxShards <= tc.parity; check.OK() != satisfiable || (check.Err() == nil) != satisfiable {
+				t.Fatalf("placed %v with %d parity shards: OK %t, %v", check.Shards, tc.parity, check.OK(), check.Err())
+			}
+		})
+	}
+}
+
+func TestCheckZonesFlagsUnlabeledShards(t *testing.T) {
+	check := CheckZones([]string{"a", "b", "", "c"}, 2)
+	if check.Unlabeled != 1 || check.OK() || check.Err() == nil {
+		t.Fatalf("shard without a zone not flagged: %+v", check)
+	}
+}
+
+func TestPlaceWithoutZonesPrefersHealth(t *testing.T) {
+	tracker := NewHealthTracker(filepath.Join(t.TempDir(), "health.json"))
+	tracker.Record("/b", 0, errTestFault)
+	placed, err := tracker.Place([]string{"/a", "/b", "/c"}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(placed) != "[/a /c]" {
+		t.Fatalf("placed %v, expected the healthy locations", placed)
+	}
+}